@@ -0,0 +1,90 @@
+package botdetect
+
+import (
+	"strings"
+	"time"
+)
+
+// Severity is what happens to requests from a blacklisted IP
+type Severity string
+
+const (
+	// SeverityBlock blocks the requests, the default
+	SeverityBlock Severity = "block"
+
+	// SeverityChallenge lets the requests through once the client solved a
+	// challenge such as a CAPTCHA; it is up to the caller to present one
+	SeverityChallenge Severity = "challenge"
+)
+
+// ParseSeverity parses block or challenge
+func ParseSeverity(s string) (Severity, error) {
+	switch Severity(s) {
+	case SeverityBlock, SeverityChallenge:
+		return Severity(s), nil
+	}
+	return "", configErrorf("invalid severity '%s': expected %s or %s", s, SeverityBlock, SeverityChallenge)
+}
+
+// RuleAction is how long and how severely a rule blacklists an IP. The zero
+// value blocks for the blacklist TTL of the history.
+type RuleAction struct {
+	// TTL is how long the IP stays on the blacklist, the blacklist TTL of
+	// the history if zero
+	TTL time.Duration
+
+	// Severity is SeverityBlock if empty
+	Severity Severity
+}
+
+// String returns the options of the action as appended to a rule, e.g.
+// ";ttl=24h0m0s;severity=challenge", or an empty string for the zero value
+func (a RuleAction) String() string {
+	s := ""
+	if a.TTL > 0 {
+		s += ";ttl=" + a.TTL.String()
+	}
+	if a.Severity != "" && a.Severity != SeverityBlock {
+		s += ";severity=" + string(a.Severity)
+	}
+	return s
+}
+
+// parseRuleAction splits the options ttl=duration and severity=block|challenge,
+// separated by ';', from the end of a rule definition and returns the rule
+// without them
+func parseRuleAction(def string) (string, RuleAction, error) {
+	action := RuleAction{}
+
+	i := strings.IndexByte(def, ';')
+	if i < 0 {
+		return def, action, nil
+	}
+
+	for _, opt := range strings.Split(def[i+1:], ";") {
+		key, value := strings.TrimSpace(opt), ""
+		if j := strings.IndexByte(key, '='); j >= 0 {
+			key, value = strings.TrimSpace(key[:j]), strings.TrimSpace(key[j+1:])
+		}
+
+		switch key {
+		case "ttl":
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				return "", action, configErrorf("invalid ttl in rule '%s'", def)
+			}
+			action.TTL = ttl
+		case "severity":
+			severity, err := ParseSeverity(value)
+			if err != nil {
+				return "", action, configErrorf("rule '%s': %w", def, err)
+			}
+			action.Severity = severity
+		default:
+			return "", action, configErrorf("invalid option '%s' in rule '%s': expected ttl=duration or severity=%s|%s",
+				opt, def, SeverityBlock, SeverityChallenge)
+		}
+	}
+
+	return strings.TrimSpace(def[:i]), action, nil
+}
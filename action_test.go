@@ -0,0 +1,108 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRuleActions(t *testing.T) {
+	rules, err := ParseRules("1m:20:0.9;ttl=30m, 1h:300:0.85:200;severity=challenge;ttl=24h, 1h:300:0.85; severity=block")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []Rule{
+		{Window: time.Minute, MaxRequests: 20, MaxRatio: 0.9, RuleAction: RuleAction{TTL: 30 * time.Minute}},
+		{Window: time.Hour, MaxRequests: 300, MaxRatio: 0.85, WarnRequests: 200, WarnRatio: 0.85,
+			RuleAction: RuleAction{TTL: 24 * time.Hour, Severity: SeverityChallenge}},
+		{Window: time.Hour, MaxRequests: 300, MaxRatio: 0.85, RuleAction: RuleAction{Severity: SeverityBlock}},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("rule %d: expected %s, got %s", i, expected[i], rules[i])
+		}
+	}
+
+	for _, invalid := range []string{"1m:20:0.9;ttl=x", "1m:20:0.9;ttl=0s", "1m:20:0.9;severity=ban", "1m:20:0.9;color=red", "1m:20:0.9;"} {
+		if _, err := ParseRules(invalid); !errors.Is(err, ErrConfig) {
+			t.Errorf("expected a config error for '%s', got %v", invalid, err)
+		}
+	}
+}
+
+func TestRuleActionString(t *testing.T) {
+	for _, def := range []string{"1m0s:20:0.9;ttl=30m0s", "1h0m0s:300:0.85:200:0.5;ttl=24h0m0s;severity=challenge", "1m0s:20:0.9;severity=challenge"} {
+		rules, err := ParseRules(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rules[0].String() != def {
+			t.Errorf("expected %s, got %s", def, rules[0])
+		}
+	}
+
+	bandwidth, err := ParseBandwidthRules("1h:500MB;ttl=2h")
+	if err != nil || len(bandwidth) != 1 || bandwidth[0].TTL != 2*time.Hour || bandwidth[0].String() != "1h0m0s:500MB;ttl=2h0m0s" {
+		t.Errorf("unexpected bandwidth rules %v, %v", bandwidth, err)
+	}
+
+	cache, err := ParseCacheRules("10m:50:0.9;severity=challenge")
+	if err != nil || len(cache) != 1 || cache[0].Severity != SeverityChallenge || cache[0].String() != "10m0s:50:0.9;severity=challenge" {
+		t.Errorf("unexpected cache rules %v, %v", cache, err)
+	}
+}
+
+func TestRuleActionBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rules, err := ParseRules("1h:1:0.5;ttl=24h;severity=challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    30 * time.Minute,
+		Rules:           rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	for h.Processed() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	entry, ok := h.Blacklist().Entry(ip)
+	if !ok {
+		t.Fatal("expected the IP to be blacklisted")
+	}
+	if entry.Severity != SeverityChallenge {
+		t.Errorf("expected severity challenge, got '%s'", entry.Severity)
+	}
+	if ttl := time.Until(entry.Expires); ttl < 23*time.Hour {
+		t.Errorf("expected the rule's TTL of 24h, got %s", ttl)
+	}
+
+	// other reasons keep the TTL of the history
+	other := net.ParseIP("192.0.2.2")
+	h.Block(other, "login")
+	entry, ok = h.Blacklist().Entry(other)
+	if !ok || entry.Severity != "" || time.Until(entry.Expires) > 30*time.Minute {
+		t.Errorf("expected a block for the blacklist TTL, got %+v", entry)
+	}
+}
@@ -0,0 +1,144 @@
+package botdetect
+
+import (
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// NearLimit is the Score from which Annotations carry the near-limit flag
+const NearLimit = 0.8
+
+// Annotations describe where the IPs of a request stand with the rules, for
+// applications that make their own soft decisions about clients that aren't
+// blocked, e.g. hiding email addresses from suspicious ones
+type Annotations struct {
+	// Score is the largest share of the request limit of a rule that has
+	// been used up, 1 at the limit
+	Score float64 `json:"score"`
+
+	// Remaining is the number of app requests left within the limit of the
+	// rule closest to matching, or -1 if there are no rules
+	Remaining int64 `json:"remaining"`
+
+	// Limit is the number of app requests the rule closest to matching
+	// allows within its window, as scaled for the IPs
+	Limit uint64 `json:"limit"`
+
+	// Reset is when the oldest app request counted against the limit
+	// leaves the window, zero if there is none, see Quota
+	Reset time.Time `json:"reset,omitempty"`
+
+	// Rule is the rule closest to matching
+	Rule string `json:"rule,omitempty"`
+
+	// Flags are sorted suspicion flags: near-limit, warned, walking,
+	// datacenter, bad-reputation and unverified, as well as exempt and
+	// granted for IPs whose limits are lifted or raised
+	Flags []string `json:"flags,omitempty"`
+}
+
+// Annotate returns the annotations for a request from the IPs. The counts
+// are the local ones as of the last request that has been processed, the
+// limits are scaled by grants, UnverifiedFactor and reputations kept in a
+// MemoryReputationStore, but not by PTR patterns. Annotate doesn't record
+// anything, it is cheap enough to be called on every request.
+func (h *IPHistory) Annotate(ips ...net.IP) Annotations {
+	a := Annotations{Remaining: -1}
+	if h == nil {
+		return a
+	}
+
+	o := h.opts()
+	now := time.Now()
+	flags := map[string]bool{}
+
+	keys := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		keys = append(keys, ipKey(ip))
+	}
+	var reputations map[string]Reputation
+	if store := memoryReputations(h.opts().Reputation); store != nil {
+		reputations, _ = store.Fetch(h.ctx, keys)
+	}
+
+	rules := h.rulesAt(now)
+	for i, ip := range ips {
+		key := keys[i]
+
+		if h.isExempt(key, now) {
+			flags["exempt"] = true
+		}
+		ipRules := rules
+		if o.Datacenters.IsDatacenter(ip) {
+			flags["datacenter"] = true
+			ipRules = append(ipRules[:len(ipRules):len(ipRules)], o.DatacenterRules...)
+		}
+		grant, granted := h.grantFor(ip, now)
+		if granted {
+			flags["granted"] = true
+		}
+		reputation, reputed := h.reputationFactor(reputations, key, now)
+		if reputed && reputation < 1 {
+			flags["bad-reputation"] = true
+		}
+
+		h.mutex.RLock()
+		counts := h.data[key]
+		if _, ok := h.walkers[key]; ok {
+			flags["walking"] = true
+		}
+		unverified, tightened := h.unverifiedFactor(key, now)
+		if tightened {
+			flags["unverified"] = true
+		}
+		for _, rule := range ipRules {
+			cutoff := now.Add(-1 * rule.Window)
+			var total, app uint64
+			if counts != nil {
+				total, app = countSince(counts, cutoff)
+			}
+			effective := rule
+			if granted {
+				effective = scaleRule(effective, grant.Factor)
+			}
+			if reputed {
+				effective = scaleRule(effective, reputation)
+			}
+			if tightened {
+				effective = scaleRule(effective, unverified)
+			}
+			if effective.warns(total, app) {
+				flags["warned"] = true
+			}
+
+			remaining := int64(effective.MaxRequests) - int64(app)
+			if remaining < 0 {
+				remaining = 0
+			}
+			score := 1.0
+			if effective.MaxRequests > 0 {
+				score = float64(app) / float64(effective.MaxRequests)
+			}
+			if a.Rule == "" || score > a.Score || (score == a.Score && remaining < a.Remaining) {
+				a.Score, a.Remaining, a.Limit, a.Rule = score, remaining, effective.MaxRequests, rule.String()
+				a.Reset = time.Time{}
+				if oldest, ok := oldestAppSince(counts, cutoff); ok {
+					a.Reset = oldest.Add(rule.Window)
+				}
+			}
+		}
+		h.mutex.RUnlock()
+	}
+
+	a.Score = math.Round(a.Score*100) / 100
+	if a.Score >= NearLimit {
+		flags["near-limit"] = true
+	}
+	for flag := range flags {
+		a.Flags = append(a.Flags, flag)
+	}
+	sort.Strings(a.Flags)
+	return a
+}
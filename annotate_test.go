@@ -0,0 +1,65 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnnotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     10,
+		MaxRatio:        0.5,
+		WarnRequests:    5,
+		WarnRatio:       0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy, granted, idle := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), net.ParseIP("203.0.113.1")
+	if _, err := h.Grant("198.51.100.0/24", 10, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: busy}
+		h.RequestChannel() <- &Request{URL: "/", IP: granted}
+	}
+	for h.Processed() < 18 {
+		time.Sleep(time.Millisecond)
+	}
+
+	a := h.Annotate(busy)
+	if a.Score != 0.9 || a.Remaining != 1 || a.Rule != "1h0m0s:10:0.5:5:0.5" {
+		t.Errorf("unexpected annotations for a busy IP: %+v", a)
+	}
+	if !reflect.DeepEqual(a.Flags, []string{"near-limit", "warned"}) {
+		t.Errorf("expected the near-limit and warned flags, got %v", a.Flags)
+	}
+
+	if a := h.Annotate(granted); a.Score != 0.09 || a.Remaining != 91 || !reflect.DeepEqual(a.Flags, []string{"granted"}) {
+		t.Errorf("expected the grant to raise the limit, got %+v", a)
+	}
+	if a := h.Annotate(idle); a.Score != 0 || a.Remaining != 10 || a.Flags != nil {
+		t.Errorf("unexpected annotations for an idle IP: %+v", a)
+	}
+	if a := h.Annotate(idle, busy); a.Score != 0.9 || a.Remaining != 1 {
+		t.Errorf("expected the annotations of the busiest IP, got %+v", a)
+	}
+
+	var nilHistory *IPHistory
+	if a := nilHistory.Annotate(busy); a.Remaining != -1 {
+		t.Errorf("expected no annotations without a history, got %+v", a)
+	}
+}
@@ -0,0 +1,183 @@
+package botdetect
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// AnomalyOptions configures the detection of IPs whose request rate suddenly
+// deviates from their own history. Every IP gets a baseline, an exponentially
+// weighted mean and variance of its app requests per slot. A slot is anomalous
+// if it exceeds the mean by more than Threshold standard deviations and
+// contains at least MinRequests app requests.
+type AnomalyOptions struct {
+	// Alpha is the weight of the newest slot in the baseline (0 < Alpha <= 1)
+	Alpha       float64
+	Threshold   float64
+	MinRequests uint64
+
+	// Warmup is the number of slots a baseline needs before it is used
+	Warmup int
+
+	// TTL is how long the baseline of an IP is kept after its last slot once
+	// it has finished the warmup, so that it outlives the slots of the IP in
+	// the history. Zero drops baselines with the slots of their IP.
+	TTL time.Duration
+
+	// Blacklist adds anomalous IPs to the blacklist, otherwise they are only
+	// counted and recorded in the audit log
+	Blacklist bool
+}
+
+// baseline tracks the typical number of app requests per slot of an IP
+type baseline struct {
+	mean     float64
+	variance float64
+	slots    int
+	lastSlot time.Time
+}
+
+// update folds a completed slot into the baseline
+func (b *baseline) update(app uint64, alpha float64) {
+	x := float64(app)
+	if b.slots == 0 {
+		b.mean = x
+	} else {
+		diff := x - b.mean
+		incr := alpha * diff
+		b.mean += incr
+		b.variance = (1 - alpha) * (b.variance + diff*incr)
+	}
+	b.slots++
+}
+
+// skip folds the slots without requests between the last slot and until
+// into the baseline, so that the baseline of an IP that paused decays
+// towards zero. They don't count towards the warmup.
+func (b *baseline) skip(until time.Time, slot time.Duration, alpha float64) {
+	if b.slots == 0 || slot <= 0 {
+		return
+	}
+	empty := until.Sub(b.lastSlot)/slot - 1
+	if empty <= 0 {
+		return
+	}
+
+	// n updates with zero in one go: the mean shrinks by (1-alpha)^n, the
+	// variance to (1-alpha)^n * (variance + mean² * (1-(1-alpha)^n))
+	q := math.Pow(1-alpha, float64(empty))
+	b.variance = q * (b.variance + b.mean*b.mean*(1-q))
+	b.mean *= q
+	b.lastSlot = until.Add(-slot)
+}
+
+// isAnomalous determines whether the app requests deviate from the baseline
+func (b *baseline) isAnomalous(app uint64, opts *AnomalyOptions) bool {
+	if b.slots < opts.Warmup || app < opts.MinRequests {
+		return false
+	}
+	return float64(app) > b.mean+opts.Threshold*math.Sqrt(b.variance)
+}
+
+// detectAnomaly updates the baseline of the IP and checks the current slot
+// against it. The caller must hold h.mutex.
+func (h *IPHistory) detectAnomaly(ip string, counts *list.List) {
+	opts := h.opts().Anomaly
+	if opts == nil || counts.Len() == 0 {
+		return
+	}
+
+	b, ok := h.baselines[ip]
+	if !ok {
+		b = &baseline{}
+		h.baselines[ip] = b
+	}
+
+	// fold all slots completed since the last check into the baseline,
+	// oldest first
+	head := counts.Front().Value.(*IPHistoryItem)
+	completed := []*IPHistoryItem{}
+	for node := counts.Front().Next(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		if !hi.Timestamp.After(b.lastSlot) {
+			break
+		}
+		completed = append(completed, hi)
+	}
+	slot := h.opts().TimeSlot
+	for i := len(completed) - 1; i >= 0; i-- {
+		b.skip(completed[i].Timestamp, slot, opts.Alpha)
+		b.update(completed[i].App, opts.Alpha)
+		b.lastSlot = completed[i].Timestamp
+	}
+	b.skip(head.Timestamp, slot, opts.Alpha)
+
+	if !b.isAnomalous(head.App, opts) {
+		return
+	}
+
+	h.anomalies.Inc()
+	detail := fmt.Sprintf("%d app requests in the current slot, baseline %.1f±%.1f", head.App, b.mean, math.Sqrt(b.variance))
+	if opts.Blacklist {
+		h.block(net.ParseIP(ip), "anomaly", detail)
+		return
+	}
+	h.opts().Audit.Record(net.ParseIP(ip), AuditEntry{
+		Decision: "anomaly",
+		Reason:   detail,
+	})
+}
+
+// expireBaselines removes the baselines of IPs that are no longer in the
+// history and either haven't finished the warmup or had their last slot
+// more than the TTL ago. The caller must hold h.mutex.
+func (h *IPHistory) expireBaselines(opts *AnomalyOptions, now time.Time) {
+	for ip, b := range h.baselines {
+		if _, ok := h.data[ip]; ok {
+			continue
+		}
+		if opts != nil && opts.TTL > 0 && b.slots >= opts.Warmup && now.Sub(b.lastSlot) < opts.TTL {
+			continue
+		}
+		delete(h.baselines, ip)
+	}
+}
+
+// AnomalyBaseline is the baseline of an IP in a State
+type AnomalyBaseline struct {
+	Mean     float64   `json:"mean"`
+	Variance float64   `json:"variance"`
+	Slots    int       `json:"slots"`
+	LastSlot time.Time `json:"last_slot"`
+}
+
+// exportBaselines returns a copy of the baselines. The caller must hold
+// h.mutex.
+func (h *IPHistory) exportBaselines() map[string]AnomalyBaseline {
+	if len(h.baselines) == 0 {
+		return nil
+	}
+	baselines := make(map[string]AnomalyBaseline, len(h.baselines))
+	for ip, b := range h.baselines {
+		baselines[ip] = AnomalyBaseline{Mean: b.mean, Variance: b.variance, Slots: b.slots, LastSlot: b.lastSlot}
+	}
+	return baselines
+}
+
+// importBaselines replaces the baselines of the IPs with the saved ones; the
+// next expiry drops those that are too old. The caller must hold h.mutex.
+func (h *IPHistory) importBaselines(baselines map[string]AnomalyBaseline) {
+	if h.opts().Anomaly == nil {
+		return
+	}
+	for ip, b := range baselines {
+		addr, err := ParseCanonicalAddr(ip)
+		if err != nil {
+			continue
+		}
+		h.baselines[addr.String()] = &baseline{mean: b.Mean, variance: b.Variance, slots: b.Slots, lastSlot: b.LastSlot}
+	}
+}
@@ -0,0 +1,123 @@
+package botdetect
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			Anomaly: &AnomalyOptions{
+				Alpha:       0.3,
+				Threshold:   3,
+				MinRequests: 10,
+				Warmup:      5,
+				Blacklist:   true,
+			},
+		},
+		blacklist: NewBlacklist(ctx, time.Hour, time.Hour),
+		baselines: make(map[string]*baseline),
+		warned:    make(map[string]time.Time),
+	}
+
+	ip := "192.0.2.1"
+	counts := list.New()
+	start := time.Now().Truncate(time.Minute).Add(-time.Hour)
+
+	// a steady IP doing 4-6 app requests per minute
+	for i := 0; i < 20; i++ {
+		counts.PushFront(&IPHistoryItem{Timestamp: start.Add(time.Duration(i) * time.Minute), App: uint64(4 + i%3)})
+		h.detectAnomaly(ip, counts)
+	}
+	if h.blacklist.IsBlacklisted(net.ParseIP(ip)) {
+		t.Fatalf("steady traffic should not be anomalous")
+	}
+
+	// suddenly bursts
+	counts.PushFront(&IPHistoryItem{Timestamp: start.Add(20 * time.Minute), App: 60})
+	h.detectAnomaly(ip, counts)
+	if reason, ok := h.blacklist.Reason(net.ParseIP(ip)); !ok || reason != "anomaly" {
+		t.Errorf("a burst should be detected as an anomaly, got '%s', %v", reason, ok)
+	}
+}
+
+func TestAnomalyBaselineDecay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			TimeSlot: time.Minute,
+			Anomaly: &AnomalyOptions{
+				Alpha:       0.1,
+				Threshold:   3,
+				MinRequests: 10,
+				Warmup:      5,
+				Blacklist:   true,
+			},
+		},
+		blacklist: NewBlacklist(ctx, time.Hour, time.Hour),
+		baselines: make(map[string]*baseline),
+		warned:    make(map[string]time.Time),
+	}
+
+	ip := "192.0.2.1"
+	counts := list.New()
+	start := time.Now().Truncate(time.Minute).Add(-3 * time.Hour)
+
+	// a busy IP doing 50 app requests per minute
+	for i := 0; i < 20; i++ {
+		counts.PushFront(&IPHistoryItem{Timestamp: start.Add(time.Duration(i) * time.Minute), App: 50})
+		h.detectAnomaly(ip, counts)
+	}
+	// the last slot of the 20 is folded in with the next one
+	warm := h.baselines[ip].slots
+
+	// that pauses for two hours and comes back with a burst that would have
+	// been below the old baseline
+	counts.PushFront(&IPHistoryItem{Timestamp: start.Add(140 * time.Minute), App: 40})
+	h.detectAnomaly(ip, counts)
+	if b := h.baselines[ip]; b.mean > 1 || b.slots != warm+1 || !b.lastSlot.Equal(start.Add(139*time.Minute)) {
+		t.Errorf("expected the baseline to decay over the pause without counting it, got %+v", *b)
+	}
+	if !h.blacklist.IsBlacklisted(net.ParseIP(ip)) {
+		t.Error("expected the burst after the pause to be anomalous")
+	}
+}
+
+func TestAnomalyBaselineTTL(t *testing.T) {
+	now := time.Now()
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			Anomaly: &AnomalyOptions{Alpha: 0.1, Threshold: 3, Warmup: 5, TTL: 24 * time.Hour},
+		},
+		data: map[string]*list.List{"192.0.2.1": list.New()},
+		baselines: map[string]*baseline{
+			"192.0.2.1": {slots: 1, lastSlot: now.Add(-48 * time.Hour)},
+			"192.0.2.2": {slots: 5, lastSlot: now.Add(-time.Hour)},
+			"192.0.2.3": {slots: 5, lastSlot: now.Add(-25 * time.Hour)},
+			"192.0.2.4": {slots: 4, lastSlot: now.Add(-time.Hour)},
+		},
+	}
+
+	h.expireBaselines(h.opts().Anomaly, now)
+	for ip, kept := range map[string]bool{"192.0.2.1": true, "192.0.2.2": true, "192.0.2.3": false, "192.0.2.4": false} {
+		if _, ok := h.baselines[ip]; ok != kept {
+			t.Errorf("%s: expected the baseline to be kept %v, got %v", ip, kept, ok)
+		}
+	}
+
+	// the baselines survive a restart
+	restored := &IPHistory{options: h.options, baselines: make(map[string]*baseline)}
+	restored.importBaselines(h.exportBaselines())
+	if b := restored.baselines["192.0.2.2"]; b == nil || *b != *h.baselines["192.0.2.2"] {
+		t.Errorf("expected the baseline to be restored, got %+v", b)
+	}
+}
@@ -0,0 +1,113 @@
+package botdetect
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ASN is an autonomous system, the network operator an IP is routed by
+type ASN struct {
+	Number uint32
+	Name   string
+}
+
+// String returns the number of the autonomous system, e.g. AS64496
+func (a ASN) String() string {
+	return "AS" + strconv.FormatUint(uint64(a.Number), 10)
+}
+
+// ASNList maps IPs to the autonomous systems announcing their networks, e.g.
+// to see which operators the blocked traffic comes from
+type ASNList struct {
+	table rangeTable
+	asns  []ASN
+}
+
+// LoadASNList reads an ASNList from a file
+func LoadASNList(path string) (*ASNList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	defer f.Close()
+
+	al, err := ReadASNList(f)
+	if err != nil {
+		return nil, configErrorf("%s: %w", path, err)
+	}
+	return al, nil
+}
+
+// ReadASNList reads an ASNList in CSV format with the columns network
+// (CIDR), the number of the autonomous system, with or without the prefix
+// AS, and an optional name. Lines starting with '#' are ignored.
+func ReadASNList(r io.Reader) (*ASNList, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	al := &ASNList{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, configError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, configErrorf("line %d: invalid network '%s'", line, record[0])
+		}
+		if len(record) < 2 {
+			return nil, configErrorf("line %d: missing AS number", line)
+		}
+		number := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(record[1])), "AS")
+		n, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return nil, configErrorf("line %d: invalid AS number '%s'", line, record[1])
+		}
+
+		asn := ASN{Number: uint32(n)}
+		if len(record) > 2 {
+			asn.Name = record[2]
+		}
+
+		al.table.add(prefix, len(al.asns))
+		al.asns = append(al.asns, asn)
+	}
+	al.table.sort()
+
+	return al, nil
+}
+
+// Lookup returns the autonomous system the IP belongs to
+func (al *ASNList) Lookup(ip net.IP) (ASN, bool) {
+	if al == nil {
+		return ASN{}, false
+	}
+
+	addr, ok := addrFromIP(ip)
+	if !ok {
+		return ASN{}, false
+	}
+
+	i, ok := al.table.lookup(addr)
+	if !ok {
+		return ASN{}, false
+	}
+	return al.asns[i], true
+}
+
+// Size returns the number of networks in the list
+func (al *ASNList) Size() int {
+	return al.table.len()
+}
@@ -0,0 +1,40 @@
+package botdetect
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestASNList(t *testing.T) {
+	al, err := ReadASNList(strings.NewReader(`
+# network,asn,name
+203.0.113.0/24,AS64496,Example Hosting
+2001:db8:100::/48,64497
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if asn, ok := al.Lookup(net.ParseIP("203.0.113.20")); !ok || asn.String() != "AS64496" || asn.Name != "Example Hosting" {
+		t.Errorf("expected 203.0.113.20 to belong to AS64496, got %+v, %v", asn, ok)
+	}
+	if asn, ok := al.Lookup(net.ParseIP("2001:db8:100::1")); !ok || asn.Number != 64497 {
+		t.Errorf("expected 2001:db8:100::1 to belong to AS64497, got %+v, %v", asn, ok)
+	}
+	if _, ok := al.Lookup(net.ParseIP("192.0.2.1")); ok {
+		t.Error("192.0.2.1 should not belong to any AS")
+	}
+
+	var nilList *ASNList
+	if _, ok := nilList.Lookup(net.ParseIP("203.0.113.20")); ok {
+		t.Error("a nil list should not map any IP")
+	}
+
+	for _, list := range []string{"203.0.113.0/24", "203.0.113.0/24,ASX", "203.0.113.0/33,1"} {
+		if _, err := ReadASNList(strings.NewReader(list)); !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected a configuration error, got %v", list, err)
+		}
+	}
+}
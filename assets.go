@@ -0,0 +1,90 @@
+package botdetect
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DefaultAssetTypes are the media types of responses counted as assets
+// unless IPHistoryOptions.AssetTypes is set
+var DefaultAssetTypes = []string{
+	"image/*",
+	"font/*",
+	"audio/*",
+	"video/*",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/font-woff",
+	"application/font-woff2",
+	"application/vnd.ms-fontobject",
+	"application/wasm",
+}
+
+// DefaultAssetURLs matches the URLs of assets unless
+// IPHistoryOptions.AssetURLs is set
+var DefaultAssetURLs = regexp.MustCompile(`\.(jpg|png|css|js|gif|ico)`)
+
+// ParseAssetTypes parses a comma separated list of media types, each either
+// type/subtype or type/*, e.g. "image/*,text/css"
+func ParseAssetTypes(s string) ([]string, error) {
+	types := []string{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if err := checkAssetType(t); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+func checkAssetType(t string) error {
+	parts := strings.Split(t, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" || strings.ContainsAny(t, "; ") {
+		return configErrorf("invalid asset type '%s': expected type/subtype or type/*", t)
+	}
+	return nil
+}
+
+// isAssetType determines whether the media type of a Content-Type header
+// matches one of the types. Parameters such as the charset are ignored.
+func isAssetType(types []string, contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	slash := strings.IndexByte(contentType, '/')
+	if slash <= 0 {
+		return false
+	}
+
+	for _, t := range types {
+		if strings.HasSuffix(t, "/*") {
+			if len(t)-1 == slash+1 && strings.EqualFold(t[:slash+1], contentType[:slash+1]) {
+				return true
+			}
+		} else if strings.EqualFold(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// documentDests are the values of Sec-Fetch-Dest of navigations, which load a
+// document rather than calling an API or fetching a subresource
+var documentDests = map[string]bool{
+	"document": true,
+	"iframe":   true,
+	"frame":    true,
+}
+
+// isDocument determines whether a request with the Sec-Fetch-Dest loads a
+// document
+func isDocument(dest string) bool {
+	return documentDests[strings.ToLower(strings.TrimSpace(dest))]
+}
@@ -0,0 +1,93 @@
+package botdetect
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestParseAssetTypes(t *testing.T) {
+	types, err := ParseAssetTypes(" Image/*, text/css ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0] != "image/*" || types[1] != "text/css" {
+		t.Errorf("unexpected types %v", types)
+	}
+
+	for _, s := range []string{"image", "*/*", "text/", "text/html; charset=utf-8", "a/b/c"} {
+		if _, err := ParseAssetTypes(s); !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected a configuration error, got %v", s, err)
+		}
+	}
+}
+
+func TestIsAsset(t *testing.T) {
+	h := &IPHistory{options: &IPHistoryOptions{}}
+
+	for _, test := range []struct {
+		req   Request
+		asset bool
+	}{
+		{Request{URL: "/logo.png"}, true},
+		{Request{URL: "/page"}, false},
+		// the content type beats the URL
+		{Request{URL: "/data.json", ContentType: "text/html; charset=utf-8"}, false},
+		{Request{URL: "/image?id=1", ContentType: "image/webp"}, true},
+		{Request{URL: "/app.js", ContentType: "Application/JavaScript"}, true},
+		{Request{URL: "/fonts/a", ContentType: "font/woff2"}, true},
+		{Request{URL: "/x", ContentType: "imagex/png"}, false},
+		{Request{URL: "/x", ContentType: "garbage"}, false},
+		// no content type logged
+		{Request{URL: "/logo.png", ContentType: "-"}, true},
+	} {
+		if asset := h.isAsset(&test.req); asset != test.asset {
+			t.Errorf("%s %s: expected asset %v", test.req.URL, test.req.ContentType, test.asset)
+		}
+	}
+
+	h.options.AssetTypes = []string{"application/pdf"}
+	if h.isAsset(&Request{URL: "/a.png", ContentType: "image/png"}) || !h.isAsset(&Request{URL: "/a", ContentType: "application/pdf"}) {
+		t.Error("expected the configured types to replace the defaults")
+	}
+
+	h.options.AssetURLs = regexp.MustCompile(`\.pdf$`)
+	if h.isAsset(&Request{URL: "/logo.png"}) || !h.isAsset(&Request{URL: "/terms.pdf", ContentType: "-"}) {
+		t.Error("expected the configured URLs to replace the defaults")
+	}
+}
+
+func TestIsAssetSPA(t *testing.T) {
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			APIPaths:      []string{"/api/*", "/graphql"},
+			FetchMetadata: true,
+		},
+	}
+
+	for _, test := range []struct {
+		req   Request
+		asset bool
+	}{
+		{Request{URL: "/products", FetchDest: "document"}, false},
+		{Request{URL: "/embed", FetchDest: "IFrame"}, false},
+		// fetch and XHR calls have an empty destination
+		{Request{URL: "/products.json", FetchDest: "empty"}, true},
+		{Request{URL: "/logo", FetchDest: "image"}, true},
+		// the destination beats the API paths
+		{Request{URL: "/api/export", FetchDest: "document"}, false},
+		// without Sec-Fetch-Dest
+		{Request{URL: "/api/products?page=2"}, true},
+		{Request{URL: "/graphql", ContentType: "application/json"}, true},
+		{Request{URL: "/products"}, false},
+	} {
+		if asset := h.isAsset(&test.req); asset != test.asset {
+			t.Errorf("%s %s: expected asset %v", test.req.URL, test.req.FetchDest, test.asset)
+		}
+	}
+
+	h.options.FetchMetadata = false
+	if h.isAsset(&Request{URL: "/products", FetchDest: "empty"}) {
+		t.Error("expected Sec-Fetch-Dest to be ignored without FetchMetadata")
+	}
+}
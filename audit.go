@@ -0,0 +1,266 @@
+package botdetect
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a decision made about an IP or a change of its
+// blacklist entry. Decisions about requests, the entries with a URL,
+// repeated with the same reason are merged into the first one, which counts
+// them in Count and keeps the time and URL of the last one in Last and URL.
+type AuditEntry struct {
+	Time     time.Time    `json:"time"`
+	Decision string       `json:"decision"`
+	Reason   string       `json:"reason"`
+	URL      string       `json:"url,omitempty"`
+	Values   *AuditValues `json:"values,omitempty"`
+	Expires  time.Time    `json:"expires,omitempty"`
+	Count    int          `json:"count,omitempty"`
+	Last     time.Time    `json:"last,omitempty"`
+}
+
+// AuditValues are the values a rule matched with
+type AuditValues struct {
+	Window   string  `json:"window,omitempty"`
+	Requests uint64  `json:"requests,omitempty"`
+	App      uint64  `json:"app,omitempty"`
+	Ratio    float64 `json:"ratio,omitempty"`
+	Bytes    uint64  `json:"bytes,omitempty"`
+	Misses   uint64  `json:"misses,omitempty"`
+}
+
+// AuditBlacklistAdded is the decision AuditLog.Follow records when an IP is
+// added to the blacklist; removals are recorded as "blacklist " and the
+// cause, e.g. "blacklist expired"
+const AuditBlacklistAdded = "blacklist added"
+
+// AuditLog keeps the most recent entries per IP so that operators can find
+// out why an IP has been blocked. It holds at most perIP entries for each of
+// at most maxIPs IPs; the IP that was added first is dropped first, unless
+// it is blacklisted according to Follow.
+type AuditLog struct {
+	perIP  int
+	maxIPs int
+
+	entries     map[string][]AuditEntry
+	order       []string
+	blacklisted map[string]bool
+	mutex       sync.RWMutex
+}
+
+// NewAuditLog creates a new AuditLog
+func NewAuditLog(perIP, maxIPs int) *AuditLog {
+	return &AuditLog{
+		perIP:       perIP,
+		maxIPs:      maxIPs,
+		entries:     make(map[string][]AuditEntry),
+		blacklisted: make(map[string]bool),
+	}
+}
+
+// Record adds an entry for the IP
+func (al *AuditLog) Record(ip net.IP, entry AuditEntry) {
+	if al == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.record(ipKey(ip), entry)
+}
+
+// record adds the entry. al.mutex must be held.
+func (al *AuditLog) record(ipstr string, entry AuditEntry) {
+	entries, exists := al.entries[ipstr]
+	if !exists {
+		if len(al.order) >= al.maxIPs {
+			al.evict()
+		}
+		al.order = append(al.order, ipstr)
+	}
+
+	if n := len(entries); n > 0 && entry.URL != "" {
+		last := &entries[n-1]
+		if last.URL != "" && last.Decision == entry.Decision && last.Reason == entry.Reason {
+			if last.Count == 0 {
+				last.Count = 1
+			}
+			last.Count++
+			last.Last = entry.Time
+			last.URL = entry.URL
+			return
+		}
+	}
+
+	entries = append(entries, entry)
+	if len(entries) > al.perIP {
+		entries = entries[len(entries)-al.perIP:]
+	}
+	al.entries[ipstr] = entries
+}
+
+// evict drops the IP added first that isn't blacklisted, or the one added
+// first if all of them are. al.mutex must be held.
+func (al *AuditLog) evict() {
+	if len(al.order) == 0 {
+		return
+	}
+	i := 0
+	for i < len(al.order) && al.blacklisted[al.order[i]] {
+		i++
+	}
+	if i == len(al.order) {
+		i = 0
+	}
+	delete(al.entries, al.order[i])
+	al.order = append(al.order[:i], al.order[i+1:]...)
+}
+
+// Entries returns a copy of the entries recorded for the IP, oldest first
+func (al *AuditLog) Entries(ip net.IP) []AuditEntry {
+	if al == nil {
+		return nil
+	}
+
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+
+	entries := al.entries[ipKey(ip)]
+	out := make([]AuditEntry, len(entries))
+	copy(out, entries)
+	return out
+}
+
+// Follow records every change of the blacklist, additions, expiries,
+// evictions and removals, and keeps the trails of blacklisted IPs when others
+// have to make room, until the context is done
+func (al *AuditLog) Follow(ctx context.Context, bl *Blacklist) {
+	if al == nil {
+		return
+	}
+
+	for {
+		entries, events, cancel := bl.Subscribe(1024)
+
+		al.mutex.Lock()
+		al.blacklisted = make(map[string]bool, len(entries))
+		for _, e := range entries {
+			al.blacklisted[ipKey(e.IP)] = true
+		}
+		al.mutex.Unlock()
+
+		if !al.follow(ctx, events) {
+			cancel()
+			return
+		}
+		// fell behind, subscribe again for a consistent copy
+	}
+}
+
+// follow records the events until the channel is closed or the context is
+// done, which it returns false for
+func (al *AuditLog) follow(ctx context.Context, events <-chan BlacklistEvent) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ev, ok := <-events:
+			if !ok {
+				return true
+			}
+			al.event(ev, time.Now())
+		}
+	}
+}
+
+func (al *AuditLog) event(ev BlacklistEvent, now time.Time) {
+	ipstr := ipKey(ev.IP)
+	entry := AuditEntry{Time: now, Reason: ev.Reason}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	switch ev.Type {
+	case BlacklistAdd:
+		entry.Decision = AuditBlacklistAdded
+		entry.Expires = ev.Expires
+		al.blacklisted[ipstr] = true
+	case BlacklistRemove:
+		entry.Decision = "blacklist " + ev.Cause
+		delete(al.blacklisted, ipstr)
+	default:
+		return
+	}
+	al.record(ipstr, entry)
+}
+
+// AuditRecord is the trail of an IP as exported by Export
+type AuditRecord struct {
+	IP      string       `json:"ip"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// Export returns the trails of all IPs, the one added first first, e.g. to
+// persist them across restarts
+func (al *AuditLog) Export() []AuditRecord {
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+
+	records := make([]AuditRecord, 0, len(al.order))
+	for _, ipstr := range al.order {
+		entries := make([]AuditEntry, len(al.entries[ipstr]))
+		copy(entries, al.entries[ipstr])
+		records = append(records, AuditRecord{IP: ipstr, Entries: entries})
+	}
+	return records
+}
+
+// Import adds exported trails before the entries recorded since, within the
+// limits of the log
+func (al *AuditLog) Import(records []AuditRecord) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	for _, rec := range records {
+		ip := net.ParseIP(rec.IP)
+		if ip == nil {
+			continue
+		}
+		ipstr := ipKey(ip)
+
+		entries := append(append([]AuditEntry{}, rec.Entries...), al.entries[ipstr]...)
+		if len(entries) > al.perIP {
+			entries = entries[len(entries)-al.perIP:]
+		}
+		if _, exists := al.entries[ipstr]; !exists {
+			if len(al.order) >= al.maxIPs {
+				al.evict()
+			}
+			al.order = append(al.order, ipstr)
+		}
+		al.entries[ipstr] = entries
+	}
+}
+
+// Write writes the exported trails as JSON
+func (al *AuditLog) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(al.Export())
+}
+
+// Read imports trails written by Write
+func (al *AuditLog) Read(r io.Reader) error {
+	var records []AuditRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return configErrorf("invalid audit trail: %s", err)
+	}
+	al.Import(records)
+	return nil
+}
@@ -0,0 +1,156 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	al := NewAuditLog(2, 2)
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+	ip3 := net.ParseIP("192.0.2.3")
+
+	al.Record(ip1, AuditEntry{Decision: "OK"})
+	al.Record(ip1, AuditEntry{Decision: "OK"})
+	al.Record(ip1, AuditEntry{Decision: "BLOCK", Reason: "blacklisted"})
+
+	entries := al.Entries(ip1)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[1].Decision != "BLOCK" || entries[1].Time.IsZero() {
+		t.Errorf("expected the latest entry to be a timestamped BLOCK, got %+v", entries[1])
+	}
+
+	al.Record(ip2, AuditEntry{Decision: "OK"})
+	al.Record(ip3, AuditEntry{Decision: "OK"})
+	if len(al.Entries(ip1)) != 0 {
+		t.Errorf("the first IP should have been dropped")
+	}
+	if len(al.Entries(ip3)) != 1 {
+		t.Errorf("expected 1 entry for %s", ip3)
+	}
+}
+
+func TestAuditLogBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	blocked := net.ParseIP("192.0.2.1")
+	bl.SetReason(blocked, "rule 1m:10:0.5")
+
+	al := NewAuditLog(5, 2)
+	done := make(chan struct{})
+	go func() {
+		al.Follow(ctx, bl)
+		close(done)
+	}()
+	for bl.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// repeated decisions are merged
+	for i := 0; i < 3; i++ {
+		al.Record(blocked, AuditEntry{Decision: "BLOCK", Reason: "blacklisted by rule 1m:10:0.5", URL: "/"})
+	}
+
+	// the removal and the addition are recorded
+	bl.Remove(blocked)
+	bl.SetReason(blocked, "rule 1h:100:0.5")
+	expected := []string{"BLOCK", "blacklist removed", AuditBlacklistAdded}
+	for start := time.Now(); len(al.Entries(blocked)) < len(expected) && time.Since(start) < 5*time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	entries := al.Entries(blocked)
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), entries)
+	}
+	for i, decision := range expected {
+		if entries[i].Decision != decision {
+			t.Errorf("entry %d: expected %s, got %s", i, decision, entries[i].Decision)
+		}
+	}
+	if entries[0].Count != 3 || entries[2].Expires.IsZero() {
+		t.Errorf("expected 3 merged decisions and the expiry of the addition, got %+v", entries)
+	}
+
+	// the blacklisted IP outlasts the ones added after it
+	for i := 2; i < 5; i++ {
+		al.Record(net.IPv4(198, 51, 100, byte(i)), AuditEntry{Decision: "would-block"})
+	}
+	if len(al.Entries(blocked)) == 0 {
+		t.Error("expected the trail of the blacklisted IP to be kept")
+	}
+	if len(al.Entries(net.ParseIP("198.51.100.3"))) != 0 || len(al.Entries(net.ParseIP("198.51.100.4"))) != 1 {
+		t.Error("expected the IP recorded first that isn't blacklisted to be dropped")
+	}
+
+	// the trail survives a restart
+	var buf bytes.Buffer
+	if err := al.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewAuditLog(5, 2)
+	restored.Record(blocked, AuditEntry{Decision: "BLOCK", Reason: "after the restart"})
+	if err := restored.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if entries := restored.Entries(blocked); len(entries) != 4 || entries[3].Reason != "after the restart" {
+		t.Errorf("expected the restored entries before the new one, got %+v", entries)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestAuditLogBlacklistedOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	al := NewAuditLog(10, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Hour,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    2,
+		MaxRatio:       0.5,
+		Audit:          al,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the IP keeps requesting while it is blacklisted
+	ip := net.ParseIP("192.0.2.1")
+	processed := uint64(0)
+	for i := 0; i < 15; i++ {
+		for j := 0; j < 5; j++ {
+			h.RequestChannel() <- &Request{IP: ip, URL: "/"}
+		}
+		processed += 5
+		for h.Processed() < processed {
+			time.Sleep(time.Millisecond)
+		}
+		h.TriggerCalculate()
+	}
+
+	blacklisted := 0
+	for _, entry := range al.Entries(ip) {
+		if entry.Decision == "blacklisted" {
+			blacklisted++
+			if entry.Values == nil || entry.Values.App != 5 {
+				t.Errorf("expected the values of the first match, got %+v", entry.Values)
+			}
+		}
+	}
+	if blacklisted != 1 {
+		t.Errorf("expected exactly one blacklisted entry, got %d in %+v", blacklisted, al.Entries(ip))
+	}
+}
@@ -0,0 +1,116 @@
+package botdetect
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BandwidthRule blacklists an IP that received more than MaxBytes within
+// Window, catching bots that download a lot with few requests
+type BandwidthRule struct {
+	Window   time.Duration
+	MaxBytes uint64
+
+	RuleAction
+}
+
+// byteUnits are the units understood by ParseBytes, largest first
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"B", 1},
+}
+
+// ParseBytes parses a size such as "500MB", "1.5GiB" or "1048576"
+func ParseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-len(unit.suffix)]), 64)
+			if err != nil || n < 0 {
+				return 0, configErrorf("invalid size '%s'", s)
+			}
+			return uint64(n * float64(unit.size)), nil
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, configErrorf("invalid size '%s'", s)
+	}
+	return n, nil
+}
+
+// FormatBytes formats a size in the largest unit that represents it exactly
+func FormatBytes(n uint64) string {
+	if n == 0 {
+		return "0B"
+	}
+	for _, unit := range byteUnits {
+		if n%unit.size == 0 {
+			return strconv.FormatUint(n/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10) + "B"
+}
+
+// String returns the rule in the format understood by ParseBandwidthRules
+func (r BandwidthRule) String() string {
+	return fmt.Sprintf("%s:%s", r.Window, FormatBytes(r.MaxBytes)) + r.RuleAction.String()
+}
+
+// ParseBandwidthRules parses a comma separated list of rules in the form
+// window:max-bytes, e.g. "1h:500MB,24h:5GB;ttl=24h". The options are those of
+// ParseRules.
+func ParseBandwidthRules(s string) ([]BandwidthRule, error) {
+	rules := []BandwidthRule{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		base, action, err := parseRuleAction(def)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Split(base, ":")
+		if len(fields) != 2 {
+			return nil, configErrorf("invalid bandwidth rule '%s': expected window:max-bytes", def)
+		}
+
+		window, err := time.ParseDuration(fields[0])
+		if err != nil || window <= 0 {
+			return nil, configErrorf("invalid window in bandwidth rule '%s'", def)
+		}
+
+		maxBytes, err := ParseBytes(fields[1])
+		if err != nil || maxBytes == 0 {
+			return nil, configErrorf("invalid max-bytes in bandwidth rule '%s'", def)
+		}
+
+		rules = append(rules, BandwidthRule{Window: window, MaxBytes: maxBytes, RuleAction: action})
+	}
+
+	return rules, nil
+}
+
+// bytesSince sums up the bytes of all items newer than cutoff
+func bytesSince(counts *list.List, cutoff time.Time) (bytes uint64) {
+	for node := counts.Front(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		if !hi.Timestamp.After(cutoff) {
+			break
+		}
+		bytes += hi.Bytes
+	}
+	return bytes
+}
@@ -0,0 +1,95 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1048576": 1 << 20,
+		"500MB":   500e6,
+		"1.5GiB":  3 << 29,
+		"2 KB":    2000,
+		"10B":     10,
+	} {
+		n, err := ParseBytes(s)
+		if err != nil || n != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", s, expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1MB", "1XB"} {
+		if _, err := ParseBytes(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+
+	for n, expected := range map[uint64]string{0: "0B", 500e6: "500MB", 1 << 30: "1GiB", 1500: "1500B", 1001: "1001B"} {
+		if s := FormatBytes(n); s != expected {
+			t.Errorf("%d: expected %s, got %s", n, expected, s)
+		}
+	}
+}
+
+func TestParseBandwidthRules(t *testing.T) {
+	rules, err := ParseBandwidthRules("1h:500MB, 24h:5GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].String() != "1h0m0s:500MB" || rules[1].MaxBytes != 5e9 {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	for _, s := range []string{"1h", "1h:0", "0s:1MB", "1h:1MB:2"} {
+		if _, err := ParseBandwidthRules(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+}
+
+func TestBandwidthRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rules, _ := ParseBandwidthRules("1h:1MB")
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		BandwidthRules:  rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDecider(h.RequestChannel(), h.Blacklist(), &DeciderOptions{IncludePrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(net.IP) (bool, string) { return false, "" }
+
+	// few requests with large responses
+	for i := 0; i < 3; i++ {
+		d.Decide(&Input{Remote: "192.0.2.1", URL: "/video", Bytes: "400000"}, check)
+	}
+	// many requests with small or no responses
+	for i := 0; i < 20; i++ {
+		d.Decide(&Input{Remote: "192.0.2.2", URL: "/", Bytes: "-"}, check)
+		d.Decide(&Input{Remote: "192.0.2.2", URL: "/", Bytes: "1000"}, check)
+	}
+	for h.Processed() < 43 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if !h.IsBlacklisted(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the IP exceeding the bandwidth to be blacklisted")
+	}
+	if h.IsBlacklisted(net.ParseIP("192.0.2.2")) {
+		t.Error("expected the IP below the bandwidth not to be blacklisted")
+	}
+}
@@ -0,0 +1,215 @@
+package bench
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// budgets are generous upper limits, several times what a laptop achieves,
+// so that only real regressions fail
+const (
+	ingestBudget    = 5 * time.Microsecond  // per request
+	decideBudget    = 10 * time.Microsecond // per input line
+	lookupBudget    = 2 * time.Microsecond  // per blacklist lookup
+	calculateBudget = 5 * time.Microsecond  // per tracked IP
+	memoryBudget    = 2048                  // bytes per tracked IP
+)
+
+func newHistory(tb testing.TB, ctx context.Context) *botdetect.IPHistory {
+	h, err := botdetect.NewIPHistory(ctx, &botdetect.IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1000,
+		MaxRatio:        0.9,
+		QueueSize:       10000,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return h
+}
+
+// waitProcessed waits until the history has processed n requests
+func waitProcessed(h *botdetect.IPHistory, n uint64) {
+	for h.Processed() < n {
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+// BenchmarkIngest measures how fast requests are counted
+func BenchmarkIngest(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHistory(b, ctx)
+	reqs := NewTraffic(TrafficOptions{Seed: 1}).Requests(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		h.Report(reqs[i%len(reqs)])
+	}
+	waitProcessed(h, uint64(b.N))
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+// BenchmarkDecide measures the whole path of an input line: parsing,
+// attribution, the blacklist lookup and handing the request to the history
+func BenchmarkDecide(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHistory(b, ctx)
+	d, err := botdetect.NewDecider(h.RequestChannel(), h.Blacklist(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	format, _ := botdetect.ParseInputFormat(botdetect.DefaultInputFormat)
+	lines := NewTraffic(TrafficOptions{Seed: 2}).Lines(100000)
+	in := &botdetect.Input{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := format.ParseInto(lines[i%len(lines)], in); err != nil {
+			b.Fatal(err)
+		}
+		d.CheckInput(in)
+	}
+	waitProcessed(h, uint64(b.N))
+}
+
+// BenchmarkIsBlacklisted measures the latency of blacklist lookups with
+// 100000 blacklisted IPs, half of the lookups being hits
+func BenchmarkIsBlacklisted(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := botdetect.NewBlacklist(ctx, time.Hour, time.Hour)
+	for i := 0; i < 100000; i++ {
+		bl.SetReason(IP(2*i), "bench")
+	}
+	ips := make([]botdetect.BlacklistEntry, 200000)
+	for i := range ips {
+		ips[i].IP = IP(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			bl.IsBlacklisted(ips[i*7919%len(ips)].IP)
+		}
+	})
+}
+
+// BenchmarkCalculate measures a run of the rules over 10000 tracked IPs that
+// all made requests since the last run
+func BenchmarkCalculate(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHistory(b, ctx)
+	reqs := NewTraffic(TrafficOptions{IPs: 10000, Skew: 1.01, Seed: 3}).Requests(200000)
+	for _, req := range reqs {
+		h.Report(req)
+	}
+	n := uint64(len(reqs))
+	waitProcessed(h, n)
+	ips := h.NumIPs()
+
+	var elapsed time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// only IPs with new requests are evaluated
+		b.StopTimer()
+		for j := 0; j < ips; j++ {
+			h.Report(&botdetect.Request{IP: IP(j), URL: "/"})
+		}
+		n += uint64(ips)
+		waitProcessed(h, n)
+		b.StartTimer()
+
+		start := time.Now()
+		h.TriggerCalculate()
+		elapsed += time.Since(start)
+	}
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N)/float64(ips), "ns/ip")
+}
+
+// memoryPerIP returns the heap the history needs per tracked IP
+func memoryPerIP(tb testing.TB, ips int) float64 {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	h := newHistory(tb, ctx)
+	n := 0
+	for i := 0; i < ips; i++ {
+		for _, url := range []string{"/", "/static/app.js", "/static/style.css"} {
+			h.Report(&botdetect.Request{IP: IP(i), URL: url})
+			n++
+		}
+	}
+	waitProcessed(h, uint64(n))
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(h)
+	return float64(after.HeapAlloc-before.HeapAlloc) / float64(h.NumIPs())
+}
+
+func BenchmarkMemoryPerIP(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.ReportMetric(memoryPerIP(b, 50000), "B/ip")
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("performance budgets need full runs without the race detector")
+	}
+
+	for _, bm := range []struct {
+		name   string
+		fn     func(b *testing.B)
+		metric func(r testing.BenchmarkResult) time.Duration
+		budget time.Duration
+	}{
+		{"ingest", BenchmarkIngest, perOp, ingestBudget},
+		{"decide", BenchmarkDecide, perOp, decideBudget},
+		{"lookup", BenchmarkIsBlacklisted, perOp, lookupBudget},
+		{"calculate", BenchmarkCalculate, func(r testing.BenchmarkResult) time.Duration {
+			return time.Duration(r.Extra["ns/ip"])
+		}, calculateBudget},
+	} {
+		r := testing.Benchmark(bm.fn)
+		got := bm.metric(r)
+		t.Logf("%s: %s (budget %s)", bm.name, got, bm.budget)
+		if got > bm.budget {
+			t.Errorf("%s takes %s, more than the budget of %s", bm.name, got, bm.budget)
+		}
+	}
+
+	perIP := memoryPerIP(t, 50000)
+	t.Logf("memory: %.0f B per IP (budget %d)", perIP, memoryBudget)
+	if perIP > memoryBudget {
+		t.Errorf("the history needs %.0f bytes per IP, more than the budget of %d", perIP, memoryBudget)
+	}
+}
+
+func perOp(r testing.BenchmarkResult) time.Duration {
+	return time.Duration(r.NsPerOp())
+}
@@ -0,0 +1,10 @@
+// Package bench benchmarks botdetect with realistic traffic: a few IPs make
+// most of the requests (Zipf distribution), humans fetch pages together with
+// their assets and bots fetch pages only. Run the benchmarks with
+//
+//	go test -run xxx -bench . -benchmem ./bench
+//
+// The tests check the results against performance budgets, so a change that
+// makes ingest, lookups or memory per IP considerably worse fails. They are
+// skipped with -short and under the race detector, which distorts timings.
+package bench
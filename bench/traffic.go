@@ -0,0 +1,124 @@
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/elcamino/botdetect"
+)
+
+// TrafficOptions describes the generated traffic. Zero values take the
+// defaults.
+type TrafficOptions struct {
+	// IPs is the number of distinct client IPs, 10000 by default
+	IPs int
+
+	// Skew is the exponent of the Zipf distribution of requests over the
+	// IPs, which must be greater than one, 1.1 by default. Larger values
+	// concentrate the requests on fewer IPs.
+	Skew float64
+
+	// BotShare is the share of IPs that only request pages, 0.05 by
+	// default
+	BotShare float64
+
+	// AssetShare is the share of requests of humans that fetch assets,
+	// 0.7 by default
+	AssetShare float64
+
+	// Seed makes the traffic reproducible
+	Seed int64
+}
+
+// Traffic generates requests
+type Traffic struct {
+	options TrafficOptions
+	rng     *rand.Rand
+	zipf    *rand.Zipf
+}
+
+var assets = []string{"/static/app.js", "/static/style.css", "/static/logo.png", "/favicon.ico", "/static/font.css"}
+
+// NewTraffic creates a generator
+func NewTraffic(options TrafficOptions) *Traffic {
+	if options.IPs <= 0 {
+		options.IPs = 10000
+	}
+	if options.Skew <= 1 {
+		options.Skew = 1.1
+	}
+	if options.BotShare <= 0 {
+		options.BotShare = 0.05
+	}
+	if options.AssetShare <= 0 {
+		options.AssetShare = 0.7
+	}
+
+	rng := rand.New(rand.NewSource(options.Seed))
+	return &Traffic{
+		options: options,
+		rng:     rng,
+		zipf:    rand.NewZipf(rng, options.Skew, 1, uint64(options.IPs-1)),
+	}
+}
+
+// IP returns the i-th client IP. The IPs are public, so deciders count them.
+func IP(i int) net.IP {
+	return net.IPv4(100, byte(i>>16&0x3f), byte(i>>8), byte(i))
+}
+
+// isBot determines whether the i-th IP is a bot. Bots are spread over the
+// distribution rather than being the busiest IPs.
+func (t *Traffic) isBot(i int) bool {
+	return float64(i*7919%1000) < t.options.BotShare*1000
+}
+
+// next returns the index of the IP and the URL of the next request
+func (t *Traffic) next() (int, string) {
+	i := int(t.zipf.Uint64())
+	if !t.isBot(i) && t.rng.Float64() < t.options.AssetShare {
+		return i, assets[t.rng.Intn(len(assets))]
+	}
+	switch t.rng.Intn(3) {
+	case 0:
+		return i, fmt.Sprintf("/products/%d", t.rng.Intn(5000))
+	case 1:
+		return i, fmt.Sprintf("/search?q=item%d&page=%d", t.rng.Intn(200), t.rng.Intn(10))
+	default:
+		return i, "/"
+	}
+}
+
+// Next returns the IP and the URL of the next request and whether the IP
+// is a bot
+func (t *Traffic) Next() (net.IP, string, bool) {
+	i, url := t.next()
+	return IP(i), url, t.isBot(i)
+}
+
+// Requests returns n requests
+func (t *Traffic) Requests(n int) []*botdetect.Request {
+	ips := make(map[int]net.IP)
+	reqs := make([]*botdetect.Request, n)
+	for j := range reqs {
+		i, url := t.next()
+		ip, ok := ips[i]
+		if !ok {
+			ip = IP(i)
+			ips[i] = ip
+		}
+		reqs[j] = &botdetect.Request{IP: ip, URL: url}
+	}
+	return reqs
+}
+
+// Lines returns n input lines in botdetect.DefaultInputFormat
+func (t *Traffic) Lines(n int) []string {
+	lines := make([]string, n)
+	for j := range lines {
+		i, url := t.next()
+		lines[j] = IP(i).String() + "|-|" + url
+	}
+	return lines
+}
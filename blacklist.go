@@ -1,31 +1,104 @@
 package botdetect
 
 import (
+	"container/heap"
 	"context"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	sll "github.com/emirpasic/gods/lists/singlylinkedlist"
-	"github.com/emirpasic/gods/maps/hashmap"
 )
 
-// Blacklist contains all blacklisted IP addresses as key
+// Blacklist contains all blacklisted IP addresses as key.
+//
+// All methods are safe for concurrent use. Lookups only take a read lock
+// (and usually none at all thanks to the bloom filter), while Set and the
+// expiry loop take the write lock for the whole check-then-modify sequence,
+// so the data map, the expiry heap and the filter never disagree.
 type Blacklist struct {
 	ttl            time.Duration
 	expireInterval time.Duration
-	data           *hashmap.Map
-	expiry         *sll.List
+	data           map[netip.Addr]blacklistRecord
+	expiry         expiryHeap
+	filter         atomic.Value
+
+	// capacity limits the number of entries, 0 means no limit
+	capacity int
+	evicted  uint64
+
+	// peak is the largest number of entries so far
+	peak int
+
+	// subscribers receive the changes, see Subscribe
+	subscribers map[*blacklistSubscriber]bool
 
-	dataMutex   sync.RWMutex
-	expiryMutex sync.RWMutex
+	// wal logs the changes, see SetWAL
+	wal *BlacklistWAL
+
+	// shared holds the *SharedBlacklistOptions the blacklist is shared
+	// with, see Share
+	shared atomic.Value
+
+	// mutex guards data, expiry, capacity, peak, subscribers and wal
+	mutex sync.RWMutex
 
 	ctx context.Context
 }
 
+type blacklistRecord struct {
+	Expires  time.Time
+	Reason   string
+	Severity Severity
+
+	// expiry is the entry of the IP in the expiry heap
+	expiry *blacklistIP
+}
+
+// BlacklistEntry describes a single blacklisted IP. An empty severity is
+// SeverityBlock.
+type BlacklistEntry struct {
+	IP       net.IP    `json:"ip"`
+	Expires  time.Time `json:"expires"`
+	Reason   string    `json:"reason,omitempty"`
+	Severity Severity  `json:"severity,omitempty"`
+}
+
 type blacklistIP struct {
-	IP      string
+	IP      netip.Addr
 	Expires time.Time
+
+	// index is the position in the heap, so that removed IPs can be taken
+	// out of it
+	index int
+}
+
+// expiryHeap is a min-heap of blacklisted IPs ordered by expiry
+type expiryHeap []*blacklistIP
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Expires.Before(h[j].Expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*blacklistIP)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
 }
 
 // NewBlacklist creates a new Blacklist
@@ -34,12 +107,13 @@ func NewBlacklist(ctx context.Context, ttl, expireInterval time.Duration) *Black
 		ctx:            ctx,
 		ttl:            ttl,
 		expireInterval: expireInterval,
-		data:           hashmap.New(),
-		expiry:         sll.New(),
-		dataMutex:      sync.RWMutex{},
-		expiryMutex:    sync.RWMutex{},
+		data:           make(map[netip.Addr]blacklistRecord),
+		expiry:         expiryHeap{},
+		mutex:          sync.RWMutex{},
 	}
 
+	bl.filter.Store(newBloomFilter(0, bloomFPRate))
+
 	go bl.expireLoop()
 
 	return &bl
@@ -47,49 +121,259 @@ func NewBlacklist(ctx context.Context, ttl, expireInterval time.Duration) *Black
 
 // Set adds an IP to the blacklist if it doesn't already exist
 func (bl *Blacklist) Set(ip net.IP) {
-	ipstr := ip.To16().String()
+	bl.SetReason(ip, "")
+}
+
+// SetReason adds an IP to the blacklist if it doesn't already exist and
+// remembers why it was added
+func (bl *Blacklist) SetReason(ip net.IP, reason string) {
+	bl.SetAction(ip, reason, RuleAction{})
+}
+
+// SetAction is like SetReason but keeps the IP on the blacklist for the TTL
+// of the action, if set, and remembers its severity. It returns whether the
+// IP has been added, false if it was already blacklisted.
+func (bl *Blacklist) SetAction(ip net.IP, reason string, action RuleAction) bool {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return false
+	}
 
-	bl.dataMutex.RLock()
-	_, ok := bl.data.Get(ipstr)
-	bl.dataMutex.RUnlock()
-	if ok {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if _, exists := bl.data[addr]; exists {
+		return false
+	}
+
+	ttl := bl.ttl
+	if action.TTL > 0 {
+		ttl = action.TTL
+	}
+	bl.add(addr, blacklistRecord{Expires: time.Now().Add(ttl), Reason: reason, Severity: action.Severity})
+
+	key := addr.As16()
+	bl.bloom().add(key[:])
+	bl.evict()
+	bl.updatePeak()
+	return true
+}
+
+// Restore adds an entry with its original expiry, reason and severity, e.g. when
+// loading a saved state. Expired entries and IPs already on the blacklist are
+// skipped.
+func (bl *Blacklist) Restore(entry BlacklistEntry) {
+	addr, ok := CanonicalAddr(entry.IP)
+	if !ok || !entry.Expires.After(time.Now()) {
 		return
 	}
 
-	bl.dataMutex.Lock()
-	bl.data.Put(ipstr, true)
-	bl.dataMutex.Unlock()
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
 
-	bl.expiryMutex.Lock()
-	bl.expiry.Add(blacklistIP{
-		IP:      ipstr,
-		Expires: time.Now().Add(bl.ttl),
-	})
-	bl.expiryMutex.Unlock()
+	if _, exists := bl.data[addr]; exists {
+		return
+	}
+
+	bl.add(addr, blacklistRecord{Expires: entry.Expires, Reason: entry.Reason, Severity: entry.Severity})
+
+	key := addr.As16()
+	bl.bloom().add(key[:])
+	bl.evict()
+	bl.updatePeak()
+}
+
+// add puts the record of an IP that isn't blacklisted yet on the blacklist
+// and into the expiry heap. The caller must hold the write lock.
+func (bl *Blacklist) add(addr netip.Addr, rec blacklistRecord) {
+	rec.expiry = &blacklistIP{IP: addr, Expires: rec.Expires}
+	heap.Push(&bl.expiry, rec.expiry)
+	bl.data[addr] = rec
+	bl.publish(BlacklistAdd, addr, rec, "")
+}
+
+// SetCapacity limits the blacklist to max entries, 0 removes the limit. When
+// the blacklist is full, the entries expiring first are evicted.
+func (bl *Blacklist) SetCapacity(max int) {
+	if max < 0 {
+		max = 0
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.capacity = max
+	bl.evict()
+}
+
+// Capacity returns the maximum number of entries, 0 means no limit
+func (bl *Blacklist) Capacity() int {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return bl.capacity
+}
+
+// Peak returns the largest number of entries the blacklist has had
+func (bl *Blacklist) Peak() int {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return bl.peak
+}
+
+// updatePeak records the current size if it is the largest so far. The
+// caller must hold the write lock.
+func (bl *Blacklist) updatePeak() {
+	if len(bl.data) > bl.peak {
+		bl.peak = len(bl.data)
+	}
+}
+
+// Evicted returns the number of entries evicted because the blacklist was full
+func (bl *Blacklist) Evicted() uint64 {
+	return atomic.LoadUint64(&bl.evicted)
 }
 
+// evict removes the entries expiring first until the blacklist fits its
+// capacity. The caller must hold the write lock. Evicted IPs stay in the
+// bloom filter until it is rebuilt, which only costs a map lookup.
+func (bl *Blacklist) evict() {
+	for bl.capacity > 0 && len(bl.data) > bl.capacity && len(bl.expiry) > 0 {
+		blip := heap.Pop(&bl.expiry).(*blacklistIP)
+		rec := bl.data[blip.IP]
+		delete(bl.data, blip.IP)
+		atomic.AddUint64(&bl.evicted, 1)
+		bl.publish(BlacklistRemove, blip.IP, rec, "evicted")
+	}
+}
+
+// Remove takes an IP off the blacklist and out of the expiry heap and returns
+// why it had been added
+func (bl *Blacklist) Remove(ip net.IP) (string, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return "", false
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	rec, exists := bl.data[addr]
+	if exists {
+		heap.Remove(&bl.expiry, rec.expiry.index)
+		delete(bl.data, addr)
+		bl.publish(BlacklistRemove, addr, rec, "removed")
+	}
+	return rec.Reason, exists
+}
+
+// Size returns the number of blacklisted IPs
 func (bl *Blacklist) Size() int {
-	bl.dataMutex.RLock()
-	defer bl.dataMutex.RUnlock()
-	return bl.data.Size()
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return len(bl.data)
 }
 
-// IsBlacklisted determines whether a given IP is on the blacklist
+// IsBlacklisted determines whether a given IP is on the blacklist, or in the
+// store it is shared with
 func (bl *Blacklist) IsBlacklisted(ip net.IP) bool {
-	bl.dataMutex.Lock()
-	defer bl.dataMutex.Unlock()
-
-	_, exists := bl.data.Get(ip.To16().String())
+	_, exists := bl.Reason(ip)
 	return exists
 }
 
+// Reason returns why the IP has been blacklisted and whether it is on the
+// blacklist at all
+func (bl *Blacklist) Reason(ip net.IP) (string, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return "", false
+	}
+	if rec, exists := bl.local(addr); exists {
+		return rec.Reason, true
+	}
+	entry, exists := bl.lookupShared(addr)
+	return entry.Reason, exists
+}
+
+// Entry returns the entry of the IP and whether it is on the blacklist
+func (bl *Blacklist) Entry(ip net.IP) (BlacklistEntry, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return BlacklistEntry{}, false
+	}
+	if rec, exists := bl.local(addr); exists {
+		return BlacklistEntry{IP: net.IP(addr.AsSlice()), Expires: rec.Expires, Reason: rec.Reason, Severity: rec.Severity}, true
+	}
+	return bl.lookupShared(addr)
+}
+
+// local returns the record of the IP on this blacklist
+func (bl *Blacklist) local(addr netip.Addr) (blacklistRecord, bool) {
+	// the bloom filter answers the common case without taking a lock
+	key := addr.As16()
+	if !bl.bloom().mayContain(key[:]) {
+		return blacklistRecord{}, false
+	}
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	rec, exists := bl.data[addr]
+	return rec, exists
+}
+
+// SnapshotList returns a copy of all blacklist entries ordered by IP. The
+// lock is only held while copying, so callers may take their time with it.
+func (bl *Blacklist) SnapshotList() []BlacklistEntry {
+	type item struct {
+		addr netip.Addr
+		rec  blacklistRecord
+	}
+
+	bl.mutex.RLock()
+	items := make([]item, 0, len(bl.data))
+	for addr, rec := range bl.data {
+		items = append(items, item{addr, rec})
+	}
+	bl.mutex.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].addr.Less(items[j].addr)
+	})
+
+	entries := make([]BlacklistEntry, len(items))
+	for i, it := range items {
+		entries[i] = BlacklistEntry{
+			IP:       net.IP(it.addr.AsSlice()),
+			Expires:  it.rec.Expires,
+			Reason:   it.rec.Reason,
+			Severity: it.rec.Severity,
+		}
+	}
+
+	return entries
+}
+
+// ForEach calls fn for every entry of a snapshot of the blacklist until fn
+// returns false
+func (bl *Blacklist) ForEach(fn func(entry BlacklistEntry) bool) {
+	for _, entry := range bl.SnapshotList() {
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
 func (bl *Blacklist) expireLoop() {
+	ticker := time.NewTicker(bl.expireInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-bl.ctx.Done():
 			return
-		case <-time.After(bl.expireInterval):
+		case <-ticker.C:
 			bl.expire()
+			bl.rebuildFilter()
 		}
 	}
 }
@@ -97,28 +381,31 @@ func (bl *Blacklist) expireLoop() {
 func (bl *Blacklist) expire() {
 	now := time.Now()
 
-	for {
-		bl.expiryMutex.RLock()
-		item, ok := bl.expiry.Get(0)
-		bl.expiryMutex.RUnlock()
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
 
-		if !ok {
-			break
-		}
+	for len(bl.expiry) > 0 && bl.expiry[0].Expires.Before(now) {
+		blip := heap.Pop(&bl.expiry).(*blacklistIP)
+		rec := bl.data[blip.IP]
+		delete(bl.data, blip.IP)
+		bl.publish(BlacklistRemove, blip.IP, rec, "expired")
+	}
+}
 
-		blip := item.(blacklistIP)
-		if blip.Expires.Before(now) {
-			// remove IP from expiry
-			bl.expiryMutex.Lock()
-			bl.expiry.Remove(0)
-			bl.expiryMutex.Unlock()
-
-			// remove IP from data
-			bl.dataMutex.Lock()
-			bl.data.Remove(blip.IP)
-			bl.dataMutex.Unlock()
-		} else {
-			break
-		}
+func (bl *Blacklist) bloom() *bloomFilter {
+	return bl.filter.Load().(*bloomFilter)
+}
+
+// rebuildFilter replaces the bloom filter with a fresh one so that expired
+// IPs no longer produce false positives and the filter grows with the data
+func (bl *Blacklist) rebuildFilter() {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	f := newBloomFilter(len(bl.data)*2, bloomFPRate)
+	for addr := range bl.data {
+		key := addr.As16()
+		f.add(key[:])
 	}
+	bl.filter.Store(f)
 }
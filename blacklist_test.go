@@ -2,8 +2,10 @@ package botdetect
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,3 +27,204 @@ func TestBlacklist(t *testing.T) {
 		t.Errorf("IP %s should not be blacklisted after it has expired", ip)
 	}
 }
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(0, bloomFPRate)
+
+	added := make([]net.IP, 500)
+	for i := range added {
+		ipbytes := make([]byte, 16)
+		rand.Read(ipbytes)
+		added[i] = net.IP(ipbytes)
+		f.add(added[i])
+	}
+
+	for _, ip := range added {
+		if !f.mayContain(ip) {
+			t.Errorf("bloom filter returned a false negative for %s", ip)
+		}
+	}
+}
+
+func TestBlacklistConcurrentAccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBlacklist(ctx, 20*time.Millisecond, time.Millisecond)
+
+	ips := make([]net.IP, 64)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, byte(i/256), byte(i%256))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				b.Set(ips[i%len(ips)])
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				b.IsBlacklisted(ips[i%len(ips)])
+				b.Size()
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.Set(ips[0])
+	if !b.IsBlacklisted(ips[0]) {
+		t.Errorf("IP %s should be blacklisted", ips[0])
+	}
+	if b.Size() > len(ips) {
+		t.Errorf("blacklist holds %d entries, expected at most %d", b.Size(), len(ips))
+	}
+}
+
+func TestBlacklistSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBlacklist(ctx, time.Minute, time.Minute)
+	b.Set(net.ParseIP("192.0.2.2"))
+	b.Set(net.ParseIP("192.0.2.1"))
+	b.Set(net.ParseIP("2001:db8::1"))
+
+	entries := b.SnapshotList()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if !entries[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected entries to be sorted by IP, got %s first", entries[0].IP)
+	}
+
+	// the snapshot must not change when the blacklist does
+	before := make([]string, len(entries))
+	for i, e := range entries {
+		before[i] = fmt.Sprintf("%s %s %q", e.IP, e.Expires, e.Reason)
+	}
+	b.Remove(net.ParseIP("192.0.2.1"))
+	b.Set(net.ParseIP("192.0.2.0"))
+	if len(entries) != len(before) {
+		t.Fatalf("snapshot changed from %d to %d entries", len(before), len(entries))
+	}
+	for i, e := range entries {
+		if after := fmt.Sprintf("%s %s %q", e.IP, e.Expires, e.Reason); after != before[i] {
+			t.Errorf("snapshot entry %d changed from %s to %s", i, before[i], after)
+		}
+	}
+	if snapshot := b.SnapshotList(); len(snapshot) != 3 || !snapshot[0].IP.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("expected a new snapshot to reflect the changes, got %v", snapshot)
+	}
+
+	seen := 0
+	b.ForEach(func(entry BlacklistEntry) bool {
+		seen++
+		return seen < 2
+	})
+	if seen != 2 {
+		t.Errorf("ForEach should stop when the callback returns false, saw %d entries", seen)
+	}
+}
+
+func TestBlacklistRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBlacklist(ctx, 30*time.Millisecond, time.Hour)
+	ip := net.ParseIP("192.0.2.1")
+
+	b.SetReason(ip, "first")
+	if reason, ok := b.Remove(ip); !ok || reason != "first" {
+		t.Errorf("expected to remove the IP blacklisted for 'first', got '%s', %v", reason, ok)
+	}
+	if b.IsBlacklisted(ip) {
+		t.Errorf("IP %s should not be blacklisted after removal", ip)
+	}
+	if len(b.expiry) != 0 {
+		t.Errorf("expected the IP to be taken out of the expiry heap, got %d entries", len(b.expiry))
+	}
+
+	// the expiry of the first entry must not remove the second one
+	time.Sleep(10 * time.Millisecond)
+	b.SetReason(ip, "second")
+	time.Sleep(25 * time.Millisecond)
+	b.expire()
+	if reason, ok := b.Reason(ip); !ok || reason != "second" {
+		t.Errorf("expected IP %s to still be blacklisted for 'second', got '%s', %v", ip, reason, ok)
+	}
+	if len(b.expiry) != 1 {
+		t.Errorf("expected one entry in the expiry heap, got %d", len(b.expiry))
+	}
+
+	// removing IPs from the middle of the heap keeps it ordered
+	c := NewBlacklist(ctx, time.Hour, time.Hour)
+	for i := 2; i < 10; i++ {
+		ttl := time.Hour
+		if i%2 == 1 {
+			ttl = time.Duration(i) * time.Millisecond
+		}
+		c.SetAction(net.ParseIP(fmt.Sprintf("192.0.2.%d", i)), "", RuleAction{TTL: ttl})
+	}
+	for _, i := range []int{4, 3, 8} {
+		c.Remove(net.ParseIP(fmt.Sprintf("192.0.2.%d", i)))
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.expire()
+	if c.Size() != 2 || len(c.expiry) != 2 || !c.IsBlacklisted(net.ParseIP("192.0.2.2")) || !c.IsBlacklisted(net.ParseIP("192.0.2.6")) {
+		t.Errorf("expected only 192.0.2.2 and 192.0.2.6 to be left, got %v", c.SnapshotList())
+	}
+}
+
+func TestBlacklistCapacity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBlacklist(ctx, time.Hour, time.Hour)
+	b.SetCapacity(2)
+
+	now := time.Now()
+	b.Restore(BlacklistEntry{IP: net.ParseIP("192.0.2.1"), Expires: now.Add(30 * time.Minute)})
+	b.Restore(BlacklistEntry{IP: net.ParseIP("192.0.2.2"), Expires: now.Add(10 * time.Minute)})
+	b.Set(net.ParseIP("192.0.2.3"))
+
+	if b.Size() != 2 {
+		t.Fatalf("expected 2 entries, got %d", b.Size())
+	}
+	if b.IsBlacklisted(net.ParseIP("192.0.2.2")) {
+		t.Error("the entry expiring first should have been evicted")
+	}
+	if !b.IsBlacklisted(net.ParseIP("192.0.2.1")) || !b.IsBlacklisted(net.ParseIP("192.0.2.3")) {
+		t.Error("the entries expiring later should have been kept")
+	}
+	if b.Evicted() != 1 {
+		t.Errorf("expected 1 eviction, got %d", b.Evicted())
+	}
+	if b.Peak() != 2 {
+		t.Errorf("expected a peak of 2 entries, got %d", b.Peak())
+	}
+
+	// a removed entry leaves the expiry heap as well
+	b.Remove(net.ParseIP("192.0.2.1"))
+	b.Set(net.ParseIP("192.0.2.4"))
+	b.SetCapacity(1)
+	if b.Size() != 1 || !b.IsBlacklisted(net.ParseIP("192.0.2.4")) {
+		t.Errorf("expected only 192.0.2.4 to be left, got %v", b.SnapshotList())
+	}
+	if b.Evicted() != 2 {
+		t.Errorf("expected 2 evictions, got %d", b.Evicted())
+	}
+
+	b.SetCapacity(0)
+	b.Set(net.ParseIP("192.0.2.5"))
+	if b.Size() != 2 {
+		t.Errorf("expected no limit after resetting the capacity, got %d entries", b.Size())
+	}
+	if b.Peak() != 2 {
+		t.Errorf("expected the peak to stay at 2 entries, got %d", b.Peak())
+	}
+}
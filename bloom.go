@@ -0,0 +1,76 @@
+package botdetect
+
+import (
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	bloomMinCapacity = 1024
+	bloomFPRate      = 0.01
+)
+
+// bloomFilter is a fixed size bloom filter that can be read and added to
+// concurrently without locks. It never yields false negatives.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter creates a bloom filter sized for n items at the given false positive rate
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < bloomMinCapacity {
+		n = bloomMinCapacity
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// hashes returns the two base hashes used for double hashing
+func (f *bloomFilter) hashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	return h1, h2 | 1
+}
+
+func (f *bloomFilter) add(key []byte) {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		word := &f.bits[pos/64]
+		mask := uint64(1) << (pos % 64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain reports false if the key was definitely never added
+func (f *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		if atomic.LoadUint64(&f.bits[pos/64])&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package botdetect
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// BotRanges verifies bots by the networks their operators publish, e.g.
+// OpenAI for GPTBot. The file format is the one of the data center list with
+// the bot name as the provider.
+type BotRanges struct {
+	list  *DatacenterList
+	names map[string]bool
+}
+
+// LoadBotRanges reads BotRanges from a file
+func LoadBotRanges(path string) (*BotRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	defer f.Close()
+
+	br, err := ReadBotRanges(f)
+	if err != nil {
+		return nil, configErrorf("%s: %w", path, err)
+	}
+	return br, nil
+}
+
+// ReadBotRanges reads BotRanges in CSV format with the columns network (CIDR)
+// and bot name. Lines starting with '#' are ignored.
+func ReadBotRanges(r io.Reader) (*BotRanges, error) {
+	dl, err := ReadDatacenterList(r)
+	if err != nil {
+		return nil, err
+	}
+
+	br := &BotRanges{list: dl, names: make(map[string]bool)}
+	for i, name := range dl.providers {
+		if name == "" {
+			return nil, configErrorf("network %d has no bot name", i+1)
+		}
+		dl.providers[i] = strings.ToLower(name)
+		br.names[dl.providers[i]] = true
+	}
+	return br, nil
+}
+
+// Verify determines whether networks are published for the bot and, if so,
+// whether the IP lies within them
+func (br *BotRanges) Verify(name string, ip net.IP) (known, verified bool) {
+	if br == nil {
+		return false, false
+	}
+
+	name = strings.ToLower(name)
+	if !br.names[name] {
+		return false, false
+	}
+	bot, ok := br.list.Lookup(ip)
+	return true, ok && bot == name
+}
+
+// Size returns the number of networks
+func (br *BotRanges) Size() int {
+	if br == nil {
+		return 0
+	}
+	return br.list.Size()
+}
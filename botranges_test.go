@@ -0,0 +1,41 @@
+package botdetect
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBotRanges(t *testing.T) {
+	br, err := ReadBotRanges(strings.NewReader("# published ranges\n192.0.2.0/28,GPTBot\n198.51.100.0/24,CCBot\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		ip       string
+		known    bool
+		verified bool
+	}{
+		{"GPTBot", "192.0.2.5", true, true},
+		{"gptbot", "192.0.2.5", true, true},
+		{"GPTBot", "192.0.2.200", true, false},
+		{"GPTBot", "198.51.100.1", true, false},
+		{"ClaudeBot", "192.0.2.5", false, false},
+	} {
+		known, verified := br.Verify(c.name, net.ParseIP(c.ip))
+		if known != c.known || verified != c.verified {
+			t.Errorf("%s from %s: expected %v/%v, got %v/%v", c.name, c.ip, c.known, c.verified, known, verified)
+		}
+	}
+
+	if _, err := ReadBotRanges(strings.NewReader("192.0.2.0/28\n")); err == nil {
+		t.Error("expected an error for a network without a bot name")
+	}
+
+	var nilRanges *BotRanges
+	if known, _ := nilRanges.Verify("GPTBot", net.ParseIP("192.0.2.5")); known {
+		t.Error("expected no bots to be known without ranges")
+	}
+}
@@ -0,0 +1,167 @@
+package botdetect
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatus is the outcome of a request at a CDN or caching proxy
+type CacheStatus uint8
+
+const (
+	// CacheUnknown means the cache status wasn't logged or the response
+	// isn't cacheable
+	CacheUnknown CacheStatus = iota
+
+	// CacheHit means the response came from the cache
+	CacheHit
+
+	// CacheMiss means the request was forwarded to the origin
+	CacheMiss
+)
+
+// String returns HIT, MISS or an empty string for CacheUnknown, which
+// ParseCacheStatus parses back
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheHit:
+		return "HIT"
+	case CacheMiss:
+		return "MISS"
+	}
+	return ""
+}
+
+// cacheStatuses are the statuses logged by common CDNs and caching proxies
+var cacheStatuses = []struct {
+	name   string
+	status CacheStatus
+}{
+	{"hit", CacheHit}, {"stale", CacheHit}, {"updating", CacheHit}, {"revalidated", CacheHit},
+	{"miss", CacheMiss}, {"bypass", CacheMiss}, {"expired", CacheMiss}, {"pass", CacheMiss},
+}
+
+// ParseCacheStatus classifies a cache status as logged by CDNs and caching
+// proxies, e.g. HIT, MISS or BYPASS (nginx, Cloudflare, Fastly, Varnish) or
+// an RFC 9211 Cache-Status header, of which the cache closest to the client
+// decides. Anything else, including "-" and DYNAMIC, is CacheUnknown.
+func ParseCacheStatus(s string) CacheStatus {
+	// RFC 9211: the last member is the cache closest to the client, its
+	// parameters tell whether it had a hit or forwarded the request
+	if i := strings.LastIndexByte(s, ','); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		for params := s[i+1:]; params != ""; {
+			param := params
+			if j := strings.IndexByte(params, ';'); j >= 0 {
+				param, params = params[:j], params[j+1:]
+			} else {
+				params = ""
+			}
+			param = strings.TrimSpace(param)
+			switch {
+			case strings.EqualFold(param, "hit"):
+				return CacheHit
+			case len(param) > 4 && strings.EqualFold(param[:4], "fwd="):
+				return CacheMiss
+			}
+		}
+		return CacheUnknown
+	}
+
+	// X-Cache: HIT from proxy.example.com
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		s = s[:i]
+	}
+	for _, cs := range cacheStatuses {
+		if strings.EqualFold(s, cs.name) {
+			return cs.status
+		}
+	}
+	return CacheUnknown
+}
+
+// CacheRule blacklists an IP whose requests within Window missed the cache
+// more often than MaxMissRatio, once at least MinRequests of them have a known
+// cache status. Scrapers that vary query strings to bypass the cache and
+// reach the origin have miss ratios close to 1.
+type CacheRule struct {
+	Window       time.Duration
+	MinRequests  uint64
+	MaxMissRatio float64
+
+	RuleAction
+}
+
+// String returns the rule in the format understood by ParseCacheRules
+func (r CacheRule) String() string {
+	return fmt.Sprintf("%s:%d:%s", r.Window, r.MinRequests, strconv.FormatFloat(r.MaxMissRatio, 'f', -1, 64)) + r.RuleAction.String()
+}
+
+// matches determines whether the hits and misses violate the rule
+func (r CacheRule) matches(hits, misses uint64) bool {
+	total := hits + misses
+	return total > 0 && total >= r.MinRequests && float64(misses)/float64(total) > r.MaxMissRatio
+}
+
+// ParseCacheRules parses a comma separated list of rules in the form
+// window:min-requests:max-miss-ratio, e.g. "10m:50:0.9,1h:200:0.8". The
+// options are those of ParseRules.
+func ParseCacheRules(s string) ([]CacheRule, error) {
+	rules := []CacheRule{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		base, action, err := parseRuleAction(def)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Split(base, ":")
+		if len(fields) != 3 {
+			return nil, configErrorf("invalid cache rule '%s': expected window:min-requests:max-miss-ratio", def)
+		}
+
+		window, err := time.ParseDuration(fields[0])
+		if err != nil || window <= 0 {
+			return nil, configErrorf("invalid window in cache rule '%s'", def)
+		}
+
+		minRequests, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, configErrorf("invalid min-requests in cache rule '%s'", def)
+		}
+
+		ratio, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ratio < 0 || ratio >= 1 {
+			return nil, configErrorf("invalid max-miss-ratio in cache rule '%s': expected at least 0 and less than 1", def)
+		}
+
+		rules = append(rules, CacheRule{Window: window, MinRequests: minRequests, MaxMissRatio: ratio, RuleAction: action})
+	}
+
+	return rules, nil
+}
+
+// cacheSince sums up the cache hits and misses of all items newer than
+// cutoff
+func cacheSince(counts *list.List, cutoff time.Time) (hits, misses uint64) {
+	for node := counts.Front(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		if !hi.Timestamp.After(cutoff) {
+			break
+		}
+		hits += hi.Hits
+		misses += hi.Misses
+	}
+	return hits, misses
+}
@@ -0,0 +1,103 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCacheStatus(t *testing.T) {
+	for s, expected := range map[string]CacheStatus{
+		"HIT":                              CacheHit,
+		"hit":                              CacheHit,
+		"STALE":                            CacheHit,
+		"MISS":                             CacheMiss,
+		"BYPASS":                           CacheMiss,
+		"EXPIRED":                          CacheMiss,
+		"HIT from proxy.example.com":       CacheHit,
+		"MISS from proxy.example.com":      CacheMiss,
+		"ExampleCDN; hit":                  CacheHit,
+		"ExampleCDN; fwd=uri-miss; stored": CacheMiss,
+		"Origin; fwd=miss, ExampleCDN; hit; ttl=3": CacheHit,
+		"Origin; hit, ExampleCDN; fwd=stale":       CacheMiss,
+		"ExampleCDN; ttl=10":                       CacheUnknown,
+		"DYNAMIC":                                  CacheUnknown,
+		"-":                                        CacheUnknown,
+		"":                                         CacheUnknown,
+	} {
+		if status := ParseCacheStatus(s); status != expected {
+			t.Errorf("%s: expected %v, got %v", s, expected, status)
+		}
+	}
+
+	for _, status := range []CacheStatus{CacheUnknown, CacheHit, CacheMiss} {
+		if parsed := ParseCacheStatus(status.String()); parsed != status {
+			t.Errorf("%v: expected the string to parse back, got %v", status, parsed)
+		}
+	}
+}
+
+func TestParseCacheRules(t *testing.T) {
+	rules, err := ParseCacheRules("10m:50:0.9, 1h:200:0.75")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].String() != "10m0s:50:0.9" || rules[1].MinRequests != 200 || rules[1].MaxMissRatio != 0.75 {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	for _, s := range []string{"10m:50", "0s:50:0.9", "10m:-1:0.9", "10m:50:1", "10m:50:x"} {
+		if _, err := ParseCacheRules(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rules, _ := ParseCacheRules("1h:10:0.8")
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		CacheRules:      rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDecider(h.RequestChannel(), h.Blacklist(), &DeciderOptions{IncludePrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(net.IP) (bool, string) { return false, "" }
+
+	for i := 0; i < 20; i++ {
+		// a visitor mostly gets cached pages
+		status := "HIT"
+		if i%4 == 0 {
+			status = "MISS"
+		}
+		d.Decide(&Input{Remote: "192.0.2.1", URL: "/", CacheStatus: status}, check)
+		// a cache buster never does
+		d.Decide(&Input{Remote: "192.0.2.2", URL: "/?" + string(rune('a'+i)), CacheStatus: "MISS"}, check)
+		// uncacheable responses don't count
+		d.Decide(&Input{Remote: "192.0.2.3", URL: "/api", CacheStatus: "DYNAMIC"}, check)
+	}
+	for h.Processed() < 60 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if h.IsBlacklisted(net.ParseIP("192.0.2.1")) || h.IsBlacklisted(net.ParseIP("192.0.2.3")) {
+		t.Error("expected the visitor and the uncacheable requests not to be blacklisted")
+	}
+	if reason, ok := h.Blacklist().Reason(net.ParseIP("192.0.2.2")); !ok || reason != "cache rule 1h0m0s:10:0.8" {
+		t.Errorf("expected the cache buster to be blacklisted, got %v %s", ok, reason)
+	}
+}
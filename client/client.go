@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// Options configures the Client. Zero values take the defaults.
+type Options struct {
+	// Token is sent as bearer token if set
+	Token string
+
+	// Timeout limits every request to the server, 1s by default
+	Timeout time.Duration
+
+	// CacheTTL is how long answers are cached, 10s by default
+	CacheTTL time.Duration
+
+	// MaxConns is the number of connections kept open to the server and
+	// the number of reports sent at the same time, 4 by default
+	MaxConns int
+
+	// QueueSize is the number of reports waiting to be sent, 1000 by
+	// default. Further reports are dropped.
+	QueueSize int
+
+	// HTTPClient replaces the client's own pooled HTTP client if set
+	HTTPClient *http.Client
+
+	// OnError is called when the server can't be reached or fails if set
+	OnError func(err error)
+}
+
+// Client queries a remote botdetect server
+type Client struct {
+	base    string
+	options Options
+	http    *http.Client
+	queue   chan *botdetect.Request
+
+	cache map[string]cacheEntry
+	mutex sync.RWMutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Client is an Engine
+var _ botdetect.Engine = (*Client)(nil)
+
+type cacheEntry struct {
+	blacklisted bool
+	reason      string
+	expires     time.Time
+}
+
+// New creates a Client for the server at baseURL. options may be nil. It
+// returns an error of the kind botdetect.ErrConfig if baseURL isn't an HTTP
+// or HTTPS URL.
+func New(baseURL string, options *Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, &botdetect.Error{Kind: botdetect.ErrConfig, Err: fmt.Errorf("invalid server URL '%s'", baseURL)}
+	}
+
+	c := &Client{
+		base:  strings.TrimSuffix(baseURL, "/"),
+		cache: make(map[string]cacheEntry),
+	}
+	if options != nil {
+		c.options = *options
+	}
+	if c.options.Timeout <= 0 {
+		c.options.Timeout = time.Second
+	}
+	if c.options.CacheTTL <= 0 {
+		c.options.CacheTTL = 10 * time.Second
+	}
+	if c.options.MaxConns <= 0 {
+		c.options.MaxConns = 4
+	}
+	if c.options.QueueSize <= 0 {
+		c.options.QueueSize = 1000
+	}
+
+	c.http = c.options.HTTPClient
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = c.options.MaxConns
+		c.http = &http.Client{Transport: transport}
+	}
+
+	c.queue = make(chan *botdetect.Request, c.options.QueueSize)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for i := 0; i < c.options.MaxConns; i++ {
+		c.wg.Add(1)
+		go c.send()
+	}
+	c.wg.Add(1)
+	go c.expireCache()
+
+	return c, nil
+}
+
+// IsBlacklisted determines whether the IP is on the server's blacklist. It
+// returns false if the server can't be asked.
+func (c *Client) IsBlacklisted(ip net.IP) bool {
+	blacklisted, _ := c.Check(ip)
+	return blacklisted
+}
+
+// Check returns whether the IP is on the server's blacklist and why. Reasons
+// are only known for answers to IsBlacklisted and Check, not for the ones to
+// reports. It returns false if the server can't be asked.
+func (c *Client) Check(ip net.IP) (bool, string) {
+	key := ip.String()
+	if e, ok := c.cached(key); ok {
+		return e.blacklisted, e.reason
+	}
+
+	var answer struct {
+		Blacklisted bool   `json:"blacklisted"`
+		Reason      string `json:"reason"`
+	}
+	body, err := c.do(http.MethodGet, "/blacklisted?"+url.Values{"ip": {key}}.Encode(), nil)
+	if err == nil {
+		err = json.Unmarshal(body, &answer)
+	}
+	if err != nil {
+		c.fail(unavailable(err))
+		return false, ""
+	}
+
+	c.store(key, answer.Blacklisted, answer.Reason)
+	return answer.Blacklisted, answer.Reason
+}
+
+// Report sends the request to the server in the background. The answer
+// updates the cache, so a following IsBlacklisted needn't ask the server.
+func (c *Client) Report(req *botdetect.Request) {
+	select {
+	case c.queue <- req:
+	default:
+		c.fail(unavailable(fmt.Errorf("report queue full, dropping the request from %s", req.IP)))
+	}
+}
+
+// Close stops sending reports, drops the ones still waiting and closes the
+// idle connections
+func (c *Client) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) send() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case req := <-c.queue:
+			params := url.Values{"remote": {req.IP.String()}, "url": {req.URL}}
+			if !req.Time.IsZero() {
+				params.Set("time", req.Time.Format(time.RFC3339))
+			}
+			if req.ContentType != "" {
+				params.Set("content-type", req.ContentType)
+			}
+			if req.Connections > 0 {
+				params.Set("connections", strconv.FormatUint(req.Connections, 10))
+			}
+			if req.CacheStatus != botdetect.CacheUnknown {
+				params.Set("cache-status", req.CacheStatus.String())
+			}
+			if req.FetchDest != "" {
+				params.Set("sec-fetch-dest", req.FetchDest)
+			}
+			if req.Verified {
+				params.Set("verified", "1")
+			}
+			body, err := c.do(http.MethodPost, "/check", strings.NewReader(params.Encode()))
+			if err != nil {
+				c.fail(unavailable(err))
+				continue
+			}
+			c.store(req.IP.String(), strings.TrimSpace(string(body)) == "BLOCK", "")
+		}
+	}
+}
+
+// do sends a request to the server and returns the body of a successful
+// response
+func (c *Client) do(method, path string, body io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return data, nil
+}
+
+// unavailable marks err as of the kind botdetect.ErrStoreUnavailable
+func unavailable(err error) error {
+	return &botdetect.Error{Kind: botdetect.ErrStoreUnavailable, Err: err}
+}
+
+func (c *Client) fail(err error) {
+	if c.options.OnError != nil {
+		c.options.OnError(err)
+	}
+}
+
+func (c *Client) cached(key string) (cacheEntry, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	e, ok := c.cache[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *Client) store(key string, blacklisted bool, reason string) {
+	c.mutex.Lock()
+	c.cache[key] = cacheEntry{blacklisted: blacklisted, reason: reason, expires: time.Now().Add(c.options.CacheTTL)}
+	c.mutex.Unlock()
+}
+
+// expireCache removes the expired answers once per CacheTTL
+func (c *Client) expireCache() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.options.CacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mutex.Lock()
+			for key, e := range c.cache {
+				if !now.Before(e.expires) {
+					delete(c.cache, key)
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// fakeServer blacklists the IPs in blocked and counts the lookups
+type fakeServer struct {
+	blocked map[string]bool
+	lookups int32
+	reports chan string
+	mutex   sync.Mutex
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.URL.Path {
+	case "/blacklisted":
+		atomic.AddInt32(&s.lookups, 1)
+		fmt.Fprintf(w, `{"ip":%q,"blacklisted":%v}`, r.FormValue("ip"), s.blocked[r.FormValue("ip")])
+	case "/check":
+		s.reports <- r.FormValue("remote") + " " + r.FormValue("url")
+		if s.blocked[r.FormValue("remote")] {
+			fmt.Fprintln(w, "BLOCK")
+		} else {
+			fmt.Fprintln(w, "OK")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeServer{blocked: map[string]bool{"192.0.2.1": true}, reports: make(chan string, 10)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c, err := New(srv.URL, &Options{Token: "secret", CacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.IsBlacklisted(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the IP to be blacklisted")
+	}
+	if c.IsBlacklisted(net.ParseIP("192.0.2.2")) {
+		t.Error("expected the IP not to be blacklisted")
+	}
+	c.IsBlacklisted(net.ParseIP("192.0.2.1"))
+	if n := atomic.LoadInt32(&fake.lookups); n != 2 {
+		t.Errorf("expected the answers to be cached, got %d lookups", n)
+	}
+
+	// the answer to a report updates the cache
+	fake.mutex.Lock()
+	fake.blocked["192.0.2.2"] = true
+	fake.mutex.Unlock()
+	c.Report(&botdetect.Request{IP: net.ParseIP("192.0.2.2"), URL: "/a"})
+	if report := <-fake.reports; report != "192.0.2.2 /a" {
+		t.Errorf("unexpected report %q", report)
+	}
+	for !c.IsBlacklisted(net.ParseIP("192.0.2.2")) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fake.lookups); n != 2 {
+		t.Errorf("expected no further lookups, got %d", n)
+	}
+}
+
+func TestClientFailOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	errs := make(chan error, 10)
+	c, err := New(srv.URL, &Options{Timeout: 100 * time.Millisecond, OnError: func(err error) { errs <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.IsBlacklisted(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the client to fail open")
+	}
+	if err := <-errs; !errors.Is(err, botdetect.ErrStoreUnavailable) {
+		t.Errorf("expected the error to be reported as unavailable, got %v", err)
+	}
+
+	srv.Close()
+	if c.IsBlacklisted(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the client to fail open when the server is gone")
+	}
+}
+
+func TestClientInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "botdetect:8080", "ftp://botdetect", "http://"} {
+		if _, err := New(u, nil); !errors.Is(err, botdetect.ErrConfig) {
+			t.Errorf("%s: expected a configuration error, got %v", u, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+// Package client talks to a botdetect server started with -listen. Its
+// Client is a botdetect.Engine like botdetect.LocalEngine and has the same
+// IsBlacklisted and Report methods as the embedded botdetect.IPHistory, so
+// applications can move between an embedded and a remote detector without
+// changing their code:
+//
+//	c, err := client.New("http://botdetect:8080", &client.Options{Token: token})
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//
+//	c.Report(&botdetect.Request{IP: ip, URL: r.URL.RequestURI()})
+//	if c.IsBlacklisted(ip) {
+//		...
+//	}
+//
+// Answers are cached for a short time and the client fails open: if the
+// server can't be reached, IPs are treated as not blacklisted and reports are
+// dropped. The errors passed to Options.OnError are of the kind
+// botdetect.ErrStoreUnavailable.
+package client
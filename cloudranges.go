@@ -0,0 +1,242 @@
+package botdetect
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DatacenterFormats are the formats of network lists a DatacenterList reads:
+//
+//   - csv: network and an optional provider name per line, see
+//     ReadDatacenterList
+//   - aws: ip-ranges.json of Amazon Web Services, the provider is aws/ and
+//     the service, e.g. aws/EC2
+//   - gcp: cloud.json of Google Cloud, the provider is gcp
+//   - azure: the ServiceTags_Public JSON file of Microsoft Azure, the
+//     provider is azure/ and the service tag, e.g. azure/AzureCloud
+//   - digitalocean: the geo feed google.csv of DigitalOcean, the provider is
+//     digitalocean
+//   - routes: route: and route6: objects of a routing registry, e.g. the
+//     networks of OVH's AS16276 from RADb, the provider is the name of the
+//     file without its extension
+//
+// The providers' lists nest, e.g. EC2 within AMAZON; the most specific
+// network of an IP determines its provider.
+var DatacenterFormats = []string{"csv", "aws", "gcp", "azure", "digitalocean", "routes"}
+
+// LoadDatacenterLists reads the files into one DatacenterList. Every path
+// may be prefixed with its format and a colon, e.g. aws:ip-ranges.json;
+// files without one are csv.
+func LoadDatacenterLists(paths []string) (*DatacenterList, error) {
+	dl := &DatacenterList{}
+	for _, path := range paths {
+		format := "csv"
+		if f, p, ok := strings.Cut(path, ":"); ok && isDatacenterFormat(f) {
+			format, path = f, p
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, configError(err)
+		}
+		err = dl.readRanges(format, routesProvider(path), f)
+		f.Close()
+		if err != nil {
+			return nil, configErrorf("%s: %w", path, err)
+		}
+	}
+	dl.table.sort()
+	return dl, nil
+}
+
+// ReadDatacenterRanges reads a DatacenterList in one of the
+// DatacenterFormats. provider names the networks of the routes format.
+func ReadDatacenterRanges(format, provider string, r io.Reader) (*DatacenterList, error) {
+	if !isDatacenterFormat(format) {
+		return nil, configErrorf("invalid data center list format '%s': expected one of %s", format, strings.Join(DatacenterFormats, ", "))
+	}
+
+	dl := &DatacenterList{}
+	if err := dl.readRanges(format, provider, r); err != nil {
+		return nil, err
+	}
+	dl.table.sort()
+	return dl, nil
+}
+
+func isDatacenterFormat(format string) bool {
+	for _, f := range DatacenterFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// routesProvider names the networks of a routes file after it, e.g. ovh for
+// /etc/botdetect/ovh.txt
+func routesProvider(path string) string {
+	name := path[strings.LastIndexAny(path, `/\`)+1:]
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// readRanges adds the networks in the format to the list without sorting
+// the table
+func (dl *DatacenterList) readRanges(format, provider string, r io.Reader) error {
+	switch format {
+	case "csv":
+		return dl.readCSV(r, 0, 1, "")
+	case "digitalocean":
+		return dl.readCSV(r, 0, -1, "digitalocean")
+	case "aws":
+		return dl.readAWS(r)
+	case "gcp":
+		return dl.readGCP(r)
+	case "azure":
+		return dl.readAzure(r)
+	case "routes":
+		return dl.readRoutes(r, provider)
+	}
+	return configErrorf("invalid data center list format '%s'", format)
+}
+
+func (dl *DatacenterList) add(network, provider string) error {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+	if err != nil {
+		return fmt.Errorf("invalid network '%s'", network)
+	}
+	dl.table.add(prefix, len(dl.providers))
+	dl.providers = append(dl.providers, provider)
+	return nil
+}
+
+// readCSV reads the network from column network and the provider from
+// column provider, or uses the given provider if that is negative or
+// missing
+func (dl *DatacenterList) readCSV(r io.Reader, network, provider int, name string) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return configError(err)
+		}
+
+		p := name
+		if provider >= 0 && len(record) > provider {
+			p = record[provider]
+		}
+		if err := dl.add(record[network], p); err != nil {
+			line, _ := reader.FieldPos(network)
+			return configErrorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (dl *DatacenterList) readAWS(r io.Reader) error {
+	var ranges struct {
+		Prefixes []struct {
+			Prefix  string `json:"ip_prefix"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return configError(err)
+	}
+
+	for _, p := range ranges.Prefixes {
+		if err := dl.add(p.Prefix, "aws/"+p.Service); err != nil {
+			return configError(err)
+		}
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		if err := dl.add(p.Prefix, "aws/"+p.Service); err != nil {
+			return configError(err)
+		}
+	}
+	return nil
+}
+
+func (dl *DatacenterList) readGCP(r io.Reader) error {
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return configError(err)
+	}
+
+	for _, p := range ranges.Prefixes {
+		network := p.IPv4Prefix
+		if network == "" {
+			network = p.IPv6Prefix
+		}
+		if err := dl.add(network, "gcp"); err != nil {
+			return configError(err)
+		}
+	}
+	return nil
+}
+
+func (dl *DatacenterList) readAzure(r io.Reader) error {
+	var tags struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&tags); err != nil {
+		return configError(err)
+	}
+
+	for _, tag := range tags.Values {
+		for _, network := range tag.Properties.AddressPrefixes {
+			if err := dl.add(network, "azure/"+tag.Name); err != nil {
+				return configError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// readRoutes reads the route: and route6: attributes of RPSL objects, as
+// output by whois -h whois.radb.net -- '-i origin AS16276', and ignores
+// everything else
+func (dl *DatacenterList) readRoutes(r io.Reader, provider string) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || (key != "route" && key != "route6") {
+			continue
+		}
+		if err := dl.add(value, provider); err != nil {
+			return configErrorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
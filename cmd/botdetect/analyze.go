@@ -0,0 +1,456 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elcamino/botdetect"
+	"github.com/namsral/flag"
+)
+
+// analysisMaxBuckets is the largest number of buckets of a timeline whose
+// bucket is chosen automatically
+const analysisMaxBuckets = 200
+
+// analyze replays a log like test-config and writes a standalone report of
+// the IPs it would have blocked, when and by which rules, e.g. for an
+// incident retrospective. It returns the exit code.
+func analyze(args []string, options *botdetect.IPHistoryOptions, manual *botdetect.ManualList,
+	geo *botdetect.GeoPolicy, format *botdetect.InputFormat, normalizer *botdetect.URLNormalizer) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	reportFormat := fs.String("format", "json", "the format of the report: json or html")
+	output := fs.String("output", "-", "write the report to this file, - for stdout")
+	bucket := fs.Duration("bucket", 0, "the duration of the buckets of the timelines (0 chooses a multiple of -timeslot for at most 200 buckets)")
+	top := fs.Int("top", 100, "list at most this many blocked IPs, those with the most blocked requests first (0 lists all)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// the log may be given before the options as well
+	path := fs.Arg(0)
+	if fs.NArg() > 0 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return 2
+		}
+	}
+	if path == "" || fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s analyze requires exactly one log file, - for stdin\n", callsign)
+		return 2
+	}
+	if *reportFormat != "json" && *reportFormat != "html" {
+		fmt.Fprintf(os.Stderr, "%s analyze: invalid format %s: expected json or html\n", callsign, *reportFormat)
+		return 2
+	}
+	if *bucket < 0 || *top < 0 {
+		fmt.Fprintf(os.Stderr, "%s analyze: bucket and top must not be negative\n", callsign)
+		return 2
+	}
+	if !format.Has("time") {
+		fmt.Fprintf(os.Stderr, "%s analyze replays requests at their time, -input-format needs a time field\n", callsign)
+		return 1
+	}
+
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	base := *bucket
+	if base == 0 {
+		base = options.TimeSlot
+	}
+	a := newAnalysis(base)
+	result, err := replaySample(in, options, manual, geo, format, normalizer, a.observe)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+		return 1
+	}
+	report := a.report(path, result, *bucket == 0, *top)
+
+	// the report is rendered first, so that a failure doesn't leave a
+	// partial file behind
+	var buf bytes.Buffer
+	if *reportFormat == "html" {
+		err = report.writeHTML(&buf)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err == nil {
+		if *output == "-" {
+			_, err = os.Stdout.Write(buf.Bytes())
+		} else {
+			err = os.WriteFile(*output, buf.Bytes(), 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+		return 1
+	}
+	return 0
+}
+
+// analysisReport is the outcome of analyze
+type analysisReport struct {
+	File      string    `json:"file"`
+	Generated time.Time `json:"generated"`
+
+	// From and To are the times of the first and the last request
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	Lines    uint64 `json:"lines"`
+	Invalid  uint64 `json:"invalid"`
+	Requests uint64 `json:"requests"`
+	IPs      int    `json:"ips"`
+	Blocked  uint64 `json:"blocked"`
+
+	Rules []analysisRule `json:"rules"`
+
+	// BlockedIPs are the IPs with the most blocked requests, NumBlockedIPs
+	// the number of all blocked IPs
+	BlockedIPs    []*analysisIP `json:"blocked_ips"`
+	NumBlockedIPs int           `json:"num_blocked_ips"`
+
+	Bucket   string           `json:"bucket"`
+	Timeline []analysisBucket `json:"timeline"`
+
+	bucket time.Duration
+}
+
+// analysisRule is what a rule or list blocked
+type analysisRule struct {
+	Reason          string  `json:"reason"`
+	IPs             int     `json:"ips"`
+	PercentIPs      float64 `json:"percent_ips"`
+	Requests        uint64  `json:"requests"`
+	PercentRequests float64 `json:"percent_requests"`
+}
+
+// analysisBucket counts the requests within a bucket of a timeline
+type analysisBucket struct {
+	Start    time.Time `json:"start"`
+	Requests uint64    `json:"requests"`
+	Blocked  uint64    `json:"blocked"`
+	IPs      int       `json:"ips,omitempty"`
+}
+
+// analysisIP is what became of the requests of a blocked IP
+type analysisIP struct {
+	IP        string    `json:"ip"`
+	Requests  uint64    `json:"requests"`
+	Blocked   uint64    `json:"blocked"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// Reasons are the reasons the IP's requests were blocked for, Blocks
+	// the times a rule of the history blacklisted it
+	Reasons []string                `json:"reasons"`
+	Blocks  []botdetect.DryRunBlock `json:"blocks,omitempty"`
+
+	Timeline []analysisBucket `json:"timeline"`
+}
+
+// analysis collects the requests of a replayed log in buckets of base
+type analysis struct {
+	base     time.Duration
+	timeline map[time.Time]*analysisBucket
+	ips      map[string]*analysisIP
+	buckets  map[string]map[time.Time]*analysisBucket
+	reasons  map[string]map[string]bool
+	from, to time.Time
+}
+
+func newAnalysis(base time.Duration) *analysis {
+	return &analysis{
+		base:     base,
+		timeline: make(map[time.Time]*analysisBucket),
+		ips:      make(map[string]*analysisIP),
+		buckets:  make(map[string]map[time.Time]*analysisBucket),
+		reasons:  make(map[string]map[string]bool),
+	}
+}
+
+// observe counts a request and its decision
+func (a *analysis) observe(in *botdetect.Input, d botdetect.Decision) {
+	at, err := time.Parse(*inputTimeFormat, in.Time)
+	if err != nil || len(d.IPs) == 0 {
+		return
+	}
+	if a.from.IsZero() || at.Before(a.from) {
+		a.from = at
+	}
+	if at.After(a.to) {
+		a.to = at
+	}
+
+	start := at.Truncate(a.base)
+	total := countBucket(a.timeline, start)
+	total.Requests++
+	if d.Blocked {
+		total.Blocked++
+	}
+
+	for _, ip := range d.IPs {
+		key := ip.String()
+		stats, ok := a.ips[key]
+		if !ok {
+			stats = &analysisIP{IP: key, FirstSeen: at}
+			a.ips[key] = stats
+			a.buckets[key] = make(map[time.Time]*analysisBucket)
+		}
+		stats.Requests++
+		stats.LastSeen = at
+		b := countBucket(a.buckets[key], start)
+		b.Requests++
+		if d.Blocked && ip.Equal(d.IP) {
+			stats.Blocked++
+			b.Blocked++
+			if a.reasons[key] == nil {
+				a.reasons[key] = make(map[string]bool)
+			}
+			a.reasons[key][d.Reason] = true
+		}
+	}
+}
+
+func countBucket(buckets map[time.Time]*analysisBucket, start time.Time) *analysisBucket {
+	b, ok := buckets[start]
+	if !ok {
+		b = &analysisBucket{Start: start}
+		buckets[start] = b
+	}
+	return b
+}
+
+// report sums up the analysis and the result of the replay. With grow the
+// buckets are doubled until the timeline has at most analysisMaxBuckets.
+func (a *analysis) report(path string, result *sampleResult, grow bool, top int) *analysisReport {
+	bucket := a.base
+	for grow && a.to.Sub(a.from)/bucket >= analysisMaxBuckets {
+		bucket *= 2
+	}
+
+	r := &analysisReport{
+		File:      path,
+		Generated: time.Now(),
+		From:      a.from,
+		To:        a.to,
+		Lines:     result.lines,
+		Invalid:   result.invalid,
+		Requests:  result.requests,
+		IPs:       len(result.ips),
+		Blocked:   result.blocked,
+		Bucket:    bucket.String(),
+		bucket:    bucket,
+	}
+	for _, rule := range result.rules {
+		r.Rules = append(r.Rules, analysisRule{
+			Reason:          rule.reason,
+			IPs:             rule.numIPs(),
+			PercentIPs:      result.percentIPs(rule),
+			Requests:        rule.requests,
+			PercentRequests: result.percentRequests(rule),
+		})
+	}
+
+	// IPs blacklisted at the end of the log have no blocked requests
+	blocks := make(map[string][]botdetect.DryRunBlock)
+	for _, b := range result.blocks {
+		blocks[b.IP.String()] = append(blocks[b.IP.String()], b)
+	}
+
+	ipsPerBucket := make(map[time.Time]int)
+	for key, stats := range a.ips {
+		timeline := regroup(a.buckets[key], bucket)
+		for _, b := range timeline {
+			ipsPerBucket[b.Start]++
+		}
+		if stats.Blocked == 0 && len(blocks[key]) == 0 {
+			continue
+		}
+
+		stats.Blocks = blocks[key]
+		reasons := a.reasons[key]
+		if reasons == nil {
+			reasons = make(map[string]bool)
+		}
+		for _, b := range stats.Blocks {
+			reasons[b.Reason] = true
+		}
+		for reason := range reasons {
+			stats.Reasons = append(stats.Reasons, reason)
+		}
+		sort.Strings(stats.Reasons)
+		stats.Timeline = timeline
+		r.BlockedIPs = append(r.BlockedIPs, stats)
+	}
+
+	sort.Slice(r.BlockedIPs, func(i, j int) bool {
+		a, b := r.BlockedIPs[i], r.BlockedIPs[j]
+		if a.Blocked != b.Blocked {
+			return a.Blocked > b.Blocked
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.IP < b.IP
+	})
+	r.NumBlockedIPs = len(r.BlockedIPs)
+	if top > 0 && len(r.BlockedIPs) > top {
+		r.BlockedIPs = r.BlockedIPs[:top]
+	}
+
+	r.Timeline = regroup(a.timeline, bucket)
+	for i := range r.Timeline {
+		r.Timeline[i].IPs = ipsPerBucket[r.Timeline[i].Start]
+	}
+	return r
+}
+
+// regroup adds the buckets up into buckets of the duration, ordered by time
+func regroup(buckets map[time.Time]*analysisBucket, bucket time.Duration) []analysisBucket {
+	grouped := make(map[time.Time]*analysisBucket)
+	for start, b := range buckets {
+		g := countBucket(grouped, start.Truncate(bucket))
+		g.Requests += b.Requests
+		g.Blocked += b.Blocked
+	}
+
+	timeline := make([]analysisBucket, 0, len(grouped))
+	for _, b := range grouped {
+		timeline = append(timeline, *b)
+	}
+	sort.Slice(timeline, func(i, j int) bool { return timeline[i].Start.Before(timeline[j].Start) })
+	return timeline
+}
+
+// analysisBar is a bar of a timeline chart, the blocked requests drawn over
+// all requests
+type analysisBar struct {
+	X, Width        float64
+	Height, Blocked float64
+	Title           string
+}
+
+// Bars lays out the timeline as bars of a chart of the size, placing every
+// bucket by its time within the report
+func (r *analysisReport) Bars(timeline []analysisBucket, width, height float64) []analysisBar {
+	n := int(r.To.Truncate(r.bucket).Sub(r.From.Truncate(r.bucket))/r.bucket) + 1
+	var max uint64
+	for _, b := range timeline {
+		if b.Requests > max {
+			max = b.Requests
+		}
+	}
+	if max == 0 {
+		return nil
+	}
+
+	bars := make([]analysisBar, 0, len(timeline))
+	step := width / float64(n)
+	for _, b := range timeline {
+		i := int(b.Start.Sub(r.From.Truncate(r.bucket)) / r.bucket)
+		bars = append(bars, analysisBar{
+			X:       float64(i) * step,
+			Width:   step,
+			Height:  float64(b.Requests) * height / float64(max),
+			Blocked: float64(b.Blocked) * height / float64(max),
+			Title:   fmt.Sprintf("%s: %d requests, %d blocked", b.Start.Format(time.RFC3339), b.Requests, b.Blocked),
+		})
+	}
+	return bars
+}
+
+// writeHTML writes the report as a standalone HTML page
+func (r *analysisReport) writeHTML(w io.Writer) error {
+	return analysisTemplate.Execute(w, r)
+}
+
+var analysisTemplate = template.Must(template.New("analysis").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"join": strings.Join,
+	"sub":  func(a, b float64) float64 { return a - b },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>botdetect analysis of {{.File}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+td.n { text-align: right; }
+rect.all { fill: #9ab; }
+rect.blocked { fill: #c33; }
+</style>
+</head>
+<body>
+<h1>botdetect analysis of {{.File}}</h1>
+<p>{{.Lines}} lines, {{.Invalid}} invalid, {{.Requests}} requests from {{.IPs}} IPs between {{time .From}} and
+{{time .To}}, {{.Blocked}} requests and {{.NumBlockedIPs}} IPs blocked. Generated at {{time .Generated}}.</p>
+
+<h2>Timeline</h2>
+<p>Requests per {{.Bucket}}, blocked ones in red.</p>
+<svg width="800" height="150">
+{{- range .Bars .Timeline 800 150}}
+<g><title>{{.Title}}</title><rect class="all" x="{{.X}}" y="{{sub 150 .Height}}" width="{{.Width}}" height="{{.Height}}"/><rect class="blocked" x="{{.X}}" y="{{sub 150 .Blocked}}" width="{{.Width}}" height="{{.Blocked}}"/></g>
+{{- end}}
+</svg>
+
+<h2>Rules</h2>
+<table>
+<tr><th>IPs</th><th>%IPs</th><th>requests</th><th>%requests</th><th>rule</th></tr>
+{{- range .Rules}}
+<tr><td class="n">{{.IPs}}</td><td class="n">{{printf "%.1f" .PercentIPs}}%</td><td class="n">{{.Requests}}</td><td class="n">{{printf "%.1f" .PercentRequests}}%</td><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Blocked IPs</h2>
+{{- if lt (len .BlockedIPs) .NumBlockedIPs}}
+<p>The {{len .BlockedIPs}} of {{.NumBlockedIPs}} IPs with the most blocked requests.</p>
+{{- end}}
+<table>
+<tr><th>IP</th><th>requests</th><th>blocked</th><th>first seen</th><th>last seen</th><th>reasons</th><th>timeline</th></tr>
+{{- $r := .}}
+{{- range .BlockedIPs}}
+<tr><td>{{.IP}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Blocked}}</td><td>{{time .FirstSeen}}</td><td>{{time .LastSeen}}</td><td>{{join .Reasons ", "}}</td>
+<td><svg width="200" height="30">
+{{- range $r.Bars .Timeline 200 30}}<g><title>{{.Title}}</title><rect class="all" x="{{.X}}" y="{{sub 30 .Height}}" width="{{.Width}}" height="{{.Height}}"/><rect class="blocked" x="{{.X}}" y="{{sub 30 .Blocked}}" width="{{.Width}}" height="{{.Blocked}}"/></g>{{end -}}
+</svg></td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
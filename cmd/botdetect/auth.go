@@ -0,0 +1,199 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serverAuth holds the TLS configuration and API clients of the HTTP server
+type serverAuth struct {
+	tls     *tls.Config
+	clients []apiClient
+}
+
+// apiClient is an upstream client identified by its bearer token. Clients
+// with a namespace get their own history and blacklist.
+type apiClient struct {
+	name      string
+	token     string
+	namespace string
+}
+
+// String returns the name of the client, never its token
+func (c apiClient) String() string {
+	if c.name == "" {
+		return "anonymous"
+	}
+	return c.name
+}
+
+type clientKey struct{}
+
+// clientFrom returns the client that made the request, if any
+func clientFrom(ctx context.Context) apiClient {
+	client, _ := ctx.Value(clientKey{}).(apiClient)
+	return client
+}
+
+// loadServerAuth loads the certificates and tokens given on the command line
+func loadServerAuth() (*serverAuth, error) {
+	auth := &serverAuth{}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the TLS certificate: %s", err)
+		}
+		auth.tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	if *tlsClientCA != "" {
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsClientCA)
+		}
+		auth.tls.ClientCAs = pool
+		auth.tls.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if *authTokenFile != "" {
+		clients, err := readClients(*authTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.clients = clients
+	}
+
+	return auth, nil
+}
+
+// readClients reads one client per line: either just a token, or a name and
+// a token and optionally a namespace separated by whitespace. Empty lines and
+// comments are ignored.
+func readClients(path string) ([]apiClient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	clients := []apiClient{}
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		client := apiClient{}
+		switch fields := strings.Fields(line); len(fields) {
+		case 1:
+			client.name = fmt.Sprintf("line %d", lineno)
+			client.token = fields[0]
+		case 2, 3:
+			client.name = fields[0]
+			client.token = fields[1]
+			if len(fields) == 3 {
+				client.namespace = fields[2]
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected [name] token [namespace]", path, lineno)
+		}
+
+		if names[client.name] {
+			return nil, fmt.Errorf("%s:%d: client %s given twice", path, lineno, client.name)
+		}
+		names[client.name] = true
+		clients = append(clients, client)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", path)
+	}
+
+	return clients, nil
+}
+
+// requireToken only lets requests with a valid bearer token through. Health
+// checks stay open so that orchestrators can probe without credentials.
+func (a *serverAuth) requireToken(next http.Handler) http.Handler {
+	if a == nil || len(a.clients) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if client, ok := a.client(r); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, client)))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="botdetect"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// client returns the client whose token the request carries
+func (a *serverAuth) client(r *http.Request) (apiClient, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < len("Bearer ") || !strings.EqualFold(h[:len("Bearer ")], "Bearer ") {
+		return apiClient{}, false
+	}
+	given := []byte(h[len("Bearer "):])
+
+	found := -1
+	for i, client := range a.clients {
+		// compare all tokens so the timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare(given, []byte(client.token)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return apiClient{}, false
+	}
+	return a.clients[found], true
+}
@@ -0,0 +1,103 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// blockLogger logs blocked requests, but at most limit per second and one
+// per IP and interval, so that neither an attack nor a single busy IP floods
+// the log. Suppressed lines are summed up instead.
+type blockLogger struct {
+	mutex      sync.Mutex
+	limit      int
+	interval   time.Duration
+	second     time.Time
+	logged     int
+	suppressed int
+
+	// ips holds when each IP was logged last, at most blockLogIPs of them
+	ips map[string]time.Time
+}
+
+// blockLogIPs limits the IPs the block logger remembers
+const blockLogIPs = 10000
+
+func newBlockLogger(limit int, interval time.Duration) *blockLogger {
+	return &blockLogger{limit: limit, interval: interval, ips: make(map[string]time.Time)}
+}
+
+// Log records a request blocked for the reason
+func (bl *blockLogger) Log(ip net.IP, url, reason string) {
+	bl.log(ip, url, reason, time.Now())
+}
+
+func (bl *blockLogger) log(ip net.IP, url, reason string, now time.Time) {
+	if bl.limit <= 0 {
+		return
+	}
+
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	second := now.Truncate(time.Second)
+	if !second.Equal(bl.second) {
+		if bl.suppressed > 0 {
+			log.Printf("%s suppressed %d blocked request logs\n", callsign, bl.suppressed)
+		}
+		bl.second = second
+		bl.logged = 0
+		bl.suppressed = 0
+	}
+
+	ipstr := ip.String()
+	if !bl.allow(ipstr, now) {
+		bl.suppressed++
+		return
+	}
+
+	bl.logged++
+	bl.ips[ipstr] = now
+	log.Printf("%s blocked %s requesting %s: %s\n", callsign, ip, url, reason)
+}
+
+// allow tells whether a line for the IP fits into the limits. bl.mutex must
+// be held.
+func (bl *blockLogger) allow(ipstr string, now time.Time) bool {
+	if bl.logged >= bl.limit {
+		return false
+	}
+	if last, exists := bl.ips[ipstr]; exists {
+		return now.Sub(last) >= bl.interval
+	}
+	if len(bl.ips) < blockLogIPs {
+		return true
+	}
+
+	for ip, last := range bl.ips {
+		if now.Sub(last) >= bl.interval {
+			delete(bl.ips, ip)
+		}
+	}
+	return len(bl.ips) < blockLogIPs
+}
@@ -0,0 +1,56 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockLoggerPerIP(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	bl := newBlockLogger(10, time.Minute)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	busy, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	for i := 0; i < 5; i++ {
+		bl.log(busy, "/", "rule 1m0s:5:0.5", now)
+	}
+	bl.log(other, "/login", "login", now)
+	bl.log(busy, "/", "rule 1m0s:5:0.5", now.Add(time.Minute))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 2 blocked lines, the summary and the busy IP again, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "192.0.2.1 requesting /: rule 1m0s:5:0.5") || !strings.Contains(lines[1], "192.0.2.2 requesting /login: login") {
+		t.Errorf("expected the IP, URL and reason to be logged, got %q", lines[:2])
+	}
+	if !strings.Contains(lines[2], "suppressed 4 ") {
+		t.Errorf("expected 4 suppressed lines, got %q", lines[2])
+	}
+}
@@ -0,0 +1,182 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/namsral/flag"
+)
+
+// dashboard writes a Grafana dashboard of the metrics served on /metrics to
+// stdout, to be imported into Grafana with a Prometheus data source. It
+// returns the exit code.
+func dashboard(args []string) int {
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	title := fs.String("title", "botdetect", "the title of the dashboard")
+	uid := fs.String("uid", "botdetect", "the UID of the dashboard, which Grafana uses to replace it on the next import")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(grafanaDashboard(*title, *uid)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+		return 1
+	}
+	return 0
+}
+
+// grafanaPanel is a panel of the dashboard, placed on Grafana's grid of 24
+// columns
+type grafanaPanel struct {
+	kind, title, description string
+	unit                     string
+	x, y, w, h               int
+
+	// queries are PromQL expressions by their legend
+	queries [][2]string
+}
+
+// instance selects the instances chosen in the dashboard
+const instance = `instance=~"$instance"`
+
+var grafanaPanels = []grafanaPanel{
+	{kind: "stat", title: "Block rate", unit: "percentunit", x: 0, y: 0, w: 6, h: 4,
+		description: "Share of the decisions that blocked or challenged the request",
+		queries:     [][2]string{{"", `sum(rate(botdetect_decisions_total{` + instance + `,decision!="OK"}[$__rate_interval])) / sum(rate(botdetect_decisions_total{` + instance + `}[$__rate_interval]))`}}},
+	{kind: "stat", title: "Blacklisted IPs", unit: "short", x: 6, y: 0, w: 6, h: 4,
+		queries: [][2]string{{"", `sum(botdetect_blacklist_size{` + instance + `})`}}},
+	{kind: "stat", title: "Ingest lag", unit: "s", x: 12, y: 0, w: 6, h: 4,
+		description: "Delay between the time of the latest request and its processing",
+		queries:     [][2]string{{"", `max(botdetect_ingest_lag_seconds{` + instance + `})`}}},
+	{kind: "stat", title: "Queue length", unit: "short", x: 18, y: 0, w: 6, h: 4,
+		queries: [][2]string{{"", `sum(botdetect_queue_length{` + instance + `})`}}},
+
+	{kind: "timeseries", title: "Decisions", unit: "reqps", x: 0, y: 4, w: 12, h: 8,
+		description: "Decisions per second by answer",
+		queries:     [][2]string{{"{{decision}}", `sum by (decision) (rate(botdetect_decisions_total{` + instance + `}[$__rate_interval]))`}}},
+	{kind: "timeseries", title: "Block rate", unit: "percentunit", x: 12, y: 4, w: 12, h: 8,
+		description: "Share of the decisions that blocked or challenged the request",
+		queries:     [][2]string{{"block rate", `sum(rate(botdetect_decisions_total{` + instance + `,decision!="OK"}[$__rate_interval])) / sum(rate(botdetect_decisions_total{` + instance + `}[$__rate_interval]))`}}},
+
+	{kind: "timeseries", title: "Top blocking reasons", unit: "reqps", x: 0, y: 12, w: 12, h: 8,
+		description: "The ten reasons most requests are blocked or challenged for",
+		queries:     [][2]string{{"{{reason}}", `topk(10, sum by (reason) (rate(botdetect_decisions_total{` + instance + `,decision!="OK"}[$__rate_interval])))`}}},
+	{kind: "bargauge", title: "Top ASNs", unit: "short", x: 12, y: 12, w: 12, h: 8,
+		description: "The ten autonomous systems with the most blocked and challenged decisions in the time range, needs -asn-list",
+		queries:     [][2]string{{"{{asn}} {{name}}", `topk(10, sum by (asn, name) (increase(botdetect_blocked_asn_total{` + instance + `}[$__range])))`}}},
+
+	{kind: "timeseries", title: "Ingest lag", unit: "s", x: 0, y: 20, w: 8, h: 8,
+		description: "Delay between the time of the latest request and its processing",
+		queries:     [][2]string{{"{{instance}}", `botdetect_ingest_lag_seconds{` + instance + `}`}}},
+	{kind: "timeseries", title: "Queue", unit: "short", x: 8, y: 20, w: 8, h: 8,
+		queries: [][2]string{
+			{"length {{instance}}", `botdetect_queue_length{` + instance + `}`},
+			{"capacity {{instance}}", `botdetect_queue_capacity{` + instance + `}`},
+		}},
+	{kind: "timeseries", title: "Requests", unit: "reqps", x: 16, y: 20, w: 8, h: 8,
+		description: "Requests processed and dropped or not counted while shedding load",
+		queries: [][2]string{
+			{"processed", `sum(rate(botdetect_processed_requests_total{` + instance + `}[$__rate_interval]))`},
+			{"dropped", `sum(rate(botdetect_dropped_requests_total{` + instance + `}[$__rate_interval]))`},
+			{"shed", `sum(rate(botdetect_shed_requests_total{` + instance + `}[$__rate_interval]))`},
+		}},
+
+	{kind: "timeseries", title: "Rule matches", unit: "short", x: 0, y: 28, w: 12, h: 8,
+		description: "IPs blacklisted per rule",
+		queries:     [][2]string{{"{{rule}}", `sum by (rule) (increase(botdetect_rule_matches_total{` + instance + `}[$__rate_interval]))`}}},
+	{kind: "timeseries", title: "Lists", unit: "short", x: 12, y: 28, w: 12, h: 8,
+		queries: [][2]string{
+			{"blacklisted", `sum(botdetect_blacklist_size{` + instance + `})`},
+			{"greylisted", `sum(botdetect_greylist_size{` + instance + `})`},
+			{"exempt", `sum(botdetect_exempt_ips{` + instance + `})`},
+		}},
+}
+
+// grafanaDashboard returns the dashboard model. Its data source and instances
+// are variables, so that it can be imported into any Grafana.
+func grafanaDashboard(title, uid string) map[string]interface{} {
+	datasource := map[string]interface{}{"type": "prometheus", "uid": "${datasource}"}
+
+	panels := make([]interface{}, 0, len(grafanaPanels))
+	for i, p := range grafanaPanels {
+		targets := make([]interface{}, 0, len(p.queries))
+		for j, q := range p.queries {
+			targets = append(targets, map[string]interface{}{
+				"refId":        string(rune('A' + j)),
+				"datasource":   datasource,
+				"expr":         q[1],
+				"legendFormat": q[0],
+			})
+		}
+		panel := map[string]interface{}{
+			"id":          i + 1,
+			"type":        p.kind,
+			"title":       p.title,
+			"datasource":  datasource,
+			"gridPos":     map[string]int{"x": p.x, "y": p.y, "w": p.w, "h": p.h},
+			"targets":     targets,
+			"fieldConfig": map[string]interface{}{"defaults": map[string]interface{}{"unit": p.unit}, "overrides": []interface{}{}},
+		}
+		if p.description != "" {
+			panel["description"] = p.description
+		}
+		if p.kind == "bargauge" {
+			panel["options"] = map[string]interface{}{"orientation": "horizontal", "displayMode": "basic",
+				"reduceOptions": map[string]interface{}{"calcs": []string{"lastNotNull"}}}
+		}
+		panels = append(panels, panel)
+	}
+
+	return map[string]interface{}{
+		"uid":           uid,
+		"title":         title,
+		"tags":          []string{"botdetect"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"panels":        panels,
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				map[string]interface{}{
+					"name":       "instance",
+					"label":      "Instance",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      "label_values(botdetect_processed_requests_total, instance)",
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+					"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+				},
+			},
+		},
+	}
+}
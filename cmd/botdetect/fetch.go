@@ -0,0 +1,92 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// loadFetchGuard creates the fetch guard if -fetch-signals is set
+func loadFetchGuard(format *botdetect.InputFormat) (*botdetect.FetchGuard, error) {
+	if !*fetchSignals {
+		return nil, nil
+	}
+	if *fetchAction != "block" && *fetchAction != "challenge" {
+		return nil, fmt.Errorf("invalid fetch-action '%s': expected block or challenge", *fetchAction)
+	}
+	if *fetchWindow <= 0 {
+		return nil, fmt.Errorf("fetch-window must be greater than zero")
+	}
+	if *fetchMaxBareNavigations < 0 {
+		return nil, fmt.Errorf("fetch-max-bare-navigations must not be negative")
+	}
+	if *listen == "" && format != nil && !hasFetchHeader(format) {
+		return nil, fmt.Errorf("fetch-signals need at least one of the headers %s in -input-format or -listen", strings.Join(botdetect.FetchHeaders, ", "))
+	}
+
+	return botdetect.NewFetchGuard(botdetect.FetchOptions{
+		Window:             *fetchWindow,
+		MaxBareNavigations: *fetchMaxBareNavigations,
+		StrictChromium:     *fetchStrictChromium,
+	}), nil
+}
+
+// hasFetchHeader determines whether the format contains one of the headers
+// the fetch guard looks at
+func hasFetchHeader(format *botdetect.InputFormat) bool {
+	for _, name := range botdetect.FetchHeaders {
+		if format.HasHeader(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch records the request with the fetch guard. IPs it flags are
+// blacklisted, or, with -fetch-action=challenge, fetch returns true so that
+// the request is answered with CHALLENGE unless it is blocked anyway.
+func (p *policy) fetch(in *botdetect.Input) bool {
+	if p.fetchGuard == nil {
+		return false
+	}
+
+	challenged := false
+	now := time.Now()
+	for _, ip := range p.decider.IPs(in) {
+		reason, flagged := p.fetchGuard.Observe(ip, in, now)
+		if !flagged {
+			continue
+		}
+
+		if p.fetchChallenge {
+			p.fetchFlagged.Inc(challenge)
+			challenged = true
+			continue
+		}
+		if !p.history.IsBlacklisted(ip) && p.history.Block(ip, reason) {
+			p.fetchFlagged.Inc(block)
+			traceLog("ip: %s, %s", ip, reason)
+		}
+	}
+	return challenged
+}
@@ -0,0 +1,93 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// loadFingerprints creates the fingerprint tracker if -fingerprints is set
+func loadFingerprints(format *botdetect.InputFormat) (*botdetect.FingerprintTracker, error) {
+	if !*fingerprints {
+		return nil, nil
+	}
+	if *fingerprintAction != "block" && *fingerprintAction != "challenge" {
+		return nil, fmt.Errorf("invalid fingerprint-action '%s': expected block or challenge", *fingerprintAction)
+	}
+	if *fingerprintTTL <= 0 {
+		return nil, fmt.Errorf("fingerprint-ttl must be greater than zero")
+	}
+	if *fingerprintMinBlocked <= 0 || *fingerprintMatches <= 0 {
+		return nil, fmt.Errorf("fingerprint-min-blocked and fingerprint-matches must be greater than zero")
+	}
+	if *fingerprintMinRatio <= 0 || *fingerprintMinRatio > 1 {
+		return nil, fmt.Errorf("fingerprint-min-ratio must be greater than 0 and at most 1")
+	}
+	// the User-Agent alone would make every visitor with a popular
+	// browser look like the blacklisted IPs using it
+	if *listen == "" && format != nil && !format.Has("header-order") {
+		return nil, fmt.Errorf("fingerprints need header-order in -input-format, or -listen")
+	}
+
+	return botdetect.NewFingerprintTracker(botdetect.FingerprintOptions{
+		TTL:        *fingerprintTTL,
+		MinBlocked: *fingerprintMinBlocked,
+		MinRatio:   *fingerprintMinRatio,
+		Matches:    *fingerprintMatches,
+	}), nil
+}
+
+// fingerprint records the request with the fingerprint tracker. IPs it flags
+// are blacklisted, or, with -fingerprint-action=challenge, fingerprint
+// returns true so that the request is answered with CHALLENGE unless it is
+// blocked anyway.
+func (p *policy) fingerprint(in *botdetect.Input) bool {
+	if p.fingerprints == nil {
+		return false
+	}
+
+	challenged := false
+	now := time.Now()
+	for _, ip := range p.decider.IPs(in) {
+		reason, blacklisted := p.history.Blacklist().Reason(ip)
+		if blacklisted && botdetect.IsFingerprintReason(reason) {
+			// blacklisted by the tracker itself, which must not make
+			// the fingerprint any worse
+			continue
+		}
+		reason, flagged := p.fingerprints.Observe(ip, in, blacklisted, now)
+		if !flagged {
+			continue
+		}
+
+		if p.fingerprintChallenge {
+			p.fingerprintFlagged.Inc(challenge)
+			challenged = true
+			continue
+		}
+		if !blacklisted && p.history.Block(ip, reason) {
+			p.fingerprintFlagged.Inc(block)
+			traceLog("ip: %s, %s", ip, reason)
+		}
+	}
+	return challenged
+}
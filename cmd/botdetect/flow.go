@@ -0,0 +1,202 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// loadFlowGuard creates the flow guard if -flow-listen or -netflow-listen
+// is set
+func loadFlowGuard() (*botdetect.FlowGuard, error) {
+	if *flowListen == "" && *netflowListen == "" {
+		return nil, nil
+	}
+	if *flowListen != "" {
+		if _, _, err := flowAddress(*flowListen); err != nil {
+			return nil, err
+		}
+	}
+	if *netflowListen != "" {
+		if _, err := net.ResolveUDPAddr("udp", *netflowListen); err != nil {
+			return nil, fmt.Errorf("invalid netflow-listen '%s': %s", *netflowListen, err)
+		}
+		// anyone could send forged flows to blacklist an IP otherwise
+		exporters, err := botdetect.ParseNetworks(splitList(*netflowExporters))
+		if err != nil {
+			return nil, fmt.Errorf("invalid netflow-exporters: %s", err)
+		}
+		if len(exporters) == 0 {
+			return nil, fmt.Errorf("netflow-listen requires the routers allowed to send in -netflow-exporters")
+		}
+		if *netflowTemplates <= 0 || *netflowMaxTemplates <= 0 {
+			return nil, fmt.Errorf("netflow-templates and netflow-max-templates must be greater than zero")
+		}
+	}
+	rules, err := botdetect.ParseFlowRules(*flowRules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("flow-listen and netflow-listen need at least one rule in -flow-rules")
+	}
+	return botdetect.NewFlowGuard(rules), nil
+}
+
+// flowAddress splits an address of -flow-listen, unix:path or tcp:host:port,
+// into the network and the address
+func flowAddress(addr string) (string, string, error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok || address == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("invalid flow-listen '%s': expected unix:path or tcp:host:port", addr)
+	}
+	return network, address, nil
+}
+
+// listenFlows opens the listener for the flow summaries, replacing a socket
+// file left behind by an earlier run
+func listenFlows(addr string) (net.Listener, error) {
+	network, address, err := flowAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// serveFlows reads flow summaries, one JSON object per line, from every
+// connection until the context is done
+func serveFlows(ctx context.Context, l net.Listener, p *policy) {
+	var conns sync.Map
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		conns.Range(func(conn, _ interface{}) bool {
+			conn.(io.Closer).Close()
+			return true
+		})
+	}()
+
+	traceLog("reading flow summaries on %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s flow listener error: %s\n", callsign, err)
+			}
+			return
+		}
+		conns.Store(conn, true)
+		go func() {
+			defer conns.Delete(conn)
+			defer conn.Close()
+			err := botdetect.ReadFlows(conn, p.flow, func(line string, err error) {
+				traceLog("skipping '%s': %s", line, err)
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("%s error reading flow summaries: %s\n", callsign, err)
+			}
+		}()
+	}
+}
+
+// listenNetflow opens the UDP socket for the Netflow collector
+func listenNetflow(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+// serveNetflow decodes the Netflow v5 and IPFIX packets of the exporters in
+// -netflow-exporters until the context is done
+func serveNetflow(ctx context.Context, conn *net.UDPConn, p *policy) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// checked at startup
+	exporters, _ := botdetect.ParseNetworks(splitList(*netflowExporters))
+
+	traceLog("collecting netflow on %s", conn.LocalAddr())
+	decoder := botdetect.NewNetflowDecoder(*netflowTemplates, *netflowMaxTemplates)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s netflow collector error: %s\n", callsign, err)
+			}
+			return
+		}
+		if !isExporter(exporters, addr.IP) {
+			p.netflowRejected.Inc()
+			traceLog("dropping netflow packet from %s", addr)
+			continue
+		}
+		flows, err := decoder.Decode(addr.IP.String(), buf[:n])
+		if err != nil {
+			p.netflowErrors.Inc()
+			traceLog("invalid netflow packet from %s: %s", addr, err)
+		}
+		for _, f := range flows {
+			p.flow(f)
+		}
+	}
+}
+
+// isExporter determines whether the sender of a Netflow packet is one of the
+// exporters
+func isExporter(exporters []*net.IPNet, ip net.IP) bool {
+	for _, n := range exporters {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// flow evaluates the flow rules on the flow summary and blacklists the IP if
+// one matches
+func (p *policy) flow(f botdetect.Flow) {
+	rule, reason, matched := p.flowGuard.Observe(f, time.Now())
+	if !matched || p.history.IsBlacklisted(f.IP) {
+		return
+	}
+	if p.history.BlockWith(f.IP, reason, rule.RuleAction) {
+		p.flowMatches.Inc(rule.String())
+		traceLog("ip: %s, %s", f.IP, reason)
+	}
+}
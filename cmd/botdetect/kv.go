@@ -0,0 +1,102 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/elcamino/botdetect"
+)
+
+// keys below -kv-prefix
+const (
+	kvRules      = "rules"
+	kvManualList = "manual-list"
+)
+
+// parseKV parses -kv: etcd:URL or consul:URL. The rules and the manual list
+// come either from it or from files.
+func parseKV() (botdetect.KVStore, error) {
+	if *kvStore == "" {
+		return nil, nil
+	}
+
+	kind, target, _ := strings.Cut(*kvStore, ":")
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid kv '%s': expected etcd:URL or consul:URL with an http or https URL", *kvStore)
+	}
+	if *rulesFile != "" || *manualList != "" {
+		return nil, fmt.Errorf("kv can't be combined with rules-file or manual-list")
+	}
+	if *kvRetry <= 0 {
+		return nil, fmt.Errorf("kv-retry must be greater than zero")
+	}
+
+	switch kind {
+	case "etcd":
+		store := botdetect.NewEtcdKV(target)
+		store.Token = *kvToken
+		return store, nil
+	case "consul":
+		store := botdetect.NewConsulKV(target)
+		store.Token = *kvToken
+		return store, nil
+	}
+	return nil, fmt.Errorf("invalid kv '%s': expected etcd:URL or consul:URL", *kvStore)
+}
+
+// watchKV applies the rules and the manual list under -kv-prefix whenever
+// they change, the rules after those of -rules. A missing key empties its
+// list, and the rules and the manual list are applied independently, so
+// that a broken one doesn't hold back the other.
+func watchKV(ctx context.Context, store botdetect.KVStore, ns *namespaces, manual *botdetect.ManualList, flagRules []botdetect.Rule) {
+	botdetect.WatchKV(ctx, store, *kvPrefix, *kvRetry, func(values map[string][]byte) error {
+		var errs []string
+
+		rules, err := botdetect.ReadRules(bytes.NewReader(values[kvRules]))
+		if err == nil {
+			err = ns.updateOptions(func(o *botdetect.IPHistoryOptions) {
+				o.Rules = append(append([]botdetect.Rule{}, flagRules...), rules...)
+			})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s%s: %s", *kvPrefix, kvRules, err))
+		} else {
+			log.Printf("%s loaded %d rules from %s%s\n", callsign, len(rules), *kvPrefix, kvRules)
+		}
+
+		if err := manual.Read(bytes.NewReader(values[kvManualList])); err != nil {
+			errs = append(errs, fmt.Sprintf("%s%s: %s", *kvPrefix, kvManualList, err))
+		} else {
+			log.Printf("%s loaded the manual list from %s%s\n", callsign, *kvPrefix, kvManualList)
+		}
+
+		if len(errs) > 0 {
+			return fmt.Errorf("%s", strings.Join(errs, ", "))
+		}
+		return nil
+	}, func(err error) {
+		log.Printf("%s error loading the configuration from %s: %s\n", callsign, *kvStore, err)
+	})
+}
@@ -0,0 +1,302 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elcamino/botdetect/bench"
+	"github.com/namsral/flag"
+)
+
+// loadgenRequest is a generated request and what became of it
+type loadgenRequest struct {
+	ip   net.IP
+	url  string
+	bot  bool
+	time time.Time
+
+	answer  string
+	latency time.Duration
+	err     error
+}
+
+// loadgen generates mixed human and bot traffic, see bench.Traffic, and
+// writes it as input lines to stdout or sends it to /check of a running
+// instance. It prints what the traffic got answered to stderr and returns
+// the exit code.
+func loadgen(args []string) int {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	target := fs.String("target", "pipe", "pipe writes input lines to stdout, an http:// or https:// URL sends the requests to /check of the instance")
+	rate := fs.Float64("rate", 1000, "requests per second (0 sends as fast as possible)")
+	duration := fs.Duration("duration", time.Minute, "stop after this long (0 runs until interrupted or -requests are sent)")
+	requests := fs.Int("requests", 0, "stop after this many requests (0 disables)")
+	ips := fs.Int("ips", 10000, "number of distinct client IPs")
+	bots := fs.Float64("bots", 0.05, "share of the IPs that are bots fetching pages without assets")
+	skew := fs.Float64("skew", 1.1, "exponent of the Zipf distribution of the requests over the IPs, larger values concentrate them on fewer IPs")
+	seed := fs.Int64("seed", 1, "seed of the generated traffic, the same seed generates the same traffic")
+	concurrency := fs.Int("concurrency", 8, "requests sent in parallel to an HTTP target")
+	token := fs.String("token", "", "bearer token for an HTTP target")
+	timed := fs.Bool("time", false, "write the scheduled time of the requests as fourth field to a pipe (remote|xff|url|time), e.g. for test-config")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *rate < 0 || *ips < 2 || *bots <= 0 || *bots > 1 || *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "%s loadgen: rate must not be negative, ips at least 2, concurrency at least 1 and bots within (0, 1]\n", callsign)
+		return 2
+	}
+	if *duration == 0 && *requests == 0 && *rate == 0 && *target != "pipe" {
+		fmt.Fprintf(os.Stderr, "%s loadgen: an unlimited run requires a rate\n", callsign)
+		return 2
+	}
+
+	var send func(*loadgenRequest)
+	if *target == "pipe" {
+		out := bufio.NewWriter(os.Stdout)
+		defer out.Flush()
+		send = func(r *loadgenRequest) {
+			line := r.ip.String() + "|-|" + r.url
+			if *timed {
+				line += "|" + r.time.Format(time.RFC3339Nano)
+			}
+			_, r.err = fmt.Fprintln(out, line)
+			r.answer = "written"
+		}
+		// a single writer keeps the lines in order
+		*concurrency = 1
+	} else {
+		base, err := url.Parse(*target)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+			fmt.Fprintf(os.Stderr, "%s loadgen: target must be pipe or an http:// or https:// URL\n", callsign)
+			return 2
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/check"
+		client := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		}
+		send = func(r *loadgenRequest) {
+			r.answer, r.err = checkRequest(client, base.String(), *token, r)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	traffic := bench.NewTraffic(bench.TrafficOptions{IPs: *ips, Skew: *skew, BotShare: *bots, Seed: *seed})
+
+	generated := make(chan *loadgenRequest, *concurrency)
+	done := make(chan *loadgenRequest, *concurrency)
+	go generate(ctx, traffic, *rate, *requests, generated)
+
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for r := range generated {
+				start := time.Now()
+				send(r)
+				r.latency = time.Since(start)
+				done <- r
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	stats := newLoadgenStats()
+	for r := range done {
+		stats.record(r)
+	}
+	stats.print(os.Stderr, *target != "pipe")
+	if stats.errors > 0 && stats.errors == stats.sent {
+		return 1
+	}
+	return 0
+}
+
+// generate produces requests at rate per second until ctx is done or n
+// requests have been generated, if n is positive
+func generate(ctx context.Context, traffic *bench.Traffic, rate float64, n int, out chan<- *loadgenRequest) {
+	defer close(out)
+
+	start := time.Now()
+	for i := 0; n <= 0 || i < n; i++ {
+		at := start
+		if rate > 0 {
+			at = start.Add(time.Duration(float64(i) / rate * float64(time.Second)))
+			if wait := time.Until(at); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		} else {
+			at = time.Now()
+		}
+
+		ip, url, bot := traffic.Next()
+		select {
+		case <-ctx.Done():
+			return
+		case out <- &loadgenRequest{ip: ip, url: url, bot: bot, time: at}:
+		}
+	}
+}
+
+// checkRequest asks the instance at checkURL for a decision on the request
+func checkRequest(client *http.Client, checkURL, token string, r *loadgenRequest) (string, error) {
+	params := url.Values{"remote": {r.ip.String()}, "url": {r.url}}
+	req, err := http.NewRequest(http.MethodGet, checkURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// loadgenStats sums up the answers to the generated traffic
+type loadgenStats struct {
+	start     time.Time
+	sent      uint64
+	errors    uint64
+	lastError error
+	answers   map[string]uint64
+	latencies []time.Duration
+
+	// ips are the IPs by whether they are bots, blocked those that were
+	// blocked at least once
+	ips     map[bool]map[string]bool
+	blocked map[bool]map[string]bool
+}
+
+func newLoadgenStats() *loadgenStats {
+	return &loadgenStats{
+		start:   time.Now(),
+		answers: make(map[string]uint64),
+		ips:     map[bool]map[string]bool{false: {}, true: {}},
+		blocked: map[bool]map[string]bool{false: {}, true: {}},
+	}
+}
+
+func (s *loadgenStats) record(r *loadgenRequest) {
+	s.sent++
+	if r.err != nil {
+		s.errors++
+		s.lastError = r.err
+		return
+	}
+	s.answers[r.answer]++
+	s.latencies = append(s.latencies, r.latency)
+
+	ip := r.ip.String()
+	s.ips[r.bot][ip] = true
+	if r.answer == block || r.answer == challenge {
+		s.blocked[r.bot][ip] = true
+	}
+}
+
+// print writes the summary of the run, with latencies and the blocked IPs
+// by kind for an HTTP target
+func (s *loadgenStats) print(w io.Writer, decisions bool) {
+	elapsed := time.Since(s.start)
+	fmt.Fprintf(w, "%s %d requests in %s, %.0f/s, %d errors\n", callsign, s.sent, elapsed.Round(time.Millisecond),
+		float64(s.sent)/elapsed.Seconds(), s.errors)
+	if s.lastError != nil {
+		fmt.Fprintf(w, "%s last error: %s\n", callsign, s.lastError)
+	}
+	if !decisions || len(s.latencies) == 0 {
+		return
+	}
+
+	answers := make([]string, 0, len(s.answers))
+	for answer := range s.answers {
+		answers = append(answers, answer)
+	}
+	sort.Strings(answers)
+	for _, answer := range answers {
+		fmt.Fprintf(w, "%s %s: %d\n", callsign, answer, s.answers[answer])
+	}
+
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return s.latencies[int(p*float64(len(s.latencies)-1))]
+	}
+	fmt.Fprintf(w, "%s latency p50 %s, p90 %s, p99 %s, max %s\n", callsign,
+		percentile(0.5), percentile(0.9), percentile(0.99), s.latencies[len(s.latencies)-1])
+
+	for _, bot := range []bool{false, true} {
+		kind := "human"
+		if bot {
+			kind = "bot"
+		}
+		seen := len(s.ips[bot])
+		if seen == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s %d of %d %s IPs blocked (%.1f%%)\n", callsign, len(s.blocked[bot]), seen, kind,
+			float64(len(s.blocked[bot]))*100/float64(seen))
+	}
+}
@@ -0,0 +1,102 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// challenge is the answer to login requests of IPs flagged by the login
+// guard with -login-action=challenge
+const challenge = "CHALLENGE"
+
+// loadLoginGuard creates the login guard if login endpoints are configured
+func loadLoginGuard(format *botdetect.InputFormat) (*botdetect.LoginGuard, error) {
+	if *loginEndpoints == "" {
+		return nil, nil
+	}
+	if *loginAction != "block" && *loginAction != "challenge" {
+		return nil, fmt.Errorf("invalid login-action '%s': expected block or challenge", *loginAction)
+	}
+	if *loginWindow <= 0 {
+		return nil, fmt.Errorf("login-window must be greater than zero")
+	}
+	if *loginMaxFailures < 0 || *loginMaxUserFailures < 0 || *loginMaxUsers < 0 {
+		return nil, fmt.Errorf("login-max-failures, login-max-user-failures and login-max-users must not be negative")
+	}
+	if *listen == "" && (format == nil || !format.Has("status")) {
+		return nil, fmt.Errorf("login-endpoints need the status field in -input-format or -listen")
+	}
+
+	options := botdetect.LoginOptions{
+		Window:          *loginWindow,
+		MaxFailures:     *loginMaxFailures,
+		MaxUserFailures: *loginMaxUserFailures,
+		MaxUsers:        *loginMaxUsers,
+	}
+	for _, e := range splitList(*loginEndpoints) {
+		options.Endpoints = append(options.Endpoints, strings.TrimSpace(e))
+	}
+	for _, s := range splitList(*loginFailureStatus) {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code '%s' in login-failure-status", s)
+		}
+		options.FailureStatus = append(options.FailureStatus, code)
+	}
+	if len(options.FailureStatus) == 0 {
+		return nil, fmt.Errorf("login-failure-status needs at least one status code")
+	}
+
+	return botdetect.NewLoginGuard(options), nil
+}
+
+// login records the request with the login guard. IPs it flags are
+// blacklisted, or, with -login-action=challenge, login is true so that the
+// request is answered with CHALLENGE unless it is blocked anyway.
+func (p *policy) login(in *botdetect.Input) bool {
+	if !p.loginGuard.IsLogin(in.URL) {
+		return false
+	}
+
+	challenged := false
+	now := time.Now()
+	for _, ip := range p.decider.IPs(in) {
+		reason, flagged := p.loginGuard.Attempt(ip, in.URL, in.Status, in.User, now)
+		if !flagged {
+			continue
+		}
+
+		if p.loginChallenge {
+			p.loginFlagged.Inc(challenge)
+			challenged = true
+			continue
+		}
+		if !p.history.IsBlacklisted(ip) && p.history.Block(ip, reason) {
+			p.loginFlagged.Inc(block)
+			traceLog("ip: %s, %s", ip, reason)
+		}
+	}
+	return challenged
+}
@@ -25,7 +25,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/elcamino/botdetect"
@@ -33,16 +36,210 @@ import (
 )
 
 var (
-	timeout          = flag.Duration("timeout", 10*time.Millisecond, "wait this long for a redis response")
-	ignorePrivateIPs = flag.Bool("ignore-private-ips", true, "igore private IPs when building the checksum")
-	timestampFormat  = flag.String("timestamp-format", "15:04", "the key by which to group requests (golang time format, default: hour:minute)")
-	timeSlot         = flag.Duration("timeslot", time.Minute, "the duration to use to group requests")
-	timeWindow       = flag.Duration("window", time.Hour, "the time window to observe")
-	interval         = flag.Duration("interval", 5*time.Second, "build a new blacklist after this much time")
-	maxRequests      = flag.Int("max-requests", 30, "maximum number of requests to allow")
-	maxRatio         = flag.Float64("max-ratio", 0.85, "blacklist IPs if the app/assets ratio is above this threshold")
-	showVersion      = flag.Bool("version", false, "Show the program version")
-	trace            = flag.Bool("trace", false, "trace the decisions the program makes")
+	timeout                  = flag.Duration("timeout", 10*time.Millisecond, "wait this long for every exchange with -redis, lookups that time out treat the IP as not blacklisted")
+	ignorePrivateIPs         = flag.Bool("ignore-private-ips", true, "ignore private IPs in the remote address and the forwarding headers")
+	timestampFormat          = flag.String("timestamp-format", "15:04", "the key by which to group requests (golang time format, default: hour:minute)")
+	timeSlot                 = flag.Duration("timeslot", time.Minute, "the duration to use to group requests")
+	timeWindow               = flag.Duration("window", time.Hour, "the time window to observe")
+	interval                 = flag.Duration("interval", 5*time.Second, "build a new blacklist after this much time")
+	expireInterval           = flag.Duration("expire-interval", time.Minute, "remove expired history and blacklist entries after this much time")
+	blacklistTTL             = flag.Duration("blacklist-ttl", time.Hour, "keep IPs on the blacklist for this long")
+	blacklistMaxSize         = flag.Int("blacklist-max-size", 0, "maximum number of blacklisted IPs, evicting the ones expiring first (0 = no limit)")
+	compactAge               = flag.Duration("compact-age", 0, "merge slots older than this into coarser slots (0 disables compaction)")
+	compactSlot              = flag.Duration("compact-slot", 5*time.Minute, "the duration of compacted slots")
+	maxRequests              = flag.Int("max-requests", 30, "maximum number of requests to allow")
+	maxRatio                 = flag.Float64("max-ratio", 0.85, "blacklist IPs if the app/assets ratio is above this threshold")
+	rules                    = flag.String("rules", "", "additional rules in the form window:max-requests:max-ratio[:warn-requests[:warn-ratio]][;ttl=duration][;severity=block|challenge], comma separated (e.g. 1m:20:0.9,24h:1000:0.85:800;ttl=24h)")
+	logBlocked               = flag.Int("log-blocked", 0, "log at most this many blocked requests per second (0 disables logging)")
+	logBlockedInterval       = flag.Duration("log-blocked-interval", time.Minute, "log at most one blocked request per IP in this interval")
+	listen                   = flag.String("listen", "", "serve /healthz, /readyz and /metrics on this address (e.g. :8080), disabled if empty")
+	manualList               = flag.String("manual-list", "", "file with manually blocked IPs/networks/host names, one per line, prefix with '-' to unblock")
+	manualAllowList          = flag.String("manual-allow-list", "", "file with IPs/networks/host names that are never blocked, one per line, kept apart from -manual-list")
+	manualInterval           = flag.Duration("manual-list-interval", 10*time.Second, "poll the modification time of -manual-list and -manual-allow-list this often, so changes take effect up to this much later")
+	datacenterList           = flag.String("datacenter-list", "", "files with data center networks, comma separated, each optionally prefixed by its format: csv (network,provider; the default), aws, gcp, azure, digitalocean or routes (e.g. \"aws:ip-ranges.json,gcp:cloud.json,own.csv\")")
+	datacenterRules          = flag.String("datacenter-rules", "", "additional rules for data center IPs, same format as -rules")
+	geoDB                    = flag.String("geo-db", "", "CSV file mapping networks to country and continent codes (network,country,continent)")
+	geoAllowCountries        = flag.String("geo-allow-countries", "", "never block IPs from these countries (comma separated ISO codes)")
+	geoDenyCountries         = flag.String("geo-deny-countries", "", "always block IPs from these countries (comma separated ISO codes)")
+	geoAllowContinents       = flag.String("geo-allow-continents", "", "never block IPs from these continents (comma separated codes, e.g. EU)")
+	geoDenyContinents        = flag.String("geo-deny-continents", "", "always block IPs from these continents (comma separated codes, e.g. EU)")
+	verifyCrawlers           = flag.Bool("verify-crawlers", false, "verify search engine crawlers through DNS and never blacklist them")
+	crawlDelay               = flag.Duration("crawl-delay", 0, "answer CHALLENGE to verified crawlers that request more often than this (0 disables)")
+	crawlerTTL               = flag.Duration("crawler-cache-ttl", 24*time.Hour, "cache crawler verifications for this long")
+	dnsTimeout               = flag.Duration("dns-timeout", 2*time.Second, "wait this long for DNS responses")
+	auditEntries             = flag.Int("audit-entries", 0, "keep this many entries per IP for /audit: blocked and challenged requests, blacklist changes and the values of the rules (0 disables the audit trail)")
+	auditIPs                 = flag.Int("audit-ips", 10000, "keep the audit trail for at most this many IPs, dropping those that aren't blacklisted first")
+	feedbackExempt           = flag.Duration("feedback-exempt", 24*time.Hour, "do not blacklist IPs reported as false positives again for this long")
+	autoTune                 = flag.String("auto-tune", "off", "tune max-requests and max-ratio to the observed traffic: off, suggest (only log) or apply")
+	autoTunePercentile       = flag.Float64("auto-tune-percentile", 0.99, "base the tuned max-requests on this percentile of app requests per IP")
+	autoTuneBlock            = flag.Float64("auto-tune-block", 0, "raise max-ratio until at most this fraction of the IPs is blacklisted by the main rule, e.g. 0.005 for the top 0.5% (0 keeps max-ratio)")
+	autoTuneFactor           = flag.Float64("auto-tune-factor", 1.5, "multiply the percentile by this factor")
+	autoTuneMin              = flag.Int("auto-tune-min", 10, "never tune max-requests below this")
+	autoTuneInterval         = flag.Duration("auto-tune-interval", 10*time.Minute, "tune the thresholds after this much time")
+	anomaly                  = flag.String("anomaly", "off", "detect IPs deviating from their own baseline: off, log or block")
+	anomalyThreshold         = flag.Float64("anomaly-threshold", 4, "flag slots exceeding the baseline by this many standard deviations")
+	anomalyAlpha             = flag.Float64("anomaly-alpha", 0.1, "weight of the newest slot in the baseline")
+	anomalyMinRequests       = flag.Int("anomaly-min-requests", 20, "ignore slots with fewer app requests than this")
+	anomalyWarmup            = flag.Int("anomaly-warmup", 10, "number of slots a baseline needs before it is used")
+	anomalyTTL               = flag.Duration("anomaly-ttl", 7*24*time.Hour, "keep the baselines of IPs without requests for this long, 0 to drop them with their slots")
+	shadowRules              = flag.String("shadow-rules", "", "evaluate these rules in shadow mode next to the regular ones, same format as -rules; results only show up in the metrics")
+	shadowQueue              = flag.Int("shadow-queue", botdetect.DefaultShadowQueue, "number of requests queued for the shadow rules before they are dropped and counted in botdetect_policy_dropped_total")
+	rulesFile                = flag.String("rules-file", "", "file with additional rules, one per line in the -rules format; changes are applied without losing state")
+	rulesInterval            = flag.Duration("rules-file-interval", 10*time.Second, "check the rules file for changes after this much time")
+	stateFile                = flag.String("state-file", "", "restore the history and blacklist from this file at startup and save them to it periodically and on shutdown")
+	stateInterval            = flag.Duration("state-interval", 5*time.Minute, "save the state after this much time (0 only saves on shutdown)")
+	inputFormat              = flag.String("input-format", botdetect.DefaultInputFormat, "the fields of an input line separated by |: remote, xff, url, time, bytes, status, user, content-type, connections, cache-status, header-order, header:<Name> or - to ignore a field; the last field takes the rest of the line")
+	proxyDetection           = flag.String("proxy-detection", "off", "detect requests through open proxies and anonymizers by their headers: off, log or block")
+	proxyHeaders             = flag.String("proxy-headers", strings.Join(botdetect.DefaultProxyHeaders, ","), "headers that give a proxy away, comma separated; they need to be part of -input-format")
+	tlsCert                  = flag.String("tls-cert", "", "serve HTTPS with this PEM certificate")
+	tlsKey                   = flag.String("tls-key", "", "the PEM key of -tls-cert")
+	tlsClientCA              = flag.String("tls-client-ca", "", "require client certificates signed by the CAs in this PEM file (mutual TLS)")
+	authTokenFile            = flag.String("auth-token-file", "", "require one of the API client tokens in this file ([name] token [namespace] per line) for all endpoints except /healthz and /readyz")
+	dedupHorizon             = flag.Duration("dedup-horizon", 0, "count events with the same IP, URL and time only once within this duration, for log pipelines that deliver lines more than once; needs time in -input-format (0 disables)")
+	dedupEntries             = flag.Int("dedup-entries", 100000, "remember at most this many events for -dedup-horizon")
+	inputTimeFormat          = flag.String("input-time-format", time.RFC3339, "the format of the time field in -input-format (golang time format)")
+	queueSize                = flag.Int("queue-size", 1000, "buffer this many requests before reading input blocks")
+	ingestMaxQueue           = flag.Float64("ingest-max-queue", 0.8, "warn when the request queue is fuller than this fraction (0 disables)")
+	ingestMaxLag             = flag.Duration("ingest-max-lag", 0, "warn when requests are processed this long after their time field (0 disables)")
+	ingestMinRate            = flag.Float64("ingest-min-rate", 0, "warn when fewer requests per second are processed (0 disables)")
+	ingestInterval           = flag.Duration("ingest-check-interval", time.Minute, "check the ingest thresholds after this much time")
+	subject                  = flag.String("subject", "all", "which IPs of the forwarding chain to count and check: all, leftmost or rightmost-untrusted")
+	trustedProxies           = flag.String("trusted-proxies", "", "networks of your own proxies, comma separated, skipped by -subject=rightmost-untrusted")
+	warnRequests             = flag.Int("warn-requests", 0, "log IPs exceeding this many requests (with -warn-ratio) without blocking them, a warn tier for -max-requests (0 disables)")
+	warnRatio                = flag.Float64("warn-ratio", 0.85, "the app/assets ratio of the -warn-requests tier")
+	scheduledRules           = flag.String("scheduled-rules", "", "rules replacing -max-requests and -rules while a cron-like schedule (minute hour day month weekday, local time) matches, in the form schedule=rules separated by | (e.g. \"* 0-5 * * *=1h:10:0.8\")")
+	gracePeriod              = flag.Duration("grace-period", 0, "only learn and log for this long after the start instead of blacklisting IPs (0 disables)")
+	ptrPatterns              = flag.String("ptr-patterns", "", "scale the rules for IPs whose PTR record matches, in the form pattern=factor or pattern=never (e.g. \"*.compute.amazonaws.com=0.5,*.googlebot.com=never\")")
+	ptrNear                  = flag.Float64("ptr-near", 0.5, "look up the PTR record of IPs that reach this fraction of the max-requests of a rule")
+	ptrCacheTTL              = flag.Duration("ptr-cache-ttl", time.Hour, "cache PTR records for this long")
+	annotateOwners           = flag.Bool("annotate-owners", false, "look up the network owner and abuse contact of blacklisted IPs through RDAP and record them in the audit trail")
+	rdapURL                  = flag.String("rdap-url", botdetect.DefaultRDAPURL, "RDAP service to query for IP ownership")
+	rdapTimeout              = flag.Duration("rdap-timeout", 5*time.Second, "wait this long for RDAP responses")
+	rdapCacheTTL             = flag.Duration("rdap-cache-ttl", 24*time.Hour, "cache RDAP results for this long")
+	reportInterval           = flag.Duration("report-interval", 0, "deliver a report of the top offenders every interval, e.g. 24h (0 disables)")
+	reportTop                = flag.Int("report-top", 10, "number of entries in the top lists of the report")
+	reportFile               = flag.String("report-file", "", "append reports to this file")
+	reportWebhook            = flag.String("report-webhook", "", "post reports as JSON to this URL")
+	reportEmail              = flag.String("report-email", "", "mail reports to these comma separated addresses")
+	reportSMTP               = flag.String("report-smtp", "", "SMTP relay (host:port) for report-email")
+	reportFrom               = flag.String("report-from", "", "sender address for report-email")
+	tenantConfig             = flag.String("tenant-config", "", "file with option overrides per namespace (namespace key=value ...)")
+	tenantByHost             = flag.Bool("tenant-by-host", false, "choose the namespace by the host parameter of /check and /feedback for clients without a namespace")
+	uaDB                     = flag.String("ua-db", "", "file replacing the built-in user agent database (class name substring per line)")
+	uaDBInterval             = flag.Duration("ua-db-interval", time.Minute, "check the user agent database for changes after this much time")
+	uaPolicy                 = flag.String("ua-policy", "", "block or allow bot classes by user agent, e.g. \"seo=block,monitoring=allow\" (classes: ai, search, seo, monitoring, scraper)")
+	aiPolicy                 = flag.String("ai-policy", "", "allow, block or limit AI crawlers by name or * for all of them, e.g. \"*=block,GPTBot=limit\"")
+	aiRanges                 = flag.String("ai-ranges", "", "CSV file with the networks published for AI crawlers (network,name); crawlers claiming a listed name from elsewhere are treated as spoofed")
+	aiCrawlDelay             = flag.Duration("ai-crawl-delay", 10*time.Second, "minimum delay between requests of an AI crawler with the limit policy")
+	bandwidthRules           = flag.String("bandwidth-rules", "", "blacklist IPs that received more than max-bytes within window, in the form window:max-bytes (e.g. \"1h:500MB,24h:5GB\"); needs the bytes input field")
+	walkPatterns             = flag.String("walk-patterns", "", "blacklist IPs walking through numbered pages or IDs: query parameters and path expressions with one capture group, comma separated (e.g. \"page,offset,^/item/(\\d+)\")")
+	walkSteps                = flag.Int("walk-steps", 20, "number of steps in a row after which an IP walks")
+	walkMaxGap               = flag.Int("walk-max-gap", 1, "largest increase of the number that still counts as a step")
+	loginEndpoints           = flag.String("login-endpoints", "", "comma separated paths of login endpoints to protect against credential stuffing, a trailing * matches a prefix (e.g. \"/login,/api/auth/*\")")
+	loginFailureStatus       = flag.String("login-failure-status", "401,403", "comma separated response status codes of failed logins")
+	loginWindow              = flag.Duration("login-window", 10*time.Minute, "time window over which failed logins are counted")
+	loginMaxFailures         = flag.Int("login-max-failures", 10, "flag IPs with more failed logins (0 disables)")
+	loginMaxUserFailures     = flag.Int("login-max-user-failures", 0, "flag IPs failing to log in as a user name with more failed logins across all IPs (0 disables)")
+	loginMaxUsers            = flag.Int("login-max-users", 3, "flag IPs failing to log in as more user names (0 disables)")
+	loginAction              = flag.String("login-action", "block", "what to do with flagged IPs: block blacklists them, challenge answers CHALLENGE to their login requests")
+	crawlerCacheFile         = flag.String("crawler-cache-file", "", "restore the crawler verifications from this file at startup and save them to it every -state-interval and on shutdown")
+	lookupConcurrent         = flag.Int("lookup-max-concurrent", 32, "run at most this many DNS lookups of each kind at the same time; IPs seen meanwhile are looked up later")
+	lookupNegativeTTL        = flag.Duration("lookup-negative-ttl", 0, "cache empty DNS and RDAP results (no PTR record, not a crawler) for this long (0 means the cache TTL of the lookup)")
+	lookupErrorTTL           = flag.Duration("lookup-error-ttl", time.Minute, "retry failed DNS and RDAP lookups after this long, keeping earlier results meanwhile")
+	lookupEntries            = flag.Int("lookup-max-entries", 100000, "cache the DNS and RDAP results of at most this many IPs per lookup kind")
+	flushEvery               = flag.Int("flush-every", 1, "flush the answers on stdout after this many decisions; keep 1 for interactive callers like RewriteMap, raise it for batch runs over log files (0 flushes only when the buffer is full and at the end of the input)")
+	printSummary             = flag.Bool("summary", false, "print a summary of the lines read from stdin to stderr at the end of the input and on shutdown")
+	summaryFile              = flag.String("summary-file", "", "write the summary of the lines read from stdin to this file at the end of the input and on shutdown, as JSON if the name ends in .json")
+	urlNormalize             = flag.String("url-normalize", "", "canonicalize URLs before they are classified, a comma separated list of steps taken in order: lowercase-host, decode, collapse-slashes, strip-query (e.g. \"decode,collapse-slashes,strip-query\")")
+	assetTypes               = flag.String("asset-types", "", "media types of responses counted as assets rather than app requests when content-type is part of -input-format, comma separated type/subtype or type/* (defaults to images, fonts, audio, video, CSS, JavaScript and WebAssembly)")
+	maxConnections           = flag.Int("max-connections", 0, "blacklist IPs holding more than this many connections open for -max-connections-duration, counted from the connections input field or the /connections endpoint (0 disables)")
+	maxConnectionsDuration   = flag.Duration("max-connections-duration", time.Minute, "how long an IP must hold more than -max-connections connections to be blacklisted")
+	cacheRules               = flag.String("cache-rules", "", "blacklist IPs whose requests missed the CDN or proxy cache more often than max-miss-ratio within window, once min-requests have a known cache status, in the form window:min-requests:max-miss-ratio (e.g. \"10m:50:0.9\"); needs the cache-status input field")
+	freezeFor                = flag.Duration("freeze-for", 0, "start with automatic blacklisting frozen for this long; blacklisted IPs stay blocked (0 disables)")
+	passThroughFor           = flag.Duration("pass-through-for", 0, "start answering OK to every request and freeze blacklisting for this long (0 disables)")
+	maintenanceMax           = flag.Duration("maintenance-max-duration", 24*time.Hour, "longest freeze or pass-through that POST /maintenance accepts")
+	canary                   = flag.Float64("canary", 0, "only blacklist this percentage of the matching IPs, chosen by a hash of the IP, and log the others as would-block (0 blacklists all)")
+	reputationHalfLife       = flag.Duration("reputation-half-life", 0, "remember blacklisted and well-behaved IPs beyond the windows of the rules, with scores decaying with this half-life, e.g. 168h (0 disables)")
+	reputationPenalty        = flag.Float64("reputation-penalty", 1, "lower the reputation score of an IP by this much whenever it is blacklisted")
+	reputationReward         = flag.Float64("reputation-reward", 0.1, "raise the reputation score of an IP by this much for every -reputation-reward-interval it sends requests without being blacklisted")
+	reputationRewardInterval = flag.Duration("reputation-reward-interval", 24*time.Hour, "how long an IP has to behave to be rewarded")
+	reputationMinFactor      = flag.Float64("reputation-min-factor", 0.25, "lowest factor the thresholds of an IP with a bad reputation are multiplied by")
+	reputationMaxFactor      = flag.Float64("reputation-max-factor", 2, "highest factor the thresholds of an IP with a good reputation are multiplied by")
+	shedMaxQueue             = flag.Float64("shed-max-queue", 0, "shed load when the request queue is fuller than this fraction (0 disables)")
+	shedMaxLag               = flag.Duration("shed-max-lag", 0, "shed load when requests are processed this long after their time field (0 disables)")
+	shedMaxCPU               = flag.Float64("shed-max-cpu", 0, "shed load when the process uses more than this fraction of the available CPUs (0 disables)")
+	shedSample               = flag.Int("shed-sample", 10, "count only every nth request, n times, while shedding load")
+	shedInterval             = flag.Duration("shed-check-interval", 10*time.Second, "check the shedding thresholds after this much time")
+	stateCodec               = flag.String("state-codec", botdetect.DefaultStateCodec, "format of the state file: json, gob, msgpack or protobuf; files in any format are read")
+	annotateResponses        = flag.Bool("annotate", false, "add the X-Botdetect-Score, X-Botdetect-Remaining and X-Botdetect-Flags headers to the answers of /check and /auth")
+	uncountedPaths           = flag.String("uncounted-paths", "", "comma separated paths of requests that are never counted, e.g. health checks and beacons, a trailing * matches a prefix (e.g. \"/healthz,/.well-known/*\")")
+	profile                  = flag.String("profile", "", "apply the flag defaults tuned for a kind of site to the flags that aren't set: spa for single-page applications")
+	apiPaths                 = flag.String("api-paths", "", "comma separated paths of XHR/fetch endpoints, whose requests count as assets rather than app requests, a trailing * matches a prefix (e.g. \"/api/*\")")
+	fetchMetadata            = flag.Bool("fetch-metadata", false, "classify requests by their Sec-Fetch-Dest header when it is known: document loads count as app requests, XHR/fetch calls and subresources as assets")
+	fetchSignals             = flag.Bool("fetch-signals", false, "blacklist IPs whose Sec-Fetch-* headers and client hints show combinations no browser sends, or that navigate without fetching subresources")
+	fetchWindow              = flag.Duration("fetch-window", 10*time.Minute, "time window over which navigations without subresources are counted")
+	fetchMaxBareNavigations  = flag.Int("fetch-max-bare-navigations", 20, "flag IPs with more navigations without a single subresource fetch in between (0 disables)")
+	fetchStrictChromium      = flag.Bool("fetch-strict-chromium", false, "flag requests from Chrome 89 or later without fetch metadata and client hints, for sites served over HTTPS only")
+	fetchAction              = flag.String("fetch-action", "block", "what to do with IPs flagged by -fetch-signals: block blacklists them, challenge answers CHALLENGE to their requests")
+	unverifiedFactor         = flag.Float64("unverified-factor", 0, "scale the thresholds of IPs without a request verified by a challenge cookie within the window by this factor, e.g. 0.5 (0 disables)")
+	verifiedHeaderName       = flag.String("verified-header", botdetect.DefaultVerifiedHeader, "the header through which the proxy tells that a request carried a valid challenge cookie, see -unverified-factor")
+	rateLimitHeaders         = flag.Bool("rate-limit-headers", false, "add the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers to the answers of /check and /auth")
+	watchdogStalls           = flag.Int("watchdog-stalls", 3, "report a background loop as stuck after this many intervals without progress (0 disables the watchdog)")
+	watchdogRestart          = flag.Bool("watchdog-restart", false, "start a new goroutine for a background loop the watchdog finds stuck")
+	flowListen               = flag.String("flow-listen", "", "experimental: read per-IP flow summaries of an eBPF/XDP exporter, one JSON object per line, on this address (unix:path or tcp:host:port), disabled if empty")
+	flowRules                = flag.String("flow-rules", "", "comma separated rules for the flow summaries in the form window:max-packets:max-syns[:max-bytes], 0 disables a limit (e.g. \"10s:20000:500,1m:0:2000:100MB;ttl=1h\")")
+	netflowListen            = flag.String("netflow-listen", "", "collect Netflow v5 and IPFIX records on this UDP address (e.g. :2055) and evaluate -flow-rules on them, disabled if empty")
+	netflowExporters         = flag.String("netflow-exporters", "", "addresses or networks of the routers allowed to send to -netflow-listen, comma separated; packets from other senders are dropped")
+	netflowTemplates         = flag.Int("netflow-templates", 64, "number of IPFIX templates kept per exporter")
+	netflowMaxTemplates      = flag.Int("netflow-max-templates", 1024, "number of IPFIX templates kept of all exporters")
+	runawayPercent           = flag.Float64("runaway-percent", 0, "disable a rule that blacklists more than this percentage of the client IPs within -runaway-interval until it is re-enabled through /disabled-rules (0 disables the guard)")
+	runawayInterval          = flag.Duration("runaway-interval", 10*time.Minute, "time over which -runaway-percent counts the client IPs")
+	runawayMinClients        = flag.Int("runaway-min-clients", 100, "only disable rules once this many client IPs have been seen within -runaway-interval")
+	runawayWebhook           = flag.String("runaway-webhook", "", "post disabled rules as JSON to this URL")
+	sinks                    = flag.String("sinks", "", "comma-separated list of sinks receiving every decision as JSON: stdout (instead of the answers), file:PATH, webhook:URL or kafka:URL of a topic on a Kafka REST proxy")
+	sinkBuffer               = flag.Int("sink-buffer", botdetect.DefaultSinkBuffer, "number of decisions buffered per sink before they are dropped")
+	greylistPromote          = flag.Int("greylist-promote", 0, "greylist IPs exceeding the warn tier of a rule and blacklist them once they exceed one in this many more evaluations (0 disables the greylist)")
+	greylistDemote           = flag.Duration("greylist-demote", 10*time.Minute, "take IPs off the greylist that exceeded no warn tier for this long")
+	greylistTTL              = flag.Duration("greylist-ttl", time.Hour, "the longest an IP stays on the greylist")
+	noPublicIP               = flag.String("no-public-ip", "allow", "what to do with requests without a public IP, e.g. with garbage in X-Forwarded-For: allow, block or challenge")
+	asnList                  = flag.String("asn-list", "", "CSV file mapping networks to autonomous systems (network,asn,name) to count the blocked decisions per AS in botdetect_blocked_asn_total")
+	kvStore                  = flag.String("kv", "", "watch a key prefix in etcd or Consul for the rules and the manual list, applied live: etcd:URL or consul:URL, e.g. consul:http://127.0.0.1:8500")
+	kvPrefix                 = flag.String("kv-prefix", "botdetect/", "prefix of the keys in -kv: PREFIXrules holds rules in the -rules-file format, PREFIXmanual-list a manual list")
+	kvToken                  = flag.String("kv-token", "", "ACL token for Consul or authentication token for etcd")
+	kvRetry                  = flag.Duration("kv-retry", 10*time.Second, "retry -kv after this much time when it fails")
+	walFile                  = flag.String("wal", "", "append every blacklist change to this log, replayed on top of the state at startup, e.g. after a crash")
+	walMaxSize               = flag.String("wal-max-size", "64MB", "rotate the blacklist log when it grows beyond this size (0 never rotates)")
+	walKeep                  = flag.Int("wal-keep", 5, "number of rotated blacklist logs to keep, as -wal.1 to -wal.N")
+	walSync                  = flag.Duration("wal-sync", time.Second, "sync the blacklist log to disk at this interval (0 only before rotations and at shutdown)")
+	fingerprints             = flag.Bool("fingerprints", false, "blacklist new IPs whose first requests match the fingerprint (User-Agent and header order) and URL patterns of several blacklisted IPs, as distributed scrapers rotating their IPs do")
+	fingerprintTTL           = flag.Duration("fingerprint-ttl", time.Hour, "remember the fingerprints of IPs and of blacklisted IPs for this much time")
+	fingerprintMinBlocked    = flag.Int("fingerprint-min-blocked", 3, "number of blacklisted IPs a fingerprint has to be seen on before new IPs with it are flagged")
+	fingerprintMatches       = flag.Int("fingerprint-matches", 3, "number of matching requests after which a new IP is flagged")
+	fingerprintAction        = flag.String("fingerprint-action", "block", "what to do with IPs flagged by -fingerprints: block blacklists them, challenge answers CHALLENGE to their requests")
+	surge                    = flag.Bool("surge", false, "detect surges: requests to a URL pattern or the whole site rising -surge-factor times above their baseline from many new IPs")
+	surgeSlot                = flag.Duration("surge-slot", time.Minute, "time over which requests are counted for -surge")
+	surgeFactor              = flag.Float64("surge-factor", 10, "how many times a slot has to exceed the baseline to be a surge")
+	surgeMinRequests         = flag.Int("surge-min-requests", 1000, "number of requests a slot needs to be a surge")
+	surgeMinNewIPs           = flag.Int("surge-min-new-ips", 100, "number of IPs without a request within the last hour a slot needs to be a surge")
+	surgeWarmup              = flag.Int("surge-warmup", 30, "number of slots to learn the baselines before surges are detected")
+	surgeHold                = flag.Duration("surge-hold", 15*time.Minute, "a surge lasts this much time after its last slot")
+	surgeAction              = flag.String("surge-action", "tighten", "what to do during a surge: tighten scales the thresholds of unverified IPs by -surge-tighten-factor, challenge answers CHALLENGE to unverified requests to the surging URL pattern, log only logs it")
+	surgeTighten             = flag.Float64("surge-tighten-factor", 0.5, "scale the thresholds of IPs without a request verified by a challenge cookie by this factor during a surge with -surge-action=tighten")
+	fingerprintMinRatio      = flag.Float64("fingerprint-min-ratio", 0.5, "share of the IPs seen with a fingerprint that have to be blacklisted before new IPs with it are flagged, so that popular browsers never are")
+	auditFile                = flag.String("audit-file", "", "restore the audit trail from this file at startup and save it to it every -state-interval and on shutdown")
+	redisAddrs               = flag.String("redis", "", "comma-separated addresses of the Redis server, sentinels or cluster nodes the replicas share their blacklist and reputations through, e.g. 10.0.0.1:6379 (empty keeps them in memory)")
+	redisTopology            = flag.String("redis-topology", "single", "how -redis is deployed: single, sentinel or cluster")
+	redisMaster              = flag.String("redis-master", "", "name of the master monitored by the sentinels of -redis")
+	redisUsername            = flag.String("redis-username", "", "user to authenticate with at Redis, default with -redis-password")
+	redisPassword            = flag.String("redis-password", "", "password to authenticate with at Redis")
+	redisDB                  = flag.Int("redis-db", 0, "Redis database to use, which clusters don't have")
+	redisPrefix              = flag.String("redis-prefix", "botdetect:", "prefix of the keys in Redis, so that several fleets can share one")
+	redisCache               = flag.Int("redis-cache", 10000, "cache this many blacklist lookups in memory, invalidated by Redis when the entries change (0 disables)")
+	redisRetention           = flag.Duration("redis-retention", 24*time.Hour, "keep the request counts of -replica in Redis this long, at least the longest window of the rules")
+	replica                  = flag.String("replica", "", "name of this replica in -redis; if set, the rules count the requests of all replicas")
+	leaderLease              = flag.Duration("leader-lease", 0, "with -replica, only the replica holding a lease of this duration in -redis evaluates the rules, the others hand their IPs over to it (0: every replica evaluates them)")
+	showVersion              = flag.Bool("version", false, "Show the program version")
+	trace                    = flag.Bool("trace", false, "trace the decisions the program makes")
 
 	// Version contains the program version
 	Version string
@@ -68,80 +265,1009 @@ func traceLog(msg string, args ...interface{}) {
 
 func main() {
 	flag.Parse()
+	profileErr := applyProfile()
 
 	if *showVersion {
 		fmt.Printf("%s %s, built at %s on %s\n", os.Args[0], Version, BuildDate, BuildHost)
 		os.Exit(0)
 	}
+	if flag.Arg(0) == "loadgen" {
+		// the generated traffic doesn't depend on the configuration
+		os.Exit(loadgen(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "dashboard" {
+		// the dashboard only depends on the metrics
+		os.Exit(dashboard(flag.Args()[1:]))
+	}
 
 	traceLog(strings.Join(os.Environ(), "\n"))
 
+	options, err := historyOptions()
+	manual, manualErr := loadManualList()
+	geo, geoErr := loadGeoPolicy()
+	var asns *botdetect.ASNList
+	var asnErr error
+	if *asnList != "" {
+		asns, asnErr = botdetect.LoadASNList(*asnList)
+	}
+	shadow, shadowErr := botdetect.ParseRules(*shadowRules)
+	if shadowErr == nil && *shadowQueue <= 0 {
+		shadowErr = fmt.Errorf("shadow-queue must be greater than zero")
+	}
+	format, formatErr := botdetect.ParseInputFormat(*inputFormat)
+	proxies, proxyErr := loadProxyDetector(format)
+	auth, authErr := loadServerAuth()
+	dedupErr := checkDedup(format)
+	bandwidthErr := checkBandwidth(format)
+	cacheErr := checkCacheRules(format)
+	subjectErr := checkSubject()
+	reportErr := checkReport()
+	tenants, tenantErr := loadTenantConfig(options)
+	agents, agentClasses, agentErr := loadUserAgents(format)
+	aiPolicies, aiNetworks, aiErr := loadAIPolicy(format)
+	loginGuard, loginErr := loadLoginGuard(format)
+	fetchGuard, fetchErr := loadFetchGuard(format)
+	fingerprintTracker, fingerprintErr := loadFingerprints(format)
+	surgeDetector, surgeErr := loadSurgeDetector(format)
+	flowGuard, flowErr := loadFlowGuard()
+	verifiedErr := checkVerified(format)
+	sinkSpecs, sinkErr := parseSinks()
+	crawlerErr := checkCrawlers()
+	lookupErr := checkLookupLimits()
+	outputErr := checkOutput()
+	noPublicIPErr := checkNoPublicIP()
+	_, stateCodecErr := botdetect.LookupStateCodec(*stateCodec)
+	normalizer, normalizeErr := botdetect.ParseURLNormalizer(*urlNormalize)
+	maintenanceErr := checkMaintenance()
+	kv, kvErr := parseKV()
+	walSize, walErr := parseWALSize()
+	redisStore, redisErr := parseRedis()
+	var rulesFileErr error
+	if *rulesFile != "" {
+		_, rulesFileErr = botdetect.LoadRules(*rulesFile)
+	}
+	errs := []error{err, manualErr, geoErr, shadowErr, rulesFileErr, formatErr, proxyErr, authErr, dedupErr, bandwidthErr, cacheErr, subjectErr, reportErr, tenantErr, agentErr, aiErr, loginErr, crawlerErr, lookupErr, outputErr, normalizeErr, maintenanceErr, stateCodecErr, profileErr, fetchErr, verifiedErr, flowErr, sinkErr, noPublicIPErr, asnErr, kvErr, walErr, fingerprintErr, surgeErr, redisErr}
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validate(options, errs...))
+	case "test-config":
+		if invalid(errs...) {
+			os.Exit(1)
+		}
+		os.Exit(testConfig(flag.Args()[1:], options, manual, geo, format, normalizer))
+	case "analyze":
+		if invalid(errs...) {
+			os.Exit(1)
+		}
+		os.Exit(analyze(flag.Args()[1:], options, manual, geo, format, normalizer))
+	}
+	for _, err := range errs {
+		if err != nil {
+			log.Fatalf("%s %s", callsign, err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	history := botdetect.NewHistory(ctx, &botdetect.HistoryOptions{
-		TimestampFormat: *timestampFormat,
-		TimeSlot:        *timeSlot,
-		Window:          *timeWindow,
-		Interval:        *interval,
-		MaxRequests:     uint64(*maxRequests),
-		MaxRatio:        *maxRatio,
-	})
-	privIP := botdetect.NewIP()
+	if *annotateOwners {
+		options.Ownership = botdetect.NewOwnershipAnnotator(ctx, botdetect.NewRDAPClient(*rdapURL),
+			options.Audit, *rdapTimeout, *rdapCacheTTL, 1000)
+		options.Ownership.SetLookupLimits(lookupLimits())
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	var redisErrors *botdetect.CounterVec
+	if redisStore != nil {
+		redisErrors, err = useRedis(ctx, options, redisStore)
+		if err != nil {
+			log.Fatalf("%s %s", callsign, err)
+		}
+	}
 
+	engine, err := botdetect.NewLocalEngine(ctx, options)
+	if err != nil {
+		log.Fatalf("%s %s", callsign, err)
+	}
+	history := engine.IPHistory
+	if redisStore != nil {
+		shareBlacklist(ctx, history.Blacklist(), redisStore, options.Metrics, redisErrors)
+	}
 	reqChan := history.RequestChannel()
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		traceLog("processing '%s'", line)
+	var snapshot time.Time
+	if *stateFile != "" {
+		snapshot, err = loadState(history, *stateFile)
+		if err != nil {
+			log.Fatalf("%s error loading the state: %s", callsign, err)
+		}
+		if *stateInterval > 0 {
+			go saveStateLoop(ctx, history, *stateFile, *stateInterval)
+		}
+	}
 
-		fields := strings.Split(scanner.Text(), "|")
-		if len(fields) < 2 {
-			traceLog("invalid input: %s. Letting it pass.", line)
-			os.Stdout.Write([]byte(ok + "\n"))
-			continue
+	var wal *botdetect.BlacklistWAL
+	if *walFile != "" {
+		wal, err = openWAL(history, walSize, snapshot, options.Metrics)
+		if err != nil {
+			log.Fatalf("%s error opening the blacklist log: %s", callsign, err)
+		}
+	}
+
+	if options.Audit != nil {
+		if *auditFile != "" {
+			if err := loadAudit(options.Audit, *auditFile); err != nil {
+				log.Fatalf("%s error loading the audit trail: %s", callsign, err)
+			}
+			if *stateInterval > 0 {
+				go saveAuditLoop(ctx, options.Audit, *auditFile, *stateInterval)
+			}
+		}
+		go options.Audit.Follow(ctx, history.Blacklist())
+	}
+
+	var fanout *botdetect.FanOut
+	if len(shadow) > 0 {
+		// the shadow history shares the options except for the rules, its
+		// own metrics and audit trail would collide with the primary ones
+		shadowOptions := *options
+		shadowOptions.Window = 0
+		shadowOptions.Rules = shadow
+		shadowOptions.Schedules = nil
+		shadowOptions.Metrics = nil
+		shadowOptions.Audit = nil
+		shadowOptions.Ownership = nil
+		shadowOptions.Walks = nil
+		shadowOptions.Concurrency = nil
+		shadowOptions.Reputation = nil
+		shadowOptions.Replication = nil
+		shadowOptions.Leader = nil
+
+		shadowHistory, err := botdetect.NewIPHistory(ctx, &shadowOptions)
+		if err != nil {
+			log.Fatalf("%s shadow rules: %s", callsign, err)
 		}
-		remote := fields[0]
-		xff := fields[1]
-		url := strings.Join(fields[2:], "|")
+		fanout = botdetect.NewFanOut(ctx, options.Metrics,
+			botdetect.Policy{Name: "primary", History: history},
+			botdetect.Policy{Name: "shadow", History: shadowHistory, Queue: *shadowQueue},
+		)
+		reqChan = fanout.RequestChannel()
+	}
 
-		ips := []net.IP{}
-		if remote := parseIP(remote); remote != nil && !privIP.IsPrivate(remote) {
-			traceLog("adding remote IP: %s", remote.String())
-			ips = append(ips, remote)
+	pol := &policy{
+		history: history,
+		engine:  engine,
+		fanout:  fanout,
+		manual:  manual,
+		geo:     geo,
+		audit:   options.Audit,
+		decisions: options.Metrics.Counter("botdetect_decisions_total",
+			"Number of decisions by outcome and reason", "decision", "reason"),
+		asns: asns,
+		asnBlocks: options.Metrics.Counter("botdetect_blocked_asn_total",
+			"Number of blocked and challenged decisions by the autonomous system of the IP in -asn-list", "asn", "name"),
+		proxies:    proxies,
+		proxyBlock: *proxyDetection == "block",
+		noPublicIP: *noPublicIP,
+		proxied: options.Metrics.Counter("botdetect_proxied_requests_total",
+			"Number of requests that came through an open proxy or anonymizer"),
+		blockLog: newBlockLogger(*logBlocked, *logBlockedInterval),
+		duplicates: options.Metrics.Counter("botdetect_duplicate_requests_total",
+			"Number of requests that were delivered more than once and not counted again"),
+		dropped: options.Metrics.Counter("botdetect_dropped_requests_total",
+			"Number of requests not recorded because the queue was full while shedding load"),
+		unknown: options.Metrics.Counter("botdetect_unknown_hops_total",
+			"Number of requests with an unknown or obfuscated hop, by whether they fell back to the nearest valid hop", "outcome"),
+		stats:        &tenantStats{},
+		agents:       agents,
+		agentClasses: agentClasses,
+		aiPolicy:     aiPolicies,
+		aiRanges:     aiNetworks,
+		aiDelay:      botdetect.NewCrawlDelay(*aiCrawlDelay),
+		agentCounts: options.Metrics.Counter("botdetect_user_agent_classes_total",
+			"Number of requests from known bots by class and decision", "class", "decision"),
+		normalizer:     normalizer,
+		maintenance:    &maintenance{},
+		loginGuard:     loginGuard,
+		loginChallenge: *loginAction == "challenge",
+		loginFlagged: options.Metrics.Counter("botdetect_login_flagged_total",
+			"Number of IPs blacklisted and login requests challenged for failed logins", "action"),
+		fetchGuard:     fetchGuard,
+		fetchChallenge: *fetchAction == "challenge",
+		fetchFlagged: options.Metrics.Counter("botdetect_fetch_flagged_total",
+			"Number of IPs blacklisted and requests challenged for their fetch metadata and client hints", "action"),
+		fingerprints:         fingerprintTracker,
+		fingerprintChallenge: *fingerprintAction == "challenge",
+		fingerprintFlagged: options.Metrics.Counter("botdetect_fingerprint_flagged_total",
+			"Number of IPs blacklisted and requests challenged for the fingerprint of blacklisted IPs", "action"),
+		surges:         surgeDetector,
+		surgeChallenge: *surgeAction == "challenge",
+		surgeChallenged: options.Metrics.Counter("botdetect_surge_challenged_total",
+			"Number of unverified requests challenged during a surge"),
+		flowGuard: flowGuard,
+		flowMatches: options.Metrics.Counter("botdetect_flow_rule_matches_total",
+			"Number of times a flow rule blacklisted an IP", "rule"),
+		netflowErrors: options.Metrics.Counter("botdetect_netflow_errors_total",
+			"Number of Netflow and IPFIX packets that couldn't be decoded completely"),
+		netflowRejected: options.Metrics.Counter("botdetect_netflow_rejected_total",
+			"Number of Netflow and IPFIX packets dropped because their sender isn't in -netflow-exporters"),
+	}
+	if *manualList != "" || *manualAllowList != "" || kv != nil {
+		// host name entries are confirmed with the PTR cache
+		if options.PTR != nil {
+			pol.hostnames = options.PTR.Cache
+		} else {
+			pol.hostnames = botdetect.NewPTRCache(net.DefaultResolver, *dnsTimeout, *ptrCacheTTL)
+			pol.hostnames.SetLookupLimits(lookupLimits())
 		}
+	}
+	if *reportInterval > 0 {
+		pol.report = botdetect.NewReportCollector(botdetect.ReportOptions{
+			Top:     *reportTop,
+			Country: geo.Country,
+			Network: options.Datacenters.Lookup,
+		})
+		go reportLoop(ctx, pol.report, *reportInterval)
+	}
+	if err := pol.useDecider(reqChan, newDeduplicator()); err != nil {
+		log.Fatalf("%s %s", callsign, err)
+	}
+	if *verifyCrawlers {
+		pol.crawlers = botdetect.NewCrawlerVerifier(botdetect.DefaultCrawlers, net.DefaultResolver, *dnsTimeout, *crawlerTTL)
+		pol.crawlers.SetLookupLimits(lookupLimits())
+		options.Metrics.CounterFunc("botdetect_crawler_lookups_postponed_total", "Number of crawler verifications postponed because too many lookups were running", func() float64 {
+			_, postponed := pol.crawlers.LookupStats()
+			return float64(postponed)
+		})
+		pol.crawlDelay = botdetect.NewCrawlDelay(*crawlDelay)
 
-		for _, xff := range strings.Split(xff, ",") {
-			if parsedIP := parseIP(strings.TrimSpace(xff)); parsedIP != nil && !privIP.IsPrivate(parsedIP) {
-				ips = append(ips, parsedIP)
-				traceLog("adding X-Forwarded-For IP: %s", parsedIP.String())
+		if *crawlerCacheFile != "" {
+			if err := loadCrawlerCache(pol.crawlers, *crawlerCacheFile); err != nil {
+				log.Fatalf("%s error loading the crawler cache: %s", callsign, err)
 			}
+			if *stateInterval > 0 {
+				go saveCrawlerCacheLoop(ctx, pol.crawlers, *crawlerCacheFile, *stateInterval)
+			}
+		}
+	}
+
+	pol.sinks, err = openSinks(sinkSpecs, options.Metrics)
+	if err != nil {
+		log.Fatalf("%s %s", callsign, err)
+	}
+
+	ns := newNamespaces(ctx, pol, tenants)
+	if options.Reputation != nil {
+		// kept in memory unless they are in Redis
+		if store, ok := options.Reputation.Store.(*botdetect.MemoryReputationStore); ok {
+			options.Metrics.GaugeFunc("botdetect_reputation_ips", "Number of IPs with a reputation", func() float64 {
+				return float64(store.Size())
+			})
 		}
+	}
+	if fingerprintTracker != nil {
+		options.Metrics.GaugeFunc("botdetect_fingerprints_bad", "Number of fingerprints seen on enough blacklisted IPs to flag new IPs with them", func() float64 {
+			return float64(fingerprintTracker.Bad())
+		})
+	}
+	options.Metrics.GaugeFunc("botdetect_maintenance_mode", "Maintenance mode: 0 off, 1 freeze, 2 pass-through", pol.maintenance.gauge)
+	if *freezeFor > 0 {
+		ns.setMaintenance(maintenanceFreeze, *freezeFor)
+	} else if *passThroughFor > 0 {
+		ns.setMaintenance(maintenancePassThrough, *passThroughFor)
+	}
+	if surgeDetector != nil {
+		watchSurges(ctx, surgeDetector, ns, options.Metrics)
+	}
 
-		decision := ok
-		for i, ip := range ips {
-			reqChan <- &botdetect.Request{
-				URL: url,
-				IP:  ip,
+	if flowGuard != nil {
+		options.Metrics.GaugeFunc("botdetect_flow_ips", "Number of IPs with flow summaries in the window of the flow rules", func() float64 {
+			return float64(flowGuard.Size())
+		})
+	}
+	if *flowListen != "" {
+		l, err := listenFlows(*flowListen)
+		if err != nil {
+			log.Fatalf("%s %s", callsign, err)
+		}
+		go serveFlows(ctx, l, pol)
+	}
+	if *netflowListen != "" {
+		conn, err := listenNetflow(*netflowListen)
+		if err != nil {
+			log.Fatalf("%s %s", callsign, err)
+		}
+		go serveNetflow(ctx, conn, pol)
+	}
+
+	serverDone := make(chan struct{})
+	if *listen != "" {
+		go func() {
+			serve(ctx, newServer(*listen, ns, options, auth))
+			close(serverDone)
+		}()
+	} else {
+		close(serverDone)
+	}
+
+	out := newDecisionWriter(os.Stdout, *flushEvery)
+	answers := !sinkStdout(sinkSpecs)
+	var sum *summary
+	if *printSummary || *summaryFile != "" {
+		sum = newSummary(*reportTop)
+	}
+
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			if err := out.flush(); err != nil {
+				log.Printf("%s error writing the decisions: %s\n", callsign, err)
+			}
+			if err := writeSummary(sum, history); err != nil {
+				log.Printf("%s error writing the summary: %s\n", callsign, err)
+			}
+			cancel()
+			<-serverDone
+			if err := pol.sinks.Close(); err != nil {
+				log.Printf("%s error closing the sinks: %s\n", callsign, err)
+			}
+			if *stateFile != "" {
+				if err := saveState(history, *stateFile); err != nil {
+					log.Printf("%s error saving the state: %s\n", callsign, err)
+				}
+			}
+			if wal != nil {
+				if err := wal.Close(); err != nil {
+					log.Printf("%s error closing the blacklist log: %s\n", callsign, err)
+				}
+			}
+			if *crawlerCacheFile != "" {
+				if err := saveCrawlerCache(pol.crawlers, *crawlerCacheFile); err != nil {
+					log.Printf("%s error saving the crawler cache: %s\n", callsign, err)
+				}
 			}
+			if *auditFile != "" && options.Audit != nil {
+				if err := saveAudit(options.Audit, *auditFile); err != nil {
+					log.Printf("%s error saving the audit trail: %s\n", callsign, err)
+				}
+			}
+		})
+	}
+	defer shutdown()
 
-			blacklisted := history.IsBlacklisted(ip.String())
-			traceLog("[%d] ip: %s, blacklisted: %v", i, ip, blacklisted)
+	// shut down cleanly when the container runtime asks us to
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		traceLog("received %s, shutting down", sig)
+		shutdown()
+		os.Exit(0)
+	}()
 
-			if blacklisted {
-				decision = block
-				break
+	if *rulesFile != "" {
+		flagRules := options.Rules
+		go botdetect.WatchFile(ctx, *rulesFile, *rulesInterval, func(path string) error {
+			fileRules, err := botdetect.LoadRules(path)
+			if err != nil {
+				return err
+			}
+			err = ns.updateOptions(func(o *botdetect.IPHistoryOptions) {
+				o.Rules = append(append([]botdetect.Rule{}, flagRules...), fileRules...)
+			})
+			if err == nil {
+				log.Printf("%s loaded %d rules from %s\n", callsign, len(fileRules), path)
 			}
+			return err
+		}, func(err error) {
+			log.Printf("%s error loading the rules file: %s\n", callsign, err)
+		})
+	}
+
+	if *manualList != "" {
+		go manual.Watch(ctx, *manualList, *manualInterval, func(err error) {
+			log.Printf("%s error reloading the manual list: %s\n", callsign, err)
+		})
+	}
+	if *manualAllowList != "" {
+		go manual.WatchAllow(ctx, *manualAllowList, *manualInterval, func(err error) {
+			log.Printf("%s error reloading the manual allow list: %s\n", callsign, err)
+		})
+	}
+
+	if kv != nil {
+		go watchKV(ctx, kv, ns, manual, options.Rules)
+	}
+
+	if *uaDB != "" && agents != nil {
+		go agents.Watch(ctx, *uaDB, *uaDBInterval, func(err error) {
+			log.Printf("%s error reloading the user agent database: %s\n", callsign, err)
+		})
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+
+	// the input is parsed into the same struct for every line, nothing
+	// holds on to it beyond the decision
+	in := &botdetect.Input{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if *trace {
+			traceLog("processing '%s'", line)
 		}
 
-		traceLog("decision for %s: %s", line, decision)
+		answer := ok
+		if err := format.ParseInto(line, in); err != nil {
+			if *trace {
+				traceLog("invalid input: %s. Letting it pass.", line)
+			}
+			sum.record(answer, nil)
+		} else {
+			var decision botdetect.Decision
+			answer, decision = pol.decideInput(in)
+			sum.record(answer, &decision)
+
+			if *trace {
+				traceLog("decision for %s: %s", line, answer)
+			}
+		}
 
-		os.Stdout.Write([]byte(decision + "\n"))
+		if !answers {
+			continue
+		}
+		if err := out.write(answer); err != nil {
+			log.Fatalf("%s error writing the decisions: %s", callsign, err)
+		}
 	}
 }
 
-func parseIP(ip string) net.IP {
-	return net.ParseIP(ip).To16()
+// historyOptions builds and validates the history options from the flags
+func historyOptions() (*botdetect.IPHistoryOptions, error) {
+	if *maxRequests < 0 {
+		return nil, fmt.Errorf("max-requests must not be negative")
+	}
+	if *warnRequests < 0 {
+		return nil, fmt.Errorf("warn-requests must not be negative")
+	}
+
+	extraRules, err := botdetect.ParseRules(*rules)
+	if err != nil {
+		return nil, err
+	}
+
+	dcRules, err := botdetect.ParseRules(*datacenterRules)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := botdetect.ParseScheduledRules(*scheduledRules)
+	if err != nil {
+		return nil, err
+	}
+
+	bandwidth, err := botdetect.ParseBandwidthRules(*bandwidthRules)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := botdetect.ParseCacheRules(*cacheRules)
+	if err != nil {
+		return nil, err
+	}
+
+	assets, err := botdetect.ParseAssetTypes(*assetTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	var ptr *botdetect.PTROptions
+	if *ptrPatterns != "" {
+		patterns, err := botdetect.ParsePTRPatterns(*ptrPatterns)
+		if err != nil {
+			return nil, err
+		}
+		cache := botdetect.NewPTRCache(net.DefaultResolver, *dnsTimeout, *ptrCacheTTL)
+		cache.SetLookupLimits(lookupLimits())
+		ptr = &botdetect.PTROptions{
+			Cache:    cache,
+			Patterns: patterns,
+			Near:     *ptrNear,
+		}
+	}
+
+	var walks *botdetect.WalkDetector
+	if *walkPatterns != "" {
+		patterns, err := botdetect.ParseWalkPatterns(*walkPatterns)
+		if err != nil {
+			return nil, err
+		}
+		if *walkSteps <= 0 || *walkMaxGap <= 0 {
+			return nil, fmt.Errorf("walk-steps and walk-max-gap must be greater than zero")
+		}
+		walks = botdetect.NewWalkDetector(patterns, *walkSteps, int64(*walkMaxGap))
+	}
+
+	var concurrency *botdetect.ConcurrencyDetector
+	if *maxConnections > 0 {
+		if *maxConnectionsDuration < 0 {
+			return nil, fmt.Errorf("max-connections-duration must not be negative")
+		}
+		concurrency = botdetect.NewConcurrencyDetector(uint64(*maxConnections), *maxConnectionsDuration)
+	} else if *maxConnections < 0 {
+		return nil, fmt.Errorf("max-connections must not be negative")
+	}
+
+	var reputation *botdetect.ReputationOptions
+	if *reputationHalfLife > 0 {
+		// the reputations are shared by all namespaces and saved with
+		// -state-file
+		reputation = &botdetect.ReputationOptions{
+			Store:          botdetect.NewMemoryReputationStore(),
+			HalfLife:       *reputationHalfLife,
+			Penalty:        *reputationPenalty,
+			Reward:         *reputationReward,
+			RewardInterval: *reputationRewardInterval,
+			MinFactor:      *reputationMinFactor,
+			MaxFactor:      *reputationMaxFactor,
+			Timeout:        time.Second,
+			OnError: func(err error) {
+				log.Printf("%s reputation error: %s\n", callsign, err)
+			},
+		}
+	}
+
+	var tune *botdetect.AutoTuneOptions
+	switch *autoTune {
+	case "off":
+	case "suggest", "apply":
+		if *autoTuneMin < 0 {
+			return nil, fmt.Errorf("auto-tune-min must not be negative")
+		}
+		tune = &botdetect.AutoTuneOptions{
+			Percentile:  *autoTunePercentile,
+			Factor:      *autoTuneFactor,
+			MinRequests: uint64(*autoTuneMin),
+			Block:       *autoTuneBlock,
+			Interval:    *autoTuneInterval,
+			Apply:       *autoTune == "apply",
+			OnTune: func(current, tuned botdetect.Thresholds) {
+				log.Printf("%s auto tuning (%s): max-requests %d -> %d, max-ratio %g -> %g\n", callsign, *autoTune,
+					current.MaxRequests, tuned.MaxRequests, current.MaxRatio, tuned.MaxRatio)
+			},
+		}
+	default:
+		return nil, fmt.Errorf("invalid auto-tune mode '%s': expected off, suggest or apply", *autoTune)
+	}
+
+	var anomalyOptions *botdetect.AnomalyOptions
+	switch *anomaly {
+	case "off":
+	case "log", "block":
+		if *anomalyMinRequests < 0 {
+			return nil, fmt.Errorf("anomaly-min-requests must not be negative")
+		}
+		if *anomalyTTL < 0 {
+			return nil, fmt.Errorf("anomaly-ttl must not be negative")
+		}
+		anomalyOptions = &botdetect.AnomalyOptions{
+			Alpha:       *anomalyAlpha,
+			Threshold:   *anomalyThreshold,
+			MinRequests: uint64(*anomalyMinRequests),
+			Warmup:      *anomalyWarmup,
+			TTL:         *anomalyTTL,
+			Blacklist:   *anomaly == "block",
+		}
+	default:
+		return nil, fmt.Errorf("invalid anomaly mode '%s': expected off, log or block", *anomaly)
+	}
+
+	var audit *botdetect.AuditLog
+	if *auditEntries > 0 {
+		audit = botdetect.NewAuditLog(*auditEntries, *auditIPs)
+	} else if *annotateOwners {
+		return nil, fmt.Errorf("annotate-owners requires the audit trail (audit-entries)")
+	} else if *auditFile != "" {
+		return nil, fmt.Errorf("audit-file requires the audit trail (audit-entries)")
+	}
+
+	var datacenters *botdetect.DatacenterList
+	if *datacenterList != "" {
+		if datacenters, err = botdetect.LoadDatacenterLists(splitList(*datacenterList)); err != nil {
+			return nil, err
+		}
+	}
+
+	var backpressure *botdetect.BackpressureOptions
+	if maxQueue := *ingestMaxQueue; (maxQueue > 0 && *queueSize > 0) || *ingestMaxLag > 0 || *ingestMinRate > 0 {
+		if *queueSize == 0 {
+			maxQueue = 0
+		}
+		backpressure = &botdetect.BackpressureOptions{
+			MaxQueue: maxQueue,
+			MaxLag:   *ingestMaxLag,
+			MinRate:  *ingestMinRate,
+			Interval: *ingestInterval,
+			OnWarning: func(msg string) {
+				log.Printf("%s ingest warning: %s\n", callsign, msg)
+			},
+		}
+	}
+
+	var shedding *botdetect.SheddingOptions
+	if *shedMaxQueue > 0 || *shedMaxLag > 0 || *shedMaxCPU > 0 {
+		shedding = &botdetect.SheddingOptions{
+			MaxQueue: *shedMaxQueue,
+			MaxLag:   *shedMaxLag,
+			MaxCPU:   *shedMaxCPU,
+			Sample:   *shedSample,
+			Interval: *shedInterval,
+			OnChange: func(shedding bool, reason string) {
+				if shedding {
+					log.Printf("%s shedding load: %s\n", callsign, reason)
+				} else {
+					log.Printf("%s stopped shedding load\n", callsign)
+				}
+			},
+		}
+	}
+
+	var watchdog *botdetect.WatchdogOptions
+	if *watchdogStalls > 0 {
+		watchdog = &botdetect.WatchdogOptions{
+			Stalls:   *watchdogStalls,
+			Restart:  *watchdogRestart,
+			Interval: *interval,
+			OnStall: func(loop string, stalled bool, age time.Duration) {
+				if stalled {
+					log.Printf("%s %s loop stuck for %s\n", callsign, loop, age.Round(time.Second))
+				} else {
+					log.Printf("%s %s loop recovered\n", callsign, loop)
+				}
+			},
+		}
+	}
+
+	var runaway *botdetect.RunawayOptions
+	if *runawayPercent > 0 {
+		runaway = &botdetect.RunawayOptions{
+			Percent:    *runawayPercent,
+			Interval:   *runawayInterval,
+			MinClients: *runawayMinClients,
+			OnDisable:  disabledRule,
+		}
+	}
+
+	var greylist *botdetect.GreylistOptions
+	if *greylistPromote > 0 {
+		greylist = &botdetect.GreylistOptions{
+			TTL:     *greylistTTL,
+			Promote: *greylistPromote,
+			Demote:  *greylistDemote,
+		}
+	}
+
+	options := &botdetect.IPHistoryOptions{
+		TimestampFormat:  *timestampFormat,
+		TimeSlot:         *timeSlot,
+		Window:           *timeWindow,
+		Interval:         *interval,
+		ExpireInterval:   *expireInterval,
+		BlacklistTTL:     *blacklistTTL,
+		BlacklistMaxSize: *blacklistMaxSize,
+		MaxRequests:      uint64(*maxRequests),
+		MaxRatio:         *maxRatio,
+		WarnRequests:     uint64(*warnRequests),
+		WarnRatio:        *warnRatio,
+		OnWarn: func(ip net.IP, rule botdetect.Rule, total, app uint64) {
+			log.Printf("%s warning: %s exceeds the warn tier of rule %s with %d requests, %d app\n", callsign, ip, rule, total, app)
+		},
+		CompactAge:      *compactAge,
+		CompactSlot:     *compactSlot,
+		Rules:           extraRules,
+		Schedules:       schedules,
+		BandwidthRules:  bandwidth,
+		CacheRules:      cache,
+		GracePeriod:     *gracePeriod,
+		Canary:          *canary,
+		Datacenters:     datacenters,
+		Audit:           audit,
+		Metrics:         botdetect.NewMetrics(),
+		AutoTune:        tune,
+		Anomaly:         anomalyOptions,
+		DatacenterRules: dcRules,
+		QueueSize:       *queueSize,
+		Backpressure:    backpressure,
+		Shedding:        shedding,
+		Watchdog:        watchdog,
+		Runaway:         runaway,
+		Greylist:        greylist,
+		PTR:             ptr,
+		Walks:           walks,
+		Concurrency:     concurrency,
+		Reputation:      reputation,
+		AssetTypes:      assets,
+		Uncounted:       splitList(*uncountedPaths),
+		APIPaths:        splitList(*apiPaths),
+		FetchMetadata:   *fetchMetadata,
+
+		UnverifiedFactor: *unverifiedFactor,
+	}
+
+	if surgeTracksVerified() {
+		// track verified IPs, so that a surge can tighten the others
+		options.UnverifiedFactor = 1
+	}
+
+	return options, options.Validate()
+}
+
+// loadManualList reads the manual block and allow lists if they are
+// configured
+func loadManualList() (*botdetect.ManualList, error) {
+	manual := botdetect.NewManualList()
+	if *manualAllowList != "" {
+		if err := manual.LoadAllow(*manualAllowList); err != nil {
+			return manual, err
+		}
+	}
+	if *manualList == "" {
+		return manual, nil
+	}
+	return manual, manual.Load(*manualList)
+}
+
+// loadGeoPolicy loads the GeoIP database if one is configured
+func loadGeoPolicy() (*botdetect.GeoPolicy, error) {
+	if *geoDB == "" {
+		return nil, nil
+	}
+
+	db, err := botdetect.LoadGeoDB(*geoDB)
+	if err != nil {
+		return nil, err
+	}
+
+	return botdetect.NewGeoPolicy(db,
+		splitList(*geoAllowCountries), splitList(*geoDenyCountries),
+		splitList(*geoAllowContinents), splitList(*geoDenyContinents),
+	), nil
+}
+
+// loadProxyDetector creates the proxy detector if proxy detection is enabled
+func loadProxyDetector(format *botdetect.InputFormat) (*botdetect.ProxyDetector, error) {
+	switch *proxyDetection {
+	case "off":
+		return nil, nil
+	case "log", "block":
+	default:
+		return nil, fmt.Errorf("invalid proxy detection mode '%s': expected off, log or block", *proxyDetection)
+	}
+
+	if format == nil {
+		return nil, nil
+	}
+
+	pd, err := botdetect.NewProxyDetector(splitList(*proxyHeaders))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range append(pd.Headers(), "Forwarded") {
+		if format.HasHeader(h) {
+			return pd, nil
+		}
+	}
+	return nil, fmt.Errorf("proxy-detection needs at least one of the headers %s or Forwarded in -input-format", strings.Join(pd.Headers(), ", "))
+}
+
+// checkBandwidth makes sure that bandwidth rules get the response sizes
+func checkBandwidth(format *botdetect.InputFormat) error {
+	if *bandwidthRules != "" && format != nil && !format.Has("bytes") {
+		return fmt.Errorf("bandwidth-rules need the bytes field in -input-format")
+	}
+	return nil
+}
+
+// checkVerified makes sure that -unverified-factor learns which requests
+// were verified
+func checkVerified(format *botdetect.InputFormat) error {
+	if *unverifiedFactor > 0 && *listen == "" && format != nil && !format.HasHeader(*verifiedHeaderName) {
+		return fmt.Errorf("unverified-factor needs header:%s in -input-format or -listen", *verifiedHeaderName)
+	}
+	return nil
+}
+
+// checkCacheRules makes sure that cache rules get the cache status
+func checkCacheRules(format *botdetect.InputFormat) error {
+	if *cacheRules != "" && format != nil && !format.Has("cache-status") {
+		return fmt.Errorf("cache-rules need the cache-status field in -input-format")
+	}
+	return nil
+}
+
+// checkDedup checks the deduplication flags
+func checkDedup(format *botdetect.InputFormat) error {
+	if *dedupHorizon <= 0 {
+		return nil
+	}
+	if *dedupEntries <= 0 {
+		return fmt.Errorf("dedup-entries must be positive")
+	}
+	if format != nil && !format.Has("time") {
+		return fmt.Errorf("dedup-horizon needs the time field in -input-format")
+	}
+	return nil
+}
+
+// checkCrawlers checks the crawler verification flags
+func checkCrawlers() error {
+	if *crawlerCacheFile != "" && !*verifyCrawlers {
+		return fmt.Errorf("crawler-cache-file requires verify-crawlers")
+	}
+	return nil
+}
+
+// checkMaintenance checks the flags of the maintenance modes
+func checkMaintenance() error {
+	if *freezeFor < 0 || *passThroughFor < 0 {
+		return fmt.Errorf("freeze-for and pass-through-for must not be negative")
+	}
+	if *freezeFor > 0 && *passThroughFor > 0 {
+		return fmt.Errorf("freeze-for and pass-through-for can't be combined")
+	}
+	if *maintenanceMax <= 0 {
+		return fmt.Errorf("maintenance-max-duration must be greater than zero")
+	}
+	return nil
+}
+
+// checkOutput checks the flags of the answers on stdout
+func checkOutput() error {
+	if *flushEvery < 0 {
+		return fmt.Errorf("flush-every must not be negative")
+	}
+	return nil
+}
+
+// checkNoPublicIP checks -no-public-ip
+func checkNoPublicIP() error {
+	switch *noPublicIP {
+	case "allow", "block", "challenge":
+		return nil
+	}
+	return fmt.Errorf("invalid no-public-ip '%s': expected allow, block or challenge", *noPublicIP)
+}
+
+// checkLookupLimits checks the limits of the external lookups
+func checkLookupLimits() error {
+	if *lookupConcurrent <= 0 || *lookupEntries <= 0 {
+		return fmt.Errorf("lookup-max-concurrent and lookup-max-entries must be positive")
+	}
+	if *lookupNegativeTTL < 0 || *lookupErrorTTL < 0 {
+		return fmt.Errorf("lookup-negative-ttl and lookup-error-ttl must not be negative")
+	}
+	return nil
+}
+
+// lookupLimits returns the limits of the external lookups
+func lookupLimits() botdetect.LookupLimits {
+	return botdetect.LookupLimits{
+		NegativeTTL:   *lookupNegativeTTL,
+		ErrorTTL:      *lookupErrorTTL,
+		MaxConcurrent: *lookupConcurrent,
+		MaxEntries:    *lookupEntries,
+	}
+}
+
+// checkSubject checks the subject and trusted proxy flags
+func checkSubject() error {
+	if _, err := botdetect.ParseSubject(*subject); err != nil {
+		return err
+	}
+	_, err := botdetect.ParseNetworks(splitList(*trustedProxies))
+	return err
+}
+
+// newDeduplicator creates the deduplicator if deduplication is enabled
+func newDeduplicator() *botdetect.Deduplicator {
+	if *dedupHorizon <= 0 {
+		return nil
+	}
+	return botdetect.NewDeduplicator(*dedupHorizon, *dedupEntries)
+}
+
+// splitList splits a comma separated flag value
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// invalid prints the configuration errors and returns whether there were any
+func invalid(errs ...error) bool {
+	found := false
+	for _, err := range errs {
+		if err != nil {
+			if !found {
+				fmt.Fprintf(os.Stderr, "%s configuration is invalid:\n", callsign)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			found = true
+		}
+	}
+	return found
+}
+
+// validate reports the outcome of the configuration check and returns the exit code
+func validate(options *botdetect.IPHistoryOptions, errs ...error) int {
+	if invalid(errs...) {
+		return 1
+	}
+
+	fmt.Printf("%s configuration is valid\n", callsign)
+	for _, rule := range options.Rules {
+		fmt.Printf("%s rule %s\n", callsign, rule)
+	}
+	for _, sr := range options.Schedules {
+		fmt.Printf("%s scheduled rules %s\n", callsign, sr)
+	}
+	for _, rule := range options.BandwidthRules {
+		fmt.Printf("%s bandwidth rule %s\n", callsign, rule)
+	}
+	for _, rule := range options.CacheRules {
+		fmt.Printf("%s cache rule %s\n", callsign, rule)
+	}
+	for _, rule := range options.DatacenterRules {
+		fmt.Printf("%s data center rule %s\n", callsign, rule)
+	}
+	if options.Datacenters != nil {
+		fmt.Printf("%s %d data center networks\n", callsign, options.Datacenters.Size())
+	}
+	if options.PTR != nil {
+		for _, p := range options.PTR.Patterns {
+			fmt.Printf("%s PTR pattern %s\n", callsign, p)
+		}
+	}
+	if *walkPatterns != "" {
+		fmt.Printf("%s walk patterns %s\n", callsign, *walkPatterns)
+	}
+	if *loginEndpoints != "" {
+		fmt.Printf("%s login endpoints %s (%s)\n", callsign, *loginEndpoints, *loginAction)
+	}
+	if *profile != "" {
+		fmt.Printf("%s profile %s\n", callsign, *profile)
+	}
+	if len(options.APIPaths) > 0 {
+		fmt.Printf("%s API paths %s\n", callsign, strings.Join(options.APIPaths, ","))
+	}
+	if options.UnverifiedFactor > 0 && options.UnverifiedFactor < 1 {
+		fmt.Printf("%s thresholds of IPs without %s scaled by %g\n", callsign, *verifiedHeaderName, options.UnverifiedFactor)
+	}
+	if *fetchSignals {
+		fmt.Printf("%s fetch signals (%s)\n", callsign, *fetchAction)
+	}
+	if *fingerprints {
+		fmt.Printf("%s fingerprints (%s)\n", callsign, *fingerprintAction)
+	}
+	if *surge {
+		fmt.Printf("%s surges of %g times the baseline per %s (%s)\n", callsign, *surgeFactor, *surgeSlot, *surgeAction)
+	}
+	if *flowListen != "" {
+		fmt.Printf("%s flow summaries on %s, rules %s\n", callsign, *flowListen, *flowRules)
+	}
+	if *netflowListen != "" {
+		fmt.Printf("%s netflow collector on %s, rules %s\n", callsign, *netflowListen, *flowRules)
+	}
+	if len(options.Uncounted) > 0 {
+		fmt.Printf("%s uncounted paths %s\n", callsign, strings.Join(options.Uncounted, ","))
+	}
+	if r := options.Reputation; r != nil {
+		fmt.Printf("%s reputation half-life %s, thresholds scaled by %g to %g\n", callsign, r.HalfLife, r.MinFactor, r.MaxFactor)
+	}
+	if *redisAddrs != "" {
+		fmt.Printf("%s shared through redis %s (%s) as replica %q\n", callsign, *redisAddrs, *redisTopology, *replica)
+	}
+	if *leaderLease > 0 {
+		fmt.Printf("%s rules evaluated by the holder of a %s lease\n", callsign, *leaderLease)
+	}
+	return 0
 }
@@ -0,0 +1,168 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The maintenance modes: freeze stops blacklisting IPs, pass-through
+// additionally answers OK to every request. Both end on their own.
+const (
+	maintenanceOff         = "off"
+	maintenanceFreeze      = "freeze"
+	maintenancePassThrough = "pass-through"
+)
+
+// maintenance is the mode botdetect is in while the detector itself is
+// suspected of causing customer impact. It is shared by all namespaces.
+type maintenance struct {
+	mode  string
+	until time.Time
+	mutex sync.RWMutex
+}
+
+// current returns the mode and when it ends
+func (m *maintenance) current() (string, time.Time) {
+	if m == nil {
+		return maintenanceOff, time.Time{}
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.mode == "" || !time.Now().Before(m.until) {
+		return maintenanceOff, time.Time{}
+	}
+	return m.mode, m.until
+}
+
+// passThrough determines whether every request has to be answered with OK
+func (m *maintenance) passThrough() bool {
+	mode, _ := m.current()
+	return mode == maintenancePassThrough
+}
+
+// gauge returns the mode as the value of botdetect_maintenance_mode
+func (m *maintenance) gauge() float64 {
+	switch mode, _ := m.current(); mode {
+	case maintenanceFreeze:
+		return 1
+	case maintenancePassThrough:
+		return 2
+	}
+	return 0
+}
+
+// setMaintenance changes the mode of all namespaces for the duration, which must be
+// positive unless the mode is off
+func (n *namespaces) setMaintenance(mode string, d time.Duration) (time.Time, error) {
+	switch mode {
+	case maintenanceOff:
+		d = 0
+	case maintenanceFreeze, maintenancePassThrough:
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("the duration of %s must be greater than zero", mode)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("invalid maintenance mode '%s': expected %s, %s or %s", mode, maintenanceFreeze, maintenancePassThrough, maintenanceOff)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// pass-through freezes as well, so that its end isn't followed by a
+	// wave of IPs blacklisted in the meantime
+	until := n.primary.history.Freeze(d)
+	for _, p := range n.policies {
+		p.history.Freeze(d)
+	}
+
+	m := n.primary.maintenance
+	m.mutex.Lock()
+	m.mode, m.until = mode, until
+	m.mutex.Unlock()
+
+	if mode == maintenanceOff {
+		log.Printf("%s maintenance mode off\n", callsign)
+	} else {
+		log.Printf("%s maintenance mode %s until %s\n", callsign, mode, until.Format(time.RFC3339))
+	}
+	return until, nil
+}
+
+// maintenanceHandler reports the maintenance mode as JSON on GET and changes
+// it on POST with the parameters mode (freeze, pass-through or off) and for,
+// a duration of at most -maintenance-max-duration. The mode applies to all
+// namespaces, so clients with a namespace may only read it.
+func maintenanceHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if client.namespace != "" {
+				http.Error(w, "the maintenance mode applies to all namespaces", http.StatusForbidden)
+				return
+			}
+
+			var d time.Duration
+			if mode := r.FormValue("mode"); mode != maintenanceOff {
+				var err error
+				if d, err = time.ParseDuration(r.FormValue("for")); err != nil || d <= 0 {
+					http.Error(w, "invalid or missing for parameter", http.StatusBadRequest)
+					return
+				}
+				if d > *maintenanceMax {
+					http.Error(w, fmt.Sprintf("for exceeds the maximum of %s", *maintenanceMax), http.StatusBadRequest)
+					return
+				}
+			}
+			if _, err := ns.setMaintenance(r.FormValue("mode"), d); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s maintenance mode changed by %s\n", callsign, client)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mode, until := ns.primary.maintenance.current()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Mode  string `json:"mode"`
+			Until string `json:"until,omitempty"`
+		}{mode, formatUntil(until)})
+	}
+}
+
+func formatUntil(until time.Time) string {
+	if until.IsZero() {
+		return ""
+	}
+	return until.Format(time.RFC3339)
+}
@@ -0,0 +1,163 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// namespaces keeps a separate history and blacklist for every API client
+// namespace. The unnamed namespace is the primary one that is also used for
+// the input on stdin.
+type namespaces struct {
+	ctx       context.Context
+	primary   *policy
+	policies  map[string]*policy
+	overrides tenantOverrides
+	mutex     sync.Mutex
+}
+
+func newNamespaces(ctx context.Context, primary *policy, overrides tenantOverrides) *namespaces {
+	return &namespaces{
+		ctx:       ctx,
+		primary:   primary,
+		policies:  make(map[string]*policy),
+		overrides: overrides,
+	}
+}
+
+// forRequest returns the namespace of the API client, or the one configured
+// for the host parameter if the client has none
+func (n *namespaces) forRequest(r *http.Request) string {
+	if name := clientFrom(r.Context()).namespace; name != "" {
+		return name
+	}
+	return n.overrides.hostTenant(r.FormValue("host"))
+}
+
+// get returns the policy of the namespace and creates it on first use
+func (n *namespaces) get(name string) *policy {
+	if name == "" {
+		return n.primary
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if p, ok := n.policies[name]; ok {
+		return p
+	}
+
+	// the metrics and the audit trail are keyed by IP and rule only, so
+	// they stay with the primary namespace
+	options := n.primary.history.Options()
+	options.Metrics = nil
+	options.Audit = nil
+	options.Ownership = nil
+	// the request counts in Redis are keyed by IP and replica, the counts
+	// of a tenant would mix with the primary ones, so every replica
+	// evaluates the rules of its tenants on its own
+	options.Replication = nil
+	options.Leader = nil
+	options.Walks = options.Walks.Clone()
+	options.Concurrency = options.Concurrency.Clone()
+
+	p := *n.primary
+	n.overrides.apply(name, &options, &p)
+
+	engine, err := botdetect.NewLocalEngine(n.ctx, &options)
+	if err != nil {
+		// the overrides have been validated at startup
+		log.Printf("%s error creating namespace %s, using the primary one: %s\n", callsign, name, err)
+		return n.primary
+	}
+	history := engine.IPHistory
+	if until, frozen := n.primary.history.FrozenUntil(); frozen {
+		history.Freeze(time.Until(until))
+	}
+	p.history = history
+	p.engine = engine
+	p.namespace = name
+	p.fanout = nil
+	p.audit = nil
+	p.stats = &tenantStats{}
+	p.loginGuard = p.loginGuard.Clone()
+	p.fetchGuard = p.fetchGuard.Clone()
+	p.fingerprints = p.fingerprints.Clone()
+	if err := p.useDecider(history.RequestChannel(), newDeduplicator()); err != nil {
+		engine.Close()
+		log.Printf("%s error creating namespace %s, using the primary one: %s\n", callsign, name, err)
+		return n.primary
+	}
+	n.policies[name] = &p
+
+	traceLog("created namespace %s", name)
+	return &p
+}
+
+// updateOptions changes the options of all namespaces
+func (n *namespaces) updateOptions(fn func(*botdetect.IPHistoryOptions)) error {
+	if err := n.primary.history.UpdateOptions(fn); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for name, p := range n.policies {
+		// the overrides of the namespace take precedence over the update
+		name := name
+		if err := p.history.UpdateOptions(func(o *botdetect.IPHistoryOptions) {
+			fn(o)
+			n.overrides.apply(name, o, nil)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stats returns the statistics of the namespace, or of all namespaces if
+// name is empty. The primary namespace is reported as "default".
+func (n *namespaces) stats(name string) map[string]tenantReport {
+	if name != "" {
+		return map[string]tenantReport{name: n.get(name).tenantReport()}
+	}
+
+	n.mutex.Lock()
+	names := make([]string, 0, len(n.policies))
+	for name := range n.policies {
+		names = append(names, name)
+	}
+	n.mutex.Unlock()
+	sort.Strings(names)
+
+	out := map[string]tenantReport{"default": n.primary.tenantReport()}
+	for _, name := range names {
+		out[name] = n.get(name).tenantReport()
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// decisionWriter buffers the answers written to stdout. Interactive callers
+// such as Apache's RewriteMap wait for every answer before they send the next
+// line, so they need a flush per decision; batch runs over log files are
+// faster if answers are flushed in bulk.
+type decisionWriter struct {
+	w       *bufio.Writer
+	every   int
+	pending int
+	mutex   sync.Mutex
+}
+
+// newDecisionWriter creates a decisionWriter that flushes after every
+// decisions, or only when the buffer is full if every is zero
+func newDecisionWriter(w io.Writer, every int) *decisionWriter {
+	return &decisionWriter{w: bufio.NewWriterSize(w, 64*1024), every: every}
+}
+
+// write writes the decision and flushes if it is due
+func (dw *decisionWriter) write(decision string) error {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	dw.w.WriteString(decision)
+	dw.w.WriteByte('\n')
+	dw.pending++
+	if dw.every > 0 && dw.pending >= dw.every {
+		return dw.flushLocked()
+	}
+	return nil
+}
+
+// flush writes the buffered decisions
+func (dw *decisionWriter) flush() error {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	return dw.flushLocked()
+}
+
+func (dw *decisionWriter) flushLocked() error {
+	dw.pending = 0
+	return dw.w.Flush()
+}
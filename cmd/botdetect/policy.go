@@ -0,0 +1,357 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/elcamino/botdetect"
+)
+
+// policy combines the blacklist with the lists and checks configured on the
+// command line
+type policy struct {
+	history    *botdetect.IPHistory
+	engine     botdetect.Engine
+	decider    *botdetect.Decider
+	fanout     *botdetect.FanOut
+	manual     *botdetect.ManualList
+	hostnames  *botdetect.PTRCache
+	geo        *botdetect.GeoPolicy
+	crawlers   *botdetect.CrawlerVerifier
+	crawlDelay *botdetect.CrawlDelay
+	audit      *botdetect.AuditLog
+	decisions  *botdetect.CounterVec
+	asns       *botdetect.ASNList
+	asnBlocks  *botdetect.CounterVec
+	proxies    *botdetect.ProxyDetector
+	proxyBlock bool
+	noPublicIP string
+	proxied    *botdetect.CounterVec
+	blockLog   *blockLogger
+	duplicates *botdetect.CounterVec
+	dropped    *botdetect.CounterVec
+	unknown    *botdetect.CounterVec
+	report     *botdetect.ReportCollector
+	stats      *tenantStats
+	normalizer *botdetect.URLNormalizer
+
+	// sinks receive every decision, tagged with the namespace
+	sinks     *botdetect.DecisionSinks
+	namespace string
+
+	// maintenance is shared by all namespaces
+	maintenance *maintenance
+
+	agents       *botdetect.UserAgentDB
+	agentClasses map[string]string
+	agentCounts  *botdetect.CounterVec
+	aiPolicy     map[string]string
+	aiRanges     *botdetect.BotRanges
+	aiDelay      *botdetect.CrawlDelay
+
+	loginGuard     *botdetect.LoginGuard
+	loginChallenge bool
+	loginFlagged   *botdetect.CounterVec
+
+	fetchGuard     *botdetect.FetchGuard
+	fetchChallenge bool
+	fetchFlagged   *botdetect.CounterVec
+
+	fingerprints         *botdetect.FingerprintTracker
+	fingerprintChallenge bool
+	fingerprintFlagged   *botdetect.CounterVec
+
+	// surges is shared by all namespaces, as a surge is one of the site
+	surges          *botdetect.SurgeDetector
+	surgeChallenge  bool
+	surgeChallenged *botdetect.CounterVec
+
+	flowGuard       *botdetect.FlowGuard
+	flowMatches     *botdetect.CounterVec
+	netflowErrors   *botdetect.CounterVec
+	netflowRejected *botdetect.CounterVec
+}
+
+// decide records the request for every public IP it came from and returns
+// the decision for it
+func (p *policy) decide(in *botdetect.Input) string {
+	answer, _ := p.decideInput(in)
+	return answer
+}
+
+// decideInput is like decide but returns the decision as well
+func (p *policy) decideInput(in *botdetect.Input) (string, botdetect.Decision) {
+	// everything below, including the audit trail, sees the canonical URL
+	in.URL = p.normalizer.Normalize(in.URL)
+
+	proxy := p.proxy(in)
+	agent := p.userAgent(in)
+	reasons := []string{}
+	challenged := false
+	if p.login(in) {
+		challenged = true
+		reasons = append(reasons, "login challenge")
+	}
+	if p.fetch(in) {
+		challenged = true
+		reasons = append(reasons, "fetch challenge")
+	}
+	if p.fingerprint(in) {
+		challenged = true
+		reasons = append(reasons, "fingerprint challenge")
+	}
+	if p.surgeCheck(in) {
+		challenged = true
+		reasons = append(reasons, "surge challenge")
+	}
+	passThrough := p.maintenance.passThrough()
+	decision := p.decider.Decide(in, func(ip net.IP) (bool, string) {
+		if passThrough {
+			return false, maintenancePassThrough
+		}
+		blocked, reason := p.blocked(ip, proxy, agent)
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+		return blocked, reason
+	})
+	if len(decision.IPs) == 0 && p.noPublicIP != "allow" && !passThrough {
+		decision.Blocked = true
+		decision.Reason = noPublicIPReason
+		if p.noPublicIP == "challenge" {
+			decision.Reason = challengedBy + noPublicIPReason
+		}
+		reasons = append(reasons, decision.Reason)
+		p.decisions.Inc(strings.ToUpper(p.noPublicIP), reasonLabel(decision.Reason))
+		traceLog("no public IP in %s|%s", in.Remote, in.XFF)
+	}
+	answer := decision.String()
+	if decision.Blocked && isChallenge(decision.Reason) {
+		answer = challenge
+	}
+	if challenged && answer == ok && !passThrough {
+		answer = challenge
+	}
+	if agent.Class != "" {
+		p.agentCounts.Inc(agent.Class, answer)
+	}
+	if p.sinks != nil {
+		e := botdetect.NewDecisionEvent(in, decision, answer, reasons)
+		e.Namespace = p.namespace
+		p.sinks.Send(e)
+	}
+	return answer, decision
+}
+
+// useDecider makes the policy record requests in the given channel
+func (p *policy) useDecider(requests chan<- *botdetect.Request, dedup *botdetect.Deduplicator) error {
+	// both have been checked at startup
+	attribution, _ := botdetect.ParseSubject(*subject)
+	trusted, _ := botdetect.ParseNetworks(splitList(*trustedProxies))
+
+	decider, err := botdetect.NewDecider(requests, p.history.Blacklist(), &botdetect.DeciderOptions{
+		IncludePrivate: !*ignorePrivateIPs,
+		Subject:        attribution,
+		TrustedProxies: trusted,
+		TimeFormat:     *inputTimeFormat,
+		Dedup:          dedup,
+		VerifiedHeader: *verifiedHeaderName,
+		OnDuplicate: func(ip net.IP, in *botdetect.Input) {
+			traceLog("ip: %s, duplicate event at %s", ip, in.Time)
+			p.duplicates.Inc()
+		},
+		OnUnknownHop: func(in *botdetect.Input, fallback net.IP) {
+			if fallback == nil {
+				p.unknown.Inc("ignored")
+				return
+			}
+			traceLog("ip: %s, fallback for an unknown hop in %s", fallback, in.XFF)
+			p.unknown.Inc("fallback")
+		},
+		OnDecision: func(ip net.IP, in *botdetect.Input, blocked bool, reason string) {
+			traceLog("ip: %s, blacklisted: %v %s", ip, blocked, reason)
+			p.record(ip, in.URL, blocked, reason)
+			p.report.Record(ip, blocked, reason)
+			p.stats.record(blocked)
+			if blocked && !isChallenge(reason) {
+				p.blockLog.Log(ip, in.URL, reason)
+			}
+		},
+		FailOpen: func() bool {
+			shedding, _ := p.history.Shedding()
+			return shedding
+		},
+		OnDrop: func(req *botdetect.Request) {
+			p.dropped.Inc()
+		},
+	})
+	if err != nil {
+		return err
+	}
+	p.decider = decider
+	return nil
+}
+
+// blocked determines whether requests from the IP should be blocked and why.
+// proxy is the reason returned by p.proxy and agent the bot recognized by
+// p.userAgent for the request.
+func (p *policy) blocked(ip net.IP, proxy string, agent botdetect.UserAgent) (bool, string) {
+	if p.manual.IsUnblocked(ip) {
+		return false, "manually unblocked"
+	}
+	if p.manual.IsBlocked(ip) {
+		return true, "manually blocked"
+	}
+	if p.hostnames != nil && p.manual.HasHosts() {
+		// until the host names are known only the IP entries apply
+		if names, ok := p.hostnames.Confirmed(ip); ok {
+			if entry, ok := p.manual.UnblockedHost(names); ok {
+				return false, "manually unblocked " + entry
+			}
+			if entry, ok := p.manual.BlockedHost(names); ok {
+				return true, "manually blocked " + entry
+			}
+		}
+	}
+
+	if p.crawlers != nil {
+		if crawler, ok := p.crawlers.Verified(ip); ok {
+			if !p.crawlDelay.Allow(crawler) {
+				// blocking a crawler could get the site deindexed
+				return true, challengedBy + "crawl delay exceeded by " + crawler.Name
+			}
+			return false, "verified " + crawler.Name
+		}
+	}
+
+	if p.geo.IsAllowed(ip) {
+		return false, "allowed by geo policy"
+	}
+	if p.geo.IsDenied(ip) {
+		return true, "denied by geo policy"
+	}
+
+	if decided, blocked, reason := p.agentPolicy(ip, agent); decided {
+		return blocked, reason
+	}
+
+	if proxy != "" {
+		return true, proxy
+	}
+
+	if p.fanout != nil {
+		// count the decisions of all policies, the primary one is
+		// enforced below
+		p.fanout.IsBlacklisted(ip)
+	}
+
+	if blocked, reason := p.engine.Check(ip); blocked {
+		if entry, ok := p.history.Blacklist().Entry(ip); ok && entry.Severity == botdetect.SeverityChallenge {
+			return true, challengedBy + reason
+		}
+		return true, "blacklisted by " + reason
+	}
+	return false, ""
+}
+
+// noPublicIPReason is the reason for blocking or challenging requests without
+// a public IP with -no-public-ip
+const noPublicIPReason = "no public IP"
+
+// challengedBy starts the reason of IPs blacklisted by a rule with
+// severity=challenge, whose requests are answered with CHALLENGE
+const challengedBy = "challenged by "
+
+// isChallenge determines whether a blocked request is to be challenged
+// rather than blocked
+func isChallenge(reason string) bool {
+	return strings.HasPrefix(reason, challengedBy)
+}
+
+// reasonLabel returns the label the reason of a decision is counted under in
+// botdetect_decisions_total: the kind of check, or the rule that blacklisted
+// the IP, without the names, entries and counts that would make a new series
+// for every IP
+func reasonLabel(reason string) string {
+	prefix := ""
+	for _, p := range []string{challengedBy, "blacklisted by "} {
+		if strings.HasPrefix(reason, p) {
+			prefix, reason = p, reason[len(p):]
+			break
+		}
+	}
+	for _, kind := range []string{
+		"manually blocked", "manually unblocked", "crawl delay exceeded", "verified", "allowed by geo policy",
+		"denied by geo policy", "spoofed AI crawler", "AI crawler", "user agent", "proxy", noPublicIPReason,
+		maintenancePassThrough,
+	} {
+		if strings.HasPrefix(reason, kind) {
+			return prefix + kind
+		}
+	}
+	return prefix + botdetect.ReasonLabel(reason)
+}
+
+// proxy checks whether the request came through an open proxy. It returns
+// the reason to block the request, or an empty string if it came directly or
+// proxies are only logged.
+func (p *policy) proxy(in *botdetect.Input) string {
+	if p.proxies == nil {
+		return ""
+	}
+
+	proxied, why := p.proxies.Detect(in)
+	if !proxied {
+		return ""
+	}
+
+	p.proxied.Inc()
+	traceLog("proxied request from %s|%s: %s", in.Remote, in.XFF, why)
+	if !p.proxyBlock {
+		return ""
+	}
+	return "proxy: " + why
+}
+
+// record adds the decision to the metrics and, if the request was blocked or
+// challenged, to the audit log. Decisions to let requests pass would push
+// the trails of blocked IPs out of the log.
+func (p *policy) record(ip net.IP, url string, blocked bool, reason string) {
+	decision := ok
+	if blocked {
+		decision = block
+		if isChallenge(reason) {
+			decision = challenge
+		}
+	}
+	p.decisions.Inc(decision, reasonLabel(reason))
+	if !blocked {
+		return
+	}
+	if asn, ok := p.asns.Lookup(ip); ok {
+		p.asnBlocks.Inc(asn.String(), asn.Name)
+	}
+	p.audit.Record(ip, botdetect.AuditEntry{
+		Decision: decision,
+		Reason:   reason,
+		URL:      url,
+	})
+}
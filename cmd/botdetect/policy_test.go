@@ -0,0 +1,70 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+func TestCrawlDelayChallenges(t *testing.T) {
+	crawlers := botdetect.NewCrawlerVerifier(botdetect.DefaultCrawlers, net.DefaultResolver, time.Second, time.Hour)
+	crawlers.Import([]botdetect.CrawlerRecord{{IP: "66.249.66.1", Crawler: "Googlebot", Expires: time.Now().Add(time.Hour)}})
+	decider, err := botdetect.NewDecider(make(chan *botdetect.Request, 10), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &policy{
+		decider:     decider,
+		manual:      botdetect.NewManualList(),
+		crawlers:    crawlers,
+		crawlDelay:  botdetect.NewCrawlDelay(time.Hour),
+		noPublicIP:  "allow",
+		maintenance: &maintenance{},
+	}
+
+	in := &botdetect.Input{Remote: "66.249.66.1", URL: "/"}
+	if answer, _ := p.decideInput(in); answer != ok {
+		t.Errorf("expected the first request of the crawler to pass, got %s", answer)
+	}
+	// a crawler that is too fast is slowed down, never blocked
+	if answer, decision := p.decideInput(in); answer != challenge || !isChallenge(decision.Reason) {
+		t.Errorf("expected CHALLENGE for the crawl delay, got %s (%s)", answer, decision.Reason)
+	}
+}
+
+func TestReasonLabel(t *testing.T) {
+	for reason, expected := range map[string]string{
+		"":                                   "",
+		"manually blocked *.scraper.example": "manually blocked",
+		challengedBy + "crawl delay exceeded by Googlebot": challengedBy + "crawl delay exceeded",
+		"verified Bingbot":                                                  "verified",
+		"user agent python-requests (library)":                              "user agent",
+		"blacklisted by rule 1m0s:20:0.9":                                   "blacklisted by rule 1m0s:20:0.9",
+		"blacklisted by fingerprint 0123456789abcdef of 12 blacklisted IPs": "blacklisted by fingerprint",
+		challengedBy + noPublicIPReason:                                     challengedBy + noPublicIPReason,
+	} {
+		if label := reasonLabel(reason); label != expected {
+			t.Errorf("%q: expected %q, got %q", reason, expected, label)
+		}
+	}
+}
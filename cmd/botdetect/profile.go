@@ -0,0 +1,74 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/elcamino/botdetect"
+	"github.com/namsral/flag"
+)
+
+// profiles are flag defaults tuned for a kind of site, see applyProfile
+var profiles = map[string]map[string]string{
+	// single-page applications load few documents and make many JSON API
+	// calls, which would count as app requests
+	"spa": {
+		"fetch-metadata":  "true",
+		"api-paths":       "/api/*,/graphql",
+		"asset-types":     strings.Join(botdetect.DefaultAssetTypes, ",") + ",application/json",
+		"uncounted-paths": "/.well-known/*,/manifest.json,/service-worker.js,/sw.js",
+	},
+}
+
+// profileNames returns the names of the profiles in order
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the flags of the profile chosen by -profile that haven't
+// been set on the command line, in the environment or in the config file
+func applyProfile() error {
+	if *profile == "" {
+		return nil
+	}
+	defaults, ok := profiles[*profile]
+	if !ok {
+		return fmt.Errorf("unknown profile '%s': expected %s", *profile, strings.Join(profileNames(), ", "))
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range defaults {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("profile %s: %s", *profile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// redisRetry is how long the client-side cache waits before it subscribes
+// to the invalidations again after Redis failed
+const redisRetry = 5 * time.Second
+
+// parseRedis connects the replicas through -redis, if set
+func parseRedis() (*botdetect.RedisStore, error) {
+	if *redisAddrs == "" {
+		if *replica != "" || *leaderLease != 0 {
+			return nil, fmt.Errorf("replica and leader-lease require redis")
+		}
+		return nil, nil
+	}
+	if *redisCache < 0 {
+		return nil, fmt.Errorf("redis-cache must not be negative")
+	}
+	if *redisRetention <= 0 {
+		return nil, fmt.Errorf("redis-retention must be greater than zero")
+	}
+	if *leaderLease < 0 || *leaderLease > 0 && *replica == "" {
+		return nil, fmt.Errorf("leader-lease must not be negative and requires replica")
+	}
+
+	client, err := botdetect.NewRedisClient(botdetect.RedisOptions{
+		Addrs:      splitList(*redisAddrs),
+		Topology:   *redisTopology,
+		MasterName: *redisMaster,
+		Username:   *redisUsername,
+		Password:   *redisPassword,
+		DB:         *redisDB,
+		Timeout:    *timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	store := botdetect.NewRedisStore(client, *redisPrefix, *redisRetention)
+	// after ten half-lives a score has decayed to almost nothing
+	store.ReputationTTL = 10 * *reputationHalfLife
+	return store, nil
+}
+
+// useRedis keeps the reputations in the store and, with -replica, shares the
+// request counts of the replicas through it and elects the leader with
+// -leader-lease until the context is done. It returns the counter of the
+// errors by what the exchange was for.
+func useRedis(ctx context.Context, options *botdetect.IPHistoryOptions, store *botdetect.RedisStore) (*botdetect.CounterVec, error) {
+	errors := options.Metrics.Counter("botdetect_redis_errors_total", "Number of failed exchanges with Redis by what they were for", "use")
+	if options.Reputation != nil {
+		options.Reputation.Store = store.Reputations()
+		options.Reputation.Timeout = *timeout
+		options.Reputation.OnError = func(err error) {
+			errors.Inc("reputation")
+			log.Printf("%s reputation error: %s\n", callsign, err)
+		}
+	}
+	if *replica != "" {
+		options.Replication = &botdetect.ReplicationOptions{
+			Store:   store,
+			Replica: *replica,
+			Timeout: *timeout,
+			OnError: func(err error) {
+				errors.Inc("replication")
+				log.Printf("%s replication error: %s\n", callsign, err)
+			},
+		}
+	}
+	if *leaderLease > 0 {
+		elector, err := botdetect.NewLeaseElector(store, "leader", *replica, *leaderLease)
+		if err != nil {
+			return nil, err
+		}
+		elector.Timeout = *timeout
+		elector.OnError = func(err error) {
+			errors.Inc("leader")
+			log.Printf("%s leader election error: %s\n", callsign, err)
+		}
+		options.Leader = elector
+		go elector.Run(ctx)
+
+		options.Metrics.GaugeFunc("botdetect_leader", "Whether this replica holds -leader-lease and evaluates the rules", func() float64 {
+			if elector.IsLeader() {
+				return 1
+			}
+			return 0
+		})
+	}
+	return errors, nil
+}
+
+// shareBlacklist shares the blacklist through the store until the context
+// is done, caching lookups with -redis-cache. Failed lookups are only
+// counted, they may happen for every request while Redis is down.
+func shareBlacklist(ctx context.Context, blacklist *botdetect.Blacklist, store *botdetect.RedisStore, metrics *botdetect.Metrics, errors *botdetect.CounterVec) {
+	if *redisCache > 0 {
+		go store.Cache(ctx, *redisCache, redisRetry, func(err error) {
+			errors.Inc("cache")
+			log.Printf("%s redis cache error: %s\n", callsign, err)
+		})
+		metrics.CounterFunc("botdetect_redis_cache_hits_total", "Number of blacklist lookups answered from the client-side cache", func() float64 {
+			hits, _ := store.CacheStats()
+			return float64(hits)
+		})
+		metrics.CounterFunc("botdetect_redis_cache_misses_total", "Number of blacklist lookups sent to Redis", func() float64 {
+			_, misses := store.CacheStats()
+			return float64(misses)
+		})
+	}
+
+	go func() {
+		err := blacklist.Share(ctx, &botdetect.SharedBlacklistOptions{
+			Store:   store,
+			Timeout: *timeout,
+			OnError: func(err error) {
+				errors.Inc("blacklist")
+			},
+		})
+		if err != nil {
+			log.Printf("%s error sharing the blacklist: %s\n", callsign, err)
+		}
+	}()
+}
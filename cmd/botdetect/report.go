@@ -0,0 +1,162 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// checkReport verifies that reports have somewhere to go if they are enabled
+func checkReport() error {
+	if *reportInterval <= 0 {
+		return nil
+	}
+	if *reportFile == "" && *reportWebhook == "" && *reportEmail == "" {
+		return fmt.Errorf("report-interval requires report-file, report-webhook or report-email")
+	}
+	if *reportEmail != "" && (*reportSMTP == "" || *reportFrom == "") {
+		return fmt.Errorf("report-email requires report-smtp and report-from")
+	}
+	return nil
+}
+
+// reportLoop delivers a report at every multiple of the interval, e.g. at
+// midnight for daily reports, until the context is done
+func reportLoop(ctx context.Context, rc *botdetect.ReportCollector, interval time.Duration) {
+	timer := time.NewTimer(time.Until(time.Now().Truncate(interval).Add(interval)))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			deliverReport(rc.Report())
+			timer.Reset(time.Until(now.Truncate(interval).Add(interval)))
+		}
+	}
+}
+
+// deliverReport sends the report to every configured destination
+func deliverReport(r *botdetect.Report) {
+	for _, d := range []struct {
+		name string
+		to   string
+		fn   func(*botdetect.Report) error
+	}{
+		{"file", *reportFile, writeReportFile},
+		{"webhook", *reportWebhook, postReport},
+		{"email", *reportEmail, mailReport},
+	} {
+		if d.to == "" {
+			continue
+		}
+		if err := d.fn(r); err != nil {
+			log.Printf("%s error delivering the report by %s: %s\n", callsign, d.name, err)
+		}
+	}
+}
+
+// writeReportFile appends the report to the report file
+func writeReportFile(r *botdetect.Report) error {
+	f, err := os.OpenFile(*reportFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteText(f); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Fprintln(f)
+	return f.Close()
+}
+
+// postReport posts the report as JSON to the webhook
+func postReport(r *botdetect.Report) error {
+	return postJSON(*reportWebhook, r)
+}
+
+// postJSON posts v as JSON to the webhook at url
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// mailReport mails the report through the SMTP relay
+func mailReport(r *botdetect.Report) error {
+	to := splitList(*reportEmail)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *reportFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: botdetect report %s\r\n", r.End.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	if err := r.WriteText(&msg); err != nil {
+		return err
+	}
+
+	return smtp.SendMail(*reportSMTP, nil, *reportFrom, to, msg.Bytes())
+}
+
+// disabledRule alerts about a rule disabled for blacklisting too many of the
+// client IPs
+func disabledRule(d botdetect.DisabledRule) {
+	log.Printf("%s disabled %s, %d blocks lifted, re-enable it through /disabled-rules\n", callsign, d, d.Lifted)
+	if *runawayWebhook == "" {
+		return
+	}
+	// the rules are checked by the calculate loop, which mustn't wait
+	go func() {
+		if err := postJSON(*runawayWebhook, d); err != nil {
+			log.Printf("%s error posting the disabled rule to the webhook: %s\n", callsign, err)
+		}
+	}()
+}
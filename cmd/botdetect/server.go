@@ -0,0 +1,741 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// eventsBuffer is the number of blacklist events a subscriber may fall
+// behind, eventsKeepalive the interval of comments that keep idle streams
+// open through proxies
+const (
+	eventsBuffer    = 1024
+	eventsKeepalive = 15 * time.Second
+)
+
+// newServer creates the HTTP server that exposes the operational endpoints
+func newServer(addr string, ns *namespaces, options *botdetect.IPHistoryOptions, auth *serverAuth) *http.Server {
+	history := ns.primary.history
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checkHandler(history.Alive))
+	mux.HandleFunc("/readyz", checkHandler(history.Ready))
+	mux.HandleFunc("/metrics", metricsHandler(options.Metrics))
+	mux.HandleFunc("/check", decisionHandler(ns))
+	mux.HandleFunc("/auth", authHandler(ns))
+	mux.HandleFunc("/auth/", authHandler(ns))
+	mux.HandleFunc("/blacklisted", blacklistedHandler(ns))
+	mux.HandleFunc("/feedback", feedbackHandler(ns))
+	mux.HandleFunc("/stats", statsHandler(ns))
+	mux.HandleFunc("/connections", connectionsHandler(ns))
+	mux.HandleFunc("/grants", grantsHandler(ns))
+	mux.HandleFunc("/canary", canaryHandler(ns))
+	mux.HandleFunc("/disabled-rules", disabledRulesHandler(ns))
+	mux.HandleFunc("/greylist", greylistHandler(ns))
+	mux.HandleFunc("/whitelist", whitelistHandler(ns))
+	mux.HandleFunc("/maintenance", maintenanceHandler(ns))
+
+	// streams would keep the graceful shutdown waiting
+	shutdown := make(chan struct{})
+	mux.HandleFunc("/blacklist/events", eventsHandler(ns, shutdown))
+	mux.HandleFunc("/slots", slotsHandler(ns))
+	if options.Audit != nil {
+		mux.HandleFunc("/audit", auditHandler(options.Audit))
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           auth.requireToken(mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if auth != nil {
+		srv.TLSConfig = auth.tls
+	}
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+	return srv
+}
+
+// serve runs the server until the context is done and in-flight requests
+// have been answered
+func serve(ctx context.Context, srv *http.Server) {
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	traceLog("listening on %s", srv.Addr)
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Printf("%s server error: %s\n", callsign, err)
+		return
+	}
+	<-shutdownDone
+}
+
+// checkHandler turns a health check into an HTTP handler
+func checkHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, ok)
+	}
+}
+
+// auditHandler returns the audit trail of the IP given in the ip parameter as
+// JSON. The trail covers the shared history, which clients with a namespace
+// have no access to.
+func auditHandler(audit *botdetect.AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientFrom(r.Context()).namespace != "" {
+			http.Error(w, "the audit trail only covers the shared history", http.StatusForbidden)
+			return
+		}
+
+		ip := botdetect.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
+			http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(audit.Entries(ip.To16()))
+	}
+}
+
+// slotsFlushEvery is the number of slots after which /slots flushes its
+// answer, so that large exports stream
+const slotsFlushEvery = 1000
+
+// slotsHandler streams the per-slot aggregates of the client's namespace as
+// NDJSON, one botdetect.SlotAggregate per line, limited to the slots starting
+// at the since parameter or later and before until, both RFC 3339. With
+// complete=true the current slot, which is still being counted, is left out.
+func slotsHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history := ns.get(ns.forRequest(r)).history
+
+		var since, until time.Time
+		for _, p := range []struct {
+			name string
+			t    *time.Time
+		}{{"since", &since}, {"until", &until}} {
+			if v := r.FormValue(p.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "invalid "+p.name+" parameter", http.StatusBadRequest)
+					return
+				}
+				*p.t = t
+			}
+		}
+		if complete, _ := strconv.ParseBool(r.FormValue("complete")); complete {
+			if current := history.CurrentSlot(); until.IsZero() || current.Before(until) {
+				until = current
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		n := 0
+		history.Slots(since, until, func(s botdetect.SlotAggregate) bool {
+			if err := enc.Encode(s); err != nil {
+				// the client went away
+				return false
+			}
+			if n++; n%slotsFlushEvery == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return r.Context().Err() == nil
+		})
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(metrics *botdetect.Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WritePrometheus(w)
+	}
+}
+
+// decisionHandler decides on a request given by the parameters remote, xff,
+// url, time, forwarded, ua, status, user, content-type, connections,
+// cache-status, header-order, verified (see -verified-header) and
+// botdetect.FetchHeaders in lower case, e.g. sec-fetch-dest, in the namespace
+// of the client (or of the host parameter, see forRequest) and answers OK,
+// BLOCK or CHALLENGE, just like on stdin. With -annotate or -rate-limit-headers the answer carries the
+// headers set by annotate.
+func decisionHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in := &botdetect.Input{
+			Remote: r.FormValue("remote"),
+			XFF:    r.FormValue("xff"),
+			URL:    r.FormValue("url"),
+			Time:   r.FormValue("time"),
+			Status: r.FormValue("status"),
+			User:   r.FormValue("user"),
+
+			ContentType: r.FormValue("content-type"),
+			Connections: r.FormValue("connections"),
+			CacheStatus: r.FormValue("cache-status"),
+			HeaderOrder: r.FormValue("header-order"),
+		}
+		in.Headers = map[string]string{}
+		if fwd := r.FormValue("forwarded"); fwd != "" {
+			in.Headers["Forwarded"] = fwd
+		}
+		if ua := r.FormValue("ua"); ua != "" {
+			in.Headers["User-Agent"] = ua
+		}
+		for _, name := range botdetect.FetchHeaders {
+			if v := r.FormValue(strings.ToLower(name)); v != "" {
+				in.Headers[name] = v
+			}
+		}
+		if v := r.FormValue("verified"); v != "" {
+			in.Headers[textproto.CanonicalMIMEHeaderKey(*verifiedHeaderName)] = v
+		}
+		if in.Remote == "" && in.XFF == "" && in.Headers["Forwarded"] == "" {
+			http.Error(w, "missing remote, xff or forwarded parameter", http.StatusBadRequest)
+			return
+		}
+
+		p := ns.get(ns.forRequest(r))
+		answer, decision := p.decideInput(in)
+		p.annotate(w.Header(), decision)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, answer)
+	}
+}
+
+// authStatus maps the answers to the status codes of /auth
+var authStatus = map[string]int{
+	ok:        http.StatusOK,
+	block:     http.StatusForbidden,
+	challenge: http.StatusUnauthorized,
+}
+
+// authHandler decides on the request described by the headers of an
+// authorization subrequest, as sent by nginx' auth_request, Envoy's
+// ext_authz HTTP service or HAProxy's haproxy-auth-request: X-Real-IP and X-Forwarded-For carry the client,
+// X-Original-URI or the path after /auth the URL, and Forwarded, User-Agent,
+// -verified-header and botdetect.FetchHeaders are passed on. It answers 200 for OK, 403 for
+// BLOCK and 401 for CHALLENGE, with the answer in the X-Botdetect-Decision
+// header and, with -annotate or -rate-limit-headers, the headers set by
+// annotate.
+func authHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in := &botdetect.Input{
+			Remote: r.Header.Get("X-Real-IP"),
+			XFF:    r.Header.Get("X-Forwarded-For"),
+			URL:    r.Header.Get("X-Original-URI"),
+		}
+		if in.URL == "" {
+			in.URL = strings.TrimPrefix(r.URL.RequestURI(), "/auth")
+		}
+		if in.URL == "" {
+			in.URL = "/"
+		}
+		in.Headers = map[string]string{}
+		if fwd := r.Header.Get("Forwarded"); fwd != "" {
+			in.Headers["Forwarded"] = fwd
+		}
+		if ua := r.Header.Get("User-Agent"); ua != "" {
+			in.Headers["User-Agent"] = ua
+		}
+		for _, name := range botdetect.FetchHeaders {
+			if v := r.Header.Get(name); v != "" {
+				in.Headers[name] = v
+			}
+		}
+		if v := r.Header.Get(*verifiedHeaderName); v != "" {
+			in.Headers[textproto.CanonicalMIMEHeaderKey(*verifiedHeaderName)] = v
+		}
+		if in.Remote == "" && in.XFF == "" && in.Headers["Forwarded"] == "" {
+			http.Error(w, "missing X-Real-IP, X-Forwarded-For or Forwarded header", http.StatusBadRequest)
+			return
+		}
+
+		p := ns.get(ns.forRequest(r))
+		answer, decision := p.decideInput(in)
+		p.annotate(w.Header(), decision)
+		w.Header().Set("X-Botdetect-Decision", answer)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(authStatus[answer])
+		fmt.Fprintln(w, answer)
+	}
+}
+
+// annotate sets the X-Botdetect-Score, X-Botdetect-Remaining and
+// X-Botdetect-Flags headers from the annotations of the IPs of the decision
+// if -annotate is set, and the X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset headers if -rate-limit-headers is set. The flags header
+// is "none" for clients without flags so that proxies always have a value to
+// pass on. The reset is in seconds from now, 0 if nothing is counted.
+func (p *policy) annotate(header http.Header, decision botdetect.Decision) {
+	if !*annotateResponses && !*rateLimitHeaders {
+		return
+	}
+
+	a := p.history.Annotate(decision.IPs...)
+	if *annotateResponses {
+		flags := "none"
+		if len(a.Flags) > 0 {
+			flags = strings.Join(a.Flags, ",")
+		}
+		header.Set("X-Botdetect-Score", strconv.FormatFloat(a.Score, 'f', -1, 64))
+		header.Set("X-Botdetect-Remaining", strconv.FormatInt(a.Remaining, 10))
+		header.Set("X-Botdetect-Flags", flags)
+	}
+	if *rateLimitHeaders && a.Remaining >= 0 {
+		reset := int64(0)
+		if !a.Reset.IsZero() {
+			reset = int64(math.Ceil(time.Until(a.Reset).Seconds()))
+		}
+		header.Set("X-RateLimit-Limit", strconv.FormatUint(a.Limit, 10))
+		header.Set("X-RateLimit-Remaining", strconv.FormatInt(a.Remaining, 10))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+	}
+}
+
+// blacklistedHandler answers whether the IP given in the ip parameter is on
+// the blacklist of the client's namespace as JSON, without recording a
+// request
+func blacklistedHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := botdetect.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+			return
+		}
+
+		entry, blacklisted := ns.get(ns.forRequest(r)).history.Blacklist().Entry(ip)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			IP          string             `json:"ip"`
+			Blacklisted bool               `json:"blacklisted"`
+			Reason      string             `json:"reason,omitempty"`
+			Severity    botdetect.Severity `json:"severity,omitempty"`
+		}{ip.String(), blacklisted, entry.Reason, entry.Severity})
+	}
+}
+
+// connectionsHandler records connections opened and closed by clients for
+// -max-connections. It expects a POST request with the parameters ip and
+// event, which is either open or close.
+func connectionsHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip := botdetect.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+			return
+		}
+
+		concurrency := ns.get(ns.forRequest(r)).history.Options().Concurrency
+		if concurrency == nil {
+			http.Error(w, "connections aren't tracked without -max-connections", http.StatusNotFound)
+			return
+		}
+
+		switch r.FormValue("event") {
+		case "open":
+			concurrency.Open(ip, time.Now())
+		case "close":
+			concurrency.Close(ip, time.Now())
+		default:
+			http.Error(w, "invalid or missing event parameter: expected open or close", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// statsHandler reports the number of decisions, blocks, blacklisted IPs and
+// tracked IPs of the namespace of the client as JSON. Clients without a
+// namespace get the statistics of all namespaces.
+func statsHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ns.stats(clientFrom(r.Context()).namespace))
+	}
+}
+
+// feedbackHandler lets operators report falsely blacklisted IPs. It expects
+// a POST request with the parameters ip, an optional comment and an optional
+// exempt duration during which the IP won't be blacklisted again.
+func feedbackHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		history := ns.get(ns.forRequest(r)).history
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip := botdetect.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+			return
+		}
+
+		exemptFor := *feedbackExempt
+		if v := r.FormValue("exempt"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid exempt parameter", http.StatusBadRequest)
+				return
+			}
+			exemptFor = d
+		}
+
+		reason, wasBlacklisted := history.ReportFalsePositiveBy(ip, exemptFor, r.FormValue("comment"), client.String())
+		log.Printf("%s false positive reported for %s by %s (blacklisted: %v, reason: %s)\n", callsign, ip, client, wasBlacklisted, reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			IP             string `json:"ip"`
+			WasBlacklisted bool   `json:"was_blacklisted"`
+			Reason         string `json:"reason,omitempty"`
+			ExemptUntil    string `json:"exempt_until"`
+		}{
+			IP:             ip.String(),
+			WasBlacklisted: wasBlacklisted,
+			Reason:         reason,
+			ExemptUntil:    time.Now().Add(exemptFor).Format(time.RFC3339),
+		})
+	}
+}
+
+// grantsHandler manages the grants that temporarily raise the limits for an
+// IP or network in the client's namespace. GET lists them, POST grants the
+// parameters network, factor, for (a duration) and an optional comment and
+// DELETE revokes the grant for the network parameter, all answering JSON.
+func grantsHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		history := ns.get(ns.forRequest(r)).history
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history.Grants())
+
+		case http.MethodPost:
+			factor, err := strconv.ParseFloat(r.FormValue("factor"), 64)
+			if err != nil {
+				http.Error(w, "invalid or missing factor parameter", http.StatusBadRequest)
+				return
+			}
+			duration, err := time.ParseDuration(r.FormValue("for"))
+			if err != nil {
+				http.Error(w, "invalid or missing for parameter", http.StatusBadRequest)
+				return
+			}
+
+			grant, err := history.Grant(r.FormValue("network"), factor, duration, r.FormValue("comment"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s grant %s by %s\n", callsign, grant, client)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(grant)
+
+		case http.MethodDelete:
+			network := r.FormValue("network")
+			revoked := history.Revoke(network, r.FormValue("comment"))
+			if revoked {
+				log.Printf("%s grant for %s revoked by %s\n", callsign, network, client)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Network string `json:"network"`
+				Revoked bool   `json:"revoked"`
+			}{network, revoked})
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// disabledRulesHandler lists the rules disabled by -runaway-percent in the
+// client's namespace on GET and re-enables the one given by the parameter
+// rule on DELETE, both answering JSON
+func disabledRulesHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		history := ns.get(ns.forRequest(r)).history
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history.DisabledRules())
+
+		case http.MethodDelete:
+			rule := r.FormValue("rule")
+			enabled := history.EnableRule(rule)
+			if enabled {
+				log.Printf("%s %s re-enabled by %s\n", callsign, rule, client)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Rule    string `json:"rule"`
+				Enabled bool   `json:"enabled"`
+			}{rule, enabled})
+
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// greylistHandler lists the greylisted IPs of the client's namespace as JSON
+// on GET and takes the IP given by the parameter ip off the greylist on
+// DELETE
+func greylistHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		history := ns.get(ns.forRequest(r)).history
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history.Greylist().Entries())
+
+		case http.MethodDelete:
+			ip := botdetect.ParseIP(r.FormValue("ip"))
+			if ip == nil {
+				http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+				return
+			}
+			removed := history.Greylist().Remove(ip)
+			if removed {
+				log.Printf("%s %s taken off the greylist by %s\n", callsign, ip, client)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				IP      string `json:"ip"`
+				Removed bool   `json:"removed"`
+			}{ip.String(), removed})
+
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// whitelistHandler manages the IPs of the client's namespace that must not be
+// blacklisted. GET lists the exemptions, POST exempts the parameter ip for
+// for (a duration) with an optional reason and DELETE removes the exemption
+// of ip, all answering JSON.
+func whitelistHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		history := ns.get(ns.forRequest(r)).history
+
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history.Exemptions())
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip := botdetect.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			removed := history.Unexempt(ip, r.FormValue("reason"))
+			if removed {
+				log.Printf("%s exemption of %s removed by %s\n", callsign, ip, client)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				IP      string `json:"ip"`
+				Removed bool   `json:"removed"`
+			}{ip.String(), removed})
+			return
+		}
+
+		duration, err := time.ParseDuration(r.FormValue("for"))
+		if err != nil {
+			http.Error(w, "invalid or missing for parameter", http.StatusBadRequest)
+			return
+		}
+		e, err := history.Exempt(ip, duration, r.FormValue("reason"), client.String(), botdetect.ExemptionManual)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s exempt %s by %s\n", callsign, e, client)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+// canaryHandler reports the percentage of IPs that are blacklisted in the
+// client's namespace as JSON on GET and changes it on POST with the parameter
+// percent, 0 blacklisting all IPs. Clients without a namespace change it for
+// all namespaces except those overriding it in -tenant-config.
+func canaryHandler(ns *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFrom(r.Context())
+		name := ns.forRequest(r)
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+			if err != nil {
+				http.Error(w, "invalid or missing percent parameter", http.StatusBadRequest)
+				return
+			}
+
+			update := func(o *botdetect.IPHistoryOptions) { o.Canary = percent }
+			if name == "" {
+				err = ns.updateOptions(update)
+			} else {
+				err = ns.get(name).history.UpdateOptions(update)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s canary set to %g%% by %s\n", callsign, percent, client)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Percent float64 `json:"percent"`
+		}{ns.get(name).history.Options().Canary})
+	}
+}
+
+// eventsHandler streams the blacklist of the client's namespace as server-sent
+// events: an add event for every entry first, then add and remove events as
+// the blacklist changes. The stream ends if the client can't keep up; it
+// should reconnect and replace its copy with the new entries.
+func eventsHandler(ns *namespaces, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		entries, events, cancel := ns.get(ns.forRequest(r)).history.Blacklist().Subscribe(eventsBuffer)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		send := func(ev botdetect.BlacklistEvent) bool {
+			data, _ := json.Marshal(ev)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			return err == nil
+		}
+		for _, e := range entries {
+			if !send(botdetect.BlacklistEvent{Type: botdetect.BlacklistAdd, IP: e.IP, Expires: e.Expires, Reason: e.Reason, Severity: e.Severity}) {
+				return
+			}
+		}
+		// tells the client that its copy is complete
+		fmt.Fprint(w, "event: synced\ndata: {}\n\n")
+		flusher.Flush()
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case ev, ok := <-events:
+				if !ok {
+					traceLog("blacklist subscriber %s fell behind", r.RemoteAddr)
+					return
+				}
+				if !send(ev) {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
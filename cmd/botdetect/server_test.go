@@ -0,0 +1,49 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elcamino/botdetect"
+)
+
+func TestAuditNamespace(t *testing.T) {
+	audit := botdetect.NewAuditLog(10, 10)
+	audit.Record(net.ParseIP("192.0.2.1"), botdetect.AuditEntry{Decision: block, Reason: "blacklisted by walk", URL: "/"})
+	handler := auditHandler(audit)
+
+	for namespace, status := range map[string]int{"": http.StatusOK, "shop": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/audit?ip=192.0.2.1", nil)
+		r = r.WithContext(context.WithValue(r.Context(), clientKey{}, apiClient{name: "client", namespace: namespace}))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != status {
+			t.Errorf("namespace %q: expected status %d, got %d", namespace, status, w.Code)
+		}
+		if leaked := strings.Contains(w.Body.String(), "walk"); leaked != (status == http.StatusOK) {
+			t.Errorf("namespace %q: unexpected answer %q", namespace, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/elcamino/botdetect"
+)
+
+// sinkSpec is a sink of -sinks: stdout, file:PATH, webhook:URL or kafka:URL
+type sinkSpec struct {
+	kind   string
+	target string
+}
+
+func (s sinkSpec) String() string {
+	if s.target == "" {
+		return s.kind
+	}
+	return s.kind + ":" + s.target
+}
+
+// parseSinks parses -sinks
+func parseSinks() ([]sinkSpec, error) {
+	specs := []sinkSpec{}
+	for _, s := range splitList(*sinks) {
+		kind, target, _ := strings.Cut(s, ":")
+		spec := sinkSpec{kind: kind, target: target}
+		switch kind {
+		case "stdout":
+			if target != "" {
+				return nil, fmt.Errorf("invalid sink '%s': stdout takes no target", s)
+			}
+		case "file":
+			if target == "" {
+				return nil, fmt.Errorf("invalid sink '%s': expected file:PATH", s)
+			}
+		case "webhook", "kafka":
+			if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid sink '%s': expected %s:URL with an http or https URL", s, kind)
+			}
+		default:
+			return nil, fmt.Errorf("invalid sink '%s': expected stdout, file:PATH, webhook:URL or kafka:URL", s)
+		}
+		specs = append(specs, spec)
+	}
+	if *sinkBuffer <= 0 {
+		return nil, fmt.Errorf("sink-buffer must be greater than zero")
+	}
+	return specs, nil
+}
+
+// openSinks opens the sinks of -sinks. The stdout sink replaces the answers.
+func openSinks(specs []sinkSpec, metrics *botdetect.Metrics) (*botdetect.DecisionSinks, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	sinks := botdetect.NewDecisionSinks(metrics)
+	kinds := make(map[string]int)
+	for _, spec := range specs {
+		// sinks of the same kind are numbered in the metrics and the log
+		kinds[spec.kind]++
+		name := spec.kind
+		if n := kinds[spec.kind]; n > 1 {
+			name = fmt.Sprintf("%s%d", spec.kind, n)
+		}
+
+		var sink botdetect.Sink
+		switch spec.kind {
+		case "stdout":
+			sink = botdetect.NewWriterSink(os.Stdout)
+		case "file":
+			f, err := botdetect.NewFileSink(spec.target)
+			if err != nil {
+				sinks.Close()
+				return nil, fmt.Errorf("error opening sink %s: %s", spec, err)
+			}
+			sink = f
+		case "webhook":
+			sink = botdetect.NewWebhookSink(spec.target)
+		case "kafka":
+			sink = botdetect.NewKafkaSink(spec.target)
+		}
+		sinks.Add(sink, botdetect.SinkOptions{
+			Name:   name,
+			Buffer: *sinkBuffer,
+			OnError: func(name string, err error) {
+				log.Printf("%s error writing decisions to the %s sink: %s\n", callsign, name, err)
+			},
+		})
+	}
+	return sinks, nil
+}
+
+// sinkStdout returns whether the decisions go to the stdout sink instead of
+// the answers
+func sinkStdout(specs []sinkSpec) bool {
+	for _, spec := range specs {
+		if spec.kind == "stdout" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// loadState reads a saved state into the history and returns when it was
+// taken. A missing file is not an error, it just means there is nothing to
+// restore yet. A state of an older version is migrated; the file is copied
+// first since the next save overwrites it with the new version.
+func loadState(history *botdetect.IPHistory, path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	s, err := botdetect.DecodeState(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if s.Version < botdetect.StateVersion {
+		backup := fmt.Sprintf("%s.v%d", path, s.Version)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if err := writeFileAtomic(backup, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}); err != nil {
+			return time.Time{}, fmt.Errorf("keeping the state of version %d: %w", s.Version, err)
+		}
+		log.Printf("%s migrating the state from version %d to %d, the old state is kept in %s\n",
+			callsign, s.Version, botdetect.StateVersion, backup)
+	}
+	if err := botdetect.MigrateState(s); err != nil {
+		return time.Time{}, err
+	}
+
+	history.ImportState(s)
+	return s.Time, nil
+}
+
+// saveState writes the state of the history to path
+func saveState(history *botdetect.IPHistory, path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return history.WriteStateCodec(w, *stateCodec)
+	})
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so that a
+// crash never leaves a truncated file behind
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadCrawlerCache reads the saved crawler verifications. A missing file is
+// not an error.
+func loadCrawlerCache(crawlers *botdetect.CrawlerVerifier, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return crawlers.ReadCache(f)
+}
+
+// saveCrawlerCache writes the crawler verifications to path
+func saveCrawlerCache(crawlers *botdetect.CrawlerVerifier, path string) error {
+	return writeFileAtomic(path, crawlers.WriteCache)
+}
+
+// loadAudit restores the audit trail from path. A missing file is not an
+// error.
+func loadAudit(audit *botdetect.AuditLog, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return audit.Read(f)
+}
+
+// saveAudit writes the audit trail to path
+func saveAudit(audit *botdetect.AuditLog, path string) error {
+	return writeFileAtomic(path, audit.Write)
+}
+
+// saveAuditLoop saves the audit trail periodically until the context is done
+func saveAuditLoop(ctx context.Context, audit *botdetect.AuditLog, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveAudit(audit, path); err != nil {
+				log.Printf("%s error saving the audit trail: %s\n", callsign, err)
+			}
+		}
+	}
+}
+
+// saveStateLoop saves the state periodically until the context is done
+func saveStateLoop(ctx context.Context, history *botdetect.IPHistory, path string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			if err := saveState(history, path); err != nil {
+				log.Printf("%s error saving the state: %s\n", callsign, err)
+			}
+		}
+	}
+}
+
+// saveCrawlerCacheLoop saves the crawler verifications periodically until the
+// context is done
+func saveCrawlerCacheLoop(ctx context.Context, crawlers *botdetect.CrawlerVerifier, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveCrawlerCache(crawlers, path); err != nil {
+				log.Printf("%s error saving the crawler cache: %s\n", callsign, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// summary counts the lines read from stdin and their decisions for the
+// summary written at the end of the input or on shutdown, so a batch run
+// over a log file leaves a result behind
+type summary struct {
+	start     time.Time
+	lines     uint64
+	invalid   uint64
+	decisions map[string]uint64
+	blocked   *botdetect.ReportCollector
+	mutex     sync.Mutex
+}
+
+// summaryReport is the summary as written
+type summaryReport struct {
+	Start          time.Time               `json:"start"`
+	End            time.Time               `json:"end"`
+	Lines          uint64                  `json:"lines"`
+	InvalidLines   uint64                  `json:"invalid_lines"`
+	Decisions      map[string]uint64       `json:"decisions"`
+	PeakBlacklist  int                     `json:"peak_blacklist_size"`
+	TopBlockedIPs  []botdetect.ReportCount `json:"top_blocked_ips"`
+	BlockedReasons []botdetect.ReportCount `json:"block_reasons"`
+}
+
+func newSummary(top int) *summary {
+	return &summary{
+		start:     time.Now(),
+		decisions: make(map[string]uint64),
+		blocked:   botdetect.NewReportCollector(botdetect.ReportOptions{Top: top}),
+	}
+}
+
+// record counts a line and its answer. decision is nil for invalid lines.
+func (s *summary) record(answer string, decision *botdetect.Decision) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.lines++
+	if decision == nil {
+		s.invalid++
+	}
+	s.decisions[answer]++
+	s.mutex.Unlock()
+
+	// requests blocked with -no-public-ip have no IP to report
+	if decision != nil && decision.Blocked && decision.IP != nil {
+		s.blocked.Record(decision.IP, true, decision.Reason)
+	}
+}
+
+// report returns the summary so far
+func (s *summary) report(history *botdetect.IPHistory) *summaryReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := &summaryReport{
+		Start:         s.start,
+		End:           time.Now(),
+		Lines:         s.lines,
+		InvalidLines:  s.invalid,
+		Decisions:     make(map[string]uint64, len(s.decisions)),
+		PeakBlacklist: history.Blacklist().Peak(),
+	}
+	for answer, n := range s.decisions {
+		r.Decisions[answer] = n
+	}
+	blocked := s.blocked.Report()
+	r.TopBlockedIPs = blocked.TopIPs
+	r.BlockedReasons = blocked.Reasons
+	return r
+}
+
+// writeText writes the summary in a form meant to be read by humans
+func (r *summaryReport) writeText(w io.Writer) error {
+	answers := make([]string, 0, len(r.Decisions))
+	for answer := range r.Decisions {
+		answers = append(answers, answer)
+	}
+	sort.Strings(answers)
+	decisions := make([]string, len(answers))
+	for i, answer := range answers {
+		decisions[i] = fmt.Sprintf("%s %d", answer, r.Decisions[answer])
+	}
+
+	if _, err := fmt.Fprintf(w, "botdetect summary %s - %s\n\nlines:         %d\ninvalid lines: %d\ndecisions:     %s\npeak blacklist size: %d\n",
+		r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), r.Lines, r.InvalidLines,
+		strings.Join(decisions, ", "), r.PeakBlacklist); err != nil {
+		return err
+	}
+
+	for _, section := range []struct {
+		title  string
+		counts []botdetect.ReportCount
+	}{
+		{"top blocked IPs", r.TopBlockedIPs},
+		{"block reasons", r.BlockedReasons},
+	} {
+		if len(section.counts) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "\n%s:\n", section.title); err != nil {
+			return err
+		}
+		for _, c := range section.counts {
+			if _, err := fmt.Fprintf(w, "  %8d  %s\n", c.Count, c.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeSummary writes the summary to stderr if -summary is set and to
+// -summary-file, as JSON if its name ends in .json
+func writeSummary(s *summary, history *botdetect.IPHistory) error {
+	if s == nil {
+		return nil
+	}
+
+	r := s.report(history)
+	if *printSummary {
+		if err := r.writeText(os.Stderr); err != nil {
+			return err
+		}
+	}
+	if *summaryFile == "" {
+		return nil
+	}
+	return writeFileAtomic(*summaryFile, func(w io.Writer) error {
+		if strings.HasSuffix(*summaryFile, ".json") {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(r)
+		}
+		return r.writeText(w)
+	})
+}
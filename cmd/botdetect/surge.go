@@ -0,0 +1,172 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// the baselines of -surge adapt to the traffic of the last hour or so, new
+// IPs are those without a request within the last hour
+const (
+	surgeAlpha    = 0.1
+	surgeIPMemory = time.Hour
+)
+
+// loadSurgeDetector creates the surge detector if -surge is set
+func loadSurgeDetector(format *botdetect.InputFormat) (*botdetect.SurgeDetector, error) {
+	if !*surge {
+		return nil, nil
+	}
+	switch *surgeAction {
+	case "tighten", "challenge", "log":
+	default:
+		return nil, fmt.Errorf("invalid surge-action '%s': expected tighten, challenge or log", *surgeAction)
+	}
+	if *surgeSlot <= 0 || *surgeHold <= 0 {
+		return nil, fmt.Errorf("surge-slot and surge-hold must be greater than zero")
+	}
+	if *surgeFactor <= 1 {
+		return nil, fmt.Errorf("surge-factor must be greater than 1")
+	}
+	if *surgeMinRequests < 0 || *surgeMinNewIPs < 0 || *surgeWarmup < 0 {
+		return nil, fmt.Errorf("surge-min-requests, surge-min-new-ips and surge-warmup must not be negative")
+	}
+	if *surgeTighten <= 0 || *surgeTighten > 1 {
+		return nil, fmt.Errorf("surge-tighten-factor must be greater than 0 and at most 1")
+	}
+	if *surgeAction != "log" && *listen == "" && format != nil && !format.HasHeader(*verifiedHeaderName) {
+		return nil, fmt.Errorf("surge-action=%s needs header:%s in -input-format or -listen", *surgeAction, *verifiedHeaderName)
+	}
+
+	return botdetect.NewSurgeDetector(botdetect.SurgeOptions{
+		Slot:        *surgeSlot,
+		Factor:      *surgeFactor,
+		MinRequests: uint64(*surgeMinRequests),
+		MinNewIPs:   *surgeMinNewIPs,
+		IPMemory:    surgeIPMemory,
+		Alpha:       surgeAlpha,
+		Warmup:      *surgeWarmup,
+		Hold:        *surgeHold,
+	}), nil
+}
+
+// surgeTracksVerified determines whether the history has to learn which IPs
+// were verified for -surge-action=tighten even without -unverified-factor
+func surgeTracksVerified() bool {
+	return *surge && *surgeAction == "tighten" && *unverifiedFactor == 0
+}
+
+// surgeCheck counts the request for the surge detector. With
+// -surge-action=challenge it returns true for unverified requests that are
+// part of a surge, so that they are answered with CHALLENGE unless they are
+// blocked anyway.
+func (p *policy) surgeCheck(in *botdetect.Input) bool {
+	if p.surges == nil {
+		return false
+	}
+
+	now := time.Now()
+	for _, ip := range p.decider.IPs(in) {
+		p.surges.Observe(ip, in.URL, now)
+	}
+
+	if !p.surgeChallenge || in.IsVerified(*verifiedHeaderName) {
+		return false
+	}
+	if _, ok := p.surges.Surging(in.URL); !ok {
+		return false
+	}
+	p.surgeChallenged.Inc()
+	return true
+}
+
+// watchSurges logs the surges and, with -surge-action=tighten, scales the
+// thresholds of unverified IPs in all namespaces while one is going on. It
+// starts a goroutine that ends the surges that ran out even without requests
+// until the context is done.
+func watchSurges(ctx context.Context, detector *botdetect.SurgeDetector, ns *namespaces, metrics *botdetect.Metrics) {
+	started := metrics.Counter("botdetect_surges_total", "Number of surges detected")
+	metrics.GaugeFunc("botdetect_surges_active", "Number of surges going on", func() float64 {
+		return float64(len(detector.Surges()))
+	})
+
+	base := ns.primary.history.Options().UnverifiedFactor
+	tightened := false
+	var mutex sync.Mutex
+	tighten := func() {
+		if *surgeAction != "tighten" {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		surging := len(detector.Surges()) > 0
+		if surging == tightened {
+			return
+		}
+		factor := base
+		if surging && (factor == 0 || *surgeTighten < factor) {
+			factor = *surgeTighten
+		}
+		if err := ns.updateOptions(func(o *botdetect.IPHistoryOptions) {
+			o.UnverifiedFactor = factor
+		}); err != nil {
+			log.Printf("%s error changing the thresholds for the surge: %s\n", callsign, err)
+			return
+		}
+		tightened = surging
+		if surging {
+			log.Printf("%s thresholds of unverified IPs scaled by %g for the surge\n", callsign, factor)
+		} else {
+			log.Printf("%s thresholds of unverified IPs restored\n", callsign)
+		}
+	}
+
+	detector.OnStart = func(s botdetect.Surge) {
+		started.Inc()
+		log.Printf("%s surge of %d requests to %s from %d new IPs, the baseline is %.1f (%s)\n",
+			callsign, s.Requests, s.Pattern, s.NewIPs, s.Baseline, *surgeAction)
+		tighten()
+	}
+	detector.OnEnd = func(s botdetect.Surge) {
+		log.Printf("%s surge to %s ended after %s\n", callsign, s.Pattern, s.Until.Sub(s.Started).Round(time.Second))
+		tighten()
+	}
+
+	go func() {
+		ticker := time.NewTicker(*surgeSlot)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				detector.Tick(now)
+			}
+		}
+	}()
+}
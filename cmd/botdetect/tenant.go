@@ -0,0 +1,236 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// tenantStats counts the decisions of a namespace
+type tenantStats struct {
+	requests uint64
+	blocked  uint64
+}
+
+func (s *tenantStats) record(blocked bool) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.requests, 1)
+	if blocked {
+		atomic.AddUint64(&s.blocked, 1)
+	}
+}
+
+// tenantReport is the per-namespace entry of /stats
+type tenantReport struct {
+	Requests    uint64 `json:"requests"`
+	Blocked     uint64 `json:"blocked"`
+	Blacklisted int    `json:"blacklisted"`
+	IPs         int    `json:"ips"`
+}
+
+func (p *policy) tenantReport() tenantReport {
+	return tenantReport{
+		Requests:    atomic.LoadUint64(&p.stats.requests),
+		Blocked:     atomic.LoadUint64(&p.stats.blocked),
+		Blacklisted: p.history.NumBL(),
+		IPs:         p.history.NumIPs(),
+	}
+}
+
+// override sets a single option of a namespace
+type override struct {
+	key   string
+	value string
+}
+
+// tenantOverrides maps namespaces to the options that differ from the
+// command line
+type tenantOverrides map[string][]override
+
+// overrideSetters apply the value of an override to the history options,
+// using the same names and formats as the command line flags
+var overrideSetters = map[string]func(o *botdetect.IPHistoryOptions, value string) error{
+	"window":          durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.Window }),
+	"time-slot":       durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.TimeSlot }),
+	"interval":        durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.Interval }),
+	"expire-interval": durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.ExpireInterval }),
+	"blacklist-ttl":   durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.BlacklistTTL }),
+	"grace-period":    durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.GracePeriod }),
+	"compact-age":     durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.CompactAge }),
+	"compact-slot":    durationSetter(func(o *botdetect.IPHistoryOptions) *time.Duration { return &o.CompactSlot }),
+	"max-requests":    uintSetter(func(o *botdetect.IPHistoryOptions) *uint64 { return &o.MaxRequests }),
+	"warn-requests":   uintSetter(func(o *botdetect.IPHistoryOptions) *uint64 { return &o.WarnRequests }),
+	"max-ratio":       floatSetter(func(o *botdetect.IPHistoryOptions) *float64 { return &o.MaxRatio }),
+	"warn-ratio":      floatSetter(func(o *botdetect.IPHistoryOptions) *float64 { return &o.WarnRatio }),
+	"canary":          floatSetter(func(o *botdetect.IPHistoryOptions) *float64 { return &o.Canary }),
+	"blacklist-max-size": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.BlacklistMaxSize, err = strconv.Atoi(value)
+		return err
+	},
+	"rules": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.Rules, err = botdetect.ParseRules(value)
+		return err
+	},
+	"datacenter-rules": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.DatacenterRules, err = botdetect.ParseRules(value)
+		return err
+	},
+	"bandwidth-rules": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.BandwidthRules, err = botdetect.ParseBandwidthRules(value)
+		return err
+	},
+	"cache-rules": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.CacheRules, err = botdetect.ParseCacheRules(value)
+		return err
+	},
+	"scheduled-rules": func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		o.Schedules, err = botdetect.ParseScheduledRules(value)
+		return err
+	},
+}
+
+func durationSetter(field func(o *botdetect.IPHistoryOptions) *time.Duration) func(*botdetect.IPHistoryOptions, string) error {
+	return func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		*field(o), err = time.ParseDuration(value)
+		return err
+	}
+}
+
+func uintSetter(field func(o *botdetect.IPHistoryOptions) *uint64) func(*botdetect.IPHistoryOptions, string) error {
+	return func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		*field(o), err = strconv.ParseUint(value, 10, 64)
+		return err
+	}
+}
+
+func floatSetter(field func(o *botdetect.IPHistoryOptions) *float64) func(*botdetect.IPHistoryOptions, string) error {
+	return func(o *botdetect.IPHistoryOptions, value string) (err error) {
+		*field(o), err = strconv.ParseFloat(value, 64)
+		return err
+	}
+}
+
+// apply changes the options and the policy of the namespace. The overrides
+// have been checked by loadTenantConfig, so errors can't happen anymore.
+func (t tenantOverrides) apply(name string, o *botdetect.IPHistoryOptions, p *policy) {
+	for _, ov := range t[name] {
+		if ov.key == "proxy-detection" {
+			if p != nil {
+				p.proxyBlock = ov.value == "block"
+			}
+			continue
+		}
+		overrideSetters[ov.key](o, ov.value)
+	}
+}
+
+// loadTenantConfig reads the per-namespace overrides, one namespace per line
+// followed by key=value pairs separated by whitespace, e.g.
+// "shop max-requests=50 rules=1m:10:0.9". Every namespace is checked against
+// the options given on the command line.
+func loadTenantConfig(options *botdetect.IPHistoryOptions) (tenantOverrides, error) {
+	overrides := tenantOverrides{}
+	if *tenantConfig == "" {
+		return overrides, nil
+	}
+	if options == nil {
+		// the command line options are invalid, which is reported already
+		return overrides, nil
+	}
+
+	f, err := os.Open(*tenantConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		name := strings.ToLower(fields[0])
+		if _, dup := overrides[name]; dup {
+			return nil, fmt.Errorf("%s:%d: namespace %s is configured twice", *tenantConfig, lineno, name)
+		}
+
+		tenant := *options
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected key=value, got '%s'", *tenantConfig, lineno, field)
+			}
+			ov := override{key: parts[0], value: parts[1]}
+
+			if ov.key == "proxy-detection" {
+				if ov.value != "log" && ov.value != "block" {
+					return nil, fmt.Errorf("%s:%d: proxy-detection must be log or block", *tenantConfig, lineno)
+				}
+				if *proxyDetection == "off" {
+					return nil, fmt.Errorf("%s:%d: proxy-detection requires -proxy-detection to be enabled", *tenantConfig, lineno)
+				}
+			} else if set, ok := overrideSetters[ov.key]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown option '%s'", *tenantConfig, lineno, ov.key)
+			} else if err := set(&tenant, ov.value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid %s: %s", *tenantConfig, lineno, ov.key, err)
+			}
+			overrides[name] = append(overrides[name], ov)
+		}
+		if _, ok := overrides[name]; !ok {
+			overrides[name] = nil
+		}
+
+		if err := tenant.Validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", *tenantConfig, lineno, err)
+		}
+	}
+
+	return overrides, scanner.Err()
+}
+
+// hostTenant returns the namespace for the host a request was sent to if
+// namespaces are chosen by host and the host has a configured namespace
+func (t tenantOverrides) hostTenant(host string) string {
+	if !*tenantByHost || host == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := t[host]; ok {
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,242 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/elcamino/botdetect"
+	"github.com/namsral/flag"
+)
+
+// testConfig replays a captured sample through the history's rules, the
+// manual list and the geo policy as if the requests arrived at their times
+// and prints the share of the IPs and requests every rule would have
+// blocked. It returns the exit code: 1 if the sample can't be replayed or a
+// rule blocks more than -max-percent of the IPs.
+func testConfig(args []string, options *botdetect.IPHistoryOptions, manual *botdetect.ManualList,
+	geo *botdetect.GeoPolicy, format *botdetect.InputFormat, normalizer *botdetect.URLNormalizer) int {
+	fs := flag.NewFlagSet("test-config", flag.ContinueOnError)
+	sample := fs.String("sample", "", "the captured log lines in -input-format, - for stdin")
+	maxPercent := fs.Float64("max-percent", 0, "fail if a rule blocks more than this percentage of the IPs (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *sample == "" {
+		fmt.Fprintf(os.Stderr, "%s test-config requires -sample\n", callsign)
+		return 2
+	}
+	if !format.Has("time") {
+		fmt.Fprintf(os.Stderr, "%s test-config replays requests at their time, -input-format needs a time field\n", callsign)
+		return 1
+	}
+
+	in := io.Reader(os.Stdin)
+	if *sample != "-" {
+		f, err := os.Open(*sample)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	result, err := replaySample(in, options, manual, geo, format, normalizer, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", callsign, err)
+		return 1
+	}
+	result.print(os.Stdout)
+
+	status := 0
+	for _, r := range result.rules {
+		if percent := result.percentIPs(r); *maxPercent > 0 && percent > *maxPercent {
+			fmt.Fprintf(os.Stderr, "%s %s blocks %.1f%% of the IPs, more than %g%%\n", callsign, r.reason, percent, *maxPercent)
+			status = 1
+		}
+	}
+	return status
+}
+
+// sampleResult is the outcome of a replayed sample
+type sampleResult struct {
+	lines    uint64
+	invalid  uint64
+	requests uint64
+	ips      map[string]bool
+	blocked  uint64
+	rules    []*sampleRule
+
+	// blocks are the times IPs were blacklisted by the history's rules
+	blocks []botdetect.DryRunBlock
+}
+
+// sampleRule counts what a rule or list blocked in a sample
+type sampleRule struct {
+	reason   string
+	ips      map[string]bool
+	requests uint64
+
+	// matched is the number of IPs a rule of the history blacklisted,
+	// including those without a request afterwards
+	matched int
+}
+
+// numIPs returns the number of IPs the rule blocked
+func (r *sampleRule) numIPs() int {
+	if r.matched > len(r.ips) {
+		return r.matched
+	}
+	return len(r.ips)
+}
+
+func (r *sampleResult) percentIPs(rule *sampleRule) float64 {
+	if len(r.ips) == 0 {
+		return 0
+	}
+	return float64(rule.numIPs()) * 100 / float64(len(r.ips))
+}
+
+func (r *sampleResult) percentRequests(rule *sampleRule) float64 {
+	if r.requests == 0 {
+		return 0
+	}
+	return float64(rule.requests) * 100 / float64(r.requests)
+}
+
+// replaySample feeds the lines of the sample into a dry run of the options.
+// observe is called with every request and its decision unless it is nil.
+func replaySample(in io.Reader, options *botdetect.IPHistoryOptions, manual *botdetect.ManualList,
+	geo *botdetect.GeoPolicy, format *botdetect.InputFormat, normalizer *botdetect.URLNormalizer,
+	observe func(*botdetect.Input, botdetect.Decision)) (*sampleResult, error) {
+	dry, err := botdetect.NewDryRun(context.Background(), options)
+	if err != nil {
+		return nil, err
+	}
+	defer dry.Close()
+
+	// both have been checked at startup
+	attribution, _ := botdetect.ParseSubject(*subject)
+	trusted, _ := botdetect.ParseNetworks(splitList(*trustedProxies))
+	decider, err := botdetect.NewEngineDecider(dry, &botdetect.DeciderOptions{
+		IncludePrivate: !*ignorePrivateIPs,
+		Subject:        attribution,
+		TrustedProxies: trusted,
+		TimeFormat:     *inputTimeFormat,
+		Normalizer:     normalizer,
+		VerifiedHeader: *verifiedHeaderName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// IP entries of the manual list and the geo policy are checked like in
+	// the policy, host names would have to be looked up
+	check := func(ip net.IP) (bool, string) {
+		if manual.IsUnblocked(ip) {
+			return false, "manually unblocked"
+		}
+		if manual.IsBlocked(ip) {
+			return true, "manually blocked"
+		}
+		if geo.IsAllowed(ip) {
+			return false, "allowed by geo policy"
+		}
+		if geo.IsDenied(ip) {
+			return true, "denied by geo policy"
+		}
+		return dry.Check(ip)
+	}
+
+	result := &sampleResult{ips: make(map[string]bool)}
+	rules := make(map[string]*sampleRule)
+	rule := func(reason string) *sampleRule {
+		r, ok := rules[reason]
+		if !ok {
+			r = &sampleRule{reason: reason, ips: make(map[string]bool)}
+			rules[reason] = r
+		}
+		return r
+	}
+
+	scanner := bufio.NewScanner(in)
+	input := &botdetect.Input{}
+	for scanner.Scan() {
+		result.lines++
+		if err := format.ParseInto(scanner.Text(), input); err != nil {
+			result.invalid++
+			continue
+		}
+		decision := decider.Decide(input, check)
+		result.requests++
+		for _, ip := range decision.IPs {
+			result.ips[ip.String()] = true
+		}
+		if decision.Blocked {
+			result.blocked++
+			r := rule(decision.Reason)
+			r.ips[decision.IP.String()] = true
+			r.requests++
+		}
+		if observe != nil {
+			observe(input, decision)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// IPs blacklisted at the end of the sample didn't send a request
+	// afterwards
+	dry.Flush()
+	for reason, n := range dry.Matches() {
+		rule(reason).matched = n
+	}
+	result.blocks = dry.Blocks()
+
+	for _, r := range rules {
+		result.rules = append(result.rules, r)
+	}
+	sort.Slice(result.rules, func(i, j int) bool {
+		a, b := result.rules[i], result.rules[j]
+		if a.numIPs() != b.numIPs() {
+			return a.numIPs() > b.numIPs()
+		}
+		return a.reason < b.reason
+	})
+	return result, nil
+}
+
+// print writes the projected block rates per rule
+func (r *sampleResult) print(w io.Writer) {
+	fmt.Fprintf(w, "%d lines, %d invalid, %d requests from %d IPs, %d requests blocked\n\n",
+		r.lines, r.invalid, r.requests, len(r.ips), r.blocked)
+	fmt.Fprintf(w, "%8s %7s %10s %7s  %s\n", "IPs", "%IPs", "requests", "%req", "rule")
+	for _, rule := range r.rules {
+		fmt.Fprintf(w, "%8d %6.1f%% %10d %6.1f%%  %s\n",
+			rule.numIPs(), r.percentIPs(rule), rule.requests, r.percentRequests(rule), rule.reason)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/elcamino/botdetect"
+)
+
+// loadUserAgents creates the user agent database and parses the policy per
+// bot class. The database is nil if user agents are neither part of the
+// input nor can be passed to /check.
+func loadUserAgents(format *botdetect.InputFormat) (*botdetect.UserAgentDB, map[string]string, error) {
+	classes := map[string]string{}
+	for _, def := range splitList(*uaPolicy) {
+		parts := strings.SplitN(strings.TrimSpace(def), "=", 2)
+		if len(parts) != 2 || (parts[1] != "block" && parts[1] != "allow") {
+			return nil, nil, fmt.Errorf("invalid user agent policy '%s': expected class=block or class=allow", def)
+		}
+		known := false
+		for _, c := range botdetect.BotClasses {
+			known = known || c == parts[0]
+		}
+		if !known {
+			return nil, nil, fmt.Errorf("unknown bot class '%s' in ua-policy, expected one of %s", parts[0], strings.Join(botdetect.BotClasses, ", "))
+		}
+		classes[parts[0]] = parts[1]
+	}
+
+	if format == nil || (!format.HasHeader("User-Agent") && *listen == "") {
+		if len(classes) > 0 || *uaDB != "" {
+			return nil, nil, fmt.Errorf("ua-policy and ua-db need header:User-Agent in -input-format or -listen")
+		}
+		return nil, classes, nil
+	}
+
+	db := botdetect.NewUserAgentDB()
+	if *uaDB != "" {
+		if err := db.Load(*uaDB); err != nil {
+			return nil, nil, err
+		}
+	}
+	return db, classes, nil
+}
+
+// userAgent classifies the user agent of the request
+func (p *policy) userAgent(in *botdetect.Input) botdetect.UserAgent {
+	agent, _ := p.agents.Classify(in.Header("User-Agent"))
+	return agent
+}
+
+// loadAIPolicy parses the policy for AI crawlers, which maps lower case bot
+// names or * for all of them to allow, block or limit, and loads the
+// networks published for them
+func loadAIPolicy(format *botdetect.InputFormat) (map[string]string, *botdetect.BotRanges, error) {
+	policy := map[string]string{}
+	for _, def := range splitList(*aiPolicy) {
+		parts := strings.SplitN(strings.TrimSpace(def), "=", 2)
+		if len(parts) != 2 || (parts[1] != "allow" && parts[1] != "block" && parts[1] != "limit") {
+			return nil, nil, fmt.Errorf("invalid AI crawler policy '%s': expected name=allow, name=block or name=limit", def)
+		}
+		policy[strings.ToLower(parts[0])] = parts[1]
+	}
+	if len(policy) > 0 && *listen == "" && (format == nil || !format.HasHeader("User-Agent")) {
+		return nil, nil, fmt.Errorf("ai-policy needs header:User-Agent in -input-format or -listen")
+	}
+
+	if *aiRanges == "" {
+		return policy, nil, nil
+	}
+	ranges, err := botdetect.LoadBotRanges(*aiRanges)
+	return policy, ranges, err
+}
+
+// aiCrawlerPolicy applies the policy for AI crawlers. Crawlers claiming to
+// be a bot with published networks from elsewhere are only blocked if the bot
+// is; otherwise spoofed is true and they are treated like any other client.
+func (p *policy) aiCrawlerPolicy(ip net.IP, agent botdetect.UserAgent) (decided, blocked, spoofed bool, reason string) {
+	action, ok := p.aiPolicy[strings.ToLower(agent.Name)]
+	if !ok {
+		action, ok = p.aiPolicy["*"]
+	}
+	if !ok {
+		return false, false, false, ""
+	}
+
+	if known, verified := p.aiRanges.Verify(agent.Name, ip); known && !verified {
+		if action == "block" {
+			return true, true, true, "spoofed AI crawler " + agent.Name
+		}
+		return false, false, true, ""
+	}
+
+	switch action {
+	case "block":
+		return true, true, false, "AI crawler " + agent.Name
+	case "limit":
+		if !p.aiDelay.Allow(&botdetect.Crawler{Name: agent.Name}) {
+			return true, true, false, "crawl delay exceeded by AI crawler " + agent.Name
+		}
+	}
+	return true, false, false, "AI crawler " + agent.Name
+}
+
+// agentPolicy returns the decision configured for the user agent or its
+// class, if any
+func (p *policy) agentPolicy(ip net.IP, agent botdetect.UserAgent) (decided, blocked bool, reason string) {
+	if agent.Class == "ai" {
+		decided, blocked, spoofed, reason := p.aiCrawlerPolicy(ip, agent)
+		if decided || spoofed {
+			return decided, blocked, reason
+		}
+	}
+
+	switch p.agentClasses[agent.Class] {
+	case "block":
+		return true, true, fmt.Sprintf("user agent %s (%s)", agent.Name, agent.Class)
+	case "allow":
+		return true, false, fmt.Sprintf("user agent %s (%s)", agent.Name, agent.Class)
+	}
+	return false, false, ""
+}
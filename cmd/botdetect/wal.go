@@ -0,0 +1,81 @@
+/*
+  botdetect, a program that detects bad bots by the HTML/asset ratio per IP over a given time frame
+	Copyright (C) 2019 Tobias von Dewitz
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// parseWALSize parses -wal-max-size and checks -wal-keep and -wal-sync
+func parseWALSize() (int64, error) {
+	if *walFile == "" {
+		return 0, nil
+	}
+	size, err := botdetect.ParseBytes(*walMaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("wal-max-size: %w", err)
+	}
+	if *walKeep < 0 {
+		return 0, fmt.Errorf("wal-keep must not be negative")
+	}
+	if *walSync < 0 {
+		return 0, fmt.Errorf("wal-sync must not be negative")
+	}
+	return int64(size), nil
+}
+
+// openWAL replays the blacklist changes in -wal since the snapshot restored
+// from -state-file, all of them without one, and logs every change from then
+// on
+func openWAL(history *botdetect.IPHistory, maxSize int64, since time.Time, metrics *botdetect.Metrics) (*botdetect.BlacklistWAL, error) {
+	applied, corrupt, err := botdetect.ReplayBlacklistWAL(*walFile, *walKeep, since, history.Blacklist())
+	if err != nil {
+		return nil, err
+	}
+	if applied > 0 || corrupt > 0 {
+		log.Printf("%s replayed %d blacklist changes from %s, skipped %d broken lines\n", callsign, applied, *walFile, corrupt)
+	}
+
+	wal, err := botdetect.OpenBlacklistWAL(*walFile, maxSize, *walKeep, *walSync)
+	if err != nil {
+		return nil, err
+	}
+	wal.OnError = func(err error) {
+		log.Printf("%s error writing the blacklist log: %s\n", callsign, err)
+	}
+	history.Blacklist().SetWAL(wal)
+
+	metrics.CounterFunc("botdetect_wal_changes_total", "Number of blacklist changes written to the blacklist log", func() float64 {
+		written, _, _ := wal.Stats()
+		return float64(written)
+	})
+	metrics.CounterFunc("botdetect_wal_rotations_total", "Number of rotations of the blacklist log", func() float64 {
+		_, rotated, _ := wal.Stats()
+		return float64(rotated)
+	})
+	metrics.CounterFunc("botdetect_wal_errors_total", "Number of blacklist changes that couldn't be written to the blacklist log or were dropped", func() float64 {
+		_, _, failures := wal.Stats()
+		return float64(failures)
+	})
+	return wal, nil
+}
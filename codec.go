@@ -0,0 +1,153 @@
+package botdetect
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StateCodec serializes the state of a history
+type StateCodec interface {
+	Encode(w io.Writer, s *State) error
+	Decode(r io.Reader, s *State) error
+}
+
+// DefaultStateCodec is the codec of WriteState
+const DefaultStateCodec = "json"
+
+// stateMagic starts the header line of every snapshot, which continues with
+// the name of the codec and the version of the state, e.g.
+// "botdetect-state json 2"
+const stateMagic = "botdetect-state "
+
+var (
+	stateCodecs = map[string]StateCodec{
+		"json":     jsonCodec{},
+		"gob":      gobCodec{},
+		"msgpack":  msgpackCodec{},
+		"protobuf": protobufCodec{},
+	}
+	stateCodecsMutex sync.RWMutex
+)
+
+// RegisterStateCodec makes a codec available by name in addition to json,
+// gob, msgpack and protobuf, replacing an existing one with the same name
+func RegisterStateCodec(name string, codec StateCodec) {
+	stateCodecsMutex.Lock()
+	defer stateCodecsMutex.Unlock()
+	stateCodecs[name] = codec
+}
+
+// StateCodecNames returns the names of the available codecs in order
+func StateCodecNames() []string {
+	stateCodecsMutex.RLock()
+	defer stateCodecsMutex.RUnlock()
+
+	names := make([]string, 0, len(stateCodecs))
+	for name := range stateCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupStateCodec returns the codec with the name or an error of the kind
+// ErrConfig if there is none
+func LookupStateCodec(name string) (StateCodec, error) {
+	stateCodecsMutex.RLock()
+	codec, ok := stateCodecs[name]
+	stateCodecsMutex.RUnlock()
+
+	if !ok {
+		return nil, configErrorf("unknown state codec '%s': expected %s", name, strings.Join(StateCodecNames(), ", "))
+	}
+	return codec, nil
+}
+
+// EncodeState writes a header naming the codec and the version of the
+// state, StateVersion unless set, followed by the state in the named codec
+func EncodeState(w io.Writer, s *State, codec string) error {
+	c, err := LookupStateCodec(codec)
+	if err != nil {
+		return err
+	}
+	version := s.Version
+	if version == 0 {
+		version = StateVersion
+	}
+	if _, err := fmt.Fprintf(w, "%s%s %d\n", stateMagic, codec, version); err != nil {
+		return err
+	}
+	return c.Encode(w, s)
+}
+
+// DecodeState reads a state written by EncodeState with any codec and sets
+// its version from the header, without migrating it, see MigrateState.
+// Snapshots without a header are JSON written before states had codecs, those
+// without a version in the header have been written before states had
+// versions; both are of version 1. Snapshots of versions newer than
+// StateVersion aren't decoded, they are an error of the kind ErrStateVersion.
+func DecodeState(r io.Reader) (*State, error) {
+	br := bufio.NewReader(r)
+
+	codec, version := DefaultStateCodec, 1
+	if magic, err := br.Peek(len(stateMagic)); err == nil && string(magic) == stateMagic {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(strings.TrimPrefix(header, stateMagic))
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid state header '%s'", strings.TrimSpace(header))
+		}
+		codec = fields[0]
+		if len(fields) == 2 {
+			if version, err = strconv.Atoi(fields[1]); err != nil || version < 1 {
+				return nil, fmt.Errorf("invalid version in state header '%s'", strings.TrimSpace(header))
+			}
+		}
+	}
+	if version > StateVersion {
+		return nil, stateVersionErrorf("the state is of version %d, but this version of botdetect only reads up to version %d", version, StateVersion)
+	}
+
+	c, err := LookupStateCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := c.Decode(br, s); err != nil {
+		return nil, err
+	}
+	s.Version = version
+	return s, nil
+}
+
+// jsonCodec writes the state as JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, s *State) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+func (jsonCodec) Decode(r io.Reader, s *State) error {
+	return json.NewDecoder(r).Decode(s)
+}
+
+// gobCodec writes the state with encoding/gob, which is compact and fast but
+// only readable by Go
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, s *State) error {
+	return gob.NewEncoder(w).Encode(s)
+}
+
+func (gobCodec) Decode(r io.Reader, s *State) error {
+	return gob.NewDecoder(r).Decode(s)
+}
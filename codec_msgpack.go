@@ -0,0 +1,265 @@
+package botdetect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// msgpackCodec writes the JSON document of the state as MessagePack: the same
+// keys, times as RFC 3339 strings, so that it can be read by any MessagePack
+// library
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(w io.Writer, s *State) error {
+	doc, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeMsgpack(bw, v); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (msgpackCodec) Decode(r io.Reader, s *State) error {
+	v, err := readMsgpack(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc, s)
+}
+
+// writeMsgpack encodes a value decoded from JSON with UseNumber
+func writeMsgpack(w *bufio.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return w.WriteByte(0xc0)
+	case bool:
+		if v {
+			return w.WriteByte(0xc3)
+		}
+		return w.WriteByte(0xc2)
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return writeMsgpackInt(w, i)
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return writeMsgpackHead(w, 0xcf, 8, u)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return writeMsgpackHead(w, 0xcb, 8, math.Float64bits(f))
+	case string:
+		n := uint64(len(v))
+		switch {
+		case n < 32:
+			w.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			writeMsgpackHead(w, 0xd9, 1, n)
+		case n <= math.MaxUint16:
+			writeMsgpackHead(w, 0xda, 2, n)
+		default:
+			writeMsgpackHead(w, 0xdb, 4, n)
+		}
+		_, err := w.WriteString(v)
+		return err
+	case []interface{}:
+		writeMsgpackLen(w, 0x90, 0xdc, 0xdd, len(v))
+		for _, e := range v {
+			if err := writeMsgpack(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackLen(w, 0x80, 0xde, 0xdf, len(v))
+		for _, k := range keys {
+			if err := writeMsgpack(w, k); err != nil {
+				return err
+			}
+			if err := writeMsgpack(w, v[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func writeMsgpackInt(w *bufio.Writer, i int64) error {
+	switch {
+	case i >= 0 && i < 128:
+		return w.WriteByte(byte(i))
+	case i >= 0:
+		return writeMsgpackHead(w, 0xcf, 8, uint64(i))
+	case i >= -32:
+		return w.WriteByte(byte(i))
+	default:
+		return writeMsgpackHead(w, 0xd3, 8, uint64(i))
+	}
+}
+
+// writeMsgpackLen writes the header of an array or a map, fix being the
+// type byte for up to 15 elements
+func writeMsgpackLen(w *bufio.Writer, fix, t16, t32 byte, n int) {
+	switch {
+	case n < 16:
+		w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		writeMsgpackHead(w, t16, 2, uint64(n))
+	default:
+		writeMsgpackHead(w, t32, 4, uint64(n))
+	}
+}
+
+// writeMsgpackHead writes the type byte followed by value in size bytes, big
+// endian
+func writeMsgpackHead(w *bufio.Writer, t byte, size int, value uint64) error {
+	buf := make([]byte, 9)
+	buf[0] = t
+	binary.BigEndian.PutUint64(buf[1:], value)
+	_, err := w.Write(append(buf[:1], buf[9-size:]...))
+	return err
+}
+
+// msgpackSizes are the sizes of the values following the type bytes not
+// handled by readMsgpack directly
+var msgpackSizes = map[byte]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+// readMsgpack decodes a value into the types of encoding/json, numbers as
+// json.Number
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case t < 0x80:
+		return json.Number(strconv.Itoa(int(t))), nil
+	case t >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(t)))), nil
+	case t&0xf0 == 0x80:
+		return readMsgpackMap(r, int(t&0x0f))
+	case t&0xf0 == 0x90:
+		return readMsgpackArray(r, int(t&0x0f))
+	case t&0xe0 == 0xa0:
+		return readMsgpackString(r, uint64(t&0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	size, ok := msgpackSizes[t]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type 0x%02x", t)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint64(buf)
+
+	switch t {
+	case 0xc4, 0xc5, 0xc6:
+		return readMsgpackString(r, n)
+	case 0xca:
+		return json.Number(strconv.FormatFloat(float64(math.Float32frombits(uint32(n))), 'g', -1, 32)), nil
+	case 0xcb:
+		return json.Number(strconv.FormatFloat(math.Float64frombits(n), 'g', -1, 64)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case 0xd0:
+		return json.Number(strconv.FormatInt(int64(int8(n)), 10)), nil
+	case 0xd1:
+		return json.Number(strconv.FormatInt(int64(int16(n)), 10)), nil
+	case 0xd2:
+		return json.Number(strconv.FormatInt(int64(int32(n)), 10)), nil
+	case 0xd3:
+		return json.Number(strconv.FormatInt(int64(n), 10)), nil
+	case 0xd9, 0xda, 0xdb:
+		return readMsgpackString(r, n)
+	case 0xdc, 0xdd:
+		return readMsgpackArray(r, int(n))
+	default:
+		return readMsgpackMap(r, int(n))
+	}
+}
+
+func readMsgpackString(r *bufio.Reader, n uint64) (string, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	out := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	for i := 0; i < n; i++ {
+		k, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key of type %T", k)
+		}
+		if out[key], err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,458 @@
+package botdetect
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// protobufCodec writes the state as a State message of state.proto, so that
+// it can be read with code generated for any language
+type protobufCodec struct{}
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+func (protobufCodec) Encode(w io.Writer, s *State) error {
+	b := appendProtoInt(nil, 1, protoTime(s.Time))
+
+	ips := make([]string, 0, len(s.History))
+	for ip := range s.History {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		h := appendProtoString(nil, 1, ip)
+		for _, hi := range s.History[ip] {
+			slot := appendProtoInt(nil, 1, protoTime(hi.Timestamp))
+			slot = appendProtoUint(slot, 2, hi.Count)
+			slot = appendProtoUint(slot, 3, hi.App)
+			slot = appendProtoUint(slot, 4, hi.Other)
+			slot = appendProtoUint(slot, 5, hi.Bytes)
+			slot = appendProtoUint(slot, 6, hi.Hits)
+			slot = appendProtoUint(slot, 7, hi.Misses)
+			h = appendProtoMessage(h, 2, slot)
+		}
+		b = appendProtoMessage(b, 2, h)
+	}
+
+	for _, e := range s.Blacklist {
+		entry := appendProtoString(nil, 1, e.IP.String())
+		entry = appendProtoInt(entry, 2, protoTime(e.Expires))
+		entry = appendProtoString(entry, 3, e.Reason)
+		entry = appendProtoString(entry, 4, string(e.Severity))
+		b = appendProtoMessage(b, 3, entry)
+	}
+
+	ips = ips[:0]
+	for ip := range s.Exempt {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		exemption := appendProtoString(nil, 1, ip)
+		exemption = appendProtoInt(exemption, 2, protoTime(s.Exempt[ip]))
+		b = appendProtoMessage(b, 4, exemption)
+	}
+
+	for _, g := range s.Grants {
+		grant := appendProtoString(nil, 1, g.Network)
+		grant = appendProtoDouble(grant, 2, g.Factor)
+		grant = appendProtoInt(grant, 3, protoTime(g.Until))
+		grant = appendProtoString(grant, 4, g.Comment)
+		b = appendProtoMessage(b, 5, grant)
+	}
+
+	ips = ips[:0]
+	for ip := range s.Reputation {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		r := s.Reputation[ip]
+		reputation := appendProtoString(nil, 1, ip)
+		reputation = appendProtoDouble(reputation, 2, r.Score)
+		reputation = appendProtoInt(reputation, 3, protoTime(r.Updated))
+		b = appendProtoMessage(b, 6, reputation)
+	}
+
+	for _, e := range s.Exemptions {
+		exemption := appendProtoString(nil, 1, e.IP.String())
+		exemption = appendProtoInt(exemption, 2, protoTime(e.Created))
+		exemption = appendProtoInt(exemption, 3, protoTime(e.Expires))
+		exemption = appendProtoString(exemption, 4, e.Reason)
+		exemption = appendProtoString(exemption, 5, e.Creator)
+		exemption = appendProtoString(exemption, 6, e.Source)
+		b = appendProtoMessage(b, 7, exemption)
+	}
+
+	ips = ips[:0]
+	for ip := range s.Baselines {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		bl := s.Baselines[ip]
+		baseline := appendProtoString(nil, 1, ip)
+		baseline = appendProtoDouble(baseline, 2, bl.Mean)
+		baseline = appendProtoDouble(baseline, 3, bl.Variance)
+		baseline = appendProtoUint(baseline, 4, uint64(bl.Slots))
+		baseline = appendProtoInt(baseline, 5, protoTime(bl.LastSlot))
+		b = appendProtoMessage(b, 8, baseline)
+	}
+
+	for _, e := range s.Greylist {
+		entry := appendProtoString(nil, 1, e.IP.String())
+		entry = appendProtoInt(entry, 2, protoTime(e.Added))
+		entry = appendProtoInt(entry, 3, protoTime(e.Expires))
+		entry = appendProtoInt(entry, 4, protoTime(e.LastAbuse))
+		entry = appendProtoUint(entry, 5, uint64(e.Strikes))
+		entry = appendProtoString(entry, 6, e.Reason)
+		b = appendProtoMessage(b, 9, entry)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+func (protobufCodec) Decode(r io.Reader, s *State) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.History = make(map[string][]IPHistoryItem)
+	s.Exempt = make(map[string]time.Time)
+
+	return protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			s.Time = protoTimeOf(v)
+		case 2:
+			ip, items, err := decodeProtoHistory(data)
+			s.History[ip] = items
+			return err
+		case 3:
+			e, err := decodeProtoBlacklistEntry(data)
+			s.Blacklist = append(s.Blacklist, e)
+			return err
+		case 4:
+			ip, until := "", time.Time{}
+			err := protoFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					ip = string(data)
+				case 2:
+					until = protoTimeOf(v)
+				}
+				return nil
+			})
+			s.Exempt[ip] = until
+			return err
+		case 5:
+			g, err := decodeProtoGrant(data)
+			s.Grants = append(s.Grants, g)
+			return err
+		case 6:
+			ip, r, err := decodeProtoReputation(data)
+			if s.Reputation == nil {
+				s.Reputation = make(map[string]Reputation)
+			}
+			s.Reputation[ip] = r
+			return err
+		case 7:
+			e, err := decodeProtoExemption(data)
+			s.Exemptions = append(s.Exemptions, e)
+			return err
+		case 8:
+			ip, bl, err := decodeProtoBaseline(data)
+			if s.Baselines == nil {
+				s.Baselines = make(map[string]AnomalyBaseline)
+			}
+			s.Baselines[ip] = bl
+			return err
+		case 9:
+			e, err := decodeProtoGreylistEntry(data)
+			s.Greylist = append(s.Greylist, e)
+			return err
+		}
+		return nil
+	})
+}
+
+func decodeProtoHistory(b []byte) (string, []IPHistoryItem, error) {
+	ip := ""
+	items := []IPHistoryItem{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			ip = string(data)
+		case 2:
+			hi, err := decodeProtoSlot(data)
+			items = append(items, hi)
+			return err
+		}
+		return nil
+	})
+	return ip, items, err
+}
+
+func decodeProtoSlot(b []byte) (IPHistoryItem, error) {
+	hi := IPHistoryItem{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			hi.Timestamp = protoTimeOf(v)
+		case 2:
+			hi.Count = v
+		case 3:
+			hi.App = v
+		case 4:
+			hi.Other = v
+		case 5:
+			hi.Bytes = v
+		case 6:
+			hi.Hits = v
+		case 7:
+			hi.Misses = v
+		}
+		return nil
+	})
+	return hi, err
+}
+
+func decodeProtoBlacklistEntry(b []byte) (BlacklistEntry, error) {
+	e := BlacklistEntry{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			e.IP = net.ParseIP(string(data))
+		case 2:
+			e.Expires = protoTimeOf(v)
+		case 3:
+			e.Reason = string(data)
+		case 4:
+			e.Severity = Severity(data)
+		}
+		return nil
+	})
+	return e, err
+}
+
+func decodeProtoExemption(b []byte) (Exemption, error) {
+	e := Exemption{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			e.IP = net.ParseIP(string(data))
+		case 2:
+			e.Created = protoTimeOf(v)
+		case 3:
+			e.Expires = protoTimeOf(v)
+		case 4:
+			e.Reason = string(data)
+		case 5:
+			e.Creator = string(data)
+		case 6:
+			e.Source = string(data)
+		}
+		return nil
+	})
+	return e, err
+}
+
+func decodeProtoGrant(b []byte) (Grant, error) {
+	g := Grant{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			g.Network = string(data)
+		case 2:
+			g.Factor = math.Float64frombits(v)
+		case 3:
+			g.Until = protoTimeOf(v)
+		case 4:
+			g.Comment = string(data)
+		}
+		return nil
+	})
+	return g, err
+}
+
+func decodeProtoReputation(b []byte) (string, Reputation, error) {
+	ip, r := "", Reputation{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			ip = string(data)
+		case 2:
+			r.Score = math.Float64frombits(v)
+		case 3:
+			r.Updated = protoTimeOf(v)
+		}
+		return nil
+	})
+	return ip, r, err
+}
+
+func decodeProtoBaseline(b []byte) (string, AnomalyBaseline, error) {
+	ip, bl := "", AnomalyBaseline{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			ip = string(data)
+		case 2:
+			bl.Mean = math.Float64frombits(v)
+		case 3:
+			bl.Variance = math.Float64frombits(v)
+		case 4:
+			bl.Slots = int(v)
+		case 5:
+			bl.LastSlot = protoTimeOf(v)
+		}
+		return nil
+	})
+	return ip, bl, err
+}
+
+func decodeProtoGreylistEntry(b []byte) (GreylistEntry, error) {
+	e := GreylistEntry{}
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			e.IP = net.ParseIP(string(data))
+		case 2:
+			e.Added = protoTimeOf(v)
+		case 3:
+			e.Expires = protoTimeOf(v)
+		case 4:
+			e.LastAbuse = protoTimeOf(v)
+		case 5:
+			e.Strikes = int(v)
+		case 6:
+			e.Reason = string(data)
+		}
+		return nil
+	})
+	return e, err
+}
+
+// protoTime returns the time in nanoseconds since the epoch, 0 for the zero
+// time
+func protoTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func protoTimeOf(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(v))
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendProtoTag(b []byte, field, wire int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendProtoUint appends a varint field unless it has the default value 0,
+// as proto3 does
+func appendProtoUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendProtoVarint(appendProtoTag(b, field, protoVarint), v)
+}
+
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	return appendProtoUint(b, field, uint64(v))
+}
+
+func appendProtoDouble(b []byte, field int, f float64) []byte {
+	if f == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoFixed64)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+	return append(b, buf...)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendProtoVarint(appendProtoTag(b, field, protoBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoMessage appends an embedded message, even an empty one, so that
+// repeated messages keep their count
+func appendProtoMessage(b []byte, field int, msg []byte) []byte {
+	b = appendProtoVarint(appendProtoTag(b, field, protoBytes), uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// protoFields calls fn for every field of the message with the value of
+// numeric fields or the data of length-delimited ones. Unknown fields are
+// up to fn to skip, so that newer snapshots remain readable.
+func protoFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch tag & 7 {
+		case protoVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errProtoTruncated
+			}
+			data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+
+		if err := fn(int(tag>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
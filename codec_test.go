@@ -0,0 +1,192 @@
+package botdetect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testState() *State {
+	now := time.Unix(1700000000, 123456789)
+	return &State{
+		Time: now,
+		History: map[string][]IPHistoryItem{
+			"192.0.2.1": {
+				{Timestamp: now.Truncate(time.Minute), Count: 300, App: 200, Other: 100, Bytes: 1 << 40, Hits: 5, Misses: 7},
+				{Timestamp: now.Truncate(time.Minute).Add(-time.Minute), Count: 1, App: 1},
+			},
+			"2001:db8::1": {{Timestamp: now.Truncate(time.Minute), Count: 2, Other: 2}},
+		},
+		Blacklist: []BlacklistEntry{
+			{IP: net.ParseIP("192.0.2.2"), Expires: now.Add(time.Hour), Reason: "rule 1h0m0s:1000:0.85"},
+			{IP: net.ParseIP("2001:db8::2"), Expires: now.Add(24 * time.Hour), Reason: "walk", Severity: SeverityChallenge},
+		},
+		Exempt: map[string]time.Time{"192.0.2.3": now.Add(time.Hour)},
+		Exemptions: []Exemption{
+			{IP: net.ParseIP("192.0.2.6"), Created: now, Expires: now.Add(time.Hour), Reason: "partner", Creator: "ops", Source: ExemptionManual},
+			{IP: net.ParseIP("2001:db8::6"), Expires: now.Add(time.Minute)},
+		},
+		Grants: []Grant{{Network: "198.51.100.0/24", Factor: 2.5, Until: now.Add(time.Hour), Comment: "load test"}},
+		Reputation: map[string]Reputation{
+			"192.0.2.4": {Score: -1.25, Updated: now},
+			"192.0.2.5": {Score: 3, Updated: now.Add(-time.Hour)},
+		},
+		Baselines: map[string]AnomalyBaseline{
+			"192.0.2.7": {Mean: 4.5, Variance: 1.25, Slots: 12, LastSlot: now.Truncate(time.Minute)},
+		},
+		Greylist: []GreylistEntry{
+			{IP: net.ParseIP("192.0.2.8"), Added: now.Add(-time.Minute), Expires: now.Add(time.Hour), LastAbuse: now, Strikes: 2, Reason: "rule 1h0m0s:1000:0.85 warn tier exceeded"},
+			{IP: net.ParseIP("2001:db8::8"), Added: now, Expires: now.Add(time.Hour), LastAbuse: now},
+		},
+	}
+}
+
+// equalStates compares states field by field since the codecs don't keep
+// the locations of times
+func equalStates(t *testing.T, expected, got *State) {
+	t.Helper()
+
+	if !got.Time.Equal(expected.Time) {
+		t.Errorf("time: expected %s, got %s", expected.Time, got.Time)
+	}
+	if len(got.History) != len(expected.History) {
+		t.Errorf("expected %d IPs in the history, got %d", len(expected.History), len(got.History))
+	}
+	for ip, items := range expected.History {
+		if len(got.History[ip]) != len(items) {
+			t.Errorf("%s: expected %d slots, got %d", ip, len(items), len(got.History[ip]))
+			continue
+		}
+		for i, hi := range items {
+			g := got.History[ip][i]
+			if !g.Timestamp.Equal(hi.Timestamp) {
+				t.Errorf("%s slot %d: expected %s, got %s", ip, i, hi.Timestamp, g.Timestamp)
+			}
+			g.Timestamp = hi.Timestamp
+			if g != hi {
+				t.Errorf("%s slot %d: expected %+v, got %+v", ip, i, hi, g)
+			}
+		}
+	}
+	if len(got.Blacklist) != len(expected.Blacklist) {
+		t.Fatalf("expected %d blacklist entries, got %d", len(expected.Blacklist), len(got.Blacklist))
+	}
+	for i, e := range expected.Blacklist {
+		g := got.Blacklist[i]
+		if !g.IP.Equal(e.IP) || !g.Expires.Equal(e.Expires) || g.Reason != e.Reason || g.Severity != e.Severity {
+			t.Errorf("blacklist entry %d: expected %+v, got %+v", i, e, g)
+		}
+	}
+	for ip, until := range expected.Exempt {
+		if !got.Exempt[ip].Equal(until) {
+			t.Errorf("exemption of %s: expected %s, got %s", ip, until, got.Exempt[ip])
+		}
+	}
+	if len(got.Exemptions) != len(expected.Exemptions) {
+		t.Fatalf("expected %d exemptions, got %d", len(expected.Exemptions), len(got.Exemptions))
+	}
+	for i, e := range expected.Exemptions {
+		g := got.Exemptions[i]
+		if !g.IP.Equal(e.IP) || !g.Created.Equal(e.Created) || !g.Expires.Equal(e.Expires) ||
+			g.Reason != e.Reason || g.Creator != e.Creator || g.Source != e.Source {
+			t.Errorf("exemption %d: expected %+v, got %+v", i, e, g)
+		}
+	}
+	if len(got.Grants) != len(expected.Grants) {
+		t.Fatalf("expected %d grants, got %d", len(expected.Grants), len(got.Grants))
+	}
+	for i, g := range expected.Grants {
+		if got.Grants[i].String() != g.String() || got.Grants[i].Comment != g.Comment {
+			t.Errorf("grant %d: expected %s, got %s", i, g, got.Grants[i])
+		}
+	}
+	for ip, r := range expected.Reputation {
+		if g := got.Reputation[ip]; g.Score != r.Score || !g.Updated.Equal(r.Updated) {
+			t.Errorf("reputation of %s: expected %+v, got %+v", ip, r, g)
+		}
+	}
+	if len(got.Baselines) != len(expected.Baselines) {
+		t.Errorf("expected %d baselines, got %d", len(expected.Baselines), len(got.Baselines))
+	}
+	for ip, b := range expected.Baselines {
+		g := got.Baselines[ip]
+		if g.Mean != b.Mean || g.Variance != b.Variance || g.Slots != b.Slots || !g.LastSlot.Equal(b.LastSlot) {
+			t.Errorf("baseline of %s: expected %+v, got %+v", ip, b, g)
+		}
+	}
+	if len(got.Greylist) != len(expected.Greylist) {
+		t.Fatalf("expected %d greylist entries, got %d", len(expected.Greylist), len(got.Greylist))
+	}
+	for i, e := range expected.Greylist {
+		g := got.Greylist[i]
+		if !g.IP.Equal(e.IP) || !g.Added.Equal(e.Added) || !g.Expires.Equal(e.Expires) || !g.LastAbuse.Equal(e.LastAbuse) ||
+			g.Strikes != e.Strikes || g.Reason != e.Reason {
+			t.Errorf("greylist entry %d: expected %+v, got %+v", i, e, g)
+		}
+	}
+}
+
+func TestStateCodecs(t *testing.T) {
+	for _, codec := range StateCodecNames() {
+		t.Run(codec, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeState(&buf, testState(), codec); err != nil {
+				t.Fatalf("unexpected error encoding: %s", err)
+			}
+			if header := fmt.Sprintf("%s%s %d\n", stateMagic, codec, StateVersion); !strings.HasPrefix(buf.String(), header) {
+				t.Errorf("expected the header %q, got %q", header, buf.String()[:len(header)])
+			}
+
+			s, err := DecodeState(&buf)
+			if err != nil {
+				t.Fatalf("unexpected error decoding: %s", err)
+			}
+			if s.Version != StateVersion {
+				t.Errorf("expected version %d, got %d", StateVersion, s.Version)
+			}
+			equalStates(t, testState(), s)
+		})
+	}
+}
+
+func TestDecodeStateErrors(t *testing.T) {
+	if _, err := DecodeState(strings.NewReader(stateMagic + "yaml\n{}")); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error for an unknown codec, got %v", err)
+	}
+	if err := EncodeState(&bytes.Buffer{}, testState(), "yaml"); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error for an unknown codec, got %v", err)
+	}
+
+	for _, codec := range []string{"gob", "msgpack", "protobuf"} {
+		var buf bytes.Buffer
+		if err := EncodeState(&buf, testState(), codec); err != nil {
+			t.Fatal(err)
+		}
+		truncated := buf.Bytes()[:buf.Len()-3]
+		if _, err := DecodeState(bytes.NewReader(truncated)); err == nil {
+			t.Errorf("%s: expected an error for a truncated snapshot", codec)
+		}
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	// a newer version may add fields, e.g. 15 to the slots and 20 to the state
+	slot := appendProtoUint(nil, 2, 5)
+	slot = appendProtoString(slot, 15, "new")
+	history := appendProtoString(nil, 1, "192.0.2.1")
+	history = appendProtoMessage(history, 2, slot)
+	b := appendProtoMessage(nil, 2, history)
+	b = appendProtoDouble(b, 20, 1.5)
+
+	s := &State{}
+	if err := (protobufCodec{}).Decode(bytes.NewReader(b), s); err != nil {
+		t.Fatal(err)
+	}
+	if items := s.History["192.0.2.1"]; len(items) != 1 || items[0].Count != 5 {
+		t.Errorf("expected the known fields to be read, got %+v", s.History)
+	}
+}
@@ -0,0 +1,167 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConcurrencyDetector detects IPs holding many connections open at the same
+// time, which browsers rarely do but scrapers often do to fetch faster. The
+// number of connections comes either from open and close events or from the
+// count a proxy reports with each request. An IP whose count stays above max
+// for at least duration holds them sustained; a single burst doesn't.
+type ConcurrencyDetector struct {
+	max      uint64
+	duration time.Duration
+
+	ips   map[string]*concurrency
+	mutex sync.Mutex
+}
+
+type concurrency struct {
+	open  uint64
+	count uint64
+	peak  uint64
+	above time.Time
+	seen  time.Time
+}
+
+// NewConcurrencyDetector creates a ConcurrencyDetector
+func NewConcurrencyDetector(max uint64, duration time.Duration) *ConcurrencyDetector {
+	return &ConcurrencyDetector{
+		max:      max,
+		duration: duration,
+		ips:      make(map[string]*concurrency),
+	}
+}
+
+// Clone returns a ConcurrencyDetector with the same configuration that
+// doesn't track any IPs yet
+func (cd *ConcurrencyDetector) Clone() *ConcurrencyDetector {
+	if cd == nil {
+		return nil
+	}
+	return NewConcurrencyDetector(cd.max, cd.duration)
+}
+
+// Open records a connection opened by the IP
+func (cd *ConcurrencyDetector) Open(ip net.IP, now time.Time) {
+	if cd == nil {
+		return
+	}
+	cd.update(ipKey(ip), now, func(c *concurrency) {
+		c.open++
+		c.count = c.open
+	})
+}
+
+// Close records a connection of the IP being closed
+func (cd *ConcurrencyDetector) Close(ip net.IP, now time.Time) {
+	if cd == nil {
+		return
+	}
+	cd.update(ipKey(ip), now, func(c *concurrency) {
+		if c.open > 0 {
+			c.open--
+		}
+		c.count = c.open
+	})
+}
+
+// Observe records the number of connections the IP holds open as reported
+// by a proxy
+func (cd *ConcurrencyDetector) Observe(ip net.IP, count uint64, now time.Time) {
+	if cd == nil {
+		return
+	}
+	cd.observe(ipKey(ip), count, now)
+}
+
+func (cd *ConcurrencyDetector) observe(ipstr string, count uint64, now time.Time) {
+	cd.update(ipstr, now, func(c *concurrency) {
+		c.count = count
+	})
+}
+
+// update changes the count of the IP and tracks since when it is above the
+// maximum
+func (cd *ConcurrencyDetector) update(ipstr string, now time.Time, fn func(c *concurrency)) {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	c, ok := cd.ips[ipstr]
+	if !ok {
+		c = &concurrency{}
+		cd.ips[ipstr] = c
+	}
+	fn(c)
+	c.seen = now
+
+	switch {
+	case c.count <= cd.max:
+		c.above = time.Time{}
+		c.peak = 0
+	case c.above.IsZero():
+		c.above = now
+		c.peak = c.count
+	case c.count > c.peak:
+		c.peak = c.count
+	}
+}
+
+// Sustained returns a description of the parallelism if the IP has held more
+// than the maximum number of connections for at least the duration
+func (cd *ConcurrencyDetector) Sustained(ip net.IP, now time.Time) (string, bool) {
+	if cd == nil {
+		return "", false
+	}
+	return cd.sustained(ipKey(ip), now)
+}
+
+func (cd *ConcurrencyDetector) sustained(ipstr string, now time.Time) (string, bool) {
+	if cd == nil {
+		return "", false
+	}
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	c, ok := cd.ips[ipstr]
+	if !ok || c.above.IsZero() {
+		return "", false
+	}
+	if held := now.Sub(c.above); held >= cd.duration {
+		return fmt.Sprintf("held more than %d connections for %s, up to %d", cd.max, held.Truncate(time.Second), c.peak), true
+	}
+	return "", false
+}
+
+// Expire forgets the IPs that haven't been seen since cutoff, so that lost
+// close events don't keep IPs around forever
+func (cd *ConcurrencyDetector) Expire(cutoff time.Time) {
+	if cd == nil {
+		return
+	}
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	for ip, c := range cd.ips {
+		if c.seen.Before(cutoff) {
+			delete(cd.ips, ip)
+		}
+	}
+}
+
+// Size returns the number of IPs being tracked
+func (cd *ConcurrencyDetector) Size() int {
+	if cd == nil {
+		return 0
+	}
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+	return len(cd.ips)
+}
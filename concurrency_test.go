@@ -0,0 +1,100 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyDetector(t *testing.T) {
+	cd := NewConcurrencyDetector(2, time.Minute)
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		cd.Open(ip, now)
+	}
+	if _, ok := cd.Sustained(ip, now.Add(30*time.Second)); ok {
+		t.Error("expected a short burst not to count")
+	}
+	if detail, ok := cd.Sustained(ip, now.Add(time.Minute)); !ok {
+		t.Error("expected the parallelism to be sustained")
+	} else if detail != "held more than 2 connections for 1m0s, up to 3" {
+		t.Errorf("unexpected detail %s", detail)
+	}
+
+	// dropping to the maximum starts over
+	cd.Close(ip, now.Add(time.Minute))
+	cd.Open(ip, now.Add(2*time.Minute))
+	if _, ok := cd.Sustained(ip, now.Add(2*time.Minute+30*time.Second)); ok {
+		t.Error("expected the count to start over after dropping to the maximum")
+	}
+
+	// counts reported by a proxy replace the events
+	other := net.ParseIP("192.0.2.2")
+	cd.Observe(other, 10, now)
+	cd.Observe(other, 20, now.Add(time.Minute))
+	if detail, ok := cd.Sustained(other, now.Add(time.Minute)); !ok || detail != "held more than 2 connections for 1m0s, up to 20" {
+		t.Errorf("unexpected detail %s %v", detail, ok)
+	}
+
+	// more closes than opens don't underflow
+	for i := 0; i < 5; i++ {
+		cd.Close(ip, now)
+	}
+	cd.Open(ip, now)
+	if _, ok := cd.Sustained(ip, now.Add(time.Hour)); ok {
+		t.Error("expected a single connection to be fine")
+	}
+
+	cd.Expire(now.Add(90 * time.Second))
+	if cd.Size() != 0 {
+		t.Errorf("expected all IPs to expire, got %d", cd.Size())
+	}
+
+	if clone := cd.Clone(); clone.Size() != 0 || clone.max != 2 || clone.duration != time.Minute {
+		t.Errorf("unexpected clone %+v", clone)
+	}
+
+	var nilDetector *ConcurrencyDetector
+	nilDetector.Open(ip, now)
+	if _, ok := nilDetector.Sustained(ip, now); ok || nilDetector.Clone() != nil {
+		t.Error("expected a nil detector to detect nothing")
+	}
+}
+
+func TestConcurrencyBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1000,
+		MaxRatio:        0.5,
+		Concurrency:     NewConcurrencyDetector(4, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calm, busy := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	h.RequestChannel() <- &Request{URL: "/", IP: calm, Connections: 4}
+	h.RequestChannel() <- &Request{URL: "/", IP: busy, Connections: 30}
+	for h.Processed() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.TriggerCalculate()
+	if h.IsBlacklisted(calm) {
+		t.Error("expected the IP within the limit not to be blacklisted")
+	}
+	if reason, ok := h.Blacklist().Reason(busy); !ok || reason != "concurrency" {
+		t.Errorf("expected the busy IP to be blacklisted for concurrency, got %v %s", ok, reason)
+	}
+}
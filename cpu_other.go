@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package botdetect
+
+import "time"
+
+// processCPUTime isn't supported on this platform
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,268 @@
+package botdetect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawler describes a search engine crawler that can be verified through
+// reverse and forward DNS lookups
+type Crawler struct {
+	Name       string
+	Domains    []string
+	CrawlDelay time.Duration
+}
+
+// DefaultCrawlers contains the well-known crawlers that publish how to verify them
+var DefaultCrawlers = []Crawler{
+	{Name: "Googlebot", Domains: []string{"googlebot.com", "google.com", "googleusercontent.com"}},
+	{Name: "Bingbot", Domains: []string{"search.msn.com"}},
+	{Name: "Applebot", Domains: []string{"applebot.apple.com"}},
+	{Name: "YandexBot", Domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{Name: "Baiduspider", Domains: []string{"baidu.com", "baidu.jp"}},
+}
+
+// Resolver performs the DNS lookups needed to verify crawlers. net.Resolver
+// implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// CrawlerVerifier verifies that an IP belongs to a known crawler. Lookups run
+// in the background so that the decision path never waits for DNS; until a
+// lookup has finished the IP counts as unverified.
+type CrawlerVerifier struct {
+	crawlers []Crawler
+	resolver Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+	cache    *lookupCache
+}
+
+// NewCrawlerVerifier creates a CrawlerVerifier that caches results for ttl
+func NewCrawlerVerifier(crawlers []Crawler, resolver Resolver, timeout, ttl time.Duration) *CrawlerVerifier {
+	return &CrawlerVerifier{
+		crawlers: crawlers,
+		resolver: resolver,
+		timeout:  timeout,
+		ttl:      ttl,
+		cache:    newLookupCache(ttl, LookupLimits{}),
+	}
+}
+
+// SetLookupLimits replaces the default limits of the cache and the DNS
+// lookups. It drops the cached verifications, so call it before use.
+func (cv *CrawlerVerifier) SetLookupLimits(limits LookupLimits) {
+	cv.cache = newLookupCache(cv.ttl, limits)
+}
+
+// Verified returns the crawler the IP belongs to if it has been verified. If
+// the IP hasn't been looked up yet a background lookup is started.
+func (cv *CrawlerVerifier) Verified(ip net.IP) (*Crawler, bool) {
+	ipstr := ipKey(ip)
+	v, _ := cv.cache.get(ipstr, func() (interface{}, error) {
+		return cv.lookup(ipstr)
+	})
+	crawler, ok := v.(*Crawler)
+	return crawler, ok
+}
+
+// lookup verifies the IP. IPs that aren't crawlers, including those without
+// a PTR record, yield nil; DNS failures an error.
+func (cv *CrawlerVerifier) lookup(ipstr string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cv.timeout)
+	defer cancel()
+
+	crawler, err := cv.Verify(ctx, ipstr)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if crawler == nil {
+		return nil, nil
+	}
+	return crawler, nil
+}
+
+// isNotFound determines whether the lookup failed because the name or
+// address doesn't exist rather than because DNS failed
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// LookupStats returns the number of cached verifications and of lookups
+// postponed because too many were running
+func (cv *CrawlerVerifier) LookupStats() (entries int, postponed uint64) {
+	return cv.cache.size(), cv.cache.postponed()
+}
+
+// Verify looks up the host name of the IP, checks it against the domains of
+// the known crawlers and confirms that the host name resolves back to the IP
+func (cv *CrawlerVerifier) Verify(ctx context.Context, ipstr string) (*Crawler, error) {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return nil, invalidIPErrorf("invalid IP '%s'", ipstr)
+	}
+
+	names, err := cv.resolver.LookupAddr(ctx, ipstr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		crawler := cv.crawlerFor(name)
+		if crawler == nil {
+			continue
+		}
+
+		addrs, err := cv.resolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return crawler, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Clear removes all cached verifications
+func (cv *CrawlerVerifier) Clear() {
+	cv.cache.clear()
+}
+
+// CrawlerRecord is a cached verification as exported by Export. Crawler is
+// empty for IPs that aren't crawlers.
+type CrawlerRecord struct {
+	IP      string    `json:"ip"`
+	Crawler string    `json:"crawler,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Export returns the verifications that haven't expired, e.g. to persist
+// them across restarts or share them between replicas
+func (cv *CrawlerVerifier) Export() []CrawlerRecord {
+	records := []CrawlerRecord{}
+	cv.cache.each(func(ip string, value interface{}, expires time.Time) {
+		rec := CrawlerRecord{IP: ip, Expires: expires}
+		if crawler, ok := value.(*Crawler); ok {
+			rec.Crawler = crawler.Name
+		}
+		records = append(records, rec)
+	})
+	return records
+}
+
+// Import adds exported verifications to the cache. Expired records, records
+// of unknown crawlers and IPs verified more recently are skipped.
+func (cv *CrawlerVerifier) Import(records []CrawlerRecord) {
+	now := time.Now()
+
+	for _, rec := range records {
+		if !now.Before(rec.Expires) {
+			continue
+		}
+		ip := net.ParseIP(rec.IP)
+		if ip == nil {
+			continue
+		}
+
+		var value interface{}
+		if rec.Crawler != "" {
+			crawler := cv.crawlerNamed(rec.Crawler)
+			if crawler == nil {
+				continue
+			}
+			value = crawler
+		}
+		cv.cache.restore(ipKey(ip), value, rec.Expires)
+	}
+}
+
+// WriteCache writes the exported verifications as JSON
+func (cv *CrawlerVerifier) WriteCache(w io.Writer) error {
+	return json.NewEncoder(w).Encode(cv.Export())
+}
+
+// ReadCache imports verifications written by WriteCache
+func (cv *CrawlerVerifier) ReadCache(r io.Reader) error {
+	var records []CrawlerRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return configErrorf("invalid crawler cache: %s", err)
+	}
+	cv.Import(records)
+	return nil
+}
+
+// crawlerNamed returns the known crawler with the name
+func (cv *CrawlerVerifier) crawlerNamed(name string) *Crawler {
+	for i := range cv.crawlers {
+		if cv.crawlers[i].Name == name {
+			return &cv.crawlers[i]
+		}
+	}
+	return nil
+}
+
+// crawlerFor returns the crawler whose domains contain the host name
+func (cv *CrawlerVerifier) crawlerFor(host string) *Crawler {
+	for i := range cv.crawlers {
+		for _, domain := range cv.crawlers[i].Domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return &cv.crawlers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// CrawlDelay enforces a minimum delay between requests of a crawler. The
+// delay applies to the crawler as a whole, not per IP, as crawlers spread
+// their requests over many addresses.
+type CrawlDelay struct {
+	defaultDelay time.Duration
+	last         map[string]time.Time
+	mutex        sync.Mutex
+}
+
+// NewCrawlDelay creates a CrawlDelay that uses defaultDelay for crawlers
+// without a CrawlDelay of their own
+func NewCrawlDelay(defaultDelay time.Duration) *CrawlDelay {
+	return &CrawlDelay{
+		defaultDelay: defaultDelay,
+		last:         make(map[string]time.Time),
+	}
+}
+
+// Allow determines whether the crawler may make another request now
+func (cd *CrawlDelay) Allow(crawler *Crawler) bool {
+	delay := crawler.CrawlDelay
+	if delay == 0 {
+		delay = cd.defaultDelay
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	if last, ok := cd.last[crawler.Name]; ok && now.Sub(last) < delay {
+		return false
+	}
+	cd.last[crawler.Name] = now
+	return true
+}
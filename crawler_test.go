@@ -0,0 +1,144 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	ptr  map[string][]string
+	host map[string][]string
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.host[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestCrawlerVerifier(t *testing.T) {
+	resolver := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"crawl-192-0-2-1.googlebot.com."},
+			"192.0.2.2": {"fake.googlebot.com.evil.example."},
+			"192.0.2.3": {"crawl-spoofed.googlebot.com."},
+		},
+		host: map[string][]string{
+			"crawl-192-0-2-1.googlebot.com": {"192.0.2.1"},
+			"crawl-spoofed.googlebot.com":   {"198.51.100.1"},
+		},
+	}
+	cv := NewCrawlerVerifier(DefaultCrawlers, resolver, time.Second, time.Hour)
+
+	for ip, expected := range map[string]string{
+		"192.0.2.1": "Googlebot",
+		"192.0.2.2": "",
+		"192.0.2.3": "",
+		"192.0.2.4": "",
+	} {
+		crawler, _ := cv.Verify(context.Background(), ip)
+		name := ""
+		if crawler != nil {
+			name = crawler.Name
+		}
+		if name != expected {
+			t.Errorf("%s: expected crawler '%s', got '%s'", ip, expected, name)
+		}
+	}
+}
+
+func TestCrawlerCacheExport(t *testing.T) {
+	resolver := &fakeResolver{
+		ptr:  map[string][]string{"192.0.2.1": {"crawl-192-0-2-1.googlebot.com."}},
+		host: map[string][]string{"crawl-192-0-2-1.googlebot.com": {"192.0.2.1"}},
+	}
+	cv := NewCrawlerVerifier(DefaultCrawlers, resolver, time.Second, time.Hour)
+	verifyNow(cv, "192.0.2.1")
+	verifyNow(cv, "192.0.2.2")
+
+	var buf bytes.Buffer
+	if err := cv.WriteCache(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted verifier knows the results without asking DNS
+	restored := NewCrawlerVerifier(DefaultCrawlers, &fakeResolver{}, time.Second, time.Hour)
+	if err := restored.ReadCache(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if crawler, ok := restored.Verified(net.ParseIP("192.0.2.1")); !ok || crawler.Name != "Googlebot" {
+		t.Errorf("expected the crawler to be restored, got %v", crawler)
+	}
+	if len(restored.Export()) != 2 {
+		t.Errorf("expected the IP that isn't a crawler to be restored as well, got %v", restored.Export())
+	}
+
+	restored.Import([]CrawlerRecord{
+		{IP: "192.0.2.3", Crawler: "Unknownbot", Expires: time.Now().Add(time.Hour)},
+		{IP: "192.0.2.4", Crawler: "Googlebot", Expires: time.Now().Add(-time.Hour)},
+	})
+	if len(restored.Export()) != 2 {
+		t.Errorf("expected unknown crawlers and expired records to be skipped, got %v", restored.Export())
+	}
+}
+
+// verifyNow looks up the IP and caches the result like a background lookup
+func verifyNow(cv *CrawlerVerifier, ip string) {
+	value, err := cv.lookup(ip)
+	cv.cache.store(ip, value, err)
+}
+
+// failingResolver fails every lookup like an unreachable DNS server
+type failingResolver struct{}
+
+func (failingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+}
+
+func (failingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+}
+
+func TestCrawlerVerifierDNSFailure(t *testing.T) {
+	cv := NewCrawlerVerifier(DefaultCrawlers, failingResolver{}, time.Second, time.Hour)
+	cv.Import([]CrawlerRecord{{IP: "192.0.2.1", Crawler: "Googlebot", Expires: time.Now().Add(time.Millisecond)}})
+	time.Sleep(2 * time.Millisecond)
+
+	verifyNow(cv, "192.0.2.1")
+	if crawler, ok := cv.Verified(net.ParseIP("192.0.2.1")); !ok || crawler.Name != "Googlebot" {
+		t.Error("expected a DNS failure to keep the earlier verification")
+	}
+	for _, rec := range cv.Export() {
+		if rec.Expires.After(time.Now().Add(defaultLookupErrorTTL)) {
+			t.Errorf("expected the failed lookup to be retried soon, expires %s", rec.Expires)
+		}
+	}
+}
+
+func TestCrawlDelay(t *testing.T) {
+	cd := NewCrawlDelay(50 * time.Millisecond)
+	crawler := &Crawler{Name: "Googlebot"}
+
+	if !cd.Allow(crawler) {
+		t.Errorf("the first request should be allowed")
+	}
+	if cd.Allow(crawler) {
+		t.Errorf("a request within the crawl delay should not be allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !cd.Allow(crawler) {
+		t.Errorf("a request after the crawl delay should be allowed")
+	}
+}
@@ -0,0 +1,66 @@
+package botdetect
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// DatacenterList classifies IPs as belonging to data centers and cloud
+// providers. Real users rarely browse from these networks, so stricter rules
+// can be applied to them.
+type DatacenterList struct {
+	table     rangeTable
+	providers []string
+}
+
+// LoadDatacenterList reads a DatacenterList from a file
+func LoadDatacenterList(path string) (*DatacenterList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	defer f.Close()
+
+	dl, err := ReadDatacenterList(f)
+	if err != nil {
+		return nil, configErrorf("%s: %w", path, err)
+	}
+	return dl, nil
+}
+
+// ReadDatacenterList reads a DatacenterList in CSV format with the columns
+// network (CIDR) and an optional provider name. Lines starting with '#' are
+// ignored.
+func ReadDatacenterList(r io.Reader) (*DatacenterList, error) {
+	return ReadDatacenterRanges("csv", "", r)
+}
+
+// Lookup returns the provider of the data center the IP belongs to
+func (dl *DatacenterList) Lookup(ip net.IP) (provider string, ok bool) {
+	if dl == nil {
+		return "", false
+	}
+
+	addr, ok := addrFromIP(ip)
+	if !ok {
+		return "", false
+	}
+
+	i, ok := dl.table.lookup(addr)
+	if !ok {
+		return "", false
+	}
+	return dl.providers[i], true
+}
+
+// IsDatacenter determines whether the IP belongs to a data center
+func (dl *DatacenterList) IsDatacenter(ip net.IP) bool {
+	_, ok := dl.Lookup(ip)
+	return ok
+}
+
+// Size returns the number of networks in the list
+func (dl *DatacenterList) Size() int {
+	return dl.table.len()
+}
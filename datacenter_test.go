@@ -0,0 +1,101 @@
+package botdetect
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDatacenterList(t *testing.T) {
+	dl, err := ReadDatacenterList(strings.NewReader(`
+# provider ranges
+203.0.113.0/24,example-cloud
+2001:db8:100::/48
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if provider, ok := dl.Lookup(net.ParseIP("203.0.113.20")); !ok || provider != "example-cloud" {
+		t.Errorf("expected 203.0.113.20 to belong to example-cloud, got '%s', %v", provider, ok)
+	}
+	if !dl.IsDatacenter(net.ParseIP("2001:db8:100::1")) {
+		t.Errorf("2001:db8:100::1 should be a data center IP")
+	}
+	if dl.IsDatacenter(net.ParseIP("192.0.2.1")) {
+		t.Errorf("192.0.2.1 should not be a data center IP")
+	}
+
+	var nilList *DatacenterList
+	if nilList.IsDatacenter(net.ParseIP("203.0.113.20")) {
+		t.Errorf("a nil list should not classify any IP")
+	}
+}
+
+func TestDatacenterFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"ip-ranges.json": `{"syncToken":"1","prefixes":[
+			{"ip_prefix":"3.0.0.0/8","region":"GLOBAL","service":"AMAZON"},
+			{"ip_prefix":"3.5.0.0/16","region":"eu-west-1","service":"EC2"}],
+			"ipv6_prefixes":[{"ipv6_prefix":"2600:1f00::/24","region":"GLOBAL","service":"AMAZON"}]}`,
+		"cloud.json": `{"prefixes":[{"ipv4Prefix":"34.1.208.0/20","service":"Google Cloud","scope":"africa-south1"},
+			{"ipv6Prefix":"2600:1900:8000::/44","service":"Google Cloud","scope":"us-east1"}]}`,
+		"ServiceTags_Public.json": `{"changeNumber":1,"cloud":"Public","values":[
+			{"name":"AzureCloud","id":"AzureCloud","properties":{"addressPrefixes":["20.0.0.0/11"]}},
+			{"name":"Storage","id":"Storage","properties":{"addressPrefixes":["20.1.0.0/16","2603:1000::/40"]}}]}`,
+		"google.csv": "5.101.96.0/21,NL,NL-NH,Amsterdam,1071 VK\n2a03:b0c0::/32,NL,NL-NH,Amsterdam,\n",
+		"ovh.txt":    "route:          51.68.0.0/16\norigin:         AS16276\nsource:         RADB\n\nroute6:         2001:41d0::/32\n",
+		"own.csv":    "# own ranges\n3.5.4.0/24,colo\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dl, err := LoadDatacenterLists([]string{
+		"aws:" + filepath.Join(dir, "ip-ranges.json"),
+		"gcp:" + filepath.Join(dir, "cloud.json"),
+		"azure:" + filepath.Join(dir, "ServiceTags_Public.json"),
+		"digitalocean:" + filepath.Join(dir, "google.csv"),
+		"routes:" + filepath.Join(dir, "ovh.txt"),
+		filepath.Join(dir, "own.csv"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Size() != 13 {
+		t.Errorf("expected 13 networks, got %d", dl.Size())
+	}
+
+	for ip, expected := range map[string]string{
+		"3.9.1.1":           "aws/AMAZON",
+		"3.5.1.1":           "aws/EC2",
+		"3.5.4.1":           "colo",
+		"2600:1f00::1":      "aws/AMAZON",
+		"34.1.210.1":        "gcp",
+		"2600:1900:8000::1": "gcp",
+		"20.2.0.1":          "azure/AzureCloud",
+		"20.1.0.1":          "azure/Storage",
+		"2603:1000::1":      "azure/Storage",
+		"5.101.100.1":       "digitalocean",
+		"2a03:b0c0::1":      "digitalocean",
+		"51.68.1.1":         "ovh",
+		"2001:41d0::1":      "ovh",
+		"192.0.2.1":         "",
+	} {
+		if provider, _ := dl.Lookup(net.ParseIP(ip)); provider != expected {
+			t.Errorf("%s: expected '%s', got '%s'", ip, expected, provider)
+		}
+	}
+
+	if _, err := ReadDatacenterRanges("aws", "", strings.NewReader(`{"prefixes":[{"ip_prefix":"3.0.0.0/33"}]}`)); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+	if _, err := ReadDatacenterRanges("oracle", "", strings.NewReader("")); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
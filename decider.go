@@ -0,0 +1,428 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Decision is the outcome of checking a request
+type Decision struct {
+	// Blocked is set if one of the IPs the request came from is blocked
+	Blocked bool
+
+	// IP is the IP that caused the block
+	IP net.IP
+
+	// Reason explains why IP is blocked
+	Reason string
+
+	// IPs are all public IPs the request came from
+	IPs []net.IP
+}
+
+// String returns BLOCK or OK, the answers expected by Apache's RewriteMap
+func (d Decision) String() string {
+	if d.Blocked {
+		return "BLOCK"
+	}
+	return "OK"
+}
+
+// Subject selects which IPs of the forwarding chain a request is attributed to
+type Subject int
+
+const (
+	// SubjectAll attributes the request to every public IP in the chain
+	SubjectAll Subject = iota
+
+	// SubjectLeftmost attributes the request to the leftmost public IP,
+	// i.e. the client as claimed by the first proxy. Clients can forge it.
+	SubjectLeftmost
+
+	// SubjectRightmostUntrusted attributes the request to the last IP
+	// that isn't a trusted proxy, the only address clients can't forge.
+	// An unknown or unparsable hop before it ends the walk, see
+	// OnUnknownHop.
+	SubjectRightmostUntrusted
+)
+
+var subjectNames = []string{"all", "leftmost", "rightmost-untrusted"}
+
+// ParseSubject parses all, leftmost or rightmost-untrusted
+func ParseSubject(s string) (Subject, error) {
+	for i, name := range subjectNames {
+		if s == name {
+			return Subject(i), nil
+		}
+	}
+	return SubjectAll, configErrorf("invalid subject '%s': expected %s", s, strings.Join(subjectNames, ", "))
+}
+
+func (s Subject) String() string {
+	if int(s) < len(subjectNames) {
+		return subjectNames[s]
+	}
+	return fmt.Sprintf("Subject(%d)", int(s))
+}
+
+// ParseNetworks parses a list of networks in CIDR notation or single IPs
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		n, err := parseNetwork(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// CheckFunc determines whether requests from an IP should be blocked and why
+type CheckFunc func(ip net.IP) (bool, string)
+
+// DeciderOptions configures a Decider
+type DeciderOptions struct {
+	// IncludePrivate also records and checks private IPs
+	IncludePrivate bool
+
+	// Subject selects which IPs of the chain are recorded and checked
+	Subject Subject
+
+	// TrustedProxies are skipped by SubjectRightmostUntrusted. Private IPs
+	// are always trusted unless IncludePrivate is set.
+	TrustedProxies []*net.IPNet
+
+	// TimeFormat is used to parse Input.Time, RFC 3339 if empty
+	TimeFormat string
+
+	// Normalizer canonicalizes the URLs of requests before they are
+	// deduplicated and recorded if set
+	Normalizer *URLNormalizer
+
+	// Dedup skips recording events that have been seen before if set
+	Dedup *Deduplicator
+
+	// VerifiedHeader is the header through which the proxy tells that a
+	// request carried a valid challenge cookie, DefaultVerifiedHeader if
+	// empty. Any value but "", "-", "0", "false" and "no" sets
+	// Request.Verified.
+	VerifiedHeader string
+
+	// OnDuplicate is called for every IP of a duplicate event
+	OnDuplicate func(ip net.IP, in *Input)
+
+	// OnUnknownHop is called for every request whose forwarding chain has
+	// an unknown or obfuscated hop, such as "unknown" or "_hidden". If
+	// the request has no other IP it is attributed to, it falls back to
+	// the nearest valid hop after the unknown one, which is passed as
+	// fallback; fallback is nil otherwise.
+	OnUnknownHop func(in *Input, fallback net.IP)
+
+	// OnDecision is called for every IP checked
+	OnDecision func(ip net.IP, in *Input, blocked bool, reason string)
+
+	// FailOpen, if set, is asked before recording a request whether the
+	// request may be dropped instead of waiting for room in the queue, so
+	// that decisions are answered right away under overload, e.g. while
+	// IPHistory.Shedding. OnDrop is called for every dropped request.
+	FailOpen func() bool
+	OnDrop   func(req *Request)
+}
+
+// Decider records requests in a history and decides whether to block them.
+// By default a request is attributed to its remote address and every address
+// in its X-Forwarded-For and Forwarded headers; the first blocked IP decides.
+type Decider struct {
+	requests  chan<- *Request
+	blacklist *Blacklist
+	engine    Engine
+	options   DeciderOptions
+	ip        *IP
+}
+
+// NewDecider creates a Decider that feeds requests into the given channel and
+// blocks IPs on the blacklist. options may be nil.
+func NewDecider(requests chan<- *Request, blacklist *Blacklist, options *DeciderOptions) (*Decider, error) {
+	ip, err := NewIP()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Decider{
+		requests:  requests,
+		blacklist: blacklist,
+		ip:        ip,
+	}
+	if options != nil {
+		d.options = *options
+	}
+	if d.options.TimeFormat == "" {
+		d.options.TimeFormat = time.RFC3339
+	}
+	return d, nil
+}
+
+// NewEngineDecider creates a Decider that records requests with the engine
+// and asks it whether to block IPs. options may be nil.
+func NewEngineDecider(engine Engine, options *DeciderOptions) (*Decider, error) {
+	if engine == nil {
+		return nil, configErrorf("a decider needs an engine")
+	}
+	d, err := NewDecider(nil, nil, options)
+	if err != nil {
+		return nil, err
+	}
+	d.engine = engine
+	return d, nil
+}
+
+// Check records and checks a request given by its remote address and
+// X-Forwarded-For header
+func (d *Decider) Check(remote, xff string) Decision {
+	return d.CheckInput(&Input{Remote: remote, XFF: xff})
+}
+
+// CheckInput records and checks a request against the blacklist
+func (d *Decider) CheckInput(in *Input) Decision {
+	return d.Decide(in, d.blacklisted)
+}
+
+// Decide records the request for every IP it came from and checks them with
+// check until one of them is blocked
+func (d *Decider) Decide(in *Input, check CheckFunc) Decision {
+	ips, unknown, fallback := d.ips(in)
+	if unknown && d.options.OnUnknownHop != nil {
+		d.options.OnUnknownHop(in, fallback)
+	}
+	decision := Decision{IPs: ips}
+
+	// the slot is determined now rather than when the history gets to
+	// process the request, unless the event brings its own time
+	at := time.Now()
+	if in.Time != "" {
+		if t, err := time.Parse(d.options.TimeFormat, in.Time); err == nil {
+			at = t
+		}
+	}
+
+	// logs write "-" for responses without a body
+	size, _ := strconv.ParseUint(in.Bytes, 10, 64)
+	connections, _ := strconv.ParseUint(in.Connections, 10, 64)
+	cacheStatus := ParseCacheStatus(in.CacheStatus)
+
+	url := d.options.Normalizer.Normalize(in.URL)
+
+	for _, ip := range decision.IPs {
+		if d.options.Dedup.Duplicate(ip, url, in.Time) {
+			if d.options.OnDuplicate != nil {
+				d.options.OnDuplicate(ip, in)
+			}
+		} else {
+			d.record(&Request{
+				URL:   url,
+				IP:    ip,
+				Time:  at,
+				Bytes: size,
+
+				ContentType: in.ContentType,
+				Connections: connections,
+				CacheStatus: cacheStatus,
+				FetchDest:   in.Header("Sec-Fetch-Dest"),
+				Verified:    in.IsVerified(d.options.VerifiedHeader),
+			})
+		}
+
+		blocked, reason := check(ip)
+		if d.options.OnDecision != nil {
+			d.options.OnDecision(ip, in, blocked, reason)
+		}
+
+		if blocked {
+			decision.Blocked = true
+			decision.IP = ip
+			decision.Reason = reason
+			break
+		}
+	}
+
+	return decision
+}
+
+// IPs returns the IPs a request is attributed to according to the subject
+// option. For SubjectAll these are, in order, the remote address (with or
+// without a port), the addresses in X-Forwarded-For and the ones in a
+// Forwarded header that X-Forwarded-For didn't contain. Private IPs are
+// skipped unless IncludePrivate is set. A request without any of these whose
+// chain has an unknown or obfuscated hop is attributed to the nearest valid
+// hop after it instead, see OnUnknownHop.
+func (d *Decider) IPs(in *Input) []net.IP {
+	ips, _, _ := d.ips(in)
+	return ips
+}
+
+// ips returns the IPs of the request, whether its forwarding chain has an
+// unknown or obfuscated hop and the hop it falls back to if it has no other
+// IPs
+func (d *Decider) ips(in *Input) ([]net.IP, bool, net.IP) {
+	ips := d.subjectIPs(in)
+	hops := d.hops(in)
+	unknown := -1
+	for i, hop := range hops {
+		if hop == nil {
+			unknown = i
+		}
+	}
+	if unknown < 0 || len(ips) > 0 {
+		return ips, unknown >= 0, nil
+	}
+
+	// the hop after the unknown one received the request from the client,
+	// unless it is trusted not to be a client itself
+	for _, hop := range hops[unknown+1:] {
+		if hop == nil {
+			continue
+		}
+		if d.options.Subject == SubjectRightmostUntrusted && (d.private(hop) || containsIP(d.options.TrustedProxies, hop)) {
+			continue
+		}
+		return []net.IP{hop.To16()}, true, hop
+	}
+	return ips, true, nil
+}
+
+// subjectIPs returns the IPs of the request according to the subject
+func (d *Decider) subjectIPs(in *Input) []net.IP {
+	switch d.options.Subject {
+	case SubjectLeftmost:
+		for _, ip := range d.chain(in) {
+			if !d.private(ip) {
+				return []net.IP{ip.To16()}
+			}
+		}
+		return []net.IP{}
+	case SubjectRightmostUntrusted:
+		// the walk stops at the first hop no trusted proxy vouches for;
+		// if that one is unknown, obfuscated or unparsable, everything to
+		// its left is up to the client, and the request is attributed
+		// through the fallback of ips, if at all
+		hops := d.walkHops(in, true)
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hops[i] == nil {
+				return []net.IP{}
+			}
+			if !d.private(hops[i]) && !containsIP(d.options.TrustedProxies, hops[i]) {
+				return []net.IP{hops[i].To16()}
+			}
+		}
+		return []net.IP{}
+	}
+
+	ips := []net.IP{}
+	add := func(ip net.IP) {
+		if ip == nil || d.private(ip) {
+			return
+		}
+		// proxies often set both headers, count each IP only once
+		for _, known := range ips {
+			if known.Equal(ip) {
+				return
+			}
+		}
+		ips = append(ips, ip.To16())
+	}
+
+	add(ParseIP(in.Remote))
+	for _, xff := range strings.Split(in.XFF, ",") {
+		add(ParseIP(xff))
+	}
+	if fwd := in.Header("Forwarded"); fwd != "" {
+		for _, ip := range ForwardedFor(fwd) {
+			add(ip)
+		}
+	}
+
+	return ips
+}
+
+// chain returns the forwarding chain from the client to the remote address.
+// Forwarded is only used if there is no X-Forwarded-For.
+func (d *Decider) chain(in *Input) []net.IP {
+	chain := []net.IP{}
+	for _, hop := range d.hops(in) {
+		if hop != nil {
+			chain = append(chain, hop)
+		}
+	}
+	return chain
+}
+
+// hops returns the forwarding chain like chain, with nil for the unknown and
+// obfuscated hops. Hops that can't be parsed at all are left out.
+func (d *Decider) hops(in *Input) []net.IP {
+	return d.walkHops(in, false)
+}
+
+// walkHops returns the forwarding chain with nil for the unknown and
+// obfuscated hops, and with invalid also for the hops that can't be parsed
+// and for the rest of a malformed Forwarded header
+func (d *Decider) walkHops(in *Input, invalid bool) []net.IP {
+	hops := []net.IP{}
+	if in.XFF != "" {
+		for _, xff := range strings.Split(in.XFF, ",") {
+			xff = strings.TrimSpace(xff)
+			if ip := ParseIP(xff); ip != nil {
+				hops = append(hops, ip)
+			} else if invalid || strings.EqualFold(xff, "unknown") || isObfuscated(xff) {
+				hops = append(hops, nil)
+			}
+		}
+	} else if fwd := in.Header("Forwarded"); fwd != "" {
+		elements, err := ParseForwarded(fwd)
+		for _, elem := range elements {
+			if elem.For.IP != nil || elem.For.Name != "" || invalid {
+				hops = append(hops, elem.For.IP)
+			}
+		}
+		if err != nil && invalid {
+			hops = append(hops, nil)
+		}
+	}
+	if ip := ParseIP(in.Remote); ip != nil {
+		hops = append(hops, ip)
+	}
+	return hops
+}
+
+func (d *Decider) private(ip net.IP) bool {
+	return !d.options.IncludePrivate && d.ip.IsPrivate(ip)
+}
+
+func (d *Decider) record(req *Request) {
+	if d.engine != nil {
+		d.engine.Report(req)
+		return
+	}
+	if d.options.FailOpen != nil && d.options.FailOpen() {
+		select {
+		case d.requests <- req:
+		default:
+			if d.options.OnDrop != nil {
+				d.options.OnDrop(req)
+			}
+		}
+		return
+	}
+	d.requests <- req
+}
+
+func (d *Decider) blacklisted(ip net.IP) (bool, string) {
+	if d.engine != nil {
+		return d.engine.Check(ip)
+	}
+	reason, ok := d.blacklist.Reason(ip)
+	return ok, reason
+}
@@ -0,0 +1,300 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeciderIPs(t *testing.T) {
+	d, err := NewDecider(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := d.IPs(&Input{
+		Remote:  "10.0.0.1",
+		XFF:     "192.0.2.1, 192.168.1.1, 192.0.2.2",
+		Headers: map[string]string{"Forwarded": "for=192.0.2.2, for=_hidden, for=192.0.2.3"},
+	})
+	expected := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	if len(ips) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+	for i, ip := range ips {
+		if !ip.Equal(net.ParseIP(expected[i])) {
+			t.Errorf("expected %s, got %s", expected[i], ip)
+		}
+	}
+
+	d, err = NewDecider(nil, nil, &DeciderOptions{IncludePrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := d.IPs(&Input{Remote: "10.0.0.1:4711", XFF: "192.0.2.1"}); len(ips) != 2 {
+		t.Errorf("expected private IPs to be included, got %v", ips)
+	}
+}
+
+func TestDeciderMixedFamilies(t *testing.T) {
+	d, err := NewDecider(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &Input{
+		Remote:  "[2001:db8::10]:52344",
+		XFF:     "198.51.100.1:4711, [2001:db8::1]:443, fe80::1%eth0, ::ffff:198.51.100.1, 2001:db8::2%25en0, 192.0.2.1",
+		Headers: map[string]string{"Forwarded": `for="[2001:db8::3%25eth0]:80", for=203.0.113.1`},
+	}
+	expected := []string{"2001:db8::10", "198.51.100.1", "2001:db8::1", "2001:db8::2", "192.0.2.1", "2001:db8::3", "203.0.113.1"}
+	ips := d.IPs(in)
+	if len(ips) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+	for i, ip := range ips {
+		if !ip.Equal(net.ParseIP(expected[i])) {
+			t.Errorf("expected %s, got %s", expected[i], ip)
+		}
+	}
+
+	// the link-local hop is private and skipped by the subjects picking one
+	// IP of the chain as well
+	d, err = NewDecider(nil, nil, &DeciderOptions{Subject: SubjectRightmostUntrusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Remote = "10.0.0.1"
+	in.XFF = "2001:db8::1, 192.0.2.1, fe80::1%eth0"
+	if ips := d.IPs(in); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected 192.0.2.1, got %v", ips)
+	}
+}
+
+func TestDeciderUnknownHops(t *testing.T) {
+	var fallbacks []net.IP
+	unknown := 0
+	options := &DeciderOptions{OnUnknownHop: func(in *Input, fallback net.IP) {
+		unknown++
+		fallbacks = append(fallbacks, fallback)
+	}}
+	d, err := NewDecider(make(chan *Request, 10), nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(ip net.IP) (bool, string) { return false, "" }
+
+	// the proxy at 10.0.0.2 received the request from an unknown client
+	decision := d.Decide(&Input{Remote: "10.0.0.1", XFF: "unknown, 10.0.0.2"}, check)
+	if len(decision.IPs) != 1 || !decision.IPs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the request to fall back to 10.0.0.2, got %v", decision.IPs)
+	}
+	decision = d.Decide(&Input{Remote: "10.0.0.1", Headers: map[string]string{"Forwarded": "for=_hidden"}}, check)
+	if len(decision.IPs) != 1 || !decision.IPs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the request to fall back to the remote address, got %v", decision.IPs)
+	}
+
+	// requests with public IPs don't fall back
+	decision = d.Decide(&Input{Remote: "10.0.0.1", XFF: "UNKNOWN, 192.0.2.1"}, check)
+	if len(decision.IPs) != 1 || !decision.IPs[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the request to be attributed to 192.0.2.1, got %v", decision.IPs)
+	}
+
+	// neither do requests without unknown hops, nor are they reported
+	if decision := d.Decide(&Input{Remote: "10.0.0.1", XFF: "garbage"}, check); len(decision.IPs) != 0 {
+		t.Errorf("expected no IPs, got %v", decision.IPs)
+	}
+
+	if unknown != 3 || fallbacks[0] == nil || fallbacks[1] == nil || fallbacks[2] != nil {
+		t.Errorf("expected 3 requests with unknown hops, 2 falling back, got %d %v", unknown, fallbacks)
+	}
+
+	// trusted proxies aren't fallen back to
+	d, err = NewDecider(nil, nil, &DeciderOptions{Subject: SubjectRightmostUntrusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := d.IPs(&Input{Remote: "10.0.0.1", XFF: "unknown"}); len(ips) != 0 {
+		t.Errorf("expected no fallback to a trusted proxy, got %v", ips)
+	}
+	if ips := d.IPs(&Input{Remote: "10.0.0.1", XFF: "unknown, 198.51.100.1"}); len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("expected 198.51.100.1, got %v", ips)
+	}
+}
+
+func TestDeciderCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	bl.SetReason(net.ParseIP("192.0.2.2"), "test")
+
+	requests := make(chan *Request, 10)
+	decisions := 0
+	d, err := NewDecider(requests, bl, &DeciderOptions{
+		OnDecision: func(ip net.IP, in *Input, blocked bool, reason string) { decisions++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision := d.Check("192.0.2.1", "192.0.2.2, 192.0.2.3")
+	if !decision.Blocked || !decision.IP.Equal(net.ParseIP("192.0.2.2")) || decision.Reason != "test" || decision.String() != "BLOCK" {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+	if len(requests) != 2 || decisions != 2 {
+		t.Errorf("expected the IPs up to the blocked one to be recorded, got %d requests and %d decisions", len(requests), decisions)
+	}
+
+	if decision := d.Check("192.0.2.1", ""); decision.Blocked || decision.String() != "OK" {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+}
+
+func TestDeciderDedup(t *testing.T) {
+	requests := make(chan *Request, 10)
+	duplicates := 0
+	d, err := NewDecider(requests, nil, &DeciderOptions{
+		Dedup:       NewDeduplicator(time.Minute, 100),
+		OnDuplicate: func(ip net.IP, in *Input) { duplicates++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := func(ip net.IP) (bool, string) { return false, "" }
+
+	in := &Input{Remote: "192.0.2.1", URL: "/", Time: "2020-01-02T03:04:05Z"}
+	d.Decide(in, pass)
+	d.Decide(in, pass)
+
+	if len(requests) != 1 || duplicates != 1 {
+		t.Fatalf("expected 1 request and 1 duplicate, got %d and %d", len(requests), duplicates)
+	}
+	if req := <-requests; !req.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("unexpected request time %s", req.Time)
+	}
+}
+
+func TestDeciderSubject(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"198.51.100.0/24", "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseNetworks([]string{"foo"}); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+
+	in := &Input{Remote: "203.0.113.7", XFF: "10.1.1.1, 192.0.2.66, 192.0.2.1, 198.51.100.5"}
+
+	tests := []struct {
+		subject  string
+		expected string
+	}{
+		{"leftmost", "192.0.2.66"},
+		{"rightmost-untrusted", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		subject, err := ParseSubject(test.subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject.String() != test.subject {
+			t.Errorf("expected %s, got %s", test.subject, subject)
+		}
+
+		d, err := NewDecider(nil, nil, &DeciderOptions{Subject: subject, TrustedProxies: trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips := d.IPs(in)
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP(test.expected)) {
+			t.Errorf("%s: expected %s, got %v", test.subject, test.expected, ips)
+		}
+	}
+
+	d, err := NewDecider(nil, nil, &DeciderOptions{Subject: SubjectRightmostUntrusted, TrustedProxies: trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd := &Input{Remote: "198.51.100.1", Headers: map[string]string{"Forwarded": "for=192.0.2.9, for=203.0.113.7"}}
+	if ips := d.IPs(fwd); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.9")) {
+		t.Errorf("expected 192.0.2.9 from Forwarded, got %v", ips)
+	}
+	if ips := d.IPs(&Input{Remote: "198.51.100.1"}); len(ips) != 0 {
+		t.Errorf("expected no IP for a chain of trusted proxies, got %v", ips)
+	}
+
+	// an unknown, obfuscated or unparsable hop ends the walk, the client
+	// may have put anything to its left
+	d, err = NewDecider(nil, nil, &DeciderOptions{Subject: SubjectRightmostUntrusted, TrustedProxies: []*net.IPNet{{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []*Input{
+		{Remote: "203.0.113.1", XFF: "198.51.100.7, unknown"},
+		{Remote: "203.0.113.1", XFF: "198.51.100.7, _hidden"},
+		{Remote: "203.0.113.1", XFF: "198.51.100.7, garbage"},
+		{Remote: "203.0.113.1", XFF: "198.51.100.7, unknown, 203.0.113.2"},
+		{Remote: "203.0.113.1", Headers: map[string]string{"Forwarded": "for=198.51.100.7, for=unknown"}},
+		{Remote: "203.0.113.1", Headers: map[string]string{"Forwarded": "for=198.51.100.7, for=_hidden"}},
+		{Remote: "203.0.113.1", Headers: map[string]string{"Forwarded": "for=198.51.100.7, for=\"broken"}},
+	} {
+		if ips := d.IPs(in); len(ips) != 0 {
+			t.Errorf("%s%s: expected no IP past the unknown hop, got %v", in.XFF, in.Headers["Forwarded"], ips)
+		}
+	}
+
+	// an untrusted hop after the unknown one received the request
+	in = &Input{Remote: "203.0.113.1", XFF: "198.51.100.7, unknown, 192.0.2.5"}
+	if ips := d.IPs(in); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.5")) {
+		t.Errorf("expected 192.0.2.5, got %v", ips)
+	}
+	in = &Input{Remote: "192.0.2.6", Headers: map[string]string{"Forwarded": "for=198.51.100.7, for=_hidden"}}
+	if ips := d.IPs(in); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.6")) {
+		t.Errorf("expected the remote address, got %v", ips)
+	}
+
+	if _, err := ParseSubject("first"); err == nil {
+		t.Error("expected an error for an invalid subject")
+	}
+}
+
+func FuzzDeciderInput(f *testing.F) {
+	f.Add("192.0.2.1:1234", "10.0.0.1, 198.51.100.7", `for="[2001:db8::1]:80", for=192.0.2.9`, "2020-01-02T03:04:05Z", "512")
+	f.Add("[2001:db8::2]:443", "unknown, , 300.1.1.1", "for=_hidden;by=unknown", "", "-1")
+	f.Add("", "", "for=", "not a time", "18446744073709551616")
+
+	trusted, _ := ParseNetworks([]string{"198.51.100.0/24"})
+	requests := make(chan *Request, 64)
+	deciders := []*Decider{}
+	for _, subject := range []Subject{SubjectAll, SubjectLeftmost, SubjectRightmostUntrusted} {
+		d, err := NewDecider(requests, nil, &DeciderOptions{Subject: subject, TrustedProxies: trusted, IncludePrivate: true})
+		if err != nil {
+			f.Fatal(err)
+		}
+		deciders = append(deciders, d)
+	}
+	pass := func(ip net.IP) (bool, string) { return false, "" }
+
+	f.Fuzz(func(t *testing.T, remote, xff, forwarded, timestamp, bytes string) {
+		in := &Input{Remote: remote, XFF: xff, Time: timestamp, Bytes: bytes, URL: "/",
+			Headers: map[string]string{"Forwarded": forwarded}}
+
+		for _, d := range deciders {
+			ips := d.IPs(in)
+			for _, ip := range ips {
+				if ip == nil {
+					t.Fatal("IPs returned a nil IP")
+				}
+			}
+			if len(ips) > cap(requests) {
+				continue
+			}
+			d.Decide(in, pass)
+			for len(requests) > 0 {
+				<-requests
+			}
+		}
+	})
+}
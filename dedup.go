@@ -0,0 +1,84 @@
+package botdetect
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Deduplicator recognizes events that are delivered more than once, as
+// at-least-once log pipelines do after retries. An event is identified by
+// IP, URL and the timestamp of the event itself and counts as a duplicate if
+// it has been seen within the horizon. At most maxEntries events are
+// remembered; the oldest one is forgotten first.
+type Deduplicator struct {
+	horizon    time.Duration
+	maxEntries int
+
+	seen  map[string]time.Time
+	order []dedupKey
+	mutex sync.Mutex
+}
+
+type dedupKey struct {
+	key  string
+	seen time.Time
+}
+
+// NewDeduplicator creates a new Deduplicator
+func NewDeduplicator(horizon time.Duration, maxEntries int) *Deduplicator {
+	return &Deduplicator{
+		horizon:    horizon,
+		maxEntries: maxEntries,
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// Duplicate records the event and determines whether it has been seen before
+func (d *Deduplicator) Duplicate(ip net.IP, url, timestamp string) bool {
+	if d == nil {
+		return false
+	}
+
+	key := string(ip.To16()) + "|" + timestamp + "|" + url
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire(now)
+
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+
+	if len(d.order) >= d.maxEntries {
+		delete(d.seen, d.order[0].key)
+		d.order = d.order[1:]
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupKey{key: key, seen: now})
+
+	return false
+}
+
+// Size returns the number of remembered events
+func (d *Deduplicator) Size() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.seen)
+}
+
+// expire forgets the events older than the horizon
+func (d *Deduplicator) expire(now time.Time) {
+	cutoff := now.Add(-d.horizon)
+
+	n := 0
+	for n < len(d.order) && d.order[n].seen.Before(cutoff) {
+		delete(d.seen, d.order[n].key)
+		n++
+	}
+	if n > 0 {
+		d.order = d.order[n:]
+	}
+}
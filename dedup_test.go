@@ -0,0 +1,35 @@
+package botdetect
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(50*time.Millisecond, 2)
+	ip := net.ParseIP("192.0.2.1")
+
+	if d.Duplicate(ip, "/a", "10:00:00") {
+		t.Error("the first event can't be a duplicate")
+	}
+	if !d.Duplicate(ip, "/a", "10:00:00") {
+		t.Error("expected a duplicate")
+	}
+	if d.Duplicate(ip, "/a", "10:00:01") || d.Duplicate(net.ParseIP("::ffff:192.0.2.2"), "/a", "10:00:00") {
+		t.Error("events with a different timestamp or IP are no duplicates")
+	}
+	if d.Size() != 2 {
+		t.Errorf("expected 2 remembered events, got %d", d.Size())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if d.Duplicate(ip, "/a", "10:00:01") {
+		t.Error("the event should have been forgotten after the horizon")
+	}
+
+	var nilDedup *Deduplicator
+	if nilDedup.Duplicate(ip, "/a", "") {
+		t.Error("a nil Deduplicator never finds duplicates")
+	}
+}
@@ -0,0 +1,216 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dryRunIdle is the interval of the background loops of a dry run's
+// history, which is evaluated in the time of the requests instead
+const dryRunIdle = 100 * 365 * 24 * time.Hour
+
+// DryRun evaluates the rules of a history on captured requests as if they
+// arrived at their times, e.g. to see what a configuration would block
+// before deploying it. The rules are evaluated every Interval of request
+// time and IPs stay blacklisted for the TTL in request time. Nothing is
+// stored or looked up, so leader election, replication, reputations, PTR
+// patterns and network owners don't apply, nor do the grace period, the
+// canary and the runaway guard. DryRun is an Engine; it expects the
+// requests in the order of their times.
+type DryRun struct {
+	history  *IPHistory
+	cancel   context.CancelFunc
+	interval time.Duration
+
+	// now is the time of the latest request, next the time of the next
+	// evaluation
+	now  time.Time
+	next time.Time
+
+	reported uint64
+	blocked  map[string]dryRunBlock
+	blocks   []DryRunBlock
+	matches  map[string]map[string]bool
+	mutex    sync.Mutex
+}
+
+type dryRunBlock struct {
+	until  time.Time
+	reason string
+
+	// index is the index of the block in blocks
+	index int
+}
+
+// DryRunBlock is a time an IP was blocked during a dry run, from the
+// evaluation that blacklisted it until the block ran out. An IP that keeps
+// exceeding a rule while it is blocked is blocked longer, not again.
+type DryRunBlock struct {
+	IP     net.IP    `json:"ip"`
+	Reason string    `json:"reason"`
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+}
+
+// NewDryRun creates a DryRun of the options, which aren't modified
+func NewDryRun(ctx context.Context, options *IPHistoryOptions) (*DryRun, error) {
+	o := *options
+	o.Interval = dryRunIdle
+	o.ExpireInterval = dryRunIdle
+	o.Leader = nil
+	o.Replication = nil
+	o.Reputation = nil
+	o.PTR = nil
+	o.Ownership = nil
+	o.Runaway = nil
+	o.Watchdog = nil
+	o.Backpressure = nil
+	o.Shedding = nil
+	o.Audit = nil
+	o.Metrics = nil
+	o.OnWarn = nil
+	o.GracePeriod = 0
+	o.Canary = 0
+	o.BlacklistMaxSize = 0
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	h, err := NewIPHistory(ctx, &o)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d := &DryRun{
+		history:  h,
+		cancel:   cancel,
+		interval: options.Interval,
+		blocked:  make(map[string]dryRunBlock),
+		matches:  make(map[string]map[string]bool),
+	}
+	h.dryRun = d
+	return d, nil
+}
+
+// Report records a request. The rules are evaluated first for every
+// interval that ended before it.
+func (d *DryRun) Report(req *Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	at := req.Time
+	if at.IsZero() || at.Before(d.now) {
+		at = d.now
+	}
+	if d.next.IsZero() {
+		d.next = at.Truncate(d.interval).Add(d.interval)
+	}
+	d.evaluateUntil(at)
+
+	d.now = at
+	d.reported++
+	r := *req
+	r.Time = at
+	d.history.reqChan <- &r
+}
+
+// Check returns whether the IP is blacklisted at the time of the latest
+// request and by which rule
+func (d *DryRun) Check(ip net.IP) (bool, string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	b, ok := d.blocked[ipKey(ip)]
+	if !ok || !b.until.After(d.now) {
+		return false, ""
+	}
+	return true, b.reason
+}
+
+// Flush evaluates the rules on the requests reported since the last
+// evaluation, at the end of the interval of the latest one
+func (d *DryRun) Flush() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.next.IsZero() {
+		d.evaluateUntil(d.next)
+	}
+}
+
+// Matches returns the number of distinct IPs each rule blacklisted, by the
+// reason the rule blacklists IPs for, e.g. "rule 1m0s:100:0.1" or "walk"
+func (d *DryRun) Matches() map[string]int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	matches := make(map[string]int, len(d.matches))
+	for rule, ips := range d.matches {
+		matches[rule] = len(ips)
+	}
+	return matches
+}
+
+// Blocks returns the blocks of the dry run in the order they began
+func (d *DryRun) Blocks() []DryRunBlock {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	blocks := make([]DryRunBlock, len(d.blocks))
+	copy(blocks, d.blocks)
+	return blocks
+}
+
+// Close stops the history of the dry run
+func (d *DryRun) Close() error {
+	d.cancel()
+	return nil
+}
+
+// evaluateUntil evaluates the rules at the end of every interval up to t.
+// d.mutex must be held.
+func (d *DryRun) evaluateUntil(t time.Time) {
+	for !d.next.After(t) {
+		for d.history.Processed() < d.reported {
+			time.Sleep(100 * time.Microsecond)
+		}
+		d.history.calculateAt(d.next)
+
+		// nothing is left to evaluate until t, so intervals without
+		// requests are skipped
+		if last := t.Truncate(d.interval); last.After(d.next) {
+			d.next = last
+		} else {
+			d.next = d.next.Add(d.interval)
+		}
+	}
+}
+
+// block blacklists the IP from the time of the evaluation. It is called by
+// the history while d.mutex is held by evaluateUntil.
+func (d *DryRun) block(ip net.IP, reason string, action RuleAction) {
+	ttl := d.history.opts().BlacklistTTL
+	if action.TTL > 0 {
+		ttl = action.TTL
+	}
+	key := ipKey(ip)
+	until := d.next.Add(ttl)
+	if b, ok := d.blocked[key]; ok && b.until.After(d.next) {
+		b.until, b.reason = until, reason
+		d.blocks[b.index].Until = until
+		d.blocked[key] = b
+	} else {
+		d.blocked[key] = dryRunBlock{until: until, reason: reason, index: len(d.blocks)}
+		d.blocks = append(d.blocks, DryRunBlock{IP: ip, Reason: reason, From: d.next, Until: until})
+	}
+
+	ips, ok := d.matches[reason]
+	if !ok {
+		ips = make(map[string]bool)
+		d.matches[reason] = ips
+	}
+	ips[key] = true
+}
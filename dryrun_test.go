@@ -0,0 +1,70 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	options := &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        10 * time.Second,
+		Window:          time.Minute,
+		Interval:        10 * time.Second,
+		ExpireInterval:  time.Minute,
+		BlacklistTTL:    5 * time.Minute,
+		MaxRequests:     10,
+		GracePeriod:     time.Hour,
+	}
+	d, err := NewDryRun(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	scraper, visitor := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Minute)
+	var blockedAt time.Time
+	for i := 0; i < 60; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		d.Report(&Request{IP: scraper, URL: "/", Time: at})
+		if i%10 == 0 {
+			d.Report(&Request{IP: visitor, URL: "/", Time: at})
+		}
+		if blocked, _ := d.Check(scraper); blocked && blockedAt.IsZero() {
+			blockedAt = at
+		}
+	}
+
+	// the scraper exceeds the limit with its 11th request and is blocked
+	// from the end of that interval on
+	if expected := start.Add(20 * time.Second); !blockedAt.Equal(expected) {
+		t.Errorf("expected the scraper to be blocked from %s, got %s", expected, blockedAt)
+	}
+	if blocked, reason := d.Check(scraper); !blocked || reason != "rule 1m0s:10:0" {
+		t.Errorf("expected the scraper to be blocked by the rule, got %v %s", blocked, reason)
+	}
+	if blocked, _ := d.Check(visitor); blocked {
+		t.Error("expected the visitor not to be blocked")
+	}
+
+	// blocks expire in the time of the requests
+	d.Report(&Request{IP: visitor, URL: "/", Time: start.Add(10 * time.Minute)})
+	if blocked, _ := d.Check(scraper); blocked {
+		t.Error("expected the block of the scraper to have expired")
+	}
+
+	d.Flush()
+	if matches := d.Matches(); len(matches) != 1 || matches["rule 1m0s:10:0"] != 1 {
+		t.Errorf("expected the rule to match one IP, got %v", matches)
+	}
+	blocks := d.Blocks()
+	if len(blocks) != 1 || !blocks[0].IP.Equal(scraper) || !blocks[0].From.Equal(start.Add(20*time.Second)) || !blocks[0].Until.After(blocks[0].From.Add(5*time.Minute)) {
+		t.Errorf("expected one block of the scraper, extended while it kept exceeding the rule, got %+v", blocks)
+	}
+	if options.Interval != 10*time.Second || options.GracePeriod != time.Hour {
+		t.Error("expected the options not to be modified")
+	}
+}
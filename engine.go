@@ -0,0 +1,50 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+)
+
+// Engine records requests and decides whether to block IPs. LocalEngine runs
+// the detection in process, the client package talks to a remote server;
+// code written against Engine works with both.
+type Engine interface {
+	// Report records a request
+	Report(req *Request)
+
+	// Check returns whether requests from the IP should be blocked and why
+	Check(ip net.IP) (bool, string)
+
+	// Close stops the engine and releases its resources
+	Close() error
+}
+
+// LocalEngine is an Engine backed by an IPHistory in the same process
+type LocalEngine struct {
+	*IPHistory
+	cancel context.CancelFunc
+}
+
+// NewLocalEngine creates an IPHistory with the options. It runs until ctx is
+// done or the engine is closed.
+func NewLocalEngine(ctx context.Context, options *IPHistoryOptions) (*LocalEngine, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	h, err := NewIPHistory(ctx, options)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &LocalEngine{IPHistory: h, cancel: cancel}, nil
+}
+
+// Check returns whether the IP is blacklisted and why
+func (e *LocalEngine) Check(ip net.IP) (bool, string) {
+	reason, ok := e.blacklist.Reason(ip)
+	return ok, reason
+}
+
+// Close stops the background goroutines of the history
+func (e *LocalEngine) Close() error {
+	e.cancel()
+	return nil
+}
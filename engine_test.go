@@ -0,0 +1,104 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEngine blocks the IPs in blocked and remembers the reports
+type fakeEngine struct {
+	blocked map[string]bool
+	reports []*Request
+	mutex   sync.Mutex
+}
+
+func (e *fakeEngine) Report(req *Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.reports = append(e.reports, req)
+}
+
+func (e *fakeEngine) Check(ip net.IP) (bool, string) {
+	return e.blocked[ip.String()], "fake"
+}
+
+func (e *fakeEngine) Close() error {
+	return nil
+}
+
+func TestEngineDecider(t *testing.T) {
+	engine := &fakeEngine{blocked: map[string]bool{"192.0.2.2": true}}
+	d, err := NewEngineDecider(engine, &DeciderOptions{IncludePrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision := d.CheckInput(&Input{Remote: "192.0.2.1", XFF: "192.0.2.2", URL: "/a"})
+	if !decision.Blocked || !decision.IP.Equal(net.ParseIP("192.0.2.2")) || decision.Reason != "fake" {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+	if len(engine.reports) != 2 || engine.reports[0].URL != "/a" {
+		t.Errorf("expected both IPs to be reported, got %v", engine.reports)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	engine := &fakeEngine{blocked: map[string]bool{"192.0.2.2": true}}
+	handler, err := Middleware(engine, &DeciderOptions{IncludePrivate: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for xff, expected := range map[string]int{
+		"192.0.2.1": http.StatusOK,
+		"192.0.2.2": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page?x=1", nil)
+		req.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("%s: expected %d, got %d", xff, expected, rec.Code)
+		}
+	}
+	if len(engine.reports) == 0 || engine.reports[0].URL != "/page?x=1" {
+		t.Errorf("expected the requests to be reported, got %v", engine.reports)
+	}
+}
+
+func TestLocalEngine(t *testing.T) {
+	engine, err := NewLocalEngine(context.Background(), &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	var e Engine = engine
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		e.Report(&Request{IP: ip, URL: "/"})
+	}
+	for engine.Processed() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	engine.TriggerCalculate()
+
+	if blocked, reason := e.Check(ip); !blocked || reason == "" {
+		t.Errorf("expected the IP to be blocked with a reason, got %v %q", blocked, reason)
+	}
+}
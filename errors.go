@@ -0,0 +1,79 @@
+package botdetect
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors returned by the package. Use errors.Is to find out
+// which kind an error is, e.g. to retry when a store is unavailable but give
+// up on an invalid configuration.
+var (
+	// ErrInvalidIP means an IP or network couldn't be parsed
+	ErrInvalidIP = errors.New("invalid IP")
+
+	// ErrStoreUnavailable means a shared store or remote detector couldn't
+	// be reached or failed
+	ErrStoreUnavailable = errors.New("store unavailable")
+
+	// ErrConfig means options, rules, patterns or files given as
+	// configuration are invalid
+	ErrConfig = errors.New("invalid configuration")
+
+	// ErrStateVersion means a saved state was written by a newer version
+	// and can't be read without losing data
+	ErrStateVersion = errors.New("unsupported state version")
+)
+
+// Error is an error of one of the kinds above. Its message is that of Err,
+// which is kept for errors.Is and errors.As as well.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// Error returns the message of the underlying error
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the kind target
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// configError marks err as of the kind ErrConfig
+func configError(err error) error {
+	if err == nil || errors.Is(err, ErrConfig) {
+		return err
+	}
+	return &Error{Kind: ErrConfig, Err: err}
+}
+
+// configErrorf formats an error of the kind ErrConfig
+func configErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ErrConfig, Err: fmt.Errorf(format, args...)}
+}
+
+// invalidIPErrorf formats an error of the kind ErrInvalidIP
+func invalidIPErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ErrInvalidIP, Err: fmt.Errorf(format, args...)}
+}
+
+// stateVersionErrorf formats an error of the kind ErrStateVersion
+func stateVersionErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ErrStateVersion, Err: fmt.Errorf(format, args...)}
+}
+
+// storeError marks err as of the kind ErrStoreUnavailable
+func storeError(err error) error {
+	if err == nil || errors.Is(err, ErrStoreUnavailable) {
+		return err
+	}
+	return &Error{Kind: ErrStoreUnavailable, Err: err}
+}
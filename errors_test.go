@@ -0,0 +1,48 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	_, err := ParseRules("1h:many:0.5")
+	if !errors.Is(err, ErrConfig) || errors.Is(err, ErrInvalidIP) {
+		t.Errorf("expected a configuration error, got %v", err)
+	}
+	if err.Error() != "invalid max-requests in rule '1h:many:0.5': strconv.ParseUint: parsing \"many\": invalid syntax" {
+		t.Errorf("expected the message to be kept, got %s", err)
+	}
+
+	// the underlying error stays accessible
+	_, err = LoadRules(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, ErrConfig) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a configuration error for a missing file, got %v", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("expected a path error, got %T", err)
+	}
+
+	if _, err := ParseCanonicalAddr("192.0.2.300"); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("expected an invalid IP error, got %v", err)
+	}
+	if _, err := ParseNetworks([]string{"192.0.2.0/33"}); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("expected an invalid IP error, got %v", err)
+	}
+
+	if _, err := NewIPHistory(context.Background(), nil); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for missing options, got %v", err)
+	}
+	if _, err := NewEngineDecider(nil, nil); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for a missing engine, got %v", err)
+	}
+
+	// marking an error twice doesn't wrap it again
+	if e := configErrorf("invalid"); configError(e) != e {
+		t.Error("expected the error to be marked once")
+	}
+}
@@ -0,0 +1,135 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+)
+
+// DefaultShadowQueue is the number of requests queued for a shadow policy
+// unless its Queue is set
+const DefaultShadowQueue = 10000
+
+// Policy is a named history taking part in a FanOut
+type Policy struct {
+	Name    string
+	History *IPHistory
+
+	// Queue is the number of requests queued for a shadow policy before
+	// they are dropped, DefaultShadowQueue if zero. The primary policy has
+	// no queue of its own.
+	Queue int
+}
+
+// FanOut feeds every request to several histories so that alternative
+// policies can be evaluated on live traffic. The first policy is the primary
+// one whose decisions are enforced, all others run in shadow mode and only
+// show up in the metrics. Every shadow policy has its own queue; requests
+// that don't fit into it are dropped and counted, so that a slow shadow
+// never holds up the primary policy.
+type FanOut struct {
+	policies  []Policy
+	queues    []chan *Request
+	reqChan   chan *Request
+	decisions *CounterVec
+	dropped   *CounterVec
+	ctx       context.Context
+}
+
+// NewFanOut creates a FanOut for the policies, the first one being primary
+func NewFanOut(ctx context.Context, metrics *Metrics, policies ...Policy) *FanOut {
+	f := &FanOut{
+		policies: policies,
+		reqChan:  make(chan *Request),
+		decisions: metrics.Counter("botdetect_policy_decisions_total",
+			"Blacklist lookups per policy and outcome", "policy", "blacklisted"),
+		dropped: metrics.Counter("botdetect_policy_dropped_total",
+			"Requests dropped because the queue of a shadow policy was full", "policy"),
+		ctx: ctx,
+	}
+
+	for _, p := range policies[1:] {
+		size := p.Queue
+		if size <= 0 {
+			size = DefaultShadowQueue
+		}
+		queue := make(chan *Request, size)
+		f.queues = append(f.queues, queue)
+		go f.drain(p, queue)
+	}
+	go f.forward()
+
+	return f
+}
+
+// RequestChannel returns the channel through which requests are fed to all histories
+func (f *FanOut) RequestChannel() chan *Request {
+	return f.reqChan
+}
+
+// Primary returns the history whose decisions are enforced
+func (f *FanOut) Primary() *IPHistory {
+	return f.policies[0].History
+}
+
+// Policies returns all policies, the primary one first
+func (f *FanOut) Policies() []Policy {
+	return f.policies
+}
+
+// IsBlacklisted looks the IP up in all histories, counts the outcomes and
+// returns the decision of the primary history
+func (f *FanOut) IsBlacklisted(ip net.IP) bool {
+	primary := false
+	for i, p := range f.policies {
+		blacklisted := p.History.IsBlacklisted(ip)
+		if i == 0 {
+			primary = blacklisted
+		}
+		if blacklisted {
+			f.decisions.Inc(p.Name, "true")
+		} else {
+			f.decisions.Inc(p.Name, "false")
+		}
+	}
+	return primary
+}
+
+// forward queues every request for the shadow policies without waiting and
+// hands it to the primary one
+func (f *FanOut) forward() {
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case req := <-f.reqChan:
+			for i, queue := range f.queues {
+				select {
+				case queue <- req:
+				default:
+					f.dropped.Inc(f.policies[i+1].Name)
+				}
+			}
+			select {
+			case <-f.ctx.Done():
+				return
+			case f.Primary().RequestChannel() <- req:
+			}
+		}
+	}
+}
+
+// drain feeds the queued requests to a shadow policy
+func (f *FanOut) drain(p Policy, queue <-chan *Request) {
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case req := <-queue:
+			select {
+			case <-f.ctx.Done():
+				return
+			case p.History.RequestChannel() <- req:
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := func(maxRequests uint64) *IPHistoryOptions {
+		return &IPHistoryOptions{
+			TimeSlot:       time.Minute,
+			Window:         time.Hour,
+			Interval:       10 * time.Millisecond,
+			ExpireInterval: time.Minute,
+			BlacklistTTL:   time.Hour,
+			MaxRequests:    maxRequests,
+			MaxRatio:       0.5,
+		}
+	}
+
+	primary, err := NewIPHistory(ctx, options(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := NewIPHistory(ctx, options(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics()
+	f := NewFanOut(ctx, metrics,
+		Policy{Name: "primary", History: primary},
+		Policy{Name: "strict", History: strict},
+	)
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		f.RequestChannel() <- &Request{URL: "/index.html", IP: ip}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if f.IsBlacklisted(ip) {
+		t.Errorf("the primary policy should not blacklist %s", ip)
+	}
+	if !f.Policies()[1].History.IsBlacklisted(ip) {
+		t.Errorf("the strict policy should blacklist %s", ip)
+	}
+
+	values := f.decisions.Values()
+	if values["primary|false"] != 1 || values["strict|true"] != 1 {
+		t.Errorf("unexpected decision counts: %v", values)
+	}
+}
+
+func TestFanOutSlowShadow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Hour,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    100,
+		MaxRatio:       0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a shadow that never takes a request
+	stuck := &IPHistory{reqChan: make(chan *Request)}
+
+	metrics := NewMetrics()
+	f := NewFanOut(ctx, metrics,
+		Policy{Name: "primary", History: primary},
+		Policy{Name: "stuck", History: stuck, Queue: 3},
+	)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			f.RequestChannel() <- &Request{URL: "/index.html", IP: net.ParseIP("192.0.2.1")}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stuck shadow policy held up the primary one")
+	}
+	for primary.Processed() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// three requests are queued and one more is waiting for the shadow,
+	// unless it was taken after the queue had filled up
+	if dropped := f.dropped.Values()["stuck"]; dropped != 6 && dropped != 7 {
+		t.Errorf("expected 6 or 7 requests to be dropped, got %d", dropped)
+	}
+}
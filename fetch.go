@@ -0,0 +1,233 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FetchHeaders are the fetch metadata and client hint headers the
+// FetchGuard looks at
+var FetchHeaders = []string{
+	"Sec-Fetch-Site",
+	"Sec-Fetch-Mode",
+	"Sec-Fetch-Dest",
+	"Sec-Fetch-User",
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+}
+
+// FetchOptions configures the FetchGuard
+type FetchOptions struct {
+	// Window is the time over which navigations are counted
+	Window time.Duration
+
+	// MaxBareNavigations flags IPs that navigate to more documents within
+	// Window without fetching a single subresource in between, as
+	// scrapers do that only download the HTML. Zero disables the check.
+	MaxBareNavigations int
+
+	// StrictChromium flags requests whose User-Agent claims a version of
+	// Chrome or another Chromium browser that sends fetch metadata and
+	// client hints, but that come without them. Browsers only send them
+	// over HTTPS, so this is for sites served over HTTPS only.
+	StrictChromium bool
+}
+
+// FetchGuard detects headless browsers and scrapers by their fetch metadata
+// (Sec-Fetch-*) and client hints (Sec-CH-UA*): combinations no browser sends
+// and navigations without any subresource fetches. Flagged IPs stay flagged
+// for the rest of the window.
+type FetchGuard struct {
+	options FetchOptions
+
+	ips        map[string]*fetchIP
+	lastExpire time.Time
+	mutex      sync.Mutex
+}
+
+type fetchIP struct {
+	navigations []time.Time
+	flagged     time.Time
+	reason      string
+}
+
+// NewFetchGuard creates a FetchGuard
+func NewFetchGuard(options FetchOptions) *FetchGuard {
+	return &FetchGuard{
+		options:    options,
+		ips:        make(map[string]*fetchIP),
+		lastExpire: time.Now(),
+	}
+}
+
+// Clone returns a FetchGuard with the same options that hasn't seen any
+// requests yet
+func (g *FetchGuard) Clone() *FetchGuard {
+	if g == nil {
+		return nil
+	}
+	return NewFetchGuard(g.options)
+}
+
+// Observe records the request by the IP and returns whether the IP is
+// flagged and why
+func (g *FetchGuard) Observe(ip net.IP, in *Input, now time.Time) (string, bool) {
+	if g == nil {
+		return "", false
+	}
+	ipstr := ipKey(ip)
+	cutoff := now.Add(-g.options.Window)
+	why := g.inconsistency(in)
+	dest := strings.ToLower(fetchHeader(in, "Sec-Fetch-Dest"))
+	navigation := fetchHeader(in, "Sec-Fetch-Mode") == "navigate" || isDocument(dest)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if now.Sub(g.lastExpire) >= g.options.Window {
+		g.expire(cutoff)
+		g.lastExpire = now
+	}
+
+	fi, ok := g.ips[ipstr]
+	if !ok {
+		if why == "" && !navigation {
+			return "", false
+		}
+		fi = &fetchIP{}
+		g.ips[ipstr] = fi
+	}
+
+	switch {
+	case why != "":
+		fi.flag(now, "fetch metadata: "+why)
+	case navigation:
+		fi.navigations = append(since(fi.navigations, cutoff), now)
+		if n := len(fi.navigations); g.options.MaxBareNavigations > 0 && n > g.options.MaxBareNavigations {
+			fi.flag(now, fmt.Sprintf("fetch metadata: %d navigations without subresources", n))
+		}
+	case dest != "":
+		fi.navigations = nil
+	}
+
+	if fi.flagged.IsZero() || fi.flagged.Before(cutoff) {
+		return "", false
+	}
+	return fi.reason, true
+}
+
+func (fi *fetchIP) flag(now time.Time, reason string) {
+	fi.flagged = now
+	fi.reason = reason
+}
+
+// expire forgets the IPs without navigations since cutoff that aren't
+// flagged anymore. g.mutex must be held.
+func (g *FetchGuard) expire(cutoff time.Time) {
+	for ip, fi := range g.ips {
+		fi.navigations = since(fi.navigations, cutoff)
+		if len(fi.navigations) == 0 && fi.flagged.Before(cutoff) {
+			delete(g.ips, ip)
+		}
+	}
+}
+
+// Size returns the number of IPs being tracked
+func (g *FetchGuard) Size() int {
+	if g == nil {
+		return 0
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.ips)
+}
+
+var (
+	fetchSites = map[string]bool{"cross-site": true, "same-origin": true, "same-site": true, "none": true}
+
+	// navigationDests are the destinations of navigations, which may also
+	// load embedded objects
+	navigationDests = map[string]bool{"document": true, "iframe": true, "frame": true, "embed": true, "object": true}
+
+	chromiumVersion = regexp.MustCompile(`(?:Chrome|Chromium)/(\d+)`)
+
+	// chPlatforms map the platforms of client hints to what the
+	// User-Agent of the same browser contains
+	chPlatforms = map[string]string{
+		"Windows":   "Windows",
+		"macOS":     "Macintosh",
+		"Linux":     "Linux",
+		"Android":   "Android",
+		"Chrome OS": "CrOS",
+	}
+)
+
+// minStrictChromium is the first version of Chrome that sends both fetch
+// metadata and client hints
+const minStrictChromium = 89
+
+// inconsistency returns why the fetch metadata and client hints of the
+// request are impossible for a browser, or an empty string if they aren't
+func (g *FetchGuard) inconsistency(in *Input) string {
+	site := fetchHeader(in, "Sec-Fetch-Site")
+	mode := fetchHeader(in, "Sec-Fetch-Mode")
+	dest := strings.ToLower(fetchHeader(in, "Sec-Fetch-Dest"))
+	user := fetchHeader(in, "Sec-Fetch-User")
+	hints := fetchHeader(in, "Sec-Ch-Ua")
+	agent := in.Header("User-Agent")
+
+	if site != "" && !fetchSites[site] {
+		return fmt.Sprintf("invalid Sec-Fetch-Site %s", site)
+	}
+	if mode == "navigate" && dest != "" && !navigationDests[dest] {
+		return fmt.Sprintf("navigation to %s", dest)
+	}
+	if dest == "document" && mode != "" && mode != "navigate" {
+		return fmt.Sprintf("document fetched in %s mode", mode)
+	}
+	if user == "?1" && mode != "navigate" {
+		return "user activation without navigation"
+	}
+
+	if strings.Contains(hints, "HeadlessChrome") {
+		return "headless client hints"
+	}
+	if hints != "" && agent != "" {
+		if !chromiumVersion.MatchString(agent) {
+			return "Chromium client hints with another User-Agent"
+		}
+		if fetchHeader(in, "Sec-Ch-Ua-Mobile") == "?1" && !strings.Contains(agent, "Mobile") && !strings.Contains(agent, "Android") {
+			return "mobile client hints with a desktop User-Agent"
+		}
+		platform := strings.Trim(fetchHeader(in, "Sec-Ch-Ua-Platform"), `"`)
+		if token, ok := chPlatforms[platform]; ok && !strings.Contains(agent, token) {
+			return fmt.Sprintf("client hints of %s with another User-Agent", platform)
+		}
+	}
+
+	if g.options.StrictChromium && site == "" && hints == "" {
+		if m := chromiumVersion.FindStringSubmatch(agent); m != nil {
+			if version, _ := strconv.Atoi(m[1]); version >= minStrictChromium {
+				return fmt.Sprintf("Chrome %d without fetch metadata and client hints", version)
+			}
+		}
+	}
+	return ""
+}
+
+// fetchHeader returns the header of the request, or an empty string if it is
+// missing or logged as "-"
+func fetchHeader(in *Input, name string) string {
+	v := strings.TrimSpace(in.Header(name))
+	if v == "-" {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,97 @@
+package botdetect
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	chromeWindows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	firefoxLinux  = "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+)
+
+func fetchInput(headers ...string) *Input {
+	in := &Input{URL: "/", Headers: map[string]string{}}
+	for i := 0; i+1 < len(headers); i += 2 {
+		in.Headers[headers[i]] = headers[i+1]
+	}
+	return in
+}
+
+func TestFetchGuardInconsistency(t *testing.T) {
+	g := NewFetchGuard(FetchOptions{Window: time.Minute, StrictChromium: true})
+
+	for _, test := range []struct {
+		in  *Input
+		why string
+	}{
+		{fetchInput("Sec-Fetch-Site", "none", "Sec-Fetch-Mode", "navigate", "Sec-Fetch-Dest", "document", "Sec-Fetch-User", "?1",
+			"Sec-Ch-Ua", `"Chromium";v="120"`, "Sec-Ch-Ua-Mobile", "?0", "Sec-Ch-Ua-Platform", `"Windows"`, "User-Agent", chromeWindows), ""},
+		{fetchInput("Sec-Fetch-Site", "same-origin", "Sec-Fetch-Mode", "cors", "Sec-Fetch-Dest", "empty", "User-Agent", firefoxLinux), ""},
+		// logged without the headers
+		{fetchInput("Sec-Fetch-Site", "-", "Sec-Fetch-Mode", "-", "User-Agent", firefoxLinux), ""},
+		{fetchInput("User-Agent", "curl/8.0"), ""},
+
+		{fetchInput("Sec-Fetch-Site", "elsewhere"), "invalid Sec-Fetch-Site"},
+		{fetchInput("Sec-Fetch-Mode", "navigate", "Sec-Fetch-Dest", "script"), "navigation to script"},
+		{fetchInput("Sec-Fetch-Mode", "no-cors", "Sec-Fetch-Dest", "document"), "document fetched in no-cors mode"},
+		{fetchInput("Sec-Fetch-Mode", "cors", "Sec-Fetch-User", "?1"), "user activation"},
+		{fetchInput("Sec-Ch-Ua", `"HeadlessChrome";v="120"`), "headless"},
+		{fetchInput("Sec-Ch-Ua", `"Chromium";v="120"`, "User-Agent", firefoxLinux), "another User-Agent"},
+		{fetchInput("Sec-Ch-Ua", `"Chromium";v="120"`, "Sec-Ch-Ua-Mobile", "?1", "User-Agent", chromeWindows), "mobile client hints"},
+		{fetchInput("Sec-Ch-Ua", `"Chromium";v="120"`, "Sec-Ch-Ua-Platform", `"macOS"`, "User-Agent", chromeWindows), "client hints of macOS"},
+		{fetchInput("User-Agent", chromeWindows), "Chrome 120 without fetch metadata"},
+	} {
+		why := g.inconsistency(test.in)
+		if test.why == "" && why != "" || !strings.Contains(why, test.why) {
+			t.Errorf("%v: expected %q, got %q", test.in.Headers, test.why, why)
+		}
+	}
+
+	g.options.StrictChromium = false
+	if why := g.inconsistency(fetchInput("User-Agent", chromeWindows)); why != "" {
+		t.Errorf("expected Chrome without fetch metadata to pass unless strict, got %q", why)
+	}
+}
+
+func TestFetchGuard(t *testing.T) {
+	g := NewFetchGuard(FetchOptions{Window: time.Minute, MaxBareNavigations: 3})
+	now := time.Now()
+	ip, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	navigate := fetchInput("Sec-Fetch-Mode", "navigate", "Sec-Fetch-Dest", "document")
+	script := fetchInput("Sec-Fetch-Mode", "no-cors", "Sec-Fetch-Dest", "script")
+
+	// a browser fetches the subresources of the pages it navigates to
+	for i := 0; i < 10; i++ {
+		if _, flagged := g.Observe(ip, navigate, now); flagged {
+			t.Fatalf("expected a browser not to be flagged, flagged after %d navigations", i+1)
+		}
+		g.Observe(ip, script, now)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, flagged := g.Observe(other, navigate, now); flagged {
+			t.Fatalf("flagged after %d navigations, expected 4", i)
+		}
+	}
+	reason, flagged := g.Observe(other, navigate, now)
+	if !flagged || reason != "fetch metadata: 4 navigations without subresources" {
+		t.Errorf("expected the IP to be flagged after 4 bare navigations, got %v %q", flagged, reason)
+	}
+	if _, flagged := g.Observe(other, script, now); !flagged {
+		t.Error("expected the IP to stay flagged for the window")
+	}
+	if _, flagged := g.Observe(other, script, now.Add(2*time.Minute)); flagged {
+		t.Error("expected the flag to expire with the window")
+	}
+
+	if _, flagged := g.Observe(net.ParseIP("192.0.2.3"), fetchInput("Sec-Fetch-Site", "elsewhere"), now); !flagged {
+		t.Error("expected an impossible combination to flag the IP")
+	}
+	// the others have been forgotten after the window
+	if g.Clone().Size() != 0 || g.Size() != 1 {
+		t.Errorf("expected the clone to be empty and 1 IP tracked, got %d", g.Size())
+	}
+}
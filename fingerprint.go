@@ -0,0 +1,330 @@
+package botdetect
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fingerprint identifies the client software behind a request by its
+// User-Agent and the order of its request headers, which tells HTTP
+// libraries apart even when they claim to be a browser
+type Fingerprint uint64
+
+// String returns the fingerprint in hex
+func (f Fingerprint) String() string {
+	return fmt.Sprintf("%016x", uint64(f))
+}
+
+// ClientFingerprint returns the fingerprint of the request and false if it
+// has no header order. The User-Agent alone is shared by millions of
+// browsers and doesn't identify any software.
+func ClientFingerprint(in *Input) (Fingerprint, bool) {
+	if strings.Trim(in.HeaderOrder, " ,") == "" {
+		return 0, false
+	}
+	agent := in.Header("User-Agent")
+
+	h := fnv.New64a()
+	h.Write([]byte(agent))
+	for _, name := range strings.Split(in.HeaderOrder, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			h.Write([]byte{'\n'})
+			h.Write([]byte(name))
+		}
+	}
+	return Fingerprint(h.Sum64()), true
+}
+
+// URLPattern returns the shape of a URL: its path with every segment that
+// contains a digit replaced by '*' and the names of its query parameters
+// without their values, sorted, e.g. /product/*?page for
+// /product/1234?page=2. Scrapers walking a catalog hit the same few
+// patterns over and over.
+func URLPattern(rawURL string) string {
+	_, path, query := splitURL(rawURL)
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.ContainsAny(s, "0123456789") {
+			segments[i] = "*"
+		}
+	}
+	pattern := strings.Join(segments, "/")
+
+	query, _, _ = strings.Cut(strings.TrimPrefix(query, "?"), "#")
+	if query == "" {
+		return pattern
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil || len(values) == 0 {
+		return pattern
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return pattern + "?" + strings.Join(names, "&")
+}
+
+// FingerprintOptions configures the FingerprintTracker
+type FingerprintOptions struct {
+	// TTL is how long the fingerprint of an IP and a fingerprint's
+	// association with blacklisted IPs are remembered
+	TTL time.Duration
+
+	// MinBlocked is the number of blacklisted IPs a fingerprint has to be
+	// seen on before it stands for blocked behavior, and MinRatio the
+	// share of them among the IPs seen with it that aren't being judged,
+	// so that the fingerprint of a popular browser never does
+	MinBlocked int
+	MinRatio   float64
+
+	// Matches is the number of requests a new IP has to make with a
+	// fingerprint standing for blocked behavior, all of them to URL
+	// patterns the blacklisted IPs requested, before it is flagged
+	Matches int
+}
+
+// maxFingerprintPatterns limits the URL patterns kept per IP and
+// fingerprint
+const maxFingerprintPatterns = 64
+
+// fingerprintReason starts the reasons of the IPs flagged by a
+// FingerprintTracker
+const fingerprintReason = "fingerprint "
+
+// IsFingerprintReason determines whether the reason is one of an IP flagged
+// by a FingerprintTracker. Such IPs must not be passed to Observe as
+// blacklisted, or the tracker would feed on its own decisions.
+func IsFingerprintReason(reason string) bool {
+	return strings.HasPrefix(reason, fingerprintReason)
+}
+
+// FingerprintTracker detects distributed scrapers that rotate their IPs: it
+// remembers the fingerprints and URL patterns of blacklisted IPs and flags
+// new IPs whose first requests come with such a fingerprint and go to the
+// same URL patterns. IPs flagged by the tracker don't make a fingerprint
+// any worse, so that it can't feed on its own decisions.
+type FingerprintTracker struct {
+	options FingerprintOptions
+
+	ips map[string]*fingerprintIP
+	bad map[Fingerprint]*badFingerprint
+
+	// clean counts the IPs per fingerprint that are neither blacklisted
+	// nor flagged nor still being judged
+	clean      map[Fingerprint]int
+	lastExpire time.Time
+	mutex      sync.Mutex
+}
+
+type fingerprintIP struct {
+	fingerprint Fingerprint
+	patterns    map[string]bool
+	seen        time.Time
+
+	// matches counts the requests matching a bad fingerprint since the
+	// first one; a single request that doesn't match sets established,
+	// and the IP is never flagged after that. clean is set while it
+	// counts in FingerprintTracker.clean.
+	matches     int
+	established bool
+	clean       bool
+	flagged     bool
+	reason      string
+}
+
+type badFingerprint struct {
+	// ips are the blacklisted IPs seen with the fingerprint and when
+	ips      map[string]time.Time
+	patterns map[string]bool
+}
+
+// NewFingerprintTracker creates a FingerprintTracker
+func NewFingerprintTracker(options FingerprintOptions) *FingerprintTracker {
+	return &FingerprintTracker{
+		options:    options,
+		ips:        make(map[string]*fingerprintIP),
+		bad:        make(map[Fingerprint]*badFingerprint),
+		clean:      make(map[Fingerprint]int),
+		lastExpire: time.Now(),
+	}
+}
+
+// Clone returns a FingerprintTracker with the same options that hasn't seen
+// any requests yet
+func (t *FingerprintTracker) Clone() *FingerprintTracker {
+	if t == nil {
+		return nil
+	}
+	return NewFingerprintTracker(t.options)
+}
+
+// Observe records the request by the IP, which is blacklisted or not, and
+// returns whether the IP is flagged and why. Requests without a header
+// order are ignored.
+func (t *FingerprintTracker) Observe(ip net.IP, in *Input, blacklisted bool, now time.Time) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	fingerprint, ok := ClientFingerprint(in)
+	if !ok {
+		return "", false
+	}
+	key := ipKey(ip)
+	pattern := URLPattern(in.URL)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Sub(t.lastExpire) >= t.options.TTL {
+		t.expire(now.Add(-t.options.TTL))
+		t.lastExpire = now
+	}
+
+	fi, ok := t.ips[key]
+	if !ok || fi.fingerprint != fingerprint {
+		// a new IP, or one that switched to other software, which
+		// isn't new anymore
+		if ok {
+			t.setClean(fi, false)
+		}
+		fi = &fingerprintIP{fingerprint: fingerprint, patterns: map[string]bool{}, established: ok}
+		t.ips[key] = fi
+		t.setClean(fi, ok && !blacklisted)
+	}
+	fi.seen = now
+	addPattern(fi.patterns, pattern)
+
+	switch {
+	case fi.flagged:
+		return fi.reason, true
+	case blacklisted:
+		bad, ok := t.bad[fingerprint]
+		if !ok {
+			bad = &badFingerprint{ips: map[string]time.Time{}, patterns: map[string]bool{}}
+			t.bad[fingerprint] = bad
+		}
+		if _, counted := bad.ips[key]; counted {
+			addPattern(bad.patterns, pattern)
+		} else {
+			for p := range fi.patterns {
+				addPattern(bad.patterns, p)
+			}
+		}
+		bad.ips[key] = now
+		fi.established = true
+		t.setClean(fi, false)
+		return "", false
+	case fi.established:
+		// an IP that was blacklisted stays out of the clean ones while
+		// the fingerprint remembers it
+		if bad := t.bad[fingerprint]; bad == nil || bad.ips[key].IsZero() {
+			t.setClean(fi, true)
+		}
+		return "", false
+	}
+
+	bad := t.bad[fingerprint]
+	if !t.isBad(fingerprint, bad) || !bad.patterns[pattern] {
+		fi.established = true
+		t.setClean(fi, true)
+		return "", false
+	}
+
+	fi.matches++
+	if fi.matches < t.options.Matches {
+		return "", false
+	}
+	fi.flagged = true
+	fi.reason = fmt.Sprintf("%s%s of %d blacklisted IPs", fingerprintReason, fingerprint, len(bad.ips))
+	return fi.reason, true
+}
+
+// isBad determines whether the fingerprint stands for blocked behavior: it
+// has been seen on enough blacklisted IPs, and they make up enough of the
+// IPs seen with it. t.mutex must be held.
+func (t *FingerprintTracker) isBad(fingerprint Fingerprint, bad *badFingerprint) bool {
+	if bad == nil || len(bad.ips) < t.options.MinBlocked {
+		return false
+	}
+	blocked := float64(len(bad.ips))
+	return blocked/(blocked+float64(t.clean[fingerprint])) >= t.options.MinRatio
+}
+
+// setClean counts the IP as clean or not. t.mutex must be held.
+func (t *FingerprintTracker) setClean(fi *fingerprintIP, clean bool) {
+	if fi.clean == clean {
+		return
+	}
+	fi.clean = clean
+	if clean {
+		t.clean[fi.fingerprint]++
+	} else if t.clean[fi.fingerprint]--; t.clean[fi.fingerprint] <= 0 {
+		delete(t.clean, fi.fingerprint)
+	}
+}
+
+func addPattern(patterns map[string]bool, pattern string) {
+	if len(patterns) < maxFingerprintPatterns {
+		patterns[pattern] = true
+	}
+}
+
+// expire forgets the IPs not seen since cutoff and the blacklisted IPs of a
+// fingerprint seen before, and the fingerprint once it has none. t.mutex
+// must be held.
+func (t *FingerprintTracker) expire(cutoff time.Time) {
+	for ip, fi := range t.ips {
+		if fi.seen.Before(cutoff) {
+			t.setClean(fi, false)
+			delete(t.ips, ip)
+		}
+	}
+	for fingerprint, bad := range t.bad {
+		for ip, seen := range bad.ips {
+			if seen.Before(cutoff) {
+				delete(bad.ips, ip)
+			}
+		}
+		if len(bad.ips) == 0 {
+			delete(t.bad, fingerprint)
+		}
+	}
+}
+
+// Size returns the number of IPs being tracked
+func (t *FingerprintTracker) Size() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.ips)
+}
+
+// Bad returns the number of fingerprints that stand for blocked behavior
+func (t *FingerprintTracker) Bad() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for fingerprint, bad := range t.bad {
+		if t.isBad(fingerprint, bad) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,150 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func fingerprintInput(agent, order, url string) *Input {
+	return &Input{URL: url, HeaderOrder: order, Headers: map[string]string{"User-Agent": agent}}
+}
+
+func TestURLPattern(t *testing.T) {
+	for url, pattern := range map[string]string{
+		"/product/1234?page=2&sort=asc": "/product/*?page&sort",
+		"/product/ab12cd/reviews":       "/product/*/reviews",
+		"https://example.com/a?":        "/a",
+		"/search?q=x#results":           "/search?q",
+		"/":                             "/",
+	} {
+		if got := URLPattern(url); got != pattern {
+			t.Errorf("%s: expected %s, got %s", url, pattern, got)
+		}
+	}
+}
+
+func TestClientFingerprint(t *testing.T) {
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0"
+	browser, _ := ClientFingerprint(fingerprintInput(chrome, "Host,Connection,User-Agent,Accept", "/"))
+	library, _ := ClientFingerprint(fingerprintInput(chrome, "Host,User-Agent,Accept,Connection", "/"))
+	same, _ := ClientFingerprint(fingerprintInput(chrome, "host, connection, user-agent, accept", "/other"))
+	if browser == library || browser != same {
+		t.Errorf("expected the header order to tell the clients apart, got %s, %s and %s", browser, library, same)
+	}
+	if _, ok := ClientFingerprint(fingerprintInput(chrome, "", "/")); ok {
+		t.Error("expected no fingerprint without a header order")
+	}
+}
+
+func TestFingerprintTracker(t *testing.T) {
+	tracker := NewFingerprintTracker(FingerprintOptions{TTL: time.Hour, MinBlocked: 2, Matches: 3})
+	now := time.Now()
+	scraper := func(url string) *Input {
+		return fingerprintInput("Mozilla/5.0 Chrome/120.0", "Host,User-Agent,Accept", url)
+	}
+	browser := func(url string) *Input {
+		return fingerprintInput("Mozilla/5.0 Chrome/120.0", "Host,Connection,User-Agent,Accept", url)
+	}
+
+	// a user with the same software browses before the scrapers show up
+	user := net.ParseIP("198.51.100.1")
+	tracker.Observe(user, scraper("/"), false, now)
+
+	// two scrapers are blacklisted by the rules
+	for i := 1; i <= 2; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i))
+		for page := 0; page < 5; page++ {
+			tracker.Observe(ip, scraper(fmt.Sprintf("/product/%d", page)), page > 2, now)
+		}
+	}
+	if tracker.Bad() != 1 {
+		t.Fatalf("expected one bad fingerprint, got %d", tracker.Bad())
+	}
+
+	// a new IP of the scraper is flagged on its third product page
+	next := net.ParseIP("192.0.2.3")
+	for page := 10; page < 12; page++ {
+		if _, flagged := tracker.Observe(next, scraper(fmt.Sprintf("/product/%d", page)), false, now); flagged {
+			t.Fatalf("flagged after %d requests, expected 3", page-9)
+		}
+	}
+	reason, flagged := tracker.Observe(next, scraper("/product/12"), false, now)
+	if !flagged || reason != "fingerprint "+mustFingerprint(scraper("/")).String()+" of 2 blacklisted IPs" {
+		t.Errorf("expected the new IP to be flagged, got %v '%s'", flagged, reason)
+	}
+
+	// flagged IPs don't count as blacklisted ones
+	tracker.Observe(next, scraper("/product/13"), true, now)
+	if reason, _ := tracker.Observe(next, scraper("/product/14"), true, now); reason != "fingerprint "+mustFingerprint(scraper("/")).String()+" of 2 blacklisted IPs" {
+		t.Errorf("expected the flagged IP not to count, got '%s'", reason)
+	}
+
+	// neither other software, nor other URL patterns, nor IPs seen before
+	for ip, in := range map[string]*Input{
+		"198.51.100.2": browser("/product/1"),
+		"198.51.100.3": scraper("/cart"),
+		"198.51.100.1": scraper("/product/1"),
+	} {
+		for i := 0; i < 3; i++ {
+			if _, flagged := tracker.Observe(net.ParseIP(ip), in, false, now); flagged {
+				t.Errorf("%s: didn't expect %s to be flagged", ip, in.URL)
+			}
+		}
+	}
+
+	// the fingerprint is forgotten after the TTL
+	tracker.Observe(net.ParseIP("203.0.113.1"), scraper("/product/1"), false, now.Add(2*time.Hour))
+	if tracker.Bad() != 0 || tracker.Size() != 1 {
+		t.Errorf("expected the tracker to forget everything but the last IP, got %d bad fingerprints, %d IPs", tracker.Bad(), tracker.Size())
+	}
+}
+
+func TestFingerprintPopularBrowser(t *testing.T) {
+	tracker := NewFingerprintTracker(FingerprintOptions{TTL: time.Hour, MinBlocked: 3, MinRatio: 0.5, Matches: 3})
+	now := time.Now()
+	chrome := fingerprintInput("Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/130.0.0.0 Safari/537.36", "Host,Connection,User-Agent,Accept", "/")
+
+	// plenty of visitors use the browser, three of them get blacklisted
+	for i := 1; i <= 50; i++ {
+		tracker.Observe(net.IPv4(198, 51, 100, byte(i)), chrome, false, now)
+	}
+	for i := 1; i <= 3; i++ {
+		tracker.Observe(net.IPv4(192, 0, 2, byte(i)), chrome, true, now)
+	}
+	if tracker.Bad() != 0 {
+		t.Fatalf("expected the fingerprint of a popular browser not to be bad, got %d", tracker.Bad())
+	}
+	for i := 0; i < 5; i++ {
+		if _, flagged := tracker.Observe(net.ParseIP("203.0.113.1"), chrome, false, now); flagged {
+			t.Fatal("didn't expect a new visitor with a popular browser to be flagged")
+		}
+	}
+
+	// a fingerprint seen mostly on blacklisted IPs is bad
+	library := fingerprintInput("Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/130.0.0.0 Safari/537.36", "Host,User-Agent,Accept", "/")
+	tracker.Observe(net.ParseIP("198.51.100.200"), library, false, now)
+	for i := 10; i < 13; i++ {
+		tracker.Observe(net.IPv4(192, 0, 2, byte(i)), library, true, now)
+	}
+	if tracker.Bad() != 1 {
+		t.Errorf("expected the fingerprint of 3 of 4 IPs blacklisted to be bad, got %d", tracker.Bad())
+	}
+
+	// requests without a header order are ignored
+	agentOnly := fingerprintInput(chrome.Header("User-Agent"), "", "/")
+	for i := 0; i < 5; i++ {
+		if _, flagged := tracker.Observe(net.ParseIP("203.0.113.2"), agentOnly, true, now); flagged {
+			t.Fatal("didn't expect a request without a header order to be flagged")
+		}
+	}
+	if tracker.Size() != 58 {
+		t.Errorf("expected 58 IPs to be tracked, got %d", tracker.Size())
+	}
+}
+
+func mustFingerprint(in *Input) Fingerprint {
+	f, _ := ClientFingerprint(in)
+	return f
+}
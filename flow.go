@@ -0,0 +1,251 @@
+package botdetect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flow summarizes the packets a source IP sent over a short interval, as
+// exported by eBPF/XDP programs. It is the input of the network-level flow
+// rules, which catch volumetric scrapers and scanners below HTTP.
+type Flow struct {
+	IP net.IP `json:"ip"`
+
+	// Time is the end of the interval, the time the flow is observed if
+	// zero
+	Time time.Time `json:"time,omitempty"`
+
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	// SYNs is the number of TCP connection attempts
+	SYNs uint64 `json:"syns"`
+}
+
+// ParseFlow parses a flow summary in the JSON format of Flow, e.g.
+// {"ip":"192.0.2.1","packets":1200,"bytes":98000,"syns":40}
+func ParseFlow(line string) (Flow, error) {
+	var f Flow
+	if err := json.Unmarshal([]byte(line), &f); err != nil {
+		return f, fmt.Errorf("invalid flow summary: %s", err)
+	}
+	if f.IP == nil {
+		return f, invalidIPErrorf("flow summary without ip")
+	}
+	return f, nil
+}
+
+// ReadFlows reads flow summaries, one per line, until r ends and passes them
+// to fn. Lines that can't be parsed are passed to onError if set and
+// skipped.
+func ReadFlows(r io.Reader, fn func(Flow), onError func(line string, err error)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		f, err := ParseFlow(line)
+		if err != nil {
+			if onError != nil {
+				onError(line, err)
+			}
+			continue
+		}
+		fn(f)
+	}
+	return scanner.Err()
+}
+
+// FlowRule blacklists an IP that sent more than MaxPackets packets, MaxSYNs
+// connection attempts or MaxBytes bytes within Window. Zero limits aren't
+// checked.
+type FlowRule struct {
+	Window     time.Duration
+	MaxPackets uint64
+	MaxSYNs    uint64
+	MaxBytes   uint64
+
+	RuleAction
+}
+
+// String returns the rule in the format understood by ParseFlowRules
+func (r FlowRule) String() string {
+	s := fmt.Sprintf("%s:%d:%d", r.Window, r.MaxPackets, r.MaxSYNs)
+	if r.MaxBytes > 0 {
+		s += ":" + FormatBytes(r.MaxBytes)
+	}
+	return s + r.RuleAction.String()
+}
+
+// match returns why the counts violate the rule, or an empty string if they
+// don't
+func (r FlowRule) match(packets, syns, bytes uint64) string {
+	switch {
+	case r.MaxPackets > 0 && packets > r.MaxPackets:
+		return fmt.Sprintf("flow rule %s matched with %d packets", r, packets)
+	case r.MaxSYNs > 0 && syns > r.MaxSYNs:
+		return fmt.Sprintf("flow rule %s matched with %d SYNs", r, syns)
+	case r.MaxBytes > 0 && bytes > r.MaxBytes:
+		return fmt.Sprintf("flow rule %s matched with %d bytes", r, bytes)
+	}
+	return ""
+}
+
+// ParseFlowRules parses a comma separated list of rules in the form
+// window:max-packets:max-syns[:max-bytes], where 0 disables a limit, e.g.
+// "10s:20000:500,1m:0:2000:100MB;ttl=1h". The options are those of
+// ParseRules.
+func ParseFlowRules(s string) ([]FlowRule, error) {
+	rules := []FlowRule{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		base, action, err := parseRuleAction(def)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Split(base, ":")
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, configErrorf("invalid flow rule '%s': expected window:max-packets:max-syns[:max-bytes]", def)
+		}
+
+		window, err := time.ParseDuration(fields[0])
+		if err != nil || window <= 0 {
+			return nil, configErrorf("invalid window in flow rule '%s'", def)
+		}
+
+		rule := FlowRule{Window: window, RuleAction: action}
+		if rule.MaxPackets, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, configErrorf("invalid max-packets in flow rule '%s'", def)
+		}
+		if rule.MaxSYNs, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return nil, configErrorf("invalid max-syns in flow rule '%s'", def)
+		}
+		if len(fields) == 4 {
+			if rule.MaxBytes, err = ParseBytes(fields[3]); err != nil {
+				return nil, configErrorf("invalid max-bytes in flow rule '%s'", def)
+			}
+		}
+		if rule.MaxPackets == 0 && rule.MaxSYNs == 0 && rule.MaxBytes == 0 {
+			return nil, configErrorf("flow rule '%s' has no limit", def)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// FlowGuard evaluates flow rules on the flow summaries of the IPs. It keeps
+// the summaries of the longest window.
+type FlowGuard struct {
+	rules  []FlowRule
+	window time.Duration
+
+	ips        map[string][]Flow
+	lastExpire time.Time
+	mutex      sync.Mutex
+}
+
+// NewFlowGuard creates a FlowGuard for the rules
+func NewFlowGuard(rules []FlowRule) *FlowGuard {
+	g := &FlowGuard{
+		rules:      rules,
+		ips:        make(map[string][]Flow),
+		lastExpire: time.Now(),
+	}
+	for _, rule := range rules {
+		if rule.Window > g.window {
+			g.window = rule.Window
+		}
+	}
+	return g
+}
+
+// Rules returns the rules of the guard
+func (g *FlowGuard) Rules() []FlowRule {
+	if g == nil {
+		return nil
+	}
+	return g.rules
+}
+
+// Observe records the flow summary and returns the first rule the IP
+// violates with it and why
+func (g *FlowGuard) Observe(f Flow, now time.Time) (FlowRule, string, bool) {
+	if g == nil || f.IP == nil {
+		return FlowRule{}, "", false
+	}
+	if f.Time.IsZero() || f.Time.After(now) {
+		f.Time = now
+	}
+	ipstr := ipKey(f.IP)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if now.Sub(g.lastExpire) >= g.window {
+		g.expire(now.Add(-g.window))
+		g.lastExpire = now
+	}
+
+	flows := append(g.ips[ipstr], f)
+	g.ips[ipstr] = flows
+
+	for _, rule := range g.rules {
+		cutoff := now.Add(-rule.Window)
+		var packets, syns, bytes uint64
+		for _, flow := range flows {
+			if flow.Time.After(cutoff) {
+				packets += flow.Packets
+				syns += flow.SYNs
+				bytes += flow.Bytes
+			}
+		}
+		if why := rule.match(packets, syns, bytes); why != "" {
+			return rule, why, true
+		}
+	}
+	return FlowRule{}, "", false
+}
+
+// expire drops the summaries up to cutoff. g.mutex must be held.
+func (g *FlowGuard) expire(cutoff time.Time) {
+	for ip, flows := range g.ips {
+		kept := flows[:0]
+		for _, flow := range flows {
+			if flow.Time.After(cutoff) {
+				kept = append(kept, flow)
+			}
+		}
+		if len(kept) == 0 {
+			delete(g.ips, ip)
+		} else {
+			g.ips[ip] = kept
+		}
+	}
+}
+
+// Size returns the number of IPs being tracked
+func (g *FlowGuard) Size() int {
+	if g == nil {
+		return 0
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.ips)
+}
@@ -0,0 +1,77 @@
+package botdetect
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFlowRules(t *testing.T) {
+	rules, err := ParseFlowRules("10s:20000:500, 1m:0:2000:100MB;ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].MaxPackets != 20000 || rules[0].MaxSYNs != 500 ||
+		rules[1].MaxBytes != 100e6 || rules[1].TTL != time.Hour {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	if s := rules[1].String(); s != "1m0s:0:2000:100MB;ttl=1h0m0s" {
+		t.Errorf("unexpected string %s", s)
+	}
+
+	for _, def := range []string{"10s:1", "x:1:1", "10s:a:1", "10s:1:1:x", "10s:0:0", "10s:1:1;foo"} {
+		if _, err := ParseFlowRules(def); !errors.Is(err, ErrConfig) {
+			t.Errorf("%s: expected a config error, got %v", def, err)
+		}
+	}
+}
+
+func TestFlowGuard(t *testing.T) {
+	rules, _ := ParseFlowRules("10s:0:100,1m:1000:0")
+	g := NewFlowGuard(rules)
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1")
+
+	if _, _, flagged := g.Observe(Flow{IP: ip, Packets: 600, SYNs: 60}, now); flagged {
+		t.Error("expected a flow within the limits not to be flagged")
+	}
+	rule, why, flagged := g.Observe(Flow{IP: ip, Packets: 100, SYNs: 50}, now.Add(time.Second))
+	if !flagged || rule.Window != 10*time.Second || !strings.Contains(why, "110 SYNs") {
+		t.Errorf("expected the SYN rule to match, got %v %s", flagged, why)
+	}
+
+	// the SYNs have left the short window, the packets not the long one
+	rule, why, flagged = g.Observe(Flow{IP: ip, Packets: 500}, now.Add(20*time.Second))
+	if !flagged || rule.Window != time.Minute || !strings.Contains(why, "1200 packets") {
+		t.Errorf("expected the packet rule to match, got %v %s", flagged, why)
+	}
+
+	g.Observe(Flow{IP: net.ParseIP("192.0.2.2"), Packets: 1}, now.Add(2*time.Minute))
+	if g.Size() != 1 {
+		t.Errorf("expected the first IP to expire, got %d IPs", g.Size())
+	}
+}
+
+func TestReadFlows(t *testing.T) {
+	input := `{"ip":"192.0.2.1","time":"2024-01-01T00:00:00Z","packets":10,"bytes":1500,"syns":2}
+
+{"packets":1}
+not json
+{"ip":"2001:db8::1","packets":3}
+`
+	flows := []Flow{}
+	bad := 0
+	err := ReadFlows(strings.NewReader(input), func(f Flow) { flows = append(flows, f) },
+		func(line string, err error) { bad++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 || bad != 2 {
+		t.Fatalf("expected 2 flows and 2 bad lines, got %+v and %d", flows, bad)
+	}
+	if !flows[0].IP.Equal(net.ParseIP("192.0.2.1")) || flows[0].SYNs != 2 || flows[0].Time.IsZero() || flows[1].Packets != 3 {
+		t.Errorf("unexpected flows %+v", flows)
+	}
+}
@@ -0,0 +1,252 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardedNode is the value of a for or by parameter of a Forwarded header.
+// Either IP is set or Name holds "unknown" or an obfuscated identifier such
+// as "_hidden".
+type ForwardedNode struct {
+	IP   net.IP
+	Name string
+	Port string
+}
+
+// ForwardedElement is one proxy hop of a Forwarded header (RFC 7239)
+type ForwardedElement struct {
+	For   ForwardedNode
+	By    ForwardedNode
+	Host  string
+	Proto string
+}
+
+// ParseForwarded parses the value of a Forwarded header. The elements parsed
+// before a syntax error are returned along with the error.
+func ParseForwarded(value string) ([]ForwardedElement, error) {
+	elements := []ForwardedElement{}
+	p := forwardedParser{s: value}
+
+	for {
+		elem, err := p.element()
+		if err != nil {
+			return elements, err
+		}
+		elements = append(elements, elem)
+
+		p.skipSpace()
+		if p.done() {
+			return elements, nil
+		}
+		if p.s[p.pos] != ',' {
+			return elements, p.errorf("expected ','")
+		}
+		p.pos++
+	}
+}
+
+// ForwardedFor returns the addresses of the for parameters of a Forwarded
+// header in order, skipping unknown and obfuscated nodes. Malformed headers
+// yield the addresses up to the first error.
+func ForwardedFor(value string) []net.IP {
+	elements, _ := ParseForwarded(value)
+	ips := make([]net.IP, 0, len(elements))
+	for _, elem := range elements {
+		if elem.For.IP != nil {
+			ips = append(ips, elem.For.IP)
+		}
+	}
+	return ips
+}
+
+// ParseForwardedNode parses a node such as 192.0.2.43:47011, "[2001:db8::1]",
+// unknown or _hidden
+func ParseForwardedNode(node string) (ForwardedNode, error) {
+	n := ForwardedNode{}
+	host := node
+
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return n, fmt.Errorf("invalid node '%s': missing ']'", node)
+		}
+		host = node[1:end]
+		rest := node[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return n, fmt.Errorf("invalid node '%s'", node)
+			}
+			n.Port = rest[1:]
+		}
+		if n.IP = parseScopedIP(host); n.IP == nil || n.IP.To4() != nil {
+			return n, fmt.Errorf("invalid node '%s': expected an IPv6 address", node)
+		}
+	} else {
+		if i := strings.Index(node, ":"); i >= 0 {
+			host, n.Port = node[:i], node[i+1:]
+		}
+		switch {
+		case host == "unknown", isObfuscated(host):
+			n.Name = host
+		default:
+			if n.IP = net.ParseIP(host).To4(); n.IP == nil {
+				return n, fmt.Errorf("invalid node '%s'", node)
+			}
+		}
+	}
+
+	if n.Port != "" && !isPort(n.Port) && !isObfuscated(n.Port) {
+		return n, fmt.Errorf("invalid port in node '%s'", node)
+	}
+
+	return n, nil
+}
+
+// isObfuscated checks for obfuscated identifiers: "_" 1*(ALPHA / DIGIT / "." / "_" / "-")
+func isObfuscated(s string) bool {
+	if len(s) < 2 || s[0] != '_' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !isAlnum(c) && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isPort(s string) bool {
+	if len(s) == 0 || len(s) > 5 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlnum(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// isTokenChar checks for the characters allowed in an HTTP token (RFC 7230)
+func isTokenChar(c byte) bool {
+	return c < 0x80 && (isAlnum(rune(c)) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0)
+}
+
+type forwardedParser struct {
+	s   string
+	pos int
+}
+
+func (p *forwardedParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *forwardedParser) skipSpace() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *forwardedParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid Forwarded header at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// element parses the pairs of a single element up to the next ',' or the end
+func (p *forwardedParser) element() (ForwardedElement, error) {
+	elem := ForwardedElement{}
+	seen := map[string]bool{}
+
+	for {
+		p.skipSpace()
+		if p.done() || p.s[p.pos] == ',' {
+			return elem, nil
+		}
+		if p.s[p.pos] == ';' {
+			p.pos++
+			continue
+		}
+
+		name := strings.ToLower(p.token())
+		if name == "" {
+			return elem, p.errorf("expected a parameter name")
+		}
+		if p.done() || p.s[p.pos] != '=' {
+			return elem, p.errorf("expected '=' after '%s'", name)
+		}
+		p.pos++
+
+		value, err := p.value()
+		if err != nil {
+			return elem, err
+		}
+
+		if seen[name] {
+			return elem, p.errorf("parameter '%s' given twice in one element", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "for":
+			elem.For, err = ParseForwardedNode(value)
+		case "by":
+			elem.By, err = ParseForwardedNode(value)
+		case "host":
+			elem.Host = value
+		case "proto":
+			elem.Proto = value
+		}
+		if err != nil {
+			return elem, err
+		}
+
+		p.skipSpace()
+		if !p.done() && p.s[p.pos] != ';' && p.s[p.pos] != ',' {
+			return elem, p.errorf("expected ';' or ','")
+		}
+	}
+}
+
+func (p *forwardedParser) token() string {
+	start := p.pos
+	for !p.done() && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// value parses a token or a quoted string
+func (p *forwardedParser) value() (string, error) {
+	if p.done() || p.s[p.pos] != '"' {
+		v := p.token()
+		if v == "" {
+			return "", p.errorf("expected a value")
+		}
+		return v, nil
+	}
+
+	p.pos++
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", p.errorf("unterminated quoted string")
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated quoted string")
+}
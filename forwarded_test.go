@@ -0,0 +1,88 @@
+package botdetect
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	elements, err := ParseForwarded(`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711", for=_hidden;host="example.com, a;b", for=unknown`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 4 {
+		t.Fatalf("expected 4 elements, got %d", len(elements))
+	}
+
+	if !elements[0].For.IP.Equal(net.ParseIP("192.0.2.60")) || elements[0].Proto != "http" || !elements[0].By.IP.Equal(net.ParseIP("203.0.113.43")) {
+		t.Errorf("unexpected first element %+v", elements[0])
+	}
+	if !elements[1].For.IP.Equal(net.ParseIP("2001:db8:cafe::17")) || elements[1].For.Port != "4711" {
+		t.Errorf("unexpected second element %+v", elements[1])
+	}
+	if elements[2].For.Name != "_hidden" || elements[2].Host != "example.com, a;b" {
+		t.Errorf("unexpected third element %+v", elements[2])
+	}
+	if elements[3].For.Name != "unknown" || elements[3].For.IP != nil {
+		t.Errorf("unexpected fourth element %+v", elements[3])
+	}
+}
+
+func TestParseForwardedErrors(t *testing.T) {
+	for _, value := range []string{
+		`for=2001:db8::1`,
+		`for="[2001:db8::1"`,
+		`for=192.0.2.60;for=192.0.2.61`,
+		`for="192.0.2.60`,
+		`for=192.0.2.60:http`,
+		`for=hidden`,
+		`for`,
+		`for=192.0.2.60 proto=http`,
+	} {
+		if _, err := ParseForwarded(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+
+	elements, err := ParseForwarded(`for=192.0.2.60, for=foo`)
+	if err == nil || len(elements) != 1 {
+		t.Errorf("expected one element and an error, got %v, %v", elements, err)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	ips := ForwardedFor(`for=192.0.2.60, for=_hidden, for="[2001:db8::1]:_port", for=192.0.2.61`)
+	expected := []string{"192.0.2.60", "2001:db8::1", "192.0.2.61"}
+	if len(ips) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+	for i, ip := range ips {
+		if !ip.Equal(net.ParseIP(expected[i])) {
+			t.Errorf("expected %s, got %s", expected[i], ip)
+		}
+	}
+}
+
+func FuzzParseForwarded(f *testing.F) {
+	f.Add(`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`)
+	f.Add(`for=_hidden;host="example.com, a;b", for=unknown`)
+	f.Add(`for="\"[::ffff:1.2.3.4]:80\""`)
+	f.Add(`for=;;,,`)
+
+	f.Fuzz(func(t *testing.T, value string) {
+		elements, err := ParseForwarded(value)
+		if err == nil {
+			for _, e := range elements {
+				if e.For.IP != nil && e.For.Name != "" {
+					t.Fatalf("node %+v has both an IP and a name", e.For)
+				}
+			}
+		}
+		for _, ip := range ForwardedFor(value) {
+			if ip == nil {
+				t.Fatal("ForwardedFor returned a nil IP")
+			}
+		}
+		ParseForwardedNode(value)
+	})
+}
@@ -0,0 +1,154 @@
+package botdetect
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// GeoDB maps IP networks to countries and continents. It is read from a CSV
+// file with the columns network (CIDR), country code and continent code.
+type GeoDB struct {
+	table     rangeTable
+	locations []geoLocation
+}
+
+type geoLocation struct {
+	country   string
+	continent string
+}
+
+// LoadGeoDB reads a GeoDB from a CSV file
+func LoadGeoDB(path string) (*GeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	defer f.Close()
+
+	db, err := ReadGeoDB(f)
+	if err != nil {
+		return nil, configErrorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// ReadGeoDB reads a GeoDB in CSV format. Lines starting with '#' are ignored.
+func ReadGeoDB(r io.Reader) (*GeoDB, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	db := &GeoDB{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, configError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 {
+			return nil, configErrorf("line %d: expected network,country[,continent]", line)
+		}
+
+		prefix, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			return nil, configErrorf("line %d: invalid network '%s'", line, record[0])
+		}
+
+		loc := geoLocation{country: strings.ToUpper(record[1])}
+		if len(record) > 2 {
+			loc.continent = strings.ToUpper(record[2])
+		}
+
+		db.table.add(prefix, len(db.locations))
+		db.locations = append(db.locations, loc)
+	}
+	db.table.sort()
+
+	return db, nil
+}
+
+// Lookup returns the country and continent code of the IP
+func (db *GeoDB) Lookup(ip net.IP) (country, continent string, ok bool) {
+	addr, ok := addrFromIP(ip)
+	if !ok {
+		return "", "", false
+	}
+
+	i, ok := db.table.lookup(addr)
+	if !ok {
+		return "", "", false
+	}
+
+	return db.locations[i].country, db.locations[i].continent, true
+}
+
+// GeoPolicy allows or denies IPs based on their country or continent.
+// Denied IPs are always blocked, allowed IPs are never blocked.
+type GeoPolicy struct {
+	db              *GeoDB
+	allowCountries  map[string]bool
+	denyCountries   map[string]bool
+	allowContinents map[string]bool
+	denyContinents  map[string]bool
+}
+
+// NewGeoPolicy creates a GeoPolicy from lists of country and continent codes
+func NewGeoPolicy(db *GeoDB, allowCountries, denyCountries, allowContinents, denyContinents []string) *GeoPolicy {
+	return &GeoPolicy{
+		db:              db,
+		allowCountries:  codeSet(allowCountries),
+		denyCountries:   codeSet(denyCountries),
+		allowContinents: codeSet(allowContinents),
+		denyContinents:  codeSet(denyContinents),
+	}
+}
+
+// IsDenied determines whether the IP lies in a denied country or continent
+func (p *GeoPolicy) IsDenied(ip net.IP) bool {
+	if p == nil || p.db == nil {
+		return false
+	}
+
+	country, continent, ok := p.db.Lookup(ip)
+	return ok && (p.denyCountries[country] || p.denyContinents[continent])
+}
+
+// IsAllowed determines whether the IP lies in an allowed country or continent
+func (p *GeoPolicy) IsAllowed(ip net.IP) bool {
+	if p == nil || p.db == nil {
+		return false
+	}
+
+	country, continent, ok := p.db.Lookup(ip)
+	return ok && (p.allowCountries[country] || p.allowContinents[continent])
+}
+
+// Country returns the country the IP lies in if it is known
+func (p *GeoPolicy) Country(ip net.IP) (string, bool) {
+	if p == nil || p.db == nil {
+		return "", false
+	}
+
+	country, _, ok := p.db.Lookup(ip)
+	return country, ok
+}
+
+func codeSet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			set[code] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,46 @@
+package botdetect
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testGeoDB = `# network,country,continent
+192.0.2.0/24,de,eu
+198.51.100.0/25,US,NA
+2001:db8::/32,JP,AS
+`
+
+func TestGeoDB(t *testing.T) {
+	db, err := ReadGeoDB(strings.NewReader(testGeoDB))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for ip, expected := range map[string]string{
+		"192.0.2.1":        "DE",
+		"192.0.2.255":      "DE",
+		"198.51.100.127":   "US",
+		"198.51.100.128":   "",
+		"2001:db8:1::1":    "JP",
+		"203.0.113.1":      "",
+		"::ffff:192.0.2.7": "DE",
+	} {
+		country, _, _ := db.Lookup(net.ParseIP(ip))
+		if country != expected {
+			t.Errorf("%s: expected country '%s', got '%s'", ip, expected, country)
+		}
+	}
+
+	policy := NewGeoPolicy(db, []string{"us"}, nil, nil, []string{"AS"})
+	if !policy.IsAllowed(net.ParseIP("198.51.100.1")) {
+		t.Errorf("198.51.100.1 should be allowed by country")
+	}
+	if !policy.IsDenied(net.ParseIP("2001:db8::1")) {
+		t.Errorf("2001:db8::1 should be denied by continent")
+	}
+	if policy.IsDenied(net.ParseIP("192.0.2.1")) || policy.IsAllowed(net.ParseIP("192.0.2.1")) {
+		t.Errorf("192.0.2.1 should be neither allowed nor denied")
+	}
+}
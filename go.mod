@@ -1,8 +1,5 @@
 module github.com/elcamino/botdetect
 
-go 1.13
+go 1.18
 
-require (
-	github.com/emirpasic/gods v1.12.0
-	github.com/namsral/flag v1.7.4-pre
-)
+require github.com/namsral/flag v1.7.4-pre
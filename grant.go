@@ -0,0 +1,158 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Grant temporarily raises the limits for the IPs of a network, e.g. for a
+// partner integration or a load test. The thresholds of the request and
+// bandwidth rules are multiplied by Factor until Until.
+type Grant struct {
+	Network string    `json:"network"`
+	Factor  float64   `json:"factor"`
+	Until   time.Time `json:"until"`
+	Comment string    `json:"comment,omitempty"`
+
+	network *net.IPNet
+}
+
+// String describes the grant
+func (g Grant) String() string {
+	return fmt.Sprintf("%s x%s until %s", g.Network, strconv.FormatFloat(g.Factor, 'f', -1, 64), g.Until.Format(time.RFC3339))
+}
+
+// Grant multiplies the thresholds of the rules by factor for the IPs of the
+// network, a single IP or a network in CIDR notation, for the given duration.
+// A grant for the same network replaces the earlier one. It is recorded in
+// the audit trail with the comment. The network is an error of the kind
+// ErrInvalidIP if it can't be parsed, the factor and duration are errors of
+// the kind ErrConfig unless they are greater than 1 and 0.
+func (h *IPHistory) Grant(network string, factor float64, duration time.Duration, comment string) (Grant, error) {
+	n, err := parseNetwork(network)
+	if err != nil {
+		return Grant{}, err
+	}
+	if factor <= 1 {
+		return Grant{}, configErrorf("invalid grant factor %g: expected more than 1", factor)
+	}
+	if duration <= 0 {
+		return Grant{}, configErrorf("invalid grant duration %s: expected more than 0", duration)
+	}
+
+	g := Grant{
+		Network: n.String(),
+		Factor:  factor,
+		Until:   time.Now().Add(duration),
+		Comment: comment,
+		network: n,
+	}
+
+	h.grantMutex.Lock()
+	h.grants[g.Network] = g
+	h.grantMutex.Unlock()
+
+	h.opts().Audit.Record(n.IP, AuditEntry{
+		Decision: "grant",
+		Reason:   grantReason(g),
+	})
+	return g, nil
+}
+
+// Revoke removes the grant for the network before it runs out and returns
+// whether there was one
+func (h *IPHistory) Revoke(network string, comment string) bool {
+	n, err := parseNetwork(network)
+	if err != nil {
+		return false
+	}
+
+	h.grantMutex.Lock()
+	g, ok := h.grants[n.String()]
+	delete(h.grants, n.String())
+	h.grantMutex.Unlock()
+
+	if ok {
+		h.opts().Audit.Record(n.IP, AuditEntry{
+			Decision: "revoke",
+			Reason:   grantReason(Grant{Network: g.Network, Factor: g.Factor, Until: g.Until, Comment: comment}),
+		})
+	}
+	return ok
+}
+
+// Grants returns the grants that haven't run out, ordered by network
+func (h *IPHistory) Grants() []Grant {
+	now := time.Now()
+
+	h.grantMutex.RLock()
+	grants := make([]Grant, 0, len(h.grants))
+	for _, g := range h.grants {
+		if g.Until.After(now) {
+			grants = append(grants, g)
+		}
+	}
+	h.grantMutex.RUnlock()
+
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Network < grants[j].Network })
+	return grants
+}
+
+// grantFor returns the grant with the largest factor that covers the IP
+func (h *IPHistory) grantFor(ip net.IP, now time.Time) (Grant, bool) {
+	h.grantMutex.RLock()
+	defer h.grantMutex.RUnlock()
+
+	var best Grant
+	found := false
+	for _, g := range h.grants {
+		if g.Until.After(now) && g.network.Contains(ip) && (!found || g.Factor > best.Factor) {
+			best, found = g, true
+		}
+	}
+	return best, found
+}
+
+// restoreGrant adds a grant read from a saved state unless it has run out
+func (h *IPHistory) restoreGrant(g Grant, now time.Time) {
+	n, err := parseNetwork(g.Network)
+	if err != nil || g.Factor <= 1 || !g.Until.After(now) {
+		return
+	}
+	g.Network, g.network = n.String(), n
+
+	h.grantMutex.Lock()
+	if existing, ok := h.grants[g.Network]; !ok || existing.Until.Before(g.Until) {
+		h.grants[g.Network] = g
+	}
+	h.grantMutex.Unlock()
+}
+
+// expireGrants removes all grants that have run out
+func (h *IPHistory) expireGrants(now time.Time) {
+	h.grantMutex.Lock()
+	defer h.grantMutex.Unlock()
+
+	for network, g := range h.grants {
+		if !g.Until.After(now) {
+			delete(h.grants, network)
+		}
+	}
+}
+
+func grantReason(g Grant) string {
+	if g.Comment == "" {
+		return g.String()
+	}
+	return g.String() + ": " + g.Comment
+}
+
+// scaleRule multiplies the thresholds of the rule by factor
+func scaleRule(rule Rule, factor float64) Rule {
+	rule.MaxRequests = uint64(float64(rule.MaxRequests) * factor)
+	rule.WarnRequests = uint64(float64(rule.WarnRequests) * factor)
+	return rule
+}
@@ -0,0 +1,113 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrant(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     5,
+		MaxRatio:        0.5,
+		Audit:           NewAuditLog(10, 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Grant("192.0.2.0/33", 10, time.Hour, ""); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("expected an invalid IP error, got %v", err)
+	}
+	for _, factor := range []float64{0, 1} {
+		if _, err := h.Grant("192.0.2.0/24", factor, time.Hour, ""); !errors.Is(err, ErrConfig) {
+			t.Errorf("%g: expected a configuration error, got %v", factor, err)
+		}
+	}
+	if _, err := h.Grant("192.0.2.0/24", 10, 0, ""); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for the duration, got %v", err)
+	}
+
+	g, err := h.Grant("192.0.2.1/24", 10, 2*time.Hour, "load test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Network != "192.0.2.0/24" || g.Factor != 10 {
+		t.Errorf("unexpected grant %+v", g)
+	}
+	if entries := h.opts().Audit.Entries(net.ParseIP("192.0.2.0")); len(entries) != 1 || entries[0].Decision != "grant" || !strings.HasSuffix(entries[0].Reason, ": load test") {
+		t.Errorf("expected the grant in the audit trail, got %v", entries)
+	}
+
+	granted, other := net.ParseIP("192.0.2.10"), net.ParseIP("198.51.100.1")
+	for i := 0; i < 20; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: granted}
+		h.RequestChannel() <- &Request{URL: "/", IP: other}
+	}
+	for h.Processed() < 40 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if h.IsBlacklisted(granted) {
+		t.Error("expected the granted IP to stay below its raised limit")
+	}
+	if !h.IsBlacklisted(other) {
+		t.Error("expected other IPs to keep the normal limit")
+	}
+
+	// the grant survives a restart
+	var buf bytes.Buffer
+	if err := h.WriteState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewIPHistory(ctx, h.opts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ReadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if grants := restored.Grants(); len(grants) != 1 || grants[0].Network != "192.0.2.0/24" || !grants[0].Until.Equal(g.Until) {
+		t.Errorf("expected the grant to be restored, got %v", grants)
+	}
+	if _, ok := restored.grantFor(granted, time.Now()); !ok {
+		t.Error("expected the restored grant to cover the IP")
+	}
+
+	if !h.Revoke("192.0.2.0/24", "done") || h.Revoke("192.0.2.0/24", "") {
+		t.Error("expected the grant to be revoked once")
+	}
+	if len(h.Grants()) != 0 {
+		t.Errorf("expected no grants, got %v", h.Grants())
+	}
+
+	// requests beyond the normal limit are blacklisted without the grant
+	h.RequestChannel() <- &Request{URL: "/", IP: granted}
+	for h.Processed() < 41 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+	if !h.IsBlacklisted(granted) {
+		t.Error("expected the IP to be blacklisted after the grant was revoked")
+	}
+
+	h.grants["198.51.100.0/24"] = Grant{Network: "198.51.100.0/24", Factor: 2, Until: time.Now().Add(-time.Second)}
+	h.expireGrants(time.Now())
+	if len(h.grants) != 0 {
+		t.Errorf("expected the grant to expire, got %v", h.grants)
+	}
+}
@@ -0,0 +1,259 @@
+package botdetect
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GreylistOptions put IPs exceeding the warn tier of a rule on a greylist.
+// A greylisted IP that keeps exceeding a warn tier in Promote more
+// evaluations is blacklisted, one that exceeds none for Demote is taken off
+// the greylist again, and every IP leaves the greylist after TTL at the
+// latest.
+type GreylistOptions struct {
+	// TTL is the longest an IP stays on the greylist
+	TTL time.Duration
+
+	// Promote is the number of evaluations after the one that greylisted
+	// an IP in which it has to exceed a warn tier to be blacklisted
+	Promote int
+
+	// Demote is how long a greylisted IP has to stay below the warn tiers
+	// to be taken off the greylist
+	Demote time.Duration
+}
+
+func (o *GreylistOptions) validate() []string {
+	problems := []string{}
+	if o.TTL <= 0 {
+		problems = append(problems, "greylist ttl must be greater than zero")
+	}
+	if o.Promote < 1 {
+		problems = append(problems, "greylist promote must be at least 1")
+	}
+	if o.Demote <= 0 {
+		problems = append(problems, "greylist demote must be greater than zero")
+	}
+	return problems
+}
+
+// Greylist transitions as counted in botdetect_greylist_transitions_total
+const (
+	GreylistAdded       = "greylisted"
+	GreylistPromoted    = "promoted"
+	GreylistDemoted     = "demoted"
+	GreylistExpired     = "expired"
+	GreylistBlacklisted = "blacklisted"
+)
+
+// GreylistEntry describes a greylisted IP
+type GreylistEntry struct {
+	IP      net.IP    `json:"ip"`
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"`
+
+	// LastAbuse is the last time the IP exceeded a warn tier, Strikes the
+	// number of evaluations it did so since it has been greylisted
+	LastAbuse time.Time `json:"last_abuse"`
+	Strikes   int       `json:"strikes"`
+
+	// Reason is why the IP has been greylisted
+	Reason string `json:"reason"`
+}
+
+// Greylist holds the IPs that behave suspiciously without having been
+// blacklisted. It is kept apart from the blacklist, so greylisted IPs aren't
+// blocked. All methods are safe for concurrent use.
+type Greylist struct {
+	data  map[netip.Addr]GreylistEntry
+	mutex sync.RWMutex
+}
+
+// NewGreylist creates an empty greylist
+func NewGreylist() *Greylist {
+	return &Greylist{data: make(map[netip.Addr]GreylistEntry)}
+}
+
+// Entry returns the entry of the IP and whether it is greylisted
+func (g *Greylist) Entry(ip net.IP) (GreylistEntry, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return GreylistEntry{}, false
+	}
+
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	e, ok := g.data[addr]
+	return e, ok
+}
+
+// IsGreylisted determines whether the IP is on the greylist
+func (g *Greylist) IsGreylisted(ip net.IP) bool {
+	_, ok := g.Entry(ip)
+	return ok
+}
+
+// Remove takes the IP off the greylist and returns whether it was on it
+func (g *Greylist) Remove(ip net.IP) bool {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return false
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	_, ok = g.data[addr]
+	delete(g.data, addr)
+	return ok
+}
+
+// Size returns the number of greylisted IPs
+func (g *Greylist) Size() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.data)
+}
+
+// Entries returns all greylisted IPs sorted by IP
+func (g *Greylist) Entries() []GreylistEntry {
+	g.mutex.RLock()
+	entries := make([]GreylistEntry, 0, len(g.data))
+	for _, e := range g.data {
+		entries = append(entries, e)
+	}
+	g.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].IP.To16(), entries[j].IP.To16()) < 0 })
+	return entries
+}
+
+// abuse records that the IP exceeded a warn tier, greylisting it if it isn't
+// yet, and returns its entry and whether it has just been greylisted
+func (g *Greylist) abuse(ip net.IP, reason string, now time.Time, ttl time.Duration) (GreylistEntry, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return GreylistEntry{}, false
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	e, exists := g.data[addr]
+	if !exists {
+		e = GreylistEntry{IP: ip, Added: now, Expires: now.Add(ttl), Reason: reason}
+	} else {
+		e.Strikes++
+	}
+	e.LastAbuse = now
+	g.data[addr] = e
+	return e, !exists
+}
+
+// restore puts an entry of a saved state back on the greylist unless it has
+// expired
+func (g *Greylist) restore(e GreylistEntry, now time.Time) {
+	addr, ok := CanonicalAddr(e.IP)
+	if !ok || !now.Before(e.Expires) {
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.data[addr] = e
+}
+
+// sweep takes the IPs off the greylist that stayed below the warn tiers for
+// demote or whose TTL is over, and returns them by transition
+func (g *Greylist) sweep(now time.Time, demote time.Duration) map[string][]GreylistEntry {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	removed := make(map[string][]GreylistEntry)
+	for addr, e := range g.data {
+		switch {
+		case now.Sub(e.LastAbuse) >= demote:
+			removed[GreylistDemoted] = append(removed[GreylistDemoted], e)
+		case !now.Before(e.Expires):
+			removed[GreylistExpired] = append(removed[GreylistExpired], e)
+		default:
+			continue
+		}
+		delete(g.data, addr)
+	}
+	return removed
+}
+
+// Greylist returns the greylist maintained by the history, which stays
+// empty unless the greylist options are set
+func (h *IPHistory) Greylist() *Greylist {
+	return h.greylist
+}
+
+// greylistAbuse greylists an IP that exceeded the warn tier of a rule, or
+// blacklists it if it has been greylisted and keeps doing so. h.mutex must be
+// held.
+func (h *IPHistory) greylistAbuse(ip string, rule Rule, total, app uint64, now time.Time) {
+	o := h.opts().Greylist
+	if o == nil {
+		return
+	}
+
+	parsed := net.ParseIP(ip)
+	e, added := h.greylist.abuse(parsed, fmt.Sprintf("rule %s warn tier exceeded with %d requests, %d app", rule, total, app), now, o.TTL)
+	if added {
+		h.greylistTransitions.Inc(GreylistAdded)
+		h.opts().Audit.Record(parsed, AuditEntry{Decision: "greylisted", Reason: e.Reason})
+		return
+	}
+	if e.Strikes < o.Promote {
+		return
+	}
+
+	// IPs that can't be blacklisted yet, e.g. during the grace period, stay
+	// on the greylist
+	detail := fmt.Sprintf("greylisted for %s and exceeded a warn tier in %d more evaluations, last rule %s with %d requests, %d app",
+		now.Sub(e.Added).Round(time.Second), e.Strikes, rule, total, app)
+	reoffender := h.reoffender(ip, now)
+	if h.blockRule(parsed, "greylist", detail, RuleAction{}, nil) {
+		h.greylist.Remove(parsed)
+		h.greylistTransitions.Inc(GreylistPromoted)
+		h.countMatch("greylist", nil, reoffender)
+	}
+}
+
+// greylistBlacklisted takes an IP off the greylist that another rule
+// blacklisted
+func (h *IPHistory) greylistBlacklisted(ip net.IP) {
+	if h.opts().Greylist == nil {
+		return
+	}
+	if h.greylist.Remove(ip) {
+		h.greylistTransitions.Inc(GreylistBlacklisted)
+	}
+}
+
+// sweepGreylist demotes and expires greylisted IPs
+func (h *IPHistory) sweepGreylist(now time.Time) {
+	o := h.opts().Greylist
+	if o == nil {
+		return
+	}
+
+	for transition, entries := range h.greylist.sweep(now, o.Demote) {
+		h.greylistTransitions.Add(uint64(len(entries)), transition)
+		for _, e := range entries {
+			reason := fmt.Sprintf("no warn tier exceeded since %s", e.LastAbuse.Format(time.RFC3339))
+			if transition == GreylistExpired {
+				reason = fmt.Sprintf("greylisted since %s", e.Added.Format(time.RFC3339))
+			}
+			h.opts().Audit.Record(e.IP, AuditEntry{Decision: "greylist " + transition, Reason: reason})
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     10,
+		WarnRequests:    5,
+		Metrics:         NewMetrics(),
+		Greylist:        &GreylistOptions{TTL: time.Hour, Promote: 2, Demote: 10 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed := uint64(0)
+	send := func(ip net.IP, n int) {
+		for i := 0; i < n; i++ {
+			h.RequestChannel() <- &Request{IP: ip, URL: "/"}
+		}
+		processed += uint64(n)
+		for h.Processed() < processed {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	abuser, sleeper, scraper := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)
+	send(abuser, 6)
+	send(sleeper, 6)
+	send(scraper, 6)
+	h.TriggerCalculate()
+	if h.Greylist().Size() != 3 || h.IsBlacklisted(abuser) {
+		t.Fatalf("expected 3 IPs to be greylisted but not blacklisted, got %v", h.Greylist().Entries())
+	}
+
+	// the abuser keeps exceeding the warn tier and is promoted after two
+	// more evaluations, the scraper exceeds the rule itself
+	send(abuser, 1)
+	send(scraper, 5)
+	h.TriggerCalculate()
+	if e, _ := h.Greylist().Entry(abuser); e.Strikes != 1 {
+		t.Errorf("expected the abuser to have one strike, got %+v", e)
+	}
+	if h.Greylist().IsGreylisted(scraper) || !h.IsBlacklisted(scraper) {
+		t.Error("expected the scraper to be blacklisted by the rule and taken off the greylist")
+	}
+	send(abuser, 1)
+	h.TriggerCalculate()
+	if h.Greylist().IsGreylisted(abuser) || !h.IsBlacklisted(abuser) {
+		t.Error("expected the abuser to be promoted to the blacklist")
+	}
+	if reason, _ := h.Blacklist().Reason(abuser); reason != "greylist" {
+		t.Errorf("expected the abuser to be blacklisted for the greylist, got %s", reason)
+	}
+
+	// the sleeper stays quiet and is demoted
+	h.calculateAt(time.Now().Add(9 * time.Minute))
+	if !h.Greylist().IsGreylisted(sleeper) {
+		t.Error("expected the sleeper to stay greylisted before it is demoted")
+	}
+	h.calculateAt(time.Now().Add(10 * time.Minute))
+	if h.Greylist().IsGreylisted(sleeper) || h.IsBlacklisted(sleeper) {
+		t.Error("expected the sleeper to be demoted")
+	}
+
+	transitions := h.greylistTransitions.Values()
+	for transition, n := range map[string]uint64{
+		GreylistAdded:       3,
+		GreylistPromoted:    1,
+		GreylistBlacklisted: 1,
+		GreylistDemoted:     1,
+	} {
+		if transitions[transition] != n {
+			t.Errorf("expected %d %s transitions, got %v", n, transition, transitions)
+		}
+	}
+}
+
+func TestGreylistExpiry(t *testing.T) {
+	g := NewGreylist()
+	ip := net.IPv4(192, 0, 2, 1)
+	now := time.Now()
+	g.abuse(ip, "rule", now, time.Hour)
+	for i := 1; i <= 6; i++ {
+		g.abuse(ip, "rule", now.Add(time.Duration(i)*10*time.Minute), time.Hour)
+	}
+
+	removed := g.sweep(now.Add(time.Hour), 30*time.Minute)
+	if len(removed[GreylistExpired]) != 1 || g.Size() != 0 {
+		t.Errorf("expected the IP to expire despite its strikes, got %v", removed)
+	}
+}
+
+func TestGreylistOptions(t *testing.T) {
+	for _, o := range []GreylistOptions{
+		{Promote: 1, Demote: time.Minute},
+		{TTL: time.Hour, Demote: time.Minute},
+		{TTL: time.Hour, Promote: 1},
+	} {
+		if problems := o.validate(); len(problems) == 0 {
+			t.Errorf("expected %+v to be invalid", o)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package botdetect
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat records when a background goroutine last made progress
+type heartbeat struct {
+	last int64
+}
+
+func (hb *heartbeat) beat() {
+	atomic.StoreInt64(&hb.last, time.Now().UnixNano())
+}
+
+func (hb *heartbeat) clear() {
+	atomic.StoreInt64(&hb.last, 0)
+}
+
+// since returns how long ago the last beat was, or zero if there was none
+func (hb *heartbeat) since() time.Duration {
+	last := atomic.LoadInt64(&hb.last)
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// stallFactor is how many intervals a loop may miss before it counts as
+// stuck, unless the watchdog is configured otherwise
+const stallFactor = 3
+
+// Alive returns an error if one of the background goroutines of the history
+// has stopped making progress
+func (h *IPHistory) Alive() error {
+	if err := h.ctx.Err(); err != nil {
+		return fmt.Errorf("history has been shut down: %s", err)
+	}
+
+	if age := h.calculateBeat.since(); age > h.stallLimit(h.opts().Interval) {
+		return fmt.Errorf("calculate loop has not run for %s", age.Round(time.Second))
+	}
+	if age := h.expireBeat.since(); age > h.stallLimit(h.opts().ExpireInterval) {
+		return fmt.Errorf("expire loop has not run for %s", age.Round(time.Second))
+	}
+
+	return nil
+}
+
+// Ready returns an error if the history is not able to take requests,
+// either because it isn't alive, because ingest has stalled or because it is
+// shedding load
+func (h *IPHistory) Ready() error {
+	if err := h.Alive(); err != nil {
+		return err
+	}
+
+	if age := h.processBeat.since(); age > h.stallLimit(h.opts().Interval) {
+		return fmt.Errorf("ingest has been stuck on a request for %s", age.Round(time.Second))
+	}
+
+	if shedding, reason := h.Shedding(); shedding {
+		return fmt.Errorf("shedding load: %s", reason)
+	}
+
+	return nil
+}
@@ -21,8 +21,12 @@ package botdetect
 import (
 	"container/list"
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,26 +34,114 @@ import (
 // IPHistory counts requests per IP for a given time window
 type IPHistory struct {
 	options          *IPHistoryOptions
+	optionsMutex     sync.RWMutex
 	data             map[string]*list.List
 	blacklist        *Blacklist
 	reqChan          chan *Request
 	ctx              context.Context
 	mutex            sync.RWMutex
 	tsmutex          sync.RWMutex
-	blmutex          sync.RWMutex
 	currentSlot      time.Time
 	currentTimestamp string
-	assetRegexp      *regexp.Regexp
-	updatedIPs       map[string]bool
-	updatedIPsMutex  sync.RWMutex
+
+	// calculateTrigger and expireTrigger request runs of the loops outside
+	// their schedule, see TriggerCalculate and TriggerExpire
+	calculateTrigger chan chan struct{}
+	expireTrigger    chan chan struct{}
+
+	// updatedIPs are the IPs with requests since the last calculation,
+	// guarded by mutex so that calculate sees their counts
+	updatedIPs map[string]bool
+
+	// heartbeats of the background goroutines, see Alive and Ready
+	calculateBeat heartbeat
+	expireBeat    heartbeat
+	processBeat   heartbeat
+	watchdog      watchdogState
+
+	// started is when the history was created, the start of the grace
+	// period
+	started time.Time
+
+	// frozenUntil is when the freeze ends, see Freeze. It is guarded by
+	// mutex.
+	frozenUntil time.Time
+
+	// tunedMaxRequests and tunedMaxRatio, the bits of a float64, are only
+	// written by calculate, lastTune only read and written there
+	tunedMaxRequests uint64
+	tunedMaxRatio    uint64
+	lastTune         time.Time
+
+	// baselines are guarded by mutex
+	baselines map[string]*baseline
+
+	ingest ingestStats
+	shed   shedState
+
+	// warned remembers until when warnings and grace period matches for an
+	// IP are suppressed, guarded by mutex
+	warned map[string]time.Time
+
+	// penalized are the IPs blacklisted since the last calculation whose
+	// reputation has to be lowered, guarded by mutex
+	penalized map[string]bool
+
+	// walkers are the IPs detected walking since the last calculation and
+	// the description of their walk, guarded by mutex
+	walkers map[string]string
+
+	// verified are the IPs that made requests verified by a challenge
+	// cookie and when they made the last one, guarded by mutex
+	verified map[string]time.Time
+
+	// runaway is guarded by mutex
+	runaway runawayState
+
+	greylist            *Greylist
+	greylistTransitions *CounterVec
+
+	// dryRun receives the IPs to blacklist instead of the blacklist if set
+	dryRun *DryRun
+
+	ruleMatches       *CounterVec
+	ruleOverlap       *CounterVec
+	reoffenders       *CounterVec
+	ruleWarnings      *CounterVec
+	graceMatches      *CounterVec
+	frozenMatches     *CounterVec
+	canarySkipped     *CounterVec
+	reputationChanges *CounterVec
+	falsePositives    *CounterVec
+	anomalies         *CounterVec
+	ingestWarnings    *CounterVec
+	shedRequests      *CounterVec
+	uncounted         *CounterVec
+	handed            *CounterVec
+	loopStalls        *CounterVec
+	loopRestarts      *CounterVec
+	rulesDisabled     *CounterVec
+	disabledSkipped   *CounterVec
+
+	// exempt holds IPs that must not be blacklisted until their exemption
+	// expires
+	exempt      map[string]Exemption
+	exemptMutex sync.RWMutex
+
+	// grants raise the limits for networks, keyed by network
+	grants     map[string]Grant
+	grantMutex sync.RWMutex
 }
 
 // IPHistoryItem contains the request count for a given period of time denoted by Timestamp
 type IPHistoryItem struct {
-	Timestamp time.Time
-	Count     uint64
-	App       uint64
-	Other     uint64
+	Timestamp time.Time `json:"timestamp"`
+	Count     uint64    `json:"count"`
+	App       uint64    `json:"app"`
+	Other     uint64    `json:"other"`
+	Bytes     uint64    `json:"bytes,omitempty"`
+	Hits      uint64    `json:"hits,omitempty"`
+	Misses    uint64    `json:"misses,omitempty"`
 }
 
 // IPHistoryOptions configures the behaviour of History
@@ -62,36 +154,417 @@ type IPHistoryOptions struct {
 	BlacklistTTL    time.Duration
 	MaxRequests     uint64
 	MaxRatio        float64
+
+	// BlacklistMaxSize limits the number of blacklisted IPs, evicting the
+	// ones expiring first. 0 means no limit.
+	BlacklistMaxSize int
+
+	// WarnRequests and WarnRatio are the warn tier of the rule defined by
+	// Window, MaxRequests and MaxRatio, see Rule
+	WarnRequests uint64
+	WarnRatio    float64
+
+	// OnWarn is called when an IP exceeds the warn tier of a rule but not
+	// the rule itself. It is called at most once per rule window and IP.
+	OnWarn func(ip net.IP, rule Rule, total, app uint64)
+
+	// Leader restricts the rule evaluation to the elected instance. Every
+	// instance evaluates the rules if it is nil.
+	Leader LeaderElector
+
+	// Rules are evaluated in addition to the rule defined by Window,
+	// MaxRequests and MaxRatio. All rules share the same slot data.
+	Rules []Rule
+
+	// Audit records why IPs have been blacklisted if set
+	Audit *AuditLog
+
+	// Metrics receives the history's metrics if set
+	Metrics *Metrics
+
+	// AutoTune adjusts MaxRequests and MaxRatio to the observed traffic if
+	// set
+	AutoTune *AutoTuneOptions
+
+	// Anomaly enables the detection of deviations from per-IP baselines
+	Anomaly *AnomalyOptions
+
+	// GracePeriod is the time after the history has been created during
+	// which rules and anomalies don't blacklist IPs. Matches are only
+	// recorded in the audit trail, so that a restart with an empty history
+	// doesn't block users right away.
+	GracePeriod time.Duration
+
+	// Canary is the percentage of IPs that are blacklisted when they match,
+	// chosen by a hash of the IP so that the same IPs stay in the canary.
+	// The others are only recorded as would-block in the audit trail, so that
+	// new rules can be rolled out gradually. 0 blacklists all IPs.
+	Canary float64
+
+	// Schedules replace the rule defined by Window, MaxRequests and MaxRatio
+	// and Rules while their schedule matches; the first matching one wins
+	Schedules []ScheduledRules
+
+	// BandwidthRules limit the bytes sent to an IP, see Request.Bytes
+	BandwidthRules []BandwidthRule
+
+	// CacheRules limit the share of requests of an IP that miss the cache,
+	// see Request.CacheStatus
+	CacheRules []CacheRule
+
+	// DatacenterRules are additionally evaluated for IPs in Datacenters
+	Datacenters     *DatacenterList
+	DatacenterRules []Rule
+
+	// CompactAge and CompactSlot control the coarsening of old slots: slots
+	// older than CompactAge are merged into slots of CompactSlot length.
+	// Compaction is disabled if either is zero.
+	CompactAge  time.Duration
+	CompactSlot time.Duration
+
+	// QueueSize is the capacity of the request channel, 0 makes it
+	// unbuffered
+	QueueSize int
+
+	// Backpressure warns about the ingest falling behind if set
+	Backpressure *BackpressureOptions
+
+	// Shedding degrades the history gracefully under overload if set
+	Shedding *SheddingOptions
+
+	// Watchdog checks that the background loops keep making progress if
+	// set
+	Watchdog *WatchdogOptions
+
+	// Runaway disables rules that blacklist too many of the client IPs if
+	// set
+	Runaway *RunawayOptions
+
+	// Greylist puts IPs exceeding a warn tier on a greylist, from which
+	// they are blacklisted if they keep doing so, if set
+	Greylist *GreylistOptions
+
+	// PTR adjusts the rules by the host names of IPs nearing a rule if set
+	PTR *PTROptions
+
+	// Ownership annotates blacklisted IPs with the owner of their network
+	// if set
+	Ownership *OwnershipAnnotator
+
+	// Walks blacklists IPs walking through numbered pages or IDs if set
+	Walks *WalkDetector
+
+	// Concurrency blacklists IPs holding many connections open for long if
+	// set, see Request.Connections
+	Concurrency *ConcurrencyDetector
+
+	// Replication evaluates the rules on the requests of all replicas if
+	// set. It can't be combined with compaction.
+	Replication *ReplicationOptions
+
+	// Reputation adjusts the thresholds for IPs by how they behaved in the
+	// past, beyond the windows of the rules, if set
+	Reputation *ReputationOptions
+
+	// AssetTypes are the media types of responses counted as assets rather
+	// than app requests, DefaultAssetTypes if empty. Requests without a
+	// content type (empty or "-") are classified by their URL.
+	AssetTypes []string
+
+	// AssetURLs matches the URLs of assets among the requests without a
+	// content type, DefaultAssetURLs if nil
+	AssetURLs *regexp.Regexp
+
+	// Uncounted are the paths of requests that are never counted, e.g.
+	// health checks, beacons and well-known paths, which would skew the
+	// app/asset ratio. A trailing '*' matches every path with the prefix.
+	Uncounted []string
+
+	// APIPaths are the paths of the XHR/fetch endpoints of single-page
+	// applications. Their requests count as other requests rather than app
+	// requests. A trailing '*' matches every path with the prefix.
+	APIPaths []string
+
+	// FetchMetadata classifies requests with a Sec-Fetch-Dest by it rather
+	// than by their URL or content type: navigations that load a document
+	// count as app requests, XHR/fetch calls and subresources as other
+	// requests
+	FetchMetadata bool
+
+	// UnverifiedFactor scales the thresholds of IPs that made no request
+	// verified by a challenge cookie within the window, see
+	// Request.Verified, so that limits are only tightened for clients that
+	// didn't pass the challenge. Zero disables it.
+	UnverifiedFactor float64
+}
+
+// Validate checks the options for values that would make the history
+// misbehave and returns an error describing every problem found
+func (o *IPHistoryOptions) Validate() error {
+	problems := []string{}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"time slot", o.TimeSlot},
+		{"interval", o.Interval},
+		{"expire interval", o.ExpireInterval},
+		{"blacklist ttl", o.BlacklistTTL},
+	} {
+		if d.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be greater than zero", d.name))
+		}
+	}
+
+	if o.Window < 0 {
+		problems = append(problems, "window must not be negative")
+	}
+	if o.Window == 0 && len(o.Rules) == 0 && len(o.BandwidthRules) == 0 && len(o.CacheRules) == 0 {
+		problems = append(problems, "either a window or at least one rule is required")
+	}
+	if o.Window > 0 && o.Window < o.TimeSlot {
+		problems = append(problems, fmt.Sprintf("window %s is shorter than the time slot %s", o.Window, o.TimeSlot))
+	}
+	for _, rule := range o.BandwidthRules {
+		if rule.Window < o.TimeSlot {
+			problems = append(problems, fmt.Sprintf("bandwidth rule %s: window is shorter than the time slot %s", rule, o.TimeSlot))
+		}
+	}
+	for _, rule := range o.CacheRules {
+		if rule.Window < o.TimeSlot {
+			problems = append(problems, fmt.Sprintf("cache rule %s: window is shorter than the time slot %s", rule, o.TimeSlot))
+		}
+	}
+	for _, rule := range o.extraRules() {
+		if rule.Window < o.TimeSlot {
+			problems = append(problems, fmt.Sprintf("rule %s: window is shorter than the time slot %s", rule, o.TimeSlot))
+		}
+		if rule.WarnRequests > rule.MaxRequests {
+			problems = append(problems, fmt.Sprintf("rule %s: warn-requests exceeds max-requests", rule))
+		}
+	}
+	for _, sr := range o.Schedules {
+		if sr.Schedule == nil || len(sr.Rules) == 0 {
+			problems = append(problems, "scheduled rules need a schedule and at least one rule")
+		}
+	}
+	if o.WarnRequests > o.MaxRequests && o.Window > 0 {
+		problems = append(problems, "warn requests exceed max requests")
+	}
+
+	if o.AutoTune != nil {
+		if o.AutoTune.Percentile <= 0 || o.AutoTune.Percentile > 1 {
+			problems = append(problems, "auto tune percentile must be within (0, 1]")
+		}
+		if o.AutoTune.Factor <= 0 {
+			problems = append(problems, "auto tune factor must be greater than zero")
+		}
+		if o.AutoTune.Block < 0 || o.AutoTune.Block >= 1 {
+			problems = append(problems, "auto tune block must be within [0, 1)")
+		}
+		if o.AutoTune.Interval <= 0 {
+			problems = append(problems, "auto tune interval must be greater than zero")
+		}
+		if o.Window <= 0 {
+			problems = append(problems, "auto tuning requires a window")
+		}
+	}
+
+	if o.Anomaly != nil {
+		if o.Anomaly.Alpha <= 0 || o.Anomaly.Alpha > 1 {
+			problems = append(problems, "anomaly alpha must be within (0, 1]")
+		}
+		if o.Anomaly.Threshold <= 0 {
+			problems = append(problems, "anomaly threshold must be greater than zero")
+		}
+	}
+
+	if o.CompactAge > 0 && o.CompactSlot > 0 && o.CompactSlot < o.TimeSlot {
+		problems = append(problems, fmt.Sprintf("compact slot %s is shorter than the time slot %s", o.CompactSlot, o.TimeSlot))
+	}
+
+	if o.Reputation != nil {
+		problems = append(problems, o.Reputation.validate()...)
+	}
+
+	problems = append(problems, validatePaths("uncounted path", o.Uncounted)...)
+	problems = append(problems, validatePaths("API path", o.APIPaths)...)
+
+	if o.UnverifiedFactor < 0 || o.UnverifiedFactor > 1 {
+		problems = append(problems, "unverified factor must be within [0, 1]")
+	}
+
+	if o.Canary < 0 || o.Canary > 100 {
+		problems = append(problems, "canary must be within [0, 100]")
+	}
+
+	if o.QueueSize < 0 {
+		problems = append(problems, "queue size must not be negative")
+	}
+	if o.PTR != nil {
+		if o.PTR.Cache == nil {
+			problems = append(problems, "PTR options require a cache")
+		}
+		if o.PTR.Near < 0 {
+			problems = append(problems, "PTR near must not be negative")
+		}
+	}
+	if o.Replication != nil {
+		if o.Replication.Store == nil || o.Replication.Replica == "" {
+			problems = append(problems, "replication requires a store and a replica name")
+		}
+		if o.Replication.Timeout <= 0 {
+			problems = append(problems, "replication timeout must be greater than zero")
+		}
+		if o.CompactAge > 0 && o.CompactSlot > 0 {
+			problems = append(problems, "replication can't be combined with compaction")
+		}
+		if _, ok := o.Replication.Store.(HandoffStore); o.Replication.Ring != nil && !ok {
+			problems = append(problems, "a replication ring requires a store that implements HandoffStore")
+		}
+	}
+	if o.BlacklistMaxSize < 0 {
+		problems = append(problems, "blacklist max size must not be negative")
+	}
+	if o.Backpressure != nil {
+		if o.Backpressure.Interval <= 0 {
+			problems = append(problems, "backpressure interval must be greater than zero")
+		}
+		if o.Backpressure.MaxQueue > 0 && o.QueueSize == 0 {
+			problems = append(problems, "a maximum queue fill level requires a queue size")
+		}
+	}
+	if o.Watchdog != nil {
+		problems = append(problems, o.Watchdog.validate()...)
+	}
+	if o.Greylist != nil {
+		problems = append(problems, o.Greylist.validate()...)
+	}
+	if o.Runaway != nil {
+		problems = append(problems, o.Runaway.validate()...)
+	}
+	if o.Shedding != nil {
+		problems = append(problems, o.Shedding.validate(o.QueueSize)...)
+	}
+	for _, t := range o.AssetTypes {
+		if err := checkAssetType(t); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return configError(errors.New(strings.Join(problems, "\n")))
+	}
+	return nil
+}
+
+// extraRules returns all rules besides the one defined by Window,
+// MaxRequests and MaxRatio
+func (o *IPHistoryOptions) extraRules() []Rule {
+	rules := make([]Rule, 0, len(o.Rules)+len(o.DatacenterRules))
+	rules = append(rules, o.Rules...)
+	for _, sr := range o.Schedules {
+		rules = append(rules, sr.Rules...)
+	}
+	return append(rules, o.DatacenterRules...)
 }
 
 // Request contains information the history needs about an HTTP request
 type Request struct {
 	URL string
 	IP  net.IP
+
+	// Time is when the request was made or received. It determines the
+	// slot the request is counted in and the ingest lag; requests without
+	// a time are counted in the slot current when they are processed.
+	Time time.Time
+
+	// Bytes is the size of the response, see BandwidthRules
+	Bytes uint64
+
+	// ContentType is the Content-Type of the response if known. It
+	// decides whether the request was for an asset, see AssetTypes.
+	ContentType string
+
+	// Connections is the number of connections the IP held open when the
+	// request was made as reported by the proxy, 0 if unknown
+	Connections uint64
+
+	// CacheStatus tells whether a CDN or caching proxy answered the
+	// request from its cache, see CacheRules
+	CacheStatus CacheStatus
+
+	// FetchDest is the Sec-Fetch-Dest header of the request if known, see
+	// FetchMetadata
+	FetchDest string
+
+	// Verified is set if the request carried a valid challenge cookie, see
+	// UnverifiedFactor
+	Verified bool
 }
 
-// NewIPHistory creates a new History item
-func NewIPHistory(ctx context.Context, options *IPHistoryOptions) *IPHistory {
+// NewIPHistory creates a new History item. It returns an error of the kind
+// ErrConfig if the options are invalid.
+func NewIPHistory(ctx context.Context, options *IPHistoryOptions) (*IPHistory, error) {
+	if options == nil {
+		return nil, configErrorf("the history needs options")
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
 	h := &IPHistory{
-		options:         options,
-		data:            make(map[string]*list.List),
-		updatedIPs:      make(map[string]bool),
-		blacklist:       NewBlacklist(ctx, options.BlacklistTTL, options.ExpireInterval),
-		reqChan:         make(chan *Request),
-		ctx:             ctx,
-		mutex:           sync.RWMutex{},
-		tsmutex:         sync.RWMutex{},
-		blmutex:         sync.RWMutex{},
-		updatedIPsMutex: sync.RWMutex{},
-		assetRegexp:     regexp.MustCompile(`\.(jpg|png|css|js|gif|ico)`),
+		options:    options,
+		data:       make(map[string]*list.List),
+		updatedIPs: make(map[string]bool),
+		exempt:     make(map[string]Exemption),
+		grants:     make(map[string]Grant),
+		baselines:  make(map[string]*baseline),
+		warned:     make(map[string]time.Time),
+		penalized:  make(map[string]bool),
+		walkers:    make(map[string]string),
+		verified:   make(map[string]time.Time),
+		blacklist:  NewBlacklist(ctx, options.BlacklistTTL, options.ExpireInterval),
+		reqChan:    make(chan *Request, options.QueueSize),
+		ctx:        ctx,
+		mutex:      sync.RWMutex{},
+		tsmutex:    sync.RWMutex{},
+
+		calculateTrigger: make(chan chan struct{}),
+		expireTrigger:    make(chan chan struct{}),
+		watchdog:         newWatchdogState(),
+		runaway:          newRunawayState(),
+		greylist:         NewGreylist(),
 	}
 
-	go h.setTimestamp(h.options.TimeSlot)
-	go h.process()
-	go h.calculate(h.options.Interval)
-	go h.expire(h.options.ExpireInterval)
+	h.blacklist.SetCapacity(options.BlacklistMaxSize)
+
+	h.calculateBeat.beat()
+	h.expireBeat.beat()
+	h.registerMetrics(options.Metrics)
+
+	h.started = time.Now()
+
+	// the slot must be set before the first request is processed
+	h.currentSlot = time.Now().Truncate(options.TimeSlot)
+	h.currentTimestamp = h.currentSlot.Format(options.TimestampFormat)
 
-	return h
+	go h.setTimestamp(h.opts().TimeSlot)
+	for _, loop := range watchedLoops {
+		h.startLoop(loop)
+	}
+	if options.Backpressure != nil {
+		go h.backpressureLoop(options.Backpressure)
+	}
+	if options.Shedding != nil {
+		go h.sheddingLoop(options.Shedding)
+	}
+	if options.Watchdog != nil {
+		go h.watchdogLoop(options.Watchdog)
+	}
+
+	return h, nil
 }
 
 // RequestChannel returns the channel through which IPs are fed to the history
@@ -99,23 +572,59 @@ func (h *IPHistory) RequestChannel() chan *Request {
 	return h.reqChan
 }
 
+// Report feeds a request into the history, waiting for room in the queue
+// unless the history has been stopped
+func (h *IPHistory) Report(req *Request) {
+	select {
+	case h.reqChan <- req:
+	case <-h.ctx.Done():
+	}
+}
+
 func (h *IPHistory) setTimestamp(slot time.Duration) {
-	h.tsmutex.Lock()
-	h.currentSlot = time.Now().Truncate(slot)
-	h.currentTimestamp = h.currentSlot.Format(h.options.TimestampFormat)
-	h.tsmutex.Unlock()
+	// wake up right at the next slot boundary instead of a slot length
+	// after the last wake up, which would drift by the scheduling delay
+	timer := time.NewTimer(time.Until(h.slot().Add(slot)))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-h.ctx.Done():
 			return
-		case <-time.After(h.currentSlot.Add(h.options.TimeSlot).Sub(h.currentSlot)):
+		case now := <-timer.C:
+			current := now.Truncate(slot)
+
 			h.tsmutex.Lock()
-			h.currentSlot = time.Now().Truncate(slot)
-			h.currentTimestamp = h.currentSlot.Format(h.options.TimestampFormat)
+			h.currentSlot = current
+			h.currentTimestamp = current.Format(h.opts().TimestampFormat)
 			h.tsmutex.Unlock()
+
+			timer.Reset(time.Until(current.Add(slot)))
 		}
+	}
+}
+
+// TriggerCalculate evaluates the rules right away and returns when done
+func (h *IPHistory) TriggerCalculate() {
+	h.trigger(h.calculateTrigger)
+}
+
+// TriggerExpire removes expired data right away and returns when done
+func (h *IPHistory) TriggerExpire() {
+	h.trigger(h.expireTrigger)
+}
 
+// trigger asks a background loop for a run and waits for it to finish
+func (h *IPHistory) trigger(c chan chan struct{}) {
+	done := make(chan struct{})
+	select {
+	case c <- done:
+	case <-h.ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-h.ctx.Done():
 	}
 }
 
@@ -146,14 +655,467 @@ func (h *IPHistory) NumBL() int {
 	return h.blacklist.Size()
 }
 
+func (h *IPHistory) registerMetrics(m *Metrics) {
+	h.ruleMatches = m.Counter("botdetect_rule_matches_total", "Number of IPs a rule blacklisted", "rule")
+	h.ruleOverlap = m.Counter("botdetect_rule_overlap_total", "Number of IPs blacklisted by a rule that matched another rule in the same evaluation", "rule", "other")
+	h.reoffenders = m.Counter("botdetect_reoffenders_total", "Number of IPs a rule blacklisted again within a TTL after their previous entry expired", "rule")
+	h.ruleWarnings = m.Counter("botdetect_rule_warnings_total", "Number of times an IP exceeded the warn tier of a rule", "rule")
+	h.graceMatches = m.Counter("botdetect_grace_matches_total", "Number of IPs that would have been blacklisted during the grace period")
+	h.frozenMatches = m.Counter("botdetect_frozen_matches_total", "Number of IPs that would have been blacklisted while blacklisting was frozen")
+	h.canarySkipped = m.Counter("botdetect_canary_skipped_total", "Number of IPs that would have been blacklisted but are outside of the canary")
+	h.reputationChanges = m.Counter("botdetect_reputation_changes_total", "Number of reputations lowered for blacklisting and raised for good behavior", "change")
+	h.anomalies = m.Counter("botdetect_anomalies_total", "Number of anomalous slots detected")
+	h.falsePositives = m.Counter("botdetect_false_positives_total", "Number of blacklisted IPs reported as false positives", "reason")
+	m.GaugeFunc("botdetect_verified_ips", "Number of IPs with a request verified by a challenge cookie within the window", func() float64 {
+		return float64(h.NumVerified())
+	})
+	m.GaugeFunc("botdetect_blacklist_size", "Number of blacklisted IPs", func() float64 {
+		return float64(h.NumBL())
+	})
+	m.GaugeFunc("botdetect_blacklist_capacity", "Maximum number of blacklisted IPs, 0 means no limit", func() float64 {
+		return float64(h.blacklist.Capacity())
+	})
+	m.GaugeFunc("botdetect_blacklist_subscribers", "Number of subscriptions to blacklist changes", func() float64 {
+		return float64(h.blacklist.Subscribers())
+	})
+	m.CounterFunc("botdetect_blacklist_evictions_total", "Number of IPs evicted because the blacklist was full", func() float64 {
+		return float64(h.blacklist.Evicted())
+	})
+	m.GaugeFunc("botdetect_tuned_max_requests", "MaxRequests computed by the last auto tuning run", func() float64 {
+		return float64(h.TunedMaxRequests())
+	})
+	m.GaugeFunc("botdetect_tuned_max_ratio", "MaxRatio computed by the last auto tuning run", func() float64 {
+		return h.TunedMaxRatio()
+	})
+	h.ingestWarnings = m.Counter("botdetect_ingest_warnings_total", "Number of backpressure thresholds exceeded")
+	h.uncounted = m.Counter("botdetect_uncounted_requests_total", "Number of requests not counted because their path is uncounted")
+	h.handed = m.Counter("botdetect_replication_handed_total", "Number of IPs handed over to the replica owning them")
+	h.loopStalls = m.Counter("botdetect_watchdog_stalls_total", "Number of times the watchdog found a background loop stuck", "loop")
+	h.loopRestarts = m.Counter("botdetect_watchdog_restarts_total", "Number of times the watchdog restarted a stuck background loop", "loop")
+	m.GaugeFunc("botdetect_watchdog_stalled_loops", "Number of background loops stuck at the last check of the watchdog", func() float64 {
+		return float64(len(h.StalledLoops()))
+	})
+	h.rulesDisabled = m.Counter("botdetect_rules_disabled_total", "Number of times a rule has been disabled for blacklisting too many of the client IPs", "rule")
+	h.disabledSkipped = m.Counter("botdetect_disabled_rule_skipped_total", "Number of IPs that would have been blacklisted by a disabled rule")
+	m.GaugeFunc("botdetect_disabled_rules", "Number of rules disabled for blacklisting too many of the client IPs", func() float64 {
+		return float64(len(h.DisabledRules()))
+	})
+	h.greylistTransitions = m.Counter("botdetect_greylist_transitions_total", "Number of IPs greylisted, promoted to the blacklist, demoted, expired or blacklisted by a rule while greylisted", "transition")
+	m.GaugeFunc("botdetect_greylist_size", "Number of greylisted IPs", func() float64 {
+		return float64(h.greylist.Size())
+	})
+	m.GaugeFunc("botdetect_exempt_ips", "Number of IPs exempt from blacklisting, e.g. after a false positive", func() float64 {
+		h.exemptMutex.RLock()
+		defer h.exemptMutex.RUnlock()
+		return float64(len(h.exempt))
+	})
+	h.shedRequests = m.Counter("botdetect_shed_requests_total", "Number of requests not counted because of sampling while shedding load")
+	m.GaugeFunc("botdetect_shedding", "Whether the history is shedding load (1) or not (0)", func() float64 {
+		if h.shedding() {
+			return 1
+		}
+		return 0
+	})
+	m.GaugeFunc("botdetect_queue_length", "Number of requests waiting to be processed", func() float64 {
+		return float64(h.QueueLength())
+	})
+	m.GaugeFunc("botdetect_queue_capacity", "Capacity of the request queue", func() float64 {
+		return float64(h.QueueCapacity())
+	})
+	m.CounterFunc("botdetect_processed_requests_total", "Number of requests processed", func() float64 {
+		return float64(h.Processed())
+	})
+	m.GaugeFunc("botdetect_ingest_lag_seconds", "Delay between the last request with an event time and its processing", func() float64 {
+		return h.IngestLag().Seconds()
+	})
+	m.GaugeFunc("botdetect_history_ips", "Number of IPs in the history", func() float64 {
+		return float64(h.NumIPs())
+	})
+	m.CounterFunc("botdetect_ptr_lookups_postponed_total", "Number of PTR lookups postponed because too many were running", func() float64 {
+		var cache *PTRCache
+		if ptr := h.opts().PTR; ptr != nil {
+			cache = ptr.Cache
+		}
+		_, postponed := cache.LookupStats()
+		return float64(postponed)
+	})
+}
+
+// ReportFalsePositive takes the IP off the blacklist and keeps it from being
+// blacklisted again for the given duration. It returns why the IP had been
+// blacklisted and whether it was blacklisted at all.
+func (h *IPHistory) ReportFalsePositive(ip net.IP, exemptFor time.Duration, comment string) (string, bool) {
+	return h.ReportFalsePositiveBy(ip, exemptFor, comment, "")
+}
+
+// ReportFalsePositiveBy is ReportFalsePositive recording the creator of the
+// exemption, e.g. the client that reported the false positive
+func (h *IPHistory) ReportFalsePositiveBy(ip net.IP, exemptFor time.Duration, comment, creator string) (string, bool) {
+	// exempt the IP first so that a concurrent calculation can't put it
+	// back on the blacklist
+	h.exemptIP(ip, exemptFor, comment, creator, ExemptionFalsePositive)
+
+	reason, ok := h.blacklist.Remove(ip)
+
+	if ok {
+		h.falsePositives.Inc(ReasonLabel(reason))
+	}
+	h.opts().Audit.Record(ip, AuditEntry{
+		Decision: "false positive",
+		Reason:   comment,
+	})
+
+	return reason, ok
+}
+
+// Block blacklists the IP for a reason found outside the history, e.g. by a
+// LoginGuard. Exempt IPs, the grace period, a freeze and the canary are
+// respected like for rules; it returns whether the IP has been blacklisted.
+func (h *IPHistory) Block(ip net.IP, reason string) bool {
+	return h.BlockWith(ip, reason, RuleAction{})
+}
+
+// BlockWith is Block with the TTL and severity of a rule found outside the
+// history, e.g. a FlowRule
+func (h *IPHistory) BlockWith(ip net.IP, reason string, action RuleAction) bool {
+	if h.isExempt(ipKey(ip), time.Now()) {
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.blockWith(ip, reason, reason, action, nil)
+}
+
+// block blacklists the IP for one of the history's rules and returns true
+// unless the rule is disabled, the grace period is still running,
+// blacklisting is frozen or the IP is outside of the canary. h.mutex must be
+// held.
+func (h *IPHistory) block(ip net.IP, reason, detail string) bool {
+	return h.blockRule(ip, reason, detail, RuleAction{}, nil)
+}
+
+// blockWith is like block but blacklists the IP for the TTL and with the
+// severity of the action and records the values the rule matched with in
+// the audit trail, if any. h.mutex must be held.
+func (h *IPHistory) blockWith(ip net.IP, reason, detail string, action RuleAction, values *AuditValues) bool {
+	if time.Now().Before(h.frozenUntil) {
+		// record every IP only once while frozen
+		key := ipKey(ip) + " frozen"
+		if _, ok := h.warned[key]; !ok {
+			h.warned[key] = h.frozenUntil
+			h.frozenMatches.Inc()
+			h.opts().Audit.Record(ip, AuditEntry{
+				Decision: "frozen",
+				Reason:   detail,
+			})
+		}
+		return false
+	}
+
+	if graceUntil := h.started.Add(h.opts().GracePeriod); time.Now().Before(graceUntil) {
+		// record every IP only once during the grace period
+		key := ipKey(ip) + " grace"
+		if _, ok := h.warned[key]; !ok {
+			h.warned[key] = graceUntil
+			h.graceMatches.Inc()
+			h.opts().Audit.Record(ip, AuditEntry{
+				Decision: "grace",
+				Reason:   detail,
+			})
+		}
+		return false
+	}
+
+	ttl := h.opts().BlacklistTTL
+	if action.TTL > 0 {
+		ttl = action.TTL
+	}
+	if canary := h.opts().Canary; canary > 0 && !inCanary(ip, canary) {
+		// record every IP only once per blacklist TTL, the time it would
+		// have been blocked for
+		key := ipKey(ip) + " canary"
+		if until, ok := h.warned[key]; !ok || !time.Now().Before(until) {
+			h.warned[key] = time.Now().Add(ttl)
+			h.canarySkipped.Inc()
+			h.opts().Audit.Record(ip, AuditEntry{
+				Decision: "would-block",
+				Reason:   detail,
+			})
+		}
+		return false
+	}
+
+	if h.dryRun != nil {
+		// a dry run blacklists in the time of the requests
+		h.dryRun.block(ip, reason, action)
+		return true
+	}
+
+	if !h.blacklist.SetAction(ip, reason, action) {
+		// already blacklisted, the trail holds the entry that did it and the
+		// reputation has been charged for it
+		return true
+	}
+
+	if h.opts().Reputation != nil {
+		h.penalized[ipKey(ip)] = true
+	}
+
+	// remember the IP for another TTL after its entry expires to count it
+	// as a reoffender if a rule blacklists it again
+	h.warned[ipKey(ip)+offenderSuffix] = time.Now().Add(2 * ttl)
+	h.opts().Audit.Record(ip, AuditEntry{
+		Decision: "blacklisted",
+		Reason:   detail,
+		Values:   values,
+	})
+	if !h.shedding() {
+		h.opts().Ownership.Annotate(ip)
+	}
+	return true
+}
+
+// offenderSuffix marks the keys in h.warned of the IPs that have been
+// blacklisted recently
+const offenderSuffix = " blacklisted"
+
+// reoffender determines whether the IP has been blacklisted within a TTL
+// before its current evaluation. h.mutex must be held.
+func (h *IPHistory) reoffender(ip string, now time.Time) bool {
+	until, ok := h.warned[ip+offenderSuffix]
+	return ok && now.Before(until)
+}
+
+// countMatch counts the rule that blacklisted an IP, the other rules the IP
+// matched in the same evaluation and whether it is a reoffender. The labels
+// are the rules, whose number the configuration limits. h.mutex must be
+// held.
+func (h *IPHistory) countMatch(rule string, others []string, reoffender bool) {
+	h.ruleMatches.Inc(rule)
+	for _, other := range others {
+		h.ruleOverlap.Inc(rule, other)
+	}
+	if reoffender {
+		h.reoffenders.Inc(rule)
+	}
+}
+
+// inCanary determines whether the IP is among the given percentage of IPs
+// that are blacklisted. The choice is stable across restarts and instances.
+func inCanary(ip net.IP, percent float64) bool {
+	hash := fnv.New64a()
+	hash.Write([]byte(ipKey(ip)))
+	return float64(hash.Sum64()%10000) < percent*100
+}
+
+// InGracePeriod determines whether the grace period is still running
+func (h *IPHistory) InGracePeriod() bool {
+	return time.Now().Before(h.started.Add(h.opts().GracePeriod))
+}
+
+// Freeze stops blacklisting IPs for the given duration, e.g. during an
+// incident in which the detector is suspected of blocking customers. IPs
+// already on the blacklist stay blocked; IPs that would have been blacklisted
+// are recorded as frozen in the audit trail once. A duration of zero or less
+// ends the freeze. It returns when the freeze ends.
+func (h *IPHistory) Freeze(d time.Duration) time.Time {
+	until := time.Time{}
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+
+	h.mutex.Lock()
+	h.frozenUntil = until
+	h.mutex.Unlock()
+	return until
+}
+
+// FrozenUntil returns when the freeze ends and whether blacklisting is frozen
+func (h *IPHistory) FrozenUntil() (time.Time, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.frozenUntil, time.Now().Before(h.frozenUntil)
+}
+
+// warn reports an IP exceeding the warn tier of a rule unless it has already
+// been reported within the rule's window. h.mutex must be held.
+func (h *IPHistory) warn(ip string, rule Rule, total, app uint64, now time.Time) {
+	key := ip + " " + rule.String()
+	if until, ok := h.warned[key]; ok && now.Before(until) {
+		return
+	}
+	h.warned[key] = now.Add(rule.Window)
+
+	h.ruleWarnings.Inc(rule.String())
+	h.opts().Audit.Record(net.ParseIP(ip), AuditEntry{
+		Decision: "warned",
+		Reason:   fmt.Sprintf("rule %s warn tier exceeded with %d requests, %d app", rule, total, app),
+	})
+	if h.opts().OnWarn != nil {
+		h.opts().OnWarn(net.ParseIP(ip), rule, total, app)
+	}
+}
+
+// ptrRule returns the rule adjusted by the PTR pattern matching the host
+// name of the IP along with the host name and the pattern. The rule is
+// returned as is while the host name isn't known or matches no pattern.
+func (h *IPHistory) ptrRule(ip string, rule Rule, app uint64) (Rule, string, *PTRPattern) {
+	o := h.opts().PTR
+	if o == nil || float64(app) < o.Near*float64(rule.MaxRequests) {
+		return rule, "", nil
+	}
+
+	// no new lookups are started while shedding load
+	lookup := o.Cache.Lookup
+	if h.shedding() {
+		lookup = o.Cache.Cached
+	}
+	names, ok := lookup(net.ParseIP(ip))
+	if !ok {
+		return rule, "", nil
+	}
+	host, pattern := o.match(names)
+	if pattern == nil {
+		return rule, "", nil
+	}
+	return pattern.scale(rule), host, pattern
+}
+
+// ptrExempt records that a rule matched an IP whose host name keeps it from
+// being blacklisted, at most once per rule window. h.mutex must be held.
+func (h *IPHistory) ptrExempt(ip string, rule Rule, host string, now time.Time) {
+	key := ip + " ptr " + rule.String()
+	if until, ok := h.warned[key]; ok && now.Before(until) {
+		return
+	}
+	h.warned[key] = now.Add(rule.Window)
+
+	h.opts().Audit.Record(net.ParseIP(ip), AuditEntry{
+		Decision: "ptr exempt",
+		Reason:   fmt.Sprintf("rule %s matched, but PTR %s is never blacklisted", rule, host),
+	})
+}
+
+// expireWarnings forgets warnings whose suppression has ended. h.mutex must
+// be held.
+func (h *IPHistory) expireWarnings(now time.Time) {
+	for key, until := range h.warned {
+		if !now.Before(until) {
+			delete(h.warned, key)
+		}
+	}
+}
+
+// Blacklist returns the blacklist maintained by the history
+func (h *IPHistory) Blacklist() *Blacklist {
+	return h.blacklist
+}
+
 // IsBlacklisted determines whether a given IP address is on the blacklist
 func (h *IPHistory) IsBlacklisted(ip net.IP) bool {
-	h.blmutex.RLock()
-	defer h.blmutex.RUnlock()
-
 	return h.blacklist.IsBlacklisted(ip)
 }
 
+// opts returns the options currently in effect
+func (h *IPHistory) opts() *IPHistoryOptions {
+	h.optionsMutex.RLock()
+	defer h.optionsMutex.RUnlock()
+
+	return h.options
+}
+
+// Options returns a copy of the options currently in effect
+func (h *IPHistory) Options() IPHistoryOptions {
+	return *h.opts()
+}
+
+// UpdateOptions changes the options of a running history without losing its
+// slot data or blacklist. update is called with a copy of the current options
+// and may change the rules, their thresholds and windows and the
+// classification of requests (AssetTypes, AssetURLs, APIPaths, Uncounted,
+// FetchMetadata); the new options are only applied if they are valid.
+// Requests already counted keep their classification, a longer window keeps
+// counting the slots already seen and a shorter one drops the older slots
+// with the next expiry.
+//
+// The slots are never re-bucketed: TimeSlot and TimestampFormat, like the
+// intervals, the blacklist TTL, the metrics, the queue and the watchdog, are
+// fixed once the history runs, and changing them is an error of the kind
+// ErrConfig. A new slot size needs a new history, e.g. a restart.
+func (h *IPHistory) UpdateOptions(update func(o *IPHistoryOptions)) error {
+	h.optionsMutex.Lock()
+	defer h.optionsMutex.Unlock()
+
+	o := *h.options
+	update(&o)
+
+	if o.TimestampFormat != h.options.TimestampFormat || o.TimeSlot != h.options.TimeSlot ||
+		o.Interval != h.options.Interval || o.ExpireInterval != h.options.ExpireInterval ||
+		o.BlacklistTTL != h.options.BlacklistTTL || o.Metrics != h.options.Metrics ||
+		o.QueueSize != h.options.QueueSize || o.Backpressure != h.options.Backpressure ||
+		o.Watchdog != h.options.Watchdog {
+		return configErrorf("the time slot, intervals, blacklist ttl, metrics, queue size, backpressure and watchdog options can't be changed at runtime")
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	h.options = &o
+	h.blacklist.SetCapacity(o.BlacklistMaxSize)
+	return nil
+}
+
+// rules returns all rules the history evaluates
+func (h *IPHistory) rules() []Rule {
+	rules := make([]Rule, 0, len(h.opts().Rules)+1)
+	if h.opts().Window > 0 {
+		rules = append(rules, Rule{
+			Window:       h.opts().Window,
+			MaxRequests:  h.maxRequests(),
+			MaxRatio:     h.maxRatio(),
+			WarnRequests: h.opts().WarnRequests,
+			WarnRatio:    h.opts().WarnRatio,
+		})
+	}
+	return append(rules, h.opts().Rules...)
+}
+
+// rulesAt returns the rules in effect at the given time
+func (h *IPHistory) rulesAt(now time.Time) []Rule {
+	for _, sr := range h.opts().Schedules {
+		if sr.Schedule.Matches(now) {
+			return sr.Rules
+		}
+	}
+	return h.rules()
+}
+
+// window returns the longest window of all rules, i.e. how long slots are kept
+func (h *IPHistory) window() time.Duration {
+	return h.opts().window()
+}
+
+func (o *IPHistoryOptions) window() time.Duration {
+	window := o.Window
+	for _, rule := range o.extraRules() {
+		if rule.Window > window {
+			window = rule.Window
+		}
+	}
+	for _, rule := range o.BandwidthRules {
+		if rule.Window > window {
+			window = rule.Window
+		}
+	}
+	for _, rule := range o.CacheRules {
+		if rule.Window > window {
+			window = rule.Window
+		}
+	}
+	return window
+}
+
 func (h *IPHistory) timestamp() string {
 	h.tsmutex.RLock()
 	defer h.tsmutex.RUnlock()
@@ -161,19 +1123,100 @@ func (h *IPHistory) timestamp() string {
 	return h.currentTimestamp
 }
 
-func (h *IPHistory) process() {
+func (h *IPHistory) slot() time.Time {
+	h.tsmutex.RLock()
+	defer h.tsmutex.RUnlock()
+
+	return h.currentSlot
+}
+
+// isAsset determines whether the request was for an asset, or anything else
+// that doesn't count as an app request: by its Sec-Fetch-Dest with
+// FetchMetadata, by APIPaths, by the content type of the response if known
+// and by the URL otherwise
+func (h *IPHistory) isAsset(req *Request) bool {
+	o := h.opts()
+	if o.FetchMetadata && req.FetchDest != "" {
+		return !isDocument(req.FetchDest)
+	}
+	if matchesPath(o.APIPaths, req.URL) {
+		return true
+	}
+
+	// logs write "-" for responses without a content type
+	if req.ContentType == "" || req.ContentType == "-" {
+		urls := o.AssetURLs
+		if urls == nil {
+			urls = DefaultAssetURLs
+		}
+		return urls.MatchString(req.URL)
+	}
+	types := o.AssetTypes
+	if len(types) == 0 {
+		types = DefaultAssetTypes
+	}
+	return isAssetType(types, req.ContentType)
+}
+
+// slotFor returns the slot a request belongs to: the one of its time if
+// given, the current one otherwise. Requests from the future are attributed
+// to the current slot.
+func (h *IPHistory) slotFor(req *Request) time.Time {
+	current := h.slot()
+	if req.Time.IsZero() {
+		return current
+	}
+	if slot := req.Time.Truncate(h.opts().TimeSlot); slot.Before(current) {
+		return slot
+	}
+	return current
+}
+
+// slotItem returns the item of the slot in counts, which is ordered newest
+// first, and inserts it if necessary
+func slotItem(counts *list.List, slot time.Time) *IPHistoryItem {
+	for e := counts.Front(); e != nil; e = e.Next() {
+		hi := e.Value.(*IPHistoryItem)
+		if hi.Timestamp.Equal(slot) {
+			return hi
+		}
+		if hi.Timestamp.Before(slot) {
+			return counts.InsertBefore(&IPHistoryItem{Timestamp: slot}, e).Value.(*IPHistoryItem)
+		}
+	}
+	return counts.PushBack(&IPHistoryItem{Timestamp: slot}).Value.(*IPHistoryItem)
+}
+
+func (h *IPHistory) process(gen uint64) {
 	for {
+		if h.superseded(LoopProcess, gen) {
+			return
+		}
 		select {
 		case <-h.ctx.Done():
 			return
 		case req := <-h.reqChan:
+			// the process beat is set while a request is being handled
+			h.processBeat.beat()
+
+			if matchesPath(h.opts().Uncounted, req.URL) {
+				h.uncounted.Inc()
+				h.ingest.record(req, time.Now())
+				h.processBeat.clear()
+				continue
+			}
+
+			n := h.sample()
+			if n == 0 {
+				h.ingest.record(req, time.Now())
+				h.processBeat.clear()
+				continue
+			}
+
 			ip := req.IP
-			ipstr := ip.To16().String()
+			ipstr := ipKey(ip)
 
-			// remember which IP was modified
-			h.updatedIPsMutex.Lock()
-			h.updatedIPs[ipstr] = true
-			h.updatedIPsMutex.Unlock()
+			slot := h.slotFor(req)
 
 			h.mutex.Lock()
 
@@ -181,117 +1224,414 @@ func (h *IPHistory) process() {
 				h.data[ipstr] = list.New()
 			}
 
-			head := h.data[ipstr].Front()
-			if head == nil || head.Value.(*IPHistoryItem).Timestamp != h.currentSlot {
-				hi := IPHistoryItem{
-					Timestamp: h.currentSlot,
-					Count:     0,
-					App:       0,
-					Other:     0,
-				}
-				head = h.data[ipstr].PushFront(&hi)
+			// a sampled request stands for n requests
+			hi := slotItem(h.data[ipstr], slot)
+			hi.Count += n
+			hi.Bytes += req.Bytes * n
+			switch req.CacheStatus {
+			case CacheHit:
+				hi.Hits += n
+			case CacheMiss:
+				hi.Misses += n
 			}
-
-			hi := head.Value.(*IPHistoryItem)
-			hi.Count++
-			if h.assetRegexp.MatchString(req.URL) {
-				hi.Other++
+			if h.isAsset(req) {
+				hi.Other += n
 			} else {
-				hi.App++
+				hi.App += n
+			}
+			// signals spanning several requests follow the time of the
+			// requests, so that replayed logs are judged like live traffic
+			seen := time.Now()
+			if !req.Time.IsZero() && req.Time.Before(seen) {
+				seen = req.Time
+			}
+			if n == 1 {
+				// walks can't be followed in a sample
+				if walk, ok := h.opts().Walks.Observe(ipstr, req.URL, seen); ok {
+					h.walkers[ipstr] = walk
+				}
+			}
+			if req.Connections > 0 {
+				h.opts().Concurrency.observe(ipstr, req.Connections, seen)
+			}
+			if req.Verified {
+				h.markVerified(ipstr, seen)
 			}
+
+			// remember which IP was modified
+			h.updatedIPs[ipstr] = true
 			h.mutex.Unlock()
+
+			h.ingest.record(req, time.Now())
+			h.processBeat.clear()
 		}
 	}
 }
 
-func (h *IPHistory) expire(expireInterval time.Duration) {
-	for {
-		cutoff := time.Now().Add(-1 * h.options.Window)
+func (h *IPHistory) expire(expireInterval time.Duration, gen uint64) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
 
+	for {
+		if h.superseded(LoopExpire, gen) {
+			return
+		}
+		var done chan struct{}
 		select {
 		case <-h.ctx.Done():
 			return
-		case <-time.After(expireInterval):
-			h.mutex.Lock()
-			for ip, counts := range h.data {
-			INNER:
-				// expire old requests
-				for back := counts.Back(); back != nil; back = counts.Back() {
-					if back.Value.(*IPHistoryItem).Timestamp.After(cutoff) {
-						break INNER
-					}
-					// log.Printf("removing old requests %v\n", *(back.Value.(*HistoryItem)))
-					counts.Remove(back)
-					back.Value = nil
-					back = nil
-				}
+		case <-ticker.C:
+		case done = <-h.expireTrigger:
+		}
 
-				if counts.Len() <= 0 {
-					counts = nil
-					delete(h.data, ip)
-				}
+		h.expireOnce()
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// expireOnce removes expired slots and other state that is no longer needed
+func (h *IPHistory) expireOnce() {
+	// the options are taken once, so that UpdateOptions can't change them
+	// halfway through
+	o := h.opts()
+	cutoff := time.Now().Add(-1 * o.window())
+
+	h.mutex.Lock()
+	for ip, counts := range h.data {
+	INNER:
+		// expire old requests
+		for back := counts.Back(); back != nil; back = counts.Back() {
+			if back.Value.(*IPHistoryItem).Timestamp.After(cutoff) {
+				break INNER
 			}
-			h.mutex.Unlock()
+			// log.Printf("removing old requests %v\n", *(back.Value.(*HistoryItem)))
+			counts.Remove(back)
+			back.Value = nil
+			back = nil
 		}
+
+		if counts.Len() <= 0 {
+			counts = nil
+			delete(h.data, ip)
+			continue
+		}
+
+		if o.CompactAge > 0 && o.CompactSlot > 0 {
+			compact(counts, time.Now().Add(-1*o.CompactAge), o.CompactSlot)
+		}
+	}
+	h.expireBaselines(o.Anomaly, time.Now())
+	h.expireWarnings(time.Now())
+	h.expireVerified(cutoff)
+	h.mutex.Unlock()
+
+	h.expireExemptions(o.Audit, time.Now())
+	h.expireGrants(time.Now())
+	if o.PTR != nil {
+		o.PTR.Cache.Expire()
+	}
+	o.Walks.Expire(cutoff)
+	o.Concurrency.Expire(cutoff)
+	if store := memoryReputations(o.Reputation); store != nil {
+		store.Expire(time.Now().Add(-2*o.Reputation.RewardInterval), o.Reputation.HalfLife)
 	}
+	h.expireBeat.beat()
 }
 
-func (h *IPHistory) calculate(updateInterval time.Duration) {
+func (h *IPHistory) calculate(updateInterval time.Duration, gen uint64) {
+	ticker := time.NewTicker(updateInterval)
+	defer ticker.Stop()
+
 	for {
+		if h.superseded(LoopCalculate, gen) {
+			return
+		}
+		var done chan struct{}
 		select {
 		case <-h.ctx.Done():
 			return
-		case <-time.After(updateInterval):
-			cutoff := time.Now().Add(-1 * h.options.Window)
-			// blacklist := Blacklist{}
+		case <-ticker.C:
+		case done = <-h.calculateTrigger:
+		}
+
+		h.calculateAt(time.Now())
+		if done != nil {
+			close(done)
+		}
+	}
+}
 
-			h.updatedIPsMutex.Lock()
-			updated := h.updatedIPs
-			h.updatedIPs = make(map[string]bool)
-			h.updatedIPsMutex.Unlock()
+// calculateAt evaluates the rules for all IPs with new requests as of now
+func (h *IPHistory) calculateAt(now time.Time) {
+	if !h.leader().IsLeader() {
+		h.handToLeader()
+		h.calculateBeat.beat()
+		return
+	}
 
-			// pretty.Println(h.data)
-			h.mutex.Lock()
-			for ip := range updated {
-				counts := h.data[ip]
+	cutoff := now.Add(-1 * h.window())
+
+	h.mutex.Lock()
+	updated := h.updatedIPs
+	h.updatedIPs = make(map[string]bool)
+	h.mutex.Unlock()
+
+	// the stores are queried without holding the lock
+	remote, evaluate := h.replicate(updated)
+	reputations := h.reputations(evaluate)
+
+	ips := make(map[string]bool, len(updated)+len(evaluate))
+	for ip := range updated {
+		ips[ip] = true
+	}
+	for ip := range evaluate {
+		ips[ip] = true
+	}
+
+	h.mutex.Lock()
+	h.tune(now)
+	h.countClients(ips)
+	rules := h.rulesAt(now)
+
+	for ip := range ips {
+		counts := h.data[ip]
+		walk, walking := h.walkers[ip]
+		delete(h.walkers, ip)
+
+		if counts == nil {
+			// IPs handed over by other replicas may have no local
+			// requests
+			if _, ok := remote[ip]; !ok {
+				continue
+			}
+			counts = list.New()
+		}
+
+	INNER:
+
+		// expire old requests
+		for back := counts.Back(); back != nil; back = counts.Back() {
+			if back.Value.(*IPHistoryItem).Timestamp.After(cutoff) {
+				break INNER
+			}
+			// log.Printf("removing old requests %v\n", *(back.Value.(*HistoryItem)))
+			counts.Remove(back)
+			back.Value = nil
+			back = nil
+		}
+
+		// remove the data for an IP if all requests have expired
+		if counts.Len() <= 0 && h.data[ip] != nil {
+			delete(h.data, ip)
+		}
+
+		if h.isExempt(ip, now) {
+			continue
+		}
+
+		// the rules see the requests of all replicas, the anomaly
+		// detection only the local ones
+		evaluated := counts
+		if items, ok := remote[ip]; ok {
+			evaluated = withRemote(counts, items)
+		}
+
+		ipRules := rules
+		if len(h.opts().DatacenterRules) > 0 && h.opts().Datacenters.IsDatacenter(net.ParseIP(ip)) {
+			ipRules = append(ipRules[:len(ipRules):len(ipRules)], h.opts().DatacenterRules...)
+		}
+		bandwidthRules, cacheRules := h.opts().BandwidthRules, h.opts().CacheRules
+		if !evaluate[ip] {
+			// another replica owns the IP and evaluates the rules on
+			// the requests of all replicas, the signals of the local
+			// requests are still evaluated here
+			ipRules, bandwidthRules, cacheRules = nil, nil, nil
+		}
 
-				if counts == nil {
+		grant, granted := h.grantFor(net.ParseIP(ip), now)
+		reputation, reputed := h.reputationFactor(reputations, ip, now)
+		unverified, tightened := h.unverifiedFactor(ip, now)
+
+		// every rule is evaluated so that the rules an IP matched besides
+		// the one that blacklisted it are counted, only the first one that
+		// matches blacklists it. IPs already on the blacklist match their
+		// rules again in every evaluation and aren't counted.
+		parsed := net.ParseIP(ip)
+		fresh, reoffender := !h.blacklist.IsBlacklisted(parsed), h.reoffender(ip, now)
+		matched := false
+		blockedBy, others := "", []string{}
+		match := func(label string, blocked bool) {
+			switch {
+			case blocked && !matched:
+				blockedBy = label
+			case blockedBy != "":
+				others = append(others, label)
+			}
+			matched = true
+		}
+
+		var warned *Rule
+		var warnedTotal, warnedApp uint64
+		exempted := false
+		for _, rule := range ipRules {
+			total, app := countSince(evaluated, now.Add(-1*rule.Window))
+			effective, host, pattern := h.ptrRule(ip, rule, app)
+			if pattern != nil && pattern.Factor == 0 {
+				if rule.matches(total, app) && !matched {
+					h.ptrExempt(ip, rule, host, now)
+					exempted = true
+					matched = true
+				}
+				continue
+			}
+			if granted {
+				effective = scaleRule(effective, grant.Factor)
+			}
+			if reputed {
+				effective = scaleRule(effective, reputation)
+			}
+			if tightened {
+				effective = scaleRule(effective, unverified)
+			}
+			if effective.matches(total, app) {
+				if matched {
+					match(rule.String(), false)
 					continue
 				}
-
-			INNER:
-
-				// expire old requests
-				for back := counts.Back(); back != nil; back = counts.Back() {
-					if back.Value.(*IPHistoryItem).Timestamp.After(cutoff) {
-						break INNER
-					}
-					// log.Printf("removing old requests %v\n", *(back.Value.(*HistoryItem)))
-					counts.Remove(back)
-					back.Value = nil
-					back = nil
+				detail := fmt.Sprintf("rule %s matched with %d requests, %d app", rule, total, app)
+				if pattern != nil {
+					detail += fmt.Sprintf(", thresholds scaled by %g for PTR %s", pattern.Factor, host)
 				}
-
-				// remove the data for an IP if all requests have expired
-				if counts.Len() <= 0 {
-					delete(h.data, ip)
+				if granted {
+					detail += fmt.Sprintf(", thresholds raised by %g for grant %s", grant.Factor, grant.Network)
 				}
+				if reputed {
+					detail += fmt.Sprintf(", thresholds scaled by %.2f for the reputation", reputation)
+				}
+				if tightened {
+					detail += fmt.Sprintf(", thresholds scaled by %g for an unverified client", unverified)
+				}
+				values := &AuditValues{Window: rule.Window.String(), Requests: total, App: app, Ratio: float64(total) / float64(app)}
+				match(rule.String(), h.blockRule(parsed, "rule "+rule.String(), detail, rule.RuleAction, values))
+				continue
+			}
+			if effective.warns(total, app) && !matched {
+				h.warn(ip, rule, total, app, now)
+				if warned == nil {
+					rule := rule
+					warned, warnedTotal, warnedApp = &rule, total, app
+				}
+			}
+		}
 
-				// count requests per IP
-				var total, app uint64
-				for node := counts.Front(); node != nil; node = node.Next() {
-					// fmt.Printf("[%s] total: %d, app: %d\n", node.Value.(*HistoryItem).Timestamp, node.Value.(*HistoryItem).Count, node.Value.(*HistoryItem).App)
-					total += node.Value.(*IPHistoryItem).Count
-					app += node.Value.(*IPHistoryItem).App
+		for _, rule := range bandwidthRules {
+			if exempted {
+				break
+			}
+			maxBytes := rule.MaxBytes
+			if granted {
+				maxBytes = uint64(float64(maxBytes) * grant.Factor)
+			}
+			if reputed {
+				maxBytes = uint64(float64(maxBytes) * reputation)
+			}
+			if tightened {
+				maxBytes = uint64(float64(maxBytes) * unverified)
+			}
+			if bytes := bytesSince(evaluated, now.Add(-1*rule.Window)); bytes > maxBytes {
+				if matched {
+					match("bandwidth "+rule.String(), false)
+					continue
 				}
+				match("bandwidth "+rule.String(), h.blockRule(parsed, "bandwidth rule "+rule.String(),
+					fmt.Sprintf("bandwidth rule %s matched with %d bytes", rule, bytes), rule.RuleAction,
+					&AuditValues{Window: rule.Window.String(), Bytes: bytes}))
+			}
+		}
 
-				// fmt.Printf("app: %d/%d, ratio: %.2f/%.2f\n", app, h.options.MaxRequests, float64(total)/float64(app), h.options.MaxRatio)
-				if app > h.options.MaxRequests && float64(total)/float64(app) > h.options.MaxRatio {
-					h.blacklist.Set(net.ParseIP(ip))
+		for _, rule := range cacheRules {
+			if exempted {
+				break
+			}
+			if hits, misses := cacheSince(evaluated, now.Add(-1*rule.Window)); rule.matches(hits, misses) {
+				if matched {
+					match("cache "+rule.String(), false)
+					continue
 				}
+				match("cache "+rule.String(), h.blockRule(parsed, "cache rule "+rule.String(),
+					fmt.Sprintf("cache rule %s matched with %d misses of %d requests", rule, misses, hits+misses), rule.RuleAction,
+					&AuditValues{Window: rule.Window.String(), Requests: hits + misses, Misses: misses}))
 			}
-			h.mutex.Unlock()
+		}
+
+		if walking && !exempted {
+			match("walk", !matched && h.block(parsed, "walk", walk))
+		}
 
+		if detail, ok := h.opts().Concurrency.sustained(ip, now); ok && !exempted {
+			match("concurrency", !matched && h.block(parsed, "concurrency", detail))
 		}
+
+		if blockedBy != "" && fresh {
+			h.countMatch(blockedBy, others, reoffender)
+		}
+
+		// an IP exceeding several warn tiers counts once per evaluation
+		if warned != nil && !matched {
+			h.greylistAbuse(ip, *warned, warnedTotal, warnedApp, now)
+		}
+
+		h.detectAnomaly(ip, counts)
+	}
+	h.mutex.Unlock()
+
+	h.updateReputations(evaluate, reputations, now)
+	h.sweepGreylist(now)
+	h.checkRunaway(now)
+	h.calculateBeat.beat()
+}
+
+// countSince sums up the requests of all items newer than cutoff
+func countSince(counts *list.List, cutoff time.Time) (total, app uint64) {
+	for node := counts.Front(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		if !hi.Timestamp.After(cutoff) {
+			break
+		}
+		total += hi.Count
+		app += hi.App
+	}
+	return total, app
+}
+
+// compact merges all items older than cutoff into items covering slot. The
+// list is ordered newest first and stays that way.
+func compact(counts *list.List, cutoff time.Time, slot time.Duration) {
+	var prev *IPHistoryItem
+
+	for node := counts.Front(); node != nil; {
+		next := node.Next()
+		hi := node.Value.(*IPHistoryItem)
+
+		if hi.Timestamp.Before(cutoff) {
+			bucket := hi.Timestamp.Truncate(slot)
+			if prev != nil && prev.Timestamp.Equal(bucket) {
+				prev.Count += hi.Count
+				prev.App += hi.App
+				prev.Other += hi.Other
+				prev.Bytes += hi.Bytes
+				prev.Hits += hi.Hits
+				prev.Misses += hi.Misses
+				counts.Remove(node)
+				node = next
+				continue
+			}
+			hi.Timestamp = bucket
+		}
+
+		prev = hi
+		node = next
 	}
 }
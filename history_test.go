@@ -0,0 +1,566 @@
+package botdetect
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	counts := list.New()
+
+	// 30 minute slots, newest first
+	for i := 0; i < 30; i++ {
+		counts.PushBack(&IPHistoryItem{
+			Timestamp: now.Add(-time.Duration(i) * time.Minute),
+			Count:     2,
+			App:       1,
+			Other:     1,
+		})
+	}
+
+	compact(counts, now.Add(-15*time.Minute), 5*time.Minute)
+
+	// 16 untouched minute slots plus the remaining 14 minutes in 5m slots
+	if counts.Len() != 16+3 {
+		t.Errorf("expected 19 slots after compaction, got %d", counts.Len())
+	}
+
+	var total uint64
+	var last time.Time
+	for node := counts.Front(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		total += hi.Count
+		if !last.IsZero() && !hi.Timestamp.Before(last) {
+			t.Errorf("slots are not ordered newest first: %s after %s", hi.Timestamp, last)
+		}
+		last = hi.Timestamp
+	}
+
+	if total != 60 {
+		t.Errorf("compaction lost requests: expected 60, got %d", total)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	options := IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       5 * time.Second,
+		ExpireInterval: time.Minute,
+		BlacklistTTL:   time.Hour,
+	}
+	if err := options.Validate(); err != nil {
+		t.Errorf("expected valid options, got %s", err)
+	}
+
+	options.Interval = 0
+	options.Rules = []Rule{{Window: time.Second}}
+	if err := options.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for a zero interval and a rule window shorter than the time slot, got %v", err)
+	}
+	if _, err := NewIPHistory(context.Background(), &options); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected the history to reject the options, got %v", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       10 * time.Millisecond,
+		ExpireInterval: 10 * time.Millisecond,
+		BlacklistTTL:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := h.Ready(); err != nil {
+		t.Errorf("expected a running history to be ready, got %s", err)
+	}
+
+	cancel()
+	if err := h.Alive(); err == nil {
+		t.Errorf("expected a cancelled history not to be alive")
+	}
+}
+
+func TestReportFalsePositive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Minute,
+		ExpireInterval: time.Minute,
+		BlacklistTTL:   time.Hour,
+		Metrics:        NewMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	h.Blacklist().SetReason(ip, "rule 1m0s:1:0.5")
+
+	reason, ok := h.ReportFalsePositive(ip, time.Hour, "customer complaint")
+	if !ok || reason != "rule 1m0s:1:0.5" {
+		t.Errorf("expected the IP to have been blacklisted by the rule, got '%s', %v", reason, ok)
+	}
+	if h.IsBlacklisted(ip) {
+		t.Errorf("IP %s should no longer be blacklisted", ip)
+	}
+	if !h.isExempt(ip.To16().String(), time.Now()) {
+		t.Errorf("IP %s should be exempt from blacklisting", ip)
+	}
+	if h.falsePositives.Values()["rule 1m0s:1:0.5"] != 1 {
+		t.Errorf("expected the false positive to be counted for the rule")
+	}
+}
+
+func TestRuleOverlap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	minute := Rule{Window: time.Minute, MaxRequests: 5, MaxRatio: 0.5}
+	hour := Rule{Window: time.Hour, MaxRequests: 8, MaxRatio: 0.5}
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Hour,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    1000,
+		MaxRatio:       0.5,
+		Rules:          []Rule{minute, hour},
+		Metrics:        NewMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	processed := uint64(0)
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			h.RequestChannel() <- &Request{IP: ip, URL: "/"}
+		}
+		processed += uint64(n)
+		for h.Processed() < processed {
+			time.Sleep(time.Millisecond)
+		}
+		h.TriggerCalculate()
+	}
+
+	// the IP matches both rules, the first one blacklists it
+	send(10)
+	if reason, _ := h.Blacklist().Reason(ip); reason != "rule "+minute.String() {
+		t.Fatalf("expected the IP to be blacklisted by the first rule, got '%s'", reason)
+	}
+
+	// while it is blacklisted it isn't counted again
+	send(1)
+
+	// blacklisted again after its entry is gone it is a reoffender
+	h.Blacklist().Remove(ip)
+	send(1)
+
+	if matches := h.ruleMatches.Values(); matches[minute.String()] != 2 || len(matches) != 1 {
+		t.Errorf("expected the first rule to have blacklisted the IP twice, got %v", matches)
+	}
+	if overlap := h.ruleOverlap.Values(); overlap[minute.String()+"|"+hour.String()] != 2 || len(overlap) != 1 {
+		t.Errorf("expected the second rule to overlap twice, got %v", overlap)
+	}
+	if reoffenders := h.reoffenders.Values(); reoffenders[minute.String()] != 1 || len(reoffenders) != 1 {
+		t.Errorf("expected one reoffender, got %v", reoffenders)
+	}
+}
+
+func TestUpdateOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       10 * time.Millisecond,
+		ExpireInterval: time.Minute,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    100,
+		MaxRatio:       0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		h.RequestChannel() <- &Request{URL: "/index.html", IP: ip}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if h.IsBlacklisted(ip) {
+		t.Fatalf("IP %s should not be blacklisted with the initial rules", ip)
+	}
+
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.TimeSlot = time.Second }); err == nil {
+		t.Errorf("changing the time slot at runtime should fail")
+	}
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.TimestampFormat = "15:04:05" }); !errors.Is(err, ErrConfig) {
+		t.Errorf("changing the timestamp format at runtime should fail, got %v", err)
+	}
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.Interval = 0 }); err == nil {
+		t.Errorf("invalid options should be rejected")
+	}
+
+	// the classifier can be swapped, the requests already counted stay app
+	// requests
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.AssetURLs = regexp.MustCompile(`\.html$`) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h.RequestChannel() <- &Request{URL: "/index.html", IP: ip}
+	for h.Processed() < 11 {
+		time.Sleep(time.Millisecond)
+	}
+	items := h.ExportState().History[ip.String()]
+	if len(items) != 1 || items[0].App != 10 || items[0].Other != 1 {
+		t.Errorf("expected the new classifier to apply to new requests only, got %+v", items)
+	}
+
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.MaxRequests = 5 }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the requests seen before the update count towards the new rule
+	h.RequestChannel() <- &Request{URL: "/index.html", IP: ip}
+	time.Sleep(30 * time.Millisecond)
+	if !h.IsBlacklisted(ip) {
+		t.Errorf("IP %s should be blacklisted after lowering max requests", ip)
+	}
+}
+
+func TestWarnTier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warnings := make(chan Rule, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        10 * time.Millisecond,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     10,
+		MaxRatio:        0.5,
+		WarnRequests:    3,
+		WarnRatio:       0.5,
+		Metrics:         NewMetrics(),
+		OnWarn: func(ip net.IP, rule Rule, total, app uint64) {
+			warnings <- rule
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 5; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+
+	select {
+	case rule := <-warnings:
+		if rule.WarnRequests != 3 {
+			t.Errorf("unexpected rule %s", rule)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a warning")
+	}
+
+	// further calculations within the window don't warn again
+	h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	time.Sleep(50 * time.Millisecond)
+	if len(warnings) != 0 {
+		t.Errorf("expected a single warning, got %d more", len(warnings))
+	}
+	if h.IsBlacklisted(ip) {
+		t.Error("the warn tier must not blacklist")
+	}
+	if h.ruleWarnings.Values()["1h0m0s:10:0.5:3:0.5"] != 1 {
+		t.Errorf("expected the warning to be counted, got %v", h.ruleWarnings.Values())
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	audit := NewAuditLog(10, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        10 * time.Millisecond,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1,
+		MaxRatio:        0.5,
+		GracePeriod:     time.Hour,
+		Audit:           audit,
+		Metrics:         NewMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.InGracePeriod() {
+		t.Fatal("expected the grace period to be running")
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 5; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if h.IsBlacklisted(ip) {
+		t.Error("no IP must be blacklisted during the grace period")
+	}
+	entries := audit.Entries(ip)
+	if len(entries) != 1 || entries[0].Decision != "grace" {
+		t.Errorf("expected a single grace entry in the audit trail, got %+v", entries)
+	}
+	if h.graceMatches.Values()[""] != 1 {
+		t.Errorf("expected one grace match, got %v", h.graceMatches.Values())
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	audit := NewAuditLog(10, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1,
+		MaxRatio:        0.5,
+		Audit:           audit,
+		Metrics:         NewMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := net.ParseIP("192.0.2.1")
+	h.Blacklist().Set(blocked)
+
+	until := h.Freeze(time.Hour)
+	if frozenUntil, frozen := h.FrozenUntil(); !frozen || !frozenUntil.Equal(until) {
+		t.Fatalf("expected blacklisting to be frozen until %s, got %s %v", until, frozenUntil, frozen)
+	}
+
+	ip := net.ParseIP("192.0.2.2")
+	for i := 0; i < 5; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	for h.Processed() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+	h.TriggerCalculate()
+
+	if h.IsBlacklisted(ip) || h.Block(ip, "login") {
+		t.Error("no IP must be blacklisted while frozen")
+	}
+	if !h.IsBlacklisted(blocked) {
+		t.Error("expected the blacklisted IP to stay blocked")
+	}
+	if entries := audit.Entries(ip); len(entries) != 1 || entries[0].Decision != "frozen" {
+		t.Errorf("expected a single frozen entry in the audit trail, got %+v", entries)
+	}
+	if h.frozenMatches.Values()[""] != 1 {
+		t.Errorf("expected one frozen match, got %v", h.frozenMatches.Values())
+	}
+
+	h.Freeze(0)
+	if _, frozen := h.FrozenUntil(); frozen {
+		t.Fatal("expected the freeze to end")
+	}
+	h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	for h.Processed() < 6 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+	if !h.IsBlacklisted(ip) {
+		t.Error("expected the IP to be blacklisted after the freeze")
+	}
+}
+
+func TestCanary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	audit := NewAuditLog(10, 1000)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1,
+		MaxRatio:        0.5,
+		Canary:          50,
+		Audit:           audit,
+		Metrics:         NewMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var in, out []net.IP
+	for i := 1; i <= 200; i++ {
+		ip := net.IPv4(198, 51, 100, byte(i))
+		if inCanary(ip, 50) {
+			in = append(in, ip)
+		} else {
+			out = append(out, ip)
+		}
+		for j := 0; j < 3; j++ {
+			h.RequestChannel() <- &Request{URL: "/", IP: ip}
+		}
+	}
+	for h.Processed() < 600 {
+		time.Sleep(time.Millisecond)
+	}
+	if len(in) < 60 || len(out) < 60 {
+		t.Fatalf("expected about half of the IPs in the canary, got %d of 200", len(in))
+	}
+
+	h.TriggerCalculate()
+	h.TriggerCalculate()
+
+	for _, ip := range in {
+		if !h.IsBlacklisted(ip) {
+			t.Errorf("expected %s in the canary to be blacklisted", ip)
+		}
+	}
+	for _, ip := range out {
+		if h.IsBlacklisted(ip) {
+			t.Errorf("expected %s outside of the canary not to be blacklisted", ip)
+		}
+		if entries := audit.Entries(ip); len(entries) != 1 || entries[0].Decision != "would-block" {
+			t.Errorf("expected a single would-block entry for %s, got %+v", ip, entries)
+		}
+	}
+	if h.canarySkipped.Values()[""] != uint64(len(out)) {
+		t.Errorf("expected %d skipped IPs, got %v", len(out), h.canarySkipped.Values())
+	}
+
+	for _, percent := range []float64{-1, 101} {
+		if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.Canary = percent }); err == nil {
+			t.Errorf("expected canary %g to be invalid", percent)
+		}
+	}
+}
+
+func TestSlotItem(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	counts := list.New()
+
+	for _, offset := range []int{0, -2, -1, -5, 0, -2} {
+		slotItem(counts, now.Add(time.Duration(offset)*time.Minute)).Count++
+	}
+
+	expected := []struct {
+		offset int
+		count  uint64
+	}{{0, 2}, {-1, 1}, {-2, 2}, {-5, 1}}
+	if counts.Len() != len(expected) {
+		t.Fatalf("expected %d slots, got %d", len(expected), counts.Len())
+	}
+	e := counts.Front()
+	for _, exp := range expected {
+		hi := e.Value.(*IPHistoryItem)
+		if !hi.Timestamp.Equal(now.Add(time.Duration(exp.offset)*time.Minute)) || hi.Count != exp.count {
+			t.Errorf("expected slot %d with %d requests, got %s with %d", exp.offset, exp.count, hi.Timestamp, hi.Count)
+		}
+		e = e.Next()
+	}
+}
+
+func TestSlotFor(t *testing.T) {
+	current := time.Now().Truncate(time.Minute)
+	h := &IPHistory{options: &IPHistoryOptions{TimeSlot: time.Minute}, currentSlot: current}
+
+	if slot := h.slotFor(&Request{}); !slot.Equal(current) {
+		t.Errorf("expected the current slot for requests without a time, got %s", slot)
+	}
+	if slot := h.slotFor(&Request{Time: current.Add(-90 * time.Second)}); !slot.Equal(current.Add(-2 * time.Minute)) {
+		t.Errorf("expected the slot of the request time, got %s", slot)
+	}
+	if slot := h.slotFor(&Request{Time: current.Add(time.Hour)}); !slot.Equal(current) {
+		t.Errorf("expected the current slot for requests from the future, got %s", slot)
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        10 * time.Millisecond,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     2,
+		MaxRatio:        0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	for h.Processed() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.TriggerCalculate()
+	if !h.IsBlacklisted(ip) {
+		t.Error("expected the IP to be blacklisted by the triggered calculation")
+	}
+
+	if h.NumIPs() != 1 {
+		t.Fatalf("expected 1 IP before expiry, got %d", h.NumIPs())
+	}
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.Window = 10 * time.Millisecond }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	h.TriggerExpire()
+	if h.NumIPs() != 0 {
+		t.Errorf("expected no IPs after the triggered expiry, got %d", h.NumIPs())
+	}
+
+	cancel()
+	h.TriggerCalculate()
+}
@@ -0,0 +1,111 @@
+package botdetect
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// BackpressureOptions configures warnings about the ingest falling behind.
+// Thresholds that are zero aren't checked.
+type BackpressureOptions struct {
+	// MaxQueue is the fill level of the request channel, as a fraction of
+	// its capacity, above which a warning is issued
+	MaxQueue float64
+
+	// MaxLag is the delay between an event (Request.Time) and its
+	// processing above which a warning is issued
+	MaxLag time.Duration
+
+	// MinRate is the number of requests per second below which a warning
+	// is issued
+	MinRate float64
+
+	// Interval is the time between two checks
+	Interval time.Duration
+
+	// OnWarning is called with a description of every threshold exceeded
+	OnWarning func(msg string)
+}
+
+// ingestStats are updated by process and read by the metrics and the
+// backpressure checks
+type ingestStats struct {
+	processed uint64
+	lag       int64
+}
+
+func (s *ingestStats) record(req *Request, now time.Time) {
+	atomic.AddUint64(&s.processed, 1)
+	if !req.Time.IsZero() {
+		atomic.StoreInt64(&s.lag, int64(now.Sub(req.Time)))
+	}
+}
+
+// QueueLength returns the number of requests waiting in the request channel
+func (h *IPHistory) QueueLength() int {
+	return len(h.reqChan)
+}
+
+// QueueCapacity returns the capacity of the request channel
+func (h *IPHistory) QueueCapacity() int {
+	return cap(h.reqChan)
+}
+
+// Processed returns the number of requests processed so far
+func (h *IPHistory) Processed() uint64 {
+	return atomic.LoadUint64(&h.ingest.processed)
+}
+
+// IngestLag returns the delay between the event time and the processing of
+// the last request that had an event time
+func (h *IPHistory) IngestLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.ingest.lag))
+}
+
+// backpressureLoop periodically compares the ingest statistics to the
+// thresholds of o
+func (h *IPHistory) backpressureLoop(o *BackpressureOptions) {
+	last := h.Processed()
+	lastTime := time.Now()
+
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case now := <-ticker.C:
+			processed := h.Processed()
+			rate := float64(processed-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = processed, now
+
+			for _, msg := range h.checkBackpressure(o, rate) {
+				h.ingestWarnings.Inc()
+				if o.OnWarning != nil {
+					o.OnWarning(msg)
+				}
+			}
+		}
+	}
+}
+
+// checkBackpressure returns a description of every threshold exceeded
+func (h *IPHistory) checkBackpressure(o *BackpressureOptions, rate float64) []string {
+	warnings := []string{}
+
+	if o.MaxQueue > 0 && h.QueueCapacity() > 0 {
+		if fill := float64(h.QueueLength()) / float64(h.QueueCapacity()); fill > o.MaxQueue {
+			warnings = append(warnings, fmt.Sprintf("request queue is %.0f%% full (%d/%d)", fill*100, h.QueueLength(), h.QueueCapacity()))
+		}
+	}
+	if o.MaxLag > 0 && h.IngestLag() > o.MaxLag {
+		warnings = append(warnings, fmt.Sprintf("ingest lag of %s exceeds %s", h.IngestLag(), o.MaxLag))
+	}
+	if o.MinRate > 0 && rate < o.MinRate {
+		warnings = append(warnings, fmt.Sprintf("processing rate of %.1f requests/s is below %.1f", rate, o.MinRate))
+	}
+
+	return warnings
+}
@@ -0,0 +1,69 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     100,
+		MaxRatio:        0.9,
+		QueueSize:       10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.QueueCapacity() != 10 {
+		t.Errorf("expected a queue capacity of 10, got %d", h.QueueCapacity())
+	}
+
+	h.RequestChannel() <- &Request{URL: "/", IP: net.ParseIP("192.0.2.1"), Time: time.Now().Add(-time.Minute)}
+	h.RequestChannel() <- &Request{URL: "/", IP: net.ParseIP("192.0.2.1")}
+
+	deadline := time.Now().Add(time.Second)
+	for h.Processed() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if h.Processed() != 2 {
+		t.Fatalf("expected 2 processed requests, got %d", h.Processed())
+	}
+	if lag := h.IngestLag(); lag < time.Minute || lag > 2*time.Minute {
+		t.Errorf("expected a lag of about a minute, got %s", lag)
+	}
+}
+
+func TestCheckBackpressure(t *testing.T) {
+	h := &IPHistory{reqChan: make(chan *Request, 4)}
+	h.reqChan <- &Request{}
+	h.reqChan <- &Request{}
+	h.reqChan <- &Request{}
+	h.ingest.lag = int64(10 * time.Second)
+
+	o := &BackpressureOptions{MaxQueue: 0.5, MaxLag: 5 * time.Second, MinRate: 10}
+	warnings := h.checkBackpressure(o, 1)
+	if len(warnings) != 3 {
+		t.Fatalf("expected 3 warnings, got %v", warnings)
+	}
+	if !strings.Contains(warnings[0], "75% full") {
+		t.Errorf("unexpected queue warning %q", warnings[0])
+	}
+
+	o = &BackpressureOptions{MaxQueue: 0.8, MaxLag: time.Minute, MinRate: 0.5}
+	if warnings := h.checkBackpressure(o, 1); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+}
@@ -0,0 +1,232 @@
+package botdetect
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultInputFormat is the input format of the Apache RewriteMap example:
+// remote address, X-Forwarded-For and request URI separated by '|'
+const DefaultInputFormat = "remote|xff|url"
+
+// InputFormat describes the fields of an input line. Fields are separated by
+// '|'; the last field takes the rest of the line, so it may contain '|'.
+// Known fields are remote, xff, url, time (the timestamp of the event as
+// logged), bytes (the size of the response), status (the response status
+// code), user (the user name of a login attempt) and header-order (the names
+// of the request headers in the order the client sent them, separated by
+// commas), header:<Name> takes the value of an arbitrary request header and
+// "-" ignores a field.
+type InputFormat struct {
+	fields []string
+
+	// kinds and headers are the parsed fields, so that lines can be parsed
+	// without comparing field names
+	kinds   []inputField
+	headers []string
+}
+
+// inputField is the kind of a field of the input format
+type inputField uint8
+
+const (
+	fieldIgnore inputField = iota
+	fieldRemote
+	fieldXFF
+	fieldURL
+	fieldTime
+	fieldBytes
+	fieldStatus
+	fieldUser
+	fieldContentType
+	fieldConnections
+	fieldCacheStatus
+	fieldHeaderOrder
+	fieldHeader
+)
+
+var inputFields = map[string]inputField{
+	"-":      fieldIgnore,
+	"remote": fieldRemote,
+	"xff":    fieldXFF,
+	"url":    fieldURL,
+	"time":   fieldTime,
+	"bytes":  fieldBytes,
+	"status": fieldStatus,
+	"user":   fieldUser,
+
+	"content-type": fieldContentType,
+	"connections":  fieldConnections,
+	"cache-status": fieldCacheStatus,
+	"header-order": fieldHeaderOrder,
+}
+
+// Input is a parsed input line
+type Input struct {
+	Remote  string
+	XFF     string
+	URL     string
+	Time    string
+	Bytes   string
+	Status  string
+	User    string
+	Headers map[string]string
+
+	// ContentType is the Content-Type of the response
+	ContentType string
+
+	// Connections is the number of connections the client holds open as
+	// counted by the proxy
+	Connections string
+
+	// CacheStatus is the cache status logged by a CDN or caching proxy,
+	// see ParseCacheStatus
+	CacheStatus string
+
+	// HeaderOrder are the names of the request headers in the order the
+	// client sent them, separated by commas, see ClientFingerprint
+	HeaderOrder string
+}
+
+// ErrShortLine is returned for lines with fewer than two fields
+var ErrShortLine = errors.New("line has fewer than two fields")
+
+// ParseInputFormat parses a format description such as "remote|xff|header:Via|url"
+func ParseInputFormat(format string) (*InputFormat, error) {
+	fields := strings.Split(format, "|")
+	f := &InputFormat{
+		fields:  fields,
+		kinds:   make([]inputField, len(fields)),
+		headers: make([]string, len(fields)),
+	}
+	seen := map[string]bool{}
+
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		kind, ok := inputFields[field]
+		switch {
+		case ok:
+		case strings.HasPrefix(field, "header:") && len(field) > len("header:"):
+			kind = fieldHeader
+			f.headers[i] = textproto.CanonicalMIMEHeaderKey(field[len("header:"):])
+			field = "header:" + f.headers[i]
+		default:
+			return nil, configErrorf("invalid input field '%s'", field)
+		}
+
+		if field != "-" && seen[field] {
+			return nil, configErrorf("input field '%s' given twice", field)
+		}
+		seen[field] = true
+		fields[i] = field
+		f.kinds[i] = kind
+	}
+
+	if !seen["remote"] && !seen["xff"] {
+		return nil, configErrorf("the input format needs at least one of remote and xff")
+	}
+
+	return f, nil
+}
+
+// Fields returns the field names of the format
+func (f *InputFormat) Fields() []string {
+	return f.fields
+}
+
+// Has determines whether the format contains the given field
+func (f *InputFormat) Has(field string) bool {
+	for _, name := range f.fields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// HasHeader determines whether the format contains the given header
+func (f *InputFormat) HasHeader(name string) bool {
+	return f.Has("header:" + textproto.CanonicalMIMEHeaderKey(name))
+}
+
+// Parse splits a line according to the format. Missing trailing fields are
+// left empty.
+func (f *InputFormat) Parse(line string) (*Input, error) {
+	in := &Input{}
+	if err := f.ParseInto(line, in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// ParseInto is like Parse but fills in, which is reset first. The fields
+// refer to line rather than copying it, and the header map of in is reused,
+// so parsing into the same Input over and over doesn't allocate.
+func (f *InputFormat) ParseInto(line string, in *Input) error {
+	headers := in.Headers
+	for name := range headers {
+		delete(headers, name)
+	}
+	*in = Input{Headers: headers}
+
+	parts := 0
+	rest := line
+	for i, kind := range f.kinds {
+		part := rest
+		last := i == len(f.kinds)-1
+		if !last {
+			if j := strings.IndexByte(rest, '|'); j >= 0 {
+				part, rest = rest[:j], rest[j+1:]
+			} else {
+				last = true
+			}
+		}
+		parts++
+
+		switch kind {
+		case fieldRemote:
+			in.Remote = part
+		case fieldXFF:
+			in.XFF = part
+		case fieldURL:
+			in.URL = part
+		case fieldTime:
+			in.Time = part
+		case fieldBytes:
+			in.Bytes = part
+		case fieldStatus:
+			in.Status = part
+		case fieldUser:
+			in.User = part
+		case fieldContentType:
+			in.ContentType = part
+		case fieldConnections:
+			in.Connections = part
+		case fieldCacheStatus:
+			in.CacheStatus = part
+		case fieldHeaderOrder:
+			in.HeaderOrder = part
+		case fieldHeader:
+			if in.Headers == nil {
+				in.Headers = make(map[string]string)
+			}
+			in.Headers[f.headers[i]] = part
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if parts < 2 {
+		return ErrShortLine
+	}
+	return nil
+}
+
+// Header returns the value of a header, or an empty string if the format
+// doesn't contain it
+func (in *Input) Header(name string) string {
+	return in.Headers[textproto.CanonicalMIMEHeaderKey(name)]
+}
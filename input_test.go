@@ -0,0 +1,171 @@
+package botdetect
+
+import "testing"
+
+func TestParseInputFormat(t *testing.T) {
+	for _, format := range []string{"", "url", "remote|remote", "remote|header:", "remote|cookie"} {
+		if _, err := ParseInputFormat(format); err == nil {
+			t.Errorf("%q: expected an error", format)
+		}
+	}
+
+	f, err := ParseInputFormat("remote|xff|time|header:x-proxy-id|-|url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Has("time") || f.Has("-x") {
+		t.Error("expected the format to contain time")
+	}
+	if !f.HasHeader("X-Proxy-ID") {
+		t.Error("expected the format to contain X-Proxy-Id")
+	}
+}
+
+func TestInputFormatParse(t *testing.T) {
+	f, err := ParseInputFormat("remote|xff|header:Via|-|url")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := f.Parse("1.2.3.4|5.6.7.8|1.1 proxy|x|/a|b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Remote != "1.2.3.4" || in.XFF != "5.6.7.8" || in.URL != "/a|b" || in.Header("via") != "1.1 proxy" {
+		t.Errorf("unexpected input %+v", in)
+	}
+
+	in, err = f.Parse("1.2.3.4|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.URL != "" || in.Header("Via") != "" {
+		t.Errorf("unexpected input %+v", in)
+	}
+
+	if _, err := f.Parse("1.2.3.4"); err != ErrShortLine {
+		t.Errorf("expected ErrShortLine, got %v", err)
+	}
+
+	f, err = ParseInputFormat("remote|content-type|url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in, err := f.Parse("1.2.3.4|text/html; charset=utf-8|/a"); err != nil || in.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type in %+v: %v", in, err)
+	}
+
+	f, err = ParseInputFormat("remote|header-order|url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in, err := f.Parse("1.2.3.4|Host,User-Agent,Accept|/a"); err != nil || in.HeaderOrder != "Host,User-Agent,Accept" {
+		t.Errorf("unexpected header order in %+v: %v", in, err)
+	}
+}
+
+func TestInputFormatParseInto(t *testing.T) {
+	f, err := ParseInputFormat("remote|xff|time|bytes|status|user|header:Via|url")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &Input{}
+	line := "1.2.3.4|5.6.7.8|2024-01-02T03:04:05Z|512|401|alice|1.1 proxy|/login?a|b"
+	if err := f.ParseInto(line, in); err != nil {
+		t.Fatal(err)
+	}
+	expected := Input{Remote: "1.2.3.4", XFF: "5.6.7.8", Time: "2024-01-02T03:04:05Z", Bytes: "512",
+		Status: "401", User: "alice", URL: "/login?a|b"}
+	if in.Remote != expected.Remote || in.XFF != expected.XFF || in.Time != expected.Time || in.Bytes != expected.Bytes ||
+		in.Status != expected.Status || in.User != expected.User || in.URL != expected.URL || in.Header("Via") != "1.1 proxy" {
+		t.Errorf("unexpected input %+v", in)
+	}
+
+	// fields missing from the next line don't keep their earlier values
+	if err := f.ParseInto("9.9.9.9|", in); err != nil {
+		t.Fatal(err)
+	}
+	if in.Remote != "9.9.9.9" || in.URL != "" || in.User != "" || in.Header("Via") != "" {
+		t.Errorf("expected the input to be reset, got %+v", in)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := f.ParseInto(line, in); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %.1f", allocs)
+	}
+}
+
+func BenchmarkInputFormatParse(b *testing.B) {
+	f, _ := ParseInputFormat(DefaultInputFormat)
+	line := "203.0.113.7|198.51.100.1, 10.0.0.1|/products/42?page=3&sort=price"
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Parse(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInputFormatParseInto(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		format string
+		line   string
+	}{
+		{"default", DefaultInputFormat, "203.0.113.7|198.51.100.1, 10.0.0.1|/products/42?page=3&sort=price"},
+		{"extended", "remote|xff|time|bytes|status|user|header:User-Agent|header:Via|url",
+			"203.0.113.7|198.51.100.1|2024-01-02T03:04:05Z|5120|200|-|Mozilla/5.0 (X11; Linux x86_64)|1.1 proxy|/products/42?page=3"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			f, err := ParseInputFormat(bm.format)
+			if err != nil {
+				b.Fatal(err)
+			}
+			in := &Input{}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bm.line)))
+			for i := 0; i < b.N; i++ {
+				if err := f.ParseInto(bm.line, in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzInputFormatParse(f *testing.F) {
+	f.Add("remote|xff|url", "1.2.3.4|5.6.7.8|/a")
+	f.Add("remote|xff|time|bytes|status|user|header:Via|url", "1.2.3.4|-|2024-01-02T03:04:05Z|512|401|alice|1.1 proxy|/login?a|b")
+	f.Add("xff|-|header:Forwarded|url", "||for=\"[::1]\"|")
+	f.Add("remote|url", "")
+
+	f.Fuzz(func(t *testing.T, format, line string) {
+		ff, err := ParseInputFormat(format)
+		if err != nil {
+			return
+		}
+
+		in, err := ff.Parse(line)
+		reused := &Input{Headers: map[string]string{"Stale": "x"}}
+		if errInto := ff.ParseInto(line, reused); (err == nil) != (errInto == nil) {
+			t.Fatalf("Parse and ParseInto disagree: %v, %v", err, errInto)
+		}
+		if err != nil {
+			return
+		}
+		if reused.Header("Stale") != "" {
+			t.Fatal("ParseInto kept a header of the previous line")
+		}
+		if in.Remote != reused.Remote || in.XFF != reused.XFF || in.URL != reused.URL || in.Time != reused.Time ||
+			in.Bytes != reused.Bytes || in.Status != reused.Status || in.User != reused.User {
+			t.Fatalf("Parse and ParseInto disagree: %+v, %+v", in, reused)
+		}
+	})
+}
@@ -0,0 +1,17 @@
+// Package integration contains end-to-end tests that put reverse proxies in
+// front of a test upstream and let them ask a botdetect binary about every
+// request through its /auth endpoint:
+//
+//   - nginx with auth_request
+//   - Envoy with the ext_authz HTTP service
+//   - HAProxy with the haproxy-auth-request Lua script, in an image built
+//     from testdata/haproxy.Dockerfile
+//
+// The proxies run in docker containers on the host network, so the tests
+// need Linux and a docker daemon. They are behind the integration build tag:
+//
+//	go test -tags integration -v ./integration
+//
+// Tests are skipped if docker isn't available. HAProxy talks to /auth like
+// the others rather than through SPOE, which botdetect doesn't implement.
+package integration
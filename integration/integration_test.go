@@ -0,0 +1,284 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blocked is on the manual list of every botdetect started by the tests
+const blocked = "203.0.113.66"
+
+// binary is the botdetect binary built for the tests
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "botdetect-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	binary = filepath.Join(dir, "botdetect")
+	build := exec.Command("go", "build", "-o", binary, "../cmd/botdetect")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "building botdetect:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestNginx(t *testing.T) {
+	requireDocker(t)
+
+	ports := map[string]int{"botdetect": startBotdetect(t), "upstream": startUpstream(t), "proxy": freePort(t)}
+	runProxy(t, "nginx:1.25-alpine", "nginx.conf", "/etc/nginx/nginx.conf", ports)
+	checkProxy(t, ports["proxy"])
+}
+
+func TestEnvoy(t *testing.T) {
+	requireDocker(t)
+
+	ports := map[string]int{"botdetect": startBotdetect(t), "upstream": startUpstream(t), "proxy": freePort(t)}
+	runProxy(t, "envoyproxy/envoy:v1.28-latest", "envoy.yaml", "/etc/envoy/envoy.yaml", ports)
+	checkProxy(t, ports["proxy"])
+}
+
+func TestHAProxy(t *testing.T) {
+	requireDocker(t)
+
+	image := buildImage(t, "haproxy.Dockerfile", "botdetect-integration-haproxy")
+	ports := map[string]int{"botdetect": startBotdetect(t), "upstream": startUpstream(t), "proxy": freePort(t)}
+	runProxy(t, image, "haproxy.cfg", "/usr/local/etc/haproxy/haproxy.cfg", ports)
+	checkProxy(t, ports["proxy"])
+}
+
+// checkProxy asserts that the proxy forwards requests of good clients to the
+// upstream, rejects those of manually blocked ones and starts rejecting a
+// client once it exceeds the rule
+func checkProxy(t *testing.T, port int) {
+	t.Helper()
+
+	if status, body := get(t, port, "198.51.100.1"); status != http.StatusOK || body != "upstream none" {
+		t.Errorf("expected the upstream to answer a good client and see its annotations, got %d %q", status, body)
+	}
+	if status, _ := get(t, port, blocked); status != http.StatusForbidden {
+		t.Errorf("expected 403 for the manually blocked client, got %d", status)
+	}
+
+	// the rule allows 5 requests, the blacklist is built every 100ms
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 1; ; i++ {
+		status, _ := get(t, port, "198.51.100.2")
+		if status == http.StatusForbidden {
+			if i <= 5 {
+				t.Errorf("expected the client to be blocked only after 5 requests, got blocked after %d", i)
+			}
+			break
+		}
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status %d for request %d", status, i)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the client to be blocked, still allowed after %d requests", i)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// get requests / through the proxy on behalf of the client IP and returns
+// the status and body
+func get(t *testing.T, port int, client string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", client)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+// requireDocker skips the test unless a docker daemon can be reached
+func requireDocker(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker daemon not available")
+	}
+}
+
+// startBotdetect runs the binary with a manual list blocking blocked, a rule
+// blacklisting IPs after 5 requests and annotations, and returns its port
+func startBotdetect(t *testing.T) int {
+	t.Helper()
+
+	manual := filepath.Join(t.TempDir(), "manual.txt")
+	if err := os.WriteFile(manual, []byte(blocked+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	cmd := exec.Command(binary,
+		"-listen=127.0.0.1:"+strconv.Itoa(port),
+		"-manual-list="+manual,
+		"-max-requests=5",
+		"-max-ratio=0.5",
+		"-interval=100ms",
+		"-annotate",
+	)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+
+	// botdetect exits at the end of its input, the pipe keeps it open
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	waitFor(t, fmt.Sprintf("http://127.0.0.1:%d/readyz", port), http.StatusOK)
+	return port
+}
+
+// startUpstream runs the server behind the proxies and returns its port. It
+// answers with the flags botdetect annotated the request with.
+func startUpstream(t *testing.T) int {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "upstream", r.Header.Get("X-Botdetect-Flags"))
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return port
+}
+
+// buildImage builds the Dockerfile in testdata as the tag and returns it
+func buildImage(t *testing.T, dockerfile, tag string) string {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	build := exec.CommandContext(ctx, "docker", "build", "-t", tag, "-")
+	build.Stdin = f
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %s: %s", tag, err, out)
+	}
+	return tag
+}
+
+// runProxy renders the configuration in testdata with the ports, mounts it
+// at target in a container of the image on the host network and waits for
+// the proxy to answer
+func runProxy(t *testing.T, image, config, target string, ports map[string]int) {
+	t.Helper()
+
+	tmpl, err := os.ReadFile(filepath.Join("testdata", config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := string(tmpl)
+	for name, port := range ports {
+		rendered = strings.ReplaceAll(rendered, "{{"+name+"}}", strconv.Itoa(port))
+	}
+	path := filepath.Join(t.TempDir(), config)
+	if err := os.WriteFile(path, []byte(rendered), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "run", "-d", "--rm", "--network", "host",
+		"-v", path+":"+target+":ro", image).CombinedOutput()
+	if err != nil {
+		t.Fatalf("starting %s: %s: %s", image, err, out)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if t.Failed() {
+			logs, _ := exec.Command("docker", "logs", id).CombinedOutput()
+			t.Logf("%s logs:\n%s", image, logs)
+		}
+		exec.Command("docker", "rm", "-f", id).Run()
+	})
+
+	waitFor(t, fmt.Sprintf("http://127.0.0.1:%d/", ports["proxy"]), 0)
+}
+
+// waitFor polls the URL until it answers with the status, or with anything
+// if status is 0
+func waitFor(t *testing.T, url string, status int) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if status == 0 || resp.StatusCode == status {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not ready: %v", url, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -18,7 +18,11 @@
 
 package botdetect
 
-import "net"
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
 
 var privateNetworks = []string{
 	"127.0.0.0/8",    // IPv4 loopback
@@ -37,15 +41,17 @@ type IP struct {
 }
 
 // NewIP creates a new IP structure
-func NewIP() *IP {
-	var ipnet *net.IPNet
+func NewIP() (*IP, error) {
 	privnets := make([]*net.IPNet, len(privateNetworks), len(privateNetworks))
 	for i, n := range privateNetworks {
-		_, ipnet, _ = net.ParseCIDR(n)
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, invalidIPErrorf("invalid private network '%s': %w", n, err)
+		}
 		privnets[i] = ipnet
 	}
 
-	return &IP{privateNetworks: privnets}
+	return &IP{privateNetworks: privnets}, nil
 }
 
 // IsPrivate checks whether a given IP address is privte
@@ -67,3 +73,79 @@ func (i *IP) Network(ip net.IP) *net.IPNet {
 	}
 	return nil
 }
+
+// CanonicalAddr converts an IP into the address used as key throughout the
+// package. IPv4-mapped IPv6 addresses are unmapped, so 1.2.3.4 and
+// ::ffff:1.2.3.4 always end up as the same address.
+func CanonicalAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// ParseCanonicalAddr parses the textual form of an IP, optionally enclosed in
+// brackets, and returns its canonical address. Zones are dropped.
+func ParseCanonicalAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, &Error{Kind: ErrInvalidIP, Err: err}
+	}
+	return addr.WithZone("").Unmap(), nil
+}
+
+// ParseIP parses an IP the way it shows up in logs and forwarding headers:
+// optionally with a port ("192.0.2.1:8080"), enclosed in brackets
+// ("[2001:db8::1]", "[2001:db8::1]:443") and, for scoped IPv6 addresses, with
+// a zone ("fe80::1%eth0", also percent-encoded as in "fe80::1%25eth0"). The
+// zone is dropped since it only means something on the host that logged the
+// address. ParseIP returns nil if s is none of these.
+func ParseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := parseScopedIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return parseScopedIP(host)
+	}
+	return nil
+}
+
+// parseScopedIP parses an IP without a port, optionally enclosed in brackets
+// and with a zone if it is an IPv6 address
+func parseScopedIP(s string) net.IP {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		// IPv4 addresses have no zones, and a zone isn't empty
+		if !strings.Contains(s[:i], ":") || i == len(s)-1 {
+			return nil
+		}
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// ipKey returns the canonical string form of an IP for maps keyed by IP
+func ipKey(ip net.IP) string {
+	if addr, ok := CanonicalAddr(ip); ok {
+		return addr.String()
+	}
+	return ip.String()
+}
+
+// addrFromIP converts an IP into the 16 byte netip representation used by
+// the range tables
+func addrFromIP(ip net.IP) (netip.Addr, bool) {
+	addr, ok := CanonicalAddr(ip)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom16(addr.As16()), true
+}
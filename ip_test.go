@@ -0,0 +1,95 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCanonicalAddr(t *testing.T) {
+	for _, s := range []string{"1.2.3.4", "::ffff:1.2.3.4", "::FFFF:1.2.3.4", " 1.2.3.4 ", "[::ffff:1.2.3.4]"} {
+		addr, err := ParseCanonicalAddr(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if addr.String() != "1.2.3.4" {
+			t.Errorf("%q: expected 1.2.3.4, got %s", s, addr)
+		}
+	}
+
+	for _, s := range []string{"2001:DB8::0001", "[2001:db8::1]", "2001:db8:0:0:0:0:0:1", "fe80::1%eth0"} {
+		addr, err := ParseCanonicalAddr(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		want := "2001:db8::1"
+		if s == "fe80::1%eth0" {
+			want = "fe80::1"
+		}
+		if addr.String() != want {
+			t.Errorf("%q: expected %s, got %s", s, want, addr)
+		}
+	}
+
+	if _, err := ParseCanonicalAddr("1.2.3"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+
+	v4, _ := CanonicalAddr(net.IP{1, 2, 3, 4})
+	mapped, _ := CanonicalAddr(net.ParseIP("::ffff:1.2.3.4"))
+	if v4 != mapped {
+		t.Errorf("expected %s and %s to be the same address", v4, mapped)
+	}
+	if _, ok := CanonicalAddr(net.IP{1, 2, 3}); ok {
+		t.Error("expected an invalid IP to be rejected")
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	for s, want := range map[string]string{
+		"192.0.2.1":              "192.0.2.1",
+		" 192.0.2.1:8080 ":       "192.0.2.1",
+		"2001:db8::1":            "2001:db8::1",
+		"[2001:db8::1]":          "2001:db8::1",
+		"[2001:db8::1]:443":      "2001:db8::1",
+		"fe80::1%eth0":           "fe80::1",
+		"fe80::1%25eth0":         "fe80::1",
+		"[fe80::1%eth0]:8080":    "fe80::1",
+		"::ffff:192.0.2.1":       "192.0.2.1",
+		"[::ffff:192.0.2.1]:443": "192.0.2.1",
+	} {
+		if ip := ParseIP(s); !ip.Equal(net.ParseIP(want)) {
+			t.Errorf("%q: expected %s, got %s", s, want, ip)
+		}
+	}
+
+	for _, s := range []string{"", "unknown", "_hidden", "192.0.2.1%eth0", "fe80::1%", "[2001:db8::1", "192.0.2", "example.com:80"} {
+		if ip := ParseIP(s); ip != nil {
+			t.Errorf("%q: expected nil, got %s", s, ip)
+		}
+	}
+}
+
+func TestCanonicalKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBlacklist(ctx, time.Hour, time.Hour)
+	b.Set(net.IP{192, 0, 2, 1})
+	if !b.IsBlacklisted(net.ParseIP("::ffff:192.0.2.1")) {
+		t.Error("expected the IPv4-mapped form to be blacklisted as well")
+	}
+	b.Set(net.ParseIP("::ffff:192.0.2.1"))
+	if b.Size() != 1 {
+		t.Errorf("expected both forms to share one entry, got %d", b.Size())
+	}
+
+	al := NewAuditLog(10, 10)
+	al.Record(net.ParseIP("::ffff:192.0.2.1"), AuditEntry{Decision: "blacklisted"})
+	if len(al.Entries(net.IP{192, 0, 2, 1})) != 1 {
+		t.Error("expected the audit entry to be found by the IPv4 form")
+	}
+}
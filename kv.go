@@ -0,0 +1,332 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KVWait is the longest a KVStore waits for a change before it returns
+const KVWait = 5 * time.Minute
+
+// KVStore is a central key-value store, such as etcd or Consul, that holds
+// configuration shared by a fleet of instances
+type KVStore interface {
+	// List returns the values of all keys starting with the prefix and a
+	// version to wait for changes from
+	List(ctx context.Context, prefix string) (map[string][]byte, uint64, error)
+
+	// Wait returns when the keys starting with the prefix may have changed
+	// since the version, at the latest after KVWait
+	Wait(ctx context.Context, prefix string, version uint64) error
+}
+
+// WatchKV calls load with the values of all keys starting with the prefix,
+// keyed by their names without it, first with the current values and then
+// whenever they change, until the context is done. Errors are passed to
+// onError and the store is asked again after retry; a failed load is retried
+// on the next change.
+func WatchKV(ctx context.Context, store KVStore, prefix string, retry time.Duration, load func(map[string][]byte) error, onError func(error)) {
+	var last map[string][]byte
+
+	for {
+		values, version, err := store.List(ctx, prefix)
+		if err == nil {
+			if last == nil || !equalKV(values, last) {
+				last = values
+				if err := load(values); err != nil {
+					onError(err)
+				}
+			}
+			err = store.Wait(ctx, prefix, version)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+
+		onError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func equalKV(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// ConsulKV reads keys from the KV store of Consul through its HTTP API and
+// waits for changes with blocking queries
+type ConsulKV struct {
+	// URL is the address of the Consul agent, e.g. http://127.0.0.1:8500
+	URL string
+
+	// Token is the ACL token, if any
+	Token  string
+	Client *http.Client
+}
+
+// NewConsulKV creates a ConsulKV for the agent at url
+func NewConsulKV(url string) *ConsulKV {
+	return &ConsulKV{URL: url, Client: http.DefaultClient}
+}
+
+type consulKey struct {
+	Key   string
+	Value []byte
+}
+
+// List returns the values of all keys starting with the prefix and the
+// index of the query
+func (c *ConsulKV) List(ctx context.Context, prefix string) (map[string][]byte, uint64, error) {
+	return c.query(ctx, prefix, 0)
+}
+
+// Wait returns when the index of the keys starting with the prefix has
+// changed
+func (c *ConsulKV) Wait(ctx context.Context, prefix string, version uint64) error {
+	// an index of 0 wouldn't block
+	if version == 0 {
+		version = 1
+	}
+	_, _, err := c.query(ctx, prefix, version)
+	return err
+}
+
+// query lists the keys, blocking until their index differs from index
+// unless it is 0
+func (c *ConsulKV) query(ctx context.Context, prefix string, index uint64) (map[string][]byte, uint64, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", KVWait.String())
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, KVWait+time.Minute)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(c.URL, "/")+"/v1/kv/"+prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	// the index only ever goes backwards if the data was reset, in which
+	// case the next query starts over
+	version, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if version < index {
+		version = 0
+	}
+
+	keys := []consulKey{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", c.URL, err)
+		}
+	case http.StatusNotFound:
+		// no key starts with the prefix
+	default:
+		return nil, 0, fmt.Errorf("%s responded with %s", c.URL, resp.Status)
+	}
+
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		// folders have no value
+		if k.Value != nil {
+			values[strings.TrimPrefix(k.Key, prefix)] = k.Value
+		}
+	}
+	return values, version, nil
+}
+
+// EtcdKV reads keys from etcd through the JSON gateway of its v3 API and
+// waits for changes with watches, so that no etcd client is needed
+type EtcdKV struct {
+	// URL is the address of an etcd member, e.g. http://127.0.0.1:2379
+	URL string
+
+	// Token is an authentication token, if any
+	Token  string
+	Client *http.Client
+}
+
+// NewEtcdKV creates an EtcdKV for the member at url
+func NewEtcdKV(url string) *EtcdKV {
+	return &EtcdKV{URL: url, Client: http.DefaultClient}
+}
+
+// etcd encodes keys and values in base64, as encoding/json does with []byte,
+// and 64 bit integers as strings
+type etcdRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest struct {
+		etcdRange
+		StartRevision string `json:"start_revision"`
+	} `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Canceled     bool              `json:"canceled"`
+		CancelReason string            `json:"cancel_reason"`
+		Events       []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// List returns the values of all keys starting with the prefix and the
+// revision of the store
+func (e *EtcdKV) List(ctx context.Context, prefix string) (map[string][]byte, uint64, error) {
+	resp, err := e.post(ctx, "/v3/kv/range", etcdPrefix(prefix))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var r etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", e.URL, err)
+	}
+	revision, err := strconv.ParseUint(r.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: invalid revision '%s'", e.URL, r.Header.Revision)
+	}
+
+	values := make(map[string][]byte, len(r.KVs))
+	for _, kv := range r.KVs {
+		values[strings.TrimPrefix(string(kv.Key), prefix)] = kv.Value
+	}
+	return values, revision, nil
+}
+
+// Wait watches the keys starting with the prefix from the revision after
+// version until one of them changes
+func (e *EtcdKV) Wait(ctx context.Context, prefix string, version uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, KVWait)
+	defer cancel()
+
+	var watch etcdWatchRequest
+	watch.CreateRequest.etcdRange = etcdPrefix(prefix)
+	watch.CreateRequest.StartRevision = strconv.FormatUint(version+1, 10)
+
+	resp, err := e.post(ctx, "/v3/watch", watch)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the watch streams one response per line, starting with the one
+	// confirming its creation
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var r etcdWatchResponse
+		err := decoder.Decode(&r)
+		if err == io.EOF || (err != nil && ctx.Err() == context.DeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.URL, err)
+		}
+
+		switch {
+		case r.Error != nil:
+			return fmt.Errorf("%s: %s", e.URL, r.Error.Message)
+		case r.Result.Canceled:
+			// e.g. the revision has been compacted, which is no
+			// reason to wait any longer
+			return nil
+		case len(r.Result.Events) > 0:
+			return nil
+		}
+	}
+}
+
+func (e *EtcdKV) post(ctx context.Context, path string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.Token != "" {
+		req.Header.Set("Authorization", e.Token)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s responded with %s", e.URL, resp.Status)
+	}
+	return resp, nil
+}
+
+// etcdPrefix returns the range of all keys starting with the prefix: up to
+// the prefix with its last byte below 0xff incremented, or all keys from the
+// prefix on if there is none
+func etcdPrefix(prefix string) etcdRange {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return etcdRange{Key: []byte(prefix), RangeEnd: end[:i+1]}
+		}
+	}
+	return etcdRange{Key: []byte(prefix), RangeEnd: []byte{0}}
+}
@@ -0,0 +1,202 @@
+package botdetect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is the state shared by the fake Consul and etcd servers
+type fakeKV struct {
+	sync.Mutex
+	index   uint64
+	values  map[string]string
+	changed chan struct{}
+}
+
+func newFakeKV(values map[string]string) *fakeKV {
+	return &fakeKV{index: 1, values: values, changed: make(chan struct{})}
+}
+
+func (f *fakeKV) set(key, value string) {
+	f.Lock()
+	f.values[key] = value
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.Unlock()
+}
+
+// wait blocks until the index is greater than index, at the latest for a
+// second
+func (f *fakeKV) wait(index uint64) {
+	f.Lock()
+	current, changed := f.index, f.changed
+	f.Unlock()
+	if current <= index {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (f *fakeKV) list(prefix string) (map[string]string, uint64) {
+	f.Lock()
+	defer f.Unlock()
+	values := map[string]string{}
+	for k, v := range f.values {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = v
+		}
+	}
+	return values, f.index
+}
+
+func TestConsulKV(t *testing.T) {
+	kv := newFakeKV(map[string]string{"botdetect/rules": "1m 10 0.5", "other/key": "x"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		if index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); err == nil {
+			kv.wait(index)
+		}
+
+		values, index := kv.list(strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		keys := []consulKey{{Key: "botdetect/"}}
+		for k, v := range values {
+			keys = append(keys, consulKey{Key: k, Value: []byte(v)})
+		}
+		json.NewEncoder(w).Encode(keys)
+	}))
+	defer server.Close()
+
+	consul := NewConsulKV(server.URL)
+	if _, _, err := consul.List(context.Background(), "botdetect/"); err == nil {
+		t.Error("expected an error without the token")
+	}
+	consul.Token = "secret"
+
+	values, _, err := consul.List(context.Background(), "botdetect/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values["rules"]) != "1m 10 0.5" {
+		t.Errorf("unexpected values %q", values)
+	}
+
+	testWatchKV(t, consul, kv)
+}
+
+func TestEtcdKV(t *testing.T) {
+	kv := newFakeKV(map[string]string{"botdetect/rules": "1m 10 0.5", "other/key": "x"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var req etcdRange
+			json.NewDecoder(r.Body).Decode(&req)
+			if want := etcdPrefix("botdetect/"); string(req.Key) != string(want.Key) || string(req.RangeEnd) != string(want.RangeEnd) {
+				http.Error(w, "unexpected range", http.StatusBadRequest)
+				return
+			}
+
+			values, index := kv.list(string(req.Key))
+			var resp etcdRangeResponse
+			resp.Header.Revision = strconv.FormatUint(index, 10)
+			for k, v := range values {
+				resp.KVs = append(resp.KVs, struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+				}{[]byte(k), []byte(v)})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v3/watch":
+			var req etcdWatchRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			start, _ := strconv.ParseUint(req.CreateRequest.StartRevision, 10, 64)
+
+			fmt.Fprintln(w, `{"result":{"header":{"revision":"1"},"created":true}}`)
+			w.(http.Flusher).Flush()
+			kv.wait(start - 1)
+			if _, index := kv.list(""); index >= start {
+				fmt.Fprintln(w, `{"result":{"header":{"revision":"2"},"events":[{"kv":{"key":"Ym90ZGV0ZWN0L3J1bGVz"}}]}}`)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	etcd := NewEtcdKV(server.URL)
+	values, _, err := etcd.List(context.Background(), "botdetect/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values["rules"]) != "1m 10 0.5" {
+		t.Errorf("unexpected values %q", values)
+	}
+
+	testWatchKV(t, etcd, kv)
+}
+
+// testWatchKV watches the prefix botdetect/ and expects a load with the
+// current values and one after every change
+func testWatchKV(t *testing.T, store KVStore, kv *fakeKV) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	loads := make(chan map[string][]byte, 10)
+	go WatchKV(ctx, store, "botdetect/", time.Millisecond, func(values map[string][]byte) error {
+		loads <- values
+		return nil
+	}, func(err error) {
+		t.Error(err)
+	})
+
+	next := func() map[string][]byte {
+		select {
+		case values := <-loads:
+			return values
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a load")
+			return nil
+		}
+	}
+
+	if values := next(); string(values["rules"]) != "1m 10 0.5" {
+		t.Errorf("unexpected initial values %q", values)
+	}
+	kv.set("botdetect/manual-list", "192.0.2.1")
+	if values := next(); len(values) != 2 || string(values["manual-list"]) != "192.0.2.1" {
+		t.Errorf("unexpected values after the change %q", values)
+	}
+
+	// changes outside of the prefix don't cause a load
+	kv.set("other/key", "y")
+	kv.set("botdetect/rules", "1m 20 0.5")
+	if values := next(); string(values["rules"]) != "1m 20 0.5" {
+		t.Errorf("unexpected values after the second change %q", values)
+	}
+}
+
+func TestEtcdPrefix(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"botdetect/": "botdetect0",
+		"a\xff":      "b",
+		"\xff":       "\x00",
+	} {
+		if r := etcdPrefix(prefix); string(r.RangeEnd) != end {
+			t.Errorf("%q: expected the range to end at %q, got %q", prefix, end, r.RangeEnd)
+		}
+	}
+}
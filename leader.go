@@ -0,0 +1,206 @@
+package botdetect
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LeaderElector decides whether this instance is the one that should run
+// the blacklist calculation. When several replicas share their state only the
+// leader needs to evaluate the rules while every replica keeps answering
+// lookups.
+type LeaderElector interface {
+	IsLeader() bool
+}
+
+// LeaderNamer is implemented by electors that know which instance leads,
+// like LeaseElector. With Replication without a Ring and a store that
+// implements HandoffStore, the other replicas then publish the slots of the
+// IPs they received requests from and hand the IPs over to the leader, which
+// evaluates them with the counts of all replicas. The names of the leaders
+// have to be the replica names.
+type LeaderNamer interface {
+	Leader() string
+}
+
+// alwaysLeader is used when no leader election is configured
+type alwaysLeader struct{}
+
+func (alwaysLeader) IsLeader() bool {
+	return true
+}
+
+func (h *IPHistory) leader() LeaderElector {
+	if h.opts().Leader == nil {
+		return alwaysLeader{}
+	}
+	return h.opts().Leader
+}
+
+// namedLeader returns the name of the leader the IPs go to, if the elector
+// knows it and the store takes them
+func (h *IPHistory) namedLeader() (string, HandoffStore, bool) {
+	o := h.opts()
+	namer, ok := o.Leader.(LeaderNamer)
+	if !ok || o.Replication == nil || o.Replication.Ring != nil {
+		return "", nil, false
+	}
+	store, ok := o.Replication.Store.(HandoffStore)
+	if !ok {
+		return "", nil, false
+	}
+	return namer.Leader(), store, true
+}
+
+// LeaseStore keeps leases shared by the replicas, e.g. in Redis. A lease is
+// held by one holder until it expires or is released.
+type LeaseStore interface {
+	// Acquire takes the lease for the holder for ttl if it is free or held
+	// by the holder already, and returns who holds it afterwards
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (string, error)
+
+	// Release gives up the lease if the holder holds it
+	Release(ctx context.Context, name, holder string) error
+}
+
+// LeaseElector elects the leader by a lease in a LeaseStore: whoever holds
+// it leads, and renews it every third of its TTL. A leader that can't renew
+// the lease steps down when it would expire, before another replica can
+// take it over, as long as the clocks run at the same pace.
+type LeaseElector struct {
+	store  LeaseStore
+	name   string
+	holder string
+	ttl    time.Duration
+
+	// Timeout limits each exchange with the store, a third of the TTL by
+	// default
+	Timeout time.Duration
+
+	// OnError is called when the store fails if set
+	OnError func(err error)
+
+	mutex  sync.Mutex
+	leader string
+	until  time.Time
+}
+
+// NewLeaseElector creates an elector campaigning for the lease of the name
+// as holder, usually the replica name
+func NewLeaseElector(store LeaseStore, name, holder string, ttl time.Duration) (*LeaseElector, error) {
+	if store == nil || name == "" || holder == "" {
+		return nil, configErrorf("a lease requires a store, a name and a holder")
+	}
+	if ttl <= 0 {
+		return nil, configErrorf("lease TTL must be greater than zero")
+	}
+	return &LeaseElector{store: store, name: name, holder: holder, ttl: ttl, Timeout: ttl / 3}, nil
+}
+
+// Run campaigns for the lease until the context is done, then releases it
+func (e *LeaseElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.mutex.Lock()
+			e.leader, e.until = "", time.Time{}
+			e.mutex.Unlock()
+
+			release, cancel := context.WithTimeout(context.Background(), e.Timeout)
+			if err := e.store.Release(release, e.name, e.holder); err != nil {
+				e.error(err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign acquires or renews the lease
+func (e *LeaseElector) campaign(ctx context.Context) {
+	// the lease runs from before it was asked for
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	leader, err := e.store.Acquire(ctx, e.name, e.holder, e.ttl)
+	if err != nil {
+		e.error(err)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.leader, e.until = leader, start.Add(e.ttl)
+}
+
+func (e *LeaseElector) error(err error) {
+	if e.OnError != nil {
+		e.OnError(storeError(err))
+	}
+}
+
+// IsLeader returns whether this instance holds the lease
+func (e *LeaseElector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leader == e.holder && time.Now().Before(e.until)
+}
+
+// Leader returns the holder of the lease as of the last exchange with the
+// store, empty if it isn't known
+func (e *LeaseElector) Leader() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !time.Now().Before(e.until) {
+		return ""
+	}
+	return e.leader
+}
+
+// MemoryLeaseStore is a LeaseStore for replicas within one process and a
+// reference for implementations backed by shared storage
+type MemoryLeaseStore struct {
+	mutex  sync.Mutex
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	holder string
+	until  time.Time
+}
+
+// NewMemoryLeaseStore creates an empty MemoryLeaseStore
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: make(map[string]memoryLease)}
+}
+
+// Acquire takes or renews the lease unless another holder has it
+func (s *MemoryLeaseStore) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if l, ok := s.leases[name]; ok && l.holder != holder && now.Before(l.until) {
+		return l.holder, nil
+	}
+	s.leases[name] = memoryLease{holder: holder, until: now.Add(ttl)}
+	return holder, nil
+}
+
+// Release gives up the lease if the holder has it
+func (s *MemoryLeaseStore) Release(ctx context.Context, name, holder string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.leases[name].holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseElector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryLeaseStore()
+	a, err := NewLeaseElector(store, "calculate", "a", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLeaseElector(store, "calculate", "b", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actx, stopA := context.WithCancel(ctx)
+	go a.Run(actx)
+	waitFor(t, a.IsLeader)
+	go b.Run(ctx)
+	waitFor(t, func() bool { return b.Leader() == "a" })
+	if b.IsLeader() {
+		t.Error("expected only one leader")
+	}
+
+	// the lease is renewed beyond its TTL
+	time.Sleep(400 * time.Millisecond)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Error("expected the leader to keep the lease")
+	}
+
+	// a leader that stops releases the lease
+	stopA()
+	waitFor(t, b.IsLeader)
+	if a.IsLeader() {
+		t.Error("expected the stopped elector not to lead")
+	}
+
+	if _, err := NewLeaseElector(store, "calculate", "", time.Second); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error without a holder, got %v", err)
+	}
+}
+
+// flakyLeaseStore fails while down is set
+type flakyLeaseStore struct {
+	*MemoryLeaseStore
+	down int32
+}
+
+func (s *flakyLeaseStore) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (string, error) {
+	if atomic.LoadInt32(&s.down) == 1 {
+		return "", errors.New("unavailable")
+	}
+	return s.MemoryLeaseStore.Acquire(ctx, name, holder, ttl)
+}
+
+func TestLeaseElectorStepsDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &flakyLeaseStore{MemoryLeaseStore: NewMemoryLeaseStore()}
+	e, err := NewLeaseElector(store, "calculate", "a", 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 100)
+	e.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	go e.Run(ctx)
+	waitFor(t, e.IsLeader)
+
+	// a leader that can't renew the lease steps down before it expires
+	// in the store
+	atomic.StoreInt32(&store.down, 1)
+	start := time.Now()
+	waitFor(t, func() bool { return !e.IsLeader() })
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("expected the leader to step down within the TTL, took %s", time.Since(start))
+	}
+	if err := <-errs; !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected the store to be unavailable, got %v", err)
+	}
+	if e.Leader() != "" {
+		t.Errorf("expected the leader to be unknown, got %s", e.Leader())
+	}
+
+	atomic.StoreInt32(&store.down, 0)
+	waitFor(t, e.IsLeader)
+}
+
+func TestRedisLease(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	store := NewRedisStore(newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}}), "bd:", time.Hour)
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		holder, leader string
+	}{
+		{"a", "a"},
+		{"b", "a"},
+		{"a", "a"},
+	} {
+		leader, err := store.Acquire(ctx, "calculate", step.holder, time.Minute)
+		if err != nil || leader != step.leader {
+			t.Errorf("%s: expected %s to lead, got %s, %v", step.holder, step.leader, leader, err)
+		}
+	}
+
+	// only the holder can release the lease
+	if err := store.Release(ctx, "calculate", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, _ := store.Acquire(ctx, "calculate", "b", time.Minute); leader != "a" {
+		t.Errorf("expected a to keep the lease, got %s", leader)
+	}
+	if err := store.Release(ctx, "calculate", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, _ := store.Acquire(ctx, "calculate", "b", time.Minute); leader != "b" {
+		t.Errorf("expected b to take the released lease, got %s", leader)
+	}
+}
+
+// fixedLeader leads if it is the named replica
+type fixedLeader struct {
+	self, leader string
+}
+
+func (l fixedLeader) IsLeader() bool { return l.self == l.leader }
+func (l fixedLeader) Leader() string { return l.leader }
+
+func TestLeaderCalculate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counts := NewMemoryCounterStore()
+	blacklists := NewMemoryBlacklistStore()
+	replica := func(name string) *IPHistory {
+		h, err := NewIPHistory(ctx, &IPHistoryOptions{
+			TimestampFormat: "15:04",
+			TimeSlot:        time.Minute,
+			Window:          time.Hour,
+			Interval:        time.Hour,
+			ExpireInterval:  time.Hour,
+			BlacklistTTL:    time.Hour,
+			MaxRequests:     15,
+			Metrics:         NewMetrics(),
+			Leader:          fixedLeader{self: name, leader: "a"},
+			Replication:     &ReplicationOptions{Store: counts, Replica: name, Timeout: time.Second},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go h.Blacklist().Share(ctx, &SharedBlacklistOptions{Store: blacklists, Timeout: time.Second})
+		return h
+	}
+	a, b := replica("a"), replica("b")
+
+	// the follower receives enough requests to blacklist the IP on its own
+	// and some go to the leader
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 20; i++ {
+		b.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	}
+	for i := 0; i < 5; i++ {
+		a.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	}
+	for a.Processed() < 5 || b.Processed() < 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the follower doesn't evaluate the rules but hands the IP over
+	b.TriggerCalculate()
+	if b.Blacklist().Size() != 0 || b.IsBlacklisted(ip) {
+		t.Fatal("expected the follower not to blacklist the IP")
+	}
+	if n := b.handed.Values()[""]; n != 1 {
+		t.Errorf("expected one IP to be handed over, got %d", n)
+	}
+
+	// the leader blacklists it with the counts of both
+	a.TriggerCalculate()
+	if a.Blacklist().Size() != 1 {
+		t.Fatal("expected the leader to blacklist the IP")
+	}
+	entries := a.Blacklist().SnapshotList()
+	if !entries[0].IP.Equal(ip) {
+		t.Errorf("unexpected entries %v", entries)
+	}
+
+	// the follower answers lookups from the shared blacklist
+	waitFor(t, func() bool { return b.IsBlacklisted(ip) })
+	if b.Blacklist().Size() != 0 {
+		t.Error("expected the follower's own blacklist to stay empty")
+	}
+}
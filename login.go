@@ -0,0 +1,189 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoginOptions configures the LoginGuard. A limit of zero disables it.
+type LoginOptions struct {
+	// Endpoints are the paths of the login endpoints. A trailing '*'
+	// matches every path with the prefix.
+	Endpoints []string
+
+	// FailureStatus are the response status codes of failed logins
+	FailureStatus []int
+
+	// Window is the time over which failed logins are counted
+	Window time.Duration
+
+	// MaxFailures limits the failed logins per IP
+	MaxFailures int
+
+	// MaxUserFailures limits the failed logins per user name across all
+	// IPs. IPs failing for a user name beyond the limit are flagged.
+	MaxUserFailures int
+
+	// MaxUsers limits the number of user names an IP failed to log in as
+	MaxUsers int
+}
+
+// LoginGuard tracks failed logins per IP and per user name to detect
+// credential stuffing and brute force attacks. IPs exceeding a limit are
+// flagged for the rest of the window.
+type LoginGuard struct {
+	options LoginOptions
+
+	ips        map[string]*loginIP
+	users      map[string][]time.Time
+	lastExpire time.Time
+	mutex      sync.Mutex
+}
+
+type loginIP struct {
+	failures []time.Time
+	users    map[string]time.Time
+	flagged  time.Time
+	reason   string
+}
+
+// NewLoginGuard creates a LoginGuard
+func NewLoginGuard(options LoginOptions) *LoginGuard {
+	return &LoginGuard{
+		options:    options,
+		ips:        make(map[string]*loginIP),
+		users:      make(map[string][]time.Time),
+		lastExpire: time.Now(),
+	}
+}
+
+// Clone returns a LoginGuard with the same options that hasn't seen any
+// logins yet
+func (g *LoginGuard) Clone() *LoginGuard {
+	if g == nil {
+		return nil
+	}
+	return NewLoginGuard(g.options)
+}
+
+// IsLogin determines whether the URL belongs to a login endpoint
+func (g *LoginGuard) IsLogin(rawURL string) bool {
+	if g == nil {
+		return false
+	}
+	return matchesPath(g.options.Endpoints, rawURL)
+}
+
+// isFailure determines whether the status code denotes a failed login
+func (g *LoginGuard) isFailure(status string) bool {
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return false
+	}
+	for _, s := range g.options.FailureStatus {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Attempt records a request to the URL by the IP with the response status
+// and the user name, if known, and returns whether the IP is flagged and
+// why. Requests to other URLs are ignored.
+func (g *LoginGuard) Attempt(ip net.IP, rawURL, status, user string, now time.Time) (string, bool) {
+	if !g.IsLogin(rawURL) {
+		return "", false
+	}
+	ipstr := ipKey(ip)
+	cutoff := now.Add(-g.options.Window)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if now.Sub(g.lastExpire) >= g.options.Window {
+		g.expire(cutoff)
+		g.lastExpire = now
+	}
+
+	li, ok := g.ips[ipstr]
+	if !ok {
+		li = &loginIP{users: make(map[string]time.Time)}
+		g.ips[ipstr] = li
+	}
+
+	if g.isFailure(status) {
+		li.failures = append(since(li.failures, cutoff), now)
+		if n := len(li.failures); g.options.MaxFailures > 0 && n > g.options.MaxFailures {
+			li.flag(now, fmt.Sprintf("credential stuffing: %d failed logins", n))
+		}
+
+		if user != "" {
+			li.users[user] = now
+			for u, seen := range li.users {
+				if seen.Before(cutoff) {
+					delete(li.users, u)
+				}
+			}
+			if n := len(li.users); g.options.MaxUsers > 0 && n > g.options.MaxUsers {
+				li.flag(now, fmt.Sprintf("credential stuffing: failed logins as %d users", n))
+			}
+
+			g.users[user] = append(since(g.users[user], cutoff), now)
+			if n := len(g.users[user]); g.options.MaxUserFailures > 0 && n > g.options.MaxUserFailures {
+				li.flag(now, fmt.Sprintf("credential stuffing: %d failed logins as %s", n, user))
+			}
+		}
+	}
+
+	if li.flagged.IsZero() || li.flagged.Before(cutoff) {
+		return "", false
+	}
+	return li.reason, true
+}
+
+func (li *loginIP) flag(now time.Time, reason string) {
+	li.flagged = now
+	li.reason = reason
+}
+
+// expire forgets the IPs and user names without failures since cutoff.
+// g.mutex must be held.
+func (g *LoginGuard) expire(cutoff time.Time) {
+	for ip, li := range g.ips {
+		li.failures = since(li.failures, cutoff)
+		if len(li.failures) == 0 && li.flagged.Before(cutoff) {
+			delete(g.ips, ip)
+		}
+	}
+	for user, failures := range g.users {
+		if failures = since(failures, cutoff); len(failures) == 0 {
+			delete(g.users, user)
+		} else {
+			g.users[user] = failures
+		}
+	}
+}
+
+// Size returns the number of IPs being tracked
+func (g *LoginGuard) Size() int {
+	if g == nil {
+		return 0
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.ips)
+}
+
+// since drops the times up to cutoff from the ordered list
+func since(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,114 @@
+package botdetect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardIsLogin(t *testing.T) {
+	g := NewLoginGuard(LoginOptions{Endpoints: []string{"/login", "/api/auth/*"}})
+
+	for url, expected := range map[string]bool{
+		"/login":             true,
+		"/login?next=/admin": true,
+		"/login/help":        false,
+		"/api/auth/token":    true,
+		"/api/other":         false,
+	} {
+		if g.IsLogin(url) != expected {
+			t.Errorf("%s: expected %v", url, expected)
+		}
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	g := NewLoginGuard(LoginOptions{
+		Endpoints:       []string{"/login"},
+		FailureStatus:   []int{401},
+		Window:          time.Minute,
+		MaxFailures:     3,
+		MaxUserFailures: 4,
+		MaxUsers:        2,
+	})
+	now := time.Now()
+	attempt := func(ip, url, status, user string) bool {
+		_, flagged := g.Attempt(net.ParseIP(ip), url, status, user, now)
+		return flagged
+	}
+
+	// brute force from one IP
+	for i := 0; i < 3; i++ {
+		if attempt("192.0.2.1", "/login", "401", "") {
+			t.Fatalf("expected %d failures not to be flagged", i+1)
+		}
+	}
+	if attempt("192.0.2.1", "/", "401", "") || attempt("192.0.2.1", "/login", "200", "") {
+		t.Error("expected other URLs and successful logins not to count")
+	}
+	if !attempt("192.0.2.1", "/login", "401", "") {
+		t.Error("expected the IP exceeding max failures to be flagged")
+	}
+	// flagged IPs stay flagged within the window
+	if !attempt("192.0.2.1", "/login", "200", "") {
+		t.Error("expected the IP to stay flagged")
+	}
+
+	// many users from one IP
+	attempt("192.0.2.2", "/login", "401", "alice")
+	attempt("192.0.2.2", "/login", "401", "bob")
+	if reason, flagged := g.Attempt(net.ParseIP("192.0.2.2"), "/login", "401", "carol", now); !flagged || reason != "credential stuffing: failed logins as 3 users" {
+		t.Errorf("expected the IP trying many users to be flagged, got %q", reason)
+	}
+
+	// one user from many IPs
+	for i := 0; i < 4; i++ {
+		if attempt(fmt.Sprintf("198.51.100.%d", i), "/login", "401", "dave") {
+			t.Fatalf("expected %d failures for the user not to be flagged", i+1)
+		}
+	}
+	if !attempt("198.51.100.9", "/login", "401", "dave") {
+		t.Error("expected the IP exceeding the failures for the user to be flagged")
+	}
+
+	// everything is forgotten after the window
+	later := now.Add(2 * time.Minute)
+	if _, flagged := g.Attempt(net.ParseIP("192.0.2.1"), "/login", "401", "", later); flagged {
+		t.Error("expected the flag to expire after the window")
+	}
+	if size := g.Size(); size != 1 {
+		t.Errorf("expected only the last IP to be tracked, got %d", size)
+	}
+}
+
+func TestHistoryBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	if !h.Block(ip, "credential stuffing") {
+		t.Fatal("expected the IP to be blacklisted")
+	}
+	if reason, _ := h.Blacklist().Reason(ip); reason != "credential stuffing" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	h.ReportFalsePositive(ip, time.Hour, "")
+	if h.Block(ip, "credential stuffing") {
+		t.Error("expected the exempt IP not to be blacklisted")
+	}
+}
@@ -0,0 +1,226 @@
+package botdetect
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LookupLimits bound the caches and the concurrency of the external lookups
+// (DNS and RDAP), so that they can neither flood the servers they query nor
+// grow without bounds. Zero values take the defaults.
+type LookupLimits struct {
+	// NegativeTTL is how long IPs without a result are cached, e.g.
+	// without a PTR record or not a crawler. It defaults to the TTL of
+	// results.
+	NegativeTTL time.Duration
+
+	// ErrorTTL is how long failed lookups are cached before they are
+	// retried, one minute by default. An earlier result is kept
+	// meanwhile.
+	ErrorTTL time.Duration
+
+	// MaxConcurrent is the number of lookups running at the same time,
+	// 32 by default. IPs seen while all are busy are looked up later.
+	MaxConcurrent int
+
+	// MaxEntries limits the number of cached IPs, 100000 by default
+	MaxEntries int
+}
+
+const (
+	defaultLookupErrorTTL      = time.Minute
+	defaultLookupMaxConcurrent = 32
+	defaultLookupMaxEntries    = 100000
+)
+
+// lookupCache caches the results of slow external lookups per key. Lookups
+// run in the background with bounded concurrency; callers only ever get what
+// is cached. Results are cached for ttl, empty results (nil) for the negative
+// TTL and errors for the error TTL, which keeps an earlier result alive.
+type lookupCache struct {
+	// skipped counts the lookups postponed because the limit was reached.
+	// It comes first to keep it 64-bit aligned for atomic access.
+	skipped uint64
+
+	ttl    time.Duration
+	limits LookupLimits
+	slots  chan struct{}
+
+	entries map[string]lookupEntry
+	pending map[string]bool
+	mutex   sync.RWMutex
+}
+
+type lookupEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newLookupCache(ttl time.Duration, limits LookupLimits) *lookupCache {
+	if limits.NegativeTTL <= 0 {
+		limits.NegativeTTL = ttl
+	}
+	if limits.ErrorTTL <= 0 {
+		limits.ErrorTTL = defaultLookupErrorTTL
+	}
+	if limits.ErrorTTL > ttl {
+		limits.ErrorTTL = ttl
+	}
+	if limits.MaxConcurrent <= 0 {
+		limits.MaxConcurrent = defaultLookupMaxConcurrent
+	}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = defaultLookupMaxEntries
+	}
+
+	return &lookupCache{
+		ttl:     ttl,
+		limits:  limits,
+		slots:   make(chan struct{}, limits.MaxConcurrent),
+		entries: make(map[string]lookupEntry),
+		pending: make(map[string]bool),
+	}
+}
+
+// get returns the cached value for the key and whether there is one. If the
+// key isn't cached or has expired, lookup is started in the background unless
+// the concurrency limit is reached.
+func (c *lookupCache) get(key string, lookup func() (interface{}, error)) (interface{}, bool) {
+	if value, ok := c.cached(key); ok {
+		return value, true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.pending[key] {
+		return nil, false
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		atomic.AddUint64(&c.skipped, 1)
+		return nil, false
+	}
+
+	c.pending[key] = true
+	go func() {
+		value, err := lookup()
+		c.store(key, value, err)
+		<-c.slots
+	}()
+	return nil, false
+}
+
+// cached returns the cached value for the key and whether there is one
+// without starting a lookup
+func (c *lookupCache) cached(key string) (interface{}, bool) {
+	c.mutex.RLock()
+	e, ok := c.entries[key]
+	c.mutex.RUnlock()
+
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// store caches the result of a lookup
+func (c *lookupCache) store(key string, value interface{}, err error) {
+	now := time.Now()
+	ttl := c.ttl
+	if value == nil {
+		ttl = c.limits.NegativeTTL
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, key)
+	if err != nil {
+		// the error says nothing about the key, so an earlier result
+		// stays valid until the lookup is retried
+		value = c.entries[key].value
+		ttl = c.limits.ErrorTTL
+	}
+	c.set(key, value, now.Add(ttl))
+}
+
+// set caches a value until expires, making room if the cache is full. The
+// caller must hold the write lock.
+func (c *lookupCache) set(key string, value interface{}, expires time.Time) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.limits.MaxEntries {
+		c.expire(time.Now())
+		// still full: drop an arbitrary entry
+		for k := range c.entries {
+			if len(c.entries) < c.limits.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = lookupEntry{value: value, expires: expires}
+}
+
+// restore caches a value until expires unless the key is cached for longer,
+// e.g. when importing saved results
+func (c *lookupCache) restore(key string, value interface{}, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.entries[key]; ok && !e.expires.Before(expires) {
+		return
+	}
+	c.set(key, value, expires)
+}
+
+// expireAll removes the expired entries
+func (c *lookupCache) expireAll() {
+	c.mutex.Lock()
+	c.expire(time.Now())
+	c.mutex.Unlock()
+}
+
+// expire removes the expired entries. The caller must hold the write lock.
+func (c *lookupCache) expire(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// each calls fn for every entry that hasn't expired
+func (c *lookupCache) each(fn func(key string, value interface{}, expires time.Time)) {
+	now := time.Now()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for key, e := range c.entries {
+		if now.Before(e.expires) {
+			fn(key, e.value, e.expires)
+		}
+	}
+}
+
+// clear removes all entries
+func (c *lookupCache) clear() {
+	c.mutex.Lock()
+	c.entries = make(map[string]lookupEntry)
+	c.mutex.Unlock()
+}
+
+// size returns the number of cached keys
+func (c *lookupCache) size() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries)
+}
+
+// postponed returns the number of lookups postponed because the limit was
+// reached
+func (c *lookupCache) postponed() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
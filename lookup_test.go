@@ -0,0 +1,122 @@
+package botdetect
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitCached waits until the key is cached
+func waitCached(t *testing.T, c *lookupCache, key string) interface{} {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if value, ok := c.cached(key); ok {
+			return value
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s wasn't cached", key)
+	return nil
+}
+
+func TestLookupCacheTTLs(t *testing.T) {
+	c := newLookupCache(time.Hour, LookupLimits{NegativeTTL: time.Minute, ErrorTTL: time.Second})
+
+	c.store("positive", "name", nil)
+	c.store("negative", nil, nil)
+	c.store("failed", nil, errors.New("timeout"))
+
+	for key, ttl := range map[string]time.Duration{
+		"positive": time.Hour,
+		"negative": time.Minute,
+		"failed":   time.Second,
+	} {
+		remaining := time.Until(c.entries[key].expires)
+		if remaining > ttl || remaining < ttl-time.Second {
+			t.Errorf("%s: expected a ttl of %s, got %s", key, ttl, remaining)
+		}
+	}
+
+	// a failure keeps the earlier result until the lookup is retried
+	c.store("positive", nil, errors.New("timeout"))
+	if value, ok := c.cached("positive"); !ok || value != "name" {
+		t.Errorf("expected the earlier result to be kept, got %v %v", value, ok)
+	}
+	if remaining := time.Until(c.entries["positive"].expires); remaining > time.Second {
+		t.Errorf("expected the failed lookup to be retried soon, got %s", remaining)
+	}
+
+	// the error TTL never exceeds the TTL of results
+	if c := newLookupCache(time.Second, LookupLimits{ErrorTTL: time.Hour}); c.limits.ErrorTTL != time.Second {
+		t.Errorf("expected the error ttl to be capped, got %s", c.limits.ErrorTTL)
+	}
+}
+
+func TestLookupCacheConcurrency(t *testing.T) {
+	c := newLookupCache(time.Hour, LookupLimits{MaxConcurrent: 1})
+
+	release := make(chan struct{})
+	lookups := 0
+	slow := func() (interface{}, error) {
+		<-release
+		return "slow", nil
+	}
+	fast := func() (interface{}, error) {
+		lookups++
+		return "fast", nil
+	}
+
+	if _, ok := c.get("a", slow); ok {
+		t.Fatal("expected a to be looked up in the background")
+	}
+	// the only slot is taken, so b is postponed and a isn't looked up twice
+	c.get("b", fast)
+	c.get("a", fast)
+	if lookups != 0 || c.postponed() != 1 {
+		t.Errorf("expected b to be postponed, got %d lookups and %d postponed", lookups, c.postponed())
+	}
+
+	close(release)
+	if value := waitCached(t, c, "a"); value != "slow" {
+		t.Errorf("expected the result of the first lookup, got %v", value)
+	}
+
+	// the slot is free again once the result is stored
+	for {
+		if _, ok := c.get("b", fast); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if value, _ := c.get("b", fast); value != "fast" {
+		t.Errorf("expected b to be looked up, got %v", value)
+	}
+}
+
+func TestLookupCacheMaxEntries(t *testing.T) {
+	c := newLookupCache(time.Hour, LookupLimits{MaxEntries: 2})
+
+	c.set("expired", "x", time.Now().Add(-time.Second))
+	c.store("a", "a", nil)
+	c.store("b", "b", nil)
+	if c.size() != 2 {
+		t.Fatalf("expected the expired entry to make room, got %d entries", c.size())
+	}
+	if _, ok := c.entries["expired"]; ok {
+		t.Error("expected the expired entry to be removed")
+	}
+
+	c.store("c", "c", nil)
+	if c.size() != 2 {
+		t.Errorf("expected at most 2 entries, got %d", c.size())
+	}
+	if value, ok := c.cached("c"); !ok || value != "c" {
+		t.Errorf("expected the new entry to be cached, got %v %v", value, ok)
+	}
+
+	// updating a key never evicts another one
+	c.store("c", "d", nil)
+	if c.size() != 2 {
+		t.Errorf("expected 2 entries, got %d", c.size())
+	}
+}
@@ -0,0 +1,319 @@
+package botdetect
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManualList holds IPs and networks an operator explicitly blocked or
+// unblocked. Unblocked entries take precedence over the blacklist and
+// blocked ones, so a single line can release a falsely blocked IP. Host
+// names and domains block or unblock the IPs whose host names match them,
+// e.g. the whole fleet of a scanning service. Entries with a TTL expire that
+// long after they first appeared.
+//
+// The entries come from two sources that are replaced independently: the
+// list read by Read, which blocks and unblocks, and the allow list read by
+// ReadAllow, which only unblocks, e.g. one file kept by the security team and
+// one by the team running the monitoring.
+type ManualList struct {
+	list  manualSet
+	allow manualSet
+	mutex sync.RWMutex
+}
+
+// manualSet holds the entries read from one source
+type manualSet struct {
+	blocked        []manualNetwork
+	unblocked      []manualNetwork
+	blockedHosts   []manualHost
+	unblockedHosts []manualHost
+
+	// firstSeen holds when each entry with a TTL first appeared, so that
+	// reloading the source doesn't renew them
+	firstSeen map[string]time.Time
+}
+
+type manualNetwork struct {
+	network *net.IPNet
+	expires time.Time
+}
+
+type manualHost struct {
+	pattern PTRPattern
+	expires time.Time
+}
+
+// NewManualList creates an empty ManualList
+func NewManualList() *ManualList {
+	return &ManualList{}
+}
+
+// IsBlocked determines whether the IP has been blocked manually
+func (ml *ManualList) IsBlocked(ip net.IP) bool {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return containsManualIP(ml.list.blocked, ip, time.Now())
+}
+
+// IsUnblocked determines whether the IP has been unblocked manually
+func (ml *ManualList) IsUnblocked(ip net.IP) bool {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	now := time.Now()
+	return containsManualIP(ml.list.unblocked, ip, now) || containsManualIP(ml.allow.unblocked, ip, now)
+}
+
+// HasHosts determines whether the list contains host names, which need the
+// host names of the IPs to be looked up
+func (ml *ManualList) HasHosts() bool {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return len(ml.list.blockedHosts) > 0 || len(ml.list.unblockedHosts) > 0 || len(ml.allow.unblockedHosts) > 0
+}
+
+// BlockedHost returns the entry that blocks one of the host names, if any.
+// The host names should be confirmed, see PTRCache.Confirmed.
+func (ml *ManualList) BlockedHost(names []string) (string, bool) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return matchManualHost(ml.list.blockedHosts, names, time.Now())
+}
+
+// UnblockedHost returns the entry that unblocks one of the host names, if
+// any. The host names must be confirmed, see PTRCache.Confirmed.
+func (ml *ManualList) UnblockedHost(names []string) (string, bool) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	now := time.Now()
+	if entry, ok := matchManualHost(ml.list.unblockedHosts, names, now); ok {
+		return entry, ok
+	}
+	return matchManualHost(ml.allow.unblockedHosts, names, now)
+}
+
+// Read replaces the list with the entries read from r. Every line contains an
+// IP, a network in CIDR notation, a host name or a domain with a leading
+// "*.", prefixed with '-' to unblock it and optionally followed by a TTL,
+// e.g. "192.0.2.1 ttl=2h". Empty lines and lines starting with '#' are
+// ignored. The allow list is kept.
+func (ml *ManualList) Read(r io.Reader) error {
+	return ml.read(r, &ml.list, false)
+}
+
+// ReadAllow replaces the allow list with the entries read from r, in the
+// format of Read. Every entry unblocks, the '-' prefix is optional.
+func (ml *ManualList) ReadAllow(r io.Reader) error {
+	return ml.read(r, &ml.allow, true)
+}
+
+// read replaces the set with the entries read from r, all of them unblocked
+// with allow
+func (ml *ManualList) read(r io.Reader, set *manualSet, allow bool) error {
+	ml.mutex.RLock()
+	previous := set.firstSeen
+	ml.mutex.RUnlock()
+
+	now := time.Now()
+	next := manualSet{firstSeen: make(map[string]time.Time)}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		unblock := allow
+		if strings.HasPrefix(line, "-") {
+			unblock = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || len(fields) > 2 {
+			return configErrorf("line %d: expected an entry and an optional ttl=DURATION", lineNo)
+		}
+		var expires time.Time
+		if len(fields) == 2 {
+			value := strings.TrimPrefix(fields[1], "ttl=")
+			ttl, err := time.ParseDuration(value)
+			if value == fields[1] || err != nil || ttl <= 0 {
+				return configErrorf("line %d: invalid option '%s', expected ttl=DURATION", lineNo, fields[1])
+			}
+
+			key := strings.Join(fields, " ")
+			if unblock {
+				key = "-" + key
+			}
+			first, seen := previous[key]
+			if !seen {
+				first = now
+			}
+			next.firstSeen[key] = first
+			expires = first.Add(ttl)
+		}
+
+		entry := fields[0]
+		if isHostPattern(entry) {
+			host := manualHost{pattern: PTRPattern{Pattern: strings.TrimSuffix(strings.ToLower(entry), ".")}, expires: expires}
+			if unblock {
+				next.unblockedHosts = append(next.unblockedHosts, host)
+			} else {
+				next.blockedHosts = append(next.blockedHosts, host)
+			}
+			continue
+		}
+		ipnet, err := parseNetwork(entry)
+		if err != nil {
+			return configErrorf("line %d: %w", lineNo, err)
+		}
+		if unblock {
+			next.unblocked = append(next.unblocked, manualNetwork{network: ipnet, expires: expires})
+		} else {
+			next.blocked = append(next.blocked, manualNetwork{network: ipnet, expires: expires})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ml.mutex.Lock()
+	*set = next
+	ml.mutex.Unlock()
+
+	return nil
+}
+
+// Load replaces the list with the entries of the given file
+func (ml *ManualList) Load(path string) error {
+	return loadManual(path, ml.Read)
+}
+
+// LoadAllow replaces the allow list with the entries of the given file
+func (ml *ManualList) LoadAllow(path string) error {
+	return loadManual(path, ml.ReadAllow)
+}
+
+func loadManual(path string, read func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return configError(err)
+	}
+	defer f.Close()
+
+	if err := read(f); err != nil {
+		return configErrorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes until the
+// context is done, polling it every interval as WatchFile does. Errors are
+// passed to onError and the previous list is kept.
+func (ml *ManualList) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	WatchFile(ctx, path, interval, ml.Load, onError)
+}
+
+// WatchAllow reloads the allow list like Watch, polling it every interval
+func (ml *ManualList) WatchAllow(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	WatchFile(ctx, path, interval, ml.LoadAllow, onError)
+}
+
+// parseNetwork parses an IP or a CIDR network. A single IP is returned as a
+// network that only contains this IP.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, invalidIPErrorf("invalid network '%s'", s)
+		}
+		return ipnet, nil
+	}
+
+	ip := parseScopedIP(s)
+	if ip == nil {
+		return nil, invalidIPErrorf("invalid IP '%s'", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsManualIP determines whether one of the entries that haven't expired
+// contains the IP
+func containsManualIP(entries []manualNetwork, ip net.IP, now time.Time) bool {
+	for _, e := range entries {
+		if e.network.Contains(ip) && (e.expires.IsZero() || now.Before(e.expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostPattern determines whether the entry is a host name or a domain with
+// a leading "*." rather than an IP or a network: labels of letters, digits
+// and dashes, the last one a top-level domain
+func isHostPattern(s string) bool {
+	labels := strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "*."), "."), ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(tld, "xn--") {
+		return true
+	}
+	for _, c := range tld {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return len(tld) >= 2
+}
+
+// matchManualHost returns the first of the entries that haven't expired
+// matching one of the host names
+func matchManualHost(entries []manualHost, names []string, now time.Time) (string, bool) {
+	for _, e := range entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			continue
+		}
+		for _, name := range names {
+			if e.pattern.Matches(name) {
+				return e.pattern.Pattern, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,140 @@
+package botdetect
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManualList(t *testing.T) {
+	ml := NewManualList()
+	err := ml.Read(strings.NewReader(`
+# known scrapers
+192.0.2.0/24
+2001:db8::1
+- 192.0.2.10
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !ml.IsBlocked(net.ParseIP("192.0.2.99")) {
+		t.Errorf("192.0.2.99 should be blocked")
+	}
+	if !ml.IsBlocked(net.ParseIP("2001:db8::1")) {
+		t.Errorf("2001:db8::1 should be blocked")
+	}
+	if ml.IsBlocked(net.ParseIP("198.51.100.1")) {
+		t.Errorf("198.51.100.1 should not be blocked")
+	}
+	if !ml.IsUnblocked(net.ParseIP("192.0.2.10")) {
+		t.Errorf("192.0.2.10 should be unblocked")
+	}
+
+	if err := ml.Read(strings.NewReader("not-an-ip\n")); err == nil {
+		t.Errorf("expected an error for an invalid line")
+	}
+	if !ml.IsBlocked(net.ParseIP("192.0.2.99")) {
+		t.Errorf("a failed read must keep the previous list")
+	}
+}
+
+func TestManualListHosts(t *testing.T) {
+	ml := NewManualList()
+	err := ml.Read(strings.NewReader(`
+# scanners
+*.shodan.io
+Scanner.Example.com.
+- *.good.shodan.io
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ml.HasHosts() {
+		t.Error("expected the list to have host names")
+	}
+
+	if entry, ok := ml.BlockedHost([]string{"other.example.net", "census1.shodan.io"}); !ok || entry != "*.shodan.io" {
+		t.Errorf("expected census1.shodan.io to be blocked by *.shodan.io, got %s", entry)
+	}
+	if entry, ok := ml.BlockedHost([]string{"scanner.example.com"}); !ok || entry != "scanner.example.com" {
+		t.Error("expected the host name to be blocked regardless of case and trailing dot")
+	}
+	if _, ok := ml.BlockedHost([]string{"shodan.io.evil.example"}); ok {
+		t.Error("expected only host names below the domain to be blocked")
+	}
+	if _, ok := ml.UnblockedHost([]string{"a.good.shodan.io"}); !ok {
+		t.Error("expected a.good.shodan.io to be unblocked")
+	}
+
+	for _, line := range []string{"192.0.2.x", "*.", "bad_host.example.com", "example.123"} {
+		if err := ml.Read(strings.NewReader(line)); err == nil {
+			t.Errorf("expected an error for '%s'", line)
+		}
+	}
+}
+
+func TestManualListTTL(t *testing.T) {
+	ml := NewManualList()
+	list := `
+192.0.2.1 ttl=1h
+192.0.2.2
+*.shodan.io ttl=1h
+`
+	if err := ml.Read(strings.NewReader(list)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ml.IsBlocked(net.ParseIP("192.0.2.1")) {
+		t.Error("expected 192.0.2.1 to be blocked until its TTL runs out")
+	}
+
+	// reloading doesn't renew the entries
+	ml.list.firstSeen["192.0.2.1 ttl=1h"] = time.Now().Add(-2 * time.Hour)
+	ml.list.firstSeen["*.shodan.io ttl=1h"] = time.Now().Add(-2 * time.Hour)
+	if err := ml.Read(strings.NewReader(list)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ml.IsBlocked(net.ParseIP("192.0.2.1")) {
+		t.Error("expected 192.0.2.1 to have expired")
+	}
+	if !ml.IsBlocked(net.ParseIP("192.0.2.2")) {
+		t.Error("expected 192.0.2.2 to be blocked without a TTL")
+	}
+	if _, ok := ml.BlockedHost([]string{"census1.shodan.io"}); ok {
+		t.Error("expected *.shodan.io to have expired")
+	}
+
+	for _, line := range []string{"192.0.2.1 2h", "192.0.2.1 ttl=soon", "192.0.2.1 ttl=-1h", "192.0.2.1 ttl=1h ttl=2h"} {
+		if err := ml.Read(strings.NewReader(line)); err == nil {
+			t.Errorf("expected an error for '%s'", line)
+		}
+	}
+}
+
+func TestManualAllowList(t *testing.T) {
+	ml := NewManualList()
+	if err := ml.Read(strings.NewReader("192.0.2.0/24\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ml.ReadAllow(strings.NewReader("192.0.2.7\n- 192.0.2.8\nprobe.example.com\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, ip := range []string{"192.0.2.7", "192.0.2.8"} {
+		if !ml.IsUnblocked(net.ParseIP(ip)) {
+			t.Errorf("expected %s to be unblocked by the allow list", ip)
+		}
+	}
+	if _, ok := ml.UnblockedHost([]string{"probe.example.com"}); !ok {
+		t.Error("expected probe.example.com to be unblocked by the allow list")
+	}
+
+	// replacing one list keeps the other
+	if err := ml.Read(strings.NewReader("198.51.100.0/24\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ml.IsUnblocked(net.ParseIP("192.0.2.7")) || ml.IsBlocked(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the allow list to be kept and the list to be replaced")
+	}
+}
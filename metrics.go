@@ -0,0 +1,200 @@
+package botdetect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a minimal registry of counters and gauges that can be written
+// in the Prometheus text format. A nil *Metrics discards everything, so
+// metrics are optional wherever they are used.
+type Metrics struct {
+	counters []*CounterVec
+	gauges   []*gaugeFunc
+	mutex    sync.Mutex
+}
+
+// CounterVec is a set of counters that share a name and differ by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]uint64
+	mutex  sync.Mutex
+}
+
+type gaugeFunc struct {
+	name string
+	help string
+	typ  string
+	fn   func() float64
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Counter registers a new counter with the given label names
+func (m *Metrics) Counter(name, help string, labels ...string) *CounterVec {
+	if m == nil {
+		return nil
+	}
+
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+
+	m.mutex.Lock()
+	m.counters = append(m.counters, c)
+	m.mutex.Unlock()
+
+	return c
+}
+
+// GaugeFunc registers a gauge whose value is determined by fn at scrape time
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	m.gauges = append(m.gauges, &gaugeFunc{name: name, help: help, typ: "gauge", fn: fn})
+	m.mutex.Unlock()
+}
+
+// CounterFunc registers a counter whose value is read from fn on every
+// scrape, for counts the caller already keeps
+func (m *Metrics) CounterFunc(name, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	m.gauges = append(m.gauges, &gaugeFunc{name: name, help: help, typ: "counter", fn: fn})
+	m.mutex.Unlock()
+}
+
+// Inc increments the counter with the given label values by one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increments the counter with the given label values by n
+func (c *CounterVec) Add(n uint64, values ...string) {
+	if c == nil {
+		return
+	}
+
+	key := strings.Join(values, "\xff")
+	c.mutex.Lock()
+	c.values[key] += n
+	c.mutex.Unlock()
+}
+
+// Values returns a copy of all counter values keyed by their label values
+// joined with '|'
+func (c *CounterVec) Values() map[string]uint64 {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	out := make(map[string]uint64, len(c.values))
+	for key, v := range c.values {
+		out[strings.ReplaceAll(key, "\xff", "|")] = v
+	}
+	return out
+}
+
+// ReasonLabel returns the label a reason the package blacklists IPs for is
+// counted under in metrics. Rules keep their definition, which the
+// configuration limits; other checks only keep their kind, without the
+// counts, fingerprints or user names that would make a new series for
+// every IP. Reasons it doesn't know are counted as "other".
+func ReasonLabel(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	for _, prefix := range []string{"rule ", "bandwidth rule ", "cache rule ", "flow rule "} {
+		if strings.HasPrefix(reason, prefix) {
+			// rules don't contain spaces, the details after them do
+			if rule := strings.Fields(reason[len(prefix):]); len(rule) > 0 {
+				return prefix + rule[0]
+			}
+		}
+	}
+	for _, kind := range []string{"greylist", "walk", "concurrency", "anomaly", "credential stuffing", "fetch metadata", strings.TrimSpace(fingerprintReason)} {
+		if strings.HasPrefix(reason, kind) {
+			return kind
+		}
+	}
+	return "other"
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mutex.Lock()
+	counters := append([]*CounterVec{}, m.counters...)
+	gauges := append([]*gaugeFunc{}, m.gauges...)
+	m.mutex.Unlock()
+
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		keys := make([]string, 0, len(c.values))
+		for key := range c.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		lines := make([]string, len(keys))
+		for i, key := range keys {
+			lines[i] = fmt.Sprintf("%s%s %d\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), c.values[key])
+		}
+		c.mutex.Unlock()
+
+		if _, err := io.WriteString(w, strings.Join(lines, "")); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", g.name, g.help, g.name, g.typ, g.name, g.fn()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
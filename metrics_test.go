@@ -0,0 +1,55 @@
+package botdetect
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	c := m.Counter("test_total", "A test counter", "rule")
+	c.Inc("1m:10:0.5")
+	c.Add(2, "1m:10:0.5")
+	c.Inc("1h:30:0.85")
+	m.GaugeFunc("test_gauge", "A test gauge", func() float64 { return 42 })
+	m.CounterFunc("test_func_total", "A test counter func", func() float64 { return 7 })
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, expected := range []string{
+		"# TYPE test_total counter\n",
+		"test_total{rule=\"1m:10:0.5\"} 3\n",
+		"test_total{rule=\"1h:30:0.85\"} 1\n",
+		"# TYPE test_gauge gauge\ntest_gauge 42\n",
+		"# TYPE test_func_total counter\ntest_func_total 7\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, buf.String())
+		}
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.Counter("ignored", "").Inc()
+}
+
+func TestReasonLabel(t *testing.T) {
+	for reason, expected := range map[string]string{
+		"":                                 "",
+		"rule 1m0s:20:0.9":                 "rule 1m0s:20:0.9",
+		"bandwidth rule 1h0m0s:1000000000": "bandwidth rule 1h0m0s:1000000000",
+		"flow rule 1m0s:1000:100 matched with 2000 packets":  "flow rule 1m0s:1000:100",
+		"credential stuffing: 12 failed logins as admin":     "credential stuffing",
+		"fetch metadata: 3 navigations without subresources": "fetch metadata",
+		"fingerprint 0123456789abcdef of 12 blacklisted IPs": "fingerprint",
+		"walk of 120 URLs": "walk",
+		"something a peer or an older version blacklisted IPs for": "other",
+	} {
+		if label := ReasonLabel(reason); label != expected {
+			t.Errorf("%q: expected %q, got %q", reason, expected, label)
+		}
+	}
+}
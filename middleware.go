@@ -0,0 +1,38 @@
+package botdetect
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Middleware reports every request to the engine and answers 403 Forbidden
+// if one of the IPs it came from is blocked. The IPs are taken from the remote
+// address and the X-Forwarded-For and Forwarded headers as configured by
+// options, which may be nil.
+func Middleware(engine Engine, options *DeciderOptions, next http.Handler) (http.Handler, error) {
+	d, err := NewEngineDecider(engine, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := &Input{
+			Remote:  r.RemoteAddr,
+			XFF:     strings.Join(r.Header.Values("X-Forwarded-For"), ", "),
+			URL:     r.URL.RequestURI(),
+			Headers: map[string]string{},
+		}
+		if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+			in.Headers["Forwarded"] = strings.Join(fwd, ", ")
+		}
+		if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+			in.Headers["Sec-Fetch-Dest"] = dest
+		}
+
+		if d.CheckInput(in).Blocked {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
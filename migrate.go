@@ -0,0 +1,125 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// StateVersion is the version of the states written by this version of the
+// package. Every change that older versions would misread gets a new version
+// and a migration from the previous one.
+//
+//   - 1: snapshots written before states had a version. IPs may be keyed in
+//     other forms than CanonicalAddr, e.g. IPv4 as ::ffff:192.0.2.1.
+//   - 2: all IPs are keyed by their CanonicalAddr.
+//   - 3: exemptions carry their creation, reason, creator and source.
+//   - 4: greylisted IPs are saved.
+const StateVersion = 4
+
+// stateMigrations migrate a state of the version they are keyed by to the
+// next version
+var stateMigrations = map[int]func(s *State) error{
+	1: migrateStateV1,
+	2: migrateStateV2,
+	3: migrateStateV3,
+}
+
+// MigrateState brings a state read by DecodeState to StateVersion. A state
+// without a version is taken to be of version 1. States of newer versions
+// are an error of the kind ErrStateVersion: reading them would lose data.
+func MigrateState(s *State) error {
+	if s.Version == 0 {
+		s.Version = 1
+	}
+	if s.Version > StateVersion {
+		return stateVersionErrorf("the state is of version %d, but this version of botdetect only reads up to version %d", s.Version, StateVersion)
+	}
+
+	for s.Version < StateVersion {
+		if err := stateMigrations[s.Version](s); err != nil {
+			return fmt.Errorf("migrating the state from version %d: %w", s.Version, err)
+		}
+		s.Version++
+	}
+	return nil
+}
+
+// migrateStateV1 keys all IPs by their CanonicalAddr. Slots of IPs that had
+// been saved under several keys are added up rather than one replacing the
+// other.
+func migrateStateV1(s *State) error {
+	if len(s.History) > 0 {
+		history := make(map[string][]IPHistoryItem, len(s.History))
+		for ip, items := range s.History {
+			key := canonicalStateKey(ip)
+			history[key] = sumSlots(history[key], items)
+		}
+		s.History = history
+	}
+
+	if len(s.Exempt) > 0 {
+		exempt := make(map[string]time.Time, len(s.Exempt))
+		for ip, until := range s.Exempt {
+			key := canonicalStateKey(ip)
+			if until.After(exempt[key]) {
+				exempt[key] = until
+			}
+		}
+		s.Exempt = exempt
+	}
+
+	if len(s.Reputation) > 0 {
+		reputation := make(map[string]Reputation, len(s.Reputation))
+		for ip, r := range s.Reputation {
+			key := canonicalStateKey(ip)
+			if known, ok := reputation[key]; !ok || r.Updated.After(known.Updated) {
+				reputation[key] = r
+			}
+		}
+		s.Reputation = reputation
+	}
+
+	return nil
+}
+
+// migrateStateV2 turns the expiry of every exempt IP into an Exemption. Its
+// creation is unknown and every exemption used to be made for a false
+// positive. IPs that can't be parsed are dropped.
+func migrateStateV2(s *State) error {
+	keys := make([]string, 0, len(s.Exempt))
+	for ip := range s.Exempt {
+		keys = append(keys, ip)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			continue
+		}
+		s.Exemptions = append(s.Exemptions, Exemption{
+			IP:      ip,
+			Expires: s.Exempt[key],
+			Source:  ExemptionFalsePositive,
+		})
+	}
+	s.Exempt = nil
+	return nil
+}
+
+// migrateStateV3 has nothing to do: states of version 3 didn't save the
+// greylist, which starts out empty
+func migrateStateV3(s *State) error {
+	return nil
+}
+
+// canonicalStateKey returns the CanonicalAddr of the IP, or the IP as is if
+// it can't be parsed
+func canonicalStateKey(ip string) string {
+	if addr, err := ParseCanonicalAddr(ip); err == nil {
+		return addr.String()
+	}
+	return ip
+}
@@ -0,0 +1,93 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateStateV1(t *testing.T) {
+	slot := time.Now().Truncate(time.Minute).UTC()
+	later := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	// written before states had codecs and versions, with the same IP under
+	// two keys
+	legacy := fmt.Sprintf(`{"time":%q,"history":{`+
+		`"::ffff:192.0.2.1":[{"timestamp":%q,"count":3,"app":3}],`+
+		`"192.0.2.1":[{"timestamp":%q,"count":2,"other":2},{"timestamp":%q,"count":1,"app":1}]},`+
+		`"blacklist":[],"exempt":{"::ffff:192.0.2.2":%q,"192.0.2.2":%q}}`,
+		slot.Format(time.RFC3339), slot.Format(time.RFC3339), slot.Format(time.RFC3339),
+		slot.Add(-time.Minute).Format(time.RFC3339), later.Format(time.RFC3339), slot.Format(time.RFC3339))
+
+	s, err := DecodeState(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 1 {
+		t.Errorf("expected version 1 for a snapshot without header, got %d", s.Version)
+	}
+	if err := MigrateState(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != StateVersion {
+		t.Errorf("expected version %d after the migration, got %d", StateVersion, s.Version)
+	}
+
+	items := s.History["192.0.2.1"]
+	if len(s.History) != 1 || len(items) != 2 {
+		t.Fatalf("expected the slots of both keys under one, got %+v", s.History)
+	}
+	if items[0].Count != 5 || items[0].App != 3 || items[0].Other != 2 || items[1].Count != 1 {
+		t.Errorf("expected the slots to be added up, got %+v", items)
+	}
+	if e := s.Exemptions; len(e) != 1 || e[0].IP.String() != "192.0.2.2" || !e[0].Expires.Equal(later) ||
+		e[0].Source != ExemptionFalsePositive || s.Exempt != nil {
+		t.Errorf("expected the later exemption to be kept, got %+v", s.Exemptions)
+	}
+}
+
+func TestStateVersions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Hour,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    100,
+		MaxRatio:       0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written with a codec but before states had versions
+	var buf bytes.Buffer
+	if err := (protobufCodec{}).Encode(&buf, testState()); err != nil {
+		t.Fatal(err)
+	}
+	s, err := DecodeState(strings.NewReader(stateMagic + "protobuf\n" + buf.String()))
+	if err != nil || s.Version != 1 {
+		t.Errorf("expected a state of version 1, got %v", err)
+	}
+
+	newer := fmt.Sprintf("%sjson %d\n{}", stateMagic, StateVersion+1)
+	if err := h.ReadState(strings.NewReader(newer)); !errors.Is(err, ErrStateVersion) {
+		t.Errorf("expected a version error for a newer state, got %v", err)
+	}
+	if err := MigrateState(&State{Version: StateVersion + 1}); !errors.Is(err, ErrStateVersion) {
+		t.Errorf("expected a version error for a newer state, got %v", err)
+	}
+
+	for _, header := range []string{"json x", "json 0", "json 1 2", ""} {
+		if _, err := DecodeState(strings.NewReader(stateMagic + header + "\n{}")); err == nil {
+			t.Errorf("expected an error for the header '%s'", header)
+		}
+	}
+}
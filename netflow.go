@@ -0,0 +1,326 @@
+package botdetect
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetflowDecoder turns Netflow v5 and IPFIX packets into flow summaries per
+// source IP, for services without HTTP logs. IPFIX data records can only be
+// decoded after their template has been received, so the decoder keeps the
+// templates of every exporter, up to a limit per exporter and in total so
+// that a sender can't exhaust the memory with templates.
+type NetflowDecoder struct {
+	perExporter int
+	total       int
+
+	templates map[ipfixTemplateKey][]ipfixField
+	exporters map[string]int
+	mutex     sync.Mutex
+}
+
+type ipfixTemplateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// IPFIX information elements the decoder reads
+const (
+	ipfixOctetDeltaCount     = 1
+	ipfixPacketDeltaCount    = 2
+	ipfixProtocolIdentifier  = 4
+	ipfixTCPControlBits      = 6
+	ipfixSourceIPv4Address   = 8
+	ipfixSourceIPv6Address   = 27
+	ipfixFlowEndSeconds      = 151
+	ipfixFlowEndMilliseconds = 153
+)
+
+const (
+	netflow5HeaderLength = 24
+	netflow5RecordLength = 48
+	netflow5Sampling     = 0x3fff
+
+	ipfixHeaderLength   = 16
+	ipfixTemplateSet    = 2
+	ipfixMinDataSet     = 256
+	ipfixVariableLength = 65535
+
+	protocolTCP = 6
+	tcpSYN      = 0x02
+	tcpACK      = 0x10
+)
+
+// NewNetflowDecoder creates a NetflowDecoder without templates that keeps
+// at most perExporter templates of every exporter and total templates of
+// all of them; zero doesn't limit them. Templates beyond the limits are an
+// error and their data records are skipped.
+func NewNetflowDecoder(perExporter, total int) *NetflowDecoder {
+	return &NetflowDecoder{
+		perExporter: perExporter,
+		total:       total,
+		templates:   make(map[ipfixTemplateKey][]ipfixField),
+		exporters:   make(map[string]int),
+	}
+}
+
+// Decode returns the flows of a Netflow v5 or IPFIX packet from the
+// exporter, identified e.g. by its address. Every flow record becomes one
+// Flow; TCP records with a SYN but no ACK count as a connection attempt.
+// Data records of IPFIX templates that haven't been received yet are
+// skipped.
+func (d *NetflowDecoder) Decode(exporter string, packet []byte) ([]Flow, error) {
+	if len(packet) < 2 {
+		return nil, fmt.Errorf("netflow packet too short")
+	}
+	switch version := binary.BigEndian.Uint16(packet); version {
+	case 5:
+		return decodeNetflow5(packet)
+	case 10:
+		return d.decodeIPFIX(exporter, packet)
+	default:
+		return nil, fmt.Errorf("unsupported netflow version %d", version)
+	}
+}
+
+func decodeNetflow5(packet []byte) ([]Flow, error) {
+	if len(packet) < netflow5HeaderLength {
+		return nil, fmt.Errorf("netflow v5 header too short")
+	}
+	count := int(binary.BigEndian.Uint16(packet[2:]))
+	if len(packet) < netflow5HeaderLength+count*netflow5RecordLength {
+		return nil, fmt.Errorf("netflow v5 packet with %d records too short", count)
+	}
+	uptime := binary.BigEndian.Uint32(packet[4:])
+	exported := time.Unix(int64(binary.BigEndian.Uint32(packet[8:])), int64(binary.BigEndian.Uint32(packet[12:])))
+	sampling := uint64(binary.BigEndian.Uint16(packet[22:]) & netflow5Sampling)
+	if sampling == 0 {
+		sampling = 1
+	}
+
+	flows := make([]Flow, 0, count)
+	for i := 0; i < count; i++ {
+		r := packet[netflow5HeaderLength+i*netflow5RecordLength:]
+		f := Flow{
+			IP:      net.IP(append([]byte(nil), r[0:4]...)),
+			Packets: uint64(binary.BigEndian.Uint32(r[16:])) * sampling,
+			Bytes:   uint64(binary.BigEndian.Uint32(r[20:])) * sampling,
+			Time:    exported,
+		}
+		// the end of the flow is in milliseconds of the exporter's uptime
+		if last := binary.BigEndian.Uint32(r[28:]); last <= uptime {
+			f.Time = exported.Add(-time.Duration(uptime-last) * time.Millisecond)
+		}
+		if isConnectionAttempt(r[38], r[37]) {
+			f.SYNs = sampling
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+// isConnectionAttempt determines whether a flow record of the protocol with
+// the cumulated TCP flags is an unanswered connection attempt
+func isConnectionAttempt(protocol, flags uint8) bool {
+	return protocol == protocolTCP && flags&tcpSYN != 0 && flags&tcpACK == 0
+}
+
+func (d *NetflowDecoder) decodeIPFIX(exporter string, packet []byte) ([]Flow, error) {
+	if len(packet) < ipfixHeaderLength {
+		return nil, fmt.Errorf("IPFIX header too short")
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if length < ipfixHeaderLength || length > len(packet) {
+		return nil, fmt.Errorf("invalid IPFIX message length %d", length)
+	}
+	exported := time.Unix(int64(binary.BigEndian.Uint32(packet[4:])), 0)
+	domain := binary.BigEndian.Uint32(packet[12:])
+
+	flows := []Flow{}
+	for rest := packet[ipfixHeaderLength:length]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return flows, fmt.Errorf("IPFIX set header too short")
+		}
+		id := binary.BigEndian.Uint16(rest)
+		setLength := int(binary.BigEndian.Uint16(rest[2:]))
+		if setLength < 4 || setLength > len(rest) {
+			return flows, fmt.Errorf("invalid IPFIX set length %d", setLength)
+		}
+		set := rest[4:setLength]
+		rest = rest[setLength:]
+
+		switch {
+		case id == ipfixTemplateSet:
+			if err := d.readTemplates(exporter, domain, set); err != nil {
+				return flows, err
+			}
+		case id >= ipfixMinDataSet:
+			d.mutex.Lock()
+			fields, ok := d.templates[ipfixTemplateKey{exporter, domain, id}]
+			d.mutex.Unlock()
+			if !ok {
+				continue
+			}
+			decoded, err := decodeIPFIXData(set, fields, exported)
+			flows = append(flows, decoded...)
+			if err != nil {
+				return flows, err
+			}
+		}
+		// options templates and their data aren't needed
+	}
+	return flows, nil
+}
+
+// readTemplates stores the templates of a template set
+func (d *NetflowDecoder) readTemplates(exporter string, domain uint32, set []byte) error {
+	for len(set) >= 4 {
+		id := binary.BigEndian.Uint16(set)
+		count := int(binary.BigEndian.Uint16(set[2:]))
+		set = set[4:]
+		if id < ipfixMinDataSet {
+			// padding at the end of the set
+			return nil
+		}
+
+		fields := make([]ipfixField, 0, count)
+		for i := 0; i < count; i++ {
+			if len(set) < 4 {
+				return fmt.Errorf("IPFIX template %d too short", id)
+			}
+			f := ipfixField{id: binary.BigEndian.Uint16(set), length: binary.BigEndian.Uint16(set[2:])}
+			set = set[4:]
+			if f.id&0x8000 != 0 {
+				// enterprise specific, never one the decoder reads
+				if len(set) < 4 {
+					return fmt.Errorf("IPFIX template %d too short", id)
+				}
+				set = set[4:]
+				f.id = 0
+			}
+			fields = append(fields, f)
+		}
+
+		if err := d.setTemplate(ipfixTemplateKey{exporter, domain, id}, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTemplate stores or, without fields, withdraws a template within the
+// limits of the decoder
+func (d *NetflowDecoder) setTemplate(key ipfixTemplateKey, fields []ipfixField) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, exists := d.templates[key]
+	switch {
+	case len(fields) == 0:
+		if exists {
+			delete(d.templates, key)
+			if d.exporters[key.exporter]--; d.exporters[key.exporter] == 0 {
+				delete(d.exporters, key.exporter)
+			}
+		}
+		return nil
+	case exists:
+		d.templates[key] = fields
+		return nil
+	case d.perExporter > 0 && d.exporters[key.exporter] >= d.perExporter:
+		return fmt.Errorf("IPFIX template %d exceeds the limit of %d templates per exporter", key.id, d.perExporter)
+	case d.total > 0 && len(d.templates) >= d.total:
+		return fmt.Errorf("IPFIX template %d exceeds the limit of %d templates", key.id, d.total)
+	}
+	d.templates[key] = fields
+	d.exporters[key.exporter]++
+	return nil
+}
+
+// decodeIPFIXData decodes the records of a data set with the fields of its
+// template
+func decodeIPFIXData(set []byte, fields []ipfixField, exported time.Time) ([]Flow, error) {
+	// anything shorter than a record at the end of the set is padding
+	minLength := 0
+	for _, field := range fields {
+		if field.length == ipfixVariableLength {
+			minLength++
+		} else {
+			minLength += int(field.length)
+		}
+	}
+	if minLength == 0 {
+		return nil, nil
+	}
+
+	flows := []Flow{}
+	for len(set) >= minLength {
+		f := Flow{Time: exported}
+		var protocol, flags uint64
+		for _, field := range fields {
+			length := int(field.length)
+			if field.length == ipfixVariableLength {
+				if len(set) < 1 {
+					return flows, fmt.Errorf("IPFIX record too short")
+				}
+				length, set = int(set[0]), set[1:]
+				if length == 255 {
+					if len(set) < 2 {
+						return flows, fmt.Errorf("IPFIX record too short")
+					}
+					length, set = int(binary.BigEndian.Uint16(set)), set[2:]
+				}
+			}
+			if len(set) < length {
+				return flows, fmt.Errorf("IPFIX record too short")
+			}
+			value := set[:length]
+			set = set[length:]
+
+			switch field.id {
+			case ipfixSourceIPv4Address, ipfixSourceIPv6Address:
+				if length == net.IPv4len || length == net.IPv6len {
+					f.IP = net.IP(append([]byte(nil), value...))
+				}
+			case ipfixPacketDeltaCount:
+				f.Packets = ipfixUint(value)
+			case ipfixOctetDeltaCount:
+				f.Bytes = ipfixUint(value)
+			case ipfixProtocolIdentifier:
+				protocol = ipfixUint(value)
+			case ipfixTCPControlBits:
+				flags = ipfixUint(value)
+			case ipfixFlowEndSeconds:
+				f.Time = time.Unix(int64(ipfixUint(value)), 0)
+			case ipfixFlowEndMilliseconds:
+				f.Time = time.UnixMilli(int64(ipfixUint(value)))
+			}
+		}
+		if f.IP == nil {
+			continue
+		}
+		if protocol <= 0xff && isConnectionAttempt(uint8(protocol), uint8(flags)) {
+			f.SYNs = 1
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+// ipfixUint reads an unsigned integer in reduced-size encoding
+func ipfixUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
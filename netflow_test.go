@@ -0,0 +1,169 @@
+package botdetect
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodeNetflow5(t *testing.T) {
+	exported := time.Unix(1700000000, 0)
+	packet := make([]byte, netflow5HeaderLength+2*netflow5RecordLength)
+	binary.BigEndian.PutUint16(packet, 5)
+	binary.BigEndian.PutUint16(packet[2:], 2)
+	binary.BigEndian.PutUint32(packet[4:], 60000)
+	binary.BigEndian.PutUint32(packet[8:], uint32(exported.Unix()))
+	binary.BigEndian.PutUint16(packet[22:], 0x4000|10) // sampling 1 in 10
+
+	records := []struct {
+		ip       string
+		packets  uint32
+		last     uint32
+		protocol uint8
+		flags    uint8
+	}{
+		{"192.0.2.1", 3, 59000, protocolTCP, tcpSYN},
+		{"192.0.2.2", 20, 60000, protocolTCP, tcpSYN | tcpACK},
+	}
+	for i, rec := range records {
+		r := packet[netflow5HeaderLength+i*netflow5RecordLength:]
+		copy(r, net.ParseIP(rec.ip).To4())
+		binary.BigEndian.PutUint32(r[16:], rec.packets)
+		binary.BigEndian.PutUint32(r[20:], rec.packets*60)
+		binary.BigEndian.PutUint32(r[28:], rec.last)
+		r[37], r[38] = rec.flags, rec.protocol
+	}
+
+	flows, err := NewNetflowDecoder(0, 0).Decode("192.0.2.254", packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flows, got %+v", flows)
+	}
+	f := flows[0]
+	if !f.IP.Equal(net.ParseIP("192.0.2.1")) || f.Packets != 30 || f.Bytes != 1800 || f.SYNs != 10 ||
+		!f.Time.Equal(exported.Add(-time.Second)) {
+		t.Errorf("unexpected first flow %+v", f)
+	}
+	if flows[1].SYNs != 0 {
+		t.Errorf("expected an answered connection not to count as an attempt, got %+v", flows[1])
+	}
+
+	if _, err := NewNetflowDecoder(0, 0).Decode("192.0.2.254", packet[:60]); err == nil {
+		t.Error("expected an error for a truncated packet")
+	}
+	if _, err := NewNetflowDecoder(0, 0).Decode("192.0.2.254", []byte{0, 9, 0, 0}); err == nil {
+		t.Error("expected an error for Netflow v9")
+	}
+}
+
+// ipfixMessage builds an IPFIX message of the sets
+func ipfixMessage(sets ...[]byte) []byte {
+	msg := make([]byte, ipfixHeaderLength)
+	binary.BigEndian.PutUint16(msg, 10)
+	binary.BigEndian.PutUint32(msg[4:], 1700000000)
+	binary.BigEndian.PutUint32(msg[12:], 7)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	return msg
+}
+
+func ipfixSet(id uint16, body []byte) []byte {
+	set := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(set, id)
+	binary.BigEndian.PutUint16(set[2:], uint16(4+len(body)))
+	return append(set, body...)
+}
+
+func TestDecodeIPFIX(t *testing.T) {
+	// template 256: sourceIPv6Address, an enterprise field, packetDeltaCount
+	// in 4 bytes, octetDeltaCount, protocolIdentifier, tcpControlBits and
+	// flowEndMilliseconds
+	template := []byte{1, 0, 0, 7,
+		0, 27, 0, 16,
+		0x80, 1, 0, 2, 0, 0, 0x12, 0x34,
+		0, 2, 0, 4,
+		0, 1, 0, 8,
+		0, 4, 0, 1,
+		0, 6, 0, 2,
+		0, 153, 0, 8,
+	}
+	end := time.UnixMilli(1700000000500)
+	record := append([]byte(nil), net.ParseIP("2001:db8::1")...)
+	record = append(record, 0xff, 0xff)
+	record = append(record, 0, 0, 0, 4)
+	record = append(record, 0, 0, 0, 0, 0, 0, 0, 240)
+	record = append(record, protocolTCP, 0, tcpSYN)
+	record = append(record, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(record[len(record)-8:], uint64(end.UnixMilli()))
+
+	d := NewNetflowDecoder(0, 0)
+	data := ipfixSet(256, append(append(append([]byte(nil), record...), record...), 0, 0, 0))
+
+	// data before its template is skipped
+	if flows, err := d.Decode("a", ipfixMessage(data)); err != nil || len(flows) != 0 {
+		t.Errorf("expected no flows without a template, got %+v, %v", flows, err)
+	}
+
+	flows, err := d.Decode("a", ipfixMessage(ipfixSet(ipfixTemplateSet, template), data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flows and the padding to be ignored, got %+v", flows)
+	}
+	f := flows[0]
+	if !f.IP.Equal(net.ParseIP("2001:db8::1")) || f.Packets != 4 || f.Bytes != 240 || f.SYNs != 1 || !f.Time.Equal(end) {
+		t.Errorf("unexpected flow %+v", f)
+	}
+
+	// templates are per exporter
+	if flows, _ := d.Decode("b", ipfixMessage(data)); len(flows) != 0 {
+		t.Errorf("expected the template of another exporter not to be used, got %+v", flows)
+	}
+	truncated := ipfixSet(256, record)
+	binary.BigEndian.PutUint16(truncated[2:], 200)
+	if _, err := d.Decode("a", ipfixMessage(truncated)); err == nil {
+		t.Error("expected an error for a truncated set")
+	}
+}
+
+func TestIPFIXTemplateLimits(t *testing.T) {
+	template := func(id uint16) []byte {
+		return ipfixMessage(ipfixSet(ipfixTemplateSet, []byte{byte(id >> 8), byte(id), 0, 1, 0, 8, 0, 4}))
+	}
+
+	d := NewNetflowDecoder(2, 3)
+	for _, id := range []uint16{256, 257} {
+		if _, err := d.Decode("a", template(id)); err != nil {
+			t.Fatalf("template %d: unexpected error %s", id, err)
+		}
+	}
+	if _, err := d.Decode("a", template(256)); err != nil {
+		t.Errorf("expected a template to be replaced within the limit, got %s", err)
+	}
+	if _, err := d.Decode("a", template(258)); err == nil {
+		t.Error("expected the third template of the exporter to exceed the limit")
+	}
+	if _, err := d.Decode("b", template(256)); err != nil {
+		t.Errorf("expected the template of another exporter within the limits, got %s", err)
+	}
+	if _, err := d.Decode("c", template(256)); err == nil {
+		t.Error("expected the fourth template to exceed the total limit")
+	}
+
+	// a withdrawal makes room
+	if _, err := d.Decode("a", ipfixMessage(ipfixSet(ipfixTemplateSet, []byte{1, 0, 0, 0}))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode("c", template(256)); err != nil {
+		t.Errorf("expected a template to fit after the withdrawal, got %s", err)
+	}
+	if len(d.templates) != 3 || d.exporters["a"] != 1 {
+		t.Errorf("expected 3 templates, 1 of exporter a, got %v and %v", d.templates, d.exporters)
+	}
+}
@@ -0,0 +1,190 @@
+package botdetect
+
+import (
+	"strings"
+)
+
+// URLNormalization is a step of a URLNormalizer
+type URLNormalization string
+
+// The steps a URLNormalizer can take
+const (
+	// NormalizeLowercaseHost lowercases the scheme and host of absolute
+	// URLs
+	NormalizeLowercaseHost URLNormalization = "lowercase-host"
+
+	// NormalizeDecode decodes percent-encoded characters in the path,
+	// except for those that would change its structure: '/', '?', '#',
+	// '%', spaces and control characters
+	NormalizeDecode URLNormalization = "decode"
+
+	// NormalizeCollapseSlashes replaces runs of slashes in the path by a
+	// single one
+	NormalizeCollapseSlashes URLNormalization = "collapse-slashes"
+
+	// NormalizeStripQuery removes the query string and the fragment
+	NormalizeStripQuery URLNormalization = "strip-query"
+)
+
+var urlNormalizations = map[URLNormalization]func(string) string{
+	NormalizeLowercaseHost:   lowercaseHost,
+	NormalizeDecode:          decodePath,
+	NormalizeCollapseSlashes: collapseSlashes,
+	NormalizeStripQuery:      stripQuery,
+}
+
+// URLNormalizer canonicalizes URLs before they are classified, so that e.g.
+// cache-busting query strings or doubled slashes don't turn an asset into an
+// app request or evade rules on paths. The steps are taken in order.
+type URLNormalizer struct {
+	steps []URLNormalization
+	funcs []func(string) string
+}
+
+// NewURLNormalizer creates a URLNormalizer taking the given steps
+func NewURLNormalizer(steps ...URLNormalization) (*URLNormalizer, error) {
+	n := &URLNormalizer{}
+	for _, step := range steps {
+		fn, ok := urlNormalizations[step]
+		if !ok {
+			return nil, configErrorf("invalid URL normalization '%s': expected %s, %s, %s or %s", step,
+				NormalizeLowercaseHost, NormalizeDecode, NormalizeCollapseSlashes, NormalizeStripQuery)
+		}
+		n.steps = append(n.steps, step)
+		n.funcs = append(n.funcs, fn)
+	}
+	return n, nil
+}
+
+// ParseURLNormalizer parses a comma separated list of steps, e.g.
+// "lowercase-host,decode,collapse-slashes,strip-query"
+func ParseURLNormalizer(s string) (*URLNormalizer, error) {
+	steps := []URLNormalization{}
+	for _, step := range strings.Split(s, ",") {
+		step = strings.TrimSpace(step)
+		if step != "" {
+			steps = append(steps, URLNormalization(step))
+		}
+	}
+	return NewURLNormalizer(steps...)
+}
+
+// String returns the steps in the format understood by ParseURLNormalizer
+func (n *URLNormalizer) String() string {
+	if n == nil {
+		return ""
+	}
+	steps := make([]string, len(n.steps))
+	for i, step := range n.steps {
+		steps[i] = string(step)
+	}
+	return strings.Join(steps, ",")
+}
+
+// Normalize returns the canonical form of the URL, which is either a path
+// with an optional query string or an absolute URL. A nil URLNormalizer
+// returns the URL unchanged. URLs that are already canonical are returned
+// without allocating.
+func (n *URLNormalizer) Normalize(url string) string {
+	if n == nil {
+		return url
+	}
+	for _, fn := range n.funcs {
+		url = fn(url)
+	}
+	return url
+}
+
+// splitURL splits a URL into the scheme and host (if it is absolute), the
+// path and the query string and fragment
+func splitURL(url string) (host, path, query string) {
+	if i := strings.Index(url, "://"); i > 0 && strings.IndexAny(url[:i], "/?#") < 0 {
+		end := i + 3
+		if j := strings.IndexAny(url[end:], "/?#"); j >= 0 {
+			end += j
+		} else {
+			end = len(url)
+		}
+		host, url = url[:end], url[end:]
+	}
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return host, url[:i], url[i:]
+	}
+	return host, url, ""
+}
+
+func lowercaseHost(url string) string {
+	host, path, query := splitURL(url)
+	if host == "" {
+		return url
+	}
+	lower := strings.ToLower(host)
+	if lower == host {
+		return url
+	}
+	return lower + path + query
+}
+
+func decodePath(url string) string {
+	host, path, query := splitURL(url)
+	if strings.IndexByte(path, '%') < 0 {
+		return url
+	}
+
+	var b strings.Builder
+	b.Grow(len(url))
+	b.WriteString(host)
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			hi, ok1 := unhex(path[i+1])
+			lo, ok2 := unhex(path[i+2])
+			c := hi<<4 | lo
+			if ok1 && ok2 && c > ' ' && c != 0x7f && c != '/' && c != '?' && c != '#' && c != '%' {
+				b.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	b.WriteString(query)
+	return b.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func collapseSlashes(url string) string {
+	host, path, query := splitURL(url)
+	if !strings.Contains(path, "//") {
+		return url
+	}
+
+	var b strings.Builder
+	b.Grow(len(url))
+	b.WriteString(host)
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	b.WriteString(query)
+	return b.String()
+}
+
+func stripQuery(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
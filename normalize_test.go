@@ -0,0 +1,92 @@
+package botdetect
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseURLNormalizer(t *testing.T) {
+	n, err := ParseURLNormalizer(" decode, strip-query ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.String() != "decode,strip-query" {
+		t.Errorf("unexpected steps %s", n)
+	}
+
+	if _, err := ParseURLNormalizer("decode,lowercase"); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error, got %v", err)
+	}
+}
+
+func TestURLNormalizer(t *testing.T) {
+	for _, test := range []struct {
+		steps    string
+		url      string
+		expected string
+	}{
+		{"strip-query", "/app.js?v=123", "/app.js"},
+		{"strip-query", "/page#top", "/page"},
+		{"collapse-slashes", "//static///app.css?u=http://x", "/static/app.css?u=http://x"},
+		{"collapse-slashes", "https://example.com//a//b", "https://example.com/a/b"},
+		{"decode", "/%61dmin/logo%2Epng?q=%61", "/admin/logo.png?q=%61"},
+		// characters that change the structure of the path stay encoded
+		{"decode", "/a%2Fb%3F%23%25%20%0a", "/a%2Fb%3F%23%25%20%0a"},
+		{"decode", "/broken%6", "/broken%6"},
+		{"lowercase-host", "HTTPS://Example.COM/Path?Q", "https://example.com/Path?Q"},
+		{"lowercase-host", "/Path/HTTP://X", "/Path/HTTP://X"},
+		// steps are taken in order
+		{"decode,collapse-slashes", "/a%2F/b", "/a%2F/b"},
+		{"decode,collapse-slashes,strip-query", "/%2e%2e//style%2Ecss?cachebust=1", "/../style.css"},
+		{"", "/Unchanged//?x", "/Unchanged//?x"},
+	} {
+		n, err := ParseURLNormalizer(test.steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url := n.Normalize(test.url); url != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.steps, test.url, test.expected, url)
+		}
+	}
+
+	var n *URLNormalizer
+	if url := n.Normalize("/a//b"); url != "/a//b" {
+		t.Errorf("expected a nil normalizer to keep the URL, got %s", url)
+	}
+}
+
+func TestURLNormalizerAllocs(t *testing.T) {
+	n, _ := ParseURLNormalizer("lowercase-host,decode,collapse-slashes,strip-query")
+	allocs := testing.AllocsPerRun(100, func() {
+		n.Normalize("/static/app.js")
+	})
+	if allocs != 0 {
+		t.Errorf("expected canonical URLs not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestDeciderNormalizer(t *testing.T) {
+	requests := make(chan *Request, 10)
+	normalizer, _ := ParseURLNormalizer("collapse-slashes,strip-query")
+	d, err := NewDecider(requests, nil, &DeciderOptions{
+		Normalizer: normalizer,
+		Dedup:      NewDeduplicator(time.Minute, 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := func(ip net.IP) (bool, string) { return false, "" }
+
+	// cache busting doesn't make an event look new
+	d.Decide(&Input{Remote: "192.0.2.1", URL: "//app.js?v=1", Time: "2020-01-02T03:04:05Z"}, pass)
+	d.Decide(&Input{Remote: "192.0.2.1", URL: "/app.js?v=2", Time: "2020-01-02T03:04:05Z"}, pass)
+
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	if req := <-requests; req.URL != "/app.js" {
+		t.Errorf("expected the normalized URL, got %s", req.URL)
+	}
+}
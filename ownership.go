@@ -0,0 +1,289 @@
+package botdetect
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points each member gets on a
+// HashRing unless configured otherwise
+const DefaultVirtualNodes = 128
+
+// HashRing assigns every IP to one member of a fleet by consistent hashing.
+// When members join or leave, only the IPs of the neighbouring points move
+// to another member.
+type HashRing struct {
+	vnodes  int
+	members []string
+	points  []ringPoint
+	mutex   sync.RWMutex
+}
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// NewHashRing creates a HashRing of the members with vnodes points each,
+// DefaultVirtualNodes if vnodes isn't positive
+func NewHashRing(members []string, vnodes int) *HashRing {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &HashRing{vnodes: vnodes}
+	r.SetMembers(members)
+	return r
+}
+
+// SetMembers replaces the members of the ring, e.g. when an instance joins
+// or leaves the fleet. Duplicates and empty names are ignored.
+func (r *HashRing) SetMembers(members []string) {
+	seen := make(map[string]bool, len(members))
+	unique := make([]string, 0, len(members))
+	for _, m := range members {
+		if m != "" && !seen[m] {
+			seen[m] = true
+			unique = append(unique, m)
+		}
+	}
+	sort.Strings(unique)
+
+	points := make([]ringPoint, 0, len(unique)*r.vnodes)
+	for _, m := range unique {
+		for i := 0; i < r.vnodes; i++ {
+			points = append(points, ringPoint{hash: ringHash(m + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].member < points[j].member
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.members = unique
+	r.points = points
+}
+
+// Members returns the sorted members of the ring
+func (r *HashRing) Members() []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]string(nil), r.members...)
+}
+
+// Owner returns the member owning the key, an empty string if the ring has
+// no members
+func (r *HashRing) Owner(key string) string {
+	if r == nil {
+		return ""
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].member
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV spreads similar keys such as the IPs of one network poorly over
+	// the high bits, so mix them once more
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// HandoffStore is implemented by CounterStores that can pass IPs on to the
+// replica owning them, which is required for ReplicationOptions.Ring
+type HandoffStore interface {
+	// Hand queues the IPs for evaluation by the owner
+	Hand(ctx context.Context, owner string, ips []string) error
+
+	// Take returns and removes the IPs queued for the owner
+	Take(ctx context.Context, owner string) ([]string, error)
+}
+
+// Hand queues the IPs for the owner
+func (s *MemoryCounterStore) Hand(ctx context.Context, owner string, ips []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.handed == nil {
+		s.handed = make(map[string]map[string]bool)
+	}
+	queue, ok := s.handed[owner]
+	if !ok {
+		queue = make(map[string]bool, len(ips))
+		s.handed[owner] = queue
+	}
+	for _, ip := range ips {
+		queue[ip] = true
+	}
+	return nil
+}
+
+// Take returns and removes the IPs queued for the owner
+func (s *MemoryCounterStore) Take(ctx context.Context, owner string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	queue := s.handed[owner]
+	delete(s.handed, owner)
+	ips := make([]string, 0, len(queue))
+	for ip := range queue {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// owns returns whether this replica evaluates the rules for the IP, which
+// is always the case without a ring or with an empty one
+func (h *IPHistory) owns(ip string) bool {
+	r := h.opts().Replication
+	if r == nil || r.Ring == nil {
+		return true
+	}
+	owner := r.Ring.Owner(ip)
+	return owner == "" || owner == r.Replica
+}
+
+// handoff passes the updated IPs this replica doesn't own on to their owners
+// and returns the IPs to evaluate: the owned ones among updated and those
+// handed over by the other replicas
+func (h *IPHistory) handoff(updated map[string]bool) map[string]bool {
+	r := h.opts().Replication
+	if r == nil {
+		return updated
+	}
+	if r.Ring == nil {
+		return h.takeFromFollowers(updated)
+	}
+	store := r.Store.(HandoffStore)
+
+	owned := make(map[string]bool, len(updated))
+	foreign := make(map[string][]string)
+	for ip := range updated {
+		owner := r.Ring.Owner(ip)
+		if owner == "" || owner == r.Replica {
+			owned[ip] = true
+			continue
+		}
+		foreign[owner] = append(foreign[owner], ip)
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, r.Timeout)
+	defer cancel()
+
+	for owner, ips := range foreign {
+		if err := store.Hand(ctx, owner, ips); err != nil {
+			h.replicationError(err)
+			continue
+		}
+		h.handed.Add(uint64(len(ips)))
+	}
+
+	taken, err := store.Take(ctx, r.Replica)
+	if err != nil {
+		h.replicationError(err)
+	}
+	for _, ip := range taken {
+		// the ring may have changed since the IP was handed over, the
+		// new owner gets it with the next request
+		if h.owns(ip) {
+			owned[ip] = true
+		}
+	}
+	return owned
+}
+
+// takeFromFollowers returns the updated IPs and those the other replicas
+// handed over to this one as the leader, see LeaderNamer
+func (h *IPHistory) takeFromFollowers(updated map[string]bool) map[string]bool {
+	_, store, ok := h.namedLeader()
+	if !ok {
+		return updated
+	}
+	r := h.opts().Replication
+
+	ctx, cancel := context.WithTimeout(h.ctx, r.Timeout)
+	defer cancel()
+
+	taken, err := store.Take(ctx, r.Replica)
+	if err != nil {
+		h.replicationError(err)
+	}
+	if len(taken) == 0 {
+		return updated
+	}
+	evaluate := make(map[string]bool, len(updated)+len(taken))
+	for ip := range updated {
+		evaluate[ip] = true
+	}
+	for _, ip := range taken {
+		evaluate[ip] = true
+	}
+	return evaluate
+}
+
+// handToLeader publishes the slots of the IPs updated since the last
+// calculation and hands the IPs over to the leader, see LeaderNamer. Without
+// a known leader, or if the store fails, they are kept for the next
+// calculation.
+func (h *IPHistory) handToLeader() {
+	leader, store, ok := h.namedLeader()
+	if !ok || leader == "" {
+		return
+	}
+	r := h.opts().Replication
+
+	h.mutex.Lock()
+	updated := h.updatedIPs
+	h.updatedIPs = make(map[string]bool)
+	h.mutex.Unlock()
+	if len(updated) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, r.Timeout)
+	defer cancel()
+
+	err := h.publish(ctx, updated)
+	if err == nil {
+		ips := make([]string, 0, len(updated))
+		for ip := range updated {
+			ips = append(ips, ip)
+		}
+		if err = store.Hand(ctx, leader, ips); err == nil {
+			h.handed.Add(uint64(len(ips)))
+			return
+		}
+	}
+	h.replicationError(err)
+
+	h.mutex.Lock()
+	for ip := range updated {
+		h.updatedIPs[ip] = true
+	}
+	h.mutex.Unlock()
+}
@@ -0,0 +1,115 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing([]string{"a", "b", "c", "b", ""}, 0)
+	if members := ring.Members(); len(members) != 3 {
+		t.Errorf("expected 3 unique members, got %v", members)
+	}
+
+	owners := map[string]string{}
+	shares := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		owners[ip] = ring.Owner(ip)
+		shares[owners[ip]]++
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		if shares[m] < 700 || shares[m] > 1300 {
+			t.Errorf("expected %s to own about a third of the IPs, got %v", m, shares)
+		}
+	}
+
+	// only the IPs of the leaving member move
+	ring.SetMembers([]string{"a", "b"})
+	for ip, owner := range owners {
+		if got := ring.Owner(ip); owner != "c" && got != owner {
+			t.Fatalf("%s moved from %s to %s", ip, owner, got)
+		} else if got == "c" {
+			t.Fatalf("%s is still owned by the member that left", ip)
+		}
+	}
+
+	if owner := NewHashRing(nil, 0).Owner("10.0.0.1"); owner != "" {
+		t.Errorf("expected no owner on an empty ring, got %s", owner)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryCounterStore()
+	ring := NewHashRing([]string{"a", "b"}, 0)
+	replica := func(name string) *IPHistory {
+		h, err := NewIPHistory(ctx, &IPHistoryOptions{
+			TimestampFormat: "15:04",
+			TimeSlot:        time.Minute,
+			Window:          time.Hour,
+			Interval:        time.Hour,
+			ExpireInterval:  time.Hour,
+			BlacklistTTL:    time.Hour,
+			MaxRequests:     15,
+			Metrics:         NewMetrics(),
+			Replication:     &ReplicationOptions{Store: store, Replica: name, Timeout: time.Second, Ring: ring},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a, b := replica("a"), replica("b")
+
+	// an IP owned by b that only sends requests to a
+	var ip net.IP
+	for i := 1; ip == nil; i++ {
+		if candidate := net.IPv4(192, 0, 2, byte(i)); ring.Owner(ipKey(candidate)) == "b" {
+			ip = candidate
+		}
+	}
+	for i := 0; i < 20; i++ {
+		a.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	}
+	for a.Processed() < 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	a.TriggerCalculate()
+	if a.IsBlacklisted(ip) {
+		t.Error("expected only the owner to evaluate the rules")
+	}
+	if handed := a.handed.Values()[""]; handed != 1 {
+		t.Errorf("expected the IP to be handed over once, got %d", handed)
+	}
+	b.TriggerCalculate()
+	if !b.IsBlacklisted(ip) {
+		t.Error("expected the owner to blacklist the IP on the requests of the other replica")
+	}
+	if ips, _ := store.Take(ctx, "b"); len(ips) != 0 {
+		t.Errorf("expected the owner to have taken the IPs handed to it, got %v", ips)
+	}
+}
+
+func TestOwnershipRequiresHandoff(t *testing.T) {
+	_, err := NewIPHistory(context.Background(), &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Hour,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    15,
+		Replication: &ReplicationOptions{Store: failingStore{}, Replica: "a", Timeout: time.Second,
+			Ring: NewHashRing([]string{"a"}, 0)},
+	})
+	if !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error for a store without handoff, got %v", err)
+	}
+}
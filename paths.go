@@ -0,0 +1,41 @@
+package botdetect
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// matchesPath determines whether the path of the URL is one of the patterns.
+// A trailing '*' in a pattern matches every path with the prefix.
+func matchesPath(patterns []string, rawURL string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(path, p[:len(p)-1]) {
+			return true
+		}
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePaths returns the problems with path patterns, which must be
+// absolute paths
+func validatePaths(name string, patterns []string) []string {
+	problems := []string{}
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "/") {
+			problems = append(problems, fmt.Sprintf("%s: '%s' must start with /", name, p))
+		}
+	}
+	return problems
+}
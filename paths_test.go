@@ -0,0 +1,79 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchesPath(t *testing.T) {
+	patterns := []string{"/healthz", "/.well-known/*"}
+
+	for url, expected := range map[string]bool{
+		"/healthz":                    true,
+		"/healthz?probe=1":            true,
+		"/healthz/deep":               false,
+		"/.well-known/security.txt":   true,
+		"/.well-known/":               true,
+		"/.well-known":                false,
+		"https://example.com/healthz": true,
+		"/index.html":                 false,
+	} {
+		if got := matchesPath(patterns, url); got != expected {
+			t.Errorf("%s: expected %v, got %v", url, expected, got)
+		}
+	}
+	if matchesPath(nil, "/healthz") {
+		t.Error("expected no match without patterns")
+	}
+}
+
+func TestUncounted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     5,
+		MaxRatio:        0.5,
+		Metrics:         NewMetrics(),
+		Uncounted:       []string{"beacon"},
+	}
+	if err := options.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for a relative path, got %v", err)
+	}
+
+	options.Uncounted = []string{"/beacon", "/sw/*"}
+	h, err := NewIPHistory(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		h.RequestChannel() <- &Request{URL: "/beacon?event=scroll", IP: ip}
+		h.RequestChannel() <- &Request{URL: "/sw/worker.js", IP: ip}
+	}
+	h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	for h.Processed() < 21 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if h.IsBlacklisted(ip) {
+		t.Error("expected requests to uncounted paths not to be counted")
+	}
+	if a := h.Annotate(ip); a.Remaining != 4 {
+		t.Errorf("expected only the request to / to be counted, got %+v", a)
+	}
+	if n := h.uncounted.Values()[""]; n != 20 {
+		t.Errorf("expected 20 uncounted requests, got %d", n)
+	}
+}
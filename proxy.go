@@ -0,0 +1,93 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultProxyHeaders are set by open proxies and anonymizers, but neither by
+// browsers nor usually by a site's own reverse proxies
+var DefaultProxyHeaders = []string{
+	"Via",
+	"X-Proxy-Id",
+	"Proxy-Connection",
+	"X-Proxy-Connection",
+}
+
+// ProxyDetector recognizes requests whose headers show that they passed
+// through an open proxy or anonymizer. SOCKS proxies don't leave traces in
+// the request and can't be detected this way.
+type ProxyDetector struct {
+	headers []string
+	ip      *IP
+}
+
+// NewProxyDetector creates a ProxyDetector that flags requests carrying any
+// of the given headers or a Forwarded header that contradicts
+// X-Forwarded-For
+func NewProxyDetector(headers []string) (*ProxyDetector, error) {
+	canonical := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h != "" {
+			canonical = append(canonical, textproto.CanonicalMIMEHeaderKey(h))
+		}
+	}
+
+	ip, err := NewIP()
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyDetector{
+		headers: canonical,
+		ip:      ip,
+	}, nil
+}
+
+// Headers returns the headers the detector looks for
+func (pd *ProxyDetector) Headers() []string {
+	return pd.headers
+}
+
+// Detect returns whether the request came through a proxy and why
+func (pd *ProxyDetector) Detect(in *Input) (bool, string) {
+	for _, name := range pd.headers {
+		if in.Header(name) != "" {
+			return true, name + " header present"
+		}
+	}
+
+	if fwd := in.Header("Forwarded"); fwd != "" && in.XFF != "" {
+		if ip, ok := pd.conflict(ForwardedFor(fwd), in.XFF); ok {
+			return true, fmt.Sprintf("Forwarded for %s missing from X-Forwarded-For", ip)
+		}
+	}
+
+	return false, ""
+}
+
+// conflict returns a public address from Forwarded that X-Forwarded-For
+// doesn't know about
+func (pd *ProxyDetector) conflict(forwarded []net.IP, xff string) (net.IP, bool) {
+	known := []net.IP{}
+	for _, hop := range strings.Split(xff, ",") {
+		if ip := ParseIP(hop); ip != nil {
+			known = append(known, ip)
+		}
+	}
+
+outer:
+	for _, ip := range forwarded {
+		if pd.ip.IsPrivate(ip) {
+			continue
+		}
+		for _, k := range known {
+			if k.Equal(ip) {
+				continue outer
+			}
+		}
+		return ip, true
+	}
+	return nil, false
+}
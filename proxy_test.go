@@ -0,0 +1,38 @@
+package botdetect
+
+import "testing"
+
+func TestProxyDetector(t *testing.T) {
+	pd, err := NewProxyDetector(DefaultProxyHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input   Input
+		proxied bool
+	}{
+		{Input{XFF: "1.2.3.4"}, false},
+		{Input{XFF: "1.2.3.4", Headers: map[string]string{"Via": "1.1 squid"}}, true},
+		{Input{XFF: "1.2.3.4", Headers: map[string]string{"X-Proxy-Id": "123"}}, true},
+		{Input{XFF: "1.2.3.4", Headers: map[string]string{"Forwarded": `for=1.2.3.4;proto=https`}}, false},
+		{Input{XFF: "1.2.3.4", Headers: map[string]string{"Forwarded": `for=10.0.0.1`}}, false},
+		{Input{XFF: "2001:db8::1", Headers: map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`}}, false},
+		{Input{XFF: "1.2.3.4", Headers: map[string]string{"Forwarded": `for=_hidden, for=5.6.7.8`}}, true},
+	}
+
+	for _, test := range tests {
+		proxied, reason := pd.Detect(&test.input)
+		if proxied != test.proxied {
+			t.Errorf("%+v: expected %v, got %v (%s)", test.input, test.proxied, proxied, reason)
+		}
+	}
+
+	pd, err = NewProxyDetector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxied, _ := pd.Detect(&Input{Headers: map[string]string{"Via": "x"}}); proxied {
+		t.Error("expected no detection without headers")
+	}
+}
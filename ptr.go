@@ -0,0 +1,230 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PTRPattern adjusts the rules for IPs whose host name matches Pattern.
+// Pattern is either a host name or a domain with a leading "*.", which
+// matches all host names below it. MaxRequests and WarnRequests of all rules
+// are multiplied by Factor; a Factor of zero means the IP is never
+// blacklisted by rules, e.g. until a crawler has been verified.
+type PTRPattern struct {
+	Pattern string
+	Factor  float64
+}
+
+// String returns the pattern in the format understood by ParsePTRPatterns
+func (p PTRPattern) String() string {
+	if p.Factor == 0 {
+		return p.Pattern + "=never"
+	}
+	return p.Pattern + "=" + strconv.FormatFloat(p.Factor, 'f', -1, 64)
+}
+
+// Matches determines whether the host name matches the pattern
+func (p PTRPattern) Matches(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.HasPrefix(p.Pattern, "*.") {
+		return strings.HasSuffix(host, p.Pattern[1:])
+	}
+	return host == p.Pattern
+}
+
+// scale applies the factor to the thresholds of the rule
+func (p PTRPattern) scale(rule Rule) Rule {
+	return scaleRule(rule, p.Factor)
+}
+
+// ParsePTRPatterns parses a comma separated list of patterns in the form
+// pattern=factor or pattern=never, e.g.
+// "*.compute.amazonaws.com=0.5,*.googlebot.com=never"
+func ParsePTRPatterns(s string) ([]PTRPattern, error) {
+	patterns := []PTRPattern{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, configErrorf("invalid PTR pattern '%s': expected pattern=factor or pattern=never", def)
+		}
+
+		p := PTRPattern{Pattern: strings.TrimSuffix(strings.ToLower(parts[0]), ".")}
+		if parts[1] != "never" {
+			factor, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || factor <= 0 {
+				return nil, configErrorf("invalid factor in PTR pattern '%s'", def)
+			}
+			p.Factor = factor
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// PTROptions enables the PTR lookups of the history. The host names of IPs
+// whose app requests reach Near times the MaxRequests of a rule are looked
+// up in the background; once known, the first matching pattern adjusts the
+// rules for the IP.
+type PTROptions struct {
+	Cache    *PTRCache
+	Patterns []PTRPattern
+	Near     float64
+}
+
+// PTRCache resolves and caches the host names of IPs. Lookups run in the
+// background so that callers never wait for DNS.
+type PTRCache struct {
+	resolver  Resolver
+	timeout   time.Duration
+	ttl       time.Duration
+	cache     *lookupCache
+	confirmed *lookupCache
+}
+
+// NewPTRCache creates a PTRCache that keeps host names for ttl
+func NewPTRCache(resolver Resolver, timeout, ttl time.Duration) *PTRCache {
+	return &PTRCache{
+		resolver:  resolver,
+		timeout:   timeout,
+		ttl:       ttl,
+		cache:     newLookupCache(ttl, LookupLimits{}),
+		confirmed: newLookupCache(ttl, LookupLimits{}),
+	}
+}
+
+// SetLookupLimits replaces the default limits of the cache and the DNS
+// lookups. It drops the cached host names, so call it before use.
+func (pc *PTRCache) SetLookupLimits(limits LookupLimits) {
+	pc.cache = newLookupCache(pc.ttl, limits)
+	pc.confirmed = newLookupCache(pc.ttl, limits)
+}
+
+// Lookup returns the cached host names of the IP. If they aren't known yet a
+// background lookup is started and false is returned. IPs without a PTR
+// record have no host names.
+func (pc *PTRCache) Lookup(ip net.IP) ([]string, bool) {
+	if pc == nil {
+		return nil, false
+	}
+	ipstr := ipKey(ip)
+
+	v, ok := pc.cache.get(ipstr, func() (interface{}, error) {
+		return pc.lookup(ipstr)
+	})
+	names, _ := v.([]string)
+	return names, ok
+}
+
+// Cached returns the cached host names of the IP without starting a lookup
+func (pc *PTRCache) Cached(ip net.IP) ([]string, bool) {
+	if pc == nil {
+		return nil, false
+	}
+	v, ok := pc.cache.cached(ipKey(ip))
+	names, _ := v.([]string)
+	return names, ok
+}
+
+func (pc *PTRCache) lookup(ipstr string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+	defer cancel()
+
+	names, err := pc.resolver.LookupAddr(ctx, ipstr)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	for i := range names {
+		names[i] = strings.TrimSuffix(strings.ToLower(names[i]), ".")
+	}
+	return names, nil
+}
+
+// Confirmed returns the cached host names of the IP that resolve back to it
+// (forward-confirmed reverse DNS), which unlike PTR records alone can't be
+// claimed by whoever controls the reverse zone of the IP. If they aren't
+// known yet a background lookup is started and false is returned.
+func (pc *PTRCache) Confirmed(ip net.IP) ([]string, bool) {
+	if pc == nil {
+		return nil, false
+	}
+	ipstr := ipKey(ip)
+
+	v, ok := pc.confirmed.get(ipstr, func() (interface{}, error) {
+		return pc.confirm(ipstr)
+	})
+	names, _ := v.([]string)
+	return names, ok
+}
+
+func (pc *PTRCache) confirm(ipstr string) (interface{}, error) {
+	v, err := pc.lookup(ipstr)
+	names, _ := v.([]string)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+	defer cancel()
+
+	ip := net.ParseIP(ipstr)
+	confirmed := []string{}
+	for _, name := range names {
+		addrs, err := pc.resolver.LookupHost(ctx, name)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				confirmed = append(confirmed, name)
+				break
+			}
+		}
+	}
+	if len(confirmed) == 0 {
+		return nil, nil
+	}
+	return confirmed, nil
+}
+
+// Expire removes the host names whose ttl has passed
+func (pc *PTRCache) Expire() {
+	if pc == nil {
+		return
+	}
+	pc.cache.expireAll()
+	pc.confirmed.expireAll()
+}
+
+// LookupStats returns the number of cached IPs and of lookups postponed
+// because too many were running
+func (pc *PTRCache) LookupStats() (entries int, postponed uint64) {
+	if pc == nil {
+		return 0, 0
+	}
+	return pc.cache.size(), pc.cache.postponed()
+}
+
+// match returns the host name and the first pattern it matches
+func (o *PTROptions) match(names []string) (string, *PTRPattern) {
+	for i := range o.Patterns {
+		for _, name := range names {
+			if o.Patterns[i].Matches(name) {
+				return name, &o.Patterns[i]
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,149 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePTRPatterns(t *testing.T) {
+	patterns, err := ParsePTRPatterns("*.compute.amazonaws.com=0.5, crawl.Googlebot.com.=never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 2 || patterns[0].String() != "*.compute.amazonaws.com=0.5" || patterns[1].String() != "crawl.googlebot.com=never" {
+		t.Errorf("unexpected patterns %v", patterns)
+	}
+
+	for _, s := range []string{"*.example.com", "=0.5", "*.example.com=0", "*.example.com=fast"} {
+		if _, err := ParsePTRPatterns(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+
+	for host, expected := range map[string]bool{
+		"ec2-1-2-3-4.compute.amazonaws.com":  true,
+		"EC2-1-2-3-4.Compute.Amazonaws.Com.": true,
+		"compute.amazonaws.com":              false,
+		"evilcompute.amazonaws.com":          false,
+	} {
+		if patterns[0].Matches(host) != expected {
+			t.Errorf("%s: expected match to be %v", host, expected)
+		}
+	}
+}
+
+func TestPTRRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := &fakeResolver{ptr: map[string][]string{
+		"192.0.2.1": {"ec2-192-0-2-1.compute.amazonaws.com."},
+		"192.0.2.2": {"crawl-192-0-2-2.googlebot.com."},
+	}}
+	patterns, _ := ParsePTRPatterns("*.compute.amazonaws.com=0.5,*.googlebot.com=never")
+	cache := NewPTRCache(resolver, time.Second, time.Hour)
+
+	audit := NewAuditLog(10, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     10,
+		MaxRatio:        0.5,
+		Audit:           audit,
+		PTR:             &PTROptions{Cache: cache, Patterns: patterns, Near: 0.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(ip net.IP, n int) {
+		for i := 0; i < n; i++ {
+			h.RequestChannel() <- &Request{URL: "/", IP: ip}
+		}
+	}
+	cloud, crawler, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	send(cloud, 7)
+	send(other, 7)
+	send(crawler, 7)
+	for h.Processed() < 21 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first run starts the lookups of the IPs nearing the threshold, the
+	// second one uses their host names
+	h.TriggerCalculate()
+	for _, ip := range []net.IP{cloud, other, crawler} {
+		for {
+			if _, ok := cache.Lookup(ip); ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	send(cloud, 1)
+	send(other, 1)
+	send(crawler, 20)
+	for h.Processed() < 43 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if !h.IsBlacklisted(cloud) {
+		t.Error("expected the cloud IP to be blacklisted with the scaled threshold")
+	}
+	if h.IsBlacklisted(other) {
+		t.Error("expected the IP without a matching PTR record to stay below the threshold")
+	}
+	if h.IsBlacklisted(crawler) {
+		t.Error("expected the crawler IP never to be blacklisted")
+	}
+	entries := audit.Entries(crawler)
+	if len(entries) != 1 || entries[0].Decision != "ptr exempt" {
+		t.Errorf("expected a ptr exempt audit entry, got %v", entries)
+	}
+}
+
+func TestPTRConfirmed(t *testing.T) {
+	resolver := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"census1.shodan.io."},
+			"192.0.2.2": {"census2.shodan.io."},
+		},
+		host: map[string][]string{
+			"census1.shodan.io": {"192.0.2.1"},
+			// the reverse zone of 192.0.2.2 claims a name that doesn't
+			// resolve back to it
+			"census2.shodan.io": {"198.51.100.2"},
+		},
+	}
+	cache := NewPTRCache(resolver, time.Second, time.Hour)
+
+	confirmed := func(ip string) []string {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			names, ok := cache.Confirmed(net.ParseIP(ip))
+			if ok {
+				return names
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: the lookup didn't finish", ip)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if names := confirmed("192.0.2.1"); len(names) != 1 || names[0] != "census1.shodan.io" {
+		t.Errorf("expected the confirmed host name, got %v", names)
+	}
+	if names := confirmed("192.0.2.2"); len(names) != 0 {
+		t.Errorf("expected no confirmed host name, got %v", names)
+	}
+	if names := confirmed("192.0.2.3"); len(names) != 0 {
+		t.Errorf("expected no host name without a PTR record, got %v", names)
+	}
+}
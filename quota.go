@@ -0,0 +1,40 @@
+package botdetect
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// Quota returns how many app requests the IP has left before the rule
+// closest to matching blacklists it, and when the oldest request counted
+// against that rule leaves its window and gives back quota. The rules work
+// like token buckets that refill as their windows slide on. reset is zero if
+// no requests are counted, remaining is -1 if there are no rules.
+// Applications can use it to ask clients to slow down before they are
+// blocked.
+func (h *IPHistory) Quota(ip net.IP) (remaining int, reset time.Time) {
+	a := h.Annotate(ip)
+	return int(a.Remaining), a.Reset
+}
+
+// oldestAppSince returns the time of the oldest slot newer than cutoff with
+// app requests
+func oldestAppSince(counts *list.List, cutoff time.Time) (time.Time, bool) {
+	if counts == nil {
+		return time.Time{}, false
+	}
+
+	var oldest time.Time
+	found := false
+	for node := counts.Front(); node != nil; node = node.Next() {
+		hi := node.Value.(*IPHistoryItem)
+		if !hi.Timestamp.After(cutoff) {
+			break
+		}
+		if hi.App > 0 {
+			oldest, found = hi.Timestamp, true
+		}
+	}
+	return oldest, found
+}
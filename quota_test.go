@@ -0,0 +1,54 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     10,
+		MaxRatio:        0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	if remaining, reset := h.Quota(ip); remaining != 10 || !reset.IsZero() {
+		t.Errorf("expected the full quota for a new IP, got %d, %s", remaining, reset)
+	}
+
+	// assets don't count against the quota
+	earlier := time.Now().Add(-30 * time.Minute)
+	h.RequestChannel() <- &Request{URL: "/logo.png", IP: ip, Time: earlier.Add(-10 * time.Minute)}
+	h.RequestChannel() <- &Request{URL: "/", IP: ip, Time: earlier}
+	for i := 0; i < 3; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	for h.Processed() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	remaining, reset := h.Quota(ip)
+	if remaining != 6 {
+		t.Errorf("expected 6 requests left, got %d", remaining)
+	}
+	if expected := earlier.Truncate(time.Minute).Add(time.Hour); !reset.Equal(expected) {
+		t.Errorf("expected the quota to reset when the oldest app request leaves the window at %s, got %s", expected, reset)
+	}
+	if a := h.Annotate(ip); a.Limit != 10 {
+		t.Errorf("expected a limit of 10, got %d", a.Limit)
+	}
+}
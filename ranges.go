@@ -0,0 +1,116 @@
+package botdetect
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// rangeTable maps IP networks to values. Add all networks, then call sort
+// before the first lookup. Networks may nest, the most specific one wins.
+type rangeTable struct {
+	// networks are the networks as added, ranges the sorted ranges
+	// without overlaps sort derives from them
+	networks []ipRange
+	ranges   []ipRange
+}
+
+type ipRange struct {
+	start netip.Addr
+	end   netip.Addr
+	value int
+}
+
+// add inserts the network with the given value
+func (t *rangeTable) add(prefix netip.Prefix, value int) {
+	start := prefix.Masked().Addr()
+	t.networks = append(t.networks, ipRange{
+		start: netip.AddrFrom16(start.As16()),
+		end:   netip.AddrFrom16(lastAddr(prefix).As16()),
+		value: value,
+	})
+}
+
+// sort sorts the ranges and flattens nested networks, such as a provider's
+// /8 with a /16 of one of its services, into ranges that don't overlap, so
+// that lookup finds the most specific network of every address. Of networks
+// added twice the last one wins. Networks can be added after sort, which
+// must be called again then.
+func (t *rangeTable) sort() {
+	sort.SliceStable(t.networks, func(i, j int) bool {
+		if t.networks[i].start != t.networks[j].start {
+			return t.networks[i].start.Less(t.networks[j].start)
+		}
+		// the enclosing network first
+		return t.networks[j].end.Less(t.networks[i].end)
+	})
+
+	flat := make([]ipRange, 0, len(t.networks))
+	emit := func(start, end netip.Addr, value int) {
+		if start.IsValid() && !end.Less(start) {
+			flat = append(flat, ipRange{start: start, end: end, value: value})
+		}
+	}
+
+	// open holds the networks enclosing the current one, the innermost
+	// last, with next set to their first address not emitted yet, which
+	// is invalid once they are done
+	type open struct {
+		ipRange
+		next netip.Addr
+	}
+	stack := []open{}
+	pop := func() {
+		top := stack[len(stack)-1]
+		emit(top.next, top.end, top.value)
+		stack = stack[:len(stack)-1]
+	}
+	for _, r := range t.networks {
+		for len(stack) > 0 && stack[len(stack)-1].end.Less(r.start) {
+			pop()
+		}
+		if len(stack) > 0 {
+			// prefixes either nest or don't overlap at all
+			top := &stack[len(stack)-1]
+			if top.next.IsValid() && top.next.Less(r.start) {
+				emit(top.next, r.start.Prev(), top.value)
+			}
+			top.next = r.end.Next()
+			if top.end.Less(top.next) {
+				top.next = netip.Addr{}
+			}
+		}
+		stack = append(stack, open{ipRange: r, next: r.start})
+	}
+	for len(stack) > 0 {
+		pop()
+	}
+	t.ranges = flat
+}
+
+// lookup returns the value of the most specific network that contains the
+// address, which must be in its 16 byte form
+func (t *rangeTable) lookup(addr netip.Addr) (int, bool) {
+	// find the last range starting at or before the address
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return addr.Less(t.ranges[i].start)
+	}) - 1
+	if i < 0 || t.ranges[i].end.Less(addr) {
+		return 0, false
+	}
+	return t.ranges[i].value, true
+}
+
+// len returns the number of networks added
+func (t *rangeTable) len() int {
+	return len(t.networks)
+}
+
+// lastAddr returns the highest address within the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
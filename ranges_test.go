@@ -0,0 +1,49 @@
+package botdetect
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNestedRanges(t *testing.T) {
+	dl, err := ReadDatacenterList(strings.NewReader(`
+3.0.0.0/8,AMAZON
+3.5.0.0/16,EC2
+3.5.4.0/24,EC2-eu
+3.200.0.0/16,S3
+0.0.0.0/0,everything
+2001:db8::/32,v6
+2001:db8:ffff::/48,v6-end
+255.255.255.0/24,top
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Size() != 8 {
+		t.Errorf("expected 8 networks, got %d", dl.Size())
+	}
+
+	for ip, expected := range map[string]string{
+		"2.255.255.255":         "everything",
+		"3.0.0.1":               "AMAZON",
+		"3.5.0.1":               "EC2",
+		"3.5.4.200":             "EC2-eu",
+		"3.5.5.1":               "EC2",
+		"3.9.1.1":               "AMAZON",
+		"3.200.255.255":         "S3",
+		"3.201.0.0":             "AMAZON",
+		"3.255.255.255":         "AMAZON",
+		"4.0.0.0":               "everything",
+		"255.255.254.255":       "everything",
+		"255.255.255.255":       "top",
+		"2001:db8:1::1":         "v6",
+		"2001:db8:ffff:ffff::1": "v6-end",
+		"2001:db9::1":           "",
+	} {
+		provider, _ := dl.Lookup(net.ParseIP(ip))
+		if provider != expected {
+			t.Errorf("%s: expected '%s', got '%s'", ip, expected, provider)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package botdetect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultRDAPURL is a bootstrap service that redirects IP queries to the
+// responsible registry
+const DefaultRDAPURL = "https://rdap.org/ip/"
+
+// Ownership describes the network an IP belongs to and whom to contact about
+// abuse
+type Ownership struct {
+	Network string `json:"network"`
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+	Abuse   string `json:"abuse,omitempty"`
+}
+
+// String returns a one line summary suitable for logs and the audit trail
+func (o Ownership) String() string {
+	parts := []string{"network " + o.Network}
+	if o.Name != "" {
+		parts = append(parts, "name "+o.Name)
+	}
+	if o.Country != "" {
+		parts = append(parts, "country "+o.Country)
+	}
+	if o.Abuse != "" {
+		parts = append(parts, "abuse "+o.Abuse)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// OwnershipLookup finds out who owns the network of an IP. RDAPClient
+// implements it.
+type OwnershipLookup interface {
+	Lookup(ctx context.Context, ip net.IP) (*Ownership, error)
+}
+
+// RDAPClient queries an RDAP service for the ownership of IPs
+type RDAPClient struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewRDAPClient creates an RDAPClient that queries url, DefaultRDAPURL if
+// url is empty
+func NewRDAPClient(url string) *RDAPClient {
+	if url == "" {
+		url = DefaultRDAPURL
+	}
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &RDAPClient{URL: url, Client: http.DefaultClient}
+}
+
+type rdapEntity struct {
+	Roles      []string      `json:"roles"`
+	VCardArray []interface{} `json:"vcardArray"`
+	Entities   []rdapEntity  `json:"entities"`
+}
+
+type rdapNetwork struct {
+	Handle       string       `json:"handle"`
+	Name         string       `json:"name"`
+	Country      string       `json:"country"`
+	StartAddress string       `json:"startAddress"`
+	EndAddress   string       `json:"endAddress"`
+	Entities     []rdapEntity `json:"entities"`
+}
+
+// Lookup queries the ownership of the IP
+func (c *RDAPClient) Lookup(ctx context.Context, ip net.IP) (*Ownership, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+ipKey(ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RDAP lookup of %s failed: %s", ip, resp.Status)
+	}
+
+	var n rdapNetwork
+	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		return nil, fmt.Errorf("invalid RDAP response for %s: %s", ip, err)
+	}
+
+	o := &Ownership{
+		Network: n.Handle,
+		Name:    n.Name,
+		Country: n.Country,
+		Abuse:   abuseEmail(n.Entities),
+	}
+	if n.StartAddress != "" && n.EndAddress != "" {
+		o.Network = n.StartAddress + " - " + n.EndAddress
+	}
+	return o, nil
+}
+
+// abuseEmail returns the email address of the first entity with the abuse
+// role, searching nested entities as well
+func abuseEmail(entities []rdapEntity) string {
+	for _, e := range entities {
+		for _, role := range e.Roles {
+			if role != "abuse" {
+				continue
+			}
+			if email := vcardEmail(e.VCardArray); email != "" {
+				return email
+			}
+		}
+		if email := abuseEmail(e.Entities); email != "" {
+			return email
+		}
+	}
+	return ""
+}
+
+// vcardEmail extracts the email property of a jCard as used by RDAP:
+// ["vcard", [["email", {}, "text", "abuse@example.com"], ...]]
+func vcardEmail(vcard []interface{}) string {
+	if len(vcard) != 2 {
+		return ""
+	}
+	props, ok := vcard[1].([]interface{})
+	if !ok {
+		return ""
+	}
+	for _, p := range props {
+		prop, ok := p.([]interface{})
+		if !ok || len(prop) < 4 || prop[0] != "email" {
+			continue
+		}
+		if email, ok := prop[3].(string); ok {
+			return email
+		}
+	}
+	return ""
+}
+
+// OwnershipAnnotator looks up the ownership of blacklisted IPs in the
+// background and records it in the audit trail. Results are cached, so an IP
+// that is blacklisted again is annotated without another lookup. Failed
+// lookups are cached as well, so they aren't retried on every blacklisting.
+type OwnershipAnnotator struct {
+	lookup  OwnershipLookup
+	audit   *AuditLog
+	timeout time.Duration
+	ttl     time.Duration
+	queue   chan net.IP
+	cache   *lookupCache
+}
+
+// NewOwnershipAnnotator creates an OwnershipAnnotator that records into audit
+// and keeps results for ttl. At most queueSize IPs wait for their lookup,
+// further IPs are not annotated.
+func NewOwnershipAnnotator(ctx context.Context, lookup OwnershipLookup, audit *AuditLog, timeout, ttl time.Duration, queueSize int) *OwnershipAnnotator {
+	oa := &OwnershipAnnotator{
+		lookup:  lookup,
+		audit:   audit,
+		timeout: timeout,
+		ttl:     ttl,
+		queue:   make(chan net.IP, queueSize),
+		cache:   newLookupCache(ttl, LookupLimits{}),
+	}
+	go oa.run(ctx)
+	return oa
+}
+
+// SetLookupLimits replaces the default limits of the cache. Lookups run one
+// at a time regardless of MaxConcurrent. It drops the cached results, so call
+// it before use.
+func (oa *OwnershipAnnotator) SetLookupLimits(limits LookupLimits) {
+	oa.cache = newLookupCache(oa.ttl, limits)
+}
+
+// Annotate schedules the IP for annotation without waiting for the lookup
+func (oa *OwnershipAnnotator) Annotate(ip net.IP) {
+	if oa == nil {
+		return
+	}
+
+	if owner, ok := oa.cache.cached(ipKey(ip)); ok {
+		// a cached nil is a recent failure that isn't retried yet
+		if owner != nil {
+			oa.record(ip, owner.(*Ownership))
+		}
+		return
+	}
+
+	select {
+	case oa.queue <- ip:
+	default:
+	}
+}
+
+// Owner returns the cached ownership of the IP
+func (oa *OwnershipAnnotator) Owner(ip net.IP) (*Ownership, bool) {
+	if oa == nil {
+		return nil, false
+	}
+
+	owner, ok := oa.cache.cached(ipKey(ip))
+	if !ok || owner == nil {
+		return nil, false
+	}
+	return owner.(*Ownership), true
+}
+
+func (oa *OwnershipAnnotator) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-oa.queue:
+			key := ipKey(ip)
+			if owner, ok := oa.cache.cached(key); ok {
+				if owner != nil {
+					oa.record(ip, owner.(*Ownership))
+				}
+				continue
+			}
+
+			lctx, cancel := context.WithTimeout(ctx, oa.timeout)
+			owner, err := oa.lookup.Lookup(lctx, ip)
+			cancel()
+			if err != nil {
+				oa.audit.Record(ip, AuditEntry{Decision: "owner", Reason: "lookup failed: " + err.Error()})
+				oa.cache.store(key, nil, err)
+			} else {
+				oa.record(ip, owner)
+				oa.cache.store(key, owner, nil)
+			}
+			oa.cache.expireAll()
+		}
+	}
+}
+
+func (oa *OwnershipAnnotator) record(ip net.IP, owner *Ownership) {
+	oa.audit.Record(ip, AuditEntry{Decision: "owner", Reason: owner.String()})
+}
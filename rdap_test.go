@@ -0,0 +1,119 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const rdapResponse = `{
+  "handle": "NET-192-0-2-0-1",
+  "name": "EXAMPLE-NET",
+  "country": "US",
+  "startAddress": "192.0.2.0",
+  "endAddress": "192.0.2.255",
+  "entities": [
+    {"roles": ["registrant"], "vcardArray": ["vcard", [["fn", {}, "text", "Example Inc."]]],
+     "entities": [
+       {"roles": ["abuse"], "vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["email", {}, "text", "abuse@example.com"]]]}
+     ]}
+  ]
+}`
+
+func TestRDAPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ip/192.0.2.1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(rdapResponse))
+	}))
+	defer srv.Close()
+
+	c := NewRDAPClient(srv.URL + "/ip")
+	owner, err := c.Lookup(context.Background(), net.ParseIP("::ffff:192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Ownership{Network: "192.0.2.0 - 192.0.2.255", Name: "EXAMPLE-NET", Country: "US", Abuse: "abuse@example.com"}
+	if *owner != expected {
+		t.Errorf("expected %v, got %v", expected, *owner)
+	}
+
+	if _, err := c.Lookup(context.Background(), net.ParseIP("192.0.2.2")); err == nil {
+		t.Error("expected an error for a failed lookup")
+	}
+}
+
+type fakeOwnershipLookup struct {
+	calls chan net.IP
+}
+
+func (l *fakeOwnershipLookup) Lookup(ctx context.Context, ip net.IP) (*Ownership, error) {
+	l.calls <- ip
+	if ip.Equal(net.ParseIP("192.0.2.1")) {
+		return &Ownership{Network: "192.0.2.0 - 192.0.2.255", Abuse: "abuse@example.com"}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestOwnershipAnnotator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lookup := &fakeOwnershipLookup{calls: make(chan net.IP, 10)}
+	audit := NewAuditLog(10, 10)
+	oa := NewOwnershipAnnotator(ctx, lookup, audit, time.Second, time.Hour, 10)
+
+	ip := net.ParseIP("192.0.2.1")
+	oa.Annotate(ip)
+	<-lookup.calls
+	for {
+		if _, ok := oa.Owner(ip); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the second annotation is served from the cache
+	oa.Annotate(ip)
+	entries := audit.Entries(ip)
+	if len(entries) != 2 || entries[1].Reason != "network 192.0.2.0 - 192.0.2.255, abuse abuse@example.com" {
+		t.Errorf("unexpected audit entries %v", entries)
+	}
+	select {
+	case <-lookup.calls:
+		t.Error("expected the cached result to be used")
+	default:
+	}
+
+	// failures are cached too and not retried on every blacklisting
+	unknown := net.ParseIP("192.0.2.2")
+	oa.Annotate(unknown)
+	<-lookup.calls
+	for len(audit.Entries(unknown)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		if _, ok := oa.cache.cached(ipKey(unknown)); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	oa.Annotate(unknown)
+	select {
+	case <-lookup.calls:
+		t.Error("expected the failed lookup not to be retried")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, ok := oa.Owner(unknown); ok {
+		t.Error("expected no owner for the failed lookup")
+	}
+
+	var nilAnnotator *OwnershipAnnotator
+	nilAnnotator.Annotate(ip)
+}
@@ -0,0 +1,775 @@
+package botdetect
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis topologies
+const (
+	// RedisSingle talks to one server
+	RedisSingle = "single"
+
+	// RedisSentinel asks the sentinels for the address of the master and
+	// asks again after a failover
+	RedisSentinel = "sentinel"
+
+	// RedisCluster spreads the keys over the masters of a cluster by their
+	// hash slots and follows MOVED and ASK redirections
+	RedisCluster = "cluster"
+)
+
+// redisSlots is the number of hash slots of a Redis cluster
+const redisSlots = 16384
+
+// redisRedirects limits the redirections and failovers followed for one
+// command
+const redisRedirects = 5
+
+// RedisOptions configures a RedisClient
+type RedisOptions struct {
+	// Addrs are the addresses of the server, of the sentinels or of some
+	// nodes of the cluster, depending on the topology
+	Addrs []string
+
+	// Topology is RedisSingle, RedisSentinel or RedisCluster
+	Topology string
+
+	// MasterName is the name of the master monitored by the sentinels
+	MasterName string
+
+	// Username and Password authenticate with the servers, not the
+	// sentinels, if Password is set
+	Username string
+	Password string
+
+	// DB selects a database, which clusters don't have
+	DB int
+
+	// Timeout limits connecting and every exchange unless the context ends
+	// earlier
+	Timeout time.Duration
+
+	// Idle is the number of idle connections kept per server
+	Idle int
+}
+
+// RedisError is an error reply of a Redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// redisPush is a RESP3 push message, e.g. an invalidation
+type redisPush []interface{}
+
+// RedisClient talks RESP3 to a Redis server, a master found through
+// sentinels or a cluster, which requires Redis 6 or later. Commands sent
+// together with Pipeline are written at once and their replies read at once,
+// per server. It is safe for concurrent use.
+type RedisClient struct {
+	options RedisOptions
+
+	// mutex guards pools, master and slots
+	mutex  sync.Mutex
+	pools  map[string]*redisPool
+	master string
+	slots  []string
+}
+
+// NewRedisClient creates a client for the servers. It connects on first use.
+func NewRedisClient(options RedisOptions) (*RedisClient, error) {
+	if options.Topology == "" {
+		options.Topology = RedisSingle
+	}
+	switch {
+	case len(options.Addrs) == 0:
+		return nil, configErrorf("redis requires an address")
+	case options.Topology != RedisSingle && options.Topology != RedisSentinel && options.Topology != RedisCluster:
+		return nil, configErrorf("invalid redis topology '%s': expected %s, %s or %s", options.Topology, RedisSingle, RedisSentinel, RedisCluster)
+	case options.Topology == RedisSentinel && options.MasterName == "":
+		return nil, configErrorf("redis sentinels require the name of the master")
+	case options.Topology == RedisCluster && options.DB != 0:
+		return nil, configErrorf("redis clusters have no databases")
+	case options.Timeout <= 0:
+		return nil, configErrorf("redis timeout must be greater than zero")
+	}
+	if options.Idle <= 0 {
+		options.Idle = 4
+	}
+	if options.Topology == RedisSingle && len(options.Addrs) > 1 {
+		return nil, configErrorf("a single redis server has one address, got %d", len(options.Addrs))
+	}
+
+	c := &RedisClient{options: options, pools: make(map[string]*redisPool)}
+	if options.Topology == RedisSingle {
+		c.master = options.Addrs[0]
+	}
+	return c, nil
+}
+
+// Do sends one command and returns its reply. Error replies are returned as
+// RedisError.
+func (c *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.Pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(RedisError); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends the commands and returns their replies in the same order.
+// Error replies of single commands are returned as RedisError in the
+// replies, errors of the connection as the error. In a cluster the commands
+// are grouped by the server owning their first key, the second argument or
+// the first key of a script.
+func (c *RedisClient) Pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	replies := make([]interface{}, len(cmds))
+	asked := make(map[int]string)
+	pending := make([]int, len(cmds))
+	for i := range cmds {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt == redisRedirects {
+			return nil, storeError(fmt.Errorf("redis: gave up after %d redirections", redisRedirects))
+		}
+
+		groups := make(map[string][]int)
+		var order []string
+		for _, i := range pending {
+			addr, ok := asked[i]
+			if !ok {
+				var err error
+				if addr, err = c.server(ctx, cmds[i]); err != nil {
+					return nil, err
+				}
+			}
+			if _, exists := groups[addr]; !exists {
+				order = append(order, addr)
+			}
+			groups[addr] = append(groups[addr], i)
+		}
+
+		var retry []int
+		for _, addr := range order {
+			indexes := groups[addr]
+			batch := make([][]string, 0, len(indexes))
+			for _, i := range indexes {
+				if _, ok := asked[i]; ok {
+					batch = append(batch, []string{"ASKING"})
+				}
+				batch = append(batch, cmds[i])
+			}
+
+			out, err := c.exchange(ctx, addr, batch)
+			if err != nil {
+				c.lost()
+				return nil, err
+			}
+
+			j := 0
+			for _, i := range indexes {
+				if _, ok := asked[i]; ok {
+					// skip the reply to ASKING
+					delete(asked, i)
+					j++
+				}
+				reply := out[j]
+				j++
+
+				if redirected, to, ask := c.redirect(reply); redirected {
+					if ask {
+						asked[i] = to
+					}
+					retry = append(retry, i)
+					continue
+				}
+				replies[i] = reply
+			}
+		}
+		pending = retry
+	}
+	return replies, nil
+}
+
+// redirect handles MOVED and ASK replies in clusters and READONLY replies of
+// a former master after a failover. It returns whether the command has to be
+// sent again and, for ASK, where to.
+func (c *RedisClient) redirect(reply interface{}) (redirected bool, to string, ask bool) {
+	err, ok := reply.(RedisError)
+	if !ok {
+		return false, "", false
+	}
+	fields := strings.Fields(string(err))
+	if len(fields) == 0 {
+		return false, "", false
+	}
+
+	switch {
+	case fields[0] == "MOVED" && len(fields) == 3 && c.options.Topology == RedisCluster:
+		slot, perr := strconv.Atoi(fields[1])
+		if perr != nil || slot < 0 || slot >= redisSlots {
+			return false, "", false
+		}
+		c.mutex.Lock()
+		if c.slots != nil {
+			// the slots are read without the lock, so they are replaced
+			// rather than changed
+			slots := append([]string(nil), c.slots...)
+			slots[slot] = fields[2]
+			c.slots = slots
+		}
+		c.mutex.Unlock()
+		return true, "", false
+	case fields[0] == "ASK" && len(fields) == 3 && c.options.Topology == RedisCluster:
+		return true, fields[2], true
+	case fields[0] == "READONLY" && c.options.Topology == RedisSentinel:
+		c.mutex.Lock()
+		c.master = ""
+		c.mutex.Unlock()
+		return true, "", false
+	}
+	return false, "", false
+}
+
+// lost forgets the topology after the connection to a server failed, so
+// that the next command finds the master or the slots again
+func (c *RedisClient) lost() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.options.Topology {
+	case RedisSentinel:
+		c.master = ""
+	case RedisCluster:
+		c.slots = nil
+	}
+}
+
+// server returns the address of the server for the command
+func (c *RedisClient) server(ctx context.Context, cmd []string) (string, error) {
+	switch c.options.Topology {
+	case RedisSentinel:
+		return c.sentinelMaster(ctx)
+	case RedisCluster:
+		slots, err := c.clusterSlots(ctx)
+		if err != nil {
+			return "", err
+		}
+		key, ok := redisKey(cmd)
+		if !ok {
+			// keyless commands go to any master
+			return slots[0], nil
+		}
+		return slots[redisSlot(key)], nil
+	}
+	return c.master, nil
+}
+
+// redisKey returns the first key of the command: its second argument, or the
+// first key after the number of keys of a script
+func redisKey(cmd []string) (string, bool) {
+	if len(cmd) > 0 && (strings.EqualFold(cmd[0], "EVAL") || strings.EqualFold(cmd[0], "EVALSHA")) {
+		if len(cmd) < 4 || cmd[2] == "0" {
+			return "", false
+		}
+		return cmd[3], true
+	}
+	if len(cmd) < 2 {
+		return "", false
+	}
+	return cmd[1], true
+}
+
+// Masters returns the addresses of the masters: the server, the master found
+// through the sentinels or the masters of the cluster
+func (c *RedisClient) Masters(ctx context.Context) ([]string, error) {
+	switch c.options.Topology {
+	case RedisSentinel:
+		master, err := c.sentinelMaster(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []string{master}, nil
+	case RedisCluster:
+		slots, err := c.clusterSlots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		masters := []string{}
+		for _, addr := range slots {
+			if !seen[addr] {
+				seen[addr] = true
+				masters = append(masters, addr)
+			}
+		}
+		return masters, nil
+	}
+	return []string{c.master}, nil
+}
+
+// sentinelMaster returns the address of the master, asking the sentinels
+// one after the other if it isn't known
+func (c *RedisClient) sentinelMaster(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	master := c.master
+	c.mutex.Unlock()
+	if master != "" {
+		return master, nil
+	}
+
+	var errs []string
+	for _, sentinel := range c.options.Addrs {
+		conn, err := dialRedis(ctx, sentinel, RedisOptions{Timeout: c.options.Timeout})
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		replies, err := conn.exchange(ctx, c.options.Timeout, [][]string{{"SENTINEL", "get-master-addr-by-name", c.options.MasterName}})
+		conn.Close()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		addr, ok := replies[0].([]interface{})
+		if !ok || len(addr) != 2 {
+			errs = append(errs, fmt.Sprintf("%s doesn't know the master %s", sentinel, c.options.MasterName))
+			continue
+		}
+		master = net.JoinHostPort(redisString(addr[0]), redisString(addr[1]))
+
+		c.mutex.Lock()
+		c.master = master
+		c.mutex.Unlock()
+		return master, nil
+	}
+	return "", storeError(fmt.Errorf("redis sentinels: %s", strings.Join(errs, "; ")))
+}
+
+// clusterSlots returns the address of the master of every slot, asking the
+// nodes one after the other if they aren't known
+func (c *RedisClient) clusterSlots(ctx context.Context) ([]string, error) {
+	c.mutex.Lock()
+	slots := c.slots
+	c.mutex.Unlock()
+	if slots != nil {
+		return slots, nil
+	}
+
+	var errs []string
+	for _, node := range c.options.Addrs {
+		out, err := c.exchange(ctx, node, [][]string{{"CLUSTER", "SLOTS"}})
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		slots, err := parseClusterSlots(node, out[0])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		c.mutex.Lock()
+		c.slots = slots
+		c.mutex.Unlock()
+		return slots, nil
+	}
+	return nil, storeError(fmt.Errorf("redis cluster: %s", strings.Join(errs, "; ")))
+}
+
+// parseClusterSlots parses the reply to CLUSTER SLOTS asked at node, which
+// must cover every slot
+func parseClusterSlots(node string, reply interface{}) ([]string, error) {
+	if err, ok := reply.(RedisError); ok {
+		return nil, err
+	}
+	ranges, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: unexpected reply to CLUSTER SLOTS", node)
+	}
+
+	nodeHost, _, _ := net.SplitHostPort(node)
+	slots := make([]string, redisSlots)
+	for _, r := range ranges {
+		fields, ok := r.([]interface{})
+		if !ok || len(fields) < 3 {
+			return nil, fmt.Errorf("%s: unexpected slot range in CLUSTER SLOTS", node)
+		}
+		start, _ := fields[0].(int64)
+		end, _ := fields[1].(int64)
+		master, ok := fields[2].([]interface{})
+		if !ok || len(master) < 2 || start < 0 || end >= redisSlots || start > end {
+			return nil, fmt.Errorf("%s: unexpected slot range in CLUSTER SLOTS", node)
+		}
+		host := redisString(master[0])
+		if host == "" || host == "?" {
+			host = nodeHost
+		}
+		addr := net.JoinHostPort(host, redisString(master[1]))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	for slot, addr := range slots {
+		if addr == "" {
+			return nil, fmt.Errorf("%s: slot %d isn't served", node, slot)
+		}
+	}
+	return slots, nil
+}
+
+// exchange sends the commands to the server on one connection and reads the
+// replies
+func (c *RedisClient) exchange(ctx context.Context, addr string, cmds [][]string) ([]interface{}, error) {
+	pool := c.pool(addr)
+	conn, err := pool.get(ctx)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	replies, err := conn.exchange(ctx, c.options.Timeout, cmds)
+	if err != nil {
+		conn.Close()
+		return nil, storeError(err)
+	}
+	pool.put(conn)
+	return replies, nil
+}
+
+func (c *RedisClient) pool(addr string) *redisPool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	p, ok := c.pools[addr]
+	if !ok {
+		p = &redisPool{addr: addr, options: c.options}
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// Subscribe opens a connection of its own to the server, sends the commands
+// and calls onPush with every push message it receives until the context is
+// done or the connection fails, e.g. to receive invalidations with CLIENT
+// TRACKING. ready is called once the commands succeeded.
+func (c *RedisClient) Subscribe(ctx context.Context, addr string, cmds [][]string, ready func(), onPush func([]interface{})) error {
+	conn, err := dialRedis(ctx, addr, c.options)
+	if err != nil {
+		return storeError(err)
+	}
+	defer conn.Close()
+
+	replies, err := conn.exchange(ctx, c.options.Timeout, cmds)
+	if err != nil {
+		return storeError(err)
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(RedisError); ok {
+			return err
+		}
+	}
+	ready()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	conn.SetDeadline(time.Time{})
+	for {
+		v, err := conn.readValue()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return storeError(err)
+		}
+		if push, ok := v.(redisPush); ok {
+			onPush(push)
+		}
+	}
+}
+
+// Close closes the idle connections
+func (c *RedisClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range c.pools {
+		p.close()
+	}
+	c.pools = make(map[string]*redisPool)
+	return nil
+}
+
+// redisPool keeps idle connections to one server
+type redisPool struct {
+	addr    string
+	options RedisOptions
+	mutex   sync.Mutex
+	idle    []*redisConn
+}
+
+func (p *redisPool) get(ctx context.Context) (*redisConn, error) {
+	p.mutex.Lock()
+	if n := len(p.idle); n > 0 {
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return conn, nil
+	}
+	p.mutex.Unlock()
+
+	return dialRedis(ctx, p.addr, p.options)
+}
+
+func (p *redisPool) put(conn *redisConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle) >= p.options.Idle {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, conn)
+}
+
+func (p *redisPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+}
+
+// redisConn is a connection speaking RESP3
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// dialRedis connects to the server, switches to RESP3, authenticates and
+// selects the database of the options
+func dialRedis(ctx context.Context, addr string, options RedisOptions) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: options.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	hello := []string{"HELLO", "3"}
+	if options.Password != "" {
+		username := options.Username
+		if username == "" {
+			username = "default"
+		}
+		hello = append(hello, "AUTH", username, options.Password)
+	}
+	cmds := [][]string{hello}
+	if options.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(options.DB)})
+	}
+
+	replies, err := conn.exchange(ctx, options.Timeout, cmds)
+	if err == nil {
+		for _, reply := range replies {
+			if rerr, ok := reply.(RedisError); ok {
+				err = rerr
+				break
+			}
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// exchange writes the commands at once and reads one reply per command
+func (conn *redisConn) exchange(ctx context.Context, timeout time.Duration, cmds [][]string) ([]interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	for _, cmd := range cmds {
+		writeRedisCommand(conn.w, cmd)
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	for len(replies) < len(cmds) {
+		v, err := conn.readValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.(redisPush); ok {
+			// pushes only matter on subscribed connections
+			continue
+		}
+		replies = append(replies, v)
+	}
+	return replies, nil
+}
+
+func writeRedisCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readValue reads one RESP2 or RESP3 value. Strings are returned as string,
+// numbers as int64 or float64, aggregates as []interface{}, with maps
+// flattened into keys and values, push messages as redisPush and error
+// replies as RedisError.
+func (conn *redisConn) readValue() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+', '(':
+		return payload, nil
+	case '-':
+		return RedisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case ',':
+		return strconv.ParseFloat(payload, 64)
+	case '#':
+		return payload == "t", nil
+	case '_':
+		return nil, nil
+	case '$', '=', '!':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		s := string(buf[:n])
+		switch kind {
+		case '=':
+			// verbatim strings start with their format, e.g. "txt:"
+			if len(s) >= 4 {
+				s = s[4:]
+			}
+		case '!':
+			return RedisError(s), nil
+		}
+		return s, nil
+	case '*', '~', '>', '%', '|':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = conn.readValue(); err != nil {
+				return nil, err
+			}
+		}
+		switch kind {
+		case '>':
+			return redisPush(values), nil
+		case '|':
+			// attributes precede the actual reply
+			return conn.readValue()
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// redisString returns a reply as a string, empty for nil
+func redisString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case RedisError:
+		return string(v)
+	}
+	return ""
+}
+
+// redisErr returns the first error reply among the replies, if any
+func redisErr(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(RedisError); ok {
+			return storeError(err)
+		}
+	}
+	return nil
+}
+
+// redisSlot returns the hash slot of the key: the CRC16 of the key, or of the
+// part between the first { and the next } if it isn't empty
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisSlots
+}
+
+// crc16 is CRC-16/XMODEM as used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,918 @@
+package botdetect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisData is the data of a fake Redis, shared by the nodes of a fake
+// cluster
+type fakeRedisData struct {
+	mutex   sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+func newFakeRedisData() *fakeRedisData {
+	return &fakeRedisData{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// expire drops the key if it has expired, the caller holds the lock
+func (d *fakeRedisData) expire(key string) {
+	if exp, ok := d.expires[key]; ok && !exp.After(time.Now()) {
+		d.del(key)
+	}
+}
+
+func (d *fakeRedisData) del(key string) bool {
+	_, s := d.strings[key]
+	_, h := d.hashes[key]
+	_, st := d.sets[key]
+	delete(d.strings, key)
+	delete(d.hashes, key)
+	delete(d.sets, key)
+	delete(d.expires, key)
+	return s || h || st
+}
+
+// fakeRedis is a server speaking enough RESP3 for RedisClient: strings,
+// hashes, sets, cluster slots with MOVED and ASK, sentinels and CLIENT
+// TRACKING in broadcast mode. It counts the commands it receives.
+type fakeRedis struct {
+	listener net.Listener
+	data     *fakeRedisData
+	password string
+
+	mutex    sync.Mutex
+	commands map[string]int
+	conns    int
+	tracking map[*fakeRedisConn]string
+
+	// owns tells whether the node serves the slot in a cluster and where
+	// it has moved to if not; nil serves every slot
+	owns func(slot int) (bool, string)
+
+	// asking sends the keys to another node with ASK
+	asking map[string]string
+
+	// readonly makes a former master reject writes after a failover
+	readonly bool
+
+	// noTracking rejects CLIENT TRACKING
+	noTracking bool
+
+	// slots is the reply to CLUSTER SLOTS
+	slots []interface{}
+
+	// master is the reply of a sentinel
+	master string
+}
+
+type fakeRedisConn struct {
+	net.Conn
+	mutex sync.Mutex
+	w     *bufio.Writer
+}
+
+func (c *fakeRedisConn) send(reply string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.w.WriteString(reply)
+	c.w.Flush()
+}
+
+func newFakeRedis(t *testing.T, data *fakeRedisData) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: l,
+		data:     data,
+		commands: make(map[string]int),
+		tracking: make(map[*fakeRedisConn]string),
+		asking:   make(map[string]string),
+	}
+	go f.serve()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) count(cmd string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.commands[cmd]
+}
+
+func (f *fakeRedis) connections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.conns
+}
+
+func (f *fakeRedis) trackers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.tracking)
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		nc, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.conns++
+		f.mutex.Unlock()
+		go f.handle(&fakeRedisConn{Conn: nc, w: bufio.NewWriter(nc)})
+	}
+}
+
+func (f *fakeRedis) handle(conn *fakeRedisConn) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.tracking, conn)
+		f.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	asking := false
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		f.mutex.Lock()
+		f.commands[cmd]++
+		f.mutex.Unlock()
+
+		if cmd == "ASKING" {
+			asking = true
+			conn.send("+OK\r\n")
+			continue
+		}
+		conn.send(f.exec(conn, cmd, args, asking))
+		asking = false
+	}
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// keyed lists the commands whose second argument is a key
+var fakeRedisKeyed = map[string]bool{
+	"GET": true, "SET": true, "DEL": true, "HGETALL": true, "HSET": true, "HDEL": true,
+	"PEXPIRE": true, "SADD": true, "SPOP": true, "PTTL": true, "EVAL": true,
+}
+
+var fakeRedisWrites = map[string]bool{
+	"SET": true, "DEL": true, "HSET": true, "HDEL": true, "PEXPIRE": true, "SADD": true, "SPOP": true, "EVAL": true,
+}
+
+func (f *fakeRedis) exec(conn *fakeRedisConn, cmd string, args []string, asking bool) string {
+	key, keyed := redisKey(args)
+	keyed = keyed && fakeRedisKeyed[cmd]
+
+	f.mutex.Lock()
+	owns, readonly := f.owns, f.readonly
+	ask := f.asking[key]
+	if cmd == "CLIENT" {
+		// CLIENT TRACKING ON BCAST PREFIX <prefix>
+		defer f.mutex.Unlock()
+		if f.noTracking || len(args) != 6 || strings.ToUpper(args[1]) != "TRACKING" || strings.ToUpper(args[3]) != "BCAST" {
+			return "-ERR unsupported CLIENT command\r\n"
+		}
+		f.tracking[conn] = args[5]
+		return "+OK\r\n"
+	}
+	f.mutex.Unlock()
+
+	if keyed {
+		slot := redisSlot(key)
+		if ask != "" {
+			return fmt.Sprintf("-ASK %d %s\r\n", slot, ask)
+		}
+		if owns != nil && !asking {
+			if ok, moved := owns(slot); !ok {
+				return fmt.Sprintf("-MOVED %d %s\r\n", slot, moved)
+			}
+		}
+		if readonly && fakeRedisWrites[cmd] {
+			return "-READONLY You can't write against a read only replica.\r\n"
+		}
+	}
+
+	d := f.data
+	d.mutex.Lock()
+	if keyed {
+		d.expire(key)
+	}
+	reply, changed := f.apply(d, cmd, args)
+	d.mutex.Unlock()
+
+	if changed != "" {
+		f.invalidate(changed)
+	}
+	return reply
+}
+
+// apply runs the command on the data and returns the reply and the key it
+// changed, if any
+func (f *fakeRedis) apply(d *fakeRedisData, cmd string, args []string) (string, string) {
+	switch cmd {
+	case "HELLO":
+		if f.password != "" && (len(args) < 5 || args[4] != f.password) {
+			return "-WRONGPASS invalid username-password pair\r\n", ""
+		}
+		return "%1\r\n+server\r\n+fake\r\n", ""
+	case "SELECT":
+		return "+OK\r\n", ""
+	case "GET":
+		v, ok := d.strings[args[1]]
+		if !ok {
+			return "_\r\n", ""
+		}
+		return fakeBulk(v), ""
+	case "SET":
+		d.del(args[1])
+		d.strings[args[1]] = args[2]
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			d.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n", args[1]
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if d.del(key) {
+				n++
+				f.invalidate(key)
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n), ""
+	case "EVAL":
+		// the scripts of RedisStore
+		key, holder := args[3], args[4]
+		current, held := d.strings[key]
+		switch args[1] {
+		case redisAcquire:
+			if held && current != holder {
+				return fakeBulk(current), ""
+			}
+			ms, _ := strconv.Atoi(args[5])
+			d.strings[key] = holder
+			d.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			return fakeBulk(holder), key
+		case redisRelease:
+			if held && current == holder {
+				d.del(key)
+				return ":1\r\n", key
+			}
+			return ":0\r\n", ""
+		}
+		return "-NOSCRIPT unknown script\r\n", ""
+	case "PTTL":
+		exp, ok := d.expires[args[1]]
+		if !ok {
+			return ":-1\r\n", ""
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(exp).Milliseconds()), ""
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		_, h := d.hashes[args[1]]
+		_, s := d.sets[args[1]]
+		if !h && !s {
+			return ":0\r\n", ""
+		}
+		d.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n", ""
+	case "HGETALL":
+		h := d.hashes[args[1]]
+		fields := make([]string, 0, len(h))
+		for k := range h {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		reply := fmt.Sprintf("%%%d\r\n", len(h))
+		for _, k := range fields {
+			reply += fakeBulk(k) + fakeBulk(h[k])
+		}
+		return reply, ""
+	case "HSET":
+		h, ok := d.hashes[args[1]]
+		if !ok {
+			h = make(map[string]string)
+			d.hashes[args[1]] = h
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, exists := h[args[i]]; !exists {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", n), ""
+	case "HDEL":
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := d.hashes[args[1]][field]; ok {
+				delete(d.hashes[args[1]], field)
+				n++
+			}
+		}
+		if len(d.hashes[args[1]]) == 0 {
+			d.del(args[1])
+		}
+		return fmt.Sprintf(":%d\r\n", n), ""
+	case "SADD":
+		s, ok := d.sets[args[1]]
+		if !ok {
+			s = make(map[string]bool)
+			d.sets[args[1]] = s
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !s[m] {
+				s[m] = true
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n), ""
+	case "SPOP":
+		count, _ := strconv.Atoi(args[2])
+		s := d.sets[args[1]]
+		reply := ""
+		n := 0
+		for m := range s {
+			if n == count {
+				break
+			}
+			delete(s, m)
+			reply += fakeBulk(m)
+			n++
+		}
+		if len(s) == 0 {
+			d.del(args[1])
+		}
+		return fmt.Sprintf("~%d\r\n", n) + reply, ""
+	case "CLUSTER":
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return fakeValue(f.slots), ""
+	case "SENTINEL":
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		host, port, err := net.SplitHostPort(f.master)
+		if err != nil {
+			return "_\r\n", ""
+		}
+		return "*2\r\n" + fakeBulk(host) + fakeBulk(port), ""
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd), ""
+}
+
+// invalidate sends an invalidation of the key to the connections tracking it
+func (f *fakeRedis) invalidate(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for conn, prefix := range f.tracking {
+		if strings.HasPrefix(key, prefix) {
+			go conn.send(">2\r\n" + fakeBulk("invalidate") + "*1\r\n" + fakeBulk(key))
+		}
+	}
+}
+
+// flushTracking sends an invalidation of every key
+func (f *fakeRedis) flushTracking() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for conn := range f.tracking {
+		go conn.send(">2\r\n" + fakeBulk("invalidate") + "_\r\n")
+	}
+}
+
+func fakeBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func fakeValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "_\r\n"
+	case int:
+		return fmt.Sprintf(":%d\r\n", v)
+	case string:
+		return fakeBulk(v)
+	case []interface{}:
+		s := fmt.Sprintf("*%d\r\n", len(v))
+		for _, e := range v {
+			s += fakeValue(e)
+		}
+		return s
+	}
+	panic(fmt.Sprintf("unsupported value %T", v))
+}
+
+func newTestRedisClient(t *testing.T, options RedisOptions) *RedisClient {
+	if options.Timeout == 0 {
+		options.Timeout = time.Second
+	}
+	c, err := NewRedisClient(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRedisOptions(t *testing.T) {
+	for _, o := range []RedisOptions{
+		{Timeout: time.Second},
+		{Addrs: []string{"a:1"}, Topology: "ring", Timeout: time.Second},
+		{Addrs: []string{"a:1"}, Topology: RedisSentinel, Timeout: time.Second},
+		{Addrs: []string{"a:1"}, Topology: RedisCluster, DB: 1, Timeout: time.Second},
+		{Addrs: []string{"a:1", "b:1"}, Timeout: time.Second},
+		{Addrs: []string{"a:1"}},
+	} {
+		if _, err := NewRedisClient(o); !errors.Is(err, ErrConfig) {
+			t.Errorf("%+v: expected a config error, got %v", o, err)
+		}
+	}
+}
+
+func TestRedisSlot(t *testing.T) {
+	// the check value of CRC-16/XMODEM
+	if slot := redisSlot("123456789"); slot != 0x31c3 {
+		t.Errorf("expected slot %d, got %d", 0x31c3, slot)
+	}
+
+	// the hash tags of the cluster specification
+	for key, tag := range map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+	} {
+		if redisSlot(key) != redisSlot(tag) {
+			t.Errorf("%s: expected the slot of %s", key, tag)
+		}
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	server.password = "secret"
+
+	c := newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}, Password: "wrong"})
+	if _, err := c.Do(context.Background(), "GET", "k"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected a wrong password to make the store unavailable, got %v", err)
+	}
+
+	c = newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}, Password: "secret", DB: 2})
+	if _, err := c.Do(context.Background(), "GET", "k"); err != nil {
+		t.Error(err)
+	}
+	if server.count("SELECT") != 1 {
+		t.Errorf("expected the database to be selected once, got %d", server.count("SELECT"))
+	}
+}
+
+func TestRedisPipeline(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	c := newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}})
+	ctx := context.Background()
+
+	replies, err := c.Pipeline(ctx, [][]string{
+		{"SET", "a", "1"},
+		{"SET", "b", "2"},
+		{"GET", "a"},
+		{"GET", "b"},
+		{"GET", "c"},
+		{"NOPE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redisString(replies[2]) != "1" || redisString(replies[3]) != "2" || replies[4] != nil {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if _, ok := replies[5].(RedisError); !ok {
+		t.Errorf("expected an error reply for an unknown command, got %v", replies[5])
+	}
+
+	// the commands went over one connection, which is kept
+	if _, err := c.Do(ctx, "GET", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("expected one connection, got %d", n)
+	}
+
+	server.listener.Close()
+	c.Close()
+	if _, err := c.Do(ctx, "GET", "a"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected the store to be unavailable, got %v", err)
+	}
+}
+
+// newFakeCluster starts two nodes, the first serving the slots below
+// split, and returns them with a function moving the split
+func newFakeCluster(t *testing.T, split int) (*fakeRedis, *fakeRedis, func(int)) {
+	data := newFakeRedisData()
+	a, b := newFakeRedis(t, data), newFakeRedis(t, data)
+
+	var mutex sync.Mutex
+	owner := func(slot int) *fakeRedis {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if slot < split {
+			return a
+		}
+		return b
+	}
+	for _, node := range []*fakeRedis{a, b} {
+		node := node
+		node.owns = func(slot int) (bool, string) {
+			o := owner(slot)
+			return o == node, o.addr()
+		}
+	}
+
+	hostPort := func(f *fakeRedis) []interface{} {
+		host, port, _ := net.SplitHostPort(f.addr())
+		p, _ := strconv.Atoi(port)
+		return []interface{}{host, p, "id"}
+	}
+	slots := []interface{}{
+		[]interface{}{0, split - 1, hostPort(a)},
+		[]interface{}{split, redisSlots - 1, hostPort(b)},
+	}
+	a.slots, b.slots = slots, slots
+
+	move := func(to int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		split = to
+	}
+	return a, b, move
+}
+
+func TestRedisCluster(t *testing.T) {
+	a, b, move := newFakeCluster(t, redisSlots/2)
+	c := newTestRedisClient(t, RedisOptions{Addrs: []string{a.addr()}, Topology: RedisCluster})
+	ctx := context.Background()
+
+	masters, err := c.Masters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(masters) != 2 || masters[0] != a.addr() || masters[1] != b.addr() {
+		t.Errorf("expected both nodes to be masters, got %v", masters)
+	}
+
+	var cmds [][]string
+	for i := 0; i < 20; i++ {
+		cmds = append(cmds, []string{"SET", fmt.Sprintf("key%d", i), strconv.Itoa(i)})
+	}
+	if _, err := c.Pipeline(ctx, cmds); err != nil {
+		t.Fatal(err)
+	}
+	if a.count("SET") == 0 || b.count("SET") == 0 || a.count("SET")+b.count("SET") != 20 {
+		t.Errorf("expected the keys to be spread over both nodes, got %d and %d", a.count("SET"), b.count("SET"))
+	}
+
+	// a resharding moves the slots of a to b, which the client learns
+	// from the MOVED replies
+	move(0)
+	for i := 0; i < 20; i++ {
+		cmds[i] = []string{"GET", fmt.Sprintf("key%d", i)}
+	}
+	replies, err := c.Pipeline(ctx, cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, reply := range replies {
+		if redisString(reply) != strconv.Itoa(i) {
+			t.Errorf("key%d: expected %d, got %v", i, i, reply)
+		}
+	}
+	before := a.count("GET")
+	if _, err := c.Pipeline(ctx, cmds); err != nil {
+		t.Fatal(err)
+	}
+	if a.count("GET") != before {
+		t.Errorf("expected the moved slots to be remembered")
+	}
+
+	// a key being migrated is asked for at its new node just once
+	b.mutex.Lock()
+	b.asking["key1"] = a.addr()
+	b.mutex.Unlock()
+	reply, err := c.Do(ctx, "GET", "key1")
+	if err != nil || redisString(reply) != "1" {
+		t.Errorf("expected the migrating key to be found, got %v, %v", reply, err)
+	}
+	if a.count("ASKING") != 1 {
+		t.Errorf("expected ASKING to be sent once, got %d", a.count("ASKING"))
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	data := newFakeRedisData()
+	first, second := newFakeRedis(t, data), newFakeRedis(t, data)
+	sentinel := newFakeRedis(t, newFakeRedisData())
+	sentinel.master = first.addr()
+
+	down := newFakeRedis(t, nil)
+	down.listener.Close()
+
+	c := newTestRedisClient(t, RedisOptions{Addrs: []string{down.addr(), sentinel.addr()}, Topology: RedisSentinel, MasterName: "bd"})
+	ctx := context.Background()
+
+	if _, err := c.Do(ctx, "SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if first.count("SET") != 1 {
+		t.Fatalf("expected the write to go to the master")
+	}
+
+	// after a failover the former master rejects writes, and the client
+	// asks the sentinels again
+	sentinel.mutex.Lock()
+	sentinel.master = second.addr()
+	sentinel.mutex.Unlock()
+	first.mutex.Lock()
+	first.readonly = true
+	first.mutex.Unlock()
+
+	if _, err := c.Do(ctx, "SET", "k", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if second.count("SET") != 1 || sentinel.count("SENTINEL") != 2 {
+		t.Errorf("expected the write to go to the new master, got %d writes and %d questions", second.count("SET"), sentinel.count("SENTINEL"))
+	}
+
+	masters, err := c.Masters(ctx)
+	if err != nil || len(masters) != 1 || masters[0] != second.addr() {
+		t.Errorf("expected the new master, got %v, %v", masters, err)
+	}
+}
+
+func TestRedisStoreCounters(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	store := NewRedisStore(newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}}), "bd:", time.Hour)
+	ctx := context.Background()
+
+	t1 := time.Now().UTC().Truncate(time.Minute)
+	t0 := t1.Add(-time.Minute)
+	old := t1.Add(-2 * time.Hour)
+
+	if err := store.Publish(ctx, "a", map[string][]IPHistoryItem{
+		"192.0.2.1": {{Timestamp: t1, Count: 3, App: 2, Other: 1}, {Timestamp: t0, Count: 5, App: 5}, {Timestamp: old, Count: 9}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Publish(ctx, "b", map[string][]IPHistoryItem{
+		"192.0.2.1": {{Timestamp: t1, Count: 1, Bytes: 100, Hits: 1}},
+		"192.0.2.2": {{Timestamp: t1, Count: 7}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// publishing the same slots again takes the maximum
+	if err := store.Publish(ctx, "a", map[string][]IPHistoryItem{
+		"192.0.2.1": {{Timestamp: t1, Count: 4, App: 2, Other: 2}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Fetch(ctx, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string][]IPHistoryItem{
+		"192.0.2.1": {
+			"a": {{Timestamp: t1, Count: 4, App: 2, Other: 2}, {Timestamp: t0, Count: 5, App: 5}},
+			"b": {{Timestamp: t1, Count: 1, Bytes: 100, Hits: 1}},
+		},
+		"192.0.2.2": {"b": {{Timestamp: t1, Count: 7}}},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// the keys expire after the retention
+	ttl, err := store.client.Do(ctx, "PTTL", "bd:counts:192.0.2.1")
+	if err != nil || ttl.(int64) <= 0 || ttl.(int64) > time.Hour.Milliseconds() {
+		t.Errorf("expected the counts to expire within the retention, got %v, %v", ttl, err)
+	}
+}
+
+func TestRedisStoreHandoff(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	store := NewRedisStore(newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}}), "bd:", time.Hour)
+	ctx := context.Background()
+
+	if err := store.Hand(ctx, "b", []string{"192.0.2.2", "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Hand(ctx, "b", []string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := store.Take(ctx, "b")
+	if err != nil || fmt.Sprint(ips) != "[192.0.2.1 192.0.2.2]" {
+		t.Errorf("expected both IPs once, got %v, %v", ips, err)
+	}
+	if ips, err := store.Take(ctx, "b"); err != nil || len(ips) != 0 {
+		t.Errorf("expected the IPs to be taken, got %v, %v", ips, err)
+	}
+}
+
+func TestRedisStoreReputations(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	store := NewRedisStore(newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}}), "bd:", time.Hour)
+	store.ReputationTTL = time.Minute
+	reputations := store.Reputations()
+	ctx := context.Background()
+
+	updated := time.Unix(1600000000, 123)
+	if err := reputations.Update(ctx, map[string]Reputation{"192.0.2.1": {Score: -2.5, Updated: updated}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := reputations.Fetch(ctx, []string{"192.0.2.1", "192.0.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["192.0.2.1"].Score != -2.5 || !got["192.0.2.1"].Updated.Equal(updated) {
+		t.Errorf("unexpected reputations %v", got)
+	}
+
+	ttl, err := store.client.Do(ctx, "PTTL", "bd:reputation:192.0.2.1")
+	if err != nil || ttl.(int64) <= 0 || ttl.(int64) > time.Minute.Milliseconds() {
+		t.Errorf("expected the reputation to expire after a minute, got %v, %v", ttl, err)
+	}
+}
+
+func TestRedisStoreBlacklist(t *testing.T) {
+	server := newFakeRedis(t, newFakeRedisData())
+	store := NewRedisStore(newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}}), "bd:", time.Hour)
+	ctx := context.Background()
+
+	ip := net.ParseIP("192.0.2.1")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := store.Add(ctx, []BlacklistEntry{
+		{IP: ip, Expires: expires, Reason: "max_requests", Severity: SeverityChallenge},
+		{IP: net.ParseIP("192.0.2.2"), Expires: time.Now().Add(-time.Second)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok, err := store.Lookup(ctx, ip)
+	if err != nil || !ok || !entry.Expires.Equal(expires) || entry.Reason != "max_requests" || entry.Severity != SeverityChallenge || !entry.IP.Equal(ip) {
+		t.Errorf("unexpected entry %+v, %v, %v", entry, ok, err)
+	}
+	if _, ok, _ := store.Lookup(ctx, net.ParseIP("192.0.2.2")); ok {
+		t.Errorf("expected an expired entry not to be added")
+	}
+
+	if err := store.Remove(ctx, []net.IP{ip}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Lookup(ctx, ip); ok {
+		t.Errorf("expected the entry to be removed")
+	}
+}
+
+func TestRedisStoreCache(t *testing.T) {
+	a, b, _ := newFakeCluster(t, redisSlots/2)
+	options := RedisOptions{Addrs: []string{a.addr()}, Topology: RedisCluster}
+	store := NewRedisStore(newTestRedisClient(t, options), "bd:", time.Hour)
+	other := NewRedisStore(newTestRedisClient(t, options), "bd:", time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Cache(ctx, 100, 10*time.Millisecond, func(err error) { t.Log(err) })
+
+	waitFor(t, func() bool { return a.trackers() == 1 && b.trackers() == 1 })
+	waitFor(t, func() bool { return redisCacheEnabled(store) })
+
+	ip := net.ParseIP("192.0.2.1")
+	gets := func() int { return a.count("GET") + b.count("GET") }
+	for i := 0; i < 3; i++ {
+		if _, ok, err := store.Lookup(ctx, ip); ok || err != nil {
+			t.Fatalf("expected the IP not to be blacklisted, got %v, %v", ok, err)
+		}
+	}
+	if gets() != 1 {
+		t.Errorf("expected the missing entry to be looked up once, got %d", gets())
+	}
+
+	// another replica blacklists the IP, which invalidates the cached
+	// answer
+	if err := other.Add(ctx, []BlacklistEntry{{IP: ip, Expires: time.Now().Add(time.Hour), Reason: "max_requests"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, ok, _ := store.Lookup(ctx, ip)
+		return ok
+	})
+	n := gets()
+	if _, ok, _ := store.Lookup(ctx, ip); !ok || gets() != n {
+		t.Errorf("expected the entry to be cached")
+	}
+	hits, misses := store.CacheStats()
+	if hits < 3 || misses < 2 {
+		t.Errorf("expected hits and misses, got %d and %d", hits, misses)
+	}
+
+	// a flush drops everything
+	a.flushTracking()
+	waitFor(t, func() bool {
+		store.Lookup(ctx, ip)
+		return gets() > n
+	})
+
+	// while a node can't be tracked nothing is cached
+	b.mutex.Lock()
+	b.noTracking = true
+	for conn := range b.tracking {
+		conn.Close()
+	}
+	b.mutex.Unlock()
+	waitFor(t, func() bool { return !redisCacheEnabled(store) })
+	n = gets()
+	store.Lookup(ctx, ip)
+	store.Lookup(ctx, ip)
+	if gets() != n+2 {
+		t.Errorf("expected the lookups not to be cached, got %d", gets()-n)
+	}
+}
+
+func redisCacheEnabled(s *RedisStore) bool {
+	c, _ := s.cache.Load().(*redisCache)
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enabled
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
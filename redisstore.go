@@ -0,0 +1,552 @@
+package botdetect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redisTakeBatch is the most IPs Take pops from a handoff queue at once
+const redisTakeBatch = 10000
+
+// RedisStore keeps what replicas share in Redis: the request counts
+// (CounterStore and HandoffStore), the reputations (ReputationStore), the
+// blacklist (BlacklistStore) and the leases of the leaders (LeaseStore). All
+// keys start with the prefix, so several fleets can share one Redis, and
+// every key holds one IP, so that a cluster spreads them over its masters.
+// Each call sends its commands in one pipeline per server.
+type RedisStore struct {
+	client *RedisClient
+	prefix string
+
+	// Retention is how long request counts and handed over IPs are kept,
+	// at least the longest window of the rules
+	Retention time.Duration
+
+	// ReputationTTL drops reputations that haven't been updated for this
+	// long, 0 keeps them
+	ReputationTTL time.Duration
+
+	// cache holds the *redisCache while Cache runs
+	cache atomic.Value
+}
+
+// NewRedisStore creates a store keeping its keys under the prefix, e.g.
+// "botdetect:", and the request counts for retention
+func NewRedisStore(client *RedisClient, prefix string, retention time.Duration) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix, Retention: retention}
+}
+
+func (s *RedisStore) key(kind, name string) string {
+	return s.prefix + kind + ":" + name
+}
+
+// Publish merges the slots of the replica into the store. Every IP is a hash
+// with a field per replica and slot; the slots of the replica that are
+// older than Retention are dropped.
+func (s *RedisStore) Publish(ctx context.Context, replica string, counts map[string][]IPHistoryItem) error {
+	ips := make([]string, 0, len(counts))
+	cmds := make([][]string, 0, len(counts))
+	for ip := range counts {
+		ips = append(ips, ip)
+		cmds = append(cmds, []string{"HGETALL", s.key("counts", ip)})
+	}
+	replies, err := s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	if err := redisErr(replies); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-s.Retention)
+	cmds = cmds[:0]
+	for i, ip := range ips {
+		key := s.key("counts", ip)
+		stored, stale := parseRedisCounts(replies[i], cutoff)
+
+		hset := []string{"HSET", key}
+		for _, item := range MergeSlots(stored[replica], counts[ip]) {
+			if item.Timestamp.After(cutoff) {
+				hset = append(hset, redisCountField(replica, item.Timestamp), formatRedisCount(item))
+			}
+		}
+		if len(hset) > 2 {
+			cmds = append(cmds, hset)
+		}
+		if len(stale) > 0 {
+			cmds = append(cmds, append([]string{"HDEL", key}, stale...))
+		}
+		cmds = append(cmds, []string{"PEXPIRE", key, strconv.FormatInt(s.Retention.Milliseconds(), 10)})
+	}
+	replies, err = s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	return redisErr(replies)
+}
+
+// Fetch returns the slots of every replica for the IPs
+func (s *RedisStore) Fetch(ctx context.Context, ips []string) (map[string]map[string][]IPHistoryItem, error) {
+	cmds := make([][]string, len(ips))
+	for i, ip := range ips {
+		cmds[i] = []string{"HGETALL", s.key("counts", ip)}
+	}
+	replies, err := s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisErr(replies); err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-s.Retention)
+	out := make(map[string]map[string][]IPHistoryItem, len(ips))
+	for i, ip := range ips {
+		if replicas, _ := parseRedisCounts(replies[i], cutoff); len(replicas) > 0 {
+			out[ip] = replicas
+		}
+	}
+	return out, nil
+}
+
+func redisCountField(replica string, ts time.Time) string {
+	return replica + "|" + strconv.FormatInt(ts.UnixNano(), 10)
+}
+
+func formatRedisCount(item IPHistoryItem) string {
+	return fmt.Sprintf("%d %d %d %d %d %d", item.Count, item.App, item.Other, item.Bytes, item.Hits, item.Misses)
+}
+
+// parseRedisCounts parses a counts hash into the slots of every replica,
+// newest first, and the fields of the slots up to cutoff
+func parseRedisCounts(reply interface{}, cutoff time.Time) (map[string][]IPHistoryItem, []string) {
+	fields, _ := reply.([]interface{})
+	replicas := make(map[string][]IPHistoryItem)
+	stale := []string{}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		field, value := redisString(fields[i]), redisString(fields[i+1])
+		sep := strings.LastIndexByte(field, '|')
+		if sep < 0 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(field[sep+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		item := IPHistoryItem{Timestamp: time.Unix(0, nanos).UTC()}
+		if _, err := fmt.Sscanf(value, "%d %d %d %d %d %d", &item.Count, &item.App, &item.Other, &item.Bytes, &item.Hits, &item.Misses); err != nil {
+			continue
+		}
+		if !item.Timestamp.After(cutoff) {
+			stale = append(stale, field)
+			continue
+		}
+		replica := field[:sep]
+		replicas[replica] = append(replicas[replica], item)
+	}
+	for replica, items := range replicas {
+		sort.Slice(items, func(i, j int) bool { return items[i].Timestamp.After(items[j].Timestamp) })
+		replicas[replica] = items
+	}
+	return replicas, stale
+}
+
+// Hand queues the IPs for the owner
+func (s *RedisStore) Hand(ctx context.Context, owner string, ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	key := s.key("handoff", owner)
+	replies, err := s.client.Pipeline(ctx, [][]string{
+		append([]string{"SADD", key}, ips...),
+		{"PEXPIRE", key, strconv.FormatInt(s.Retention.Milliseconds(), 10)},
+	})
+	if err != nil {
+		return err
+	}
+	return redisErr(replies)
+}
+
+// Take returns and removes up to 10000 of the IPs queued for the owner, the
+// others are taken the next time
+func (s *RedisStore) Take(ctx context.Context, owner string) ([]string, error) {
+	reply, err := s.client.Do(ctx, "SPOP", s.key("handoff", owner), strconv.Itoa(redisTakeBatch))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	members, _ := reply.([]interface{})
+	ips := make([]string, 0, len(members))
+	for _, m := range members {
+		ips = append(ips, redisString(m))
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// Reputations returns the ReputationStore keeping the reputations in the
+// store. The RedisStore can't be one itself: its Fetch is the CounterStore's.
+func (s *RedisStore) Reputations() ReputationStore {
+	return redisReputations{s}
+}
+
+// redisReputations keeps every reputation in a key of its own
+type redisReputations struct {
+	s *RedisStore
+}
+
+// Fetch returns the reputations of the IPs that have one
+func (r redisReputations) Fetch(ctx context.Context, ips []string) (map[string]Reputation, error) {
+	cmds := make([][]string, len(ips))
+	for i, ip := range ips {
+		cmds[i] = []string{"GET", r.s.key("reputation", ip)}
+	}
+	replies, err := r.s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisErr(replies); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]Reputation)
+	for i, ip := range ips {
+		var score float64
+		var nanos int64
+		if _, err := fmt.Sscanf(redisString(replies[i]), "%g %d", &score, &nanos); err != nil {
+			continue
+		}
+		out[ip] = Reputation{Score: score, Updated: time.Unix(0, nanos)}
+	}
+	return out, nil
+}
+
+// Update replaces the reputations of the IPs
+func (r redisReputations) Update(ctx context.Context, reputations map[string]Reputation) error {
+	cmds := make([][]string, 0, len(reputations))
+	for ip, rep := range reputations {
+		cmd := []string{"SET", r.s.key("reputation", ip), fmt.Sprintf("%s %d", strconv.FormatFloat(rep.Score, 'g', -1, 64), rep.Updated.UnixNano())}
+		if r.s.ReputationTTL > 0 {
+			cmd = append(cmd, "PX", strconv.FormatInt(r.s.ReputationTTL.Milliseconds(), 10))
+		}
+		cmds = append(cmds, cmd)
+	}
+	replies, err := r.s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	return redisErr(replies)
+}
+
+// redisAcquire takes or renews a lease unless another holder has it and
+// returns the holder
+const redisAcquire = `local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return holder
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]`
+
+// redisRelease deletes a lease if the holder has it
+const redisRelease = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// Acquire takes the lease for the holder, or renews it, unless another
+// holder has it, and returns who holds it
+func (s *RedisStore) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (string, error) {
+	reply, err := s.client.Do(ctx, "EVAL", redisAcquire, "1", s.key("lease", name), holder, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return "", storeError(err)
+	}
+	return redisString(reply), nil
+}
+
+// Release gives up the lease if the holder has it
+func (s *RedisStore) Release(ctx context.Context, name, holder string) error {
+	if _, err := s.client.Do(ctx, "EVAL", redisRelease, "1", s.key("lease", name), holder); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// redisBlacklisted is the value of a blacklist key
+type redisBlacklisted struct {
+	Expires  time.Time `json:"expires"`
+	Reason   string    `json:"reason,omitempty"`
+	Severity Severity  `json:"severity,omitempty"`
+}
+
+// Add adds the entries, each expiring with the entry
+func (s *RedisStore) Add(ctx context.Context, entries []BlacklistEntry) error {
+	now := time.Now()
+	cmds := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		ttl := e.Expires.Sub(now).Milliseconds()
+		if ttl <= 0 {
+			continue
+		}
+		value, err := json.Marshal(redisBlacklisted{Expires: e.Expires, Reason: e.Reason, Severity: e.Severity})
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, []string{"SET", s.key("blacklist", ipKey(e.IP)), string(value), "PX", strconv.FormatInt(ttl, 10)})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	replies, err := s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	return redisErr(replies)
+}
+
+// Remove removes the IPs
+func (s *RedisStore) Remove(ctx context.Context, ips []net.IP) error {
+	cmds := make([][]string, len(ips))
+	for i, ip := range ips {
+		cmds[i] = []string{"DEL", s.key("blacklist", ipKey(ip))}
+	}
+	replies, err := s.client.Pipeline(ctx, cmds)
+	if err != nil {
+		return err
+	}
+	return redisErr(replies)
+}
+
+// Lookup returns the entry of the IP and whether it is in the store, from
+// the client-side cache if it is enabled and holds the IP
+func (s *RedisStore) Lookup(ctx context.Context, ip net.IP) (BlacklistEntry, bool, error) {
+	key := s.key("blacklist", ipKey(ip))
+	cache, _ := s.cache.Load().(*redisCache)
+	entry, found, cached, epoch := cache.get(key)
+	if !cached {
+		reply, err := s.client.Do(ctx, "GET", key)
+		if err != nil {
+			return BlacklistEntry{}, false, storeError(err)
+		}
+		entry, found = BlacklistEntry{}, false
+		if value := redisString(reply); value != "" {
+			var b redisBlacklisted
+			if err := json.Unmarshal([]byte(value), &b); err != nil {
+				return BlacklistEntry{}, false, storeError(fmt.Errorf("%s: %w", key, err))
+			}
+			entry, found = BlacklistEntry{IP: ip, Expires: b.Expires, Reason: b.Reason, Severity: b.Severity}, true
+		}
+		cache.put(key, entry, found, epoch)
+	}
+
+	if found && !entry.Expires.After(time.Now()) {
+		return BlacklistEntry{}, false, nil
+	}
+	entry.IP = ip
+	return entry, found, nil
+}
+
+// Cache keeps the answers of up to size blacklist lookups in memory until
+// the context is done. Redis invalidates them whenever the entries change,
+// with CLIENT TRACKING in broadcast mode on a connection to every master.
+// While a connection is down nothing is cached, and the cache is emptied
+// when it comes back. Errors are passed to onError, then the connections
+// are opened again after retry.
+func (s *RedisStore) Cache(ctx context.Context, size int, retry time.Duration, onError func(error)) {
+	c := &redisCache{size: size, entries: make(map[string]redisCached)}
+	s.cache.Store(c)
+	defer s.cache.Store((*redisCache)(nil))
+
+	prefix := s.key("blacklist", "")
+	for {
+		err := s.track(ctx, c, prefix)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// track subscribes to the invalidations of every master and returns when
+// one of the subscriptions ends or the masters change
+func (s *RedisStore) track(ctx context.Context, c *redisCache, prefix string) error {
+	masters, err := s.client.Masters(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.disable()
+
+	tracking := []string{"CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", prefix}
+	var ready int32
+	errs := make(chan error, len(masters))
+	for _, addr := range masters {
+		go func(addr string) {
+			errs <- s.client.Subscribe(ctx, addr, [][]string{tracking}, func() {
+				if int(atomic.AddInt32(&ready, 1)) == len(masters) {
+					c.enable()
+				}
+			}, c.invalidate)
+		}(addr)
+	}
+
+	// a failover or resharding moves keys to masters without a subscription
+	check := time.NewTicker(30 * time.Second)
+	defer check.Stop()
+	for {
+		select {
+		case err := <-errs:
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		case <-check.C:
+			current, err := s.client.Masters(ctx)
+			if err != nil {
+				return err
+			}
+			if !equalStrings(current, masters) {
+				return nil
+			}
+		}
+	}
+}
+
+// CacheStats returns the number of lookups answered from the client-side
+// cache and of those sent to Redis
+func (s *RedisStore) CacheStats() (hits, misses uint64) {
+	c, _ := s.cache.Load().(*redisCache)
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// redisCache holds the answers of blacklist lookups. An answer read while an
+// invalidation arrived may be stale and isn't kept, which epoch, counting
+// the invalidations, tells.
+type redisCache struct {
+	size    int
+	hits    uint64
+	misses  uint64
+	mutex   sync.Mutex
+	enabled bool
+	epoch   uint64
+	entries map[string]redisCached
+}
+
+type redisCached struct {
+	entry BlacklistEntry
+	found bool
+}
+
+// get returns the cached answer for the key, whether there is one and the
+// epoch to put a fresh answer with
+func (c *redisCache) get(key string) (BlacklistEntry, bool, bool, uint64) {
+	if c == nil {
+		return BlacklistEntry{}, false, false, 0
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, ok := c.entries[key]
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return cached.entry, cached.found, ok, c.epoch
+}
+
+// put caches the answer read since get returned epoch, unless an
+// invalidation arrived in between
+func (c *redisCache) put(key string, entry BlacklistEntry, found bool, epoch uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.enabled || epoch != c.epoch {
+		return
+	}
+	if len(c.entries) >= c.size {
+		// make room by dropping any entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	if c.size > 0 {
+		c.entries[key] = redisCached{entry: entry, found: found}
+	}
+}
+
+// invalidate drops the keys of an invalidation message, all of them if it
+// has none
+func (c *redisCache) invalidate(push []interface{}) {
+	if len(push) < 2 || redisString(push[0]) != "invalidate" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.epoch++
+	keys, ok := push[1].([]interface{})
+	if !ok {
+		c.entries = make(map[string]redisCached)
+		return
+	}
+	for _, k := range keys {
+		delete(c.entries, redisString(k))
+	}
+}
+
+func (c *redisCache) enable() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.epoch++
+	c.entries = make(map[string]redisCached)
+	c.enabled = true
+}
+
+func (c *redisCache) disable() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.epoch++
+	c.entries = make(map[string]redisCached)
+	c.enabled = false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
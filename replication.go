@@ -0,0 +1,256 @@
+package botdetect
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CounterStore shares the request counts of several replicas, e.g. in Redis.
+// Every replica only writes its own slots, and slots of the same replica are
+// merged by taking the maximum of each count. That makes them grow-only
+// counters (a CRDT): publishing is idempotent and stale or reordered
+// publishes can't lose requests, so replicas never need to coordinate.
+// Stores should drop slots older than the longest window, e.g. with a TTL.
+type CounterStore interface {
+	// Publish merges the slots of the replica for the given IPs into the
+	// store
+	Publish(ctx context.Context, replica string, counts map[string][]IPHistoryItem) error
+
+	// Fetch returns the slots of every replica for the IPs, keyed by IP
+	// and replica
+	Fetch(ctx context.Context, ips []string) (map[string]map[string][]IPHistoryItem, error)
+}
+
+// ReplicationOptions make the history evaluate its rules against the
+// requests of all replicas rather than only its own. Every replica publishes
+// the slots of the IPs it received requests from and evaluates those IPs
+// with the counts of all replicas added up, so an IP whose requests are
+// spread across replicas is blacklisted on each of them.
+type ReplicationOptions struct {
+	Store CounterStore
+
+	// Replica identifies this instance in the store and must be unique
+	Replica string
+
+	// Timeout limits each exchange with the store. The rules are
+	// evaluated on the local counts if it fails.
+	Timeout time.Duration
+
+	// OnError is called when the store fails if set
+	OnError func(err error)
+
+	// Ring partitions the IPs between the replicas if set, so that only
+	// the replica owning an IP evaluates the rules for it. The others hand
+	// the IPs they receive requests from over to the owner through the
+	// store, which has to implement HandoffStore. Ring members are replica
+	// names; a replica that isn't a member only publishes its counts.
+	Ring *HashRing
+}
+
+// MergeSlots merges two versions of the slots of one replica by taking the
+// maximum of each count per slot. The result is ordered newest first.
+func MergeSlots(a, b []IPHistoryItem) []IPHistoryItem {
+	return combineSlots(a, b, func(x, y uint64) uint64 {
+		if x > y {
+			return x
+		}
+		return y
+	})
+}
+
+// sumSlots adds up the slots of different replicas
+func sumSlots(a, b []IPHistoryItem) []IPHistoryItem {
+	return combineSlots(a, b, func(x, y uint64) uint64 { return x + y })
+}
+
+func combineSlots(a, b []IPHistoryItem, combine func(x, y uint64) uint64) []IPHistoryItem {
+	slots := make(map[time.Time]*IPHistoryItem, len(a)+len(b))
+	out := make([]IPHistoryItem, 0, len(a)+len(b))
+
+	for _, items := range [][]IPHistoryItem{a, b} {
+		for _, item := range items {
+			key := item.Timestamp.UTC()
+			hi, ok := slots[key]
+			if !ok {
+				// out never grows beyond its capacity, so the
+				// pointer stays valid
+				out = append(out, item)
+				slots[key] = &out[len(out)-1]
+				continue
+			}
+			hi.Count = combine(hi.Count, item.Count)
+			hi.App = combine(hi.App, item.App)
+			hi.Other = combine(hi.Other, item.Other)
+			hi.Bytes = combine(hi.Bytes, item.Bytes)
+			hi.Hits = combine(hi.Hits, item.Hits)
+			hi.Misses = combine(hi.Misses, item.Misses)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Timestamp.After(out[j].Timestamp) })
+	return out
+}
+
+// MemoryCounterStore is a CounterStore for replicas within one process and a
+// reference for implementations backed by shared storage
+type MemoryCounterStore struct {
+	counts map[string]map[string][]IPHistoryItem
+	handed map[string]map[string]bool
+	mutex  sync.Mutex
+}
+
+// NewMemoryCounterStore creates an empty MemoryCounterStore
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{counts: make(map[string]map[string][]IPHistoryItem)}
+}
+
+// Publish merges the slots of the replica into the store
+func (s *MemoryCounterStore) Publish(ctx context.Context, replica string, counts map[string][]IPHistoryItem) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for ip, items := range counts {
+		replicas, ok := s.counts[ip]
+		if !ok {
+			replicas = make(map[string][]IPHistoryItem)
+			s.counts[ip] = replicas
+		}
+		replicas[replica] = MergeSlots(replicas[replica], items)
+	}
+	return nil
+}
+
+// Fetch returns the slots of every replica for the IPs
+func (s *MemoryCounterStore) Fetch(ctx context.Context, ips []string) (map[string]map[string][]IPHistoryItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make(map[string]map[string][]IPHistoryItem, len(ips))
+	for _, ip := range ips {
+		replicas, ok := s.counts[ip]
+		if !ok {
+			continue
+		}
+		out[ip] = make(map[string][]IPHistoryItem, len(replicas))
+		for replica, items := range replicas {
+			out[ip][replica] = append([]IPHistoryItem(nil), items...)
+		}
+	}
+	return out, nil
+}
+
+// Expire drops the slots up to cutoff
+func (s *MemoryCounterStore) Expire(cutoff time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for ip, replicas := range s.counts {
+		for replica, items := range replicas {
+			i := len(items)
+			for i > 0 && !items[i-1].Timestamp.After(cutoff) {
+				i--
+			}
+			if i == 0 {
+				delete(replicas, replica)
+			} else {
+				replicas[replica] = items[:i]
+			}
+		}
+		if len(replicas) == 0 {
+			delete(s.counts, ip)
+		}
+	}
+}
+
+// replicate publishes the local slots of the updated IPs and returns the IPs
+// to evaluate, see handoff, with the slots of the other replicas added up.
+// If the store fails, the updated IPs are evaluated on the local slots.
+func (h *IPHistory) replicate(updated map[string]bool) (map[string][]IPHistoryItem, map[string]bool) {
+	r := h.opts().Replication
+	if _, _, named := h.namedLeader(); r == nil || len(updated) == 0 && r.Ring == nil && !named {
+		return nil, updated
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, r.Timeout)
+	defer cancel()
+
+	if err := h.publish(ctx, updated); err != nil {
+		h.replicationError(err)
+		return nil, updated
+	}
+
+	// the IPs are handed over only after their slots have been published,
+	// so that the owner finds them
+	evaluate := h.handoff(updated)
+	if len(evaluate) == 0 {
+		return nil, evaluate
+	}
+	keys := make([]string, 0, len(evaluate))
+	for ip := range evaluate {
+		keys = append(keys, ip)
+	}
+	all, err := r.Store.Fetch(ctx, keys)
+	if err != nil {
+		h.replicationError(err)
+		return nil, evaluate
+	}
+
+	remote := make(map[string][]IPHistoryItem, len(all))
+	for ip, replicas := range all {
+		for replica, items := range replicas {
+			if replica != r.Replica {
+				remote[ip] = sumSlots(remote[ip], items)
+			}
+		}
+	}
+	return remote, evaluate
+}
+
+// publish publishes the local slots of the updated IPs
+func (h *IPHistory) publish(ctx context.Context, updated map[string]bool) error {
+	local := make(map[string][]IPHistoryItem, len(updated))
+	h.mutex.RLock()
+	for ip := range updated {
+		counts, ok := h.data[ip]
+		if !ok {
+			continue
+		}
+		items := make([]IPHistoryItem, 0, counts.Len())
+		for node := counts.Front(); node != nil; node = node.Next() {
+			items = append(items, *node.Value.(*IPHistoryItem))
+		}
+		local[ip] = items
+	}
+	h.mutex.RUnlock()
+
+	if len(local) == 0 {
+		return nil
+	}
+	r := h.opts().Replication
+	return r.Store.Publish(ctx, r.Replica, local)
+}
+
+func (h *IPHistory) replicationError(err error) {
+	if fn := h.opts().Replication.OnError; fn != nil {
+		fn(storeError(err))
+	}
+}
+
+// withRemote returns a list of the local slots with the slots of the other
+// replicas added, ordered newest first like the local list
+func withRemote(counts *list.List, remote []IPHistoryItem) *list.List {
+	local := make([]IPHistoryItem, 0, counts.Len())
+	for node := counts.Front(); node != nil; node = node.Next() {
+		local = append(local, *node.Value.(*IPHistoryItem))
+	}
+
+	merged := list.New()
+	for _, item := range sumSlots(local, remote) {
+		item := item
+		merged.PushBack(&item)
+	}
+	return merged
+}
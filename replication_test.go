@@ -0,0 +1,147 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMergeSlots(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+
+	a := []IPHistoryItem{{Timestamp: t1, Count: 3, App: 2}, {Timestamp: t0, Count: 5, App: 5}}
+	b := []IPHistoryItem{{Timestamp: t1, Count: 4, App: 1}}
+
+	merged := MergeSlots(a, b)
+	if len(merged) != 2 || merged[0].Count != 4 || merged[0].App != 2 || merged[1].Count != 5 {
+		t.Errorf("unexpected merge %+v", merged)
+	}
+
+	// merging is idempotent and commutative
+	if again := MergeSlots(merged, b); len(again) != 2 || again[0] != merged[0] || again[1] != merged[1] {
+		t.Errorf("expected merging twice not to change the slots, got %+v", again)
+	}
+	if swapped := MergeSlots(b, a); swapped[0] != merged[0] || swapped[1] != merged[1] {
+		t.Errorf("expected the order not to matter, got %+v", swapped)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryCounterStore()
+	replica := func(name string) *IPHistory {
+		h, err := NewIPHistory(ctx, &IPHistoryOptions{
+			TimestampFormat: "15:04",
+			TimeSlot:        time.Minute,
+			Window:          time.Hour,
+			Interval:        time.Hour,
+			ExpireInterval:  time.Hour,
+			BlacklistTTL:    time.Hour,
+			MaxRequests:     15,
+			Replication:     &ReplicationOptions{Store: store, Replica: name, Timeout: time.Second},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a, b := replica("a"), replica("b")
+
+	// the requests are spread across the replicas, neither sees enough of
+	// them to blacklist the IP on its own
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		a.RequestChannel() <- &Request{IP: ip, URL: "/"}
+		b.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	}
+	for a.Processed() < 10 || b.Processed() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	a.TriggerCalculate()
+	if a.IsBlacklisted(ip) {
+		t.Error("expected the first replica not to know about the requests of the second yet")
+	}
+	b.TriggerCalculate()
+	if !b.IsBlacklisted(ip) {
+		t.Error("expected the second replica to blacklist the IP with the requests of both")
+	}
+
+	// the store holds each replica's slots only once, however often they
+	// are published
+	a.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	for a.Processed() < 11 {
+		time.Sleep(time.Millisecond)
+	}
+	a.TriggerCalculate()
+	if !a.IsBlacklisted(ip) {
+		t.Error("expected the first replica to blacklist the IP once it published again")
+	}
+	all, _ := store.Fetch(ctx, []string{ipKey(ip)})
+	total := uint64(0)
+	for _, items := range all[ipKey(ip)] {
+		for _, item := range items {
+			total += item.Count
+		}
+	}
+	if total != 21 {
+		t.Errorf("expected 21 requests in the store, got %d", total)
+	}
+
+	store.Expire(time.Now().Add(time.Hour))
+	if all, _ := store.Fetch(ctx, []string{ipKey(ip)}); len(all) != 0 {
+		t.Errorf("expected all slots to expire, got %v", all)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Publish(context.Context, string, map[string][]IPHistoryItem) error {
+	return errors.New("unavailable")
+}
+
+func (failingStore) Fetch(context.Context, []string) (map[string]map[string][]IPHistoryItem, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestReplicationFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     5,
+		Replication: &ReplicationOptions{Store: failingStore{}, Replica: "a", Timeout: time.Second,
+			OnError: func(err error) { errs <- err }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		h.RequestChannel() <- &Request{IP: ip, URL: "/"}
+	}
+	for h.Processed() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if err := <-errs; !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected the store error to be reported as unavailable, got %v", err)
+	}
+	if !h.IsBlacklisted(ip) {
+		t.Error("expected the local counts to be evaluated when the store fails")
+	}
+}
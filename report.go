@@ -0,0 +1,182 @@
+package botdetect
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReportOptions configures the contents of the reports
+type ReportOptions struct {
+	// Top is the number of entries in each of the top lists
+	Top int
+
+	// Country and Network look up where blocked IPs come from. The
+	// corresponding top list stays empty if they are nil.
+	Country func(ip net.IP) (string, bool)
+	Network func(ip net.IP) (string, bool)
+}
+
+// ReportCount is an entry of a top list
+type ReportCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Report summarizes the decisions made within a period
+type Report struct {
+	Start        time.Time     `json:"start"`
+	End          time.Time     `json:"end"`
+	Requests     uint64        `json:"requests"`
+	Blocked      uint64        `json:"blocked"`
+	BlockedShare float64       `json:"blocked_share"`
+	TopIPs       []ReportCount `json:"top_ips"`
+	TopCountries []ReportCount `json:"top_countries,omitempty"`
+	TopNetworks  []ReportCount `json:"top_networks,omitempty"`
+	Reasons      []ReportCount `json:"reasons"`
+}
+
+// WriteText writes the report in a form meant to be read by humans, e.g. in
+// a mail
+func (r *Report) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "botdetect report %s - %s\n\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "requests: %d\nblocked:  %d (%.2f%%)\n", r.Requests, r.Blocked, r.BlockedShare*100); err != nil {
+		return err
+	}
+
+	for _, section := range []struct {
+		title  string
+		counts []ReportCount
+	}{
+		{"top blocked IPs", r.TopIPs},
+		{"top countries", r.TopCountries},
+		{"top networks", r.TopNetworks},
+		{"block reasons", r.Reasons},
+	} {
+		if len(section.counts) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "\n%s:\n", section.title); err != nil {
+			return err
+		}
+		for _, c := range section.counts {
+			if _, err := fmt.Fprintf(w, "  %8d  %s\n", c.Count, c.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReportCollector aggregates decisions until the next report is taken
+type ReportCollector struct {
+	options ReportOptions
+
+	start     time.Time
+	requests  uint64
+	blocked   uint64
+	ips       map[string]uint64
+	countries map[string]uint64
+	networks  map[string]uint64
+	reasons   map[string]uint64
+	mutex     sync.Mutex
+}
+
+// NewReportCollector creates a ReportCollector whose first period starts now
+func NewReportCollector(options ReportOptions) *ReportCollector {
+	rc := &ReportCollector{options: options}
+	rc.reset(time.Now())
+	return rc
+}
+
+func (rc *ReportCollector) reset(now time.Time) {
+	rc.start = now
+	rc.requests = 0
+	rc.blocked = 0
+	rc.ips = make(map[string]uint64)
+	rc.countries = make(map[string]uint64)
+	rc.networks = make(map[string]uint64)
+	rc.reasons = make(map[string]uint64)
+}
+
+// Record counts a decision
+func (rc *ReportCollector) Record(ip net.IP, blocked bool, reason string) {
+	if rc == nil {
+		return
+	}
+
+	var country, network string
+	if blocked && rc.options.Country != nil {
+		country, _ = rc.options.Country(ip)
+	}
+	if blocked && rc.options.Network != nil {
+		network, _ = rc.options.Network(ip)
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.requests++
+	if !blocked {
+		return
+	}
+	rc.blocked++
+	rc.ips[ipKey(ip)]++
+	rc.reasons[reason]++
+	if country != "" {
+		rc.countries[country]++
+	}
+	if network != "" {
+		rc.networks[network]++
+	}
+}
+
+// Report returns the report for the period since the last one and starts a
+// new period
+func (rc *ReportCollector) Report() *Report {
+	now := time.Now()
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	r := &Report{
+		Start:        rc.start,
+		End:          now,
+		Requests:     rc.requests,
+		Blocked:      rc.blocked,
+		TopIPs:       topCounts(rc.ips, rc.options.Top),
+		TopCountries: topCounts(rc.countries, rc.options.Top),
+		TopNetworks:  topCounts(rc.networks, rc.options.Top),
+		Reasons:      topCounts(rc.reasons, 0),
+	}
+	if r.Requests > 0 {
+		r.BlockedShare = float64(r.Blocked) / float64(r.Requests)
+	}
+
+	rc.reset(now)
+	return r
+}
+
+// topCounts returns the n largest counts, all of them if n is zero, ordered
+// by count and key
+func topCounts(counts map[string]uint64, n int) []ReportCount {
+	out := make([]ReportCount, 0, len(counts))
+	for key, count := range counts {
+		out = append(out, ReportCount{Key: key, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
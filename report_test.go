@@ -0,0 +1,57 @@
+package botdetect
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReportCollector(t *testing.T) {
+	rc := NewReportCollector(ReportOptions{
+		Top: 2,
+		Country: func(ip net.IP) (string, bool) {
+			return "DE", true
+		},
+	})
+
+	for i, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.3", "::ffff:192.0.2.1"} {
+		rc.Record(net.ParseIP(ip), true, []string{"rule a", "rule b"}[i%2])
+	}
+	for i := 0; i < 5; i++ {
+		rc.Record(net.ParseIP("192.0.2.9"), false, "")
+	}
+
+	r := rc.Report()
+	if r.Requests != 10 || r.Blocked != 5 || r.BlockedShare != 0.5 {
+		t.Errorf("unexpected totals %d/%d/%f", r.Requests, r.Blocked, r.BlockedShare)
+	}
+	if len(r.TopIPs) != 2 || r.TopIPs[0] != (ReportCount{"192.0.2.1", 3}) || r.TopIPs[1] != (ReportCount{"192.0.2.2", 1}) {
+		t.Errorf("unexpected top IPs %v", r.TopIPs)
+	}
+	if len(r.TopCountries) != 1 || r.TopCountries[0] != (ReportCount{"DE", 5}) {
+		t.Errorf("unexpected top countries %v", r.TopCountries)
+	}
+	if len(r.TopNetworks) != 0 {
+		t.Errorf("expected no networks without a lookup, got %v", r.TopNetworks)
+	}
+	if len(r.Reasons) != 2 || r.Reasons[0] != (ReportCount{"rule a", 3}) {
+		t.Errorf("unexpected reasons %v", r.Reasons)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "blocked:  5 (50.00%)") || !strings.Contains(buf.String(), "top countries:") {
+		t.Errorf("unexpected text report:\n%s", buf.String())
+	}
+
+	// the next report starts from scratch
+	if next := rc.Report(); next.Requests != 0 || len(next.TopIPs) != 0 || !next.Start.Equal(r.End) {
+		t.Errorf("expected an empty report starting at the end of the last one, got %+v", next)
+	}
+
+	var nilCollector *ReportCollector
+	nilCollector.Record(net.ParseIP("192.0.2.1"), true, "")
+}
@@ -0,0 +1,290 @@
+package botdetect
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reputation is what the history remembers about an IP beyond the window of
+// its rules. The score drops when the IP is blacklisted and rises while it
+// behaves, and decays towards 0 with ReputationOptions.HalfLife.
+type Reputation struct {
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"updated"`
+}
+
+// At returns the score decayed until now
+func (r Reputation) At(now time.Time, halfLife time.Duration) float64 {
+	if r.Score == 0 || halfLife <= 0 {
+		return r.Score
+	}
+	elapsed := now.Sub(r.Updated)
+	if elapsed <= 0 {
+		return r.Score
+	}
+	return r.Score * math.Pow(0.5, float64(elapsed)/float64(halfLife))
+}
+
+// ReputationStore keeps the reputations of IPs, e.g. in Redis, so that they
+// survive restarts and are shared by replicas. Updates of the same IP by
+// different replicas may overwrite each other, which only loses a penalty or
+// reward.
+type ReputationStore interface {
+	// Fetch returns the reputations of the IPs that have one
+	Fetch(ctx context.Context, ips []string) (map[string]Reputation, error)
+
+	// Update replaces the reputations of the IPs
+	Update(ctx context.Context, reputations map[string]Reputation) error
+}
+
+// ReputationOptions adjust the thresholds of the request and bandwidth rules
+// for an IP by its reputation: they are multiplied by 2^score, bounded by
+// MinFactor and MaxFactor. An IP blacklisted twice recently gets a quarter
+// of the limits, one that behaved for weeks may get twice as much.
+type ReputationOptions struct {
+	Store ReputationStore
+
+	// HalfLife is the time after which a score has decayed to half
+	HalfLife time.Duration
+
+	// Penalty is subtracted from the score whenever the IP is blacklisted
+	Penalty float64
+
+	// Reward is added to the score for every RewardInterval in which the IP
+	// sent requests without being blacklisted
+	Reward         float64
+	RewardInterval time.Duration
+
+	// MinFactor and MaxFactor bound the factor applied to the thresholds
+	MinFactor float64
+	MaxFactor float64
+
+	// Timeout limits each exchange with the store. The rules are
+	// evaluated without reputations if it fails.
+	Timeout time.Duration
+
+	// OnError is called when the store fails if set
+	OnError func(err error)
+}
+
+// factor returns the factor for the thresholds of an IP with the score
+func (o *ReputationOptions) factor(score float64) float64 {
+	return math.Min(o.MaxFactor, math.Max(o.MinFactor, math.Pow(2, score)))
+}
+
+func (o *ReputationOptions) validate() []string {
+	problems := []string{}
+	if o.Store == nil {
+		problems = append(problems, "reputation requires a store")
+	}
+	if o.HalfLife <= 0 || o.RewardInterval <= 0 || o.Timeout <= 0 {
+		problems = append(problems, "reputation half-life, reward interval and timeout must be greater than zero")
+	}
+	if o.Penalty < 0 || o.Reward < 0 {
+		problems = append(problems, "reputation penalty and reward must not be negative")
+	}
+	if o.MinFactor <= 0 || o.MinFactor > 1 || o.MaxFactor < 1 {
+		problems = append(problems, fmt.Sprintf("reputation factors must be within (0, 1] and [1, ...), got %g and %g", o.MinFactor, o.MaxFactor))
+	}
+	return problems
+}
+
+// MemoryReputationStore is a ReputationStore within one process and a
+// reference for implementations backed by shared storage. It is saved with
+// the state of the history that uses it.
+type MemoryReputationStore struct {
+	reputations map[string]Reputation
+	mutex       sync.Mutex
+}
+
+// NewMemoryReputationStore creates an empty MemoryReputationStore
+func NewMemoryReputationStore() *MemoryReputationStore {
+	return &MemoryReputationStore{reputations: make(map[string]Reputation)}
+}
+
+// Fetch returns the reputations of the IPs that have one
+func (s *MemoryReputationStore) Fetch(ctx context.Context, ips []string) (map[string]Reputation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make(map[string]Reputation, len(ips))
+	for _, ip := range ips {
+		if r, ok := s.reputations[ip]; ok {
+			out[ip] = r
+		}
+	}
+	return out, nil
+}
+
+// Update replaces the reputations of the IPs
+func (s *MemoryReputationStore) Update(ctx context.Context, reputations map[string]Reputation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for ip, r := range reputations {
+		s.reputations[ip] = r
+	}
+	return nil
+}
+
+// Expire drops the reputations that haven't changed since cutoff and whose
+// score has decayed to almost 0
+func (s *MemoryReputationStore) Expire(cutoff time.Time, halfLife time.Duration) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for ip, r := range s.reputations {
+		if r.Updated.Before(cutoff) && math.Abs(r.At(now, halfLife)) < 0.01 {
+			delete(s.reputations, ip)
+		}
+	}
+}
+
+// Size returns the number of IPs with a reputation
+func (s *MemoryReputationStore) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.reputations)
+}
+
+// snapshot returns a copy of all reputations
+func (s *MemoryReputationStore) snapshot() map[string]Reputation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make(map[string]Reputation, len(s.reputations))
+	for ip, r := range s.reputations {
+		out[ip] = r
+	}
+	return out
+}
+
+// memoryReputations returns the store of the reputations if it is a
+// MemoryReputationStore, which is saved with the state
+func memoryReputations(o *ReputationOptions) *MemoryReputationStore {
+	if o != nil {
+		if store, ok := o.Store.(*MemoryReputationStore); ok {
+			return store
+		}
+	}
+	return nil
+}
+
+// reputations fetches the reputations of the IPs, or returns nil if
+// reputations are disabled or the store failed
+func (h *IPHistory) reputations(ips map[string]bool) map[string]Reputation {
+	o := h.opts().Reputation
+	if o == nil || len(ips) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(ips))
+	for ip := range ips {
+		keys = append(keys, ip)
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, o.Timeout)
+	defer cancel()
+
+	reputations, err := o.Store.Fetch(ctx, keys)
+	if err != nil {
+		reputationError(o, err)
+		return nil
+	}
+	return reputations
+}
+
+// reputationFactor returns the factor for the thresholds of the IP and
+// whether it differs from 1
+func (h *IPHistory) reputationFactor(reputations map[string]Reputation, ip string, now time.Time) (float64, bool) {
+	o := h.opts().Reputation
+	r, ok := reputations[ip]
+	if o == nil || !ok {
+		return 1, false
+	}
+	factor := o.factor(r.At(now, o.HalfLife))
+	return factor, factor != 1
+}
+
+// updateReputations penalizes the IPs blacklisted since the last calculation
+// and rewards the active ones that behaved for a whole reward interval.
+// known are the reputations fetched for the active IPs before the
+// calculation; h.mutex must not be held.
+func (h *IPHistory) updateReputations(active map[string]bool, known map[string]Reputation, now time.Time) {
+	o := h.opts().Reputation
+	if o == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	penalized := h.penalized
+	h.penalized = make(map[string]bool)
+	h.mutex.Unlock()
+
+	if known == nil {
+		if len(active) > 0 {
+			// the store failed before the calculation, don't
+			// overwrite what it knows with fresh reputations
+			return
+		}
+		known = make(map[string]Reputation)
+	}
+
+	missing := map[string]bool{}
+	for ip := range penalized {
+		if _, ok := known[ip]; !ok && !active[ip] {
+			missing[ip] = true
+		}
+	}
+	if len(missing) > 0 {
+		fetched := h.reputations(missing)
+		if fetched == nil {
+			return
+		}
+		for ip, r := range fetched {
+			known[ip] = r
+		}
+	}
+
+	changes := make(map[string]Reputation)
+	for ip := range penalized {
+		changes[ip] = Reputation{Score: known[ip].At(now, o.HalfLife) - o.Penalty, Updated: now}
+		h.reputationChanges.Inc("penalty")
+	}
+	for ip := range active {
+		if penalized[ip] || h.blacklist.IsBlacklisted(net.ParseIP(ip)) {
+			continue
+		}
+		r, ok := known[ip]
+		switch {
+		case !ok:
+			// good behavior is rewarded after a whole interval
+			changes[ip] = Reputation{Updated: now}
+		case now.Sub(r.Updated) >= o.RewardInterval && o.Reward > 0:
+			changes[ip] = Reputation{Score: r.At(now, o.HalfLife) + o.Reward, Updated: now}
+			h.reputationChanges.Inc("reward")
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, o.Timeout)
+	defer cancel()
+
+	if err := o.Store.Update(ctx, changes); err != nil {
+		reputationError(o, err)
+	}
+}
+
+func reputationError(o *ReputationOptions, err error) {
+	if o.OnError != nil {
+		o.OnError(storeError(err))
+	}
+}
@@ -0,0 +1,254 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+	now := time.Now()
+	r := Reputation{Score: -2, Updated: now.Add(-24 * time.Hour)}
+
+	if score := r.At(now, 24*time.Hour); math.Abs(score+1) > 1e-9 {
+		t.Errorf("expected the score to halve after one half-life, got %g", score)
+	}
+	if score := r.At(now.Add(-48*time.Hour), 24*time.Hour); score != -2 {
+		t.Errorf("expected no decay before the update, got %g", score)
+	}
+
+	o := &ReputationOptions{MinFactor: 0.25, MaxFactor: 2}
+	for score, factor := range map[float64]float64{-1: 0.5, -5: 0.25, 0: 1, 0.5: math.Sqrt2, 3: 2} {
+		if f := o.factor(score); math.Abs(f-factor) > 1e-9 {
+			t.Errorf("expected factor %g for score %g, got %g", factor, score, f)
+		}
+	}
+}
+
+func newReputationHistory(t *testing.T, ctx context.Context, store ReputationStore) *IPHistory {
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		Rules:           []Rule{{Window: time.Hour, MaxRequests: 4, MaxRatio: 0.5}},
+		Metrics:         NewMetrics(),
+		Reputation: &ReputationOptions{
+			Store:          store,
+			HalfLife:       7 * 24 * time.Hour,
+			Penalty:        1,
+			Reward:         1,
+			RewardInterval: 50 * time.Millisecond,
+			MinFactor:      0.25,
+			MaxFactor:      2,
+			Timeout:        time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func sendRequests(h *IPHistory, ip net.IP, n int) {
+	processed := h.Processed()
+	for i := 0; i < n; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: ip}
+	}
+	for h.Processed() < processed+uint64(n) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReputationPenalty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryReputationStore()
+	h := newReputationHistory(t, ctx, store)
+
+	repeat := net.ParseIP("192.0.2.1")
+	fresh := net.ParseIP("192.0.2.2")
+
+	if !h.Block(repeat, "login") {
+		t.Fatal("expected the IP to be blacklisted")
+	}
+	h.TriggerCalculate()
+	if r, _ := store.Fetch(ctx, []string{"192.0.2.1"}); r["192.0.2.1"].Score != -1 {
+		t.Fatalf("expected a penalty of 1, got %+v", r)
+	}
+	if h.reputationChanges.Values()["penalty"] != 1 {
+		t.Errorf("expected one penalty, got %v", h.reputationChanges.Values())
+	}
+	h.Blacklist().Remove(repeat)
+
+	// the thresholds of the repeat offender are halved
+	sendRequests(h, repeat, 3)
+	sendRequests(h, fresh, 3)
+	h.TriggerCalculate()
+
+	if !h.IsBlacklisted(repeat) {
+		t.Error("expected the repeat offender to be blacklisted with lowered thresholds")
+	}
+	if h.IsBlacklisted(fresh) {
+		t.Error("expected the fresh IP not to be blacklisted")
+	}
+}
+
+func TestReputationPenaltyOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryReputationStore()
+	h := newReputationHistory(t, ctx, store)
+
+	// the IP stays above the rule while it is blacklisted
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 10; i++ {
+		sendRequests(h, ip, 10)
+		h.TriggerCalculate()
+	}
+
+	r, _ := store.Fetch(ctx, []string{"192.0.2.1"})
+	if score := r["192.0.2.1"].Score; math.Abs(score+1) > 1e-6 {
+		t.Errorf("expected one blacklisting to cost the penalty of 1, got a score of %g", score)
+	}
+	if penalties := h.reputationChanges.Values()["penalty"]; penalties != 1 {
+		t.Errorf("expected one penalty, got %v", penalties)
+	}
+}
+
+func TestReputationReward(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryReputationStore()
+	h := newReputationHistory(t, ctx, store)
+
+	regular := net.ParseIP("192.0.2.1")
+	sendRequests(h, regular, 2)
+	h.TriggerCalculate()
+	if r, _ := store.Fetch(ctx, []string{"192.0.2.1"}); r["192.0.2.1"].Score != 0 {
+		t.Fatalf("expected no reward before a whole interval, got %+v", r)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	sendRequests(h, regular, 1)
+	h.TriggerCalculate()
+	if r, _ := store.Fetch(ctx, []string{"192.0.2.1"}); r["192.0.2.1"].Score != 1 {
+		t.Fatalf("expected a reward of 1, got %+v", r)
+	}
+
+	// 6 app requests exceed 4, but not the doubled threshold
+	sendRequests(h, regular, 3)
+	h.TriggerCalculate()
+	if h.IsBlacklisted(regular) {
+		t.Error("expected the well-behaved IP to get raised thresholds")
+	}
+
+	// the state carries the reputations to a new history
+	var buf bytes.Buffer
+	if err := h.WriteState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryReputationStore()
+	if err := newReputationHistory(t, ctx, restored).ReadState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := restored.Fetch(ctx, []string{"192.0.2.1"}); r["192.0.2.1"].Score != 1 {
+		t.Errorf("expected the reputation to be restored, got %+v", r)
+	}
+}
+
+type failingReputationStore struct{}
+
+func (failingReputationStore) Fetch(context.Context, []string) (map[string]Reputation, error) {
+	return nil, errors.New("unavailable")
+}
+
+func (failingReputationStore) Update(context.Context, map[string]Reputation) error {
+	return errors.New("unavailable")
+}
+
+func TestReputationStoreFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var failures []error
+	h := newReputationHistory(t, ctx, failingReputationStore{})
+	h.UpdateOptions(func(o *IPHistoryOptions) {
+		reputation := *o.Reputation
+		reputation.OnError = func(err error) { failures = append(failures, err) }
+		o.Reputation = &reputation
+	})
+
+	ip := net.ParseIP("192.0.2.1")
+	sendRequests(h, ip, 5)
+	h.TriggerCalculate()
+
+	if !h.IsBlacklisted(ip) {
+		t.Error("expected the rules to be evaluated without reputations")
+	}
+	if len(failures) == 0 || !errors.Is(failures[0], ErrStoreUnavailable) {
+		t.Errorf("expected store errors, got %v", failures)
+	}
+}
+
+func TestReputationValidate(t *testing.T) {
+	o := &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Interval:       time.Minute,
+		ExpireInterval: time.Minute,
+		BlacklistTTL:   time.Minute,
+		Window:         time.Hour,
+		Reputation:     &ReputationOptions{MinFactor: 2, MaxFactor: 0.5, Penalty: -1},
+	}
+	if err := o.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error, got %v", err)
+	}
+}
+
+func TestReputationUpdateOptionsDuringExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newReputationHistory(t, ctx, NewMemoryReputationStore())
+	reputation := h.opts().Reputation
+	sendRequests(h, net.ParseIP("192.0.2.1"), 5)
+
+	// turning the reputations and the compaction on and off while the
+	// history expires must neither race nor see half of the options
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			err := h.UpdateOptions(func(o *IPHistoryOptions) {
+				if o.Reputation == nil {
+					o.Reputation = reputation
+					o.CompactAge, o.CompactSlot = 10*time.Minute, 5*time.Minute
+				} else {
+					o.Reputation = nil
+					o.CompactAge, o.CompactSlot = 0, 0
+				}
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			h.expireOnce()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package botdetect
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule blacklists an IP if it exceeds MaxRequests app requests with a
+// total/app ratio above MaxRatio within Window. IPs exceeding WarnRequests
+// and WarnRatio only cause a warning; the warn tier is disabled if
+// WarnRequests is zero. The RuleAction sets how long and how severely IPs
+// are blacklisted.
+type Rule struct {
+	Window       time.Duration
+	MaxRequests  uint64
+	MaxRatio     float64
+	WarnRequests uint64
+	WarnRatio    float64
+
+	RuleAction
+}
+
+// String returns the rule in the format understood by ParseRules
+func (r Rule) String() string {
+	s := fmt.Sprintf("%s:%d:%s", r.Window, r.MaxRequests, strconv.FormatFloat(r.MaxRatio, 'f', -1, 64))
+	if r.WarnRequests > 0 {
+		s += fmt.Sprintf(":%d:%s", r.WarnRequests, strconv.FormatFloat(r.WarnRatio, 'f', -1, 64))
+	}
+	return s + r.RuleAction.String()
+}
+
+// matches determines whether the request counts violate the rule
+func (r Rule) matches(total, app uint64) bool {
+	return app > r.MaxRequests && float64(total)/float64(app) > r.MaxRatio
+}
+
+// warns determines whether the request counts exceed the warn tier
+func (r Rule) warns(total, app uint64) bool {
+	return r.WarnRequests > 0 && app > r.WarnRequests && float64(total)/float64(app) > r.WarnRatio
+}
+
+// ParseRules parses a comma separated list of rules in the form
+// window:max-requests:max-ratio[:warn-requests[:warn-ratio]], e.g.
+// "1m:20:0.9,1h:300:0.85:200". The warn ratio defaults to the max ratio. A
+// rule may end in the options ttl and severity, e.g. "1m:20:0.9;ttl=30m" or
+// "1h:300:0.85;ttl=24h;severity=challenge".
+func ParseRules(s string) ([]Rule, error) {
+	rules := []Rule{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		base, action, err := parseRuleAction(def)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Split(base, ":")
+		if len(fields) < 3 || len(fields) > 5 {
+			return nil, configErrorf("invalid rule '%s': expected window:max-requests:max-ratio[:warn-requests[:warn-ratio]]", def)
+		}
+
+		window, err := time.ParseDuration(fields[0])
+		if err != nil || window <= 0 {
+			return nil, configErrorf("invalid window in rule '%s'", def)
+		}
+
+		maxRequests, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, configErrorf("invalid max-requests in rule '%s': %s", def, err)
+		}
+
+		maxRatio, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, configErrorf("invalid max-ratio in rule '%s': %s", def, err)
+		}
+
+		rule := Rule{
+			Window:      window,
+			MaxRequests: maxRequests,
+			MaxRatio:    maxRatio,
+			RuleAction:  action,
+		}
+
+		if len(fields) > 3 {
+			if rule.WarnRequests, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+				return nil, configErrorf("invalid warn-requests in rule '%s': %s", def, err)
+			}
+			rule.WarnRatio = maxRatio
+			if len(fields) > 4 {
+				if rule.WarnRatio, err = strconv.ParseFloat(fields[4], 64); err != nil {
+					return nil, configErrorf("invalid warn-ratio in rule '%s': %s", def, err)
+				}
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ReadRules reads rules from r, one or more per line in the format of
+// ParseRules. Empty lines and lines starting with '#' are ignored.
+func ReadRules(r io.Reader) ([]Rule, error) {
+	rules := []Rule{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := ParseRules(line)
+		if err != nil {
+			return nil, configErrorf("line %d: %w", lineNo, err)
+		}
+		rules = append(rules, parsed...)
+	}
+
+	return rules, scanner.Err()
+}
+
+// LoadRules reads rules from a file
+func LoadRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, configError(err)
+	}
+	defer f.Close()
+
+	rules, err := ReadRules(f)
+	if err != nil {
+		return nil, configErrorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,65 @@
+package botdetect
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("1m:20:0.9, 1h:300:0.85, 1h:300:0.85:200, 1h:300:0.85:200:0.5")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []Rule{
+		{Window: time.Minute, MaxRequests: 20, MaxRatio: 0.9},
+		{Window: time.Hour, MaxRequests: 300, MaxRatio: 0.85},
+		{Window: time.Hour, MaxRequests: 300, MaxRatio: 0.85, WarnRequests: 200, WarnRatio: 0.85},
+		{Window: time.Hour, MaxRequests: 300, MaxRatio: 0.85, WarnRequests: 200, WarnRatio: 0.5},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("rule %d: expected %s, got %s", i, expected[i], rules[i])
+		}
+	}
+
+	for _, invalid := range []string{"1m:20", "x:20:0.9", "1m:-1:0.9", "1m:20:y", "0s:20:0.9", "1m:20:0.9:x", "1m:20:0.9:10:y", "1m:20:0.9:10:0.5:1"} {
+		if _, err := ParseRules(invalid); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+
+	if rules, err := ParseRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("expected no rules and no error for an empty string, got %v, %v", rules, err)
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	for _, def := range []string{"1m0s:20:0.9", "1h0m0s:300:0.85:200:0.5"} {
+		rules, err := ParseRules(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rules[0].String() != def {
+			t.Errorf("expected %s, got %s", def, rules[0])
+		}
+	}
+}
+
+func TestReadRules(t *testing.T) {
+	rules, err := ReadRules(strings.NewReader("# bursts\n1m:20:0.9\n\n1h:300:0.85, 24h:1000:0.85\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("expected 3 rules, got %d", len(rules))
+	}
+
+	if _, err := ReadRules(strings.NewReader("1m:20:0.9\nbogus\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+}
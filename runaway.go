@@ -0,0 +1,214 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// RunawayOptions guard against a misconfigured rule taking the site down. A
+// rule that blacklists more than Percent of the distinct client IPs seen
+// within Interval is disabled until it is enabled again with EnableRule, and
+// the IPs it blacklisted within the interval are taken off the blacklist.
+// The rules the history evaluates itself are guarded, IPs blocked with Block
+// aren't. Every instance counts the clients whose requests it evaluates.
+type RunawayOptions struct {
+	// Percent is the share of the client IPs a single rule may blacklist
+	// within an interval
+	Percent float64
+
+	// Interval is the time over which client IPs and blacklisted IPs are
+	// counted
+	Interval time.Duration
+
+	// MinClients is the number of client IPs an interval needs before a
+	// rule is disabled, so that a few scrapers in a quiet hour don't
+	// disable the rule catching them
+	MinClients int
+
+	// OnDisable is called when a rule has been disabled
+	OnDisable func(d DisabledRule)
+}
+
+func (o *RunawayOptions) validate() []string {
+	problems := []string{}
+	if o.Percent <= 0 || o.Percent > 100 {
+		problems = append(problems, "runaway percent must be within (0, 100]")
+	}
+	if o.Interval <= 0 {
+		problems = append(problems, "runaway interval must be greater than zero")
+	}
+	if o.MinClients < 0 {
+		problems = append(problems, "runaway min clients must not be negative")
+	}
+	return problems
+}
+
+// DisabledRule is a rule that has been disabled for blacklisting too many of
+// the client IPs, see RunawayOptions
+type DisabledRule struct {
+	// Rule is the reason the rule blacklists IPs for, e.g. "rule 1m:100:0.1"
+	// or "walk"
+	Rule     string    `json:"rule"`
+	Disabled time.Time `json:"disabled"`
+
+	// Blocked is the number of client IPs the rule blacklisted within the
+	// interval, Clients the number of client IPs seen
+	Blocked int `json:"blocked"`
+	Clients int `json:"clients"`
+
+	// Lifted is the number of IPs taken off the blacklist
+	Lifted int `json:"lifted"`
+}
+
+// String describes why the rule has been disabled
+func (d DisabledRule) String() string {
+	return fmt.Sprintf("%s blacklisted %d of %d client IPs", d.Rule, d.Blocked, d.Clients)
+}
+
+// runawayState counts the client IPs and the IPs blacklisted per rule within
+// the current interval. It is guarded by the history's mutex.
+type runawayState struct {
+	start    time.Time
+	clients  map[string]bool
+	blocked  map[string]map[string]bool
+	disabled map[string]DisabledRule
+}
+
+func newRunawayState() runawayState {
+	return runawayState{
+		start:    time.Now(),
+		clients:  make(map[string]bool),
+		blocked:  make(map[string]map[string]bool),
+		disabled: make(map[string]DisabledRule),
+	}
+}
+
+// blockRule is blockWith for the rules the history evaluates itself, which
+// don't blacklist while they are disabled. h.mutex must be held.
+func (h *IPHistory) blockRule(ip net.IP, reason, detail string, action RuleAction, values *AuditValues) bool {
+	if _, disabled := h.runaway.disabled[reason]; disabled {
+		// record every IP only once per blacklist TTL
+		key := ipKey(ip) + " disabled"
+		if until, ok := h.warned[key]; !ok || !time.Now().Before(until) {
+			h.warned[key] = time.Now().Add(h.opts().BlacklistTTL)
+			h.disabledSkipped.Inc()
+			h.opts().Audit.Record(ip, AuditEntry{
+				Decision: "rule disabled",
+				Reason:   detail,
+			})
+		}
+		return false
+	}
+
+	if !h.blockWith(ip, reason, detail, action, values) {
+		return false
+	}
+	if reason != "greylist" {
+		h.greylistBlacklisted(ip)
+	}
+	if h.opts().Runaway != nil {
+		ips, ok := h.runaway.blocked[reason]
+		if !ok {
+			ips = make(map[string]bool)
+			h.runaway.blocked[reason] = ips
+		}
+		ips[ipKey(ip)] = true
+	}
+	return true
+}
+
+// countClients adds the IPs to the client IPs of the interval. h.mutex must
+// be held.
+func (h *IPHistory) countClients(ips map[string]bool) {
+	if h.opts().Runaway == nil {
+		return
+	}
+	for ip := range ips {
+		h.runaway.clients[ip] = true
+	}
+}
+
+// checkRunaway disables the rules that blacklisted too many of the client
+// IPs and starts a new interval when the current one is over
+func (h *IPHistory) checkRunaway(now time.Time) {
+	o := h.opts().Runaway
+	if o == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	r := &h.runaway
+	clients := len(r.clients)
+	disabled := []DisabledRule{}
+	for rule, ips := range r.blocked {
+		if clients == 0 || clients < o.MinClients {
+			break
+		}
+		blocked := 0
+		for ip := range ips {
+			if r.clients[ip] {
+				blocked++
+			}
+		}
+		if float64(blocked)*100 <= o.Percent*float64(clients) {
+			continue
+		}
+
+		d := DisabledRule{Rule: rule, Disabled: now, Blocked: blocked, Clients: clients}
+		for ip := range ips {
+			parsed := net.ParseIP(ip)
+			if reason, ok := h.blacklist.Reason(parsed); !ok || reason != rule {
+				continue
+			}
+			h.blacklist.Remove(parsed)
+			d.Lifted++
+			h.opts().Audit.Record(parsed, AuditEntry{
+				Decision: "rule disabled",
+				Reason:   d.String(),
+			})
+		}
+		r.disabled[rule] = d
+		delete(r.blocked, rule)
+		disabled = append(disabled, d)
+	}
+	if now.Sub(r.start) >= o.Interval {
+		r.start = now
+		r.clients = make(map[string]bool)
+		r.blocked = make(map[string]map[string]bool)
+	}
+	h.mutex.Unlock()
+
+	for _, d := range disabled {
+		h.rulesDisabled.Inc(d.Rule)
+		if o.OnDisable != nil {
+			o.OnDisable(d)
+		}
+	}
+}
+
+// DisabledRules returns the rules that have been disabled for blacklisting
+// too many of the client IPs, sorted by rule
+func (h *IPHistory) DisabledRules() []DisabledRule {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	rules := make([]DisabledRule, 0, len(h.runaway.disabled))
+	for _, d := range h.runaway.disabled {
+		rules = append(rules, d)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Rule < rules[j].Rule })
+	return rules
+}
+
+// EnableRule enables a rule that has been disabled, e.g. after it has been
+// fixed, and returns whether it had been disabled
+func (h *IPHistory) EnableRule(rule string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, ok := h.runaway.disabled[rule]
+	delete(h.runaway.disabled, rule)
+	return ok
+}
@@ -0,0 +1,115 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRunaway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	disabled := make(chan DisabledRule, 1)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     5,
+		Metrics:         NewMetrics(),
+		Runaway: &RunawayOptions{
+			Percent:    40,
+			Interval:   time.Hour,
+			MinClients: 5,
+			OnDisable:  func(d DisabledRule) { disabled <- d },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed := uint64(0)
+	send := func(ip net.IP, n int) {
+		for i := 0; i < n; i++ {
+			h.RequestChannel() <- &Request{IP: ip, URL: "/"}
+		}
+		processed += uint64(n)
+		for h.Processed() < processed {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// two of three clients match, but there are too few clients
+	send(net.IPv4(192, 0, 2, 1), 10)
+	send(net.IPv4(192, 0, 2, 2), 10)
+	send(net.IPv4(192, 0, 2, 3), 1)
+	h.TriggerCalculate()
+	if len(h.DisabledRules()) != 0 {
+		t.Fatalf("expected no rule to be disabled with 3 clients, got %v", h.DisabledRules())
+	}
+
+	send(net.IPv4(192, 0, 2, 4), 10)
+	send(net.IPv4(192, 0, 2, 5), 1)
+	send(net.IPv4(192, 0, 2, 6), 1)
+	h.TriggerCalculate()
+
+	rules := h.DisabledRules()
+	if len(rules) != 1 || rules[0].Rule != "rule 1h0m0s:5:0" {
+		t.Fatalf("expected the rule to be disabled, got %v", rules)
+	}
+	if rules[0].Blocked != 3 || rules[0].Clients != 6 || rules[0].Lifted != 3 {
+		t.Errorf("expected 3 of 6 clients blocked and lifted, got %+v", rules[0])
+	}
+	if d := <-disabled; d.Rule != rules[0].Rule {
+		t.Errorf("expected OnDisable to be called for %s, got %s", rules[0].Rule, d.Rule)
+	}
+	if h.IsBlacklisted(net.IPv4(192, 0, 2, 1)) {
+		t.Error("expected the blocks of the disabled rule to be lifted")
+	}
+	if n := h.rulesDisabled.Values()[rules[0].Rule]; n != 1 {
+		t.Errorf("expected the rule to be counted as disabled once, got %d", n)
+	}
+
+	// disabled rules stay disabled until enabled manually
+	send(net.IPv4(192, 0, 2, 7), 10)
+	h.TriggerCalculate()
+	if h.IsBlacklisted(net.IPv4(192, 0, 2, 7)) {
+		t.Error("expected a disabled rule not to blacklist")
+	}
+	if n := h.disabledSkipped.Values()[""]; n == 0 {
+		t.Error("expected the skipped IPs to be counted")
+	}
+
+	if !h.EnableRule(rules[0].Rule) {
+		t.Error("expected the rule to have been disabled")
+	}
+	if h.EnableRule(rules[0].Rule) {
+		t.Error("expected the rule to be enabled")
+	}
+	send(net.IPv4(192, 0, 2, 7), 1)
+	h.TriggerCalculate()
+	if !h.IsBlacklisted(net.IPv4(192, 0, 2, 7)) {
+		t.Error("expected the enabled rule to blacklist again")
+	}
+}
+
+func TestRunawayOptions(t *testing.T) {
+	for _, o := range []RunawayOptions{
+		{Percent: 0, Interval: time.Minute},
+		{Percent: 101, Interval: time.Minute},
+		{Percent: 10},
+		{Percent: 10, Interval: time.Minute, MinClients: -1},
+	} {
+		if problems := o.validate(); len(problems) == 0 {
+			t.Errorf("expected %+v to be invalid", o)
+		}
+	}
+	o := RunawayOptions{Percent: 10, Interval: time.Minute}
+	if problems := o.validate(); len(problems) != 0 {
+		t.Errorf("expected %+v to be valid, got %v", o, problems)
+	}
+}
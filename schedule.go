@@ -0,0 +1,157 @@
+package botdetect
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like expression of five fields: minute, hour, day of
+// month, month and day of week (0 is Sunday). Fields are *, numbers, ranges
+// such as 1-5 and lists thereof, each optionally with a step such as */15.
+// As with cron, if both day fields are restricted either may match.
+type Schedule struct {
+	expr   string
+	fields [5]uint64
+	days   [2]bool
+}
+
+var scheduleBounds = [5][2]int{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week
+}
+
+// ParseSchedule parses a cron-like expression, e.g. "* 0-5 * * *" for every
+// night between midnight and 6 o'clock
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, configErrorf("invalid schedule '%s': expected minute hour day-of-month month day-of-week", expr)
+	}
+
+	s := &Schedule{expr: strings.Join(fields, " ")}
+	for i, field := range fields {
+		bits, err := parseScheduleField(field, scheduleBounds[i][0], scheduleBounds[i][1])
+		if err != nil {
+			return nil, configErrorf("invalid schedule '%s': %s", expr, err)
+		}
+		s.fields[i] = bits
+	}
+	s.days = [2]bool{fields[2] != "*", fields[4] != "*"}
+
+	return s, nil
+}
+
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, configErrorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, configErrorf("invalid value '%s'", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, configErrorf("invalid value '%s'", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, configErrorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Matches determines whether the minute of t is part of the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	has := func(field, v int) bool {
+		return s.fields[field]&(1<<uint(v)) != 0
+	}
+
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	if s.days[0] && s.days[1] {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// String returns the expression of the schedule
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// ScheduledRules replace the regular rules while their schedule matches
+type ScheduledRules struct {
+	Schedule *Schedule
+	Rules    []Rule
+}
+
+// String returns the scheduled rules in the format understood by
+// ParseScheduledRules
+func (sr ScheduledRules) String() string {
+	rules := make([]string, len(sr.Rules))
+	for i, rule := range sr.Rules {
+		rules[i] = rule.String()
+	}
+	return sr.Schedule.String() + "=" + strings.Join(rules, ",")
+}
+
+// ParseScheduledRules parses a '|' separated list of schedules and rules in
+// the form schedule=rules, e.g. "* 0-5 * * *=1h:10:0.8|* 10-14 24 11 *=1h:100:0.9"
+func ParseScheduledRules(s string) ([]ScheduledRules, error) {
+	scheduled := []ScheduledRules{}
+
+	for _, def := range strings.Split(s, "|") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 {
+			return nil, configErrorf("invalid scheduled rules '%s': expected schedule=rules", def)
+		}
+
+		schedule, err := ParseSchedule(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		rules, err := ParseRules(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(rules) == 0 {
+			return nil, configErrorf("invalid scheduled rules '%s': no rules given", def)
+		}
+
+		scheduled = append(scheduled, ScheduledRules{Schedule: schedule, Rules: rules})
+	}
+
+	return scheduled, nil
+}
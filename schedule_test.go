@@ -0,0 +1,79 @@
+package botdetect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		expr    string
+		time    string
+		matches bool
+	}{
+		{"* * * * *", "2020-01-01T12:34:00Z", true},
+		{"* 0-5 * * *", "2020-01-01T03:10:00Z", true},
+		{"* 0-5 * * *", "2020-01-01T06:00:00Z", false},
+		{"*/15 * * * *", "2020-01-01T06:30:00Z", true},
+		{"*/15 * * * *", "2020-01-01T06:31:00Z", false},
+		{"0,30 9-17/2 * * 1-5", "2020-01-03T11:30:00Z", true},  // Friday
+		{"0,30 9-17/2 * * 1-5", "2020-01-04T11:30:00Z", false}, // Saturday
+		{"* * 24 11 *", "2020-11-24T10:00:00Z", true},
+		{"* * 24 11 *", "2020-11-25T10:00:00Z", false},
+		{"* * 1 * 0", "2020-01-05T10:00:00Z", true}, // a Sunday, not the 1st
+		{"* * 1 * 0", "2020-01-01T10:00:00Z", true}, // the 1st, a Wednesday
+		{"* * 1 * 0", "2020-01-02T10:00:00Z", false},
+	}
+
+	for _, test := range tests {
+		s, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.expr, err)
+		}
+		tm, _ := time.Parse(time.RFC3339, test.time)
+		if s.Matches(tm) != test.matches {
+			t.Errorf("%s at %s: expected %v", test.expr, test.time, test.matches)
+		}
+	}
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "*/0 * * * *", "x * * * *", "* * 0 * *"} {
+		if _, err := ParseSchedule(invalid); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestParseScheduledRules(t *testing.T) {
+	scheduled, err := ParseScheduledRules("* 0-5 * * *=1h:10:0.8 | * 10-14 24 11 *=1h:100:0.9,1m:20:0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 2 || len(scheduled[1].Rules) != 2 {
+		t.Fatalf("unexpected scheduled rules %v", scheduled)
+	}
+	if scheduled[0].String() != "* 0-5 * * *=1h0m0s:10:0.8" {
+		t.Errorf("unexpected string %s", scheduled[0])
+	}
+
+	for _, invalid := range []string{"* * * * *", "* * * *=1h:10:0.8", "* * * * *=", "* * * * *=x"} {
+		if _, err := ParseScheduledRules(invalid); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestRulesAt(t *testing.T) {
+	night, _ := ParseSchedule("* 0-5 * * *")
+	h := &IPHistory{options: &IPHistoryOptions{
+		Window:      time.Hour,
+		MaxRequests: 30,
+		Schedules:   []ScheduledRules{{Schedule: night, Rules: []Rule{{Window: time.Hour, MaxRequests: 5}}}},
+	}}
+
+	if rules := h.rulesAt(time.Date(2020, 1, 1, 3, 0, 0, 0, time.Local)); len(rules) != 1 || rules[0].MaxRequests != 5 {
+		t.Errorf("expected the night rules, got %v", rules)
+	}
+	if rules := h.rulesAt(time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)); len(rules) != 1 || rules[0].MaxRequests != 30 {
+		t.Errorf("expected the regular rules, got %v", rules)
+	}
+}
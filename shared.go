@@ -0,0 +1,209 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// BlacklistStore shares the blacklists of several replicas, e.g. in Redis,
+// so that an IP blacklisted by one of them is blocked by all. Entries expire
+// in the store when they do on the blacklist that added them.
+type BlacklistStore interface {
+	// Add adds the entries, replacing those of the same IPs
+	Add(ctx context.Context, entries []BlacklistEntry) error
+
+	// Remove removes the IPs
+	Remove(ctx context.Context, ips []net.IP) error
+
+	// Lookup returns the entry of the IP and whether it is in the store
+	Lookup(ctx context.Context, ip net.IP) (BlacklistEntry, bool, error)
+}
+
+// SharedBlacklistOptions configure the sharing of a blacklist, see
+// Blacklist.Share
+type SharedBlacklistOptions struct {
+	Store BlacklistStore
+
+	// Timeout limits each exchange with the store. A lookup that fails
+	// treats the IP as not blacklisted.
+	Timeout time.Duration
+
+	// OnError is called when the store fails if set. Every IP that isn't
+	// on the local blacklist is looked up, so while the store is down it
+	// may be called for every request.
+	OnError func(err error)
+}
+
+// sharedBatch is the number of changes passed to the store at once
+const sharedBatch = 256
+
+// Share adds the entries of the blacklist to the store and every entry added
+// or taken off with Remove from then on, until the context is done. IPs that
+// aren't on the blacklist are looked up in the store, so that IPs
+// blacklisted by other replicas are blocked as well; SnapshotList, ForEach
+// and Size only cover the local entries. Expiries and evictions aren't
+// passed on: the entries expire in the store by themselves and evictions
+// only make room locally. It returns right away if the options are invalid.
+func (bl *Blacklist) Share(ctx context.Context, o *SharedBlacklistOptions) error {
+	if o == nil || o.Store == nil || o.Timeout <= 0 {
+		return configErrorf("sharing a blacklist requires a store and a timeout greater than zero")
+	}
+	bl.shared.Store(o)
+	defer bl.shared.Store((*SharedBlacklistOptions)(nil))
+
+	for {
+		entries, events, cancel := bl.Subscribe(sharedBatch * 4)
+		bl.storeShared(o, entries, nil)
+
+		if !bl.followShared(ctx, o, events) {
+			cancel()
+			return nil
+		}
+		// fell behind, subscribe again for a consistent copy
+	}
+}
+
+// followShared passes the events on to the store until the channel is closed
+// or the context is done, which it returns false for
+func (bl *Blacklist) followShared(ctx context.Context, o *SharedBlacklistOptions, events <-chan BlacklistEvent) bool {
+	for {
+		var added []BlacklistEntry
+		var removed []net.IP
+		collect := func(ev BlacklistEvent) {
+			switch {
+			case ev.Type == BlacklistAdd:
+				added = append(added, BlacklistEntry{IP: ev.IP, Expires: ev.Expires, Reason: ev.Reason, Severity: ev.Severity})
+			case ev.Type == BlacklistRemove && ev.Cause == "removed":
+				removed = append(removed, ev.IP)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case ev, ok := <-events:
+			if !ok {
+				return true
+			}
+			collect(ev)
+		}
+
+		// pass on whatever else is waiting along with the event
+	drain:
+		for len(added)+len(removed) < sharedBatch {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					bl.storeShared(o, added, removed)
+					return true
+				}
+				collect(ev)
+			default:
+				break drain
+			}
+		}
+		bl.storeShared(o, added, removed)
+	}
+}
+
+// storeShared adds and removes the entries in the store
+func (bl *Blacklist) storeShared(o *SharedBlacklistOptions, added []BlacklistEntry, removed []net.IP) {
+	ctx, cancel := context.WithTimeout(bl.ctx, o.Timeout)
+	defer cancel()
+
+	for len(added) > 0 {
+		n := len(added)
+		if n > sharedBatch {
+			n = sharedBatch
+		}
+		if err := o.Store.Add(ctx, added[:n]); err != nil {
+			sharedError(o, err)
+			break
+		}
+		added = added[n:]
+	}
+	if len(removed) > 0 {
+		if err := o.Store.Remove(ctx, removed); err != nil {
+			sharedError(o, err)
+		}
+	}
+}
+
+// lookupShared looks the IP up in the store the blacklist is shared with,
+// if any
+func (bl *Blacklist) lookupShared(addr netip.Addr) (BlacklistEntry, bool) {
+	o, _ := bl.shared.Load().(*SharedBlacklistOptions)
+	if o == nil {
+		return BlacklistEntry{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(bl.ctx, o.Timeout)
+	defer cancel()
+
+	entry, ok, err := o.Store.Lookup(ctx, net.IP(addr.AsSlice()))
+	if err != nil {
+		sharedError(o, err)
+		return BlacklistEntry{}, false
+	}
+	if !ok || !entry.Expires.After(time.Now()) {
+		return BlacklistEntry{}, false
+	}
+	return entry, true
+}
+
+func sharedError(o *SharedBlacklistOptions, err error) {
+	if o.OnError != nil {
+		o.OnError(storeError(err))
+	}
+}
+
+// MemoryBlacklistStore is a BlacklistStore for replicas within one process
+// and a reference for implementations backed by shared storage
+type MemoryBlacklistStore struct {
+	entries map[string]BlacklistEntry
+	mutex   sync.Mutex
+}
+
+// NewMemoryBlacklistStore creates an empty MemoryBlacklistStore
+func NewMemoryBlacklistStore() *MemoryBlacklistStore {
+	return &MemoryBlacklistStore{entries: make(map[string]BlacklistEntry)}
+}
+
+// Add adds the entries, replacing those of the same IPs
+func (s *MemoryBlacklistStore) Add(ctx context.Context, entries []BlacklistEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range entries {
+		s.entries[ipKey(e.IP)] = e
+	}
+	return nil
+}
+
+// Remove removes the IPs
+func (s *MemoryBlacklistStore) Remove(ctx context.Context, ips []net.IP) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, ip := range ips {
+		delete(s.entries, ipKey(ip))
+	}
+	return nil
+}
+
+// Lookup returns the entry of the IP unless it has expired
+func (s *MemoryBlacklistStore) Lookup(ctx context.Context, ip net.IP) (BlacklistEntry, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := ipKey(ip)
+	e, ok := s.entries[key]
+	if ok && !e.Expires.After(time.Now()) {
+		delete(s.entries, key)
+		return BlacklistEntry{}, false, nil
+	}
+	return e, ok, nil
+}
@@ -0,0 +1,129 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlacklistShare(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryBlacklistStore()
+	a := NewBlacklist(ctx, time.Hour, time.Hour)
+	b := NewBlacklist(ctx, time.Hour, time.Hour)
+
+	before, after := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	a.SetReason(before, "before")
+
+	for _, bl := range []*Blacklist{a, b} {
+		go bl.Share(ctx, &SharedBlacklistOptions{Store: store, Timeout: time.Second})
+	}
+	waitFor(t, func() bool { return b.IsBlacklisted(before) })
+
+	a.SetAction(after, "after", RuleAction{Severity: SeverityChallenge})
+	waitFor(t, func() bool { return b.IsBlacklisted(after) })
+	if entry, ok := b.Entry(after); !ok || entry.Reason != "after" || entry.Severity != SeverityChallenge {
+		t.Errorf("unexpected shared entry %+v", entry)
+	}
+
+	// the IPs of other replicas aren't copied
+	if b.Size() != 0 {
+		t.Errorf("expected the shared entries not to be local, got %d", b.Size())
+	}
+
+	a.Remove(before)
+	waitFor(t, func() bool { return !b.IsBlacklisted(before) })
+	if !a.IsBlacklisted(after) || !b.IsBlacklisted(after) {
+		t.Errorf("expected the other IP to stay blacklisted")
+	}
+}
+
+func TestBlacklistShareOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	if err := bl.Share(ctx, &SharedBlacklistOptions{Store: NewMemoryBlacklistStore()}); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error without a timeout, got %v", err)
+	}
+}
+
+type failingBlacklistStore struct{}
+
+func (failingBlacklistStore) Add(context.Context, []BlacklistEntry) error {
+	return errors.New("down")
+}
+
+func (failingBlacklistStore) Remove(context.Context, []net.IP) error {
+	return errors.New("down")
+}
+
+func (failingBlacklistStore) Lookup(context.Context, net.IP) (BlacklistEntry, bool, error) {
+	return BlacklistEntry{}, false, errors.New("down")
+}
+
+func TestBlacklistShareFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 10)
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	go bl.Share(ctx, &SharedBlacklistOptions{
+		Store:   failingBlacklistStore{},
+		Timeout: time.Second,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	waitFor(t, func() bool {
+		o, _ := bl.shared.Load().(*SharedBlacklistOptions)
+		return o != nil
+	})
+
+	// a failing store leaves the local blacklist alone
+	ip := net.ParseIP("192.0.2.1")
+	if bl.IsBlacklisted(ip) {
+		t.Error("expected the IP not to be blacklisted")
+	}
+	if err := <-errs; !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected the store to be unavailable, got %v", err)
+	}
+	bl.Set(ip)
+	if !bl.IsBlacklisted(ip) {
+		t.Error("expected the IP to be blacklisted")
+	}
+}
+
+func TestRedisSharedBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := newFakeRedis(t, newFakeRedisData())
+	client := newTestRedisClient(t, RedisOptions{Addrs: []string{server.addr()}})
+
+	a := NewBlacklist(ctx, time.Hour, time.Hour)
+	b := NewBlacklist(ctx, time.Hour, time.Hour)
+	for _, bl := range []*Blacklist{a, b} {
+		store := NewRedisStore(client, "bd:", time.Hour)
+		go store.Cache(ctx, 100, 10*time.Millisecond, nil)
+		go bl.Share(ctx, &SharedBlacklistOptions{Store: store, Timeout: time.Second})
+	}
+	waitFor(t, func() bool { return server.trackers() == 2 })
+
+	ip := net.ParseIP("192.0.2.1")
+	if b.IsBlacklisted(ip) {
+		t.Fatal("expected the IP not to be blacklisted")
+	}
+	a.SetReason(ip, "max_requests")
+	waitFor(t, func() bool { return b.IsBlacklisted(ip) })
+
+	a.Remove(ip)
+	waitFor(t, func() bool { return !b.IsBlacklisted(ip) })
+}
@@ -0,0 +1,166 @@
+package botdetect
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SheddingOptions make the history degrade gracefully instead of silently
+// falling behind when it can't keep up. While any threshold is exceeded the
+// history sheds load: it samples the requests it counts, skips DNS and RDAP
+// enrichment and walk detection, and deciders drop requests rather than wait
+// for room in the queue (see DeciderOptions.FailOpen). Thresholds that are
+// zero aren't checked.
+type SheddingOptions struct {
+	// MaxQueue is the fill level of the request channel, as a fraction of
+	// its capacity
+	MaxQueue float64
+
+	// MaxLag is the delay between an event (Request.Time) and its
+	// processing
+	MaxLag time.Duration
+
+	// MaxCPU is the CPU time used by the process per second as a fraction
+	// of the CPUs it may use (GOMAXPROCS). It is ignored on platforms that
+	// don't report the CPU time of a process.
+	MaxCPU float64
+
+	// Sample is how many requests one counted request stands for while
+	// shedding: only every Sample-th request is counted, Sample times, so
+	// that the rules see about the same numbers. 1 counts every request.
+	Sample int
+
+	// Interval is the time between two checks
+	Interval time.Duration
+
+	// OnChange is called when shedding starts, with the thresholds
+	// exceeded, and when it stops
+	OnChange func(shedding bool, reason string)
+}
+
+func (o *SheddingOptions) validate(queueSize int) []string {
+	problems := []string{}
+	if o.Interval <= 0 {
+		problems = append(problems, "shedding interval must be greater than zero")
+	}
+	if o.Sample < 1 {
+		problems = append(problems, "shedding sample must be at least 1")
+	}
+	if o.MaxQueue < 0 || o.MaxLag < 0 || o.MaxCPU < 0 {
+		problems = append(problems, "shedding thresholds must not be negative")
+	}
+	if o.MaxQueue > 0 && queueSize == 0 {
+		problems = append(problems, "a maximum queue fill level for shedding requires a queue size")
+	}
+	return problems
+}
+
+// shedState is whether the history is shedding load and why
+type shedState struct {
+	active int32
+
+	// seq counts the requests seen while shedding
+	seq uint64
+
+	mutex  sync.RWMutex
+	reason string
+}
+
+// Shedding returns whether the history is shedding load and which
+// thresholds are exceeded
+func (h *IPHistory) Shedding() (bool, string) {
+	if h == nil || atomic.LoadInt32(&h.shed.active) == 0 {
+		return false, ""
+	}
+	h.shed.mutex.RLock()
+	defer h.shed.mutex.RUnlock()
+	return true, h.shed.reason
+}
+
+// shedding is the fast check for the request path
+func (h *IPHistory) shedding() bool {
+	return atomic.LoadInt32(&h.shed.active) != 0
+}
+
+// sample returns how many requests the request stands for while shedding,
+// 0 if it isn't counted
+func (h *IPHistory) sample() uint64 {
+	o := h.opts().Shedding
+	if o == nil || o.Sample <= 1 || !h.shedding() {
+		return 1
+	}
+	if atomic.AddUint64(&h.shed.seq, 1)%uint64(o.Sample) != 0 {
+		h.shedRequests.Inc()
+		return 0
+	}
+	return uint64(o.Sample)
+}
+
+// setShedding switches shedding on if reasons isn't empty and off otherwise
+func (h *IPHistory) setShedding(o *SheddingOptions, reasons []string) {
+	active := len(reasons) > 0
+	reason := strings.Join(reasons, "; ")
+
+	h.shed.mutex.Lock()
+	h.shed.reason = reason
+	h.shed.mutex.Unlock()
+
+	var value int32
+	if active {
+		value = 1
+	}
+	if atomic.SwapInt32(&h.shed.active, value) == value {
+		return
+	}
+	if o.OnChange != nil {
+		o.OnChange(active, reason)
+	}
+}
+
+// sheddingLoop periodically compares the load to the thresholds of o
+func (h *IPHistory) sheddingLoop(o *SheddingOptions) {
+	lastCPU, cpuOK := processCPUTime()
+	lastTime := time.Now()
+
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case now := <-ticker.C:
+			cpu := 0.0
+			if t, ok := processCPUTime(); ok && cpuOK {
+				cpu = float64(t-lastCPU) / float64(now.Sub(lastTime)) / float64(runtime.GOMAXPROCS(0))
+				lastCPU = t
+			}
+			lastTime = now
+
+			h.setShedding(o, h.checkShedding(o, cpu))
+		}
+	}
+}
+
+// checkShedding returns a description of every threshold exceeded
+func (h *IPHistory) checkShedding(o *SheddingOptions, cpu float64) []string {
+	reasons := []string{}
+
+	if o.MaxQueue > 0 && h.QueueCapacity() > 0 {
+		if fill := float64(h.QueueLength()) / float64(h.QueueCapacity()); fill > o.MaxQueue {
+			reasons = append(reasons, fmt.Sprintf("request queue is %.0f%% full", fill*100))
+		}
+	}
+	if o.MaxLag > 0 && h.IngestLag() > o.MaxLag {
+		reasons = append(reasons, fmt.Sprintf("ingest lag of %s exceeds %s", h.IngestLag().Round(time.Millisecond), o.MaxLag))
+	}
+	if o.MaxCPU > 0 && cpu > o.MaxCPU {
+		reasons = append(reasons, fmt.Sprintf("CPU usage of %.1f%% exceeds %.1f%%", cpu*100, o.MaxCPU*100))
+	}
+
+	return reasons
+}
@@ -0,0 +1,113 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckShedding(t *testing.T) {
+	h := &IPHistory{reqChan: make(chan *Request, 4)}
+	h.reqChan <- &Request{}
+	h.reqChan <- &Request{}
+	h.reqChan <- &Request{}
+	h.ingest.lag = int64(10 * time.Second)
+
+	o := &SheddingOptions{MaxQueue: 0.5, MaxLag: 5 * time.Second, MaxCPU: 0.8}
+	if reasons := h.checkShedding(o, 0.9); len(reasons) != 3 {
+		t.Fatalf("expected 3 reasons, got %v", reasons)
+	}
+
+	o = &SheddingOptions{MaxQueue: 0.9, MaxLag: time.Minute, MaxCPU: 0.95}
+	if reasons := h.checkShedding(o, 0.9); len(reasons) != 0 {
+		t.Errorf("expected no reasons, got %v", reasons)
+	}
+}
+
+func TestShedding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := []bool{}
+	o := &SheddingOptions{
+		MaxLag:   time.Minute,
+		Sample:   5,
+		Interval: time.Hour,
+		OnChange: func(shedding bool, reason string) { changes = append(changes, shedding) },
+	}
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     100,
+		MaxRatio:        0.9,
+		Metrics:         NewMetrics(),
+		Shedding:        o,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	sendRequests(h, ip, 1)
+	h.RequestChannel() <- &Request{URL: "/", IP: ip, Time: time.Now().Add(-time.Hour)}
+	for h.Processed() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.setShedding(o, h.checkShedding(o, 0))
+	if shedding, reason := h.Shedding(); !shedding || !strings.Contains(reason, "lag") {
+		t.Fatalf("expected the history to shed load for the lag, got %v '%s'", shedding, reason)
+	}
+	if err := h.Ready(); err == nil || !strings.Contains(err.Error(), "shedding") {
+		t.Errorf("expected the history not to be ready, got %v", err)
+	}
+
+	// every fifth request is counted five times
+	sendRequests(h, ip, 10)
+	h.mutex.RLock()
+	total, _ := countSince(h.data[ipKey(ip)], time.Now().Add(-2*time.Hour))
+	h.mutex.RUnlock()
+	if total != 12 {
+		t.Errorf("expected 12 requests counted, got %d", total)
+	}
+	if shed := h.shedRequests.Values()[""]; shed != 8 {
+		t.Errorf("expected 8 shed requests, got %d", shed)
+	}
+
+	h.setShedding(o, nil)
+	if shedding, _ := h.Shedding(); shedding {
+		t.Error("expected shedding to stop")
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("expected shedding to start and stop once, got %v", changes)
+	}
+	if err := h.Ready(); err != nil {
+		t.Errorf("expected the history to be ready, got %v", err)
+	}
+}
+
+func TestDeciderFailOpen(t *testing.T) {
+	// nobody reads the channel, a decider waiting for room would hang
+	requests := make(chan *Request)
+	dropped := 0
+	d, err := NewDecider(requests, NewBlacklist(context.Background(), time.Hour, time.Hour), &DeciderOptions{
+		FailOpen: func() bool { return true },
+		OnDrop:   func(req *Request) { dropped++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision := d.Check("192.0.2.1", "198.51.100.1"); decision.Blocked {
+		t.Errorf("expected the request to be allowed, got %+v", decision)
+	}
+	if dropped != 2 {
+		t.Errorf("expected 2 dropped requests, got %d", dropped)
+	}
+}
@@ -0,0 +1,357 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DecisionEvent is a request together with the decision made on it
+type DecisionEvent struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	XFF       string    `json:"xff,omitempty"`
+	URL       string    `json:"url"`
+
+	// IPs are the public IPs the request came from, IP the one that caused
+	// the block
+	IPs []string `json:"ips,omitempty"`
+	IP  string   `json:"ip,omitempty"`
+
+	// Answer is the answer given, e.g. OK, BLOCK or CHALLENGE
+	Answer  string `json:"answer"`
+	Blocked bool   `json:"blocked"`
+
+	// Reasons are the reasons given for the IPs of the request, e.g. why an
+	// IP is whitelisted or by which rule it is blacklisted
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// NewDecisionEvent creates the event of the decision on the input
+func NewDecisionEvent(in *Input, d Decision, answer string, reasons []string) DecisionEvent {
+	e := DecisionEvent{
+		Time:    time.Now(),
+		Remote:  in.Remote,
+		XFF:     in.XFF,
+		URL:     in.URL,
+		Answer:  answer,
+		Blocked: d.Blocked,
+		Reasons: reasons,
+	}
+	for _, ip := range d.IPs {
+		e.IPs = append(e.IPs, ip.String())
+	}
+	if d.IP != nil {
+		e.IP = d.IP.String()
+	}
+	return e
+}
+
+// Sink receives decision events, e.g. to pass them on to enforcement points
+// or to an observability pipeline. Write is called with batches of events by
+// a single goroutine.
+type Sink interface {
+	Write(ctx context.Context, events []DecisionEvent) error
+	Close() error
+}
+
+// Defaults of SinkOptions
+const (
+	DefaultSinkBuffer        = 10000
+	DefaultSinkBatch         = 100
+	DefaultSinkFlushInterval = time.Second
+	DefaultSinkTimeout       = 10 * time.Second
+)
+
+// SinkOptions configure how events are buffered for a sink
+type SinkOptions struct {
+	// Name identifies the sink in the metrics and errors
+	Name string
+
+	// Buffer is the number of events held for the sink. Events that don't
+	// fit are dropped.
+	Buffer int
+
+	// Batch is the maximum number of events passed to a single Write,
+	// FlushInterval the longest an event waits for its batch to fill up
+	Batch         int
+	FlushInterval time.Duration
+
+	// Timeout limits every Write
+	Timeout time.Duration
+
+	// OnError is called when a Write failed. The events are not retried.
+	OnError func(sink string, err error)
+}
+
+// DecisionSinks passes every decision event to all sinks. Every sink has its
+// own buffer and goroutine, so a slow or failing sink neither delays the
+// decisions nor the other sinks.
+type DecisionSinks struct {
+	workers []*sinkWorker
+	events  *CounterVec
+	closed  bool
+	mutex   sync.RWMutex
+}
+
+type sinkWorker struct {
+	sink    Sink
+	options SinkOptions
+	events  chan DecisionEvent
+	done    chan struct{}
+}
+
+// NewDecisionSinks creates a DecisionSinks without any sinks
+func NewDecisionSinks(metrics *Metrics) *DecisionSinks {
+	return &DecisionSinks{
+		events: metrics.Counter("botdetect_sink_events_total",
+			"Decision events per sink and outcome: written, failed or dropped", "sink", "outcome"),
+	}
+}
+
+// Add starts passing events to the sink
+func (s *DecisionSinks) Add(sink Sink, options SinkOptions) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if options.Name == "" {
+		options.Name = fmt.Sprintf("sink%d", len(s.workers))
+	}
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultSinkBuffer
+	}
+	if options.Batch <= 0 {
+		options.Batch = DefaultSinkBatch
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultSinkFlushInterval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultSinkTimeout
+	}
+	w := &sinkWorker{
+		sink:    sink,
+		options: options,
+		events:  make(chan DecisionEvent, options.Buffer),
+		done:    make(chan struct{}),
+	}
+	s.workers = append(s.workers, w)
+	go w.run(s.events)
+}
+
+// Send passes the event to all sinks without blocking
+func (s *DecisionSinks) Send(e DecisionEvent) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return
+	}
+	for _, w := range s.workers {
+		select {
+		case w.events <- e:
+		default:
+			s.events.Inc(w.options.Name, "dropped")
+		}
+	}
+}
+
+// Close writes the buffered events and closes all sinks
+func (s *DecisionSinks) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, w := range s.workers {
+		close(w.events)
+	}
+	s.mutex.Unlock()
+
+	var first error
+	for _, w := range s.workers {
+		<-w.done
+		if err := w.sink.Close(); err != nil && first == nil {
+			first = fmt.Errorf("closing %s: %s", w.options.Name, err)
+		}
+	}
+	return first
+}
+
+func (w *sinkWorker) run(counts *CounterVec) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]DecisionEvent, 0, w.options.Batch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), w.options.Timeout)
+		err := w.sink.Write(ctx, batch)
+		cancel()
+		if err != nil {
+			counts.Add(uint64(len(batch)), w.options.Name, "failed")
+			if w.options.OnError != nil {
+				w.options.OnError(w.options.Name, err)
+			}
+		} else {
+			counts.Add(uint64(len(batch)), w.options.Name, "written")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= w.options.Batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// WriterSink writes the events as JSON lines
+type WriterSink struct {
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewWriterSink creates a WriterSink writing to w, e.g. os.Stdout. Closing
+// the sink doesn't close w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewFileSink creates a WriterSink appending to the file, which is created
+// if it doesn't exist
+func NewFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterSink{w: f, closer: f}, nil
+}
+
+// Write writes the events, one per line
+func (s *WriterSink) Write(ctx context.Context, events []DecisionEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the file of a file sink
+func (s *WriterSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// WebhookSink posts every batch of events as a JSON array to a URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookSink creates a WebhookSink posting to url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: http.DefaultClient}
+}
+
+// Write posts the events
+func (s *WebhookSink) Write(ctx context.Context, events []DecisionEvent) error {
+	return postSink(ctx, s.Client, s.URL, "application/json", events)
+}
+
+// Close does nothing
+func (s *WebhookSink) Close() error {
+	return nil
+}
+
+// KafkaSink produces the events to a Kafka topic through the v2 API of a
+// Kafka REST proxy, such as Confluent's, so that no Kafka client is needed.
+// Every event is a JSON record without a key.
+type KafkaSink struct {
+	// URL is the topic's URL, e.g. http://rest-proxy:8082/topics/decisions
+	URL    string
+	Client *http.Client
+}
+
+// NewKafkaSink creates a KafkaSink producing to the topic's URL
+func NewKafkaSink(url string) *KafkaSink {
+	return &KafkaSink{URL: url, Client: http.DefaultClient}
+}
+
+type kafkaRecord struct {
+	Value DecisionEvent `json:"value"`
+}
+
+// Write produces the events
+func (s *KafkaSink) Write(ctx context.Context, events []DecisionEvent) error {
+	records := make([]kafkaRecord, len(events))
+	for i, e := range events {
+		records[i].Value = e
+	}
+	return postSink(ctx, s.Client, s.URL, "application/vnd.kafka.json.v2+json",
+		map[string]interface{}{"records": records})
+}
+
+// Close does nothing
+func (s *KafkaSink) Close() error {
+	return nil
+}
+
+func postSink(ctx context.Context, client *http.Client, url, contentType string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package botdetect
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	events  []DecisionEvent
+	batches int
+	closed  bool
+	block   chan struct{}
+	err     error
+	mutex   sync.Mutex
+}
+
+func (s *recordingSink) Write(ctx context.Context, events []DecisionEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, events...)
+	s.batches++
+	return s.err
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestDecisionSinks(t *testing.T) {
+	sinks := NewDecisionSinks(NewMetrics())
+	fast := &recordingSink{}
+	slow := &recordingSink{block: make(chan struct{})}
+	failed := make(chan error, 10)
+	failing := &recordingSink{err: errors.New("unavailable")}
+	sinks.Add(fast, SinkOptions{Name: "fast", Batch: 2, FlushInterval: time.Hour})
+	sinks.Add(slow, SinkOptions{Name: "slow", Buffer: 1, Batch: 1})
+	sinks.Add(failing, SinkOptions{OnError: func(sink string, err error) { failed <- err }})
+
+	in := &Input{Remote: "192.0.2.1", URL: "/"}
+	d := Decision{Blocked: true, IP: net.IPv4(192, 0, 2, 1), Reason: "walk", IPs: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	for i := 0; i < 5; i++ {
+		sinks.Send(NewDecisionEvent(in, d, "BLOCK", []string{"walk"}))
+	}
+
+	// the slow sink holds at most one event in Write and one in its buffer,
+	// the others are dropped without delaying the fast sink
+	for {
+		fast.mutex.Lock()
+		n := len(fast.events)
+		fast.mutex.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(slow.block)
+
+	if err := sinks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fast.events) != 5 || fast.batches != 3 || !fast.closed {
+		t.Errorf("expected 5 events in 3 batches and the sink to be closed, got %d in %d", len(fast.events), fast.batches)
+	}
+	if e := fast.events[0]; e.IP != "192.0.2.1" || e.Answer != "BLOCK" || !e.Blocked || len(e.Reasons) != 1 {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if len(slow.events) < 1 || len(slow.events) > 2 {
+		t.Errorf("expected the slow sink to get 1 or 2 events, got %d", len(slow.events))
+	}
+	if err := <-failed; err.Error() != "unavailable" {
+		t.Errorf("expected the error to be reported, got %s", err)
+	}
+
+	counts := sinks.events.Values()
+	if counts["fast|written"] != 5 || counts["slow|dropped"] == 0 || counts["sink2|failed"] != 5 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+
+	// events sent after closing are ignored
+	sinks.Send(DecisionEvent{})
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	for i := 0; i < 2; i++ {
+		s, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(context.Background(), []DecisionEvent{{URL: "/", Answer: "OK"}}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var e DecisionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Answer != "OK" {
+			t.Errorf("unexpected line %s: %v", scanner.Text(), err)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("expected the file to be appended to, got %d lines", lines)
+	}
+}
+
+func TestHTTPSinks(t *testing.T) {
+	var contentType string
+	var body map[string][]map[string]DecisionEvent
+	var events []DecisionEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		switch r.URL.Path {
+		case "/topics/decisions":
+			json.NewDecoder(r.Body).Decode(&body)
+		case "/hook":
+			json.NewDecoder(r.Body).Decode(&events)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	batch := []DecisionEvent{{URL: "/a", Answer: "OK"}, {URL: "/b", Answer: "BLOCK"}}
+	if err := NewKafkaSink(server.URL+"/topics/decisions").Write(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+	if records := body["records"]; len(records) != 2 || records[1]["value"].URL != "/b" {
+		t.Errorf("unexpected records %v", body)
+	}
+
+	if err := NewWebhookSink(server.URL+"/hook").Write(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].URL != "/a" {
+		t.Errorf("unexpected events %v", events)
+	}
+
+	if err := NewWebhookSink(server.URL+"/missing").Write(context.Background(), batch); err == nil {
+		t.Error("expected an error for a 404")
+	}
+}
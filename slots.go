@@ -0,0 +1,75 @@
+package botdetect
+
+import (
+	"sort"
+	"time"
+)
+
+// SlotAggregate is what an IP requested within one time slot, the data the
+// rules are evaluated on. Slots older than CompactAge cover CompactSlot.
+type SlotAggregate struct {
+	IP     string    `json:"ip"`
+	Slot   time.Time `json:"slot"`
+	Count  uint64    `json:"count"`
+	App    uint64    `json:"app"`
+	Other  uint64    `json:"other"`
+	Bytes  uint64    `json:"bytes,omitempty"`
+	Hits   uint64    `json:"hits,omitempty"`
+	Misses uint64    `json:"misses,omitempty"`
+}
+
+// Slots passes the slots starting at since or later and before until to fn,
+// ordered by IP and then by slot, until fn returns false. Zero times don't
+// limit the slots. The current slot is still being counted, see
+// CurrentSlot. The data of one IP is copied at a time, so the history keeps
+// recording requests meanwhile.
+func (h *IPHistory) Slots(since, until time.Time, fn func(SlotAggregate) bool) {
+	h.mutex.RLock()
+	ips := make([]string, 0, len(h.data))
+	for ip := range h.data {
+		ips = append(ips, ip)
+	}
+	h.mutex.RUnlock()
+	sort.Strings(ips)
+
+	slots := []SlotAggregate{}
+	for _, ip := range ips {
+		slots = slots[:0]
+		h.mutex.RLock()
+		if counts, ok := h.data[ip]; ok {
+			// the list is ordered newest first
+			for node := counts.Back(); node != nil; node = node.Prev() {
+				hi := node.Value.(*IPHistoryItem)
+				if hi.Timestamp.Before(since) {
+					continue
+				}
+				if !until.IsZero() && !hi.Timestamp.Before(until) {
+					break
+				}
+				slots = append(slots, SlotAggregate{
+					IP:     ip,
+					Slot:   hi.Timestamp,
+					Count:  hi.Count,
+					App:    hi.App,
+					Other:  hi.Other,
+					Bytes:  hi.Bytes,
+					Hits:   hi.Hits,
+					Misses: hi.Misses,
+				})
+			}
+		}
+		h.mutex.RUnlock()
+
+		for _, slot := range slots {
+			if !fn(slot) {
+				return
+			}
+		}
+	}
+}
+
+// CurrentSlot returns the start of the slot requests are currently counted
+// in. Earlier slots only change for requests that arrive late.
+func (h *IPHistory) CurrentSlot() time.Time {
+	return h.slot()
+}
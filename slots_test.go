@@ -0,0 +1,71 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := h.CurrentSlot()
+	previous := current.Add(-time.Minute)
+	requests := []*Request{
+		{IP: net.IPv4(192, 0, 2, 2), URL: "/", Time: previous},
+		{IP: net.IPv4(192, 0, 2, 1), URL: "/", Time: previous},
+		{IP: net.IPv4(192, 0, 2, 1), URL: "/app.js", Time: previous},
+		{IP: net.IPv4(192, 0, 2, 1), URL: "/", Bytes: 100},
+	}
+	for _, req := range requests {
+		h.RequestChannel() <- req
+	}
+	for h.Processed() < uint64(len(requests)) {
+		time.Sleep(time.Millisecond)
+	}
+
+	slots := []SlotAggregate{}
+	h.Slots(time.Time{}, time.Time{}, func(s SlotAggregate) bool {
+		slots = append(slots, s)
+		return true
+	})
+	expected := []SlotAggregate{
+		{IP: "192.0.2.1", Slot: previous, Count: 2, App: 1, Other: 1},
+		{IP: "192.0.2.1", Slot: current, Count: 1, App: 1, Bytes: 100},
+		{IP: "192.0.2.2", Slot: previous, Count: 1, App: 1},
+	}
+	if len(slots) != len(expected) {
+		t.Fatalf("expected %d slots, got %+v", len(expected), slots)
+	}
+	for i, s := range expected {
+		if slots[i].IP != s.IP || !slots[i].Slot.Equal(s.Slot) || slots[i].Count != s.Count ||
+			slots[i].App != s.App || slots[i].Other != s.Other || slots[i].Bytes != s.Bytes {
+			t.Errorf("slot %d: expected %+v, got %+v", i, s, slots[i])
+		}
+	}
+
+	// only the complete slots, and stop after the first one
+	slots = slots[:0]
+	h.Slots(previous, current, func(s SlotAggregate) bool {
+		slots = append(slots, s)
+		return false
+	})
+	if len(slots) != 1 || slots[0].IP != "192.0.2.1" || !slots[0].Slot.Equal(previous) {
+		t.Errorf("expected the previous slot of 192.0.2.1 only, got %+v", slots)
+	}
+}
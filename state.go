@@ -0,0 +1,156 @@
+package botdetect
+
+import (
+	"container/list"
+	"io"
+	"time"
+)
+
+// State is a snapshot of everything an IPHistory has learned. It can be
+// written out and read back into a new history, e.g. across restarts.
+type State struct {
+	// Version is the version of the format the state was written in, see
+	// StateVersion. It is kept in the header of a snapshot, see EncodeState.
+	Version int `json:"-"`
+
+	Time      time.Time                  `json:"time"`
+	History   map[string][]IPHistoryItem `json:"history"`
+	Blacklist []BlacklistEntry           `json:"blacklist"`
+	Grants    []Grant                    `json:"grants,omitempty"`
+
+	// Exemptions are the exemptions with their metadata. States of version 2
+	// and earlier only have the expiry of every exempt IP in Exempt, which
+	// MigrateState turns into Exemptions.
+	Exemptions []Exemption          `json:"exemptions,omitempty"`
+	Exempt     map[string]time.Time `json:"exempt,omitempty"`
+
+	// Reputation is only saved for a MemoryReputationStore, other stores
+	// keep the reputations themselves
+	Reputation map[string]Reputation `json:"reputation,omitempty"`
+
+	// Baselines are the baselines of the anomaly detection by IP
+	Baselines map[string]AnomalyBaseline `json:"baselines,omitempty"`
+
+	// Greylist are the greylisted IPs, kept since version 4
+	Greylist []GreylistEntry `json:"greylist,omitempty"`
+}
+
+// ExportState returns a snapshot of the history's state
+func (h *IPHistory) ExportState() *State {
+	s := &State{
+		Version:   StateVersion,
+		Time:      time.Now(),
+		History:   make(map[string][]IPHistoryItem),
+		Blacklist: h.blacklist.SnapshotList(),
+	}
+
+	h.mutex.RLock()
+	for ip, counts := range h.data {
+		items := make([]IPHistoryItem, 0, counts.Len())
+		for node := counts.Front(); node != nil; node = node.Next() {
+			items = append(items, *node.Value.(*IPHistoryItem))
+		}
+		s.History[ip] = items
+	}
+	s.Baselines = h.exportBaselines()
+	h.mutex.RUnlock()
+
+	s.Exemptions = h.Exemptions()
+	s.Grants = h.Grants()
+	s.Greylist = h.greylist.Entries()
+	if store := memoryReputations(h.opts().Reputation); store != nil {
+		s.Reputation = store.snapshot()
+	}
+
+	return s
+}
+
+// ImportState merges a snapshot into the history. Slots and baselines of IPs
+// that are already known replace the existing ones; items outside the window and
+// expired blacklist entries, exemptions, grants and greylist entries are
+// dropped. The greylist is only restored if the greylist options are set.
+func (h *IPHistory) ImportState(s *State) {
+	now := time.Now()
+	cutoff := now.Add(-1 * h.window())
+
+	h.mutex.Lock()
+	for ip, items := range s.History {
+		counts := list.New()
+		// items are stored newest first
+		for i := range items {
+			if !items[i].Timestamp.After(cutoff) {
+				break
+			}
+			hi := items[i]
+			counts.PushBack(&hi)
+		}
+		if counts.Len() == 0 {
+			continue
+		}
+
+		key := ip
+		if addr, err := ParseCanonicalAddr(ip); err == nil {
+			key = addr.String()
+		}
+		h.data[key] = counts
+		h.updatedIPs[key] = true
+	}
+	h.importBaselines(s.Baselines)
+	h.mutex.Unlock()
+
+	for _, entry := range s.Blacklist {
+		h.blacklist.Restore(entry)
+	}
+
+	for _, e := range s.Exemptions {
+		h.restoreExemption(e, now)
+	}
+
+	for _, g := range s.Grants {
+		h.restoreGrant(g, now)
+	}
+
+	if h.opts().Greylist != nil {
+		for _, e := range s.Greylist {
+			h.greylist.restore(e, now)
+		}
+	}
+
+	if store := memoryReputations(h.opts().Reputation); store != nil && len(s.Reputation) > 0 {
+		reputations := make(map[string]Reputation, len(s.Reputation))
+		for ip, r := range s.Reputation {
+			if addr, err := ParseCanonicalAddr(ip); err == nil {
+				reputations[addr.String()] = r
+			}
+		}
+		store.Update(h.ctx, reputations)
+	}
+}
+
+// WriteState writes a snapshot of the history's state as JSON
+func (h *IPHistory) WriteState(w io.Writer) error {
+	return h.WriteStateCodec(w, DefaultStateCodec)
+}
+
+// WriteStateCodec writes a snapshot of the history's state with the named
+// codec, see EncodeState
+func (h *IPHistory) WriteStateCodec(w io.Writer, codec string) error {
+	return EncodeState(w, h.ExportState(), codec)
+}
+
+// ReadState reads a snapshot written by WriteState or WriteStateCodec,
+// migrates it to the current version and merges it into the history.
+// Snapshots written by newer versions are an error of the kind
+// ErrStateVersion.
+func (h *IPHistory) ReadState(r io.Reader) error {
+	s, err := DecodeState(r)
+	if err != nil {
+		return err
+	}
+	if err := MigrateState(s); err != nil {
+		return err
+	}
+
+	h.ImportState(s)
+	return nil
+}
@@ -0,0 +1,122 @@
+package botdetect
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := func() *IPHistoryOptions {
+		return &IPHistoryOptions{
+			TimeSlot:       time.Minute,
+			Window:         time.Hour,
+			Interval:       time.Hour,
+			ExpireInterval: time.Hour,
+			BlacklistTTL:   time.Hour,
+			MaxRequests:    100,
+			MaxRatio:       0.5,
+			Greylist:       &GreylistOptions{TTL: time.Hour, Promote: 2, Demote: time.Hour},
+		}
+	}
+
+	src, err := NewIPHistory(ctx, options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		src.RequestChannel() <- &Request{URL: "/index.html", IP: ip}
+	}
+	src.RequestChannel() <- &Request{URL: "/style.css", IP: ip}
+	src.Blacklist().SetReason(net.ParseIP("192.0.2.2"), "rule 1m0s:1:0.5")
+	src.ReportFalsePositive(net.ParseIP("192.0.2.3"), time.Hour, "")
+	src.Greylist().abuse(net.ParseIP("192.0.2.4"), "warn", time.Now(), time.Hour)
+
+	// wait for the last request to be processed
+	time.Sleep(10 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	if err := src.WriteState(buf); err != nil {
+		t.Fatalf("unexpected error writing the state: %s", err)
+	}
+
+	dst, err := NewIPHistory(ctx, options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.ReadState(buf); err != nil {
+		t.Fatalf("unexpected error reading the state: %s", err)
+	}
+
+	if dst.Size() != 1 || dst.NumIPs() != 1 {
+		t.Errorf("expected 1 IP with 1 slot, got %d IPs with %d slots", dst.NumIPs(), dst.Size())
+	}
+	items := dst.ExportState().History[ip.To16().String()]
+	if len(items) != 1 || items[0].Count != 4 || items[0].Other != 1 {
+		t.Errorf("unexpected slots after import: %+v", items)
+	}
+	if reason, ok := dst.Blacklist().Reason(net.ParseIP("192.0.2.2")); !ok || reason != "rule 1m0s:1:0.5" {
+		t.Errorf("expected the blacklist entry to be restored, got '%s', %v", reason, ok)
+	}
+	if !dst.isExempt(net.ParseIP("192.0.2.3").To16().String(), time.Now()) {
+		t.Errorf("expected the exemption to be restored")
+	}
+	if e, ok := dst.Greylist().Entry(net.ParseIP("192.0.2.4")); !ok || e.Reason != "warn" {
+		t.Errorf("expected the greylist entry to be restored, got %+v, %v", e, ok)
+	}
+}
+
+func FuzzReadState(f *testing.F) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	f.Add([]byte(fmt.Sprintf(`{"time":%q,"history":{"192.0.2.1":[{"timestamp":%q,"count":5,"other":1}]},`+
+		`"blacklist":[{"ip":"192.0.2.2","expires":%q,"reason":"rule"}],"exempt":{"192.0.2.3":%q}}`,
+		now.Format(time.RFC3339), now.Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))))
+	f.Add([]byte(fmt.Sprintf(`{"history":{"not an ip":[{"timestamp":%q,"count":1},{"timestamp":%q,"count":2}]},"blacklist":[{"ip":null}]}`,
+		now.Add(-time.Minute).Format(time.RFC3339), now.Format(time.RFC3339))))
+	f.Add([]byte(`{"history":{"::ffff:192.0.2.1":[]},"exempt":{"":"2999-01-01T00:00:00Z"}}`))
+	f.Add([]byte(`[`))
+	for _, codec := range []string{"gob", "msgpack", "protobuf"} {
+		var buf bytes.Buffer
+		if err := EncodeState(&buf, testState(), codec); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := NewIPHistory(ctx, &IPHistoryOptions{
+			TimeSlot:       time.Minute,
+			Window:         time.Hour,
+			Interval:       time.Hour,
+			ExpireInterval: time.Hour,
+			BlacklistTTL:   time.Hour,
+			MaxRequests:    3,
+			MaxRatio:       0.5,
+			CompactAge:     10 * time.Minute,
+			CompactSlot:    5 * time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ReadState(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		// the imported data has to survive everything the history does with it
+		h.TriggerCalculate()
+		h.TriggerExpire()
+		if err := h.WriteState(&bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,7 @@
+// Package stress contains stress tests that hammer the history and the
+// blacklist from many goroutines at once. Run them with the race detector:
+//
+//	go test -race ./stress
+//
+// The -short flag shortens the runs.
+package stress
@@ -0,0 +1,156 @@
+package stress
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elcamino/botdetect"
+)
+
+// duration returns how long each stress test runs
+func duration() time.Duration {
+	if testing.Short() {
+		return 200 * time.Millisecond
+	}
+	return time.Second
+}
+
+// hammer runs every worker in the given number of goroutines until the
+// duration has passed
+func hammer(t *testing.T, goroutines int, workers ...func(i int)) {
+	t.Helper()
+
+	stop := time.Now().Add(duration())
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(worker func(int), g int) {
+				defer wg.Done()
+				for i := g; time.Now().Before(stop); i++ {
+					worker(i)
+				}
+			}(worker, g)
+		}
+	}
+	wg.Wait()
+}
+
+func ip(i int) net.IP {
+	return net.IPv4(192, 0, byte(i>>8), byte(i))
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := botdetect.NewIPHistory(ctx, &botdetect.IPHistoryOptions{
+		TimestampFormat: "15:04:05",
+		TimeSlot:        10 * time.Millisecond,
+		Window:          time.Second,
+		Interval:        5 * time.Millisecond,
+		ExpireInterval:  7 * time.Millisecond,
+		BlacklistTTL:    50 * time.Millisecond,
+		MaxRequests:     20,
+		MaxRatio:        0.5,
+		CompactAge:      100 * time.Millisecond,
+		CompactSlot:     50 * time.Millisecond,
+		QueueSize:       100,
+		Audit:           botdetect.NewAuditLog(10, 100),
+		Metrics:         botdetect.NewMetrics(),
+		AutoTune: &botdetect.AutoTuneOptions{
+			Percentile: 0.9, Factor: 2, MinRequests: 5, Interval: 20 * time.Millisecond, Apply: true,
+		},
+		Anomaly: &botdetect.AnomalyOptions{Alpha: 0.3, Threshold: 3, MinRequests: 5, Warmup: 3, Blacklist: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decider, err := botdetect.NewDecider(h.RequestChannel(), h.Blacklist(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hammer(t, 8,
+		func(i int) {
+			h.RequestChannel() <- &botdetect.Request{URL: "/", IP: ip(i % 500)}
+		},
+		func(i int) {
+			decider.Check(ip(i%300).String(), fmt.Sprintf("%s, %s", ip(i%7), ip(i%11)))
+		},
+		func(i int) {
+			h.IsBlacklisted(ip(i % 500))
+			h.NumIPs()
+			h.Size()
+			h.NumBL()
+			h.Ready()
+		},
+		func(i int) {
+			if i%50 == 0 {
+				h.ReportFalsePositive(ip(i%500), 10*time.Millisecond, "stress")
+			}
+			if i%100 == 0 {
+				h.UpdateOptions(func(o *botdetect.IPHistoryOptions) {
+					o.MaxRequests = uint64(10 + i%20)
+				})
+			}
+		},
+		func(i int) {
+			if i%20 != 0 {
+				return
+			}
+			buf := &bytes.Buffer{}
+			if err := h.WriteState(buf); err != nil {
+				t.Error(err)
+			}
+			if i%100 == 0 {
+				h.ReadState(buf)
+			}
+			h.Options().Metrics.WritePrometheus(&bytes.Buffer{})
+		},
+	)
+}
+
+func TestBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := botdetect.NewBlacklist(ctx, 20*time.Millisecond, 5*time.Millisecond)
+
+	hammer(t, 8,
+		func(i int) {
+			bl.SetReason(ip(i%2000), "stress")
+		},
+		func(i int) {
+			bl.IsBlacklisted(ip(i % 2000))
+			bl.Reason(ip(i % 2000))
+		},
+		func(i int) {
+			if i%3 == 0 {
+				bl.Remove(ip(i % 2000))
+			}
+			bl.Restore(botdetect.BlacklistEntry{IP: ip(i % 2000), Expires: time.Now().Add(time.Millisecond)})
+		},
+		func(i int) {
+			if i%50 == 0 {
+				bl.SnapshotList()
+				bl.ForEach(func(botdetect.BlacklistEntry) bool { return true })
+			}
+			bl.Size()
+		},
+	)
+
+	// everything expires eventually
+	deadline := time.Now().Add(time.Second)
+	for bl.Size() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if bl.Size() != 0 {
+		t.Errorf("expected all entries to expire, %d left", bl.Size())
+	}
+}
@@ -0,0 +1,95 @@
+package botdetect
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Types of blacklist events
+const (
+	BlacklistAdd    = "add"
+	BlacklistRemove = "remove"
+)
+
+// BlacklistEvent describes a change of the blacklist. Removals carry the
+// reason the IP had been blacklisted for and why it was removed: expired,
+// evicted or removed.
+type BlacklistEvent struct {
+	Type     string    `json:"type"`
+	IP       net.IP    `json:"ip"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Severity Severity  `json:"severity,omitempty"`
+	Cause    string    `json:"cause,omitempty"`
+}
+
+type blacklistSubscriber struct {
+	events chan BlacklistEvent
+}
+
+// Subscribe returns the current entries of the blacklist and a channel that
+// receives every change from then on. If the subscriber falls more than
+// buffer events behind, the channel is closed and the subscriber has to
+// subscribe again to get a consistent copy. cancel ends the subscription.
+func (bl *Blacklist) Subscribe(buffer int) (entries []BlacklistEntry, events <-chan BlacklistEvent, cancel func()) {
+	sub := &blacklistSubscriber{events: make(chan BlacklistEvent, buffer)}
+
+	// the write lock keeps changes from slipping in between the snapshot
+	// and the subscription
+	bl.mutex.Lock()
+	entries = make([]BlacklistEntry, 0, len(bl.data))
+	for addr, rec := range bl.data {
+		entries = append(entries, BlacklistEntry{IP: net.IP(addr.AsSlice()), Expires: rec.Expires, Reason: rec.Reason, Severity: rec.Severity})
+	}
+	if bl.subscribers == nil {
+		bl.subscribers = make(map[*blacklistSubscriber]bool)
+	}
+	bl.subscribers[sub] = true
+	bl.mutex.Unlock()
+
+	cancel = func() {
+		bl.mutex.Lock()
+		defer bl.mutex.Unlock()
+		bl.unsubscribe(sub)
+	}
+	return entries, sub.events, cancel
+}
+
+// Subscribers returns the number of active subscriptions
+func (bl *Blacklist) Subscribers() int {
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return len(bl.subscribers)
+}
+
+// unsubscribe closes the channel of the subscriber. The caller must hold the
+// write lock.
+func (bl *Blacklist) unsubscribe(sub *blacklistSubscriber) {
+	if bl.subscribers[sub] {
+		delete(bl.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publish queues the event for the WAL, if any, and delivers it to all
+// subscribers without waiting for them. The caller must hold the write lock.
+func (bl *Blacklist) publish(typ string, addr netip.Addr, rec blacklistRecord, cause string) {
+	if len(bl.subscribers) == 0 && bl.wal == nil {
+		return
+	}
+
+	ev := BlacklistEvent{Type: typ, IP: net.IP(addr.AsSlice()), Reason: rec.Reason, Cause: cause}
+	if typ == BlacklistAdd {
+		ev.Expires = rec.Expires
+		ev.Severity = rec.Severity
+	}
+	bl.wal.append(ev)
+	for sub := range bl.subscribers {
+		select {
+		case sub.events <- ev:
+		default:
+			bl.unsubscribe(sub)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlacklistSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	bl.SetReason(net.ParseIP("192.0.2.1"), "before")
+
+	entries, events, unsubscribe := bl.Subscribe(10)
+	if len(entries) != 1 || entries[0].Reason != "before" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	if bl.Subscribers() != 1 {
+		t.Errorf("expected 1 subscriber, got %d", bl.Subscribers())
+	}
+
+	bl.SetReason(net.ParseIP("192.0.2.2"), "after")
+	bl.SetReason(net.ParseIP("192.0.2.2"), "again")
+	bl.Remove(net.ParseIP("192.0.2.1"))
+
+	for _, expected := range []BlacklistEvent{
+		{Type: BlacklistAdd, IP: net.ParseIP("192.0.2.2"), Reason: "after"},
+		{Type: BlacklistRemove, IP: net.ParseIP("192.0.2.1"), Reason: "before", Cause: "removed"},
+	} {
+		ev := <-events
+		if ev.Type != expected.Type || !ev.IP.Equal(expected.IP) || ev.Reason != expected.Reason || ev.Cause != expected.Cause {
+			t.Errorf("expected %+v, got %+v", expected, ev)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("expected the channel to be closed")
+	}
+	unsubscribe()
+}
+
+func TestBlacklistSubscriberOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	_, events, unsubscribe := bl.Subscribe(1)
+	defer unsubscribe()
+
+	bl.Set(net.ParseIP("192.0.2.1"))
+	bl.Set(net.ParseIP("192.0.2.2"))
+
+	<-events
+	if _, ok := <-events; ok {
+		t.Error("expected the channel of the slow subscriber to be closed")
+	}
+	if bl.Subscribers() != 0 {
+		t.Errorf("expected the slow subscriber to be dropped, got %d", bl.Subscribers())
+	}
+}
+
+func TestBlacklistSubscribeExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bl := NewBlacklist(ctx, time.Millisecond, time.Hour)
+	_, events, unsubscribe := bl.Subscribe(10)
+	defer unsubscribe()
+
+	bl.Set(net.ParseIP("192.0.2.1"))
+	time.Sleep(5 * time.Millisecond)
+	bl.expire()
+
+	<-events
+	if ev := <-events; ev.Type != BlacklistRemove || ev.Cause != "expired" {
+		t.Errorf("expected an expiry event, got %+v", ev)
+	}
+}
@@ -0,0 +1,266 @@
+package botdetect
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SurgeSite is the pattern of a surge of the requests to the whole site
+const SurgeSite = "*"
+
+// maxSurgePatterns limits the URL patterns with a baseline; requests to
+// others only count for the whole site
+const maxSurgePatterns = 1000
+
+// SurgeOptions configures the SurgeDetector
+type SurgeOptions struct {
+	// Slot is the time over which requests are counted
+	Slot time.Duration
+
+	// Factor is how many times the requests of a slot to a URL pattern, or
+	// to the whole site, have to exceed their baseline to be a surge, e.g.
+	// 10. The slot also needs at least MinRequests requests from at least
+	// MinNewIPs new IPs, IPs without a request within IPMemory before it.
+	Factor      float64
+	MinRequests uint64
+	MinNewIPs   int
+	IPMemory    time.Duration
+
+	// Alpha is the weight of the newest slot in the baselines
+	// (0 < Alpha <= 1), Warmup the number of slots the detector needs
+	// before it uses them. A URL pattern without a baseline after that has
+	// had no requests, so its baseline starts at zero.
+	Alpha  float64
+	Warmup int
+
+	// Hold is how long a surge lasts after its last slot
+	Hold time.Duration
+}
+
+// Surge is a sudden rise of the requests to a URL pattern (see URLPattern),
+// or to the whole site, from many new IPs
+type Surge struct {
+	Pattern  string    `json:"pattern"`
+	Started  time.Time `json:"started"`
+	Until    time.Time `json:"until"`
+	Requests uint64    `json:"requests"`
+	Baseline float64   `json:"baseline"`
+	NewIPs   int       `json:"new_ips"`
+}
+
+// SurgeDetector notices site-wide anomalies no single IP stands out in, such
+// as a botnet hitting one path with ten times the usual rate from hundreds
+// of IPs never seen before. Every URL pattern and the whole site get a
+// baseline of requests per slot, which slots of a surge don't change.
+type SurgeDetector struct {
+	options SurgeOptions
+
+	// OnStart and OnEnd are called when a surge starts and ends, without
+	// holding any lock
+	OnStart func(Surge)
+	OnEnd   func(Surge)
+
+	slot      time.Time
+	slots     int
+	counts    map[string]*surgeCount
+	newIPs    map[string]bool
+	known     map[string]time.Time
+	baselines map[string]*baseline
+	surges    map[string]*Surge
+	mutex     sync.Mutex
+}
+
+type surgeCount struct {
+	requests uint64
+	newIPs   map[string]bool
+}
+
+// NewSurgeDetector creates a SurgeDetector
+func NewSurgeDetector(options SurgeOptions) *SurgeDetector {
+	return &SurgeDetector{
+		options:   options,
+		slot:      time.Now().Truncate(options.Slot),
+		counts:    make(map[string]*surgeCount),
+		newIPs:    make(map[string]bool),
+		known:     make(map[string]time.Time),
+		baselines: make(map[string]*baseline),
+		surges:    make(map[string]*Surge),
+	}
+}
+
+// Observe counts a request by the IP to the URL
+func (d *SurgeDetector) Observe(ip net.IP, url string, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.Tick(now)
+
+	key := ipKey(ip)
+	pattern := URLPattern(url)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	isNew, seen := d.newIPs[key]
+	if !seen {
+		last, known := d.known[key]
+		isNew = !known || now.Sub(last) > d.options.IPMemory
+		d.newIPs[key] = isNew
+	}
+	d.known[key] = now
+
+	d.count(SurgeSite, key, isNew)
+	if _, ok := d.counts[pattern]; ok || len(d.baselines)+len(d.counts) < maxSurgePatterns {
+		d.count(pattern, key, isNew)
+	}
+}
+
+// count counts the request for the pattern. d.mutex must be held.
+func (d *SurgeDetector) count(pattern, ip string, isNew bool) {
+	c, ok := d.counts[pattern]
+	if !ok {
+		c = &surgeCount{newIPs: map[string]bool{}}
+		d.counts[pattern] = c
+	}
+	c.requests++
+	if isNew {
+		c.newIPs[ip] = true
+	}
+}
+
+// Tick evaluates the slot once it is over and ends the surges that have run
+// out, calling OnStart and OnEnd
+func (d *SurgeDetector) Tick(now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	started, ended := []Surge{}, []Surge{}
+	if slot := now.Truncate(d.options.Slot); slot.After(d.slot) {
+		started = d.evaluate(now)
+		d.slot = slot
+	}
+	for pattern, s := range d.surges {
+		if !now.Before(s.Until) {
+			ended = append(ended, *s)
+			delete(d.surges, pattern)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, s := range started {
+		if d.OnStart != nil {
+			d.OnStart(s)
+		}
+	}
+	for _, s := range ended {
+		if d.OnEnd != nil {
+			d.OnEnd(s)
+		}
+	}
+}
+
+// evaluate compares the counts of the slot that is over with the baselines
+// and returns the surges that started. d.mutex must be held.
+func (d *SurgeDetector) evaluate(now time.Time) []Surge {
+	started := []*Surge{}
+	for pattern, c := range d.counts {
+		b, ok := d.baselines[pattern]
+		if !ok {
+			b = &baseline{}
+			if d.slots >= d.options.Warmup {
+				b.slots = 1
+			}
+			d.baselines[pattern] = b
+		}
+
+		if d.slots < d.options.Warmup || c.requests < d.options.MinRequests || len(c.newIPs) < d.options.MinNewIPs ||
+			float64(c.requests) <= d.options.Factor*b.mean {
+			b.update(c.requests, d.options.Alpha)
+			continue
+		}
+
+		s, ok := d.surges[pattern]
+		if !ok {
+			s = &Surge{Pattern: pattern, Started: now, Baseline: b.mean}
+			d.surges[pattern] = s
+			started = append(started, s)
+		}
+		s.Until = now.Add(d.options.Hold)
+		s.Requests = c.requests
+		s.NewIPs = len(c.newIPs)
+	}
+
+	// patterns without requests in the slot decay towards zero and are
+	// forgotten once they do
+	for pattern, b := range d.baselines {
+		if _, ok := d.counts[pattern]; !ok {
+			b.update(0, d.options.Alpha)
+			if b.mean < 0.01 {
+				delete(d.baselines, pattern)
+			}
+		}
+	}
+
+	for ip, last := range d.known {
+		if now.Sub(last) > d.options.IPMemory {
+			delete(d.known, ip)
+		}
+	}
+	d.counts = make(map[string]*surgeCount)
+	d.newIPs = make(map[string]bool)
+	d.slots++
+
+	surges := make([]Surge, len(started))
+	for i, s := range started {
+		surges[i] = *s
+	}
+	return surges
+}
+
+// Surges returns the surges going on, the earliest first
+func (d *SurgeDetector) Surges() []Surge {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	surges := make([]Surge, 0, len(d.surges))
+	for _, s := range d.surges {
+		surges = append(surges, *s)
+	}
+	d.mutex.Unlock()
+
+	sort.Slice(surges, func(i, j int) bool {
+		if !surges[i].Started.Equal(surges[j].Started) {
+			return surges[i].Started.Before(surges[j].Started)
+		}
+		return surges[i].Pattern < surges[j].Pattern
+	})
+	return surges
+}
+
+// Surging returns the surge a request to the URL is part of: one of its URL
+// pattern or of the whole site
+func (d *SurgeDetector) Surging(url string) (Surge, bool) {
+	if d == nil {
+		return Surge{}, false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.surges) == 0 {
+		return Surge{}, false
+	}
+	if s, ok := d.surges[SurgeSite]; ok {
+		return *s, true
+	}
+	if s, ok := d.surges[URLPattern(url)]; ok {
+		return *s, true
+	}
+	return Surge{}, false
+}
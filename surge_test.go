@@ -0,0 +1,80 @@
+package botdetect
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSurgeDetector(t *testing.T) {
+	d := NewSurgeDetector(SurgeOptions{
+		Slot:        time.Minute,
+		Factor:      10,
+		MinRequests: 100,
+		MinNewIPs:   50,
+		IPMemory:    time.Hour,
+		Alpha:       0.5,
+		Warmup:      3,
+		Hold:        5 * time.Minute,
+	})
+	started, ended := []Surge{}, []Surge{}
+	d.OnStart = func(s Surge) { started = append(started, s) }
+	d.OnEnd = func(s Surge) { ended = append(ended, s) }
+
+	// regular traffic of 20 IPs, 60 requests per minute
+	now := time.Now().Truncate(time.Minute)
+	regular := func(slot time.Time) {
+		for i := 0; i < 60; i++ {
+			d.Observe(net.IPv4(198, 51, 100, byte(i%20)), fmt.Sprintf("/product/%d", i), slot.Add(time.Duration(i)*time.Second))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		regular(now)
+		now = now.Add(time.Minute)
+	}
+
+	// the same IPs elevenfold don't make a surge, there are no new IPs
+	for i := 0; i < 11; i++ {
+		regular(now)
+	}
+	now = now.Add(time.Minute)
+	d.Tick(now)
+	if len(started) != 0 {
+		t.Fatalf("didn't expect a surge from known IPs, got %v", started)
+	}
+	regular(now)
+	now = now.Add(time.Minute)
+
+	// hundreds of new IPs hit the login
+	regular(now)
+	for i := 0; i < 300; i++ {
+		d.Observe(net.IPv4(203, 0, 113, byte(i)), "/login?next=/", now.Add(time.Second))
+	}
+	d.Tick(now.Add(time.Minute))
+	if len(started) != 1 || started[0].Pattern != "/login?next" || started[0].NewIPs != 256 {
+		t.Fatalf("expected a surge to /login?next from 256 new IPs, got %+v", started)
+	}
+	if _, ok := d.Surging("/login?next=/account"); !ok {
+		t.Error("expected a request to the login to be part of the surge")
+	}
+	if _, ok := d.Surging("/product/1"); ok {
+		t.Error("didn't expect a request to a product to be part of the surge")
+	}
+
+	// the surge ends after the hold time without the slots of the surge
+	// raising the baseline
+	d.Tick(now.Add(6 * time.Minute))
+	if len(ended) != 1 || len(d.Surges()) != 0 {
+		t.Errorf("expected the surge to end, got %v", d.Surges())
+	}
+	if b := d.baselines["/login?next"]; b != nil && b.mean > 10 {
+		t.Errorf("expected the surge to leave the baseline alone, got %g", b.mean)
+	}
+
+	var nilDetector *SurgeDetector
+	nilDetector.Observe(net.IPv4(192, 0, 2, 1), "/", now)
+	if _, ok := nilDetector.Surging("/"); ok {
+		t.Error("a nil detector should not report surges")
+	}
+}
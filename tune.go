@@ -0,0 +1,145 @@
+package botdetect
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// AutoTuneOptions configures the automatic tuning of the main rule. The
+// MaxRequests threshold is derived from the distribution of app requests per
+// IP within Window: the given percentile multiplied by Factor, but never
+// below MinRequests. With Block, MaxRatio is raised until at most this
+// fraction of the IPs matches the rule, e.g. 0.005 for the top 0.5%, but
+// never below the configured MaxRatio.
+type AutoTuneOptions struct {
+	Percentile  float64
+	Factor      float64
+	MinRequests uint64
+	Block       float64
+	Interval    time.Duration
+
+	// Apply uses the tuned thresholds. Otherwise they are only reported
+	// through OnTune and the metrics, which makes it possible to try the
+	// tuning out.
+	Apply bool
+
+	// OnTune is called with the current and the tuned thresholds if set
+	OnTune func(current, tuned Thresholds)
+}
+
+// Thresholds are the thresholds of the main rule auto tuning adjusts
+type Thresholds struct {
+	MaxRequests uint64
+	MaxRatio    float64
+}
+
+// applyTuning determines whether the tuned thresholds are in effect
+func (h *IPHistory) applyTuning() bool {
+	return h.opts().AutoTune != nil && h.opts().AutoTune.Apply
+}
+
+// maxRequests returns the MaxRequests currently in effect for the main rule
+func (h *IPHistory) maxRequests() uint64 {
+	if tuned := atomic.LoadUint64(&h.tunedMaxRequests); tuned > 0 && h.applyTuning() {
+		return tuned
+	}
+	return h.opts().MaxRequests
+}
+
+// maxRatio returns the MaxRatio currently in effect for the main rule
+func (h *IPHistory) maxRatio() float64 {
+	if tuned := h.TunedMaxRatio(); tuned > 0 && h.applyTuning() {
+		return tuned
+	}
+	return h.opts().MaxRatio
+}
+
+// TunedMaxRequests returns the MaxRequests the last auto tuning run
+// computed, or zero if it hasn't run yet
+func (h *IPHistory) TunedMaxRequests() uint64 {
+	return atomic.LoadUint64(&h.tunedMaxRequests)
+}
+
+// TunedMaxRatio returns the MaxRatio the last auto tuning run computed, or
+// zero if it hasn't run yet
+func (h *IPHistory) TunedMaxRatio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.tunedMaxRatio))
+}
+
+// tune computes new thresholds from all IPs in the history. The caller must
+// hold h.mutex.
+func (h *IPHistory) tune(now time.Time) {
+	at := h.opts().AutoTune
+	if at == nil || now.Sub(h.lastTune) < at.Interval {
+		return
+	}
+	h.lastTune = now
+
+	cutoff := now.Add(-1 * h.opts().Window)
+	totals := make([]uint64, 0, len(h.data))
+	apps := make([]uint64, 0, len(h.data))
+	for _, counts := range h.data {
+		total, app := countSince(counts, cutoff)
+		if app > 0 {
+			totals = append(totals, total)
+			apps = append(apps, app)
+		}
+	}
+	if len(apps) == 0 {
+		return
+	}
+
+	tuned := Thresholds{MaxRatio: h.opts().MaxRatio}
+	tuned.MaxRequests = uint64(math.Ceil(float64(percentile(append([]uint64{}, apps...), at.Percentile)) * at.Factor))
+	if tuned.MaxRequests < at.MinRequests {
+		tuned.MaxRequests = at.MinRequests
+	}
+	if at.Block > 0 {
+		tuned.MaxRatio = blockRatio(totals, apps, tuned, int(math.Floor(at.Block*float64(len(apps)))))
+	}
+
+	current := Thresholds{MaxRequests: h.maxRequests(), MaxRatio: h.maxRatio()}
+	atomic.StoreUint64(&h.tunedMaxRequests, tuned.MaxRequests)
+	atomic.StoreUint64(&h.tunedMaxRatio, math.Float64bits(tuned.MaxRatio))
+
+	if at.OnTune != nil {
+		at.OnTune(current, tuned)
+	}
+}
+
+// blockRatio returns the lowest MaxRatio, but at least the one of the
+// thresholds, with which at most limit of the IPs with the given counts
+// match a rule with the thresholds
+func blockRatio(totals, apps []uint64, thresholds Thresholds, limit int) float64 {
+	ratios := []float64{}
+	for i, app := range apps {
+		rule := Rule{MaxRequests: thresholds.MaxRequests, MaxRatio: thresholds.MaxRatio}
+		if rule.matches(totals[i], app) {
+			ratios = append(ratios, float64(totals[i])/float64(app))
+		}
+	}
+	if len(ratios) <= limit {
+		return thresholds.MaxRatio
+	}
+
+	// the IPs above the ratio of the one after the limit match
+	sort.Sort(sort.Reverse(sort.Float64Slice(ratios)))
+	return ratios[limit]
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of the values using
+// the nearest rank method. The values are sorted in place.
+func percentile(values []uint64, p float64) uint64 {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(values) {
+		rank = len(values) - 1
+	}
+	return values[rank]
+}
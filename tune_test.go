@@ -0,0 +1,113 @@
+package botdetect
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	values := []uint64{5, 1, 4, 2, 3, 10, 9, 8, 7, 6}
+	if p := percentile(values, 0.9); p != 9 {
+		t.Errorf("expected the 90th percentile to be 9, got %d", p)
+	}
+	if p := percentile(values, 1); p != 10 {
+		t.Errorf("expected the 100th percentile to be 10, got %d", p)
+	}
+}
+
+func TestTune(t *testing.T) {
+	var current, tuned Thresholds
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			Window:      time.Hour,
+			MaxRequests: 30,
+			AutoTune: &AutoTuneOptions{
+				Percentile:  0.9,
+				Factor:      2,
+				MinRequests: 5,
+				Interval:    time.Minute,
+				Apply:       true,
+				OnTune:      func(c, t Thresholds) { current, tuned = c, t },
+			},
+		},
+		data: make(map[string]*list.List),
+	}
+
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		l := list.New()
+		l.PushFront(&IPHistoryItem{Timestamp: now, Count: uint64(i), App: uint64(i)})
+		h.data[fmt.Sprintf("192.0.2.%d", i)] = l
+	}
+
+	h.tune(now)
+	if current.MaxRequests != 30 || tuned.MaxRequests != 18 {
+		t.Errorf("expected tuning from 30 to 18, got %d to %d", current.MaxRequests, tuned.MaxRequests)
+	}
+	if h.rules()[0].MaxRequests != 18 {
+		t.Errorf("expected the tuned threshold to be applied, got %d", h.rules()[0].MaxRequests)
+	}
+
+	h.options.AutoTune.Apply = false
+	if h.rules()[0].MaxRequests != 30 {
+		t.Errorf("expected the configured threshold without Apply, got %d", h.rules()[0].MaxRequests)
+	}
+}
+
+func TestTuneBlock(t *testing.T) {
+	h := &IPHistory{
+		options: &IPHistoryOptions{
+			Window:      time.Hour,
+			MaxRequests: 30,
+			MaxRatio:    0.5,
+			AutoTune: &AutoTuneOptions{
+				Percentile: 0.5,
+				Factor:     2,
+				Block:      0.05,
+				Interval:   time.Minute,
+				Apply:      true,
+			},
+		},
+		data: make(map[string]*list.List),
+	}
+
+	// half of the IPs make 100 app requests, with ratios from 1.51 to 2
+	now := time.Now()
+	counts := map[string][2]uint64{}
+	for i := 1; i <= 100; i++ {
+		app := uint64(5)
+		if i > 50 {
+			app = 100
+		}
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		counts[ip] = [2]uint64{app + uint64(i), app}
+		l := list.New()
+		l.PushFront(&IPHistoryItem{Timestamp: now, Count: app + uint64(i), App: app})
+		h.data[ip] = l
+	}
+
+	h.tune(now)
+	rule := h.rules()[0]
+	if rule.MaxRequests != 10 || rule.MaxRatio != 1.95 {
+		t.Errorf("expected max requests 10 and max ratio 1.95, got %d and %g", rule.MaxRequests, rule.MaxRatio)
+	}
+	matched := 0
+	for _, c := range counts {
+		if rule.matches(c[0], c[1]) {
+			matched++
+		}
+	}
+	if matched != 5 {
+		t.Errorf("expected the top 5%% of the IPs to match, got %d", matched)
+	}
+
+	// a larger share to block never lowers the configured ratio
+	h.options.AutoTune.Block = 0.9
+	h.lastTune = time.Time{}
+	h.tune(now)
+	if ratio := h.rules()[0].MaxRatio; ratio != 0.5 {
+		t.Errorf("expected the configured max ratio, got %g", ratio)
+	}
+}
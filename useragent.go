@@ -0,0 +1,136 @@
+package botdetect
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BotClasses are the classes of the bots in a UserAgentDB
+var BotClasses = []string{"ai", "search", "seo", "monitoring", "scraper"}
+
+//go:embed useragents.txt
+var defaultUserAgents string
+
+// UserAgent is a known bot recognized by a substring of its User-Agent header
+type UserAgent struct {
+	Name    string
+	Class   string
+	Pattern string
+}
+
+// UserAgentDB classifies requests by their User-Agent header. A new database
+// contains the bots shipped with botdetect; Read and Load replace them.
+type UserAgentDB struct {
+	agents []UserAgent
+	mutex  sync.RWMutex
+}
+
+// NewUserAgentDB creates a UserAgentDB with the bots shipped with botdetect
+func NewUserAgentDB() *UserAgentDB {
+	db := &UserAgentDB{}
+	if err := db.Read(strings.NewReader(defaultUserAgents)); err != nil {
+		panic(fmt.Sprintf("invalid embedded user agent database: %s", err))
+	}
+	return db
+}
+
+// Classify returns the first bot whose pattern occurs in the user agent
+func (db *UserAgentDB) Classify(ua string) (UserAgent, bool) {
+	if db == nil || ua == "" {
+		return UserAgent{}, false
+	}
+	ua = strings.ToLower(ua)
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	for _, agent := range db.agents {
+		if strings.Contains(ua, agent.Pattern) {
+			return agent, true
+		}
+	}
+	return UserAgent{}, false
+}
+
+// Size returns the number of known bots
+func (db *UserAgentDB) Size() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.agents)
+}
+
+// Read replaces the database with the bots read from r. Every line contains
+// a class, a name and the substring to look for, which may contain spaces,
+// separated by whitespace. Empty lines and lines starting with '#' are
+// ignored.
+func (db *UserAgentDB) Read(r io.Reader) error {
+	agents := []UserAgent{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return configErrorf("line %d: expected class name substring", lineNo)
+		}
+		if !isBotClass(fields[0]) {
+			return configErrorf("line %d: unknown class '%s', expected one of %s", lineNo, fields[0], strings.Join(BotClasses, ", "))
+		}
+
+		agents = append(agents, UserAgent{
+			Class:   fields[0],
+			Name:    fields[1],
+			Pattern: strings.ToLower(strings.Join(fields[2:], " ")),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	db.agents = agents
+	db.mutex.Unlock()
+
+	return nil
+}
+
+// Load replaces the database with the bots of the given file
+func (db *UserAgentDB) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return configError(err)
+	}
+	defer f.Close()
+
+	if err := db.Read(f); err != nil {
+		return configErrorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes until the
+// context is done. Errors are passed to onError and the previous bots are
+// kept.
+func (db *UserAgentDB) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	WatchFile(ctx, path, interval, db.Load, onError)
+}
+
+func isBotClass(class string) bool {
+	for _, c := range BotClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package botdetect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserAgentDB(t *testing.T) {
+	db := NewUserAgentDB()
+	if db.Size() == 0 {
+		t.Fatal("expected the embedded database to contain bots")
+	}
+
+	for ua, expected := range map[string]string{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                               "search",
+		"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)":                                     "seo",
+		"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)":                                 "monitoring",
+		"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2; +https://openai.com/gptbot)": "ai",
+		"python-requests/2.31.0": "scraper",
+		"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)": "search",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":              "",
+		"": "",
+	} {
+		agent, ok := db.Classify(ua)
+		if agent.Class != expected || ok != (expected != "") {
+			t.Errorf("%q: expected class %q, got %q", ua, expected, agent.Class)
+		}
+	}
+
+	if err := db.Read(strings.NewReader("# custom\nseo   Example  example crawler\n")); err != nil {
+		t.Fatal(err)
+	}
+	if agent, ok := db.Classify("Example Crawler/1.0"); !ok || agent.Name != "Example" {
+		t.Errorf("expected the custom bot to be recognized, got %v", agent)
+	}
+	if _, ok := db.Classify("Googlebot/2.1"); ok {
+		t.Error("expected Read to replace the embedded bots")
+	}
+
+	for _, s := range []string{"seo Example", "unknown Example example"} {
+		if err := db.Read(strings.NewReader(s)); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+	if db.Size() != 1 {
+		t.Error("expected a failed read to keep the previous bots")
+	}
+}
@@ -0,0 +1,76 @@
+package botdetect
+
+import (
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DefaultVerifiedHeader is the header through which proxies tell that a
+// request carried a valid challenge cookie
+const DefaultVerifiedHeader = "X-Botdetect-Verified"
+
+// isVerified determines whether the value of the verified header marks the
+// request as verified: anything but empty, "-", "0", "false" and "no" does
+func isVerified(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "-", "0", "false", "no":
+		return false
+	}
+	return true
+}
+
+// verifiedHeader returns the canonical name of the verified header of the
+// options, DefaultVerifiedHeader if unset
+func verifiedHeader(name string) string {
+	if name == "" {
+		return DefaultVerifiedHeader
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// IsVerified determines whether the request carried a valid challenge cookie
+// according to the verified header, DefaultVerifiedHeader if name is empty
+func (in *Input) IsVerified(name string) bool {
+	return isVerified(in.Header(verifiedHeader(name)))
+}
+
+// markVerified records that the IP made a request verified by a challenge
+// cookie. h.mutex must be held.
+func (h *IPHistory) markVerified(ip string, now time.Time) {
+	if h.opts().UnverifiedFactor > 0 {
+		h.verified[ip] = now
+	}
+}
+
+// unverifiedFactor returns the factor for the thresholds of the IP and
+// whether it applies, which it does for IPs without a verified request
+// within the window. h.mutex must be held.
+func (h *IPHistory) unverifiedFactor(ip string, now time.Time) (float64, bool) {
+	factor := h.opts().UnverifiedFactor
+	if factor <= 0 || factor == 1 {
+		return 1, false
+	}
+	if last, ok := h.verified[ip]; ok && last.After(now.Add(-1*h.window())) {
+		return 1, false
+	}
+	return factor, true
+}
+
+// expireVerified forgets IPs without a verified request since cutoff.
+// h.mutex must be held.
+func (h *IPHistory) expireVerified(cutoff time.Time) {
+	for ip, last := range h.verified {
+		if !last.After(cutoff) {
+			delete(h.verified, ip)
+		}
+	}
+}
+
+// NumVerified returns the number of IPs with a request verified by a
+// challenge cookie within the window
+func (h *IPHistory) NumVerified() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.verified)
+}
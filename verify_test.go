@@ -0,0 +1,92 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsVerified(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"1": true, "yes": true, "abc123": true,
+		"": false, "-": false, "0": false, "False": false, " no ": false,
+	} {
+		if isVerified(value) != expected {
+			t.Errorf("%q: expected %v", value, expected)
+		}
+	}
+}
+
+func TestDeciderVerified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan *Request, 2)
+	d, err := NewDecider(requests, NewBlacklist(ctx, time.Hour, time.Hour), &DeciderOptions{VerifiedHeader: "x-challenge-passed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.CheckInput(&Input{Remote: "192.0.2.1", URL: "/", Headers: map[string]string{"X-Challenge-Passed": "1"}})
+	d.CheckInput(&Input{Remote: "192.0.2.1", URL: "/"})
+	if req := <-requests; !req.Verified {
+		t.Error("expected the request with the header to be verified")
+	}
+	if req := <-requests; req.Verified {
+		t.Error("expected the request without the header not to be verified")
+	}
+}
+
+func TestUnverifiedFactor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := &IPHistoryOptions{
+		TimestampFormat:  "15:04",
+		TimeSlot:         time.Minute,
+		Window:           time.Hour,
+		Interval:         time.Hour,
+		ExpireInterval:   time.Hour,
+		BlacklistTTL:     time.Hour,
+		MaxRequests:      10,
+		MaxRatio:         0.5,
+		Metrics:          NewMetrics(),
+		UnverifiedFactor: 1.5,
+	}
+	if err := options.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for a factor above 1, got %v", err)
+	}
+
+	options.UnverifiedFactor = 0.5
+	h, err := NewIPHistory(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, unverified := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	h.RequestChannel() <- &Request{URL: "/", IP: verified, Verified: true}
+	for i := 0; i < 7; i++ {
+		h.RequestChannel() <- &Request{URL: "/", IP: verified}
+		h.RequestChannel() <- &Request{URL: "/", IP: unverified}
+	}
+	for h.Processed() < 15 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if a := h.Annotate(unverified); a.Remaining != 0 || len(a.Flags) != 2 || a.Flags[1] != "unverified" {
+		t.Errorf("expected the tightened limit in the annotations, got %+v", a)
+	}
+	h.TriggerCalculate()
+
+	if h.IsBlacklisted(verified) {
+		t.Error("expected the verified IP to keep the normal limit")
+	}
+	if !h.IsBlacklisted(unverified) {
+		t.Error("expected the unverified IP to be blacklisted at the tightened limit")
+	}
+	if h.NumVerified() != 1 {
+		t.Errorf("expected 1 verified IP, got %d", h.NumVerified())
+	}
+}
@@ -0,0 +1,372 @@
+package botdetect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WALEntry is a change of the blacklist in a BlacklistWAL
+type WALEntry struct {
+	Time time.Time `json:"time"`
+	BlacklistEvent
+}
+
+// BlacklistWAL is an append-only log of every change of a blacklist, one
+// JSON WALEntry per line. It is replayed on top of the last snapshot after a
+// crash and doubles as a forensic record of who was blocked when and why.
+// The log is rotated when it grows beyond a size, keeping a number of old
+// files with the suffixes .1 (the newest) to .N.
+//
+// The blacklist only queues its changes, a goroutine writes them, so that
+// a slow disk never holds up the blacklist. The log is synced to disk every
+// sync interval, before it is rotated and when it is closed: a crash loses
+// at most the changes of the last interval and those still queued, which
+// the next snapshot covers. If more than walMaxQueued changes are waiting,
+// further ones are dropped and counted as failures.
+type BlacklistWAL struct {
+	path         string
+	maxSize      int64
+	keep         int
+	syncInterval time.Duration
+
+	// OnError is called by the writer when changes can't be written or
+	// have been dropped
+	OnError func(error)
+
+	// mutex guards f, size, unsynced and the counters, and is held while
+	// the queued changes are written so that they keep their order
+	mutex    sync.Mutex
+	f        *os.File
+	size     int64
+	unsynced bool
+	written  uint64
+	rotated  uint64
+	failures uint64
+
+	// queueMutex guards queued and dropped
+	queueMutex sync.Mutex
+	queued     []WALEntry
+	dropped    uint64
+
+	wake chan struct{}
+	done chan struct{}
+	stop sync.Once
+}
+
+// walMaxQueued limits the changes waiting for the writer
+const walMaxQueued = 100000
+
+// OpenBlacklistWAL opens the log at path for appending. It is rotated when it
+// grows beyond maxSize bytes, 0 means never, and keep rotated files are kept.
+// The changes are synced to disk every syncInterval, 0 only syncs before a
+// rotation and on Close.
+func OpenBlacklistWAL(path string, maxSize int64, keep int, syncInterval time.Duration) (*BlacklistWAL, error) {
+	if maxSize < 0 || keep < 0 || syncInterval < 0 {
+		return nil, configErrorf("invalid WAL rotation: size %d, keep %d, sync interval %s", maxSize, keep, syncInterval)
+	}
+
+	w := &BlacklistWAL{
+		path:         path,
+		maxSize:      maxSize,
+		keep:         keep,
+		syncInterval: syncInterval,
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// open opens the log and ends a line torn by a crash, so that the next entry
+// starts on a line of its own
+func (w *BlacklistWAL) open() error {
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f, w.size = f, fi.Size()
+	if w.size == 0 {
+		return nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, w.size-1); err != nil {
+		f.Close()
+		return err
+	}
+	if last[0] != '\n' {
+		n, err := f.Write([]byte{'\n'})
+		w.size += int64(n)
+		w.unsynced = true
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Append writes the change to the log right away, rotating it first if it
+// is full. Changes of the blacklist set with SetWAL are queued instead.
+func (w *BlacklistWAL) Append(ev BlacklistEvent, now time.Time) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.write(WALEntry{Time: now, BlacklistEvent: ev})
+}
+
+// write writes the entry. The caller must hold the mutex.
+func (w *BlacklistWAL) write(entry WALEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if w.f == nil {
+		return fmt.Errorf("%s is closed", w.path)
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			w.failures++
+			return err
+		}
+	}
+
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	w.unsynced = true
+	if err != nil {
+		w.failures++
+		return err
+	}
+	w.written++
+	return nil
+}
+
+// append queues the change for the writer. It is nil-safe, so that the
+// blacklist can call it without a log, and never waits for the disk.
+func (w *BlacklistWAL) append(ev BlacklistEvent) {
+	if w == nil {
+		return
+	}
+
+	w.queueMutex.Lock()
+	if len(w.queued) >= walMaxQueued {
+		w.dropped++
+	} else {
+		w.queued = append(w.queued, WALEntry{Time: time.Now(), BlacklistEvent: ev})
+	}
+	w.queueMutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued changes and syncs the log until the log is closed
+func (w *BlacklistWAL) run() {
+	var tick <-chan time.Time
+	if w.syncInterval > 0 {
+		ticker := time.NewTicker(w.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+			w.flush(false)
+		case <-tick:
+			w.flush(true)
+		}
+	}
+}
+
+// flush writes the queued changes and, with sync, syncs them to disk. Errors
+// are reported to OnError.
+func (w *BlacklistWAL) flush(sync bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.queueMutex.Lock()
+	queued, dropped := w.queued, w.dropped
+	w.queued, w.dropped = nil, 0
+	w.queueMutex.Unlock()
+
+	var errs []error
+	if dropped > 0 {
+		w.failures += dropped
+		errs = append(errs, fmt.Errorf("dropped %d changes, more than %d were waiting to be written", dropped, walMaxQueued))
+	}
+	for _, entry := range queued {
+		if err := w.write(entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if sync && w.unsynced && w.f != nil {
+		if err := w.f.Sync(); err != nil {
+			errs = append(errs, err)
+		} else {
+			w.unsynced = false
+		}
+	}
+
+	for _, err := range errs {
+		if w.OnError != nil {
+			w.OnError(err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Sync writes the queued changes and syncs the log to disk
+func (w *BlacklistWAL) Sync() error {
+	return w.flush(true)
+}
+
+// rotate syncs the log and moves it to .1, the older files one further and
+// drops the oldest. The caller must hold the mutex.
+func (w *BlacklistWAL) rotate() error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+
+	if w.keep == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.keep))
+		for i := w.keep - 1; i > 0; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	w.rotated++
+	w.unsynced = false
+	return w.open()
+}
+
+// Stats returns the number of changes written, rotations and changes that
+// couldn't be written or were dropped
+func (w *BlacklistWAL) Stats() (written, rotated, failures uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.written, w.rotated, w.failures
+}
+
+// Close writes the queued changes, syncs and closes the log. Changes queued
+// afterwards are dropped.
+func (w *BlacklistWAL) Close() error {
+	w.stop.Do(func() { close(w.done) })
+	err := w.flush(true)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.f == nil {
+		return err
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// SetWAL appends every change of the blacklist from now on to the log, nil
+// stops it
+func (bl *Blacklist) SetWAL(w *BlacklistWAL) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.wal = w
+}
+
+// ReplayBlacklistWAL applies the changes in the log at path and its rotated
+// files that happened since the given time, e.g. that of the last snapshot,
+// to the blacklist, oldest first. Entries that have run out in the meantime
+// are skipped. Missing files are ignored, and so are lines that can't be
+// decoded, e.g. one torn by a crash; their number is returned with the
+// number of changes applied.
+func ReplayBlacklistWAL(path string, keep int, since time.Time, bl *Blacklist) (applied, corrupt int, err error) {
+	for i := keep; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return applied, corrupt, err
+		}
+		a, c, err := replayWAL(f, since, bl)
+		f.Close()
+		applied, corrupt = applied+a, corrupt+c
+		if err != nil {
+			return applied, corrupt, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return applied, corrupt, nil
+}
+
+func replayWAL(r io.Reader, since time.Time, bl *Blacklist) (applied, corrupt int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry WALEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.IP == nil {
+			corrupt++
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+
+		switch entry.Type {
+		case BlacklistAdd:
+			bl.Restore(BlacklistEntry{IP: entry.IP, Expires: entry.Expires, Reason: entry.Reason, Severity: entry.Severity})
+		case BlacklistRemove:
+			bl.Remove(entry.IP)
+		default:
+			corrupt++
+			continue
+		}
+		applied++
+	}
+	return applied, corrupt, scanner.Err()
+}
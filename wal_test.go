@@ -0,0 +1,118 @@
+package botdetect
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlacklistWAL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "blacklist.wal")
+	wal, err := OpenBlacklistWAL(path, 300, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	bl.SetReason(net.ParseIP("192.0.2.1"), "before the log")
+	bl.SetWAL(wal)
+
+	snapshot := time.Now()
+	for i := 2; i <= 5; i++ {
+		bl.SetReason(net.IPv4(192, 0, 2, byte(i)), "walk")
+	}
+	bl.Remove(net.ParseIP("192.0.2.1"))
+	bl.Remove(net.ParseIP("192.0.2.2"))
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if written, rotated, failures := wal.Stats(); written != 6 || rotated == 0 || failures != 0 {
+		t.Errorf("expected 6 changes in rotated files, got %d written, %d rotations, %d failures", written, rotated, failures)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected at most 2 rotated files")
+	}
+
+	// a crash tears the last line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2`)
+	f.Close()
+
+	// the restored snapshot still has 192.0.2.1, the log takes it off again
+	restored := NewBlacklist(ctx, time.Hour, time.Hour)
+	restored.Restore(BlacklistEntry{IP: net.ParseIP("192.0.2.1"), Expires: time.Now().Add(time.Hour)})
+	applied, corrupt, err := ReplayBlacklistWAL(path, 2, snapshot, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupt != 1 || applied == 0 {
+		t.Errorf("expected the torn line to be skipped, got %d applied, %d corrupt", applied, corrupt)
+	}
+	for ip, blacklisted := range map[string]bool{"192.0.2.1": false, "192.0.2.2": false, "192.0.2.5": true} {
+		if restored.IsBlacklisted(net.ParseIP(ip)) != blacklisted {
+			t.Errorf("%s: expected blacklisted to be %v after the replay", ip, blacklisted)
+		}
+	}
+
+	// the reopened log continues on a line of its own
+	wal, err = OpenBlacklistWAL(path, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.SetWAL(wal)
+	restored.SetReason(net.ParseIP("198.51.100.1"), "after the crash")
+	wal.Close()
+
+	replayed := NewBlacklist(ctx, time.Hour, time.Hour)
+	if _, corrupt, err := ReplayBlacklistWAL(path, 0, snapshot, replayed); err != nil || corrupt != 1 {
+		t.Errorf("expected only the torn line to be corrupt, got %d, %v", corrupt, err)
+	}
+	if reason, _ := replayed.Reason(net.ParseIP("198.51.100.1")); reason != "after the crash" {
+		t.Errorf("expected the change after the crash to be replayed, got '%s'", reason)
+	}
+}
+
+func TestBlacklistWALStuck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wal, err := OpenBlacklistWAL(filepath.Join(t.TempDir(), "blacklist.wal"), 0, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := NewBlacklist(ctx, time.Hour, time.Hour)
+	bl.SetWAL(wal)
+
+	// a stuck disk holds up the writer, not the blacklist
+	wal.mutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= 10; i++ {
+			bl.SetReason(net.IPv4(192, 0, 2, byte(i)), "walk")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blacklist waited for the log")
+	}
+	wal.mutex.Unlock()
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if written, _, failures := wal.Stats(); written != 10 || failures != 0 {
+		t.Errorf("expected the queued changes to be written on Close, got %d written, %d failures", written, failures)
+	}
+}
@@ -0,0 +1,185 @@
+package botdetect
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WalkPattern selects a number from a URL whose sequential increase is
+// watched: either the value of a query parameter or the first capture group
+// of a regular expression matched against the path
+type WalkPattern struct {
+	Param string
+	Path  *regexp.Regexp
+}
+
+// String returns the pattern in the format understood by ParseWalkPatterns
+func (p WalkPattern) String() string {
+	if p.Path != nil {
+		return p.Path.String()
+	}
+	return p.Param
+}
+
+// value extracts the number from the URL
+func (p WalkPattern) value(u *url.URL) (int64, bool) {
+	var s string
+	if p.Path != nil {
+		m := p.Path.FindStringSubmatch(u.Path)
+		if m == nil {
+			return 0, false
+		}
+		s = m[1]
+	} else {
+		s = u.Query().Get(p.Param)
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// ParseWalkPatterns parses a comma separated list of query parameters and
+// path expressions, which start with '/' or '^' and have one capture group,
+// e.g. "page,offset,^/item/(\d+)"
+func ParseWalkPatterns(s string) ([]WalkPattern, error) {
+	patterns := []WalkPattern{}
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(def, "/") && !strings.HasPrefix(def, "^") {
+			patterns = append(patterns, WalkPattern{Param: def})
+			continue
+		}
+
+		re, err := regexp.Compile(def)
+		if err != nil {
+			return nil, configErrorf("invalid walk pattern '%s': %s", def, err)
+		}
+		if re.NumSubexp() != 1 {
+			return nil, configErrorf("invalid walk pattern '%s': expected exactly one capture group", def)
+		}
+		patterns = append(patterns, WalkPattern{Path: re})
+	}
+
+	return patterns, nil
+}
+
+// WalkDetector detects IPs walking through numbered pages or IDs, e.g.
+// ?page=1, ?page=2, ... or /item/1001, /item/1002, ... A step is a request
+// whose number is larger than the previous one by at most MaxGap; other
+// numbers start over. An IP walks once it made MinSteps steps in a row.
+type WalkDetector struct {
+	patterns []WalkPattern
+	minSteps int
+	maxGap   int64
+
+	walks map[string]*walk
+	mutex sync.Mutex
+}
+
+type walk struct {
+	first int64
+	last  int64
+	steps int
+	seen  time.Time
+}
+
+// NewWalkDetector creates a WalkDetector
+func NewWalkDetector(patterns []WalkPattern, minSteps int, maxGap int64) *WalkDetector {
+	return &WalkDetector{
+		patterns: patterns,
+		minSteps: minSteps,
+		maxGap:   maxGap,
+		walks:    make(map[string]*walk),
+	}
+}
+
+// Clone returns a WalkDetector with the same configuration that doesn't
+// track any walks yet
+func (wd *WalkDetector) Clone() *WalkDetector {
+	if wd == nil {
+		return nil
+	}
+	return NewWalkDetector(wd.patterns, wd.minSteps, wd.maxGap)
+}
+
+// Observe records the request and returns a description of the walk if the
+// IP is walking through one of the patterns
+func (wd *WalkDetector) Observe(ip, rawURL string, now time.Time) (string, bool) {
+	if wd == nil || len(wd.patterns) == 0 {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	for i, p := range wd.patterns {
+		n, ok := p.value(u)
+		if !ok {
+			continue
+		}
+
+		key := ip + " " + strconv.Itoa(i)
+		w, ok := wd.walks[key]
+		if !ok {
+			wd.walks[key] = &walk{first: n, last: n, seen: now}
+			continue
+		}
+		w.seen = now
+
+		switch gap := n - w.last; {
+		case gap == 0:
+			continue
+		case gap > 0 && gap <= wd.maxGap:
+			w.steps++
+		default:
+			w.first, w.steps = n, 0
+		}
+		w.last = n
+
+		if w.steps >= wd.minSteps {
+			return fmt.Sprintf("walked %s from %d to %d in %d steps", p, w.first, w.last, w.steps), true
+		}
+	}
+	return "", false
+}
+
+// Expire forgets the walks not continued since cutoff
+func (wd *WalkDetector) Expire(cutoff time.Time) {
+	if wd == nil {
+		return
+	}
+
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	for key, w := range wd.walks {
+		if w.seen.Before(cutoff) {
+			delete(wd.walks, key)
+		}
+	}
+}
+
+// Size returns the number of walks being tracked
+func (wd *WalkDetector) Size() int {
+	if wd == nil {
+		return 0
+	}
+
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	return len(wd.walks)
+}
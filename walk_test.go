@@ -0,0 +1,98 @@
+package botdetect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseWalkPatterns(t *testing.T) {
+	patterns, err := ParseWalkPatterns(`page, offset, ^/item/(\d+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 3 || patterns[0].Param != "page" || patterns[2].Path == nil || patterns[2].String() != `^/item/(\d+)` {
+		t.Errorf("unexpected patterns %v", patterns)
+	}
+
+	for _, s := range []string{`^/item/\d+`, `/(a)/(\d+)`, `^/item/(\d+`} {
+		if _, err := ParseWalkPatterns(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+}
+
+func TestWalkDetector(t *testing.T) {
+	patterns, _ := ParseWalkPatterns(`page,^/item/(\d+)`)
+	wd := NewWalkDetector(patterns, 3, 1)
+	now := time.Now()
+
+	for _, test := range []struct {
+		url     string
+		walking bool
+	}{
+		{"/list?page=1", false},
+		{"/list?page=2", false},
+		{"/list?page=2", false},
+		{"/list?page=3", false},
+		{"/list?page=4", true},
+		// a jump starts over
+		{"/list?page=10", false},
+		{"/item/5", false},
+		{"/item/6", false},
+		{"/item/7", false},
+		{"/item/8", true},
+	} {
+		if _, walking := wd.Observe("192.0.2.1", test.url, now); walking != test.walking {
+			t.Errorf("%s: expected walking %v", test.url, test.walking)
+		}
+	}
+
+	// other IPs walk separately
+	if _, walking := wd.Observe("192.0.2.2", "/list?page=5", now); walking {
+		t.Error("expected a new IP not to be walking")
+	}
+
+	wd.Expire(now.Add(time.Second))
+	if size := wd.Size(); size != 0 {
+		t.Errorf("expected all walks to expire, %d left", size)
+	}
+}
+
+func TestWalkBlacklist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	patterns, _ := ParseWalkPatterns("page")
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     1000,
+		Walks:           NewWalkDetector(patterns, 5, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		h.RequestChannel() <- &Request{IP: net.ParseIP("192.0.2.1"), URL: fmt.Sprintf("/list?page=%d", i)}
+		h.RequestChannel() <- &Request{IP: net.ParseIP("192.0.2.2"), URL: fmt.Sprintf("/list?page=%d", i*7)}
+	}
+	for h.Processed() < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	h.TriggerCalculate()
+
+	if !h.IsBlacklisted(net.ParseIP("192.0.2.1")) {
+		t.Error("expected the walking IP to be blacklisted")
+	}
+	if h.IsBlacklisted(net.ParseIP("192.0.2.2")) {
+		t.Error("expected the IP jumping between pages not to be blacklisted")
+	}
+}
@@ -0,0 +1,38 @@
+package botdetect
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchFile calls load whenever the modification time of the file changes,
+// starting with the current version, until the context is done. Errors are
+// passed to onError; a failed load is retried on the next change.
+//
+// The file is polled rather than watched for notifications: its
+// modification time is checked every interval, so a change is loaded up to
+// an interval later. A change that keeps the modification time, e.g. a
+// second write within the resolution of the file system's timestamps after
+// the file has been checked, is only picked up with the next change.
+func WatchFile(ctx context.Context, path string, interval time.Duration, load func(path string) error, onError func(error)) {
+	var lastMod time.Time
+
+	for {
+		fi, err := os.Stat(path)
+		if err != nil {
+			onError(err)
+		} else if !fi.ModTime().Equal(lastMod) {
+			lastMod = fi.ModTime()
+			if err := load(path); err != nil {
+				onError(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
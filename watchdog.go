@@ -0,0 +1,184 @@
+package botdetect
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the background loops the watchdog checks
+const (
+	LoopProcess   = "process"
+	LoopCalculate = "calculate"
+	LoopExpire    = "expire"
+)
+
+var watchedLoops = []string{LoopProcess, LoopCalculate, LoopExpire}
+
+// WatchdogOptions make the history check that its background loops keep
+// making progress. A stuck calculate loop silently stops all new blocking,
+// a stuck process loop stops counting. The health checks (Alive and Ready)
+// fail while a loop is stuck either way.
+type WatchdogOptions struct {
+	// Stalls is the number of intervals a loop may go without completing
+	// an iteration before it counts as stuck. The process loop is checked
+	// against Interval while it handles a request.
+	Stalls int
+
+	// Restart starts a new goroutine for a stuck loop, at most once per
+	// Stalls intervals. The stuck goroutine exits as soon as it gets
+	// unstuck. A loop waiting for a lock that is never released can't be
+	// recovered that way, but one waiting for a store or resolver that
+	// ignores its timeout can.
+	Restart bool
+
+	// Interval is the time between two checks
+	Interval time.Duration
+
+	// OnStall is called when a loop gets stuck, with the time since it
+	// last made progress, and when it recovers
+	OnStall func(loop string, stalled bool, age time.Duration)
+}
+
+func (o *WatchdogOptions) validate() []string {
+	problems := []string{}
+	if o.Interval <= 0 {
+		problems = append(problems, "watchdog interval must be greater than zero")
+	}
+	if o.Stalls < 1 {
+		problems = append(problems, "watchdog stalls must be at least 1")
+	}
+	return problems
+}
+
+// loopState is the generation of a background loop and what the watchdog
+// knows about it
+type loopState struct {
+	// generation is incremented for every restart, loops of an older
+	// generation exit
+	generation uint64
+
+	stalled   bool
+	restarted time.Time
+}
+
+type watchdogState struct {
+	loops map[string]*loopState
+	mutex sync.Mutex
+}
+
+func newWatchdogState() watchdogState {
+	loops := make(map[string]*loopState, len(watchedLoops))
+	for _, name := range watchedLoops {
+		loops[name] = &loopState{}
+	}
+	return watchdogState{loops: loops}
+}
+
+// superseded returns whether a loop of generation gen has been replaced by
+// a restart
+func (h *IPHistory) superseded(loop string, gen uint64) bool {
+	return atomic.LoadUint64(&h.watchdog.loops[loop].generation) != gen
+}
+
+// startLoop starts a new goroutine for the loop that replaces any running
+// one
+func (h *IPHistory) startLoop(loop string) {
+	gen := atomic.AddUint64(&h.watchdog.loops[loop].generation, 1)
+	switch loop {
+	case LoopProcess:
+		go h.process(gen)
+	case LoopCalculate:
+		go h.calculate(h.opts().Interval, gen)
+	case LoopExpire:
+		go h.expire(h.opts().ExpireInterval, gen)
+	}
+}
+
+// stallLimit returns how long a loop running every interval may go without
+// progress before it counts as stuck
+func (h *IPHistory) stallLimit(interval time.Duration) time.Duration {
+	if o := h.opts().Watchdog; o != nil {
+		return time.Duration(o.Stalls) * interval
+	}
+	return stallFactor * interval
+}
+
+// loopAge returns the time since the loop last made progress and how long
+// it may take
+func (h *IPHistory) loopAge(loop string) (age, limit time.Duration) {
+	switch loop {
+	case LoopProcess:
+		return h.processBeat.since(), h.stallLimit(h.opts().Interval)
+	case LoopCalculate:
+		return h.calculateBeat.since(), h.stallLimit(h.opts().Interval)
+	default:
+		return h.expireBeat.since(), h.stallLimit(h.opts().ExpireInterval)
+	}
+}
+
+// StalledLoops returns the background loops the watchdog found stuck at its
+// last check
+func (h *IPHistory) StalledLoops() []string {
+	h.watchdog.mutex.Lock()
+	defer h.watchdog.mutex.Unlock()
+
+	stalled := []string{}
+	for _, name := range watchedLoops {
+		if h.watchdog.loops[name].stalled {
+			stalled = append(stalled, name)
+		}
+	}
+	return stalled
+}
+
+// watchdogLoop periodically checks the background loops
+func (h *IPHistory) watchdogLoop(o *WatchdogOptions) {
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.watch(o, now)
+		}
+	}
+}
+
+// watch checks the background loops once and restarts stuck ones if
+// configured
+func (h *IPHistory) watch(o *WatchdogOptions, now time.Time) {
+	for _, name := range watchedLoops {
+		age, limit := h.loopAge(name)
+		stalled := age > limit
+
+		h.watchdog.mutex.Lock()
+		l := h.watchdog.loops[name]
+		changed := l.stalled != stalled
+		l.stalled = stalled
+		restart := stalled && o.Restart && now.Sub(l.restarted) > limit
+		if restart {
+			l.restarted = now
+		}
+		h.watchdog.mutex.Unlock()
+
+		if changed {
+			if stalled {
+				h.loopStalls.Inc(name)
+			}
+			if o.OnStall != nil {
+				o.OnStall(name, stalled, age)
+			}
+		}
+		if restart {
+			if name == LoopProcess {
+				// the new goroutine isn't handling a request yet
+				h.processBeat.clear()
+			}
+			h.loopRestarts.Inc(name)
+			h.startLoop(name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stuckLeader hangs the first time it is asked, like an elector waiting for
+// a store without a timeout
+type stuckLeader struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (l *stuckLeader) IsLeader() bool {
+	if atomic.AddInt32(&l.calls, 1) == 1 {
+		<-l.release
+	}
+	return true
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leader := &stuckLeader{release: make(chan struct{})}
+	defer close(leader.release)
+
+	stalls := make(chan string, 10)
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       10 * time.Millisecond,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    100,
+		Metrics:        NewMetrics(),
+		Leader:         leader,
+		Watchdog: &WatchdogOptions{Stalls: 3, Restart: true, Interval: 5 * time.Millisecond,
+			OnStall: func(loop string, stalled bool, age time.Duration) {
+				if stalled {
+					stalls <- loop
+				}
+			}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case loop := <-stalls:
+		if loop != LoopCalculate {
+			t.Errorf("expected the calculate loop to be stuck, got %s", loop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watchdog to find the calculate loop stuck")
+	}
+
+	// the restarted loop runs while the first one still hangs
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Alive() != nil || len(h.StalledLoops()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the restarted loop to recover, got %v", h.Alive())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := h.loopStalls.Values()[LoopCalculate]; n != 1 {
+		t.Errorf("expected one stall of the calculate loop, got %d", n)
+	}
+	if n := h.loopRestarts.Values()[LoopCalculate]; n != 1 {
+		t.Errorf("expected one restart of the calculate loop, got %d", n)
+	}
+}
+
+func TestWatchdogOptions(t *testing.T) {
+	o := &IPHistoryOptions{
+		TimeSlot:       time.Minute,
+		Window:         time.Hour,
+		Interval:       time.Minute,
+		ExpireInterval: time.Hour,
+		BlacklistTTL:   time.Hour,
+		MaxRequests:    100,
+		Watchdog:       &WatchdogOptions{Interval: time.Minute},
+	}
+	if err := o.Validate(); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error without stalls, got %v", err)
+	}
+
+	o.Watchdog.Stalls = 2
+	h, err := NewIPHistory(context.Background(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.UpdateOptions(func(o *IPHistoryOptions) { o.Watchdog = nil }); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected the watchdog not to be changeable at runtime, got %v", err)
+	}
+
+	// Alive allows the configured number of intervals rather than 3
+	atomic.StoreInt64(&h.calculateBeat.last, time.Now().Add(-150*time.Second).UnixNano())
+	if err := h.Alive(); err == nil {
+		t.Error("expected 2.5 intervals without progress to be too many with stalls 2")
+	}
+}
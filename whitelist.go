@@ -0,0 +1,184 @@
+package botdetect
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Sources of exemptions
+const (
+	ExemptionFalsePositive = "false positive"
+	ExemptionManual        = "manual"
+)
+
+// Exemption keeps an IP from being blacklisted until it expires, e.g. after
+// it has been reported as a false positive. Like a blacklist entry it carries
+// why, by whom and how it was created, so that temporary exemptions can be
+// reviewed before they run out.
+type Exemption struct {
+	IP      net.IP    `json:"ip"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// Reason is the comment given for the exemption, Creator who created
+	// it, e.g. the client of the admin API, and Source how, e.g.
+	// ExemptionFalsePositive
+	Reason  string `json:"reason,omitempty"`
+	Creator string `json:"creator,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+// String describes the exemption
+func (e Exemption) String() string {
+	s := fmt.Sprintf("%s until %s", e.IP, e.Expires.Format(time.RFC3339))
+	if e.Source != "" {
+		s += " (" + e.Source + ")"
+	}
+	return s
+}
+
+// Exempt keeps the IP from being blacklisted for the given duration and takes
+// it off the blacklist. An exemption of the same IP is replaced. It is
+// recorded in the audit trail with the reason. The IP is an error of the kind
+// ErrInvalidIP if it is nil, the duration one of the kind ErrConfig unless it
+// is greater than 0.
+func (h *IPHistory) Exempt(ip net.IP, duration time.Duration, reason, creator, source string) (Exemption, error) {
+	if ip == nil {
+		return Exemption{}, invalidIPErrorf("missing IP")
+	}
+	if duration <= 0 {
+		return Exemption{}, configErrorf("invalid exemption duration %s: expected more than 0", duration)
+	}
+
+	e := h.exemptIP(ip, duration, reason, creator, source)
+	h.blacklist.Remove(ip)
+	h.opts().Audit.Record(ip, AuditEntry{
+		Decision: "exempt",
+		Reason:   exemptionReason(e),
+	})
+	return e, nil
+}
+
+// Unexempt removes the exemption of the IP before it runs out and returns
+// whether there was one
+func (h *IPHistory) Unexempt(ip net.IP, comment string) bool {
+	key := ipKey(ip)
+
+	h.exemptMutex.Lock()
+	e, ok := h.exempt[key]
+	delete(h.exempt, key)
+	h.exemptMutex.Unlock()
+
+	if ok {
+		h.opts().Audit.Record(ip, AuditEntry{
+			Decision: "unexempt",
+			Reason:   fmt.Sprintf("%s: %s", e, comment),
+		})
+	}
+	return ok
+}
+
+// Exemption returns the exemption of the IP and whether it is exempt
+func (h *IPHistory) Exemption(ip net.IP) (Exemption, bool) {
+	h.exemptMutex.RLock()
+	e, ok := h.exempt[ipKey(ip)]
+	h.exemptMutex.RUnlock()
+
+	if !ok || !time.Now().Before(e.Expires) {
+		return Exemption{}, false
+	}
+	return e, true
+}
+
+// Exemptions returns the exemptions that haven't run out, sorted by IP
+func (h *IPHistory) Exemptions() []Exemption {
+	now := time.Now()
+
+	h.exemptMutex.RLock()
+	exemptions := make([]Exemption, 0, len(h.exempt))
+	for _, e := range h.exempt {
+		if now.Before(e.Expires) {
+			exemptions = append(exemptions, e)
+		}
+	}
+	h.exemptMutex.RUnlock()
+
+	sort.Slice(exemptions, func(i, j int) bool {
+		return bytes.Compare(exemptions[i].IP.To16(), exemptions[j].IP.To16()) < 0
+	})
+	return exemptions
+}
+
+// exemptIP adds the exemption without taking the IP off the blacklist
+func (h *IPHistory) exemptIP(ip net.IP, duration time.Duration, reason, creator, source string) Exemption {
+	now := time.Now()
+	e := Exemption{
+		IP:      ip,
+		Created: now,
+		Expires: now.Add(duration),
+		Reason:  reason,
+		Creator: creator,
+		Source:  source,
+	}
+
+	h.exemptMutex.Lock()
+	h.exempt[ipKey(ip)] = e
+	h.exemptMutex.Unlock()
+	return e
+}
+
+// restoreExemption adds an exemption of a saved state unless it has run out
+// or its IP is missing
+func (h *IPHistory) restoreExemption(e Exemption, now time.Time) {
+	if e.IP == nil || !now.Before(e.Expires) {
+		return
+	}
+
+	h.exemptMutex.Lock()
+	h.exempt[ipKey(e.IP)] = e
+	h.exemptMutex.Unlock()
+}
+
+// isExempt determines whether the IP must not be blacklisted right now
+func (h *IPHistory) isExempt(ip string, now time.Time) bool {
+	h.exemptMutex.RLock()
+	e, ok := h.exempt[ip]
+	h.exemptMutex.RUnlock()
+
+	return ok && now.Before(e.Expires)
+}
+
+// expireExemptions removes all exemptions that have run out and records them
+// in the audit trail, so that it shows when an IP could be blacklisted again
+func (h *IPHistory) expireExemptions(audit *AuditLog, now time.Time) {
+	h.exemptMutex.Lock()
+	expired := []Exemption{}
+	for ip, e := range h.exempt {
+		if !now.Before(e.Expires) {
+			expired = append(expired, e)
+			delete(h.exempt, ip)
+		}
+	}
+	h.exemptMutex.Unlock()
+
+	for _, e := range expired {
+		audit.Record(e.IP, AuditEntry{
+			Decision: "exemption expired",
+			Reason:   exemptionReason(e),
+		})
+	}
+}
+
+func exemptionReason(e Exemption) string {
+	reason := e.String()
+	if e.Creator != "" {
+		reason += " by " + e.Creator
+	}
+	if e.Reason != "" {
+		reason += ": " + e.Reason
+	}
+	return reason
+}
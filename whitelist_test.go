@@ -0,0 +1,83 @@
+package botdetect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExempt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := NewIPHistory(ctx, &IPHistoryOptions{
+		TimestampFormat: "15:04",
+		TimeSlot:        time.Minute,
+		Window:          time.Hour,
+		Interval:        time.Hour,
+		ExpireInterval:  time.Hour,
+		BlacklistTTL:    time.Hour,
+		MaxRequests:     5,
+		MaxRatio:        0.5,
+		Audit:           NewAuditLog(10, 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Exempt(nil, time.Hour, "", "", ExemptionManual); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("expected an invalid IP error, got %v", err)
+	}
+	if _, err := h.Exempt(net.ParseIP("192.0.2.1"), 0, "", "", ExemptionManual); !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a configuration error for the duration, got %v", err)
+	}
+
+	exempt, other := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1")
+	h.Block(exempt, "walk")
+	e, err := h.Exempt(exempt, time.Hour, "partner", "ops", ExemptionManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.IsBlacklisted(exempt) {
+		t.Error("expected the exemption to take the IP off the blacklist")
+	}
+	if got, ok := h.Exemption(exempt); !ok || got.Reason != "partner" || got.Creator != "ops" || got.Source != ExemptionManual || !got.Expires.Equal(e.Expires) {
+		t.Errorf("unexpected exemption %+v", got)
+	}
+	if h.Block(exempt, "walk") || !h.Block(other, "walk") {
+		t.Error("expected only the other IP to be blacklisted")
+	}
+
+	h.ReportFalsePositiveBy(other, time.Minute, "complaint", "support")
+	exemptions := h.Exemptions()
+	if len(exemptions) != 2 || !exemptions[0].IP.Equal(exempt) || exemptions[1].Source != ExemptionFalsePositive || exemptions[1].Creator != "support" {
+		t.Errorf("unexpected exemptions %v", exemptions)
+	}
+
+	if !h.Unexempt(exempt, "contract ended") || h.Unexempt(exempt, "") {
+		t.Error("expected the exemption to be removed once")
+	}
+	if !h.Block(exempt, "walk") {
+		t.Error("expected the IP to be blacklisted after its exemption was removed")
+	}
+
+	h.expireExemptions(h.opts().Audit, time.Now().Add(time.Minute))
+	if _, ok := h.Exemption(other); ok || len(h.Exemptions()) != 0 {
+		t.Error("expected the exemption to expire")
+	}
+
+	decisions := []string{}
+	for _, entry := range h.opts().Audit.Entries(exempt) {
+		decisions = append(decisions, entry.Decision)
+	}
+	if strings.Join(decisions, ",") != "blacklisted,exempt,unexempt,blacklisted" {
+		t.Errorf("unexpected audit trail %v", decisions)
+	}
+	if entries := h.opts().Audit.Entries(other); entries[len(entries)-1].Decision != "exemption expired" ||
+		!strings.HasSuffix(entries[len(entries)-1].Reason, "by support: complaint") {
+		t.Errorf("expected the expiry in the audit trail, got %v", entries)
+	}
+}